@@ -0,0 +1 @@
+println 'Hello, World!'
@@ -0,0 +1 @@
+main = putStrLn "Hello, World!"
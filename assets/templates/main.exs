@@ -0,0 +1 @@
+IO.puts("Hello, World!")
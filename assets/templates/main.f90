@@ -0,0 +1,3 @@
+program main
+    print *, "Hello, World!"
+end program main
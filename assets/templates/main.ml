@@ -0,0 +1 @@
+let () = print_endline "Hello, World!"
@@ -0,0 +1,71 @@
+// Compares encoding a compile response the way `axum::Json` does, into a
+// small buffer that grows as it goes, with the pooled, pre-sized encoder the
+// handlers use. Run with `cargo bench --bench json_encoding`.
+
+use std::{
+    hint::black_box,
+    time::{Duration, Instant},
+};
+
+use comphub::handlers::{
+    compile::CompilerResponse,
+    json::{buffer_pool, encode},
+};
+
+const SIZES: &[usize] = &[1 << 10, 64 << 10, 1 << 20, 8 << 20];
+const TARGET: Duration = Duration::from_secs(1);
+
+fn response(size: usize) -> CompilerResponse {
+    let line = "iteration 4096: value=0.318309886 status=ok\n";
+    CompilerResponse {
+        id: Some(String::from("0b7c6f0e-4f7a-4c53-9d38-0c5f6b2d5a1e")),
+        lang: None,
+        result: line.repeat(size / line.len() + 1),
+        result_url: None,
+        result_bytes: None,
+        warnings: None,
+        files: None,
+        images: None,
+        transcript: None,
+        version: None,
+        coverage: None,
+        sanitizer: None,
+        profile: None,
+    }
+}
+
+fn grown(response: &CompilerResponse) -> usize {
+    let mut buf = Vec::with_capacity(128);
+    serde_json::to_writer(&mut buf, response).unwrap();
+    buf.len()
+}
+
+fn pooled(response: &CompilerResponse) -> usize {
+    encode(buffer_pool(), response).unwrap().as_ref().len()
+}
+
+fn measure(name: &str, size: usize, run: impl Fn() -> usize) {
+    let mut iterations = 0u32;
+    let mut bytes = 0;
+    let started = Instant::now();
+    while started.elapsed() < TARGET {
+        bytes += black_box(run());
+        iterations += 1;
+    }
+    let elapsed = started.elapsed();
+    println!(
+        "{:>8} KiB  {:<7} {:>12.1?}/iter  {:>8.1} MiB/s",
+        size >> 10,
+        name,
+        elapsed / iterations,
+        bytes as f64 / elapsed.as_secs_f64() / (1 << 20) as f64
+    );
+}
+
+fn main() {
+    for &size in SIZES {
+        let response = response(size);
+        measure("grown", size, || grown(&response));
+        measure("pooled", size, || pooled(&response));
+    }
+}
@@ -0,0 +1,56 @@
+use std::{
+    env, fs, io,
+    path::{Path, PathBuf},
+};
+
+fn main() -> Result<(), Box<dyn std::error::Error>> {
+    #[cfg(feature = "grpc")]
+    tonic_build::compile_protos("proto/comphub.proto")?;
+    embed_playground()?;
+    Ok(())
+}
+
+// Bundles whatever `web/dist` holds into the binary. Without a built
+// playground the table is empty and the server only serves the API.
+fn embed_playground() -> io::Result<()> {
+    let dist = Path::new("web/dist");
+    // Watching a path that does not exist would rerun this on every build;
+    // building the playground touches `web` itself.
+    let watched = if dist.is_dir() {
+        dist
+    } else {
+        Path::new("web")
+    };
+    println!("cargo:rerun-if-changed={}", watched.display());
+    let mut files = Vec::new();
+    if dist.is_dir() {
+        collect(dist, &mut files)?;
+    }
+    files.sort();
+
+    let mut table = String::from("pub static PLAYGROUND: &[(&str, &[u8])] = &[\n");
+    for file in files {
+        let name = file
+            .strip_prefix(dist)
+            .unwrap()
+            .to_string_lossy()
+            .replace('\\', "/");
+        let path = fs::canonicalize(&file)?;
+        table.push_str(&format!("    ({:?}, include_bytes!({:?})),\n", name, path));
+    }
+    table.push_str("];\n");
+    let out = PathBuf::from(env::var("OUT_DIR").unwrap()).join("playground.rs");
+    fs::write(out, table)
+}
+
+fn collect(dir: &Path, files: &mut Vec<PathBuf>) -> io::Result<()> {
+    for entry in fs::read_dir(dir)? {
+        let path = entry?.path();
+        if path.is_dir() {
+            collect(&path, files)?;
+        } else {
+            files.push(path);
+        }
+    }
+    Ok(())
+}
@@ -25,6 +25,7 @@
             cargoHash = "sha256-cJ1h6RrUhjT0sGgEa0B6OP1luTdFWaz+8LtVyVeDwSs=";
             nativeBuildInputs = with pkgs; [
               pkg-config
+              protobuf
             ];
             buildInputs = with pkgs; [
               openssl
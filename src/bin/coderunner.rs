@@ -0,0 +1,211 @@
+// Runs a local file on a comphub server and streams its output:
+//
+//     coderunner run main.go [--stdin input.txt] [--lang auto]
+//
+// The server is CODERUNNER_URL, http://localhost:5000 by default, and
+// CODERUNNER_API_KEY is sent as its API key when set; `--url` and
+// `--api-key` override both. `--lang auto`, the default, picks the language
+// from the file's extension, and `--stdin -` forwards this process's input.
+//
+// Exits with the program's own status, so it can stand in for running the
+// file locally in scripts. Runs that fail without one, such as a rejected
+// request or a compile error, exit with 1, and bad usage with 2.
+use std::{
+    env,
+    io::{self, Read, Write},
+    path::Path,
+    process::exit,
+};
+
+use comphub::handlers::extract::NDJSON;
+use comphub::infra::language::Language;
+use reqwest::{Client, StatusCode, header};
+use serde_json::{Value, json};
+
+const USAGE: &str =
+    "usage: coderunner run <file> [--stdin <file>] [--lang <lang>] [--url <url>] [--api-key <key>]";
+const DEFAULT_URL: &str = "http://localhost:5000";
+
+struct Options {
+    file: String,
+    stdin: Option<String>,
+    lang: String,
+    url: String,
+    api_key: Option<String>,
+}
+
+fn fail(code: i32, message: &str) -> ! {
+    eprintln!("coderunner: {}", message);
+    exit(code)
+}
+
+fn parse_args(mut args: impl Iterator<Item = String>) -> Options {
+    if args.next().is_none_or(|command| command != "run") {
+        fail(2, USAGE);
+    }
+    let mut options = Options {
+        file: String::new(),
+        stdin: None,
+        lang: String::from("auto"),
+        url: env::var("CODERUNNER_URL").unwrap_or_else(|_| String::from(DEFAULT_URL)),
+        api_key: env::var("CODERUNNER_API_KEY").ok(),
+    };
+    while let Some(arg) = args.next() {
+        let mut value = || {
+            args.next()
+                .unwrap_or_else(|| fail(2, &format!("{} needs a value", arg)))
+        };
+        match arg.as_str() {
+            "--stdin" => options.stdin = Some(value()),
+            "--lang" => options.lang = value(),
+            "--url" => options.url = value(),
+            "--api-key" => options.api_key = Some(value()),
+            _ if arg.starts_with("--") => fail(2, &format!("unknown option {}\n{}", arg, USAGE)),
+            _ if options.file.is_empty() => options.file = arg,
+            _ => fail(2, USAGE),
+        }
+    }
+    if options.file.is_empty() {
+        fail(2, USAGE);
+    }
+    options
+}
+
+fn detect_lang(file: &str) -> String {
+    Path::new(file)
+        .extension()
+        .and_then(|ext| ext.to_str())
+        .and_then(Language::from_extension)
+        .map(|language| language.as_str().to_string())
+        .unwrap_or_else(|| {
+            fail(
+                2,
+                &format!("cannot tell the language of {}, pass --lang", file),
+            )
+        })
+}
+
+fn read_stdin(source: &str) -> io::Result<String> {
+    if source == "-" {
+        let mut input = String::new();
+        io::stdin().read_to_string(&mut input)?;
+        return Ok(input);
+    }
+    std::fs::read_to_string(source)
+}
+
+// Native runs that exit non-zero fail with "... status code: N" in their
+// message.
+fn exit_code(message: &str) -> i32 {
+    message
+        .split_once("status code: ")
+        .and_then(|(_, rest)| {
+            let digits: String = rest.chars().take_while(|c| c.is_ascii_digit()).collect();
+            digits.parse().ok()
+        })
+        .unwrap_or(1)
+}
+
+fn error_message(body: &str) -> String {
+    serde_json::from_str::<Value>(body)
+        .ok()
+        .and_then(|error| error["message"].as_str().map(str::to_string))
+        .unwrap_or_else(|| body.trim().to_string())
+}
+
+// Prints one streamed event, returning the exit status once the run is over.
+fn handle_event(line: &[u8], printed: &mut bool) -> Option<i32> {
+    let event: Value = match serde_json::from_slice(line) {
+        Ok(event) => event,
+        Err(err) => fail(1, &format!("unreadable response from the server: {}", err)),
+    };
+    let data = event["data"].as_str().unwrap_or_default();
+    match (event["event"].as_str(), event["stream"].as_str()) {
+        (Some("output"), Some("stderr")) => {
+            let _ = io::stderr().write_all(data.as_bytes());
+            None
+        }
+        (Some("output"), _) => {
+            *printed = true;
+            let _ = io::stdout().write_all(data.as_bytes());
+            let _ = io::stdout().flush();
+            None
+        }
+        // A replayed response arrives whole, without output events.
+        (Some("result"), _) => {
+            if !*printed {
+                print!("{}", event["result"].as_str().unwrap_or_default());
+            }
+            Some(0)
+        }
+        (Some("error"), _) => {
+            let message = event["message"].as_str().unwrap_or("the run failed");
+            eprintln!("{}", message);
+            Some(exit_code(message))
+        }
+        _ => None,
+    }
+}
+
+async fn run(options: Options) -> Result<i32, String> {
+    let content = std::fs::read_to_string(&options.file)
+        .map_err(|err| format!("cannot read {}: {}", options.file, err))?;
+    let stdin = match &options.stdin {
+        Some(source) => {
+            read_stdin(source).map_err(|err| format!("cannot read {}: {}", source, err))?
+        }
+        None => String::new(),
+    };
+    let lang = match options.lang.as_str() {
+        "auto" => detect_lang(&options.file),
+        lang => lang.to_string(),
+    };
+    let body = json!({ "lang": lang, "content": content, "stdin": stdin });
+
+    let mut request = Client::new()
+        .post(format!(
+            "{}/api/v1/compile",
+            options.url.trim_end_matches('/')
+        ))
+        .header(header::ACCEPT, NDJSON)
+        .header(header::CONTENT_TYPE, "application/json")
+        .body(body.to_string());
+    if let Some(api_key) = &options.api_key {
+        request = request.header("x-api-key", api_key);
+    }
+    let mut response = request
+        .send()
+        .await
+        .map_err(|err| format!("cannot reach {}: {}", options.url, err))?;
+    if response.status() != StatusCode::OK {
+        let body = response.text().await.unwrap_or_default();
+        return Err(error_message(&body));
+    }
+
+    let mut pending = Vec::new();
+    let mut printed = false;
+    while let Some(chunk) = response.chunk().await.map_err(|err| err.to_string())? {
+        pending.extend_from_slice(&chunk);
+        while let Some(end) = pending.iter().position(|&byte| byte == b'\n') {
+            let line: Vec<u8> = pending.drain(..=end).collect();
+            if let Some(code) = handle_event(&line, &mut printed) {
+                return Ok(code);
+            }
+        }
+    }
+    Err(String::from(
+        "the server closed the stream before the run finished",
+    ))
+}
+
+#[tokio::main]
+async fn main() {
+    let options = parse_args(env::args().skip(1));
+    match run(options).await {
+        Ok(code) => {
+            let _ = io::stdout().flush();
+            exit(code)
+        }
+        Err(err) => fail(1, &err),
+    }
+}
@@ -0,0 +1,72 @@
+// Starts a submitted program under a seccomp profile:
+//
+//     comphub-launcher <profile> -- <program> [args...]
+//
+// The filter is installed in this process and survives the exec, so the
+// program is confined from its first instruction. Exits with 126 if the
+// program cannot be started and 127 if it cannot be found, like a shell.
+use std::{
+    env,
+    ffi::{CString, OsString},
+    os::unix::ffi::OsStrExt,
+    path::PathBuf,
+    process::exit,
+    ptr,
+};
+
+use comphub::infra::seccomp::{SyscallProfile, install};
+
+fn fail(code: i32, message: &str) -> ! {
+    eprintln!("comphub-launcher: {}", message);
+    exit(code)
+}
+
+fn to_cstring(value: impl AsRef<std::ffi::OsStr>) -> CString {
+    CString::new(value.as_ref().as_bytes())
+        .unwrap_or_else(|_| fail(126, "argument contains a NUL byte"))
+}
+
+fn main() {
+    let mut args = env::args_os().skip(1);
+    let profile: SyscallProfile = args
+        .next()
+        .and_then(|profile| profile.into_string().ok())
+        .unwrap_or_else(|| {
+            fail(
+                126,
+                "usage: comphub-launcher <profile> -- <program> [args...]",
+            )
+        })
+        .parse()
+        .unwrap_or_else(|err: String| fail(126, &err));
+    if args.next().is_none_or(|separator| separator != "--") {
+        fail(126, "expected -- before the program");
+    }
+    let argv: Vec<OsString> = args.collect();
+    let Some(program) = argv.first() else {
+        fail(126, "no program given");
+    };
+
+    let path = if program.as_bytes().contains(&b'/') {
+        PathBuf::from(program)
+    } else {
+        which::which(program)
+            .unwrap_or_else(|_| fail(127, &format!("{} not found", program.to_string_lossy())))
+    };
+
+    let path = to_cstring(&path);
+    let argv: Vec<CString> = argv.iter().map(to_cstring).collect();
+    let mut argv_ptrs: Vec<_> = argv.iter().map(|arg| arg.as_ptr()).collect();
+    argv_ptrs.push(ptr::null());
+
+    if let Err(err) = install(&profile.denied_numbers(), path.as_ptr()) {
+        fail(126, &format!("failed to install seccomp filter: {}", err));
+    }
+    unsafe {
+        libc::execv(path.as_ptr(), argv_ptrs.as_ptr());
+    }
+    fail(
+        126,
+        &format!("exec failed: {}", std::io::Error::last_os_error()),
+    )
+}
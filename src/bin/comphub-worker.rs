@@ -0,0 +1,51 @@
+// Runs submitted programs for an API node started with JOB_DISPATCH=remote:
+//
+//     WORKER_TOKEN=... DISPATCHER_URL=http://api:5000 comphub-worker
+//
+// The worker serves no API of its own. It registers with the node at
+// DISPATCHER_URL, pulls queued jobs, JOB_WORKERS at a time, and reports
+// each result back. Its sandbox, plugins and toolchain versions are
+// configured like the API node's.
+use std::process::exit;
+
+use comphub::config::config;
+use comphub::handlers::recover::log_panics;
+use comphub::infra::calibration::calibration;
+use comphub::infra::disk::watch_execution_zone;
+use comphub::infra::dispatch::run_worker;
+use comphub::infra::plugin::load_plugins;
+use comphub::infra::reload::reload_on_hangup;
+use comphub::infra::sandbox::init_sandbox;
+use comphub::infra::warm::start_warm_pool;
+use comphub::utils::init_tracing;
+
+#[tokio::main]
+async fn main() {
+    init_tracing();
+    log_panics();
+    let app_config = config().await;
+
+    let Some(token) = app_config.worker_token() else {
+        eprintln!("comphub-worker: WORKER_TOKEN is not set");
+        exit(2)
+    };
+
+    tokio::spawn(watch_execution_zone(
+        app_config.disk_high_watermark(),
+        app_config.disk_gc_max_age(),
+        app_config.disk_check_interval(),
+    ));
+
+    init_sandbox(app_config.sandbox_users());
+    load_plugins(app_config.plugins_dir()).await;
+    tokio::spawn(reload_on_hangup());
+    calibration().await;
+    start_warm_pool(app_config.warm_pool_sizes()).await;
+
+    tracing::info!("worker dispatching from {}", app_config.dispatcher_url());
+    if let Err(err) = run_worker(app_config.dispatcher_url(), token, app_config.job_workers()).await
+    {
+        eprintln!("comphub-worker: {}", err);
+        exit(1)
+    }
+}
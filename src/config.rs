@@ -1,16 +1,195 @@
 use dotenvy::dotenv;
-use std::{env};
+use std::{
+    env, fs,
+    path::{Path, PathBuf},
+    time::Duration,
+};
 use tokio::sync::OnceCell;
 
+use crate::infra::{
+    archive::ArchiveLimits,
+    build_cache::{CacheAddress, S3Credentials},
+    arch::ToolchainDirs,
+    canary::CanaryVersions,
+    cpuset::{CoreList, CpuPinning},
+    chaos::ChaosLimits,
+    dispatch::JobDispatch,
+    events::EventSinks,
+    fsview::FilesystemView,
+    hooks::SourceHooks,
+    go::GoModules,
+    javascript::NodePackages,
+    load::LoadLimits,
+    locale::AllowList,
+    lua::LuaEngine,
+    matrix::ToolchainVersions,
+    python::PythonPackages,
+    quickjs::JsEngine,
+    sandbox::SandboxUsers,
+    seccomp::SeccompConfig,
+    signing::SigningKeys,
+    store::StoreBackend,
+    throttle::ThrottleLimits,
+    warm::WarmPoolSizes,
+};
+
 #[derive(Debug)]
 struct ServerConfig {
     host: String,
     port: u16,
+    grpc_port: u16,
+    tls_cert_file: Option<PathBuf>,
+    tls_key_file: Option<PathBuf>,
+    read_timeout: Duration,
+    write_timeout: Duration,
+    idle_timeout: Duration,
+    node_url: Option<String>,
+    swagger_ui_assets: String,
+}
+
+#[derive(Debug)]
+struct ExecConfig {
+    timeout: Duration,
+    chaos: Option<ChaosLimits>,
+    plugins_dir: PathBuf,
+    interactors_dir: PathBuf,
+    checkers_dir: PathBuf,
+    source_hooks_dir: PathBuf,
+    source_hooks: SourceHooks,
+    toolchain_versions: ToolchainVersions,
+    toolchain_dirs: ToolchainDirs,
+    canary_versions: CanaryVersions,
+    canary_rate: f64,
+    sandbox_users: Option<SandboxUsers>,
+    cpu_pinning: Option<CpuPinning>,
+    calibrate: bool,
+    calibration_reference: Option<Duration>,
+    crash_backtraces: bool,
+    seccomp: Option<SeccompConfig>,
+    filesystem_view: Option<FilesystemView>,
+    disk_quota: Option<u64>,
+    warm_pool: WarmPoolSizes,
+    snippet_max_bytes: usize,
+    session_ttl: Duration,
+    session_max: usize,
+    judge_max_tests: usize,
+    judge_parallelism: usize,
+    judge_tle_attempts: usize,
+    judge_webhook_url: Option<String>,
+    judge_webhook_secret: Option<String>,
+    judge_webhook_attempts: usize,
+    js_engine: JsEngine,
+    js_memory_bytes: usize,
+    lua_engine: LuaEngine,
+    lua_memory_bytes: usize,
+    lua_max_instructions: Option<u64>,
+    bash_enabled: bool,
+    go_modules: GoModules,
+    go_module_cache: Option<PathBuf>,
+    python_packages: PythonPackages,
+    python_venv: Option<PathBuf>,
+    python_wheels: Option<PathBuf>,
+    node_packages: NodePackages,
+    node_modules_dir: Option<PathBuf>,
+    languages_file: Option<PathBuf>,
+    locales: AllowList,
+    timezones: AllowList,
+}
+
+#[derive(Debug)]
+struct JobConfig {
+    workers: usize,
+    retention: Duration,
+    max_delay: Duration,
+    group_max_jobs: usize,
+    dispatch: JobDispatch,
+    worker_token: Option<String>,
+    worker_timeout: Duration,
+    dispatcher_url: String,
+    node_name: String,
+}
+
+#[derive(Debug)]
+struct StoreConfig {
+    backend: StoreBackend,
+    path: PathBuf,
+    url: String,
+    result_ttl: Duration,
+    snippet_ttl: Duration,
+    submission_ttl: Duration,
+    idempotency_ttl: Duration,
+    blob_dir: PathBuf,
+    blob_max_bytes: u64,
+    blob_max_file_bytes: usize,
+    build_cache: Option<CacheAddress>,
+    build_cache_ttl: Duration,
+    s3_credentials: Option<S3Credentials>,
+    sweep_interval: Duration,
+}
+
+#[derive(Debug)]
+struct RequestConfig {
+    max_body_bytes: usize,
+    max_code_bytes: usize,
+    max_stdin_bytes: usize,
+    max_image_bytes: u64,
+    max_files: usize,
+    max_file_bytes: u64,
+    signing_keys: SigningKeys,
+    signature_window: Duration,
+    tiers_file: Option<PathBuf>,
+    policy_file: Option<PathBuf>,
+    import_policy_file: Option<PathBuf>,
+    admin_token: Option<String>,
+}
+
+#[derive(Debug)]
+struct UploadConfig {
+    max_bytes: usize,
+    stream_max_bytes: u64,
+    archive_limits: ArchiveLimits,
+}
+
+#[derive(Debug)]
+struct ThrottleConfig {
+    limits: ThrottleLimits,
+    trust_forwarded_for: bool,
+    forwarded_hops: usize,
+    load_limits: LoadLimits,
+}
+
+#[derive(Debug)]
+struct RunLogConfig {
+    capacity: usize,
+    max_output_bytes: usize,
+    persist: bool,
+    event_sinks: EventSinks,
+    usage_export_file: Option<PathBuf>,
+    usage_export_interval: Duration,
+    audit_log_file: Option<PathBuf>,
+}
+
+#[derive(Debug)]
+struct DiskConfig {
+    zone_dir: PathBuf,
+    zone_tmpfs_bytes: Option<u64>,
+    high_watermark: f64,
+    check_interval: Duration,
+    gc_max_age: Duration,
+    artifact_ttl: Duration,
 }
 
 #[derive(Debug)]
 pub struct Config {
     server: ServerConfig,
+    disk: DiskConfig,
+    exec: ExecConfig,
+    jobs: JobConfig,
+    store: StoreConfig,
+    request: RequestConfig,
+    upload: UploadConfig,
+    throttle: ThrottleConfig,
+    run_logs: RunLogConfig,
 }
 
 impl Config {
@@ -21,6 +200,474 @@ impl Config {
     pub fn server_port(&self) -> u16 {
         self.server.port
     }
+
+    pub fn grpc_port(&self) -> u16 {
+        self.server.grpc_port
+    }
+
+    // The certificate chain and private key to serve HTTPS with, if set.
+    pub fn tls_files(&self) -> Option<(&Path, &Path)> {
+        self.server
+            .tls_cert_file
+            .as_deref()
+            .zip(self.server.tls_key_file.as_deref())
+    }
+
+    pub fn http_read_timeout(&self) -> Duration {
+        self.server.read_timeout
+    }
+
+    pub fn http_write_timeout(&self) -> Duration {
+        self.server.write_timeout
+    }
+
+    pub fn http_idle_timeout(&self) -> Duration {
+        self.server.idle_timeout
+    }
+
+    // Where other nodes reach this one, if it runs alongside others.
+    pub fn node_url(&self) -> Option<&str> {
+        self.server.node_url.as_deref()
+    }
+
+    // Where the API docs page loads Swagger UI's script and stylesheet from.
+    pub fn swagger_ui_assets(&self) -> &str {
+        &self.server.swagger_ui_assets
+    }
+
+    pub fn exec_timeout(&self) -> Duration {
+        self.exec.timeout
+    }
+
+    pub fn chaos_limits(&self) -> Option<ChaosLimits> {
+        self.exec.chaos
+    }
+
+    pub fn plugins_dir(&self) -> &Path {
+        &self.exec.plugins_dir
+    }
+
+    pub fn interactors_dir(&self) -> &Path {
+        &self.exec.interactors_dir
+    }
+
+    pub fn checkers_dir(&self) -> &Path {
+        &self.exec.checkers_dir
+    }
+
+    pub fn source_hooks_dir(&self) -> &Path {
+        &self.exec.source_hooks_dir
+    }
+
+    pub fn source_hooks(&self) -> &SourceHooks {
+        &self.exec.source_hooks
+    }
+
+    pub fn toolchain_versions(&self) -> &ToolchainVersions {
+        &self.exec.toolchain_versions
+    }
+
+    pub fn toolchain_dirs(&self) -> &ToolchainDirs {
+        &self.exec.toolchain_dirs
+    }
+
+    pub fn canary_versions(&self) -> &CanaryVersions {
+        &self.exec.canary_versions
+    }
+
+    pub fn canary_rate(&self) -> f64 {
+        self.exec.canary_rate
+    }
+
+    pub fn sandbox_users(&self) -> Option<SandboxUsers> {
+        self.exec.sandbox_users
+    }
+
+    pub fn cpu_pinning(&self) -> Option<&CpuPinning> {
+        self.exec.cpu_pinning.as_ref()
+    }
+
+    pub fn calibrate(&self) -> bool {
+        self.exec.calibrate
+    }
+
+    pub fn calibration_reference(&self) -> Option<Duration> {
+        self.exec.calibration_reference
+    }
+
+    // Native programs run under gdb so a crash reports a backtrace.
+    pub fn crash_backtraces(&self) -> bool {
+        self.exec.crash_backtraces
+    }
+
+    pub fn seccomp(&self) -> Option<&SeccompConfig> {
+        self.exec.seccomp.as_ref()
+    }
+
+    pub fn filesystem_view(&self) -> Option<&FilesystemView> {
+        self.exec.filesystem_view.as_ref()
+    }
+
+    pub fn disk_quota(&self) -> Option<u64> {
+        self.exec.disk_quota
+    }
+
+    pub fn warm_pool_sizes(&self) -> &WarmPoolSizes {
+        &self.exec.warm_pool
+    }
+
+    // Programs up to this size are piped to their interpreter rather than
+    // written to disk; 0 turns this off.
+    pub fn snippet_max_bytes(&self) -> usize {
+        self.exec.snippet_max_bytes
+    }
+
+    pub fn session_ttl(&self) -> Duration {
+        self.exec.session_ttl
+    }
+
+    pub fn session_max(&self) -> usize {
+        self.exec.session_max
+    }
+
+    pub fn judge_max_tests(&self) -> usize {
+        self.exec.judge_max_tests
+    }
+
+    pub fn judge_parallelism(&self) -> usize {
+        self.exec.judge_parallelism
+    }
+
+    pub fn judge_tle_attempts(&self) -> usize {
+        self.exec.judge_tle_attempts
+    }
+
+    // Where judge verdicts are posted as they come, and the secret they are
+    // signed with.
+    pub fn judge_webhook(&self) -> Option<(&str, &str)> {
+        self.exec
+            .judge_webhook_url
+            .as_deref()
+            .zip(self.exec.judge_webhook_secret.as_deref())
+    }
+
+    pub fn judge_webhook_attempts(&self) -> usize {
+        self.exec.judge_webhook_attempts
+    }
+
+    pub fn js_engine(&self) -> JsEngine {
+        self.exec.js_engine
+    }
+
+    pub fn js_memory_bytes(&self) -> usize {
+        self.exec.js_memory_bytes
+    }
+
+    pub fn lua_engine(&self) -> LuaEngine {
+        self.exec.lua_engine
+    }
+
+    pub fn lua_memory_bytes(&self) -> usize {
+        self.exec.lua_memory_bytes
+    }
+
+    // None when embedded Lua programs are limited by time alone.
+    pub fn lua_max_instructions(&self) -> Option<u64> {
+        self.exec.lua_max_instructions
+    }
+
+    pub fn bash_enabled(&self) -> bool {
+        self.exec.bash_enabled
+    }
+
+    pub fn go_modules(&self) -> &GoModules {
+        &self.exec.go_modules
+    }
+
+    pub fn go_module_cache(&self) -> Option<&Path> {
+        self.exec.go_module_cache.as_deref()
+    }
+
+    pub fn python_packages(&self) -> &PythonPackages {
+        &self.exec.python_packages
+    }
+
+    pub fn python_venv(&self) -> Option<&Path> {
+        self.exec.python_venv.as_deref()
+    }
+
+    pub fn python_wheels(&self) -> Option<&Path> {
+        self.exec.python_wheels.as_deref()
+    }
+
+    pub fn node_packages(&self) -> &NodePackages {
+        &self.exec.node_packages
+    }
+
+    pub fn node_modules_dir(&self) -> Option<&Path> {
+        self.exec.node_modules_dir.as_deref()
+    }
+
+    pub fn languages_file(&self) -> Option<&Path> {
+        self.exec.languages_file.as_deref()
+    }
+
+    // Locales and timezones a request may run its program under.
+    pub fn allowed_locales(&self) -> &AllowList {
+        &self.exec.locales
+    }
+
+    pub fn allowed_timezones(&self) -> &AllowList {
+        &self.exec.timezones
+    }
+
+    pub fn job_workers(&self) -> usize {
+        self.jobs.workers
+    }
+
+    pub fn job_retention(&self) -> Duration {
+        self.jobs.retention
+    }
+
+    // How far ahead a job may be scheduled.
+    pub fn job_max_delay(&self) -> Duration {
+        self.jobs.max_delay
+    }
+
+    // Jobs a single job group may hold.
+    pub fn job_group_max_jobs(&self) -> usize {
+        self.jobs.group_max_jobs
+    }
+
+    pub fn job_dispatch(&self) -> JobDispatch {
+        self.jobs.dispatch
+    }
+
+    // Shared by the API node and its remote workers; the worker endpoints
+    // refuse every request while it is unset.
+    pub fn worker_token(&self) -> Option<&str> {
+        self.jobs.worker_token.as_deref()
+    }
+
+    pub fn worker_timeout(&self) -> Duration {
+        self.jobs.worker_timeout
+    }
+
+    pub fn dispatcher_url(&self) -> &str {
+        &self.jobs.dispatcher_url
+    }
+
+    // Tells apart API nodes sharing a store, which each keep their own
+    // unfinished jobs in it; it has to stay the same across restarts.
+    pub fn node_name(&self) -> &str {
+        &self.jobs.node_name
+    }
+
+    pub fn store_backend(&self) -> StoreBackend {
+        self.store.backend
+    }
+
+    pub fn store_path(&self) -> &Path {
+        &self.store.path
+    }
+
+    pub fn store_url(&self) -> &str {
+        &self.store.url
+    }
+
+    pub fn result_cache_ttl(&self) -> Duration {
+        self.store.result_ttl
+    }
+
+    // Where replicas share compiled builds, if anywhere.
+    pub fn build_cache(&self) -> Option<&CacheAddress> {
+        self.store.build_cache.as_ref()
+    }
+
+    pub fn build_cache_ttl(&self) -> Duration {
+        self.store.build_cache_ttl
+    }
+
+    // How often expired entries are dropped from the store.
+    pub fn store_sweep_interval(&self) -> Duration {
+        self.store.sweep_interval
+    }
+
+    pub fn s3_credentials(&self) -> Option<&S3Credentials> {
+        self.store.s3_credentials.as_ref()
+    }
+
+    // Zero keeps snippets indefinitely.
+    pub fn snippet_retention(&self) -> Duration {
+        self.store.snippet_ttl
+    }
+
+    // How long judged submissions are kept for regrading. Zero keeps them
+    // indefinitely.
+    pub fn submission_retention(&self) -> Duration {
+        self.store.submission_ttl
+    }
+
+    // Where uploaded test data is kept, how much of it before the least
+    // recently used is evicted, and how large one upload may be.
+    pub fn blob_dir(&self) -> &Path {
+        &self.store.blob_dir
+    }
+
+    pub fn blob_max_bytes(&self) -> u64 {
+        self.store.blob_max_bytes
+    }
+
+    pub fn blob_max_file_bytes(&self) -> usize {
+        self.store.blob_max_file_bytes
+    }
+
+    // How long a compile response is replayed to retries sent with the
+    // same idempotency key; zero ignores the header.
+    pub fn idempotency_ttl(&self) -> Duration {
+        self.store.idempotency_ttl
+    }
+
+    pub fn request_max_bytes(&self) -> usize {
+        self.request.max_body_bytes
+    }
+
+    pub fn code_max_bytes(&self) -> usize {
+        self.request.max_code_bytes
+    }
+
+    pub fn stdin_max_bytes(&self) -> usize {
+        self.request.max_stdin_bytes
+    }
+
+    pub fn image_max_bytes(&self) -> u64 {
+        self.request.max_image_bytes
+    }
+
+    // How many written files, and how many bytes of them in all, a response
+    // returns the contents of.
+    pub fn file_max_count(&self) -> usize {
+        self.request.max_files
+    }
+
+    pub fn file_max_bytes(&self) -> u64 {
+        self.request.max_file_bytes
+    }
+
+    pub fn signing_keys(&self) -> &SigningKeys {
+        &self.request.signing_keys
+    }
+
+    pub fn tiers_file(&self) -> Option<&Path> {
+        self.request.tiers_file.as_deref()
+    }
+
+    // Rules refusing or flagging submissions, added to the built-in ones.
+    pub fn policy_file(&self) -> Option<&Path> {
+        self.request.policy_file.as_deref()
+    }
+
+    // Modules and headers each language may or may not import.
+    pub fn import_policy_file(&self) -> Option<&Path> {
+        self.request.import_policy_file.as_deref()
+    }
+
+    pub fn admin_token(&self) -> Option<&str> {
+        self.request.admin_token.as_deref()
+    }
+
+    pub fn signature_window(&self) -> Duration {
+        self.request.signature_window
+    }
+
+    pub fn upload_max_bytes(&self) -> usize {
+        self.upload.max_bytes
+    }
+
+    // Stdin piped into a program as it is uploaded is never held whole, so
+    // it may be much larger than other uploads.
+    pub fn stdin_stream_max_bytes(&self) -> u64 {
+        self.upload.stream_max_bytes
+    }
+
+    pub fn archive_limits(&self) -> ArchiveLimits {
+        self.upload.archive_limits
+    }
+
+    pub fn throttle_limits(&self) -> ThrottleLimits {
+        self.throttle.limits
+    }
+
+    pub fn trust_forwarded_for(&self) -> bool {
+        self.throttle.trust_forwarded_for
+    }
+
+    // How many proxies in front of the server append to X-Forwarded-For.
+    pub fn forwarded_hops(&self) -> usize {
+        self.throttle.forwarded_hops
+    }
+
+    pub fn load_limits(&self) -> LoadLimits {
+        self.throttle.load_limits
+    }
+
+    pub fn run_log_capacity(&self) -> usize {
+        self.run_logs.capacity
+    }
+
+    pub fn run_log_max_output(&self) -> usize {
+        self.run_logs.max_output_bytes
+    }
+
+    pub fn run_log_persist(&self) -> bool {
+        self.run_logs.persist
+    }
+
+    pub fn event_sinks(&self) -> &EventSinks {
+        &self.run_logs.event_sinks
+    }
+
+    // Where per-tenant usage is appended for billing, if anywhere.
+    pub fn usage_export_file(&self) -> Option<&Path> {
+        self.run_logs.usage_export_file.as_deref()
+    }
+
+    pub fn usage_export_interval(&self) -> Duration {
+        self.run_logs.usage_export_interval
+    }
+
+    // Where every run is appended for auditing, if anywhere.
+    pub fn audit_log_file(&self) -> Option<&Path> {
+        self.run_logs.audit_log_file.as_deref()
+    }
+
+    // Where programs are built and run.
+    pub fn execution_zone_dir(&self) -> &Path {
+        &self.disk.zone_dir
+    }
+
+    // The size of the tmpfs mounted at the execution zone, if it is kept in
+    // memory rather than on disk.
+    pub fn execution_zone_tmpfs_bytes(&self) -> Option<u64> {
+        self.disk.zone_tmpfs_bytes
+    }
+
+    pub fn disk_high_watermark(&self) -> f64 {
+        self.disk.high_watermark
+    }
+
+    pub fn disk_check_interval(&self) -> Duration {
+        self.disk.check_interval
+    }
+
+    pub fn disk_gc_max_age(&self) -> Duration {
+        self.disk.gc_max_age
+    }
+
+    // How long a kept build stays downloadable; zero refuses to keep any.
+    pub fn artifact_ttl(&self) -> Duration {
+        self.disk.artifact_ttl
+    }
 }
 
 pub static CONFIG: OnceCell<Config> = OnceCell::const_new();
@@ -34,11 +681,646 @@ async fn init_config() -> Config {
             .unwrap_or_else(|_| String::from("5000"))
             .parse::<u16>()
             .unwrap(),
+        grpc_port: env::var("GRPC_PORT")
+            .unwrap_or_else(|_| String::from("50051"))
+            .parse::<u16>()
+            .unwrap(),
+        tls_cert_file: env::var("TLS_CERT_FILE")
+            .ok()
+            .filter(|path| !path.is_empty())
+            .map(PathBuf::from),
+        tls_key_file: env::var("TLS_KEY_FILE")
+            .ok()
+            .filter(|path| !path.is_empty())
+            .map(PathBuf::from),
+        read_timeout: Duration::from_secs(
+            env::var("HTTP_READ_TIMEOUT_SECS")
+                .unwrap_or_else(|_| String::from("30"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        write_timeout: Duration::from_secs(
+            env::var("HTTP_WRITE_TIMEOUT_SECS")
+                .unwrap_or_else(|_| String::from("300"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        idle_timeout: Duration::from_secs(
+            env::var("HTTP_IDLE_TIMEOUT_SECS")
+                .unwrap_or_else(|_| String::from("120"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        node_url: env::var("NODE_URL")
+            .ok()
+            .map(|url| url.trim_end_matches('/').to_string())
+            .filter(|url| !url.is_empty()),
+        swagger_ui_assets: env::var("SWAGGER_UI_ASSETS")
+            .unwrap_or_else(|_| String::from("https://unpkg.com/swagger-ui-dist@5"))
+            .trim_end_matches('/')
+            .to_string(),
     };
+    assert_eq!(
+        server_config.tls_cert_file.is_some(),
+        server_config.tls_key_file.is_some(),
+        "TLS_CERT_FILE and TLS_KEY_FILE must be set together"
+    );
+
+    let zone_dir = env::var("EXECUTION_ZONE_DIR")
+        .ok()
+        .filter(|path| !path.is_empty())
+        .map_or_else(|| env::temp_dir().join("comphub"), PathBuf::from);
 
+    let exec_config = ExecConfig {
+        timeout: Duration::from_secs(
+            env::var("EXEC_TIMEOUT_SECS")
+                .unwrap_or_else(|_| String::from("30"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        chaos: env::var("CHAOS_MODE")
+            .unwrap_or_else(|_| String::from("false"))
+            .parse::<bool>()
+            .unwrap()
+            .then(|| ChaosLimits {
+                failure_rate: env::var("CHAOS_FAILURE_RATE")
+                    .unwrap_or_else(|_| String::from("0.1"))
+                    .parse::<f64>()
+                    .unwrap(),
+                slow_rate: env::var("CHAOS_SLOW_RATE")
+                    .unwrap_or_else(|_| String::from("0.1"))
+                    .parse::<f64>()
+                    .unwrap(),
+                max_delay: Duration::from_millis(
+                    env::var("CHAOS_MAX_DELAY_MS")
+                        .unwrap_or_else(|_| String::from("5000"))
+                        .parse::<u64>()
+                        .unwrap(),
+                ),
+                partial_rate: env::var("CHAOS_PARTIAL_RATE")
+                    .unwrap_or_else(|_| String::from("0.1"))
+                    .parse::<f64>()
+                    .unwrap(),
+            }),
+        plugins_dir: PathBuf::from(
+            env::var("PLUGINS_DIR").unwrap_or_else(|_| String::from("plugins")),
+        ),
+        interactors_dir: PathBuf::from(
+            env::var("INTERACTORS_DIR").unwrap_or_else(|_| String::from("interactors")),
+        ),
+        checkers_dir: PathBuf::from(
+            env::var("CHECKERS_DIR").unwrap_or_else(|_| String::from("checkers")),
+        ),
+        source_hooks_dir: PathBuf::from(
+            env::var("SOURCE_HOOKS_DIR").unwrap_or_else(|_| String::from("hooks")),
+        ),
+        source_hooks: env::var("SOURCE_HOOKS")
+            .unwrap_or_default()
+            .parse::<SourceHooks>()
+            .unwrap(),
+        toolchain_versions: env::var("TOOLCHAIN_VERSIONS")
+            .unwrap_or_default()
+            .parse::<ToolchainVersions>()
+            .unwrap(),
+        toolchain_dirs: env::var("TOOLCHAIN_DIRS")
+            .unwrap_or_default()
+            .parse::<ToolchainDirs>()
+            .unwrap(),
+        canary_versions: env::var("CANARY_VERSIONS")
+            .unwrap_or_default()
+            .parse::<CanaryVersions>()
+            .unwrap(),
+        canary_rate: env::var("CANARY_PERCENT")
+            .unwrap_or_else(|_| String::from("0"))
+            .parse::<f64>()
+            .unwrap()
+            .clamp(0.0, 100.0)
+            / 100.0,
+        sandbox_users: env::var("SANDBOX_USER")
+            .ok()
+            .filter(|users| !users.is_empty())
+            .map(|users| users.parse::<SandboxUsers>().unwrap()),
+        cpu_pinning: env::var("CPU_PIN_CORES")
+            .ok()
+            .map(|cores| cores.parse::<CoreList>().unwrap())
+            .filter(|cores| !cores.0.is_empty())
+            .map(|cores| CpuPinning {
+                cores,
+                per_run: env::var("CPU_PIN_PER_RUN")
+                    .unwrap_or_else(|_| String::from("1"))
+                    .parse::<usize>()
+                    .unwrap(),
+            }),
+        calibrate: env::var("CALIBRATE")
+            .unwrap_or_else(|_| String::from("false"))
+            .parse::<bool>()
+            .unwrap(),
+        calibration_reference: env::var("CALIBRATION_REFERENCE_MS")
+            .ok()
+            .map(|ms| Duration::from_millis(ms.parse::<u64>().unwrap())),
+        crash_backtraces: env::var("CRASH_BACKTRACES")
+            .unwrap_or_else(|_| String::from("false"))
+            .parse::<bool>()
+            .unwrap(),
+        seccomp: env::var("SECCOMP_ENABLED")
+            .unwrap_or_else(|_| String::from("false"))
+            .parse::<bool>()
+            .unwrap()
+            .then(|| {
+                let launcher = env::var("SECCOMP_LAUNCHER")
+                    .map(PathBuf::from)
+                    .unwrap_or_else(|_| {
+                        env::current_exe()
+                            .unwrap()
+                            .with_file_name("comphub-launcher")
+                    });
+                SeccompConfig::new(launcher, &env::var("SECCOMP_PROFILES").unwrap_or_default())
+                    .unwrap()
+            }),
+        filesystem_view: env::var("READONLY_ROOT_ENABLED")
+            .unwrap_or_else(|_| String::from("false"))
+            .parse::<bool>()
+            .unwrap()
+            .then(|| {
+                FilesystemView::new(&zone_dir, &env::var("HIDDEN_PATHS").unwrap_or_default())
+                    .unwrap()
+            }),
+        disk_quota: Some(
+            env::var("DISK_QUOTA_BYTES")
+                .unwrap_or_else(|_| String::from("134217728"))
+                .parse::<u64>()
+                .unwrap(),
+        )
+        .filter(|bytes| *bytes > 0),
+        warm_pool: env::var("WARM_POOL")
+            .unwrap_or_default()
+            .parse::<WarmPoolSizes>()
+            .unwrap(),
+        snippet_max_bytes: env::var("SNIPPET_MAX_BYTES")
+            .unwrap_or_else(|_| String::from("4096"))
+            .parse::<usize>()
+            .unwrap(),
+        session_ttl: Duration::from_secs(
+            env::var("SESSION_TTL_SECS")
+                .unwrap_or_else(|_| String::from("900"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        session_max: env::var("SESSION_MAX")
+            .unwrap_or_else(|_| String::from("16"))
+            .parse::<usize>()
+            .unwrap(),
+        judge_max_tests: env::var("JUDGE_MAX_TESTS")
+            .unwrap_or_else(|_| String::from("64"))
+            .parse::<usize>()
+            .unwrap(),
+        judge_parallelism: env::var("JUDGE_PARALLELISM")
+            .ok()
+            .map(|parallelism| parallelism.parse::<usize>().unwrap())
+            .unwrap_or_else(|| {
+                std::thread::available_parallelism()
+                    .map(|n| n.get())
+                    .unwrap_or(1)
+            })
+            .max(1),
+        judge_tle_attempts: env::var("JUDGE_TLE_ATTEMPTS")
+            .unwrap_or_else(|_| String::from("3"))
+            .parse::<usize>()
+            .unwrap()
+            .max(1),
+        judge_webhook_url: env::var("JUDGE_WEBHOOK_URL")
+            .ok()
+            .filter(|url| !url.is_empty()),
+        judge_webhook_secret: env::var("JUDGE_WEBHOOK_SECRET")
+            .ok()
+            .filter(|secret| !secret.is_empty()),
+        judge_webhook_attempts: env::var("JUDGE_WEBHOOK_ATTEMPTS")
+            .unwrap_or_else(|_| String::from("5"))
+            .parse::<usize>()
+            .unwrap()
+            .max(1),
+        js_engine: env::var("JS_ENGINE")
+            .unwrap_or_else(|_| String::from("bun"))
+            .parse::<JsEngine>()
+            .unwrap(),
+        js_memory_bytes: env::var("JS_MEMORY_BYTES")
+            .unwrap_or_else(|_| String::from("67108864"))
+            .parse::<usize>()
+            .unwrap(),
+        lua_engine: env::var("LUA_ENGINE")
+            .unwrap_or_else(|_| String::from("external"))
+            .parse::<LuaEngine>()
+            .unwrap(),
+        lua_memory_bytes: env::var("LUA_MEMORY_BYTES")
+            .unwrap_or_else(|_| String::from("67108864"))
+            .parse::<usize>()
+            .unwrap(),
+        lua_max_instructions: Some(
+            env::var("LUA_MAX_INSTRUCTIONS")
+                .unwrap_or_else(|_| String::from("0"))
+                .parse::<u64>()
+                .unwrap(),
+        )
+        .filter(|instructions| *instructions > 0),
+        bash_enabled: env::var("BASH_ENABLED")
+            .unwrap_or_else(|_| String::from("false"))
+            .parse::<bool>()
+            .unwrap(),
+        go_modules: env::var("GO_MODULES")
+            .unwrap_or_default()
+            .parse::<GoModules>()
+            .unwrap(),
+        go_module_cache: env::var("GO_MODULE_CACHE")
+            .ok()
+            .filter(|dir| !dir.is_empty())
+            .map(PathBuf::from),
+        python_packages: env::var("PYTHON_PACKAGES")
+            .unwrap_or_default()
+            .parse::<PythonPackages>()
+            .unwrap(),
+        python_venv: env::var("PYTHON_VENV")
+            .ok()
+            .filter(|dir| !dir.is_empty())
+            .map(PathBuf::from),
+        python_wheels: env::var("PYTHON_WHEELS")
+            .ok()
+            .filter(|dir| !dir.is_empty())
+            .map(PathBuf::from),
+        node_packages: env::var("NODE_PACKAGES")
+            .unwrap_or_default()
+            .parse::<NodePackages>()
+            .unwrap(),
+        node_modules_dir: env::var("NODE_MODULES_DIR")
+            .ok()
+            .filter(|dir| !dir.is_empty())
+            .map(PathBuf::from),
+        languages_file: env::var("LANGUAGES_FILE")
+            .ok()
+            .filter(|path| !path.is_empty())
+            .map(PathBuf::from),
+        locales: env::var("ALLOWED_LOCALES")
+            .unwrap_or_else(|_| String::from("C.UTF-8,en_US.UTF-8"))
+            .parse::<AllowList>()
+            .unwrap(),
+        timezones: env::var("ALLOWED_TIMEZONES")
+            .unwrap_or_else(|_| String::from("UTC"))
+            .parse::<AllowList>()
+            .unwrap(),
+    };
+    assert_eq!(
+        exec_config.judge_webhook_url.is_some(),
+        exec_config.judge_webhook_secret.is_some(),
+        "JUDGE_WEBHOOK_URL and JUDGE_WEBHOOK_SECRET must be set together"
+    );
+
+    let job_config = JobConfig {
+        workers: env::var("JOB_WORKERS")
+            .ok()
+            .map(|workers| workers.parse::<usize>().unwrap())
+            .unwrap_or_else(|| {
+                std::thread::available_parallelism()
+                    .map(|n| n.get())
+                    .unwrap_or(1)
+            }),
+        retention: Duration::from_secs(
+            env::var("JOB_RETENTION_SECS")
+                .unwrap_or_else(|_| String::from("3600"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        max_delay: Duration::from_secs(
+            env::var("JOB_MAX_DELAY_SECS")
+                .unwrap_or_else(|_| String::from("604800"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        group_max_jobs: env::var("JOB_GROUP_MAX_JOBS")
+            .unwrap_or_else(|_| String::from("256"))
+            .parse::<usize>()
+            .unwrap(),
+        dispatch: env::var("JOB_DISPATCH")
+            .unwrap_or_else(|_| String::from("local"))
+            .parse::<JobDispatch>()
+            .unwrap(),
+        worker_token: env::var("WORKER_TOKEN")
+            .ok()
+            .filter(|token| !token.is_empty()),
+        worker_timeout: Duration::from_secs(
+            env::var("WORKER_TIMEOUT_SECS")
+                .unwrap_or_else(|_| String::from("30"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        dispatcher_url: env::var("DISPATCHER_URL")
+            .unwrap_or_else(|_| String::from("http://127.0.0.1:5000")),
+        node_name: env::var("NODE_NAME")
+            .ok()
+            .filter(|name| !name.is_empty())
+            .or_else(|| {
+                fs::read_to_string("/proc/sys/kernel/hostname")
+                    .ok()
+                    .map(|name| name.trim().to_string())
+            })
+            .unwrap_or_else(|| String::from("comphub")),
+    };
+
+    let disk_config = DiskConfig {
+        zone_dir: zone_dir.clone(),
+        zone_tmpfs_bytes: Some(
+            env::var("EXECUTION_ZONE_TMPFS_BYTES")
+                .unwrap_or_else(|_| String::from("0"))
+                .parse::<u64>()
+                .unwrap(),
+        )
+        .filter(|bytes| *bytes > 0),
+        high_watermark: env::var("DISK_HIGH_WATERMARK_PERCENT")
+            .unwrap_or_else(|_| String::from("90"))
+            .parse::<f64>()
+            .unwrap()
+            / 100.0,
+        check_interval: Duration::from_secs(
+            env::var("DISK_CHECK_INTERVAL_SECS")
+                .unwrap_or_else(|_| String::from("15"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        gc_max_age: Duration::from_secs(
+            env::var("DISK_GC_MAX_AGE_SECS")
+                .unwrap_or_else(|_| String::from("300"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        artifact_ttl: Duration::from_secs(
+            env::var("ARTIFACT_TTL_SECS")
+                .unwrap_or_else(|_| String::from("3600"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+    };
+
+    let store_config = StoreConfig {
+        backend: env::var("STORE_BACKEND")
+            .unwrap_or_else(|_| String::from("memory"))
+            .parse::<StoreBackend>()
+            .unwrap(),
+        path: PathBuf::from(
+            env::var("STORE_PATH").unwrap_or_else(|_| String::from("comphub.db")),
+        ),
+        url: env::var("STORE_URL")
+            .unwrap_or_else(|_| String::from("postgres://localhost/comphub")),
+        result_ttl: Duration::from_secs(
+            env::var("RESULT_CACHE_TTL_SECS")
+                .unwrap_or_else(|_| String::from("0"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        snippet_ttl: Duration::from_secs(
+            env::var("SNIPPET_RETENTION_SECS")
+                .unwrap_or_else(|_| String::from("2592000"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        submission_ttl: Duration::from_secs(
+            env::var("SUBMISSION_RETENTION_SECS")
+                .unwrap_or_else(|_| String::from("0"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        idempotency_ttl: Duration::from_secs(
+            env::var("IDEMPOTENCY_TTL_SECS")
+                .unwrap_or_else(|_| String::from("86400"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        blob_dir: PathBuf::from(
+            env::var("BLOB_DIR").unwrap_or_else(|_| String::from("blobs")),
+        ),
+        blob_max_bytes: env::var("BLOB_MAX_BYTES")
+            .unwrap_or_else(|_| String::from("1073741824"))
+            .parse::<u64>()
+            .unwrap(),
+        blob_max_file_bytes: env::var("BLOB_MAX_FILE_BYTES")
+            .unwrap_or_else(|_| String::from("67108864"))
+            .parse::<usize>()
+            .unwrap(),
+        build_cache: env::var("BUILD_CACHE_URL")
+            .ok()
+            .filter(|url| !url.is_empty())
+            .map(|url| url.parse::<CacheAddress>().unwrap()),
+        build_cache_ttl: Duration::from_secs(
+            env::var("BUILD_CACHE_TTL_SECS")
+                .unwrap_or_else(|_| String::from("86400"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        s3_credentials: match (
+            env::var("AWS_ACCESS_KEY_ID"),
+            env::var("AWS_SECRET_ACCESS_KEY"),
+        ) {
+            (Ok(access_key), Ok(secret_key)) => Some(S3Credentials {
+                access_key,
+                secret_key,
+            }),
+            _ => None,
+        },
+        sweep_interval: Duration::from_secs(
+            env::var("STORE_SWEEP_INTERVAL_SECS")
+                .unwrap_or_else(|_| String::from("60"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+    };
+
+    let request_config = RequestConfig {
+        max_body_bytes: env::var("REQUEST_MAX_BYTES")
+            .unwrap_or_else(|_| String::from("2097152"))
+            .parse::<usize>()
+            .unwrap(),
+        max_code_bytes: env::var("CODE_MAX_BYTES")
+            .unwrap_or_else(|_| String::from("262144"))
+            .parse::<usize>()
+            .unwrap(),
+        max_stdin_bytes: env::var("STDIN_MAX_BYTES")
+            .unwrap_or_else(|_| String::from("1048576"))
+            .parse::<usize>()
+            .unwrap(),
+        max_image_bytes: env::var("IMAGE_MAX_BYTES")
+            .unwrap_or_else(|_| String::from("5242880"))
+            .parse::<u64>()
+            .unwrap(),
+        max_files: env::var("FILE_MAX_COUNT")
+            .unwrap_or_else(|_| String::from("32"))
+            .parse::<usize>()
+            .unwrap(),
+        max_file_bytes: env::var("FILE_MAX_BYTES")
+            .unwrap_or_else(|_| String::from("10485760"))
+            .parse::<u64>()
+            .unwrap(),
+        signing_keys: env::var("REQUEST_SIGNING_KEYS")
+            .unwrap_or_default()
+            .parse::<SigningKeys>()
+            .unwrap(),
+        signature_window: Duration::from_secs(
+            env::var("REQUEST_SIGNATURE_WINDOW_SECS")
+                .unwrap_or_else(|_| String::from("300"))
+                .parse::<u64>()
+                .unwrap(),
+        ),
+        tiers_file: env::var("TIERS_FILE")
+            .ok()
+            .filter(|path| !path.is_empty())
+            .map(PathBuf::from),
+        policy_file: env::var("SUBMISSION_POLICY_FILE")
+            .ok()
+            .filter(|path| !path.is_empty())
+            .map(PathBuf::from),
+        import_policy_file: env::var("IMPORT_POLICY_FILE")
+            .ok()
+            .filter(|path| !path.is_empty())
+            .map(PathBuf::from),
+        admin_token: env::var("ADMIN_TOKEN")
+            .ok()
+            .filter(|token| !token.is_empty()),
+    };
+
+    let upload_config = UploadConfig {
+        max_bytes: env::var("UPLOAD_MAX_BYTES")
+            .unwrap_or_else(|_| String::from("10485760"))
+            .parse::<usize>()
+            .unwrap(),
+        stream_max_bytes: env::var("STDIN_STREAM_MAX_BYTES")
+            .unwrap_or_else(|_| String::from("1073741824"))
+            .parse::<u64>()
+            .unwrap(),
+        archive_limits: ArchiveLimits {
+            max_entries: env::var("UPLOAD_MAX_ENTRIES")
+                .unwrap_or_else(|_| String::from("1000"))
+                .parse::<usize>()
+                .unwrap(),
+            max_extracted_bytes: env::var("UPLOAD_MAX_EXTRACTED_BYTES")
+                .unwrap_or_else(|_| String::from("52428800"))
+                .parse::<u64>()
+                .unwrap(),
+        },
+    };
+
+    let throttle_config = ThrottleConfig {
+        limits: ThrottleLimits {
+            window: Duration::from_secs(
+                env::var("THROTTLE_WINDOW_SECS")
+                    .unwrap_or_else(|_| String::from("60"))
+                    .parse::<u64>()
+                    .unwrap(),
+            ),
+            slow_after: env::var("THROTTLE_SLOW_AFTER")
+                .unwrap_or_else(|_| String::from("5"))
+                .parse::<usize>()
+                .unwrap(),
+            reject_after: env::var("THROTTLE_REJECT_AFTER")
+                .unwrap_or_else(|_| String::from("20"))
+                .parse::<usize>()
+                .unwrap(),
+            delay: Duration::from_millis(
+                env::var("THROTTLE_DELAY_MS")
+                    .unwrap_or_else(|_| String::from("1000"))
+                    .parse::<u64>()
+                    .unwrap(),
+            ),
+        },
+        trust_forwarded_for: env::var("TRUST_FORWARDED_FOR")
+            .unwrap_or_else(|_| String::from("false"))
+            .parse::<bool>()
+            .unwrap(),
+        forwarded_hops: env::var("FORWARDED_FOR_HOPS")
+            .unwrap_or_else(|_| String::from("1"))
+            .parse::<usize>()
+            .unwrap()
+            .max(1),
+        load_limits: LoadLimits {
+            cpu: Some(
+                env::var("LOAD_SHED_CPU_PERCENT")
+                    .unwrap_or_else(|_| String::from("0"))
+                    .parse::<f64>()
+                    .unwrap()
+                    / 100.0,
+            )
+            .filter(|limit| *limit > 0.0),
+            memory: Some(
+                env::var("LOAD_SHED_MEMORY_PERCENT")
+                    .unwrap_or_else(|_| String::from("0"))
+                    .parse::<f64>()
+                    .unwrap()
+                    / 100.0,
+            )
+            .filter(|limit| *limit > 0.0),
+            queue_depth: Some(
+                env::var("LOAD_SHED_QUEUE_DEPTH")
+                    .unwrap_or_else(|_| String::from("0"))
+                    .parse::<usize>()
+                    .unwrap(),
+            )
+            .filter(|limit| *limit > 0),
+            retry_after: Duration::from_secs(
+                env::var("LOAD_SHED_RETRY_AFTER_SECS")
+                    .unwrap_or_else(|_| String::from("5"))
+                    .parse::<u64>()
+                    .unwrap()
+                    .max(1),
+            ),
+            interval: Duration::from_millis(
+                env::var("LOAD_SAMPLE_INTERVAL_MS")
+                    .unwrap_or_else(|_| String::from("1000"))
+                    .parse::<u64>()
+                    .unwrap()
+                    .max(100),
+            ),
+        },
+    };
+
+    let run_log_config = RunLogConfig {
+        capacity: env::var("RUN_LOG_CAPACITY")
+            .unwrap_or_else(|_| String::from("1000"))
+            .parse::<usize>()
+            .unwrap(),
+        max_output_bytes: env::var("RUN_LOG_MAX_OUTPUT_BYTES")
+            .unwrap_or_else(|_| String::from("16384"))
+            .parse::<usize>()
+            .unwrap(),
+        persist: env::var("RUN_LOG_PERSIST")
+            .unwrap_or_else(|_| String::from("false"))
+            .parse::<bool>()
+            .unwrap(),
+        event_sinks: env::var("EVENT_SINKS")
+            .unwrap_or_default()
+            .parse::<EventSinks>()
+            .unwrap(),
+        usage_export_file: env::var("USAGE_EXPORT_FILE")
+            .ok()
+            .filter(|path| !path.is_empty())
+            .map(PathBuf::from),
+        usage_export_interval: Duration::from_secs(
+            env::var("USAGE_EXPORT_INTERVAL_SECS")
+                .unwrap_or_else(|_| String::from("3600"))
+                .parse::<u64>()
+                .unwrap()
+                .max(1),
+        ),
+        audit_log_file: env::var("AUDIT_LOG_FILE")
+            .ok()
+            .filter(|path| !path.is_empty())
+            .map(PathBuf::from),
+    };
 
     Config {
         server: server_config,
+        disk: disk_config,
+        exec: exec_config,
+        jobs: job_config,
+        store: store_config,
+        request: request_config,
+        upload: upload_config,
+        throttle: throttle_config,
+        run_logs: run_log_config,
     }
 }
 
@@ -0,0 +1,184 @@
+// Runs programs from another Rust application, without the HTTP server in
+// between. Runs are confined and limited by the same configuration the
+// server reads; a runner's own limits take precedence over it.
+//
+//     comphub::engine::init().await;
+//     let runner = Runner::new().with_timeout(Duration::from_secs(5));
+//     let output = runner.run(&Program::new("python", "print(1)")).await?;
+use std::{future::Future, time::Duration};
+
+use tokio::sync::mpsc::UnboundedSender;
+
+use crate::{
+    config::config,
+    infra::{
+        compile::compile_lang,
+        error::InfraError,
+        plugin::load_plugins,
+        runner::{ExecContext, OutputChunk},
+        sandbox::init_sandbox,
+        transcript::UNBUFFERED_ENV,
+        wasm::Backend,
+    },
+};
+
+// Sets the process up to run programs the way the server does: as the
+// configured sandbox user, with the configured plugins. Call it once before
+// the first run.
+pub async fn init() {
+    let app_config = config().await;
+    init_sandbox(app_config.sandbox_users());
+    load_plugins(app_config.plugins_dir()).await;
+}
+
+// One program to run.
+#[derive(Debug, Clone, Default)]
+pub struct Program {
+    pub lang: String,
+    pub content: String,
+    pub stdin: String,
+    pub args: Vec<String>,
+    pub env: Vec<(String, String)>,
+    // SQL run against the database before `content`, for sql programs.
+    pub setup: String,
+}
+
+impl Program {
+    pub fn new(lang: &str, content: &str) -> Self {
+        Program {
+            lang: lang.to_string(),
+            content: content.to_string(),
+            ..Program::default()
+        }
+    }
+
+    pub fn with_stdin(mut self, stdin: &str) -> Self {
+        self.stdin = stdin.to_string();
+        self
+    }
+
+    pub fn with_args(mut self, args: Vec<String>) -> Self {
+        self.args = args;
+        self
+    }
+
+    pub fn with_env(mut self, key: &str, value: &str) -> Self {
+        self.env.push((key.to_string(), value.to_string()));
+        self
+    }
+
+    pub fn with_setup(mut self, setup: &str) -> Self {
+        self.setup = setup.to_string();
+        self
+    }
+}
+
+// Runs programs with a fixed set of limits. Cheap to clone and safe to
+// share between tasks.
+#[derive(Debug, Clone, Default)]
+pub struct Runner {
+    ctx: ExecContext,
+}
+
+impl Runner {
+    pub fn new() -> Self {
+        Runner::default()
+    }
+
+    pub fn with_timeout(mut self, timeout: Duration) -> Self {
+        self.ctx = self.ctx.with_timeout(timeout);
+        self
+    }
+
+    pub fn with_memory_limit(mut self, bytes: u64) -> Self {
+        self.ctx = self.ctx.with_memory_limit(bytes);
+        self
+    }
+
+    pub fn with_max_output(mut self, bytes: usize) -> Self {
+        self.ctx = self.ctx.with_max_output(bytes);
+        self
+    }
+
+    pub fn with_disk_quota(mut self, bytes: u64) -> Self {
+        self.ctx = self.ctx.with_disk_quota(bytes);
+        self
+    }
+
+    pub fn with_backend(mut self, backend: Backend) -> Self {
+        self.ctx = self.ctx.with_backend(backend);
+        self
+    }
+
+    fn context(&self, program: &Program) -> ExecContext {
+        self.ctx
+            .clone()
+            .with_args(program.args.clone())
+            .with_envs(program.env.iter().cloned())
+            .with_setup(program.setup.clone())
+    }
+
+    // Runs `program` to completion and returns its standard output.
+    pub async fn run(&self, program: &Program) -> Result<String, InfraError> {
+        let ctx = self.context(program);
+        compile_lang(&program.lang, &program.content, &program.stdin, &ctx).await
+    }
+
+    // Like `run`, but also sends what the program writes to `output` as it
+    // is written.
+    pub async fn run_streaming(
+        &self,
+        program: &Program,
+        output: UnboundedSender<OutputChunk>,
+    ) -> Result<String, InfraError> {
+        let mut ctx = self.context(program);
+        for (key, value) in UNBUFFERED_ENV {
+            ctx = ctx.with_env(key, value);
+        }
+        let ctx = ctx.with_output(output);
+        compile_lang(&program.lang, &program.content, &program.stdin, &ctx).await
+    }
+
+    // Like `run`, but stops the program and fails with `InfraError::Killed`
+    // if `cancelled` resolves first. Dropping the returned future stops it
+    // too.
+    pub async fn run_until<F>(&self, program: &Program, cancelled: F) -> Result<String, InfraError>
+    where
+        F: Future<Output = ()>,
+    {
+        tokio::select! {
+            result = self.run(program) => result,
+            _ = cancelled => Err(InfraError::Killed),
+        }
+    }
+}
+
+#[cfg(test)]
+mod engine_tests {
+    use super::*;
+    use std::time::Instant;
+
+    #[tokio::test]
+    async fn test_run_passes_stdin_args_and_env() {
+        let program = Program::new(
+            "python",
+            "import os, sys\nprint(sys.stdin.read(), sys.argv[1], os.environ['GREETING'])",
+        )
+        .with_stdin("in")
+        .with_args(vec![String::from("arg")])
+        .with_env("GREETING", "hi");
+        let output = Runner::new().run(&program).await.unwrap();
+        assert_eq!(output, "in arg hi\n");
+    }
+
+    #[tokio::test]
+    async fn test_run_until_stops_the_program_when_cancelled() {
+        let program = Program::new("python", "import time\ntime.sleep(30)");
+        let started = Instant::now();
+        let result = Runner::new()
+            .run_until(&program, tokio::time::sleep(Duration::from_millis(200)))
+            .await;
+        assert!(matches!(result, Err(InfraError::Killed)));
+        assert!(started.elapsed() < Duration::from_secs(5));
+    }
+}
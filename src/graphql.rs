@@ -0,0 +1,468 @@
+use std::sync::LazyLock;
+
+use async_graphql::{
+    Context, Enum, ErrorExtensions, InputObject, Object, Schema, SimpleObject, Subscription, Union,
+    http::GraphiQLSource,
+};
+use async_graphql_axum::{GraphQLRequest, GraphQLResponse, GraphQLSubscription};
+use axum::{
+    http::HeaderMap,
+    response::{Html, IntoResponse},
+};
+use chrono::{DateTime, Utc};
+use tokio::sync::{broadcast, mpsc};
+use tokio_stream::{Stream, wrappers::ReceiverStream};
+use uuid::Uuid;
+
+use crate::{
+    handlers::{
+        compile::{
+            CompilerRequest, admit_language, admit_run, admit_tier, check_dependencies,
+            check_limits, resolve_version, screen_submission, throttle_submission, validate,
+        },
+        error::ApiError,
+        extract::{ApiKey, ClientIp},
+    },
+    infra::{
+        catalog::{self, LanguageInfo},
+        compile::compile_lang,
+        events::Submitter,
+        jobs::{self, JobEvent, JobSpec, job_queue},
+        logs::logged,
+        runner::{self, ExecContext, OutputEncoding},
+        scheduler::IDEMPOTENCY_HEADER,
+        tenants::queue_tenant,
+        tier::{Feature, tiers},
+        wasm::Backend,
+    },
+};
+
+pub const GRAPHQL_PATH: &str = "/graphql";
+pub const GRAPHQL_WS_PATH: &str = "/graphql/ws";
+
+pub type ComphubSchema = Schema<QueryRoot, MutationRoot, SubscriptionRoot>;
+
+static SCHEMA: LazyLock<ComphubSchema> =
+    LazyLock::new(|| Schema::build(QueryRoot, MutationRoot, SubscriptionRoot).finish());
+
+pub fn schema() -> ComphubSchema {
+    SCHEMA.clone()
+}
+
+// The status the REST API would answer with goes along as the `status`
+// extension, so clients can tell a timeout from a refusal.
+fn graphql_error(err: ApiError) -> async_graphql::Error {
+    let (status, response) = err.report();
+    async_graphql::Error::new(response.message)
+        .extend_with(|_, extensions| extensions.set("status", i32::from(status.as_u16())))
+}
+
+// Who sent the request, taken from its headers as the REST handlers do.
+struct Caller {
+    api_key: Option<String>,
+    client_ip: String,
+    idempotency_key: Option<String>,
+}
+
+#[derive(InputObject)]
+struct EnvVar {
+    name: String,
+    value: String,
+}
+
+#[derive(InputObject)]
+struct CompileInput {
+    lang: String,
+    content: String,
+    #[graphql(default)]
+    stdin: String,
+    #[graphql(default)]
+    args: Vec<String>,
+    #[graphql(default)]
+    env: Vec<EnvVar>,
+    #[graphql(default)]
+    compiler_flags: Vec<String>,
+    /// Runs on the host's default toolchain when absent
+    version: Option<String>,
+    /// Packages from the instance's allow-list for the language
+    #[graphql(default)]
+    dependencies: Vec<String>,
+}
+
+impl From<CompileInput> for CompilerRequest {
+    fn from(input: CompileInput) -> Self {
+        CompilerRequest {
+            lang: input.lang,
+            content: input.content,
+            stdin: input.stdin,
+            args: input.args,
+            env: input
+                .env
+                .into_iter()
+                .map(|var| (var.name, var.value))
+                .collect(),
+            compiler_flags: input.compiler_flags,
+            collect_files: false,
+            file_contents: None,
+            collect_images: false,
+            transcript: false,
+            backend: Backend::Native,
+            js_engine: None,
+            version: input.version.filter(|version| !version.is_empty()),
+            dependencies: input.dependencies,
+            setup: String::new(),
+            coverage: false,
+            debug: false,
+            profile: false,
+            output_encoding: OutputEncoding::Text,
+            inline_output_bytes: None,
+            locale: None,
+            timezone: None,
+        }
+    }
+}
+
+#[derive(SimpleObject)]
+struct CompileResult {
+    id: String,
+    result: String,
+    version: Option<String>,
+}
+
+#[derive(SimpleObject)]
+struct Language {
+    name: String,
+    compiled: bool,
+    version: Option<String>,
+    arch: String,
+    available: bool,
+}
+
+impl From<LanguageInfo> for Language {
+    fn from(info: LanguageInfo) -> Self {
+        Language {
+            name: info.name,
+            compiled: info.compiled,
+            version: info.version,
+            arch: info.arch.to_string(),
+            available: info.available,
+        }
+    }
+}
+
+#[derive(Enum, Clone, Copy, PartialEq, Eq)]
+enum JobStatus {
+    Scheduled,
+    Queued,
+    Running,
+    Completed,
+    Failed,
+    Interrupted,
+}
+
+impl From<jobs::JobStatus> for JobStatus {
+    fn from(status: jobs::JobStatus) -> Self {
+        match status {
+            jobs::JobStatus::Scheduled => JobStatus::Scheduled,
+            jobs::JobStatus::Queued => JobStatus::Queued,
+            jobs::JobStatus::Running => JobStatus::Running,
+            jobs::JobStatus::Completed => JobStatus::Completed,
+            jobs::JobStatus::Failed => JobStatus::Failed,
+            jobs::JobStatus::Interrupted => JobStatus::Interrupted,
+        }
+    }
+}
+
+#[derive(SimpleObject)]
+struct Job {
+    id: String,
+    lang: String,
+    status: JobStatus,
+    result: Option<String>,
+    error: Option<String>,
+    created_at: DateTime<Utc>,
+    started_at: Option<DateTime<Utc>>,
+    finished_at: Option<DateTime<Utc>>,
+    version: Option<String>,
+    scheduled_for: Option<DateTime<Utc>>,
+    /// While the job is queued, how many jobs will start before it
+    queue_position: Option<usize>,
+    estimated_start: Option<DateTime<Utc>>,
+}
+
+impl From<jobs::Job> for Job {
+    fn from(job: jobs::Job) -> Self {
+        Job {
+            id: job.id,
+            lang: job.lang,
+            status: job.status.into(),
+            result: job.result,
+            error: job.error,
+            created_at: job.created_at,
+            started_at: job.started_at,
+            finished_at: job.finished_at,
+            version: job.version,
+            scheduled_for: job.scheduled_for,
+            queue_position: job.queue_position,
+            estimated_start: job.estimated_start,
+        }
+    }
+}
+
+#[derive(Enum, Clone, Copy, PartialEq, Eq)]
+#[graphql(name = "Stream")]
+enum OutputStream {
+    Stdout,
+    Stderr,
+}
+
+#[derive(SimpleObject)]
+struct OutputChunk {
+    stream: OutputStream,
+    data: String,
+}
+
+impl From<runner::OutputChunk> for OutputChunk {
+    fn from(chunk: runner::OutputChunk) -> Self {
+        let (stream, data) = match chunk {
+            runner::OutputChunk::Stdout(data) => (OutputStream::Stdout, data),
+            runner::OutputChunk::Stderr(data) => (OutputStream::Stderr, data),
+        };
+        OutputChunk { stream, data }
+    }
+}
+
+// What the program is using while it runs.
+#[derive(SimpleObject)]
+struct Usage {
+    elapsed_ms: u64,
+    cpu_percent: f64,
+    memory_bytes: u64,
+    output_bytes: u64,
+}
+
+impl From<runner::UsageSample> for Usage {
+    fn from(sample: runner::UsageSample) -> Self {
+        Usage {
+            elapsed_ms: sample.elapsed_ms,
+            cpu_percent: sample.cpu_percent,
+            memory_bytes: sample.memory_bytes,
+            output_bytes: sample.output_bytes,
+        }
+    }
+}
+
+#[derive(Union)]
+enum OutputEvent {
+    Output(OutputChunk),
+    Usage(Usage),
+    Finished(Job),
+}
+
+// The subscription carries the program's output and usage, not its
+// compiler's output.
+fn output_event(event: JobEvent) -> Option<OutputEvent> {
+    match event {
+        JobEvent::Compiler(_) => None,
+        JobEvent::Output(chunk) => Some(OutputEvent::Output(chunk.into())),
+        JobEvent::Usage(sample) => Some(OutputEvent::Usage(sample.into())),
+        JobEvent::Finished(job) => Some(OutputEvent::Finished(job.into())),
+    }
+}
+
+pub struct QueryRoot;
+
+#[Object]
+impl QueryRoot {
+    /// Languages this instance runs, with the version of each toolchain
+    async fn languages(&self) -> Vec<Language> {
+        catalog::languages()
+            .await
+            .into_iter()
+            .map(Language::from)
+            .collect()
+    }
+
+    /// Current job state; null for an unknown or expired job
+    async fn job(&self, id: String) -> Option<Job> {
+        job_queue().await.get(&id).map(Job::from)
+    }
+}
+
+pub struct MutationRoot;
+
+#[Object]
+impl MutationRoot {
+    /// Runs the program and answers once it is done
+    async fn compile(
+        &self,
+        ctx: &Context<'_>,
+        input: CompileInput,
+    ) -> async_graphql::Result<CompileResult> {
+        let caller = ctx.data::<Caller>()?;
+        run(caller, input.into()).await.map_err(graphql_error)
+    }
+
+    /// Queues the program; its output follows on the `jobOutput` subscription
+    async fn submit_job(
+        &self,
+        ctx: &Context<'_>,
+        input: CompileInput,
+    ) -> async_graphql::Result<Job> {
+        let caller = ctx.data::<Caller>()?;
+        submit(caller, input.into()).await.map_err(graphql_error)
+    }
+}
+
+async fn run(caller: &Caller, req: CompilerRequest) -> Result<CompileResult, ApiError> {
+    let api_key = caller.api_key.as_deref();
+    let tier = admit_tier(api_key, &caller.client_ip, &[]).await?;
+    check_limits(&req.content, &req.stdin, tier).await?;
+    let toolchain = validate(&req)?;
+    let version = resolve_version(toolchain, req.version.as_deref()).await?;
+    check_dependencies(toolchain, &req.dependencies, tier).await?;
+    let submitter = Submitter::new(api_key, &caller.client_ip);
+    screen_submission(&submitter, &req.lang, &req.content).await?;
+    let _slot = admit_run(api_key, tier, toolchain).await?;
+    throttle_submission(&caller.client_ip, &req.lang, req.content.as_bytes()).await?;
+    let mut ctx = ExecContext::default();
+    if let Some(tier) = tier {
+        ctx = tier.apply(ctx);
+    }
+    if let Some(version) = version {
+        ctx = ctx.with_toolchain_dir(version.dir.clone());
+    }
+    let ctx = ctx
+        .with_args(req.args)
+        .with_envs(req.env)
+        .with_compiler_flags(req.compiler_flags)
+        .with_dependencies(req.dependencies);
+    let id = Uuid::new_v4().to_string();
+    let result = logged(
+        &id,
+        &req.lang,
+        &req.content,
+        &submitter,
+        compile_lang(&req.lang, &req.content, &req.stdin, &ctx),
+    )
+    .await?;
+
+    Ok(CompileResult {
+        id,
+        result,
+        version: version.map(|version| version.name.clone()),
+    })
+}
+
+async fn submit(caller: &Caller, req: CompilerRequest) -> Result<Job, ApiError> {
+    let api_key = caller.api_key.as_deref();
+    let tier = admit_tier(api_key, &caller.client_ip, &[Feature::Jobs]).await?;
+    check_limits(&req.content, &req.stdin, tier).await?;
+    let toolchain = validate(&req)?;
+    admit_language(tier, toolchain)?;
+    let version = resolve_version(toolchain, req.version.as_deref()).await?;
+    check_dependencies(toolchain, &req.dependencies, tier).await?;
+    let submitter = Submitter::new(api_key, &caller.client_ip);
+    screen_submission(&submitter, &req.lang, &req.content).await?;
+    throttle_submission(&caller.client_ip, &req.lang, req.content.as_bytes()).await?;
+    let tenant = &queue_tenant(tiers().await, api_key, &caller.client_ip);
+    let spec = JobSpec {
+        tier: tier.cloned(),
+        version,
+        submitter,
+        ..req.into()
+    };
+    let queue = job_queue().await;
+    let job = match &caller.idempotency_key {
+        Some(key) => queue.submit_once(key, tenant, spec),
+        None => queue.submit(tenant, spec),
+    };
+    Ok(job.into())
+}
+
+pub struct SubscriptionRoot;
+
+#[Subscription]
+impl SubscriptionRoot {
+    /// The job's output so far, then the rest as it is written, ending with
+    /// the finished job
+    async fn job_output(
+        &self,
+        job_id: String,
+    ) -> async_graphql::Result<impl Stream<Item = OutputEvent>> {
+        let mut subscription = job_queue()
+            .await
+            .subscribe(&job_id)
+            .ok_or_else(|| graphql_error(ApiError::NotFound(format!("job {}", job_id))))?;
+
+        let (tx, rx) = mpsc::channel(64);
+        tokio::spawn(async move {
+            let finished = subscription.finished.is_some();
+            let replay = subscription
+                .history
+                .into_iter()
+                .map(JobEvent::Output)
+                .chain(subscription.finished.map(JobEvent::Finished));
+            for event in replay.filter_map(output_event) {
+                if tx.send(event).await.is_err() {
+                    return;
+                }
+            }
+            if finished {
+                return;
+            }
+
+            loop {
+                let event = match subscription.events.recv().await {
+                    Ok(event) => event,
+                    Err(broadcast::error::RecvError::Lagged(_)) => continue,
+                    Err(broadcast::error::RecvError::Closed) => return,
+                };
+                let finished = matches!(event, JobEvent::Finished(_));
+                let Some(event) = output_event(event) else {
+                    continue;
+                };
+                if tx.send(event).await.is_err() || finished {
+                    return;
+                }
+            }
+        });
+
+        Ok(ReceiverStream::new(rx))
+    }
+}
+
+pub async fn graphql(
+    ApiKey(api_key): ApiKey,
+    ClientIp(client_ip): ClientIp,
+    headers: HeaderMap,
+    request: GraphQLRequest,
+) -> GraphQLResponse {
+    let idempotency_key = headers
+        .get(IDEMPOTENCY_HEADER)
+        .and_then(|value| value.to_str().ok())
+        .map(str::to_string);
+    let caller = Caller {
+        api_key,
+        client_ip,
+        idempotency_key,
+    };
+    SCHEMA
+        .execute(request.into_inner().data(caller))
+        .await
+        .into()
+}
+
+// An in-browser editor for trying queries out.
+pub async fn graphiql() -> impl IntoResponse {
+    Html(
+        GraphiQLSource::build()
+            .endpoint(GRAPHQL_PATH)
+            .subscription_endpoint(GRAPHQL_WS_PATH)
+            .finish(),
+    )
+}
+
+pub fn subscriptions() -> GraphQLSubscription<ComphubSchema> {
+    GraphQLSubscription::new(schema())
+}
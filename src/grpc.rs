@@ -0,0 +1,302 @@
+use std::net::SocketAddr;
+
+use tokio::sync::{broadcast, mpsc};
+use tokio_stream::wrappers::ReceiverStream;
+use tonic::{Request, Response, Status, transport::Server};
+use uuid::Uuid;
+
+use crate::{
+    handlers::{
+        compile::{
+            CompilerRequest, admit_language, admit_run, admit_tier, check_dependencies,
+            check_limits, resolve_version, screen_submission, throttle_submission, validate,
+        },
+        error::ApiError,
+    },
+    infra::{
+        compile::compile_lang,
+        error::InfraError,
+        events::Submitter,
+        jobs::{self, JobEvent, JobSpec, job_queue},
+        logs::logged,
+        runner::{self, ExecContext, OutputEncoding},
+        scheduler::{IDEMPOTENCY_HEADER, TENANT_HEADER},
+        tenants::queue_tenant,
+        tier::{Feature, tiers},
+        wasm::Backend,
+    },
+};
+
+pub mod proto {
+    tonic::include_proto!("comphub.v1");
+}
+
+use proto::{
+    CompileRequest, CompileResponse, OutputEvent, StreamOutputRequest, SubmitJobResponse,
+    output_event::Event,
+    runner_server::{Runner, RunnerServer},
+};
+
+impl From<ApiError> for Status {
+    fn from(err: ApiError) -> Self {
+        match err {
+            ApiError::NotFound(msg) => Status::not_found(msg),
+            ApiError::BadRequest(msg) => Status::invalid_argument(msg),
+            ApiError::Unauthorized(msg) => Status::unauthenticated(msg),
+            ApiError::Forbidden(msg) => Status::permission_denied(msg),
+            ApiError::Conflict(msg) => Status::aborted(msg),
+            err @ ApiError::ValidationError(_) => Status::invalid_argument(err.to_string()),
+            err @ ApiError::PayloadTooLarge(_) => Status::resource_exhausted(err.to_string()),
+            ApiError::NotAcceptible(msg) => Status::failed_precondition(msg),
+            ApiError::ServiceUnavailable(msg) => Status::unavailable(msg),
+            ApiError::TooManyRequests(msg) | ApiError::Overloaded(msg, _) => {
+                Status::resource_exhausted(msg)
+            }
+            ApiError::Internal(msg) => Status::internal(msg),
+            ApiError::InternalServerError(err @ InfraError::Timeout(..)) => {
+                Status::deadline_exceeded(err.to_string())
+            }
+            ApiError::InternalServerError(err @ InfraError::BlockedSyscall(_)) => {
+                Status::permission_denied(err.to_string())
+            }
+            ApiError::InternalServerError(
+                err @ (InfraError::DiskQuotaExceeded(_) | InfraError::OutputLimitExceeded(_)),
+            ) => Status::resource_exhausted(err.to_string()),
+            ApiError::InternalServerError(err) => Status::internal(err.to_string()),
+        }
+    }
+}
+
+impl From<CompileRequest> for CompilerRequest {
+    fn from(req: CompileRequest) -> Self {
+        CompilerRequest {
+            lang: req.lang,
+            content: req.content,
+            stdin: req.stdin,
+            args: req.args,
+            env: req.env.into_iter().collect(),
+            compiler_flags: req.compiler_flags,
+            collect_files: false,
+            file_contents: None,
+            collect_images: false,
+            transcript: false,
+            backend: Backend::Native,
+            js_engine: None,
+            version: Some(req.version).filter(|version| !version.is_empty()),
+            dependencies: req.dependencies,
+            setup: String::new(),
+            coverage: false,
+            debug: false,
+            profile: false,
+            output_encoding: OutputEncoding::Text,
+            inline_output_bytes: None,
+            locale: None,
+            timezone: None,
+        }
+    }
+}
+
+impl From<runner::OutputChunk> for proto::OutputChunk {
+    fn from(chunk: runner::OutputChunk) -> Self {
+        let (stream, data) = match chunk {
+            runner::OutputChunk::Stdout(data) => (proto::Stream::Stdout, data),
+            runner::OutputChunk::Stderr(data) => (proto::Stream::Stderr, data),
+        };
+        proto::OutputChunk {
+            stream: stream.into(),
+            data,
+        }
+    }
+}
+
+impl From<jobs::Job> for proto::JobFinished {
+    fn from(job: jobs::Job) -> Self {
+        let status = match job.status {
+            jobs::JobStatus::Scheduled => proto::JobStatus::Scheduled,
+            jobs::JobStatus::Queued => proto::JobStatus::Queued,
+            jobs::JobStatus::Running => proto::JobStatus::Running,
+            jobs::JobStatus::Completed => proto::JobStatus::Completed,
+            jobs::JobStatus::Failed => proto::JobStatus::Failed,
+            jobs::JobStatus::Interrupted => proto::JobStatus::Interrupted,
+        };
+        proto::JobFinished {
+            status: status.into(),
+            result: job.result,
+            error: job.error,
+        }
+    }
+}
+
+// The stream carries the program's output only, not its compiler's or
+// usage samples.
+fn output_event(event: JobEvent) -> Option<OutputEvent> {
+    let event = match event {
+        JobEvent::Compiler(_) | JobEvent::Usage(_) => return None,
+        JobEvent::Output(chunk) => Event::Output(chunk.into()),
+        JobEvent::Finished(job) => Event::Finished(job.into()),
+    };
+    Some(OutputEvent { event: Some(event) })
+}
+
+fn client_ip<T>(request: &Request<T>) -> String {
+    request
+        .remote_addr()
+        .map(|addr| addr.ip().to_string())
+        .unwrap_or_else(|| String::from("unknown"))
+}
+
+#[derive(Default)]
+pub struct RunnerService;
+
+#[tonic::async_trait]
+impl Runner for RunnerService {
+    async fn compile(
+        &self,
+        request: Request<CompileRequest>,
+    ) -> Result<Response<CompileResponse>, Status> {
+        let api_key = request
+            .metadata()
+            .get(TENANT_HEADER)
+            .and_then(|value| value.to_str().ok())
+            .map(str::to_string);
+        let client_ip = client_ip(&request);
+        let req = CompilerRequest::from(request.into_inner());
+        let tier = admit_tier(api_key.as_deref(), &client_ip, &[]).await?;
+        check_limits(&req.content, &req.stdin, tier).await?;
+        let toolchain = validate(&req)?;
+        let version = resolve_version(toolchain, req.version.as_deref()).await?;
+        check_dependencies(toolchain, &req.dependencies, tier).await?;
+        let submitter = Submitter::new(api_key.as_deref(), &client_ip);
+        screen_submission(&submitter, &req.lang, &req.content).await?;
+        let _slot = admit_run(api_key.as_deref(), tier, toolchain).await?;
+        throttle_submission(&client_ip, &req.lang, req.content.as_bytes()).await?;
+        let mut ctx = ExecContext::default();
+        if let Some(tier) = tier {
+            ctx = tier.apply(ctx);
+        }
+        if let Some(version) = version {
+            ctx = ctx.with_toolchain_dir(version.dir.clone());
+        }
+        let ctx = ctx
+            .with_args(req.args)
+            .with_envs(req.env)
+            .with_compiler_flags(req.compiler_flags)
+            .with_dependencies(req.dependencies);
+        let id = Uuid::new_v4().to_string();
+        let result = logged(
+            &id,
+            &req.lang,
+            &req.content,
+            &submitter,
+            compile_lang(&req.lang, &req.content, &req.stdin, &ctx),
+        )
+        .await
+        .map_err(ApiError::from)?;
+
+        let version = version
+            .map(|version| version.name.clone())
+            .unwrap_or_default();
+        Ok(Response::new(CompileResponse {
+            result,
+            id,
+            version,
+        }))
+    }
+
+    async fn submit_job(
+        &self,
+        request: Request<CompileRequest>,
+    ) -> Result<Response<SubmitJobResponse>, Status> {
+        let api_key = request
+            .metadata()
+            .get(TENANT_HEADER)
+            .and_then(|value| value.to_str().ok())
+            .map(str::to_string);
+        let idempotency_key = request
+            .metadata()
+            .get(IDEMPOTENCY_HEADER)
+            .and_then(|value| value.to_str().ok())
+            .map(str::to_string);
+        let client_ip = client_ip(&request);
+        let req = CompilerRequest::from(request.into_inner());
+        let tier = admit_tier(api_key.as_deref(), &client_ip, &[Feature::Jobs]).await?;
+        check_limits(&req.content, &req.stdin, tier).await?;
+        let toolchain = validate(&req)?;
+        admit_language(tier, toolchain)?;
+        let version = resolve_version(toolchain, req.version.as_deref()).await?;
+        check_dependencies(toolchain, &req.dependencies, tier).await?;
+        let submitter = Submitter::new(api_key.as_deref(), &client_ip);
+        screen_submission(&submitter, &req.lang, &req.content).await?;
+        throttle_submission(&client_ip, &req.lang, req.content.as_bytes()).await?;
+        let tenant = &queue_tenant(tiers().await, api_key.as_deref(), &client_ip);
+        let spec = JobSpec {
+            tier: tier.cloned(),
+            version,
+            submitter,
+            ..req.into()
+        };
+        let queue = job_queue().await;
+        let job = match idempotency_key {
+            Some(key) => queue.submit_once(&key, tenant, spec),
+            None => queue.submit(tenant, spec),
+        };
+
+        Ok(Response::new(SubmitJobResponse { job_id: job.id }))
+    }
+
+    type StreamOutputStream = ReceiverStream<Result<OutputEvent, Status>>;
+
+    async fn stream_output(
+        &self,
+        request: Request<StreamOutputRequest>,
+    ) -> Result<Response<Self::StreamOutputStream>, Status> {
+        let job_id = request.into_inner().job_id;
+        let mut subscription = job_queue()
+            .await
+            .subscribe(&job_id)
+            .ok_or_else(|| Status::not_found(format!("job {}", job_id)))?;
+
+        let (tx, rx) = mpsc::channel(64);
+        tokio::spawn(async move {
+            let finished = subscription.finished.is_some();
+            let replay = subscription
+                .history
+                .into_iter()
+                .map(JobEvent::Output)
+                .chain(subscription.finished.map(JobEvent::Finished));
+            for event in replay.filter_map(output_event) {
+                if tx.send(Ok(event)).await.is_err() {
+                    return;
+                }
+            }
+            if finished {
+                return;
+            }
+
+            loop {
+                let event = match subscription.events.recv().await {
+                    Ok(event) => event,
+                    Err(broadcast::error::RecvError::Lagged(_)) => continue,
+                    Err(broadcast::error::RecvError::Closed) => return,
+                };
+                let finished = matches!(event, JobEvent::Finished(_));
+                let Some(event) = output_event(event) else {
+                    continue;
+                };
+                if tx.send(Ok(event)).await.is_err() || finished {
+                    return;
+                }
+            }
+        });
+
+        Ok(Response::new(ReceiverStream::new(rx)))
+    }
+}
+
+pub async fn serve(addr: SocketAddr) -> Result<(), tonic::transport::Error> {
+    tracing::info!("grpc server listening on: {}", addr);
+    Server::builder()
+        .add_service(RunnerServer::new(RunnerService))
+        .serve(addr)
+        .await
+}
@@ -0,0 +1,272 @@
+use axum::{
+    Json,
+    extract::{Path, Query},
+    http::{HeaderMap, StatusCode},
+};
+use serde::Deserialize;
+use utoipa::ToSchema;
+
+use crate::config::config;
+use crate::infra::{
+    audit::{AuditEntry, AuditQuery, audit_trail},
+    blobs::blob_store,
+    canary::{CanaryRun, canary_log},
+    executions::{ExecutionInfo, kill, running},
+    groups::GroupStatus,
+    jobs::job_queue,
+    judge::TestCase,
+    policy::{PolicyMatch, audit_log},
+    regrade::{RegradeFilter, regrade},
+    signing::constant_time_eq,
+    store::store,
+    tenants::{TenantUsage, tenants},
+};
+
+use super::{
+    blobs::resolve_tests,
+    error::{ApiError, ErrorResponse, FieldError},
+    extract::ValidJson,
+};
+
+pub const ADMIN_TOKEN_HEADER: &str = "x-admin-token";
+
+// Operator endpoints only answer requests carrying ADMIN_TOKEN, and do not
+// exist at all while it is unset.
+async fn authorize(headers: &HeaderMap) -> Result<(), ApiError> {
+    let Some(token) = config().await.admin_token() else {
+        return Err(ApiError::NotFound(String::from(
+            "admin endpoints are disabled",
+        )));
+    };
+    let presented = headers
+        .get(ADMIN_TOKEN_HEADER)
+        .map(|value| value.as_bytes())
+        .unwrap_or_default();
+    if constant_time_eq(presented, token.as_bytes()) {
+        Ok(())
+    } else {
+        Err(ApiError::Unauthorized(String::from("invalid admin token")))
+    }
+}
+
+#[utoipa::path(
+    get,
+    path = "/admin/executions",
+    tag = "admin",
+    params(("x-admin-token" = String, Header, description = "The server's ADMIN_TOKEN")),
+    responses(
+        (status = 200, description = "Executions running in this process, oldest first", body = [ExecutionInfo]),
+        (status = 401, description = "Missing or wrong admin token", body = ErrorResponse),
+        (status = 404, description = "No admin token is configured", body = ErrorResponse),
+    )
+)]
+pub async fn list_executions(headers: HeaderMap) -> Result<Json<Vec<ExecutionInfo>>, ApiError> {
+    authorize(&headers).await?;
+    let mut executions = running();
+    executions.sort_by_key(|execution| execution.started_at);
+    Ok(Json(executions))
+}
+
+#[utoipa::path(
+    get,
+    path = "/admin/tenants",
+    tag = "admin",
+    params(("x-admin-token" = String, Header, description = "The server's ADMIN_TOKEN")),
+    responses(
+        (status = 200, description = "Usage of every tenant seen since the server started, by the hash of its API key", body = [TenantUsage]),
+        (status = 401, description = "Missing or wrong admin token", body = ErrorResponse),
+        (status = 404, description = "No admin token is configured", body = ErrorResponse),
+    )
+)]
+pub async fn list_tenants(headers: HeaderMap) -> Result<Json<Vec<TenantUsage>>, ApiError> {
+    authorize(&headers).await?;
+    Ok(Json(tenants().all()))
+}
+
+#[utoipa::path(
+    get,
+    path = "/admin/policy/audit",
+    tag = "admin",
+    params(("x-admin-token" = String, Header, description = "The server's ADMIN_TOKEN")),
+    responses(
+        (status = 200, description = "The latest submissions that matched a submission policy rule, newest first, whether they were refused or only flagged", body = [PolicyMatch]),
+        (status = 401, description = "Missing or wrong admin token", body = ErrorResponse),
+        (status = 404, description = "No admin token is configured", body = ErrorResponse),
+    )
+)]
+pub async fn list_policy_matches(headers: HeaderMap) -> Result<Json<Vec<PolicyMatch>>, ApiError> {
+    authorize(&headers).await?;
+    Ok(Json(audit_log()))
+}
+
+#[utoipa::path(
+    get,
+    path = "/admin/canary",
+    tag = "admin",
+    params(("x-admin-token" = String, Header, description = "The server's ADMIN_TOKEN")),
+    responses(
+        (status = 200, description = "The latest runs tried again on a candidate toolchain version, newest first, with the lines their output differed in", body = [CanaryRun]),
+        (status = 401, description = "Missing or wrong admin token", body = ErrorResponse),
+        (status = 404, description = "No admin token is configured", body = ErrorResponse),
+    )
+)]
+pub async fn list_canary_runs(headers: HeaderMap) -> Result<Json<Vec<CanaryRun>>, ApiError> {
+    authorize(&headers).await?;
+    Ok(Json(canary_log()))
+}
+
+#[utoipa::path(
+    get,
+    path = "/admin/audit",
+    tag = "admin",
+    params(
+        AuditQuery,
+        ("x-admin-token" = String, Header, description = "The server's ADMIN_TOKEN"),
+    ),
+    responses(
+        (status = 200, description = "Audited runs, newest first", body = [AuditEntry]),
+        (status = 401, description = "Missing or wrong admin token", body = ErrorResponse),
+        (status = 404, description = "No admin token or audit log is configured", body = ErrorResponse),
+        (status = 500, description = "The audit log could not be read", body = ErrorResponse),
+    )
+)]
+pub async fn search_audit_log(
+    headers: HeaderMap,
+    Query(query): Query<AuditQuery>,
+) -> Result<Json<Vec<AuditEntry>>, ApiError> {
+    authorize(&headers).await?;
+    let trail = audit_trail()
+        .await
+        .ok_or_else(|| ApiError::NotFound(String::from("runs are not audited")))?;
+    trail
+        .search(&query)
+        .map(Json)
+        .map_err(|err| ApiError::Internal(err.to_string()))
+}
+
+#[utoipa::path(
+    delete,
+    path = "/admin/executions/{id}",
+    tag = "admin",
+    params(
+        ("id" = String, Path, description = "Execution id, as listed"),
+        ("x-admin-token" = String, Header, description = "The server's ADMIN_TOKEN"),
+    ),
+    responses(
+        (status = 204, description = "The execution was killed"),
+        (status = 401, description = "Missing or wrong admin token", body = ErrorResponse),
+        (status = 404, description = "No such execution is running, or no admin token is configured", body = ErrorResponse),
+    )
+)]
+pub async fn kill_execution(
+    headers: HeaderMap,
+    Path(id): Path<String>,
+) -> Result<StatusCode, ApiError> {
+    authorize(&headers).await?;
+    if !kill(&id) {
+        return Err(ApiError::NotFound(format!("execution {}", id)));
+    }
+    Ok(StatusCode::NO_CONTENT)
+}
+
+#[derive(Deserialize, ToSchema)]
+pub struct RegradeRequest {
+    #[serde(flatten)]
+    pub filter: RegradeFilter,
+    // The problem's tests as they now stand.
+    pub tests: Vec<TestCase>,
+}
+
+fn check_regrade(request: &RegradeRequest, max_tests: usize) -> Vec<FieldError> {
+    let mut errors = Vec::new();
+    if request.filter.problem.is_empty() {
+        errors.push(FieldError::new(
+            "problem",
+            "required",
+            "problem must not be empty",
+        ));
+    }
+    if request.tests.is_empty() {
+        errors.push(FieldError::new(
+            "tests",
+            "required",
+            "at least one test is required",
+        ));
+    }
+    if request.tests.len() > max_tests {
+        errors.push(FieldError::new(
+            "tests",
+            "max_items",
+            format!("at most {} tests are allowed", max_tests),
+        ));
+    }
+    errors
+}
+
+#[utoipa::path(
+    post,
+    path = "/admin/regrades",
+    tag = "admin",
+    request_body = RegradeRequest,
+    params(("x-admin-token" = String, Header, description = "The server's ADMIN_TOKEN")),
+    responses(
+        (status = 202, description = "The problem's kept submissions that match, queued at low priority against each test in a job group, whose progress GET /api/v1/job-groups/{id} reports", body = GroupStatus),
+        (status = 400, description = "Malformed request body, no problem, no or too many tests, or a test naming a blob that is not stored", body = ErrorResponse),
+        (status = 401, description = "Missing or wrong admin token", body = ErrorResponse),
+        (status = 404, description = "No admin token is configured", body = ErrorResponse),
+        (status = 500, description = "The job group could not be saved", body = ErrorResponse),
+    )
+)]
+pub async fn regrade_submissions(
+    headers: HeaderMap,
+    ValidJson(mut request): ValidJson<RegradeRequest>,
+) -> Result<(StatusCode, Json<GroupStatus>), ApiError> {
+    authorize(&headers).await?;
+    let app_config = config().await;
+    let mut errors = check_regrade(&request, app_config.judge_max_tests());
+    if errors.is_empty() {
+        errors = resolve_tests(blob_store().await, &mut request.tests, "tests");
+    }
+    if !errors.is_empty() {
+        return Err(ApiError::ValidationError(errors));
+    }
+    let queue = job_queue().await;
+    let group = regrade(
+        queue,
+        store().await,
+        app_config.job_retention(),
+        &request.filter,
+        &request.tests,
+        app_config.toolchain_versions(),
+    )
+    .map_err(|err| ApiError::Internal(format!("failed to save the regrade: {}", err)))?;
+    Ok((StatusCode::ACCEPTED, Json(group.status(queue))))
+}
+
+#[cfg(test)]
+mod admin_tests {
+    use super::*;
+
+    #[test]
+    fn test_check_regrade_wants_a_problem_and_tests() {
+        let request = |problem: &str, tests: usize| RegradeRequest {
+            filter: RegradeFilter {
+                problem: problem.into(),
+                ..RegradeFilter::default()
+            },
+            tests: vec![TestCase::default(); tests],
+        };
+        assert!(check_regrade(&request("sum", 2), 4).is_empty());
+        let rules: Vec<_> = check_regrade(&request("", 5), 4)
+            .into_iter()
+            .map(|err| (err.field, err.rule))
+            .collect();
+        assert_eq!(
+            rules,
+            vec![
+                ("problem".into(), "required".into()),
+                ("tests".into(), "max_items".into()),
+            ]
+        );
+    }
+}
@@ -0,0 +1,182 @@
+use axum::extract::{Multipart, multipart::Field};
+use tempfile::TempDir;
+use utoipa::ToSchema;
+use uuid::Uuid;
+
+use crate::{
+    config::config,
+    infra::{
+        archive::{extract_zip, resolve_entrypoint},
+        compile::compile_lang,
+        disk::execution_zone,
+        error::InfraError,
+        events::Submitter,
+        language::Language,
+        logs::logged,
+        runner::{CompilerWarnings, ExecContext},
+        tier::Feature,
+    },
+};
+
+use super::{
+    compile::{
+        CompilerResponse, admit, admit_run, admit_tier, check_limits, resolve_version,
+        throttle_submission,
+    },
+    error::{ApiError, ErrorResponse, FieldError},
+    extract::{ApiKey, ClientIp},
+    json::PooledJson,
+};
+
+#[derive(ToSchema)]
+pub struct ArchiveUpload {
+    #[schema(value_type = String, format = Binary)]
+    pub archive: Vec<u8>,
+    #[schema(value_type = Language)]
+    pub lang: String,
+    #[schema(example = "main.py")]
+    pub entrypoint: String,
+    pub stdin: Option<String>,
+    #[schema(example = "3.12")]
+    pub version: Option<String>,
+}
+
+pub(super) async fn read_field(mut field: Field<'_>, limit: usize) -> Result<Vec<u8>, ApiError> {
+    let name = field.name().unwrap_or_default().to_string();
+    let mut data = Vec::new();
+    while let Some(chunk) = field
+        .chunk()
+        .await
+        .map_err(|err| ApiError::BadRequest(err.to_string()))?
+    {
+        if data.len() + chunk.len() > limit {
+            return Err(ApiError::PayloadTooLarge(vec![FieldError::new(
+                &name,
+                "max_bytes",
+                format!("{} must be at most {} bytes", name, limit),
+            )]));
+        }
+        data.extend_from_slice(&chunk);
+    }
+    Ok(data)
+}
+
+pub(super) fn text(data: Vec<u8>, name: &str) -> Result<String, ApiError> {
+    String::from_utf8(data).map_err(|_| ApiError::BadRequest(format!("{} must be UTF-8", name)))
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/compile/archive",
+    tag = "compile",
+    request_body(content = ArchiveUpload, content_type = "multipart/form-data"),
+    params(
+        ("x-api-key" = Option<String>, Header, description = "API key that selects the caller's tier"),
+    ),
+    responses(
+        (status = 200, description = "Program ran successfully", body = CompilerResponse),
+        (status = 400, description = "Malformed upload or unsafe archive", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "Program made a system call its seccomp profile blocks, or the API key's tier does not include archive uploads or the program's language", body = ErrorResponse),
+        (status = 408, description = "Execution exceeded the time limit; `timed_out` tells how long it ran and what it wrote until then", body = ErrorResponse),
+        (status = 413, description = "Upload, archive contents or entrypoint exceed their size limits", body = ErrorResponse),
+        (status = 429, description = "Identical submission repeated too often, the tier's rate limit was reached, or too many of the caller's runs are in progress. Also sent, with Retry-After, while the server sheds load", body = ErrorResponse),
+        (status = 500, description = "Compilation or execution failed; `crashed` tells how a program that ran ended and what it wrote", body = ErrorResponse),
+        (status = 503, description = "Compiled languages are paused while disk space is low", body = ErrorResponse),
+        (status = 507, description = "Program wrote more than the per-execution disk quota or its language's output limit", body = ErrorResponse),
+    )
+)]
+pub async fn compile_archive(
+    ApiKey(api_key): ApiKey,
+    ClientIp(client_ip): ClientIp,
+    mut multipart: Multipart,
+) -> Result<PooledJson<CompilerResponse>, ApiError> {
+    let tier = admit_tier(api_key.as_deref(), &client_ip, &[Feature::Archive]).await?;
+    let app_config = config().await;
+    let max_bytes = app_config.upload_max_bytes();
+
+    let (mut archive, mut lang, mut entrypoint, mut stdin) = (None, None, None, String::new());
+    let mut version = None;
+    while let Some(field) = multipart
+        .next_field()
+        .await
+        .map_err(|err| ApiError::BadRequest(err.to_string()))?
+    {
+        match field.name().unwrap_or_default() {
+            "archive" => archive = Some(read_field(field, max_bytes).await?),
+            "lang" => lang = Some(text(read_field(field, max_bytes).await?, "lang")?),
+            "entrypoint" => {
+                entrypoint = Some(text(read_field(field, max_bytes).await?, "entrypoint")?)
+            }
+            "version" => version = Some(text(read_field(field, max_bytes).await?, "version")?),
+            "stdin" => {
+                stdin = text(
+                    read_field(field, app_config.stdin_max_bytes()).await?,
+                    "stdin",
+                )?
+            }
+            _ => {}
+        }
+    }
+
+    let archive = archive.ok_or_else(|| ApiError::BadRequest("missing field `archive`".into()))?;
+    let lang = lang.ok_or_else(|| ApiError::BadRequest("missing field `lang`".into()))?;
+    let entrypoint =
+        entrypoint.ok_or_else(|| ApiError::BadRequest("missing field `entrypoint`".into()))?;
+    let toolchain = admit(&lang)?;
+    let version = resolve_version(toolchain, version.as_deref()).await?;
+    let _slot = admit_run(api_key.as_deref(), tier, toolchain).await?;
+    throttle_submission(&client_ip, &lang, &archive).await?;
+
+    let workspace = TempDir::new_in(execution_zone()).map_err(InfraError::from)?;
+    let invalid = |err: InfraError| match err {
+        InfraError::InvalidArchive(msg) => ApiError::BadRequest(msg),
+        InfraError::ArchiveTooLarge(msg) => {
+            ApiError::PayloadTooLarge(vec![FieldError::new("archive", "max_size", msg)])
+        }
+        err => ApiError::from(err),
+    };
+    extract_zip(&archive, workspace.path(), app_config.archive_limits()).map_err(invalid)?;
+    let entry_path = resolve_entrypoint(workspace.path(), &entrypoint).map_err(invalid)?;
+    let content = std::fs::read_to_string(&entry_path).map_err(InfraError::from)?;
+    check_limits(&content, &stdin, tier).await?;
+
+    let mut ctx = ExecContext::default().with_workspace(workspace.path().to_path_buf());
+    if let Some(tier) = tier {
+        ctx = tier.apply(ctx);
+    }
+    if let Some(version) = version {
+        ctx = ctx.with_toolchain_dir(version.dir.clone());
+    }
+    if let Some(var) = toolchain.module_path_env() {
+        ctx = ctx.with_env(var, &workspace.path().to_string_lossy());
+    }
+    let warnings = CompilerWarnings::default();
+    let ctx = ctx.with_compiler_warnings(warnings.clone());
+    let id = Uuid::new_v4().to_string();
+    let submitter = Submitter::new(api_key.as_deref(), &client_ip);
+    let res = logged(
+        &id,
+        &lang,
+        &content,
+        &submitter,
+        compile_lang(&lang, &content, &stdin, &ctx),
+    )
+    .await?;
+
+    Ok(PooledJson(CompilerResponse {
+        id: Some(id),
+        lang: None,
+        result: res,
+        result_url: None,
+        result_bytes: None,
+        warnings: warnings.take(),
+        files: None,
+        images: None,
+        transcript: None,
+        version: version.map(|version| version.name.clone()),
+        coverage: None,
+        sanitizer: None,
+        profile: None,
+    }))
+}
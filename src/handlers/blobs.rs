@@ -0,0 +1,168 @@
+use axum::{
+    Json,
+    body::Bytes,
+    extract::Path,
+    http::{StatusCode, header},
+    response::{IntoResponse, Response},
+};
+use serde::Serialize;
+use utoipa::ToSchema;
+
+use crate::infra::{
+    blobs::{BlobStore, blob_store},
+    error::InfraError,
+    judge::TestCase,
+};
+
+use super::error::{ApiError, ErrorResponse, FieldError};
+
+#[derive(Debug, Serialize, ToSchema)]
+pub struct StoredBlob {
+    // Hex SHA-256 of the contents, which judge tests refer to it by.
+    #[schema(example = "d287bb7f9d15abdc5b6e98536263815744b6ef21c8f3c839fc434ca70d8efe99")]
+    pub hash: String,
+    #[schema(example = 8)]
+    pub size: usize,
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/blobs",
+    tag = "compile",
+    request_body(content = Vec<u8>, content_type = "application/octet-stream"),
+    responses(
+        (status = 201, description = "The upload is kept under the hash of its contents, until it is the least recently used once the store is full", body = StoredBlob),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 413, description = "The upload exceeds BLOB_MAX_FILE_BYTES"),
+    )
+)]
+pub async fn upload_blob(body: Bytes) -> Result<(StatusCode, Json<StoredBlob>), ApiError> {
+    let hash = blob_store().await.put(&body).map_err(InfraError::from)?;
+    let blob = StoredBlob {
+        hash,
+        size: body.len(),
+    };
+    Ok((StatusCode::CREATED, Json(blob)))
+}
+
+#[utoipa::path(
+    get,
+    path = "/api/v1/blobs/{hash}",
+    tag = "compile",
+    params(("hash" = String, Path, description = "Hash returned by the upload")),
+    responses(
+        (status = 200, description = "The blob's contents. A HEAD request checks whether it has to be uploaded again", content_type = "application/octet-stream", body = Vec<u8>),
+        (status = 404, description = "Unknown or evicted blob", body = ErrorResponse),
+    )
+)]
+pub async fn get_blob(Path(hash): Path<String>) -> Result<Response, ApiError> {
+    match blob_store().await.get(&hash).map_err(InfraError::from)? {
+        Some(bytes) => Ok((
+            [(header::CONTENT_TYPE, "application/octet-stream")],
+            bytes,
+        )
+            .into_response()),
+        None => Err(ApiError::NotFound(format!("blob {}", hash))),
+    }
+}
+
+// Fills in the stdin and expected output of tests that give them by hash.
+// `field` names the tests in the errors, one for each hash that is given
+// alongside the text it stands for or that names no blob.
+pub fn resolve_tests(blobs: &BlobStore, tests: &mut [TestCase], field: &str) -> Vec<FieldError> {
+    let mut errors = Vec::new();
+    let mut fetch = |hash: &str, name: String, given: bool| -> Option<String> {
+        if given {
+            errors.push(FieldError::new(
+                &name,
+                "exclusive",
+                "give either the text or its hash, not both",
+            ));
+            return None;
+        }
+        match blobs.get(hash) {
+            Ok(Some(bytes)) => match String::from_utf8(bytes) {
+                Ok(text) => Some(text),
+                Err(_) => {
+                    errors.push(FieldError::new(&name, "utf8", "the blob is not UTF-8 text"));
+                    None
+                }
+            },
+            Ok(None) => {
+                errors.push(FieldError::new(
+                    &name,
+                    "unknown",
+                    format!("no blob {} is stored; upload it again", hash),
+                ));
+                None
+            }
+            Err(err) => {
+                tracing::warn!("failed to read blob {}: {}", hash, err);
+                errors.push(FieldError::new(&name, "unreadable", "the blob could not be read"));
+                None
+            }
+        }
+    };
+    for (i, test) in tests.iter_mut().enumerate() {
+        if let Some(hash) = test.stdin_hash.take() {
+            let name = format!("{}[{}].stdin_hash", field, i);
+            if let Some(stdin) = fetch(&hash, name, !test.stdin.is_empty()) {
+                test.stdin = stdin;
+            }
+        }
+        if let Some(hash) = test.expected_output_hash.take() {
+            let name = format!("{}[{}].expected_output_hash", field, i);
+            let given = test.expected_output.is_some();
+            if let Some(expected) = fetch(&hash, name, given) {
+                test.expected_output = Some(expected);
+            }
+        }
+    }
+    errors
+}
+
+#[cfg(test)]
+mod blobs_tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_resolve_tests_fetches_blobs_by_hash() {
+        let dir = TempDir::new().unwrap();
+        let blobs = BlobStore::open(dir.path(), 1024).unwrap();
+        let input = blobs.put(b"3 4\n").unwrap();
+        let expected = blobs.put(b"7\n").unwrap();
+        let binary = blobs.put(&[0xff, 0xfe]).unwrap();
+        let mut tests = vec![
+            TestCase {
+                stdin_hash: Some(input.clone()),
+                expected_output_hash: Some(expected),
+                ..TestCase::default()
+            },
+            TestCase {
+                stdin: "1".into(),
+                stdin_hash: Some(input),
+                expected_output_hash: Some("0".repeat(64)),
+                ..TestCase::default()
+            },
+            TestCase {
+                stdin_hash: Some(binary),
+                ..TestCase::default()
+            },
+        ];
+        let errors: Vec<_> = resolve_tests(&blobs, &mut tests, "tests")
+            .into_iter()
+            .map(|err| (err.field, err.rule))
+            .collect();
+        assert_eq!(
+            errors,
+            vec![
+                ("tests[1].stdin_hash".into(), "exclusive".into()),
+                ("tests[1].expected_output_hash".into(), "unknown".into()),
+                ("tests[2].stdin_hash".into(), "utf8".into()),
+            ]
+        );
+        assert_eq!(tests[0].stdin, "3 4\n");
+        assert_eq!(tests[0].expected_output.as_deref(), Some("7\n"));
+    }
+}
@@ -0,0 +1,254 @@
+use axum::{
+    Json,
+    extract::Path,
+    http::{StatusCode, header},
+    response::{IntoResponse, Response},
+};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+
+use crate::config::config;
+use crate::infra::{
+    artifacts::{self, Artifact},
+    cross,
+    error::InfraError,
+    events::Submitter,
+    language::Language,
+    runner::ExecContext,
+    tier::Feature,
+    toolchain::Toolchain,
+};
+
+use super::{
+    compile::{
+        admit, admit_run, admit_tier, check_compiler_flags, check_limits, screen_submission,
+        throttle_submission,
+    },
+    error::{ApiError, ErrorResponse, FieldError},
+    extract::{ApiKey, ClientIp, ValidJson},
+};
+
+#[derive(Deserialize, ToSchema)]
+pub struct BuildRequest {
+    #[schema(example = "go")]
+    pub lang: String,
+    #[schema(example = "package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n")]
+    pub content: String,
+    // A GOOS/GOARCH pair for Go or a target triple for C; the server's own
+    // platform when left out.
+    #[schema(example = "linux/arm64")]
+    pub target: Option<String>,
+    #[serde(default)]
+    pub compiler_flags: Vec<String>,
+    // Keep the executable for a while and respond with where to download
+    // it, instead of with the executable itself.
+    #[serde(default)]
+    pub keep: bool,
+}
+
+#[derive(Debug, Serialize, ToSchema)]
+pub struct KeptArtifact {
+    #[schema(example = "9f1c2e7a4b3d4c5e8f6a7b8c9d0e1f2a")]
+    pub id: String,
+    #[schema(example = "/api/v1/artifacts/9f1c2e7a4b3d4c5e8f6a7b8c9d0e1f2a")]
+    pub url: String,
+    #[schema(example = "main")]
+    pub file_name: String,
+    pub expires_at: DateTime<Utc>,
+}
+
+fn validate(payload: &BuildRequest) -> Result<Language, ApiError> {
+    let toolchain = admit(&payload.lang)?;
+    let language = match toolchain {
+        Toolchain::Builtin(language) if !cross::targets(language).is_empty() => language,
+        _ => {
+            return Err(ApiError::ValidationError(vec![FieldError::new(
+                "lang",
+                "unsupported",
+                format!("{} programs cannot be built for download", toolchain),
+            )]));
+        }
+    };
+    let mut errors = check_compiler_flags(toolchain, &payload.compiler_flags);
+    let targets = cross::targets(language);
+    if let Some(target) = payload
+        .target
+        .as_deref()
+        .filter(|target| !targets.contains(target))
+    {
+        errors.push(
+            FieldError::new(
+                "target",
+                "oneof",
+                format!("{} cannot be built for {}", language, target),
+            )
+            .allowed(targets.iter()),
+        );
+    }
+    if errors.is_empty() {
+        Ok(language)
+    } else {
+        Err(ApiError::ValidationError(errors))
+    }
+}
+
+fn download(artifact: Artifact) -> Response {
+    let disposition = format!("attachment; filename=\"{}\"", artifact.file_name);
+    (
+        [
+            (
+                header::CONTENT_TYPE,
+                String::from("application/octet-stream"),
+            ),
+            (header::CONTENT_DISPOSITION, disposition),
+        ],
+        artifact.bytes,
+    )
+        .into_response()
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/build",
+    tag = "compile",
+    request_body = BuildRequest,
+    params(
+        ("x-api-key" = Option<String>, Header, description = "API key that selects the caller's tier"),
+    ),
+    responses(
+        (status = 200, description = "The compiled executable; the program is never run", content_type = "application/octet-stream", body = Vec<u8>),
+        (status = 201, description = "The executable was kept for download, as `keep` asked", body = KeptArtifact),
+        (status = 400, description = "Malformed request body, or a language or target that cannot be built", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "The API key's tier does not include builds or the program's language", body = ErrorResponse),
+        (status = 408, description = "Compilation exceeded the time limit", body = ErrorResponse),
+        (status = 413, description = "Request body or code exceeds its size limit", body = ErrorResponse),
+        (status = 429, description = "Identical submission repeated too often, the tier's rate limit was reached, or too many of the caller's runs are in progress. Also sent, with Retry-After, while the server sheds load", body = ErrorResponse),
+        (status = 500, description = "Compilation failed", body = ErrorResponse),
+        (status = 503, description = "Compiled languages are paused while disk space is low", body = ErrorResponse),
+    )
+)]
+pub async fn build(
+    ApiKey(api_key): ApiKey,
+    ClientIp(client_ip): ClientIp,
+    ValidJson(payload): ValidJson<BuildRequest>,
+) -> Result<Response, ApiError> {
+    let tier = admit_tier(api_key.as_deref(), &client_ip, &[Feature::Builds]).await?;
+    check_limits(&payload.content, "", tier).await?;
+    let language = validate(&payload)?;
+    let ttl = config().await.artifact_ttl();
+    if payload.keep && ttl.is_zero() {
+        return Err(ApiError::ValidationError(vec![FieldError::new(
+            "keep",
+            "unsupported",
+            "this instance does not keep builds",
+        )]));
+    }
+    let submitter = Submitter::new(api_key.as_deref(), &client_ip);
+    screen_submission(&submitter, &payload.lang, &payload.content).await?;
+    let _slot = admit_run(api_key.as_deref(), tier, Toolchain::Builtin(language)).await?;
+    throttle_submission(&client_ip, &payload.lang, payload.content.as_bytes()).await?;
+
+    let ctx = ExecContext::default()
+        .with_compile_timeout(config().await.exec_timeout())
+        .with_compiler_flags(payload.compiler_flags.clone());
+    let artifact =
+        cross::build(language, &payload.content, payload.target.as_deref(), &ctx).await?;
+    if !payload.keep {
+        return Ok(download(artifact));
+    }
+    let id = artifacts::keep(&artifact).map_err(InfraError::from)?;
+    let kept = KeptArtifact {
+        url: artifacts::url(&id),
+        id,
+        file_name: artifact.file_name,
+        expires_at: Utc::now() + chrono::Duration::from_std(ttl).unwrap_or_default(),
+    };
+    Ok((StatusCode::CREATED, Json(kept)).into_response())
+}
+
+#[utoipa::path(
+    get,
+    path = "/api/v1/artifacts/{id}",
+    tag = "compile",
+    params(("id" = String, Path, description = "Artifact id from a kept build, a file link or `result_url`")),
+    responses(
+        (status = 200, description = "The kept executable, file or output", content_type = "application/octet-stream", body = Vec<u8>),
+        (status = 404, description = "Unknown or expired artifact", body = ErrorResponse),
+    )
+)]
+pub async fn get_artifact(Path(id): Path<String>) -> Result<Response, ApiError> {
+    let ttl = config().await.artifact_ttl();
+    match artifacts::load(&id, ttl).map_err(InfraError::from)? {
+        Some(artifact) => Ok(download(artifact)),
+        None => Err(ApiError::NotFound(format!("artifact {}", id))),
+    }
+}
+
+#[cfg(test)]
+mod build_tests {
+    use super::*;
+
+    fn request(lang: &str, target: Option<&str>) -> BuildRequest {
+        BuildRequest {
+            lang: lang.to_string(),
+            content: String::new(),
+            target: target.map(str::to_string),
+            compiler_flags: Vec::new(),
+            keep: false,
+        }
+    }
+
+    fn rules(err: ApiError) -> Vec<(String, String)> {
+        match err {
+            ApiError::ValidationError(errors) => errors
+                .into_iter()
+                .map(|err| (err.field, err.rule))
+                .collect(),
+            other => panic!("unexpected error: {}", other),
+        }
+    }
+
+    #[test]
+    fn test_validate_checks_target_against_language() {
+        assert_eq!(validate(&request("go", None)).unwrap(), Language::GO);
+        assert!(validate(&request("go", Some("windows/amd64"))).is_ok());
+        assert!(validate(&request("c", Some("aarch64-linux-musl"))).is_ok());
+        assert_eq!(
+            rules(validate(&request("go", Some("aarch64-linux-musl"))).unwrap_err()),
+            vec![("target".into(), "oneof".into())]
+        );
+        assert_eq!(
+            rules(validate(&request("python", None)).unwrap_err()),
+            vec![("lang".into(), "unsupported".into())]
+        );
+    }
+
+    #[test]
+    fn test_validate_checks_compiler_flags() {
+        let mut req = request("c", None);
+        req.compiler_flags = vec!["-O2".into(), "-fplugin=evil.so".into()];
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![("compiler_flags[1]".into(), "oneof".into())]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_get_artifact_serves_kept_builds() {
+        let artifact = Artifact {
+            file_name: String::from("main"),
+            bytes: b"\x7fELF".to_vec(),
+        };
+        let id = artifacts::keep(&artifact).unwrap();
+        let response = get_artifact(Path(id)).await.unwrap();
+        assert_eq!(
+            response.headers()[header::CONTENT_DISPOSITION],
+            "attachment; filename=\"main\""
+        );
+
+        let missing = get_artifact(Path(String::from("0123456789abcdef0123456789abcdef"))).await;
+        assert!(matches!(missing, Err(ApiError::NotFound(_))));
+    }
+}
@@ -0,0 +1,15 @@
+use axum::Json;
+
+use crate::infra::calibration::{Calibration, calibration};
+
+#[utoipa::path(
+    get,
+    path = "/api/v1/calibration",
+    tag = "health",
+    responses(
+        (status = 200, description = "Benchmark result and the factor applied to time limits on this host", body = Calibration),
+    )
+)]
+pub async fn get_calibration() -> Json<Calibration> {
+    Json(*calibration().await)
+}
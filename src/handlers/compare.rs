@@ -0,0 +1,248 @@
+use std::path::{Path, PathBuf};
+
+use axum::Json;
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+
+use crate::config::config;
+use crate::infra::{
+    compare::{Comparison, diff, run_checker},
+    error::InfraError,
+    interactive::{Verdict, find_executable},
+    tier::Feature,
+};
+
+use super::{
+    compile::admit_tier,
+    error::{ApiError, ErrorResponse, FieldError},
+    extract::{ApiKey, ClientIp, ValidJson},
+};
+
+const DEFAULT_EPSILON: f64 = 1e-6;
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize, ToSchema)]
+#[serde(rename_all = "snake_case")]
+pub enum CompareMode {
+    // Byte for byte.
+    Exact,
+    // Line by line, ignoring trailing whitespace, as /api/v1/judge compares.
+    #[default]
+    Lines,
+    // Whitespace-separated tokens, however they are spaced.
+    Token,
+    // Tokens, with numbers accepted within `epsilon`.
+    Float,
+    // One of the server's checkers decides.
+    Checker,
+}
+
+#[derive(Deserialize, ToSchema)]
+pub struct CompareRequest {
+    #[schema(example = "0.333333\n")]
+    pub expected: String,
+    #[schema(example = "0.3333331\n")]
+    pub actual: String,
+    #[serde(default)]
+    pub mode: CompareMode,
+    // How far apart numbers may be in float mode, absolutely or relative to
+    // the expected number, whichever is looser. Defaults to 1e-6.
+    #[schema(example = 1e-6)]
+    pub epsilon: Option<f64>,
+    // Name of one of the server's checkers, for checker mode.
+    #[schema(example = "sum")]
+    pub checker: Option<String>,
+    // The test's input, handed to the checker.
+    #[serde(default)]
+    pub input: String,
+}
+
+#[derive(Debug, Serialize, ToSchema)]
+pub struct CompareResponse {
+    pub verdict: Verdict,
+    // What the checker printed to stderr.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = "ok 1 number")]
+    pub message: Option<String>,
+    // The lines that differ, expected ones marked `-` and actual ones `+`;
+    // empty when the output is accepted.
+    #[schema(example = json!(["-0.333333", "+0.3333331"]))]
+    pub diff: Vec<String>,
+}
+
+enum Comparer {
+    Builtin(Comparison),
+    Checker(PathBuf),
+}
+
+fn validate(payload: &CompareRequest, checkers_dir: &Path) -> Result<Comparer, ApiError> {
+    let mut errors = Vec::new();
+    if let Some(epsilon) = payload.epsilon {
+        if payload.mode != CompareMode::Float {
+            errors.push(FieldError::new(
+                "epsilon",
+                "unsupported",
+                "only used in float mode",
+            ));
+        } else if !epsilon.is_finite() || epsilon < 0.0 {
+            errors.push(FieldError::new(
+                "epsilon",
+                "range",
+                "must be a number no less than 0",
+            ));
+        }
+    }
+    let checker = match (&payload.checker, payload.mode) {
+        (Some(name), CompareMode::Checker) => {
+            let checker = find_executable(checkers_dir, name);
+            if checker.is_none() {
+                errors.push(FieldError::new(
+                    "checker",
+                    "oneof",
+                    format!("no checker named {:?}", name),
+                ));
+            }
+            checker
+        }
+        (None, CompareMode::Checker) => {
+            errors.push(FieldError::new(
+                "checker",
+                "required",
+                "checker mode needs a checker",
+            ));
+            None
+        }
+        (Some(_), _) => {
+            errors.push(FieldError::new(
+                "checker",
+                "unsupported",
+                "only used in checker mode",
+            ));
+            None
+        }
+        (None, _) => None,
+    };
+    if !errors.is_empty() {
+        return Err(ApiError::ValidationError(errors));
+    }
+    Ok(match payload.mode {
+        CompareMode::Exact => Comparer::Builtin(Comparison::Exact),
+        CompareMode::Lines => Comparer::Builtin(Comparison::Lines),
+        CompareMode::Token => Comparer::Builtin(Comparison::Tokens),
+        CompareMode::Float => Comparer::Builtin(Comparison::Float {
+            epsilon: payload.epsilon.unwrap_or(DEFAULT_EPSILON),
+        }),
+        CompareMode::Checker => Comparer::Checker(checker.expect("validated to be found")),
+    })
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/compare",
+    tag = "compile",
+    request_body = CompareRequest,
+    params(
+        ("x-api-key" = Option<String>, Header, description = "API key that selects the caller's tier"),
+    ),
+    responses(
+        (status = 200, description = "The output was compared; a mismatch shows in `verdict` and `diff`", body = CompareResponse),
+        (status = 400, description = "Malformed request body, unknown checker, or options the mode does not use", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "The API key's tier does not include judge runs", body = ErrorResponse),
+        (status = 413, description = "Request body exceeds its size limit", body = ErrorResponse),
+        (status = 429, description = "The tier's rate limit was reached", body = ErrorResponse),
+    )
+)]
+pub async fn compare(
+    ApiKey(api_key): ApiKey,
+    ClientIp(client_ip): ClientIp,
+    ValidJson(payload): ValidJson<CompareRequest>,
+) -> Result<Json<CompareResponse>, ApiError> {
+    admit_tier(api_key.as_deref(), &client_ip, &[Feature::Judge]).await?;
+    let comparer = validate(&payload, config().await.checkers_dir())?;
+    let (verdict, message) = match comparer {
+        Comparer::Builtin(comparison) => {
+            (comparison.verdict(&payload.expected, &payload.actual), None)
+        }
+        Comparer::Checker(checker) => {
+            let judgement =
+                run_checker(&checker, &payload.input, &payload.expected, &payload.actual)
+                    .await
+                    .map_err(InfraError::from)?;
+            (judgement.verdict, Some(judgement.message))
+        }
+    };
+    let diff = match verdict {
+        Verdict::Accepted => Vec::new(),
+        _ => diff(&payload.expected, &payload.actual),
+    };
+    Ok(Json(CompareResponse {
+        verdict,
+        message: message.filter(|message| !message.is_empty()),
+        diff,
+    }))
+}
+
+#[cfg(test)]
+mod compare_tests {
+    use super::*;
+
+    fn request(mode: CompareMode, epsilon: Option<f64>, checker: Option<&str>) -> CompareRequest {
+        CompareRequest {
+            expected: String::from("1\n"),
+            actual: String::from("1\n"),
+            mode,
+            epsilon,
+            checker: checker.map(str::to_string),
+            input: String::new(),
+        }
+    }
+
+    fn rules(result: Result<Comparer, ApiError>) -> Vec<(String, String)> {
+        match result {
+            Err(ApiError::ValidationError(errors)) => errors
+                .into_iter()
+                .map(|err| (err.field, err.rule))
+                .collect(),
+            Err(other) => panic!("unexpected error: {}", other),
+            Ok(_) => Vec::new(),
+        }
+    }
+
+    #[test]
+    fn test_validate_checks_options_against_the_mode() {
+        let dir = Path::new("/nonexistent");
+        let float = validate(&request(CompareMode::Float, None, None), dir);
+        assert!(matches!(
+            float,
+            Ok(Comparer::Builtin(Comparison::Float { epsilon })) if epsilon == DEFAULT_EPSILON
+        ));
+        assert_eq!(
+            rules(validate(
+                &request(CompareMode::Lines, Some(0.1), Some("sum")),
+                dir
+            )),
+            vec![
+                ("epsilon".into(), "unsupported".into()),
+                ("checker".into(), "unsupported".into()),
+            ]
+        );
+        assert_eq!(
+            rules(validate(
+                &request(CompareMode::Float, Some(-1.0), None),
+                dir
+            )),
+            vec![("epsilon".into(), "range".into())]
+        );
+        assert_eq!(
+            rules(validate(&request(CompareMode::Checker, None, None), dir)),
+            vec![("checker".into(), "required".into())]
+        );
+        assert_eq!(
+            rules(validate(
+                &request(CompareMode::Checker, None, Some("sum")),
+                dir
+            )),
+            vec![("checker".into(), "oneof".into())]
+        );
+    }
+}
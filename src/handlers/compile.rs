@@ -1,90 +1,1970 @@
-use std::str::FromStr;
-
-use crate::infra::{compile::compile_lang, error::InfraError};
-use axum::Json;
+use crate::infra::{
+    canary::{self, canary},
+    compile::compile_lang,
+    coverage::{self, CoverageReport},
+    detect::detect,
+    disk::{self, execution_zone},
+    error::InfraError,
+    events::Submitter,
+    idempotency::{self, Claim, Reservation},
+    images::{HEADLESS_ENV, ImageAttachment, collect_images},
+    imports::import_policy,
+    jobs::JobSpec,
+    language::Language,
+    load,
+    logs::logged,
+    matrix::ToolchainVersion,
+    metrics,
+    outputs::{FileContents, attach_contents, spill_output},
+    policy::{PolicyAction, audit, submission_policy},
+    profile::{self, ProfileReport},
+    quickjs::JsEngine,
+    runner::{CompilerWarnings, ExecContext, INHERITED_ENV, OutputChunk, OutputEncoding},
+    sanitizer::{self, SanitizerReport},
+    scheduler::{ANONYMOUS_TENANT, IDEMPOTENCY_HEADER, Priority},
+    store::store,
+    tenants::{RunSlot, tenant_id, tenants},
+    throttle::{Verdict, throttle},
+    tier::{Feature, Tier, tiers},
+    toolchain::Toolchain,
+    transcript::{TranscriptEntry, TranscriptRecorder, UNBUFFERED_ENV},
+    wasm::Backend,
+    workspace::{FileEntry, Snapshot},
+};
+use crate::config::config;
+use std::collections::BTreeMap;
+use axum::{
+    http::StatusCode,
+    response::{IntoResponse, Response},
+};
 use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use tempfile::TempDir;
+use tokio::sync::mpsc::UnboundedSender;
+use utoipa::ToSchema;
+use uuid::Uuid;
 
-use super::error::ApiError;
+use super::{
+    error::{ApiError, ErrorResponse, FieldError},
+    extract::{ApiKey, ClientIp, IdempotencyKey, ResponseFormat, ValidBody},
+    formats::{
+        LiveRun, event_stream, event_stream_replay, live, ndjson, ndjson_replay, plain_text,
+        plain_text_error,
+    },
+    json::{EncodedLen, PooledJson, string_len},
+    msgpack::PooledMsgpack,
+};
 
-#[derive(Serialize)]
+#[derive(Serialize, Deserialize, ToSchema)]
 pub struct CompilerResponse {
-    result: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub id: Option<String>,
+    // The language read from the code, when the request left `lang` out.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = "python")]
+    pub lang: Option<String>,
+    #[schema(example = "hello world\n")]
+    pub result: String,
+    // Set when the output passed `inline_output_bytes`: where all of it is
+    // downloaded from, and how long `result` would have been.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = "/api/v1/artifacts/9f1c2e7a4b3d4c5e8f6a7b8c9d0e1f2a")]
+    pub result_url: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = 52428800)]
+    pub result_bytes: Option<usize>,
+    // What the compiler printed while still building the program.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = "main.cpp:3:9: warning: unused variable 'x' [-Wunused-variable]\n")]
+    pub warnings: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub files: Option<Vec<FileEntry>>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub images: Option<Vec<ImageAttachment>>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub transcript: Option<Vec<TranscriptEntry>>,
+    // The installed version the program ran on, when the request named one.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = "3.12.4")]
+    pub version: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub coverage: Option<CoverageReport>,
+    // What the sanitizers caught in a `debug` run; empty if nothing.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub sanitizer: Option<Vec<SanitizerReport>>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub profile: Option<ProfileReport>,
+}
+
+// Field names, the id and per-entry metadata; only the output itself and
+// attachments are large.
+const RESPONSE_OVERHEAD: usize = 128;
+const ENTRY_OVERHEAD: usize = 96;
+
+impl EncodedLen for CompilerResponse {
+    fn encoded_len(&self) -> usize {
+        let files = self.files.iter().flatten().map(|file| {
+            let contents = file.data.iter().chain(&file.url).map(String::len);
+            file.path.len() + contents.sum::<usize>()
+        });
+        let images = self
+            .images
+            .iter()
+            .flatten()
+            .map(|image| image.path.len() + image.data.len());
+        let transcript = self
+            .transcript
+            .iter()
+            .flatten()
+            .map(|entry| string_len(entry.chunk.text()));
+        let coverage = self
+            .coverage
+            .iter()
+            .flat_map(|report| &report.files)
+            .map(|file| file.file.len());
+        let sanitizer = self
+            .sanitizer
+            .iter()
+            .flatten()
+            .map(|report| report.message.len() + report.stack.len() * ENTRY_OVERHEAD);
+        let profile = self
+            .profile
+            .iter()
+            .flat_map(|report| &report.hotspots)
+            .map(|hotspot| hotspot.function.len());
+        let entries: usize = files
+            .chain(images)
+            .chain(transcript)
+            .chain(coverage)
+            .chain(sanitizer)
+            .chain(profile)
+            .map(|len| len + ENTRY_OVERHEAD)
+            .sum();
+        RESPONSE_OVERHEAD + string_len(&self.result) + entries
+    }
 }
 
-#[derive(Deserialize)]
+#[derive(Deserialize, ToSchema)]
 pub struct CompilerRequest {
-    lang: String,
-    content: String,
-    #[serde(default)]
-    stdin: String,
-}
-
-#[derive(Debug, Serialize, Deserialize)]
-#[serde(rename_all = "lowercase")]
-enum Language {
-    Python,
-    JAVASCRIPT,
-    TYPESCRIPT,
-    C,
-    CPP,
-    RUST,
-    NIX,
-    GO,
-    ZIG,
-    D,
-    SCALA,
-    GROOVY,
-    DART,
-    RUBY,
-    LUA,
-    JULIA,
-    R,
-    PERL,
-    CRYSTAL,
-    HASKELL,
-    BRAINFUCK,
-}
-
-impl FromStr for Language {
-    type Err = InfraError;
-
-    fn from_str(s: &str) -> Result<Self, Self::Err> {
-        match s.to_lowercase().as_str() {
-            "python" => Ok(Language::Python),
-            "javascript" => Ok(Language::JAVASCRIPT),
-            "typescript" => Ok(Language::TYPESCRIPT),
-            "c" => Ok(Language::C),
-            "cpp" => Ok(Language::CPP),
-            "rust" => Ok(Language::RUST),
-            "nix" => Ok(Language::NIX),
-            "go" => Ok(Language::GO),
-            "zig" => Ok(Language::ZIG),
-            "d" => Ok(Language::D),
-            "scala" => Ok(Language::SCALA),
-            "groovy" => Ok(Language::GROOVY),
-            "dart" => Ok(Language::DART),
-            "ruby" => Ok(Language::RUBY),
-            "lua" => Ok(Language::LUA),
-            "julia" => Ok(Language::JULIA),
-            "r" => Ok(Language::R),
-            "perl" => Ok(Language::PERL),
-            "crystal" => Ok(Language::CRYSTAL),
-            "haskell" => Ok(Language::HASKELL),
-            "brainfuck" => Ok(Language::BRAINFUCK),
-            _ => Err(InfraError::UnsupportedLanguage(
-                format!("{} language is not supported", s).into(),
-            )),
+    // Left out or empty, the language is detected from the code: a shebang,
+    // `package main`, `#include` and the like.
+    #[serde(default)]
+    #[schema(value_type = Language)]
+    pub lang: String,
+    #[schema(example = "print(\"hello world\")")]
+    pub content: String,
+    #[serde(default)]
+    pub stdin: String,
+    #[serde(default)]
+    #[schema(example = json!(["--verbose", "input.txt"]))]
+    pub args: Vec<String>,
+    #[serde(default)]
+    #[schema(example = json!({"LOG_LEVEL": "debug"}))]
+    pub env: BTreeMap<String, String>,
+    #[serde(default)]
+    #[schema(example = json!(["-O2", "-std=c++20"]))]
+    pub compiler_flags: Vec<String>,
+    #[serde(default)]
+    pub collect_files: bool,
+    // With `collect_files`, also return what is in the files: `inline`
+    // base64-encodes them into the response, `link` keeps them for download
+    // from /api/v1/artifacts/{id}. Limited by FILE_MAX_COUNT and
+    // FILE_MAX_BYTES; files past the limits are listed without contents.
+    #[serde(default)]
+    pub file_contents: Option<FileContents>,
+    // Return images the program writes to its working directory, such as
+    // saved plots, base64-encoded.
+    #[serde(default)]
+    pub collect_images: bool,
+    // Also return stdout and stderr merged into one stream, in the order the
+    // program wrote them.
+    #[serde(default)]
+    pub transcript: bool,
+    // Run on the embedded WebAssembly runtime instead of as a native process.
+    // Only languages that compile to WASI support it.
+    #[serde(default)]
+    pub backend: Backend,
+    // JavaScript and TypeScript only: `bun`, `node` or `deno`, `embedded`
+    // for the built-in interpreter with no Node APIs, or `auto` to use it
+    // when the script needs none. Defaults to the instance's JS_ENGINE.
+    #[serde(default, alias = "runtime")]
+    pub js_engine: Option<JsEngine>,
+    // A configured toolchain version, exactly or by prefix: "3.12" runs on
+    // the newest installed 3.12.x. The host's default toolchain otherwise.
+    #[serde(default)]
+    #[schema(example = "3.12")]
+    pub version: Option<String>,
+    // Packages the program imports, from those the instance provides for
+    // the language. Nothing is downloaded at run time.
+    #[serde(default)]
+    #[schema(example = json!(["numpy", "requests"]))]
+    pub dependencies: Vec<String>,
+    // SQL only: statements that seed the program's fresh database before it
+    // runs, up to just under 128 KiB. Whatever they print is left out of the
+    // result.
+    #[serde(default)]
+    #[schema(example = "CREATE TABLE users (name TEXT); INSERT INTO users VALUES ('Ada');")]
+    pub setup: String,
+    // Measure which statements the run executed: coverage.py for Python,
+    // `go run -cover` for Go and c8 on Node for JavaScript.
+    #[serde(default)]
+    pub coverage: bool,
+    // C and C++ only: build with AddressSanitizer and UBSan and debug info.
+    // A run the sanitizers stop still returns its output, with the reports.
+    #[serde(default)]
+    pub debug: bool,
+    // Sample the run's CPU use and return the hottest functions: pprof for
+    // Go, `node --prof` for JavaScript and `perf` for C, C++ and Rust.
+    #[serde(default)]
+    pub profile: bool,
+    // `base64` returns `result` base64-encoded, for programs whose output
+    // is binary or not UTF-8.
+    #[serde(default)]
+    pub output_encoding: OutputEncoding,
+    // Output longer than this is kept for download from
+    // /api/v1/artifacts/{id}, and `result` holds only its first bytes.
+    #[serde(default)]
+    #[schema(example = 65536)]
+    pub inline_output_bytes: Option<usize>,
+    // LANG and LC_ALL for the program, one of ALLOWED_LOCALES. The server's
+    // locale, or C.UTF-8, otherwise.
+    #[serde(default)]
+    #[schema(example = "en_US.UTF-8")]
+    pub locale: Option<String>,
+    // TZ for the program, one of ALLOWED_TIMEZONES. The host's timezone
+    // otherwise.
+    #[serde(default)]
+    #[schema(example = "UTC")]
+    pub timezone: Option<String>,
+}
+
+const MAX_ARGS: usize = 64;
+const MAX_ARG_BYTES: usize = 4096;
+const MAX_ENV_VARS: usize = 32;
+const MAX_ENV_KEY_BYTES: usize = 128;
+const MAX_ENV_VALUE_BYTES: usize = 4096;
+// Setup reaches sqlite3 as a single argument, which the kernel holds to
+// 128 KiB including its terminating NUL.
+const SETUP_MAX_BYTES: usize = 128 * 1024 - 1;
+const THROTTLED_METRIC: &str = "comphub_throttled_submissions_total";
+const POLICY_METRIC: &str = "comphub_policy_matches_total";
+const IMPORT_METRIC: &str = "comphub_import_refusals_total";
+const SHED_METRIC: &str = "comphub_shed_submissions_total";
+
+impl From<CompilerRequest> for JobSpec {
+    fn from(payload: CompilerRequest) -> Self {
+        JobSpec {
+            lang: payload.lang,
+            content: payload.content,
+            stdin: payload.stdin,
+            args: payload.args,
+            env: payload.env,
+            compiler_flags: payload.compiler_flags,
+            backend: payload.backend,
+            js_engine: payload.js_engine,
+            dependencies: payload.dependencies,
+            setup: payload.setup,
+            output_encoding: payload.output_encoding,
+            version: None,
+            tier: None,
+            submitter: Submitter::default(),
+            run_at: None,
+            priority: Priority::default(),
+            rerun_of: None,
+            group: None,
+            expected_output: None,
+            time_limit: None,
+            memory_limit: None,
+            locale: payload.locale,
+            timezone: payload.timezone,
+            traceparent: None,
+        }
+    }
+}
+
+// Adds `value` to `hasher` behind its tag, each with its length first, so
+// no two different sets of fields hash the same bytes.
+fn hash_field(hasher: &mut Sha256, tag: &str, value: &[u8]) {
+    for bytes in [tag.as_bytes(), value] {
+        hasher.update((bytes.len() as u64).to_le_bytes());
+        hasher.update(bytes);
+    }
+}
+
+// Every field that changes what a run does, shared by the result cache key
+// and the idempotency fingerprint.
+fn hash_request(payload: &CompilerRequest) -> Sha256 {
+    let mut hasher = Sha256::new();
+    hash_field(&mut hasher, "lang", payload.lang.as_bytes());
+    hash_field(&mut hasher, "content", payload.content.as_bytes());
+    hash_field(&mut hasher, "stdin", payload.stdin.as_bytes());
+    hash_field(&mut hasher, "setup", payload.setup.as_bytes());
+    for arg in &payload.args {
+        hash_field(&mut hasher, "arg", arg.as_bytes());
+    }
+    for (key, value) in &payload.env {
+        hash_field(&mut hasher, "env.key", key.as_bytes());
+        hash_field(&mut hasher, "env.value", value.as_bytes());
+    }
+    for flag in &payload.compiler_flags {
+        hash_field(&mut hasher, "compiler_flag", flag.as_bytes());
+    }
+    for dependency in &payload.dependencies {
+        hash_field(&mut hasher, "dependency", dependency.as_bytes());
+    }
+    hash_field(&mut hasher, "backend", payload.backend.as_str().as_bytes());
+    if let Some(engine) = payload.js_engine {
+        hash_field(&mut hasher, "js_engine", engine.as_str().as_bytes());
+    }
+    hash_field(
+        &mut hasher,
+        "output_encoding",
+        payload.output_encoding.as_str().as_bytes(),
+    );
+    if let Some(locale) = &payload.locale {
+        hash_field(&mut hasher, "locale", locale.as_bytes());
+    }
+    if let Some(timezone) = &payload.timezone {
+        hash_field(&mut hasher, "timezone", timezone.as_bytes());
+    }
+    hasher
+}
+
+// Only runs that answer with their output alone are kept in the result
+// cache.
+fn is_cacheable(payload: &CompilerRequest) -> bool {
+    !payload.collect_files
+        && !payload.collect_images
+        && !payload.transcript
+        && !payload.coverage
+        && !payload.debug
+        && !payload.profile
+}
+
+// Whether `payload` would be answered from the result cache without running.
+pub async fn has_cached_result(
+    payload: &CompilerRequest,
+    tier: Option<&Tier>,
+    version: Option<&ToolchainVersion>,
+) -> bool {
+    is_cacheable(payload)
+        && !config().await.result_cache_ttl().is_zero()
+        && store()
+            .await
+            .get::<String>(&result_cache_key(payload, tier, version))
+            .is_some()
+}
+
+// A run's result also depends on the limits its tier runs it under: one
+// that timed out under a short limit is not the answer under a longer one.
+fn result_cache_key(
+    payload: &CompilerRequest,
+    tier: Option<&Tier>,
+    version: Option<&ToolchainVersion>,
+) -> String {
+    let mut hasher = hash_request(payload);
+    if let Some(version) = version {
+        hash_field(&mut hasher, "version", version.name.as_bytes());
+    }
+    if let Some(tier) = tier {
+        let limits = tier.apply(ExecContext::default());
+        if let Some(timeout) = limits.timeout() {
+            hash_field(&mut hasher, "timeout", &timeout.as_millis().to_le_bytes());
+        }
+        if let Some(quota) = limits.disk_quota() {
+            hash_field(&mut hasher, "disk_quota", &quota.to_le_bytes());
         }
+        if limits.is_offline() {
+            hash_field(&mut hasher, "offline", b"1");
+        }
+    }
+    format!("result:{:x}", hasher.finalize())
+}
+
+// Tells a retry apart from a different request sent with the same key, so
+// it also covers what the response includes.
+fn request_fingerprint(payload: &CompilerRequest) -> String {
+    let mut hasher = hash_request(payload);
+    let flags = [
+        payload.collect_files,
+        payload.collect_images,
+        payload.transcript,
+        payload.coverage,
+        payload.debug,
+        payload.profile,
+    ];
+    hash_field(&mut hasher, "flags", &flags.map(u8::from));
+    if let Some(contents) = payload.file_contents {
+        hash_field(&mut hasher, "file_contents", contents.as_str().as_bytes());
+    }
+    if let Some(version) = &payload.version {
+        hash_field(&mut hasher, "version", version.as_bytes());
+    }
+    if let Some(bytes) = payload.inline_output_bytes {
+        hash_field(&mut hasher, "inline_output_bytes", &bytes.to_le_bytes());
     }
+    format!("{:x}", hasher.finalize())
 }
 
+const MAX_IDEMPOTENCY_KEY_BYTES: usize = 255;
+
+// Keys are scoped to the API key, as for jobs, so callers cannot read each
+// other's responses by guessing a key.
+fn idempotency_store_key(api_key: Option<&str>, key: &str) -> Result<String, ApiError> {
+    if key.len() > MAX_IDEMPOTENCY_KEY_BYTES {
+        return Err(ApiError::ValidationError(vec![FieldError::new(
+            IDEMPOTENCY_HEADER,
+            "max_bytes",
+            format!(
+                "idempotency key must be at most {} bytes",
+                MAX_IDEMPOTENCY_KEY_BYTES
+            ),
+        )]));
+    }
+    Ok(format!(
+        "replay:{}:{}",
+        api_key.unwrap_or(ANONYMOUS_TENANT),
+        key
+    ))
+}
+
+// The installed version a request asked for, if it named one.
+pub async fn resolve_version(
+    toolchain: Toolchain,
+    requested: Option<&str>,
+) -> Result<Option<&'static ToolchainVersion>, ApiError> {
+    let Some(requested) = requested else {
+        return Ok(None);
+    };
+    let versions = config().await.toolchain_versions();
+    let lang = toolchain.as_str();
+    match versions.resolve(lang, requested) {
+        Some(version) => Ok(Some(version)),
+        None => Err(ApiError::ValidationError(vec![
+            FieldError::new(
+                "version",
+                "oneof",
+                format!("{} {} is not installed", lang, requested),
+            )
+            .allowed(versions.for_lang(lang).iter().map(|version| &version.name)),
+        ])),
+    }
+}
+
+// Checks declared dependencies against the packages configured for the
+// request's language, and that the caller's tier may use them.
+pub async fn check_dependencies(
+    toolchain: Toolchain,
+    dependencies: &[String],
+    tier: Option<&Tier>,
+) -> Result<(), ApiError> {
+    if dependencies.is_empty() {
+        return Ok(());
+    }
+    if tier.is_some_and(|tier| !tier.allows(Feature::Dependencies)) {
+        return Err(ApiError::Forbidden(String::from(
+            "dependencies are not available on this tier",
+        )));
+    }
+    let app_config = config().await;
+    let unavailable = |names: &[String], contains: &dyn Fn(&str) -> bool| -> Vec<FieldError> {
+        dependencies
+            .iter()
+            .enumerate()
+            .filter(|(_, name)| !contains(name))
+            .map(|(i, name)| {
+                FieldError::new(
+                    &format!("dependencies[{}]", i),
+                    "oneof",
+                    format!("{} is not an available {} package", name, toolchain),
+                )
+                .allowed(names)
+            })
+            .collect()
+    };
+    let errors = match toolchain {
+        Toolchain::Builtin(Language::Python) => {
+            let packages = app_config.python_packages();
+            unavailable(packages.names(), &|name| packages.contains(name))
+        }
+        Toolchain::Builtin(Language::JAVASCRIPT | Language::TYPESCRIPT) => {
+            let packages = app_config.node_packages();
+            unavailable(packages.names(), &|name| packages.contains(name))
+        }
+        _ => vec![FieldError::new(
+            "dependencies",
+            "unsupported",
+            format!("{} does not support dependencies", toolchain),
+        )],
+    };
+    if errors.is_empty() {
+        Ok(())
+    } else {
+        Err(ApiError::ValidationError(errors))
+    }
+}
+
+// Checks the requested locale and timezone against those the instance
+// allows.
+pub async fn check_locale(payload: &CompilerRequest) -> Result<(), ApiError> {
+    let app_config = config().await;
+    let settings = [
+        ("locale", &payload.locale, app_config.allowed_locales()),
+        ("timezone", &payload.timezone, app_config.allowed_timezones()),
+    ];
+    let errors: Vec<_> = settings
+        .into_iter()
+        .filter_map(|(field, requested, allowed)| {
+            let requested = requested.as_deref()?;
+            (!allowed.contains(requested)).then(|| {
+                FieldError::new(
+                    field,
+                    "oneof",
+                    format!("{} is not an available {}", requested, field),
+                )
+                .allowed(allowed.names())
+            })
+        })
+        .collect();
+    if errors.is_empty() {
+        Ok(())
+    } else {
+        Err(ApiError::ValidationError(errors))
+    }
+}
+
+// Refuses `content` if it matches a rejecting rule of the submission
+// policy or imports or uses what the import policy keeps from its
+// language. Every rule matched, rejecting or not, is kept in the audit log.
+pub async fn screen_submission(
+    submitter: &Submitter,
+    lang: &str,
+    content: &str,
+) -> Result<(), ApiError> {
+    let mut errors = Vec::new();
+    for (rule, matched) in submission_policy().await.check(lang, content) {
+        let action = match rule.action {
+            PolicyAction::Reject => "rejected",
+            PolicyAction::Flag => "flagged",
+        };
+        tracing::warn!("{} a {} submission matching policy rule {}", action, lang, rule.name);
+        metrics::increment(POLICY_METRIC, &[("rule", &rule.name), ("action", action)]);
+        audit(rule, lang, submitter, matched);
+        if rule.action == PolicyAction::Reject {
+            errors.push(FieldError::new(
+                "content",
+                "policy",
+                format!("refused by the {} rule: {}", rule.name, rule.reason),
+            ));
+        }
+    }
+    for violation in import_policy().await.check(lang, content) {
+        tracing::warn!("rejected a {} submission: {}", lang, violation);
+        metrics::increment(IMPORT_METRIC, &[("lang", violation.lang)]);
+        errors.push(FieldError::new("content", "import", violation.to_string()));
+    }
+    if errors.is_empty() {
+        Ok(())
+    } else {
+        Err(ApiError::ValidationError(errors))
+    }
+}
+
+// Slows down, then rejects, the same program arriving from the same client
+// in a tight loop.
+pub async fn throttle_submission(
+    client_ip: &str,
+    lang: &str,
+    code: &[u8],
+) -> Result<(), ApiError> {
+    let mut hasher = Sha256::new();
+    hasher.update(lang.as_bytes());
+    hasher.update([0]);
+    hasher.update(code);
+    let key = format!("{}:{:x}", client_ip, hasher.finalize());
+
+    match throttle().await.check(&key) {
+        Verdict::Allow => Ok(()),
+        Verdict::Delay(delay) => {
+            metrics::increment(THROTTLED_METRIC, &[("action", "delayed")]);
+            tokio::time::sleep(delay).await;
+            Ok(())
+        }
+        Verdict::Reject => {
+            metrics::increment(THROTTLED_METRIC, &[("action", "rejected")]);
+            Err(ApiError::TooManyRequests(
+                "identical submission repeated too often, slow down".into(),
+            ))
+        }
+    }
+}
+
+// Looks up the tier for `api_key`, refusing features the tier does not
+// include and callers over its rate limit. Callers without a key are rate
+// limited by address. Every request counts towards its tenant's usage.
+pub async fn admit_tier(
+    api_key: Option<&str>,
+    client_ip: &str,
+    features: &[Feature],
+) -> Result<Option<&'static Tier>, ApiError> {
+    let policy = tiers().await;
+    tenants().count_request(policy.tenant(&tenant_id(api_key)));
+    let Some((name, tier)) = policy.resolve(api_key) else {
+        return Ok(None);
+    };
+    if let Some(feature) = features.iter().find(|feature| !tier.allows(**feature)) {
+        return Err(ApiError::Forbidden(format!(
+            "{} is not available on the {} tier",
+            feature.as_str(),
+            name
+        )));
+    }
+    match policy.check_rate(name, api_key.unwrap_or(client_ip)) {
+        Verdict::Reject => {
+            metrics::increment(THROTTLED_METRIC, &[("action", "rate_limited")]);
+            Err(ApiError::TooManyRequests(format!(
+                "rate limit for the {} tier exceeded",
+                name
+            )))
+        }
+        _ => Ok(Some(tier)),
+    }
+}
+
+pub fn admit_language(tier: Option<&Tier>, toolchain: Toolchain) -> Result<(), ApiError> {
+    if tier.is_some_and(|tier| !tier.allows_language(toolchain)) {
+        return Err(ApiError::Forbidden(format!(
+            "{} is not available on this tier",
+            toolchain
+        )));
+    }
+    Ok(())
+}
+
+// Admits a run of `toolchain` and takes one of the caller's run slots.
+pub async fn admit_run(
+    api_key: Option<&str>,
+    tier: Option<&Tier>,
+    toolchain: Toolchain,
+) -> Result<RunSlot<'static>, ApiError> {
+    admit_language(tier, toolchain)?;
+    run_slot(api_key, tier).await
+}
+
+// Takes one of the run slots of the caller's tenant if one is free, given
+// back when the returned guard is dropped. Keys the tier policy does not
+// know share the anonymous tenant's slots.
+pub async fn try_run_slot(api_key: Option<&str>, tier: Option<&Tier>) -> Option<RunSlot<'static>> {
+    let limit = tier.and_then(|tier| tier.max_concurrent_runs);
+    let tenant = tiers().await.tenant(&tenant_id(api_key)).to_string();
+    tenants().acquire(&tenant, limit)
+}
+
+// Like `try_run_slot`, but refuses the request when no slot is free.
+pub async fn run_slot(
+    api_key: Option<&str>,
+    tier: Option<&Tier>,
+) -> Result<RunSlot<'static>, ApiError> {
+    let limit = tier.and_then(|tier| tier.max_concurrent_runs);
+    try_run_slot(api_key, tier).await.ok_or_else(|| {
+        metrics::increment(THROTTLED_METRIC, &[("action", "concurrency_limited")]);
+        ApiError::TooManyRequests(format!(
+            "at most {} runs may be in progress at once",
+            limit.unwrap_or_default()
+        ))
+    })
+}
+
+pub fn requested_features(payload: &CompilerRequest) -> Vec<Feature> {
+    [
+        (payload.collect_files, Feature::Files),
+        (payload.collect_images, Feature::Images),
+        (payload.transcript, Feature::Transcript),
+        (!payload.dependencies.is_empty(), Feature::Dependencies),
+    ]
+    .into_iter()
+    .filter_map(|(requested, feature)| requested.then_some(feature))
+    .collect()
+}
+
+pub fn resolve_lang(lang: &str) -> Result<Toolchain, ApiError> {
+    Toolchain::resolve(lang).map_err(|err| {
+        ApiError::ValidationError(vec![
+            FieldError::new("lang", "oneof", err.to_string()).allowed(Toolchain::names()),
+        ])
+    })
+}
+
+// Fills in the language of a request that left it out from its code, and
+// returns the one detected.
+fn detect_lang(payload: &mut CompilerRequest) -> Result<Option<&'static str>, ApiError> {
+    if !payload.lang.trim().is_empty() {
+        return Ok(None);
+    }
+    let Some(language) = detect(&payload.content) else {
+        return Err(ApiError::ValidationError(vec![
+            FieldError::new(
+                "lang",
+                "required",
+                "the language could not be detected from the code, give it in `lang`",
+            )
+            .allowed(Toolchain::names()),
+        ]));
+    };
+    payload.lang = language.as_str().to_string();
+    Ok(Some(language.as_str()))
+}
+
+pub fn admit(lang: &str) -> Result<Toolchain, ApiError> {
+    let toolchain = resolve_lang(lang)?;
+    if let Some(overload) = load::overloaded() {
+        metrics::increment(SHED_METRIC, &[("reason", overload.pressure.as_str())]);
+        return Err(ApiError::Overloaded(
+            format!("{}, try again later", overload.pressure.describe()),
+            overload.retry_after,
+        ));
+    }
+    if toolchain.is_compiled() && disk::under_pressure() {
+        return Err(ApiError::ServiceUnavailable(format!(
+            "{} is temporarily disabled because the execution zone is low on disk space",
+            lang
+        )));
+    }
+    Ok(toolchain)
+}
+
+fn check_args(toolchain: Toolchain, args: &[String]) -> Vec<FieldError> {
+    let mut errors = Vec::new();
+    if let Toolchain::Builtin(language @ (Language::NIX | Language::SQL)) = toolchain {
+        if !args.is_empty() {
+            errors.push(FieldError::new(
+                "args",
+                "unsupported",
+                format!("{} programs do not accept command-line arguments", language),
+            ));
+        }
+    }
+    if args.len() > MAX_ARGS {
+        errors.push(FieldError::new(
+            "args",
+            "max_items",
+            format!("at most {} arguments are allowed", MAX_ARGS),
+        ));
+    }
+    for (i, arg) in args.iter().enumerate() {
+        let field = format!("args[{}]", i);
+        if arg.len() > MAX_ARG_BYTES {
+            errors.push(FieldError::new(
+                &field,
+                "max_length",
+                format!("arguments must be at most {} bytes", MAX_ARG_BYTES),
+            ));
+        }
+        if arg.contains('\0') {
+            errors.push(FieldError::new(
+                &field,
+                "no_nul",
+                "arguments must not contain NUL bytes",
+            ));
+        }
+    }
+    errors
+}
+
+fn check_backend(toolchain: Toolchain, backend: Backend) -> Option<FieldError> {
+    let supported = match toolchain {
+        Toolchain::Builtin(language) => backend.supports(language),
+        Toolchain::Plugin(_) => backend == Backend::Native,
+    };
+    (!supported).then(|| {
+        FieldError::new(
+            "backend",
+            "unsupported",
+            format!(
+                "{} cannot run on the {} backend",
+                toolchain,
+                backend.as_str()
+            ),
+        )
+    })
+}
+
+fn check_js_engine(
+    toolchain: Toolchain,
+    engine: Option<JsEngine>,
+    dependencies: &[String],
+) -> Option<FieldError> {
+    let engine = engine?;
+    if !dependencies.is_empty() && !engine.loads_packages() && engine != JsEngine::Auto {
+        return Some(FieldError::new(
+            "js_engine",
+            "unsupported",
+            format!("the {} JavaScript engine cannot load dependencies", engine),
+        ));
+    }
+    let supported = match toolchain {
+        Toolchain::Builtin(Language::JAVASCRIPT) => {
+            engine != JsEngine::Embedded || JsEngine::AVAILABLE
+        }
+        Toolchain::Builtin(Language::TYPESCRIPT) => engine.runs_typescript(),
+        _ => false,
+    };
+    (!supported).then(|| {
+        FieldError::new(
+            "js_engine",
+            "unsupported",
+            format!("{} cannot run on the {} JavaScript engine", toolchain, engine),
+        )
+    })
+}
+
+fn check_coverage(toolchain: Toolchain, payload: &CompilerRequest) -> Option<FieldError> {
+    if !payload.coverage {
+        return None;
+    }
+    let supported = match toolchain {
+        Toolchain::Builtin(language) => coverage::supports(language),
+        Toolchain::Plugin(_) => false,
+    };
+    let message = if !supported {
+        format!("{} does not support coverage", toolchain)
+    } else if payload.backend != Backend::Native {
+        String::from("coverage is only measured on the native backend")
+    } else if payload.js_engine.is_some_and(|engine| engine != JsEngine::Node) {
+        String::from("JavaScript coverage runs on node")
+    } else {
+        return None;
+    };
+    Some(FieldError::new("coverage", "unsupported", message))
+}
+
+fn check_debug(toolchain: Toolchain, payload: &CompilerRequest) -> Option<FieldError> {
+    if !payload.debug {
+        return None;
+    }
+    let message = if !matches!(
+        toolchain,
+        Toolchain::Builtin(Language::C | Language::CPP)
+    ) {
+        format!("{} has no sanitizer build", toolchain)
+    } else if payload.backend != Backend::Native {
+        String::from("sanitizers only run on the native backend")
+    } else {
+        return None;
+    };
+    Some(FieldError::new("debug", "unsupported", message))
+}
+
+fn check_file_contents(payload: &CompilerRequest) -> Option<FieldError> {
+    if payload.file_contents.is_none() || payload.collect_files {
+        return None;
+    }
+    Some(FieldError::new(
+        "file_contents",
+        "unsupported",
+        "file contents are only returned along with collect_files",
+    ))
+}
+
+// A SQL program is fed to sqlite3 on stdin, so its input is the database
+// that `setup` seeds.
+fn check_setup(toolchain: Toolchain, payload: &CompilerRequest) -> Option<FieldError> {
+    let sql = matches!(toolchain, Toolchain::Builtin(Language::SQL));
+    if !sql && !payload.setup.is_empty() {
+        return Some(FieldError::new(
+            "setup",
+            "unsupported",
+            format!("{} does not support setup", toolchain),
+        ));
+    }
+    if sql && !payload.stdin.is_empty() {
+        return Some(FieldError::new(
+            "stdin",
+            "unsupported",
+            "sql programs read no input; seed their database with setup instead",
+        ));
+    }
+    if payload.setup.len() > SETUP_MAX_BYTES {
+        return Some(FieldError::new(
+            "setup",
+            "max_bytes",
+            format!("setup must be at most {} bytes", SETUP_MAX_BYTES),
+        ));
+    }
+    None
+}
+
+fn check_profile(toolchain: Toolchain, payload: &CompilerRequest) -> Option<FieldError> {
+    if !payload.profile {
+        return None;
+    }
+    let supported = match toolchain {
+        Toolchain::Builtin(language) => profile::supports(language),
+        Toolchain::Plugin(_) => false,
+    };
+    let message = if !supported {
+        format!("{} does not support profiling", toolchain)
+    } else if payload.backend != Backend::Native {
+        String::from("profiles are only taken on the native backend")
+    } else if payload.js_engine.is_some_and(|engine| engine != JsEngine::Node) {
+        String::from("JavaScript profiles are taken on node")
+    } else if payload.coverage || payload.debug {
+        // Instrumented builds would be what the profile measured.
+        String::from("cannot be combined with coverage or debug")
+    } else {
+        return None;
+    };
+    Some(FieldError::new("profile", "unsupported", message))
+}
+
+pub fn check_compiler_flags(toolchain: Toolchain, flags: &[String]) -> Vec<FieldError> {
+    let allowed = toolchain.allowed_compiler_flags();
+    flags
+        .iter()
+        .enumerate()
+        .filter(|(_, flag)| !allowed.contains(&flag.as_str()))
+        .map(|(i, flag)| {
+            let message = if allowed.is_empty() {
+                format!("{} does not accept compiler flags", toolchain)
+            } else {
+                format!("{} is not an allowed {} compiler flag", flag, toolchain)
+            };
+            FieldError::new(&format!("compiler_flags[{}]", i), "oneof", message)
+                .allowed(allowed.iter())
+        })
+        .collect()
+}
+
+fn is_reserved_env(key: &str) -> bool {
+    INHERITED_ENV.contains(&key) || key.starts_with("LD_") || key.starts_with("DYLD_")
+}
+
+fn check_env(env: &BTreeMap<String, String>) -> Vec<FieldError> {
+    let mut errors = Vec::new();
+    if env.len() > MAX_ENV_VARS {
+        errors.push(FieldError::new(
+            "env",
+            "max_items",
+            format!("at most {} environment variables are allowed", MAX_ENV_VARS),
+        ));
+    }
+    for (key, value) in env {
+        let field = format!("env.{}", key);
+        let valid_name = !key.is_empty()
+            && !key.starts_with(|c: char| c.is_ascii_digit())
+            && key.chars().all(|c| c.is_ascii_alphanumeric() || c == '_');
+        if !valid_name {
+            errors.push(FieldError::new(
+                &field,
+                "pattern",
+                "names must contain only letters, digits and underscores",
+            ));
+        } else if key == "TZ" {
+            errors.push(FieldError::new(
+                &field,
+                "reserved",
+                "set the timezone with `timezone` instead",
+            ));
+        } else if is_reserved_env(key) {
+            errors.push(FieldError::new(
+                &field,
+                "reserved",
+                format!("{} is managed by the server", key),
+            ));
+        }
+        if key.len() > MAX_ENV_KEY_BYTES || value.len() > MAX_ENV_VALUE_BYTES {
+            errors.push(FieldError::new(
+                &field,
+                "max_length",
+                format!(
+                    "names must be at most {} bytes and values at most {} bytes",
+                    MAX_ENV_KEY_BYTES, MAX_ENV_VALUE_BYTES
+                ),
+            ));
+        }
+        if value.contains('\0') {
+            errors.push(FieldError::new(
+                &field,
+                "no_nul",
+                "values must not contain NUL bytes",
+            ));
+        }
+    }
+    errors
+}
+
+fn check_size(field: &str, value: &str, limit: usize) -> Option<FieldError> {
+    (value.len() > limit).then(|| {
+        FieldError::new(
+            field,
+            "max_bytes",
+            format!("{} must be at most {} bytes", field, limit),
+        )
+    })
+}
+
+fn size_errors(content: &str, stdin: &str, code_limit: usize, stdin_limit: usize) -> Vec<FieldError> {
+    [
+        check_size("content", content, code_limit),
+        check_size("stdin", stdin, stdin_limit),
+    ]
+    .into_iter()
+    .flatten()
+    .collect()
+}
+
+pub async fn check_limits(content: &str, stdin: &str, tier: Option<&Tier>) -> Result<(), ApiError> {
+    let app_config = config().await;
+    let errors = size_errors(
+        content,
+        stdin,
+        tier.and_then(|tier| tier.max_code_bytes)
+            .unwrap_or(app_config.code_max_bytes()),
+        tier.and_then(|tier| tier.max_stdin_bytes)
+            .unwrap_or(app_config.stdin_max_bytes()),
+    );
+    if errors.is_empty() {
+        Ok(())
+    } else {
+        Err(ApiError::PayloadTooLarge(errors))
+    }
+}
+
+pub fn validate(payload: &CompilerRequest) -> Result<Toolchain, ApiError> {
+    let toolchain = admit(&payload.lang)?;
+    check_request(toolchain, payload)?;
+    Ok(toolchain)
+}
+
+// Checks the fields of `payload` that depend on the language it is for.
+pub fn check_request(toolchain: Toolchain, payload: &CompilerRequest) -> Result<(), ApiError> {
+    let mut errors = check_args(toolchain, &payload.args);
+    errors.extend(check_env(&payload.env));
+    errors.extend(check_compiler_flags(toolchain, &payload.compiler_flags));
+    errors.extend(check_backend(toolchain, payload.backend));
+    errors.extend(check_js_engine(
+        toolchain,
+        payload.js_engine,
+        &payload.dependencies,
+    ));
+    errors.extend(check_coverage(toolchain, payload));
+    errors.extend(check_debug(toolchain, payload));
+    errors.extend(check_profile(toolchain, payload));
+    errors.extend(check_setup(toolchain, payload));
+    errors.extend(check_file_contents(payload));
+
+    if errors.is_empty() {
+        Ok(())
+    } else {
+        Err(ApiError::ValidationError(errors))
+    }
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/compile",
+    tag = "compile",
+    request_body(content(
+        (CompilerRequest = "application/json"),
+        (CompilerRequest = "application/msgpack"),
+    )),
+    params(
+        ("x-api-key" = Option<String>, Header, description = "API key that selects the caller's tier"),
+        ("idempotency-key" = Option<String>, Header, description = "Retries of the same request with the same key return the stored response instead of running again"),
+    ),
+    responses(
+        (status = 200, description = "Program ran successfully. With `Accept: text/plain` the body is only the output; with `application/x-ndjson` output events are streamed as they are written, with a `usage` event every half second while the program runs, ending with a `result` or `error` event; with `text/event-stream` the same arrive as server-sent events named `stdout`, `stderr`, `usage`, `result` and `error`; with `application/msgpack` the JSON document is encoded as MessagePack", content(
+            (CompilerResponse = "application/json"),
+            (String = "text/plain"),
+            (String = "application/x-ndjson"),
+            (String = "text/event-stream"),
+            (CompilerResponse = "application/msgpack"),
+        )),
+        (status = 400, description = "Malformed request body or invalid fields, or an idempotency key reused for a different request", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "Program made a system call its seccomp profile blocks, or the API key's tier does not include a requested feature or the program's language", body = ErrorResponse),
+        (status = 406, description = "The Accept header allows none of JSON, plain text, NDJSON, server-sent events or MessagePack", body = ErrorResponse),
+        (status = 408, description = "Execution exceeded the time limit; `timed_out` tells how long it ran and what it wrote until then", body = ErrorResponse),
+        (status = 409, description = "A request with the same idempotency key is still running", body = ErrorResponse),
+        (status = 413, description = "Request body, code or stdin exceeds its size limit", body = ErrorResponse),
+        (status = 429, description = "Identical submission repeated too often, the tier's rate limit was reached, or too many of the caller's runs are in progress. Also sent, with Retry-After, while the server sheds load", body = ErrorResponse),
+        (status = 500, description = "Compilation or execution failed; `crashed` tells how a program that ran ended and what it wrote", body = ErrorResponse),
+        (status = 503, description = "Compiled languages are paused while disk space is low", body = ErrorResponse),
+        (status = 507, description = "Program wrote more than the per-execution disk quota or its language's output limit", body = ErrorResponse),
+    )
+)]
 pub async fn compile(
-    Json(payload): Json<CompilerRequest>,
-) -> Result<Json<CompilerResponse>, ApiError> {
-    payload.lang.parse::<Language>()?;
-    let res = compile_lang(&payload.lang, &payload.content, &payload.stdin).await?;
+    ApiKey(api_key): ApiKey,
+    ClientIp(client_ip): ClientIp,
+    IdempotencyKey(idempotency_key): IdempotencyKey,
+    format: ResponseFormat,
+    ValidBody(payload): ValidBody<CompilerRequest>,
+) -> Result<Response, ApiError> {
+    respond(
+        format,
+        api_key.as_deref(),
+        &client_ip,
+        idempotency_key,
+        payload,
+    )
+    .await
+}
 
-    Ok(Json(CompilerResponse {
-        result: res.to_string(),
+// A submission that passed every check and may run, holding its
+// idempotency key if it came with one.
+struct Admitted {
+    tier: Option<&'static Tier>,
+    detected: Option<&'static str>,
+    version: Option<&'static ToolchainVersion>,
+    submitter: Submitter,
+    reservation: Option<Reservation<'static>>,
+    _slot: RunSlot<'static>,
+}
+
+enum Admission {
+    Run(Admitted),
+    // A retry of a request that already finished.
+    Replay(CompilerResponse),
+}
+
+async fn admit_submission(
+    api_key: Option<&str>,
+    client_ip: &str,
+    idempotency_key: Option<String>,
+    payload: &mut CompilerRequest,
+) -> Result<Admission, ApiError> {
+    let tier = admit_tier(api_key, client_ip, &requested_features(payload)).await?;
+    check_limits(&payload.content, &payload.stdin, tier).await?;
+    let detected = detect_lang(payload)?;
+    let toolchain = validate(payload)?;
+    let version = resolve_version(toolchain, payload.version.as_deref()).await?;
+    check_dependencies(toolchain, &payload.dependencies, tier).await?;
+    check_locale(payload).await?;
+
+    let app_config = config().await;
+    let reservation = match idempotency_key.filter(|_| !app_config.idempotency_ttl().is_zero()) {
+        Some(key) => {
+            let key = idempotency_store_key(api_key, &key)?;
+            let lease = app_config.http_write_timeout();
+            match idempotency::claim(store().await, key, &request_fingerprint(payload), lease) {
+                Claim::Reserved(reservation) => Some(reservation),
+                Claim::Replay(response) => return Ok(Admission::Replay(response)),
+                Claim::InProgress => {
+                    return Err(ApiError::Conflict(String::from(
+                        "a request with this idempotency key is still running",
+                    )));
+                }
+                Claim::Mismatch => {
+                    return Err(ApiError::ValidationError(vec![FieldError::new(
+                        IDEMPOTENCY_HEADER,
+                        "reused",
+                        "idempotency key was already used for a different request",
+                    )]));
+                }
+            }
+        }
+        None => None,
+    };
+
+    // Retries answered from the reservation above are not throttled.
+    let submitter = Submitter::new(api_key, client_ip);
+    screen_submission(&submitter, &payload.lang, &payload.content).await?;
+    let slot = admit_run(api_key, tier, toolchain).await?;
+    throttle_submission(client_ip, &payload.lang, payload.content.as_bytes()).await?;
+    Ok(Admission::Run(Admitted {
+        tier,
+        detected,
+        version,
+        submitter,
+        reservation,
+        _slot: slot,
     }))
 }
+
+impl Admitted {
+    async fn run(
+        self,
+        payload: CompilerRequest,
+        live: Option<LiveRun>,
+    ) -> Result<CompilerResponse, ApiError> {
+        let mut response =
+            execute(payload, self.tier, self.version, &self.submitter, live).await?;
+        response.lang = self.detected.map(String::from);
+        if let Some(reservation) = self.reservation {
+            reservation.finish(&response, config().await.idempotency_ttl());
+        }
+        Ok(response)
+    }
+}
+
+// Checks and runs a submission, waiting for the whole response.
+pub async fn run_submission(
+    api_key: Option<&str>,
+    client_ip: &str,
+    idempotency_key: Option<String>,
+    mut payload: CompilerRequest,
+) -> Result<CompilerResponse, ApiError> {
+    match admit_submission(api_key, client_ip, idempotency_key, &mut payload).await? {
+        Admission::Run(admitted) => admitted.run(payload, None).await,
+        Admission::Replay(response) => Ok(response),
+    }
+}
+
+// Runs a submission and answers in the format the client asked for.
+pub async fn respond(
+    format: ResponseFormat,
+    api_key: Option<&str>,
+    client_ip: &str,
+    idempotency_key: Option<String>,
+    mut payload: CompilerRequest,
+) -> Result<Response, ApiError> {
+    match format {
+        ResponseFormat::Json => {
+            let response = run_submission(api_key, client_ip, idempotency_key, payload).await?;
+            Ok(PooledJson(response).into_response())
+        }
+        ResponseFormat::MessagePack => {
+            let response = run_submission(api_key, client_ip, idempotency_key, payload).await?;
+            Ok(PooledMsgpack(response).into_response())
+        }
+        ResponseFormat::Text => {
+            if payload.inline_output_bytes.is_some() {
+                return Err(ApiError::ValidationError(vec![FieldError::new(
+                    "inline_output_bytes",
+                    "unsupported",
+                    "a plain text response has no room for a download link",
+                )]));
+            }
+            match run_submission(api_key, client_ip, idempotency_key, payload).await {
+                Ok(response) => Ok(plain_text(StatusCode::OK, response.result)),
+                Err(err) => Ok(plain_text_error(err)),
+            }
+        }
+        ResponseFormat::Ndjson | ResponseFormat::EventStream => {
+            if payload.transcript {
+                return Err(ApiError::ValidationError(vec![FieldError::new(
+                    "transcript",
+                    "unsupported",
+                    "a streamed response already sends the output in order",
+                )]));
+            }
+            let admission =
+                admit_submission(api_key, client_ip, idempotency_key, &mut payload).await?;
+            let as_ndjson = format == ResponseFormat::Ndjson;
+            match admission {
+                Admission::Run(admitted) => {
+                    let (live, events) = live();
+                    let run = admitted.run(payload, Some(live));
+                    Ok(if as_ndjson {
+                        ndjson(run, events)
+                    } else {
+                        event_stream(run, events)
+                    })
+                }
+                Admission::Replay(response) if as_ndjson => Ok(ndjson_replay(response)),
+                Admission::Replay(response) => Ok(event_stream_replay(response)),
+            }
+        }
+    }
+}
+
+// Runs the program, sending its output and usage to `live` as it runs if
+// set.
+async fn execute(
+    payload: CompilerRequest,
+    tier: Option<&Tier>,
+    version: Option<&ToolchainVersion>,
+    submitter: &Submitter,
+    live: Option<LiveRun>,
+) -> Result<CompilerResponse, ApiError> {
+    let resolved_name = version.map(|version| version.name.clone());
+    let app_config = config().await;
+    if payload.file_contents == Some(FileContents::Link) && app_config.artifact_ttl().is_zero() {
+        return Err(ApiError::ValidationError(vec![FieldError::new(
+            "file_contents",
+            "unsupported",
+            "this instance does not keep files for download",
+        )]));
+    }
+    if payload.inline_output_bytes.is_some() && app_config.artifact_ttl().is_zero() {
+        return Err(ApiError::ValidationError(vec![FieldError::new(
+            "inline_output_bytes",
+            "unsupported",
+            "this instance does not keep output for download",
+        )]));
+    }
+    if is_cacheable(&payload) {
+        let ttl = app_config.result_cache_ttl();
+        let key = result_cache_key(&payload, tier, version);
+        if !ttl.is_zero() {
+            if let Some(res) = store().await.get::<String>(&key) {
+                let response = CompilerResponse {
+                    id: None,
+                    lang: None,
+                    result: res,
+                    result_url: None,
+                    result_bytes: None,
+                    warnings: None,
+                    files: None,
+                    images: None,
+                    transcript: None,
+                    version: resolved_name,
+                    coverage: None,
+                    sanitizer: None,
+                    profile: None,
+                };
+                return spill(response, &payload);
+            }
+        }
+
+        let id = Uuid::new_v4().to_string();
+        let warnings = CompilerWarnings::default();
+        // Nothing is collected from it, but the disk quota only covers what
+        // is written inside a workspace.
+        let workspace = TempDir::new_in(execution_zone()).map_err(InfraError::from)?;
+        let mut ctx = ExecContext::default();
+        if let Some(tier) = tier {
+            ctx = tier.apply(ctx);
+        }
+        if let Some(version) = version {
+            ctx = ctx.with_toolchain_dir(version.dir.clone());
+        }
+        // Runs that asked for a version are not tried on another.
+        let candidate = match version {
+            Some(_) => None,
+            None => canary().await.pick(&payload.lang),
+        };
+        let canary_ctx = candidate.map(|_| request_context(ctx.clone(), &payload));
+        if let Some(live) = live {
+            ctx = streaming(ctx, live.output).with_usage_stream(live.usage);
+        }
+        let ctx = request_context(ctx, &payload)
+            .with_workspace(workspace.path().to_path_buf())
+            .with_compiler_warnings(warnings.clone());
+        let run = logged(
+            &id,
+            &payload.lang,
+            &payload.content,
+            submitter,
+            compile_lang(&payload.lang, &payload.content, &payload.stdin, &ctx),
+        )
+        .await;
+        if let Some((candidate, canary_ctx)) = candidate.zip(canary_ctx) {
+            tokio::spawn(canary::compare(
+                id.clone(),
+                payload.lang.clone(),
+                payload.content.clone(),
+                payload.stdin.clone(),
+                canary_ctx,
+                candidate,
+                run.as_ref().cloned().map_err(|err| err.to_string()),
+            ));
+        }
+        let res = run?;
+        let warnings = warnings.take();
+
+        // A cached result skips the compiler, so only results it had no
+        // warnings about are kept.
+        if !ttl.is_zero() && warnings.is_none() {
+            if let Err(err) = store().await.put(&key, &res, Some(ttl)) {
+                tracing::warn!("failed to cache result: {}", err);
+            }
+        }
+
+        let response = CompilerResponse {
+            id: Some(id),
+            lang: None,
+            result: res,
+            result_url: None,
+            result_bytes: None,
+            warnings,
+            files: None,
+            images: None,
+            transcript: None,
+            version: resolved_name,
+            coverage: None,
+            sanitizer: None,
+            profile: None,
+        };
+        return spill(response, &payload);
+    }
+
+    let id = Uuid::new_v4().to_string();
+    let warnings = CompilerWarnings::default();
+    let workspace = TempDir::new_in(execution_zone()).map_err(InfraError::from)?;
+    let before = Snapshot::take(workspace.path()).map_err(InfraError::from)?;
+    let mut ctx = ExecContext::default().with_workspace(workspace.path().to_path_buf());
+    if let Some(tier) = tier {
+        ctx = tier.apply(ctx);
+    }
+    if let Some(version) = version {
+        ctx = ctx.with_toolchain_dir(version.dir.clone());
+    }
+    if payload.collect_images {
+        for (key, value) in HEADLESS_ENV {
+            ctx = ctx.with_env(key, value);
+        }
+    }
+    let mut recorder = None;
+    if payload.transcript {
+        let (tx, started) = TranscriptRecorder::start();
+        ctx = streaming(ctx, tx);
+        recorder = Some(started);
+    } else if let Some(live) = live {
+        ctx = streaming(ctx, live.output).with_usage_stream(live.usage);
+    }
+    // Kept apart from the workspace so the tool's data files are not
+    // reported as files the program wrote.
+    let coverage_dir = if payload.coverage {
+        let dir = scratch_dir()?;
+        ctx = ctx.with_coverage_dir(dir.path().to_path_buf());
+        Some(dir)
+    } else {
+        None
+    };
+    let sanitizer_dir = if payload.debug {
+        let dir = scratch_dir()?;
+        ctx = ctx.with_sanitizer_dir(dir.path().to_path_buf());
+        Some(dir)
+    } else {
+        None
+    };
+    let profile_dir = if payload.profile {
+        let dir = scratch_dir()?;
+        ctx = ctx.with_profile_dir(dir.path().to_path_buf());
+        Some(dir)
+    } else {
+        None
+    };
+    let ctx = request_context(ctx, &payload).with_compiler_warnings(warnings.clone());
+    let res = logged(
+        &id,
+        &payload.lang,
+        &payload.content,
+        submitter,
+        compile_lang(&payload.lang, &payload.content, &payload.stdin, &ctx),
+    )
+    .await?;
+    drop(ctx);
+    let transcript = match recorder {
+        Some(recorder) => Some(recorder.finish().await),
+        None => None,
+    };
+    let after = Snapshot::take(workspace.path()).map_err(InfraError::from)?;
+    let mut changes = after.changes_since(&before);
+    if let Some(contents) = payload.file_contents.filter(|_| payload.collect_files) {
+        attach_contents(
+            workspace.path(),
+            &mut changes,
+            contents,
+            app_config.file_max_count(),
+            app_config.file_max_bytes(),
+        )
+        .map_err(InfraError::from)?;
+    }
+    let images = if payload.collect_images {
+        Some(
+            collect_images(workspace.path(), &changes, app_config.image_max_bytes())
+                .map_err(InfraError::from)?,
+        )
+    } else {
+        None
+    };
+    let coverage = match &coverage_dir {
+        Some(dir) => CoverageReport::load(dir.path()).map_err(InfraError::from)?,
+        None => None,
+    };
+    let sanitizer = match &sanitizer_dir {
+        Some(dir) => Some(sanitizer::load(dir.path()).map_err(InfraError::from)?),
+        None => None,
+    };
+    let profile = match &profile_dir {
+        Some(dir) => ProfileReport::load(dir.path()).map_err(InfraError::from)?,
+        None => None,
+    };
+
+    let response = CompilerResponse {
+        id: Some(id),
+        lang: None,
+        result: res,
+        result_url: None,
+        result_bytes: None,
+        warnings: warnings.take(),
+        files: payload.collect_files.then_some(changes),
+        images,
+        transcript,
+        version: resolved_name,
+        coverage,
+        sanitizer,
+        profile,
+    };
+    spill(response, &payload)
+}
+
+// Keeps output past the request's `inline_output_bytes` for download.
+fn spill(
+    mut response: CompilerResponse,
+    payload: &CompilerRequest,
+) -> Result<CompilerResponse, ApiError> {
+    let Some(inline_bytes) = payload.inline_output_bytes else {
+        return Ok(response);
+    };
+    let len = response.result.len();
+    let url = spill_output(&mut response.result, inline_bytes, payload.output_encoding)
+        .map_err(InfraError::from)?;
+    if url.is_some() {
+        response.result_url = url;
+        response.result_bytes = Some(len);
+    }
+    Ok(response)
+}
+
+// Applies what the request asks of its run to `ctx`.
+fn request_context(ctx: ExecContext, payload: &CompilerRequest) -> ExecContext {
+    ctx.with_args(payload.args.clone())
+        .with_envs(payload.env.clone())
+        .with_locale(payload.locale.clone())
+        .with_timezone(payload.timezone.clone())
+        .with_compiler_flags(payload.compiler_flags.clone())
+        .with_backend(payload.backend)
+        .with_js_engine(payload.js_engine)
+        .with_dependencies(payload.dependencies.clone())
+        .with_setup(payload.setup.clone())
+        .with_output_encoding(payload.output_encoding)
+}
+
+// Sends the program's output to `output` as it is written, unbuffered where
+// the language allows it.
+fn streaming(mut ctx: ExecContext, output: UnboundedSender<OutputChunk>) -> ExecContext {
+    for (key, value) in UNBUFFERED_ENV {
+        ctx = ctx.with_env(key, value);
+    }
+    ctx.with_output(output)
+}
+
+// A directory for a run's tools to write reports to, handed to the run's
+// sandbox user once it has one.
+fn scratch_dir() -> Result<TempDir, InfraError> {
+    Ok(TempDir::new_in(execution_zone())?)
+}
+
+#[cfg(test)]
+mod compile_tests {
+    use super::*;
+
+    fn request(lang: &str) -> CompilerRequest {
+        CompilerRequest {
+            lang: lang.into(),
+            content: String::new(),
+            stdin: String::new(),
+            args: Vec::new(),
+            env: BTreeMap::new(),
+            compiler_flags: Vec::new(),
+            collect_files: false,
+            file_contents: None,
+            collect_images: false,
+            transcript: false,
+            backend: Backend::Native,
+            js_engine: None,
+            version: None,
+            dependencies: Vec::new(),
+            setup: String::new(),
+            coverage: false,
+            debug: false,
+            profile: false,
+            output_encoding: OutputEncoding::Text,
+            inline_output_bytes: None,
+            locale: None,
+            timezone: None,
+        }
+    }
+
+    fn rules(err: ApiError) -> Vec<(String, String)> {
+        match err {
+            ApiError::ValidationError(errors) => errors
+                .into_iter()
+                .map(|err| (err.field, err.rule))
+                .collect(),
+            other => panic!("unexpected error: {}", other),
+        }
+    }
+
+    #[test]
+    fn test_detect_lang_fills_in_a_missing_language() {
+        let mut payload = request("");
+        payload.content = String::from("package main\n\nfunc main() {}\n");
+        assert_eq!(detect_lang(&mut payload).unwrap(), Some("go"));
+        assert_eq!(payload.lang, "go");
+
+        let mut payload = request("python");
+        payload.content = String::from("package main\n");
+        assert_eq!(detect_lang(&mut payload).unwrap(), None);
+        assert_eq!(payload.lang, "python");
+
+        let mut payload = request(" ");
+        payload.content = String::from("hello there");
+        let err = detect_lang(&mut payload).unwrap_err();
+        assert_eq!(rules(err), [("lang".to_string(), "required".to_string())]);
+    }
+
+    #[test]
+    fn test_result_cache_key_keeps_fields_and_tiers_apart() {
+        let mut split = request("python");
+        split.args = vec!["a".into(), "b".into()];
+        let mut joined = request("python");
+        joined.args = vec!["a\0b".into()];
+        assert_ne!(
+            result_cache_key(&split, None, None),
+            result_cache_key(&joined, None, None)
+        );
+
+        let mut moved = request("python");
+        moved.content = String::from("print(1)");
+        let mut other = request("python");
+        other.stdin = String::from("print(1)");
+        assert_ne!(
+            result_cache_key(&moved, None, None),
+            result_cache_key(&other, None, None)
+        );
+
+        let presets = crate::infra::tier::presets();
+        assert_ne!(
+            result_cache_key(&moved, Some(&presets["free"]), None),
+            result_cache_key(&moved, Some(&presets["classroom"]), None)
+        );
+    }
+
+    #[test]
+    fn test_validate_rejects_unknown_language_with_allowed_values() {
+        let Err(ApiError::ValidationError(errors)) = validate(&request("cobol")) else {
+            panic!("expected validation error");
+        };
+        assert_eq!(errors[0].field, "lang");
+        assert!(errors[0].allowed_values.as_ref().unwrap().contains(&"python".into()));
+    }
+
+    #[test]
+    fn test_validate_reports_every_bad_env_entry() {
+        let mut req = request("python");
+        req.env.insert("LD_PRELOAD".into(), "/tmp/x.so".into());
+        req.env.insert("1BAD".into(), "x".into());
+        req.env.insert("OK".into(), "fine".into());
+
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![
+                ("env.1BAD".into(), "pattern".into()),
+                ("env.LD_PRELOAD".into(), "reserved".into()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_validate_checks_compiler_flags_against_language() {
+        let mut req = request("cpp");
+        req.compiler_flags = vec!["-O2".into(), "-fplugin=evil.so".into()];
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![("compiler_flags[1]".into(), "oneof".into())]
+        );
+
+        let mut req = request("python");
+        req.compiler_flags = vec!["-O".into()];
+        assert!(validate(&req).is_err());
+    }
+
+    #[test]
+    fn test_size_errors_name_each_oversized_field() {
+        assert!(size_errors("print(1)", "", 16, 16).is_empty());
+
+        let errors = size_errors(&"x".repeat(17), &"y".repeat(17), 16, 16);
+        let fields: Vec<_> = errors.iter().map(|err| err.field.as_str()).collect();
+        assert_eq!(fields, ["content", "stdin"]);
+        assert!(errors.iter().all(|err| err.rule == "max_bytes"));
+    }
+
+    #[test]
+    fn test_validate_checks_backend_against_language() {
+        let mut req = request("python");
+        req.backend = Backend::Wasm;
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![("backend".into(), "unsupported".into())]
+        );
+
+        let mut req = request("rust");
+        req.backend = Backend::Wasm;
+        assert!(validate(&req).is_ok());
+        assert!(validate(&request("wasm")).is_ok());
+    }
+
+    #[test]
+    fn test_validate_checks_js_engine_against_language() {
+        let mut req = request("python");
+        req.js_engine = Some(JsEngine::Auto);
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![("js_engine".into(), "unsupported".into())]
+        );
+
+        let mut req = request("typescript");
+        req.js_engine = Some(JsEngine::Auto);
+        assert!(validate(&req).is_err());
+        req.js_engine = Some(JsEngine::Node);
+        assert!(validate(&req).is_err());
+        req.js_engine = Some(JsEngine::Deno);
+        assert!(validate(&req).is_ok());
+
+        let mut req = request("javascript");
+        req.js_engine = Some(JsEngine::Embedded);
+        assert_eq!(validate(&req).is_ok(), JsEngine::AVAILABLE);
+
+        req.dependencies.push("lodash".into());
+        assert!(validate(&req).is_err());
+        req.js_engine = Some(JsEngine::Node);
+        assert!(validate(&req).is_ok());
+    }
+
+    #[test]
+    fn test_validate_requires_collect_files_for_file_contents() {
+        let mut req = request("python");
+        req.file_contents = Some(FileContents::Inline);
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![("file_contents".into(), "unsupported".into())]
+        );
+        req.collect_files = true;
+        assert!(validate(&req).is_ok());
+    }
+
+    #[test]
+    fn test_validate_checks_setup_against_language() {
+        let mut req = request("python");
+        req.setup = "CREATE TABLE t (x);".into();
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![("setup".into(), "unsupported".into())]
+        );
+
+        let mut req = request("sql");
+        req.setup = "CREATE TABLE t (x);".into();
+        assert!(validate(&req).is_ok());
+        req.stdin = "1".into();
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![("stdin".into(), "unsupported".into())]
+        );
+
+        let mut req = request("sql");
+        req.setup = "-".repeat(SETUP_MAX_BYTES + 1);
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![("setup".into(), "max_bytes".into())]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_resolve_version_rejects_versions_not_installed() {
+        let toolchain = validate(&request("python")).unwrap();
+        assert!(resolve_version(toolchain, None).await.unwrap().is_none());
+        assert_eq!(
+            rules(resolve_version(toolchain, Some("2.7")).await.unwrap_err()),
+            vec![("version".into(), "oneof".into())]
+        );
+    }
+
+    #[test]
+    fn test_validate_checks_coverage_support() {
+        let mut req = request("go");
+        req.coverage = true;
+        assert!(validate(&req).is_ok());
+
+        let mut req = request("ruby");
+        req.coverage = true;
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![("coverage".into(), "unsupported".into())]
+        );
+
+        let mut req = request("javascript");
+        req.coverage = true;
+        req.js_engine = Some(JsEngine::Bun);
+        assert!(validate(&req).is_err());
+        req.js_engine = Some(JsEngine::Node);
+        assert!(validate(&req).is_ok());
+    }
+
+    #[test]
+    fn test_validate_checks_debug_support() {
+        let mut req = request("cpp");
+        req.debug = true;
+        assert!(validate(&req).is_ok());
+
+        let mut req = request("python");
+        req.debug = true;
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![("debug".into(), "unsupported".into())]
+        );
+
+        let mut req = request("c");
+        req.debug = true;
+        req.backend = Backend::Wasm;
+        assert!(
+            rules(validate(&req).unwrap_err()).contains(&("debug".into(), "unsupported".into()))
+        );
+    }
+
+    #[test]
+    fn test_validate_checks_profile_support() {
+        let mut req = request("rust");
+        req.profile = true;
+        assert!(validate(&req).is_ok());
+
+        let mut req = request("python");
+        req.profile = true;
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![("profile".into(), "unsupported".into())]
+        );
+
+        let mut req = request("go");
+        req.profile = true;
+        req.coverage = true;
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![("profile".into(), "unsupported".into())]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_check_dependencies_against_language_packages() {
+        let python = validate(&request("python")).unwrap();
+        assert!(check_dependencies(python, &[], None).await.is_ok());
+        assert_eq!(
+            rules(check_dependencies(python, &["left-pad".into()], None).await.unwrap_err()),
+            vec![("dependencies[0]".into(), "oneof".into())]
+        );
+        let javascript = validate(&request("javascript")).unwrap();
+        assert_eq!(
+            rules(check_dependencies(javascript, &["lodash".into()], None).await.unwrap_err()),
+            vec![("dependencies[0]".into(), "oneof".into())]
+        );
+        let go = validate(&request("go")).unwrap();
+        assert_eq!(
+            rules(check_dependencies(go, &["numpy".into()], None).await.unwrap_err()),
+            vec![("dependencies".into(), "unsupported".into())]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_check_locale_against_allowed_settings() {
+        let mut req = request("python");
+        assert!(check_locale(&req).await.is_ok());
+        req.locale = Some("C.UTF-8".into());
+        req.timezone = Some("UTC".into());
+        assert!(check_locale(&req).await.is_ok());
+        req.locale = Some("tlh_QO.UTF-8".into());
+        req.timezone = Some("Mars/Olympus_Mons".into());
+        assert_eq!(
+            rules(check_locale(&req).await.unwrap_err()),
+            vec![
+                ("locale".into(), "oneof".into()),
+                ("timezone".into(), "oneof".into()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_validate_rejects_args_for_nix() {
+        let mut req = request("nix");
+        req.args.push("x".into());
+        assert_eq!(
+            rules(validate(&req).unwrap_err()),
+            vec![("args".into(), "unsupported".into())]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_idempotency_key_replays_the_first_response() {
+        let run = |content: &str| {
+            let mut req = request("python");
+            req.content = content.into();
+            run_submission(None, "127.0.0.1", Some(String::from("retry-test")), req)
+        };
+        let random = "import uuid; print(uuid.uuid4())";
+        let first = run(random).await.unwrap();
+        let retry = run(random).await.unwrap();
+        assert_eq!(retry.id, first.id);
+        assert_eq!(retry.result, first.result);
+
+        assert_eq!(
+            rules(run("print(1)").await.err().unwrap()),
+            vec![(IDEMPOTENCY_HEADER.into(), "reused".into())]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_file_contents_come_back_inline() {
+        let mut req = request("python");
+        req.content = "open('results.csv', 'w').write('x,y\\n1,2\\n')".into();
+        req.collect_files = true;
+        req.file_contents = Some(FileContents::Inline);
+        let response = run_submission(None, "127.0.0.1", None, req).await.unwrap();
+        let files = response.files.unwrap();
+        assert_eq!(files[0].path, "results.csv");
+        assert_eq!(files[0].data.as_deref(), Some("eCx5CjEsMgo="));
+    }
+
+    #[tokio::test]
+    async fn test_long_output_is_linked_past_inline_output_bytes() {
+        let mut req = request("python");
+        req.content = "print('x' * 10000)".into();
+        req.inline_output_bytes = Some(100);
+        let response = run_submission(None, "127.0.0.1", None, req).await.unwrap();
+        assert_eq!(response.result, "x".repeat(100));
+        assert_eq!(response.result_bytes, Some(10001));
+        assert!(response.result_url.unwrap().starts_with("/api/v1/artifacts/"));
+    }
+
+    #[tokio::test]
+    async fn test_compiler_warnings_come_back_without_failing_the_run() {
+        let mut req = request("rust");
+        req.content = "fn main() { let unused = 1; println!(\"hi\"); }".into();
+        let response = run_submission(None, "127.0.0.1", None, req).await.unwrap();
+        assert_eq!(response.result, "hi\n");
+        assert!(response.warnings.unwrap().contains("unused variable"));
+
+        let mut req = request("rust");
+        req.content = "fn main() { println!(\"hi\"); }".into();
+        let response = run_submission(None, "127.0.0.1", None, req).await.unwrap();
+        assert!(response.warnings.is_none());
+    }
+
+    #[tokio::test]
+    async fn test_msgpack_request_is_answered_in_msgpack() {
+        use axum::{body::Body, extract::FromRequest, http::header};
+
+        let body = rmp_serde::to_vec_named(&serde_json::json!({
+            "lang": "python",
+            "content": "print(6 * 7)",
+        }))
+        .unwrap();
+        let req = axum::http::Request::builder()
+            .header(header::CONTENT_TYPE, "application/msgpack")
+            .body(Body::from(body))
+            .unwrap();
+        let ValidBody(payload) = ValidBody::<CompilerRequest>::from_request(req, &())
+            .await
+            .unwrap();
+        let response = respond(ResponseFormat::MessagePack, None, "127.0.0.1", None, payload)
+            .await
+            .unwrap();
+        assert_eq!(response.headers()[header::CONTENT_TYPE], "application/msgpack");
+        let bytes = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        let value: serde_json::Value = rmp_serde::from_slice(&bytes).unwrap();
+        assert_eq!(value["result"], "42\n");
+    }
+}
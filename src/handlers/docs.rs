@@ -0,0 +1,211 @@
+use axum::{Json, response::Html};
+use utoipa::OpenApi;
+
+use crate::config::config;
+
+use crate::infra::{
+    audit::AuditEntry,
+    calibration::Calibration,
+    canary::CanaryRun,
+    catalog::LanguageInfo,
+    coverage::{CoverageReport, FileCoverage},
+    events::Submitter,
+    executions::{ExecutionInfo, ProcessUsage},
+    groups::{GroupStatus, MemberStatus},
+    history::RunRecord,
+    hooks::AppliedHook,
+    images::ImageAttachment,
+    interactive::Verdict,
+    jobs::{Job, JobStatus},
+    judge::{TestCase, TestResult},
+    lint::{Diagnostic, LintReport, Severity},
+    logs::{RunLog, RunStatus},
+    matrix::MatrixResult,
+    outputs::FileContents,
+    policy::{PolicyAction, PolicyMatch},
+    profile::{Hotspot, ProfileReport},
+    quickjs::JsEngine,
+    regrade::RegradeFilter,
+    runner::{OutputChunk, OutputEncoding, UsageSample},
+    sanitizer::{SanitizerReport, StackFrame},
+    scheduler::Priority,
+    tenants::TenantUsage,
+    transcript::TranscriptEntry,
+    wasm::Backend,
+    workspace::{FileChange, FileEntry},
+};
+
+use super::{
+    admin, archive, blobs, build, calibration, compare, compile,
+    estimate,
+    error::{Crashed, ErrorResponse, FieldError, TimedOut},
+    groups, health, interactive, jobs, judge, languages, lint, logs, matrix, metrics, sessions, snippets,
+    upload, usage,
+};
+
+#[derive(OpenApi)]
+#[openapi(
+    info(title = "comphub", description = "Compile and run code in many languages"),
+    paths(
+        compile::compile,
+        estimate::estimate,
+        archive::compile_archive,
+        upload::compile_upload,
+        build::build,
+        build::get_artifact,
+        blobs::upload_blob,
+        blobs::get_blob,
+        interactive::judge_interactive,
+        matrix::compile_matrix,
+        judge::judge,
+        compare::compare,
+        lint::lint,
+        jobs::submit_job,
+        jobs::get_job,
+        jobs::job_logs,
+        jobs::rerun_job,
+        jobs::job_history,
+        groups::submit_job_group,
+        groups::get_job_group,
+        logs::search_logs,
+        snippets::save_snippet,
+        snippets::get_snippet,
+        snippets::run_snippet,
+        sessions::open_session,
+        sessions::run_cell,
+        sessions::close_session,
+        health::healthz,
+        calibration::get_calibration,
+        languages::list_languages,
+        usage::get_usage,
+        metrics::metrics,
+        admin::list_executions,
+        admin::kill_execution,
+        admin::list_tenants,
+        admin::list_policy_matches,
+        admin::list_canary_runs,
+        admin::search_audit_log,
+        admin::regrade_submissions,
+    ),
+    components(schemas(
+        compile::CompilerRequest,
+        compile::CompilerResponse,
+        estimate::Estimate,
+        estimate::RunLimits,
+        estimate::Sandbox,
+        estimate::QueueEstimate,
+        jobs::JobRequest,
+        groups::GroupRequest,
+        groups::GroupedJob,
+        archive::ArchiveUpload,
+        upload::StdinUpload,
+        build::BuildRequest,
+        build::KeptArtifact,
+        blobs::StoredBlob,
+        interactive::InteractiveRequest,
+        interactive::InteractiveResponse,
+        Verdict,
+        matrix::MatrixRequest,
+        matrix::MatrixResponse,
+        MatrixResult,
+        judge::JudgeRequest,
+        judge::JudgeResponse,
+        TestCase,
+        TestResult,
+        compare::CompareRequest,
+        compare::CompareResponse,
+        compare::CompareMode,
+        snippets::Snippet,
+        snippets::SavedSnippet,
+        sessions::SessionRequest,
+        sessions::SessionResponse,
+        sessions::CellRequest,
+        sessions::CellResponse,
+        lint::LintRequest,
+        LintReport,
+        Diagnostic,
+        Severity,
+        ErrorResponse,
+        FieldError,
+        TimedOut,
+        Crashed,
+        health::Status,
+        Calibration,
+        LanguageInfo,
+        usage::UsageResponse,
+        TenantUsage,
+        PolicyMatch,
+        CanaryRun,
+        PolicyAction,
+        AuditEntry,
+        AppliedHook,
+        Job,
+        JobStatus,
+        GroupStatus,
+        MemberStatus,
+        admin::RegradeRequest,
+        RegradeFilter,
+        Priority,
+        RunLog,
+        RunStatus,
+        RunRecord,
+        OutputChunk,
+        UsageSample,
+        TranscriptEntry,
+        FileEntry,
+        FileChange,
+        FileContents,
+        ImageAttachment,
+        Backend,
+        JsEngine,
+        OutputEncoding,
+        CoverageReport,
+        FileCoverage,
+        SanitizerReport,
+        StackFrame,
+        ProfileReport,
+        Hotspot,
+        ExecutionInfo,
+        ProcessUsage,
+        Submitter,
+    )),
+    tags(
+        (name = "compile", description = "Compile and execute source code"),
+        (name = "jobs", description = "Asynchronous execution"),
+        (name = "snippets", description = "Saved programs shared by link"),
+        (name = "sessions", description = "Notebook-style cells that share state"),
+        (name = "logs", description = "Recent run history"),
+        (name = "health", description = "Liveness checks"),
+        (name = "admin", description = "Operator controls, enabled by ADMIN_TOKEN"),
+    )
+)]
+pub struct ApiDoc;
+
+// Swagger UI itself is not embedded: `{assets}` is SWAGGER_UI_ASSETS, by
+// default a CDN the viewer's browser has to be able to reach.
+const SWAGGER_UI: &str = r##"<!doctype html>
+<html lang="en">
+<head>
+    <meta charset="utf-8" />
+    <title>comphub API</title>
+    <link rel="stylesheet" href="{assets}/swagger-ui.css" />
+</head>
+<body>
+    <div id="swagger-ui"></div>
+    <script src="{assets}/swagger-ui-bundle.js" crossorigin></script>
+    <script>
+        window.onload = () => {
+            window.ui = SwaggerUIBundle({ url: "/api/v1/openapi.json", dom_id: "#swagger-ui" });
+        };
+    </script>
+</body>
+</html>
+"##;
+
+pub async fn openapi_json() -> Json<utoipa::openapi::OpenApi> {
+    Json(ApiDoc::openapi())
+}
+
+pub async fn swagger_ui() -> Html<String> {
+    Html(SWAGGER_UI.replace("{assets}", config().await.swagger_ui_assets()))
+}
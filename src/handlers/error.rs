@@ -1,13 +1,134 @@
+use std::{os::unix::process::ExitStatusExt, time::Duration};
+
 use axum::{
     Json,
-    http::StatusCode,
+    http::{HeaderValue, StatusCode, header},
     response::{IntoResponse, Response},
 };
-use serde_json::json;
+use serde::Serialize;
 use thiserror::Error;
 use tracing;
+use utoipa::ToSchema;
+
+use crate::infra::{
+    crash::signal_name,
+    error::{Crash, InfraError, PartialRun},
+};
+
+#[derive(Debug, Clone, PartialEq, Serialize, ToSchema)]
+pub struct FieldError {
+    #[schema(example = "lang")]
+    pub field: String,
+    #[schema(example = "oneof")]
+    pub rule: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub allowed_values: Option<Vec<String>>,
+    #[schema(example = "cobol language is not supported")]
+    pub message: String,
+}
+
+impl FieldError {
+    pub fn new(field: &str, rule: &str, message: impl Into<String>) -> Self {
+        FieldError {
+            field: field.to_string(),
+            rule: rule.to_string(),
+            allowed_values: None,
+            message: message.into(),
+        }
+    }
+
+    pub fn allowed<I: IntoIterator<Item = S>, S: ToString>(mut self, values: I) -> Self {
+        self.allowed_values = Some(values.into_iter().map(|v| v.to_string()).collect());
+        self
+    }
+}
+
+fn describe(errors: &[FieldError]) -> String {
+    errors
+        .iter()
+        .map(|err| format!("{}: {}", err.field, err.message))
+        .collect::<Vec<_>>()
+        .join("; ")
+}
+
+// A run stopped by its time limit: how long it ran and the start of what
+// it wrote until then.
+#[derive(Debug, Clone, PartialEq, Serialize, ToSchema)]
+pub struct TimedOut {
+    #[schema(example = 5000)]
+    pub limit_ms: u64,
+    #[schema(example = 5003)]
+    pub elapsed_ms: u64,
+    #[schema(example = "iteration 1\niteration 2\n")]
+    pub stdout: String,
+    pub stderr: String,
+}
+
+impl TimedOut {
+    fn new(limit: Duration, partial: &PartialRun) -> Self {
+        TimedOut {
+            limit_ms: limit.as_millis() as u64,
+            elapsed_ms: partial.elapsed.as_millis() as u64,
+            stdout: partial.stdout.clone(),
+            stderr: partial.stderr.clone(),
+        }
+    }
+}
+
+// A program that exited unsuccessfully: how it ended and the start of what
+// it wrote before it did.
+#[derive(Debug, Clone, PartialEq, Serialize, ToSchema)]
+pub struct Crashed {
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = 1)]
+    pub exit_code: Option<i32>,
+    // Set instead of `exit_code` when a signal killed the program.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = 11)]
+    pub signal: Option<i32>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = "SIGSEGV")]
+    pub signal_name: Option<String>,
+    // Innermost frame first, when crash backtraces are on.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    #[schema(example = json!(["#0  0x0000555555555131 in main () at main.c:5"]))]
+    pub backtrace: Vec<String>,
+    #[schema(example = 120)]
+    pub elapsed_ms: u64,
+    #[schema(example = "iteration 1\niteration 2\n")]
+    pub stdout: String,
+    pub stderr: String,
+}
 
-use crate::infra::error::InfraError;
+impl Crashed {
+    fn new(crash: &Crash) -> Self {
+        Crashed {
+            exit_code: crash.status.code(),
+            signal: crash.status.signal(),
+            signal_name: crash
+                .status
+                .signal()
+                .and_then(signal_name)
+                .map(str::to_string),
+            backtrace: crash.stack.clone(),
+            elapsed_ms: crash.output.elapsed.as_millis() as u64,
+            stdout: crash.output.stdout.clone(),
+            stderr: crash.output.stderr.clone(),
+        }
+    }
+}
+
+#[derive(Serialize, ToSchema)]
+pub struct ErrorResponse {
+    #[schema(example = "Bad request: missing field `lang`")]
+    message: String,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    errors: Vec<FieldError>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    timed_out: Option<TimedOut>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    crashed: Option<Crashed>,
+}
 
 #[derive(Debug, Error)]
 pub enum ApiError {
@@ -17,36 +138,176 @@ pub enum ApiError {
     #[error("Bad Request: {0}")]
     BadRequest(String),
 
-    #[error("Validation error: {0}")]
-    ValidationError(String),
+    #[error("Unauthorized: {0}")]
+    Unauthorized(String),
+
+    #[error("Forbidden: {0}")]
+    Forbidden(String),
+
+    #[error("Conflict: {0}")]
+    Conflict(String),
+
+    #[error("Validation error: {}", describe(.0))]
+    ValidationError(Vec<FieldError>),
+
+    #[error("Payload too large: {}", describe(.0))]
+    PayloadTooLarge(Vec<FieldError>),
 
     #[error("Not Acceptable: {0}")]
     NotAcceptible(String),
 
+    #[error("Service unavailable: {0}")]
+    ServiceUnavailable(String),
+
+    #[error("Too many requests: {0}")]
+    TooManyRequests(String),
+
+    // Sent with a Retry-After header of the given duration.
+    #[error("Too many requests: {0}")]
+    Overloaded(String, Duration),
+
+    #[error("Internal server error: {0}")]
+    Internal(String),
+
     #[error("Not Acceptable: {0}")]
     InternalServerError(#[from] InfraError),
 }
 
-impl IntoResponse for ApiError {
-    fn into_response(self) -> Response {
+impl ErrorResponse {
+    pub fn message(&self) -> &str {
+        &self.message
+    }
+}
+
+impl ApiError {
+    // The Retry-After header value telling a client that was turned away
+    // when to come back, if the error says.
+    pub fn retry_after(&self) -> Option<HeaderValue> {
+        match self {
+            Self::Overloaded(_, after) => Some(HeaderValue::from(after.as_secs().max(1))),
+            _ => None,
+        }
+    }
+
+    // The status and body the error is reported with, for responses that
+    // are not plain JSON.
+    pub fn report(self) -> (StatusCode, ErrorResponse) {
         tracing::error!("API Error: {}", self);
 
-        let (status, err_msg) = match self {
-            Self::NotFound(msg) => (StatusCode::NOT_FOUND, format!("Not found: {}", msg)),
-            Self::BadRequest(msg) => (StatusCode::BAD_REQUEST, format!("Bad request: {}", msg)),
-            Self::ValidationError(err) => {
-                (StatusCode::BAD_REQUEST, format!("Invalid input: {}", err))
+        let timed_out = match &self {
+            Self::InternalServerError(InfraError::Timeout(limit, partial)) => {
+                Some(TimedOut::new(*limit, partial))
             }
+            _ => None,
+        };
+        let crashed = match &self {
+            Self::InternalServerError(InfraError::CompilationError(err)) => {
+                err.downcast_ref::<Crash>().map(Crashed::new)
+            }
+            _ => None,
+        };
+        let (status, err_msg, errors) = match self {
+            Self::NotFound(msg) => (
+                StatusCode::NOT_FOUND,
+                format!("Not found: {}", msg),
+                Vec::new(),
+            ),
+            Self::BadRequest(msg) => (
+                StatusCode::BAD_REQUEST,
+                format!("Bad request: {}", msg),
+                Vec::new(),
+            ),
+            Self::Unauthorized(msg) => (
+                StatusCode::UNAUTHORIZED,
+                format!("Unauthorized: {}", msg),
+                Vec::new(),
+            ),
+            Self::Forbidden(msg) => (
+                StatusCode::FORBIDDEN,
+                format!("Forbidden: {}", msg),
+                Vec::new(),
+            ),
+            Self::Conflict(msg) => (
+                StatusCode::CONFLICT,
+                format!("Conflict: {}", msg),
+                Vec::new(),
+            ),
+            Self::ValidationError(errors) => (
+                StatusCode::BAD_REQUEST,
+                format!("Invalid input: {}", describe(&errors)),
+                errors,
+            ),
+            Self::PayloadTooLarge(errors) => (
+                StatusCode::PAYLOAD_TOO_LARGE,
+                format!("Payload too large: {}", describe(&errors)),
+                errors,
+            ),
             Self::NotAcceptible(msg) => (
                 StatusCode::NOT_ACCEPTABLE,
                 format!("Not Acceptable: {}", msg),
+                Vec::new(),
+            ),
+            Self::ServiceUnavailable(msg) => (
+                StatusCode::SERVICE_UNAVAILABLE,
+                format!("Service unavailable: {}", msg),
+                Vec::new(),
+            ),
+            Self::TooManyRequests(msg) | Self::Overloaded(msg, _) => (
+                StatusCode::TOO_MANY_REQUESTS,
+                format!("Too many requests: {}", msg),
+                Vec::new(),
+            ),
+            Self::Internal(msg) => (
+                StatusCode::INTERNAL_SERVER_ERROR,
+                format!("Internal server error: {}", msg),
+                Vec::new(),
+            ),
+            Self::InternalServerError(err @ InfraError::Timeout(..)) => (
+                StatusCode::REQUEST_TIMEOUT,
+                err.to_string(),
+                Vec::new(),
+            ),
+            Self::InternalServerError(err @ InfraError::BlockedSyscall(_)) => (
+                StatusCode::FORBIDDEN,
+                err.to_string(),
+                Vec::new(),
+            ),
+            Self::InternalServerError(
+                err @ (InfraError::DiskQuotaExceeded(_) | InfraError::OutputLimitExceeded(_)),
+            ) => (
+                StatusCode::INSUFFICIENT_STORAGE,
+                err.to_string(),
+                Vec::new(),
             ),
             Self::InternalServerError(err) => (
                 StatusCode::INTERNAL_SERVER_ERROR,
                 format!("Internal server error: {}", err),
+                Vec::new(),
             ),
         };
 
-        (status, Json(json!({ "message": err_msg }))).into_response()
+        (
+            status,
+            ErrorResponse {
+                message: err_msg,
+                errors,
+                timed_out,
+                crashed,
+            },
+        )
+    }
+}
+
+impl IntoResponse for ApiError {
+    fn into_response(self) -> Response {
+        let retry_after = self.retry_after();
+        let (status, body) = self.report();
+        let mut response = (status, Json(body)).into_response();
+        if let Some(retry_after) = retry_after {
+            response
+                .headers_mut()
+                .insert(header::RETRY_AFTER, retry_after);
+        }
+        response
     }
 }
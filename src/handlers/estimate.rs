@@ -0,0 +1,197 @@
+use axum::Json;
+use serde::Serialize;
+use utoipa::ToSchema;
+
+use crate::config::config;
+use crate::infra::{
+    calibration::calibration, compile::confine, disk, executions, jobs::job_queue,
+    limits::language_defaults, load, runner::ExecContext, sandbox::sandboxed, tier::tiers,
+    toolchain::Toolchain,
+};
+
+use super::{
+    compile::{
+        CompilerRequest, admit_language, check_dependencies, check_limits, check_request,
+        has_cached_result, requested_features, resolve_lang, resolve_version,
+    },
+    error::{ApiError, ErrorResponse},
+    extract::{ApiKey, ValidBody},
+};
+
+// What a submission would be held to if it were sent now.
+#[derive(Debug, Serialize, ToSchema)]
+pub struct Estimate {
+    #[schema(example = "python")]
+    pub lang: String,
+    // The installed version the request asked for.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub version: Option<String>,
+    // The tier the API key belongs to.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub tier: Option<String>,
+    pub limits: RunLimits,
+    pub sandbox: Sandbox,
+    // The result would come from the result cache without running.
+    pub cached: bool,
+    pub queue: QueueEstimate,
+    // Why a submission would be turned away right now, if it would be.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub refused: Option<String>,
+}
+
+// Limits left out are not enforced.
+#[derive(Debug, Serialize, ToSchema)]
+pub struct RunLimits {
+    // Scaled by the host's calibration factor.
+    pub timeout_ms: Option<u64>,
+    pub compile_timeout_ms: Option<u64>,
+    pub memory_bytes: Option<u64>,
+    pub max_output_bytes: Option<usize>,
+    pub disk_quota_bytes: Option<u64>,
+    pub max_concurrent_runs: Option<usize>,
+}
+
+#[derive(Debug, Serialize, ToSchema)]
+pub struct Sandbox {
+    // Programs run as an unprivileged user of their own.
+    pub isolated_user: bool,
+    // The seccomp profile programs are confined to, if any.
+    #[schema(example = "strict")]
+    pub syscall_profile: Option<String>,
+}
+
+// Runs sent to /compile start at once; jobs wait their turn for a worker.
+#[derive(Debug, Serialize, ToSchema)]
+pub struct QueueEstimate {
+    pub runs_in_progress: usize,
+    pub jobs_waiting: usize,
+    // How long a job submitted now should wait for a worker, unknown until
+    // a job has finished.
+    pub expected_wait_ms: Option<u64>,
+}
+
+// Why a run of `toolchain` would be turned away before it started.
+fn refusal(toolchain: Toolchain) -> Option<String> {
+    if let Some(overload) = load::overloaded() {
+        return Some(format!(
+            "{}, retry after {}s",
+            overload.pressure.describe(),
+            overload.retry_after.as_secs()
+        ));
+    }
+    (toolchain.is_compiled() && disk::under_pressure())
+        .then(|| String::from("compiled languages are paused while disk space is low"))
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/estimate",
+    tag = "compile",
+    request_body(content(
+        (CompilerRequest = "application/json"),
+        (CompilerRequest = "application/msgpack"),
+    )),
+    params(
+        ("x-api-key" = Option<String>, Header, description = "API key that selects the caller's tier"),
+    ),
+    responses(
+        (status = 200, description = "The request is valid; the limits and sandbox it would run under, whether its result is cached and how busy the server is. Nothing is run and no rate limit is spent", body = Estimate),
+        (status = 400, description = "Malformed request body or invalid fields", body = ErrorResponse),
+        (status = 403, description = "The API key's tier does not include a requested feature or the program's language", body = ErrorResponse),
+        (status = 413, description = "Request body, code or stdin exceeds its size limit", body = ErrorResponse),
+    )
+)]
+pub async fn estimate(
+    ApiKey(api_key): ApiKey,
+    ValidBody(payload): ValidBody<CompilerRequest>,
+) -> Result<Json<Estimate>, ApiError> {
+    let resolved = tiers().await.resolve(api_key.as_deref());
+    let tier = resolved.map(|(_, tier)| tier);
+    if let Some((name, tier)) = resolved {
+        let features = requested_features(&payload);
+        if let Some(feature) = features.iter().find(|feature| !tier.allows(**feature)) {
+            return Err(ApiError::Forbidden(format!(
+                "{} is not available on the {} tier",
+                feature.as_str(),
+                name
+            )));
+        }
+    }
+    check_limits(&payload.content, &payload.stdin, tier).await?;
+    let toolchain = resolve_lang(&payload.lang)?;
+    check_request(toolchain, &payload)?;
+    admit_language(tier, toolchain)?;
+    let version = resolve_version(toolchain, payload.version.as_deref()).await?;
+    check_dependencies(toolchain, &payload.dependencies, tier).await?;
+
+    let mut ctx = ExecContext::default();
+    if let Some(tier) = tier {
+        ctx = tier.apply(ctx);
+    }
+    let ctx = confine(ctx, &toolchain, config().await, language_defaults().await);
+    let calibration = calibration().await;
+    let limits = RunLimits {
+        timeout_ms: ctx
+            .timeout()
+            .map(|limit| calibration.scale(limit).as_millis() as u64),
+        compile_timeout_ms: ctx.compile_timeout().map(|limit| limit.as_millis() as u64),
+        memory_bytes: ctx.memory_limit(),
+        max_output_bytes: ctx.max_output(),
+        disk_quota_bytes: ctx.disk_quota(),
+        max_concurrent_runs: tier.and_then(|tier| tier.max_concurrent_runs),
+    };
+    let queue = job_queue().await;
+    Ok(Json(Estimate {
+        lang: toolchain.as_str().to_string(),
+        version: version.map(|version| version.name.clone()),
+        tier: resolved.map(|(name, _)| name.to_string()),
+        limits,
+        sandbox: Sandbox {
+            isolated_user: sandboxed(),
+            syscall_profile: ctx
+                .syscall_profile()
+                .map(|profile| profile.as_str().to_string()),
+        },
+        cached: has_cached_result(&payload, tier, version).await,
+        queue: QueueEstimate {
+            runs_in_progress: executions::in_progress(),
+            jobs_waiting: queue.waiting(),
+            expected_wait_ms: queue.expected_wait().map(|wait| wait.as_millis() as u64),
+        },
+        refused: refusal(toolchain),
+    }))
+}
+
+#[cfg(test)]
+mod estimate_tests {
+    use super::*;
+    use crate::handlers::snippets::Snippet;
+
+    fn request(lang: &str) -> CompilerRequest {
+        Snippet {
+            lang: lang.into(),
+            content: "print(input())".into(),
+            stdin: String::new(),
+        }
+        .into()
+    }
+
+    #[tokio::test]
+    async fn test_estimate_reports_limits_without_running() {
+        let Json(report) = estimate(ApiKey(None), ValidBody(request("python")))
+            .await
+            .unwrap();
+        assert_eq!(report.lang, "python");
+        assert_eq!(report.tier, None);
+        assert!(report.limits.timeout_ms.is_some());
+        assert!(!report.cached);
+        assert_eq!(report.refused, None);
+
+        let Err(ApiError::ValidationError(errors)) =
+            estimate(ApiKey(None), ValidBody(request("cobol"))).await
+        else {
+            panic!("expected validation error");
+        };
+        assert_eq!(errors[0].field, "lang");
+    }
+}
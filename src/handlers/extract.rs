@@ -0,0 +1,419 @@
+use std::{convert::Infallible, net::SocketAddr};
+
+use axum::{
+    body::Bytes,
+    extract::{ConnectInfo, FromRequest, FromRequestParts, Request},
+    http::{HeaderMap, StatusCode, header, request::Parts},
+};
+use serde::de::DeserializeOwned;
+
+use crate::{
+    config::config,
+    infra::scheduler::{IDEMPOTENCY_HEADER, TENANT_HEADER},
+};
+
+use super::error::{ApiError, FieldError};
+
+pub struct ValidJson<T>(pub T);
+
+impl<T, S> FromRequest<S> for ValidJson<T>
+where
+    T: DeserializeOwned,
+    S: Send + Sync,
+{
+    type Rejection = ApiError;
+
+    async fn from_request(req: Request, state: &S) -> Result<Self, Self::Rejection> {
+        if !is_json(req.headers()) {
+            return Err(ApiError::ValidationError(vec![FieldError::new(
+                "body",
+                "json",
+                "Expected request with `Content-Type: application/json`",
+            )]));
+        }
+        let bytes = read_body(req, state).await?;
+        parse_json(&bytes)
+            .map(ValidJson)
+            .map_err(|err| ApiError::ValidationError(vec![err]))
+    }
+}
+
+async fn read_body<S: Send + Sync>(req: Request, state: &S) -> Result<Bytes, ApiError> {
+    let limit = config().await.request_max_bytes();
+    Bytes::from_request(req, state).await.map_err(|rejection| {
+        if rejection.status() == StatusCode::PAYLOAD_TOO_LARGE {
+            ApiError::PayloadTooLarge(vec![FieldError::new(
+                "body",
+                "max_bytes",
+                format!("request body must be at most {} bytes", limit),
+            )])
+        } else {
+            ApiError::BadRequest(rejection.body_text())
+        }
+    })
+}
+
+// Like `ValidJson`, but also takes a MessagePack body when the request's
+// Content-Type says it is one.
+pub struct ValidBody<T>(pub T);
+
+// The request's Content-Type without its parameters, lowercased.
+fn media_type(headers: &HeaderMap) -> Option<String> {
+    headers
+        .get(header::CONTENT_TYPE)
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| value.split(';').next())
+        .map(|media_type| media_type.trim().to_ascii_lowercase())
+}
+
+// application/json, or a type that declares itself JSON with +json.
+fn is_json(headers: &HeaderMap) -> bool {
+    media_type(headers).is_some_and(|media_type| {
+        media_type
+            .strip_prefix("application/")
+            .is_some_and(|subtype| subtype == "json" || subtype.ends_with("+json"))
+    })
+}
+
+fn is_msgpack(headers: &HeaderMap) -> bool {
+    media_type(headers).is_some_and(|media_type| {
+        ResponseFormat::from_media_type(&media_type) == Some(ResponseFormat::MessagePack)
+    })
+}
+
+impl<T, S> FromRequest<S> for ValidBody<T>
+where
+    T: DeserializeOwned,
+    S: Send + Sync,
+{
+    type Rejection = ApiError;
+
+    async fn from_request(req: Request, state: &S) -> Result<Self, Self::Rejection> {
+        if !is_msgpack(req.headers()) {
+            let ValidJson(value) = ValidJson::from_request(req, state).await?;
+            return Ok(ValidBody(value));
+        }
+        let bytes = read_body(req, state).await?;
+        rmp_serde::from_slice(&bytes).map(ValidBody).map_err(|err| {
+            ApiError::ValidationError(vec![FieldError::new("body", "msgpack", err.to_string())])
+        })
+    }
+}
+
+pub struct ClientIp(pub String);
+
+// The client X-Forwarded-For names when each of `hops` proxies in front
+// appended whom it heard the request from. Entries further left were sent
+// by the client itself and prove nothing.
+fn forwarded_client(headers: &HeaderMap, hops: usize) -> Option<String> {
+    let listed: Vec<&str> = headers
+        .get_all("x-forwarded-for")
+        .iter()
+        .filter_map(|value| value.to_str().ok())
+        .flat_map(|value| value.split(','))
+        .map(str::trim)
+        .filter(|ip| !ip.is_empty())
+        .collect();
+    let client = listed.len().checked_sub(1)?.saturating_sub(hops - 1);
+    Some(listed[client].to_string())
+}
+
+impl<S> FromRequestParts<S> for ClientIp
+where
+    S: Send + Sync,
+{
+    type Rejection = Infallible;
+
+    async fn from_request_parts(parts: &mut Parts, _: &S) -> Result<Self, Self::Rejection> {
+        let app_config = config().await;
+        if app_config.trust_forwarded_for() {
+            if let Some(ip) = forwarded_client(&parts.headers, app_config.forwarded_hops()) {
+                return Ok(ClientIp(ip));
+            }
+        }
+
+        let ip = parts
+            .extensions
+            .get::<ConnectInfo<SocketAddr>>()
+            .map(|ConnectInfo(addr)| addr.ip().to_string())
+            .unwrap_or_else(|| String::from("unknown"));
+        Ok(ClientIp(ip))
+    }
+}
+
+pub struct ApiKey(pub Option<String>);
+
+impl<S> FromRequestParts<S> for ApiKey
+where
+    S: Send + Sync,
+{
+    type Rejection = Infallible;
+
+    async fn from_request_parts(parts: &mut Parts, _: &S) -> Result<Self, Self::Rejection> {
+        let key = parts
+            .headers
+            .get(TENANT_HEADER)
+            .and_then(|value| value.to_str().ok())
+            .map(String::from);
+        Ok(ApiKey(key))
+    }
+}
+
+pub struct IdempotencyKey(pub Option<String>);
+
+impl<S> FromRequestParts<S> for IdempotencyKey
+where
+    S: Send + Sync,
+{
+    type Rejection = Infallible;
+
+    async fn from_request_parts(parts: &mut Parts, _: &S) -> Result<Self, Self::Rejection> {
+        let key = parts
+            .headers
+            .get(IDEMPOTENCY_HEADER)
+            .and_then(|value| value.to_str().ok())
+            .filter(|value| !value.is_empty())
+            .map(String::from);
+        Ok(IdempotencyKey(key))
+    }
+}
+
+pub const NDJSON: &str = "application/x-ndjson";
+pub const MSGPACK: &str = "application/msgpack";
+pub const EVENT_STREAM: &str = "text/event-stream";
+
+// How a run is answered, chosen from the Accept header.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ResponseFormat {
+    Json,
+    // Only the program's output, for use from a terminal.
+    Text,
+    // One JSON event per line, sent as the program writes its output.
+    Ndjson,
+    // The JSON document encoded as MessagePack, which is smaller and
+    // cheaper to encode for clients that parse it themselves.
+    MessagePack,
+    // Server-sent events, for clients that can read a stream but not an
+    // NDJSON one, such as a browser's EventSource.
+    EventStream,
+}
+
+impl ResponseFormat {
+    fn from_media_type(media_type: &str) -> Option<Self> {
+        match media_type {
+            "*/*" | "application/*" | "application/json" => Some(ResponseFormat::Json),
+            "text/*" | "text/plain" => Some(ResponseFormat::Text),
+            NDJSON => Some(ResponseFormat::Ndjson),
+            MSGPACK | "application/x-msgpack" | "application/vnd.msgpack" => {
+                Some(ResponseFormat::MessagePack)
+            }
+            EVENT_STREAM => Some(ResponseFormat::EventStream),
+            _ => None,
+        }
+    }
+
+    // The supported format with the highest quality, the first listed among
+    // equals. None if the client accepts none of them.
+    pub fn negotiate(accept: &str) -> Option<Self> {
+        let mut best: Option<(f32, Self)> = None;
+        for entry in accept.split(',') {
+            let mut params = entry.split(';');
+            let media_type = params
+                .next()
+                .unwrap_or_default()
+                .trim()
+                .to_ascii_lowercase();
+            let quality = params
+                .find_map(|param| param.trim().strip_prefix("q="))
+                .and_then(|quality| quality.parse::<f32>().ok())
+                .unwrap_or(1.0);
+            let Some(format) = Self::from_media_type(&media_type) else {
+                continue;
+            };
+            if quality > 0.0 && best.is_none_or(|(best, _)| quality > best) {
+                best = Some((quality, format));
+            }
+        }
+        best.map(|(_, format)| format)
+    }
+}
+
+impl<S> FromRequestParts<S> for ResponseFormat
+where
+    S: Send + Sync,
+{
+    type Rejection = ApiError;
+
+    async fn from_request_parts(parts: &mut Parts, _: &S) -> Result<Self, Self::Rejection> {
+        let Some(accept) = parts
+            .headers
+            .get(header::ACCEPT)
+            .and_then(|value| value.to_str().ok())
+            .filter(|value| !value.trim().is_empty())
+        else {
+            return Ok(ResponseFormat::Json);
+        };
+        ResponseFormat::negotiate(accept).ok_or_else(|| {
+            ApiError::NotAcceptible(format!(
+                "responses are available as application/json, text/plain, {}, {} or {}",
+                NDJSON, EVENT_STREAM, MSGPACK
+            ))
+        })
+    }
+}
+
+// Deserializes a JSON body, naming the field at fault when it does not fit.
+fn parse_json<T: DeserializeOwned>(bytes: &[u8]) -> Result<T, FieldError> {
+    let mut deserializer = serde_json::Deserializer::from_slice(bytes);
+    let value =
+        serde_path_to_error::deserialize(&mut deserializer).map_err(|err| translate(&err))?;
+    deserializer
+        .end()
+        .map_err(|err| FieldError::new("body", "json", err.to_string()))?;
+    Ok(value)
+}
+
+fn translate(err: &serde_path_to_error::Error<serde_json::Error>) -> FieldError {
+    let inner = err.inner();
+    let message = inner.to_string();
+    if !inner.is_data() {
+        return FieldError::new("body", "json", message);
+    }
+    // A path of "." is the document itself.
+    let path = err.path().to_string();
+    let path = (path != ".").then_some(path);
+
+    // serde reports a missing field against the object lacking it, and
+    // names the field only in its message.
+    if let Some(field) = message
+        .strip_prefix("missing field `")
+        .and_then(|rest| rest.split('`').next())
+    {
+        let field = match path {
+            Some(path) => format!("{}.{}", path, field),
+            None => field.to_string(),
+        };
+        return FieldError::new(&field, "required", format!("{} is required", field));
+    }
+    match path {
+        Some(path) => FieldError::new(&path, "type", message),
+        None => FieldError::new("body", "json", message),
+    }
+}
+
+#[cfg(test)]
+mod extract_tests {
+    use super::*;
+
+    #[test]
+    fn test_forwarded_client_counts_hops_from_the_right() {
+        let mut headers = HeaderMap::new();
+        assert_eq!(forwarded_client(&headers, 1), None);
+        headers.append("x-forwarded-for", "6.6.6.6, 1.2.3.4".parse().unwrap());
+        headers.append("x-forwarded-for", "10.0.0.1".parse().unwrap());
+        assert_eq!(forwarded_client(&headers, 1).as_deref(), Some("10.0.0.1"));
+        assert_eq!(forwarded_client(&headers, 2).as_deref(), Some("1.2.3.4"));
+        assert_eq!(forwarded_client(&headers, 5).as_deref(), Some("6.6.6.6"));
+    }
+
+    #[derive(Debug, serde::Deserialize)]
+    #[allow(dead_code)]
+    struct Limits {
+        cpu: u32,
+    }
+
+    #[derive(Debug, serde::Deserialize)]
+    #[allow(dead_code)]
+    struct Payload {
+        lang: String,
+        #[serde(default)]
+        args: Vec<String>,
+        limits: Option<Limits>,
+    }
+
+    fn parse_error(body: &str) -> FieldError {
+        parse_json::<Payload>(body.as_bytes()).unwrap_err()
+    }
+
+    #[test]
+    fn test_translate_missing_field() {
+        assert_eq!(
+            parse_error("{}"),
+            FieldError::new("lang", "required", "lang is required")
+        );
+        assert_eq!(
+            parse_error(r#"{"lang": "c", "limits": {}}"#).field,
+            "limits.cpu"
+        );
+    }
+
+    #[test]
+    fn test_translate_field_type_error() {
+        let err = parse_error(r#"{"lang": "c", "args": [1]}"#);
+        assert_eq!(err.field, "args[0]");
+        assert_eq!(err.rule, "type");
+        assert!(err.message.starts_with("invalid type: integer"));
+    }
+
+    #[test]
+    fn test_translate_syntax_error() {
+        for body in [r#"{"lang": "c""#, r#"{"lang": "c"} {}"#, "[]"] {
+            let err = parse_error(body);
+            assert_eq!(err.field, "body");
+            assert_eq!(err.rule, "json");
+        }
+        assert!(parse_json::<Payload>(br#"{"lang": "c"}"#).is_ok());
+    }
+
+    #[test]
+    fn test_json_bodies_are_recognised_by_content_type() {
+        let headers = |content_type: &str| {
+            let mut headers = HeaderMap::new();
+            headers.insert(header::CONTENT_TYPE, content_type.parse().unwrap());
+            headers
+        };
+        assert!(is_json(&headers("application/json; charset=utf-8")));
+        assert!(is_json(&headers("application/problem+json")));
+        assert!(!is_json(&headers("text/json")));
+        assert!(!is_json(&HeaderMap::new()));
+    }
+
+    #[test]
+    fn test_msgpack_bodies_are_recognised_by_content_type() {
+        let headers = |content_type: &str| {
+            let mut headers = HeaderMap::new();
+            headers.insert(header::CONTENT_TYPE, content_type.parse().unwrap());
+            headers
+        };
+        assert!(is_msgpack(&headers("application/msgpack")));
+        assert!(is_msgpack(&headers(
+            "Application/X-MsgPack; charset=binary"
+        )));
+        assert!(!is_msgpack(&headers("application/json")));
+        assert!(!is_msgpack(&HeaderMap::new()));
+    }
+
+    #[test]
+    fn test_negotiate_prefers_highest_quality_supported_type() {
+        let negotiate = ResponseFormat::negotiate;
+        assert_eq!(negotiate("*/*"), Some(ResponseFormat::Json));
+        assert_eq!(negotiate("text/plain"), Some(ResponseFormat::Text));
+        assert_eq!(
+            negotiate("text/html, application/x-ndjson, */*;q=0.8"),
+            Some(ResponseFormat::Ndjson)
+        );
+        assert_eq!(
+            negotiate("application/json;q=0.5, Text/Plain;q=0.9"),
+            Some(ResponseFormat::Text)
+        );
+        assert_eq!(
+            negotiate("application/x-msgpack, application/json;q=0.9"),
+            Some(ResponseFormat::MessagePack)
+        );
+        assert_eq!(
+            negotiate("text/event-stream"),
+            Some(ResponseFormat::EventStream)
+        );
+        assert_eq!(negotiate("text/plain;q=0, image/png"), None);
+    }
+}
@@ -0,0 +1,264 @@
+use std::{convert::Infallible, future::Future, pin::Pin};
+
+use axum::{
+    body::{Body, Bytes},
+    http::{HeaderValue, StatusCode, header},
+    response::{
+        IntoResponse, Response,
+        sse::{Event, KeepAlive, Sse},
+    },
+};
+use futures_util::stream;
+use serde::Serialize;
+use tokio::sync::mpsc::{self, UnboundedReceiver, UnboundedSender};
+
+use crate::infra::runner::{OutputChunk, UsageSample};
+
+use super::{
+    compile::CompilerResponse,
+    error::{ApiError, ErrorResponse},
+    extract::NDJSON,
+};
+
+pub fn plain_text(status: StatusCode, text: String) -> Response {
+    (
+        status,
+        [(
+            header::CONTENT_TYPE,
+            HeaderValue::from_static("text/plain; charset=utf-8"),
+        )],
+        text,
+    )
+        .into_response()
+}
+
+// The response to a request that asked for text and failed.
+pub fn plain_text_error(err: ApiError) -> Response {
+    let retry_after = err.retry_after();
+    let (status, body) = err.report();
+    let mut response = plain_text(status, format!("{}\n", body.message()));
+    if let Some(retry_after) = retry_after {
+        response
+            .headers_mut()
+            .insert(header::RETRY_AFTER, retry_after);
+    }
+    response
+}
+
+// One line of an NDJSON response. Output and usage events arrive while the
+// program runs, and the stream ends with its result or the error that
+// stopped it. The status is 200 either way, since it is sent before the run
+// finishes.
+#[derive(Serialize)]
+#[serde(tag = "event", rename_all = "lowercase")]
+pub enum StreamEvent {
+    Output(OutputChunk),
+    Usage(UsageSample),
+    Result(CompilerResponse),
+    Error {
+        status: u16,
+        #[serde(flatten)]
+        error: ErrorResponse,
+    },
+}
+
+impl StreamEvent {
+    fn finished(result: Result<CompilerResponse, ApiError>) -> Self {
+        match result {
+            Ok(response) => StreamEvent::Result(response),
+            Err(err) => {
+                let (status, error) = err.report();
+                StreamEvent::Error {
+                    status: status.as_u16(),
+                    error,
+                }
+            }
+        }
+    }
+
+    pub fn line(&self) -> Bytes {
+        let mut line = serde_json::to_vec(self).unwrap_or_default();
+        line.push(b'\n');
+        Bytes::from(line)
+    }
+
+    // As a server-sent event: output as `stdout` or `stderr` with the text
+    // as a JSON string, `usage` with the sample, then `result` or `error`
+    // with the document NDJSON ends with.
+    fn sse(&self) -> Result<Event, axum::Error> {
+        let name = match self {
+            StreamEvent::Output(OutputChunk::Stdout(_)) => "stdout",
+            StreamEvent::Output(OutputChunk::Stderr(_)) => "stderr",
+            StreamEvent::Usage(_) => "usage",
+            StreamEvent::Result(_) => "result",
+            StreamEvent::Error { .. } => "error",
+        };
+        let event = Event::default().event(name);
+        match self {
+            StreamEvent::Output(chunk) => event.json_data(chunk.text()),
+            StreamEvent::Usage(sample) => event.json_data(sample),
+            _ => event.json_data(self),
+        }
+    }
+}
+
+// Where a streamed run sends what it reports while running: its output as
+// it is written, and samples of what it is using.
+pub struct LiveRun {
+    pub output: UnboundedSender<OutputChunk>,
+    pub usage: UnboundedSender<UsageSample>,
+}
+
+pub struct LiveEvents {
+    output: UnboundedReceiver<OutputChunk>,
+    usage: UnboundedReceiver<UsageSample>,
+}
+
+pub fn live() -> (LiveRun, LiveEvents) {
+    let (output, output_rx) = mpsc::unbounded_channel();
+    let (usage, usage_rx) = mpsc::unbounded_channel();
+    (
+        LiveRun { output, usage },
+        LiveEvents {
+            output: output_rx,
+            usage: usage_rx,
+        },
+    )
+}
+
+type Run = Pin<Box<dyn Future<Output = Result<CompilerResponse, ApiError>> + Send>>;
+
+enum State {
+    Running(Run, LiveEvents),
+    Finished(
+        UnboundedReceiver<OutputChunk>,
+        Result<CompilerResponse, ApiError>,
+    ),
+    Done,
+}
+
+async fn next_event(state: State) -> Option<(StreamEvent, State)> {
+    match state {
+        State::Running(mut run, mut live) => tokio::select! {
+            biased;
+            Some(chunk) = live.output.recv() => {
+                Some((StreamEvent::Output(chunk), State::Running(run, live)))
+            }
+            Some(sample) = live.usage.recv() => {
+                Some((StreamEvent::Usage(sample), State::Running(run, live)))
+            }
+            result = &mut run => Some(drain(live.output, result)),
+        },
+        State::Finished(output, result) => Some(drain(output, result)),
+        State::Done => None,
+    }
+}
+
+// Everything the program wrote was sent before `run` finished, so whatever
+// is left is already queued. Usage samples still queued are out of date and
+// are dropped.
+fn drain(
+    mut output: UnboundedReceiver<OutputChunk>,
+    result: Result<CompilerResponse, ApiError>,
+) -> (StreamEvent, State) {
+    match output.try_recv() {
+        Ok(chunk) => (StreamEvent::Output(chunk), State::Finished(output, result)),
+        Err(_) => (StreamEvent::finished(result), State::Done),
+    }
+}
+
+fn ndjson_response(body: Body) -> Response {
+    (
+        [(header::CONTENT_TYPE, HeaderValue::from_static(NDJSON))],
+        body,
+    )
+        .into_response()
+}
+
+// Streams what `run` sends to its live channels as it arrives, then its
+// result. The run is driven by the response body, so a client that goes
+// away stops the program.
+pub fn ndjson<F>(run: F, live: LiveEvents) -> Response
+where
+    F: Future<Output = Result<CompilerResponse, ApiError>> + Send + 'static,
+{
+    let state = State::Running(Box::pin(run), live);
+    let lines = stream::unfold(state, |state| async move {
+        let (event, next) = next_event(state).await?;
+        Some((Ok::<_, Infallible>(event.line()), next))
+    });
+    ndjson_response(Body::from_stream(lines))
+}
+
+// A finished response as a stream of one result event.
+pub fn ndjson_replay(response: CompilerResponse) -> Response {
+    ndjson_response(Body::from(StreamEvent::Result(response).line()))
+}
+
+// `ndjson` as server-sent events.
+pub fn event_stream<F>(run: F, live: LiveEvents) -> Response
+where
+    F: Future<Output = Result<CompilerResponse, ApiError>> + Send + 'static,
+{
+    let state = State::Running(Box::pin(run), live);
+    let events = stream::unfold(state, |state| async move {
+        let (event, next) = next_event(state).await?;
+        Some((event.sse(), next))
+    });
+    Sse::new(events)
+        .keep_alive(KeepAlive::default())
+        .into_response()
+}
+
+pub fn event_stream_replay(response: CompilerResponse) -> Response {
+    Sse::new(stream::iter([StreamEvent::Result(response).sse()])).into_response()
+}
+
+#[cfg(test)]
+mod formats_tests {
+    use super::*;
+
+    async fn events(mut state: State) -> Vec<String> {
+        let mut lines = Vec::new();
+        while let Some((event, next)) = next_event(state).await {
+            lines.push(String::from_utf8(event.line().to_vec()).unwrap());
+            state = next;
+        }
+        lines
+    }
+
+    #[tokio::test]
+    async fn test_output_is_streamed_before_the_result() {
+        let (tx, rx) = live();
+        let run = async move {
+            tx.output
+                .send(OutputChunk::Stdout(String::from("hi\n")))
+                .unwrap();
+            tokio::task::yield_now().await;
+            tx.usage
+                .send(UsageSample {
+                    elapsed_ms: 500,
+                    cpu_percent: 12.5,
+                    memory_bytes: 4096,
+                    output_bytes: 3,
+                })
+                .unwrap();
+            tokio::task::yield_now().await;
+            tx.output
+                .send(OutputChunk::Stderr(String::from("oops\n")))
+                .unwrap();
+            Err(ApiError::BadRequest(String::from("stopped")))
+        };
+        let lines = events(State::Running(Box::pin(run), rx)).await;
+        assert_eq!(
+            lines,
+            [
+                "{\"event\":\"output\",\"stream\":\"stdout\",\"data\":\"hi\\n\"}\n",
+                "{\"event\":\"usage\",\"elapsed_ms\":500,\"cpu_percent\":12.5,\
+                 \"memory_bytes\":4096,\"output_bytes\":3}\n",
+                "{\"event\":\"output\",\"stream\":\"stderr\",\"data\":\"oops\\n\"}\n",
+                "{\"event\":\"error\",\"status\":400,\"message\":\"Bad request: stopped\"}\n",
+            ]
+        );
+    }
+}
@@ -0,0 +1,280 @@
+use std::time::Duration;
+
+use axum::{
+    Json,
+    extract::Path,
+    http::{HeaderMap, StatusCode},
+};
+use serde::Deserialize;
+use utoipa::ToSchema;
+
+use crate::config::config;
+use crate::infra::{
+    blobs::blob_store,
+    events::Submitter,
+    groups::{GroupStatus, JobGroup},
+    jobs::{JobSpec, job_queue},
+    judge::TestCase,
+    scheduler::{Priority, TENANT_HEADER},
+    store::store,
+    tenants::queue_tenant,
+    tier::{Feature, Tier, tiers},
+};
+
+use super::{
+    blobs::resolve_tests,
+    compile::{
+        CompilerRequest, admit_language, admit_tier, check_dependencies, check_limits, check_locale,
+        resolve_version, screen_submission, throttle_submission, validate,
+    },
+    error::{ApiError, ErrorResponse, FieldError},
+    extract::{ClientIp, ValidJson},
+};
+
+#[derive(Deserialize, ToSchema)]
+pub struct GroupedJob {
+    #[serde(flatten)]
+    pub submission: CompilerRequest,
+    // Names the job within the group, such as the student who submitted it.
+    #[schema(example = "ada")]
+    pub name: Option<String>,
+    // What the program should print to be accepted.
+    #[schema(example = "7\n")]
+    pub expected_output: Option<String>,
+}
+
+// Either one submission and the tests to run it against, one job per test,
+// or a list of separate jobs such as a class's submissions.
+#[derive(Deserialize, ToSchema)]
+pub struct GroupRequest {
+    #[schema(example = "week 3")]
+    pub name: Option<String>,
+    pub submission: Option<CompilerRequest>,
+    #[serde(default)]
+    pub tests: Vec<TestCase>,
+    #[serde(default)]
+    pub jobs: Vec<GroupedJob>,
+    #[serde(default)]
+    pub priority: Priority,
+}
+
+fn check_group(request: &GroupRequest, max_jobs: usize) -> Vec<FieldError> {
+    let mut errors = Vec::new();
+    let jobs = match &request.submission {
+        Some(_) if !request.jobs.is_empty() => {
+            errors.push(FieldError::new(
+                "jobs",
+                "exclusive",
+                "give either a submission and its tests or jobs, not both",
+            ));
+            return errors;
+        }
+        Some(submission) => {
+            if !submission.stdin.is_empty() {
+                errors.push(FieldError::new(
+                    "submission.stdin",
+                    "unsupported",
+                    "each test gives the submission's stdin",
+                ));
+            }
+            ("tests", request.tests.len())
+        }
+        None => {
+            if !request.tests.is_empty() {
+                errors.push(FieldError::new(
+                    "tests",
+                    "unsupported",
+                    "tests are run against a submission",
+                ));
+            }
+            ("jobs", request.jobs.len())
+        }
+    };
+    match jobs {
+        (field, 0) => errors.push(FieldError::new(
+            field,
+            "required",
+            format!("at least one of {} is required", field),
+        )),
+        (field, n) if n > max_jobs => errors.push(FieldError::new(
+            field,
+            "max_items",
+            format!("a group may hold at most {} jobs", max_jobs),
+        )),
+        _ => {}
+    }
+    errors
+}
+
+// Admits one of the group's programs as a job would be, and returns what it
+// runs.
+async fn admit_job(
+    payload: CompilerRequest,
+    tier: Option<&'static Tier>,
+    submitter: &Submitter,
+    priority: Priority,
+) -> Result<JobSpec, ApiError> {
+    check_limits(&payload.content, &payload.stdin, tier).await?;
+    let toolchain = validate(&payload)?;
+    admit_language(tier, toolchain)?;
+    let version = resolve_version(toolchain, payload.version.as_deref()).await?;
+    check_dependencies(toolchain, &payload.dependencies, tier).await?;
+    check_locale(&payload).await?;
+    screen_submission(submitter, &payload.lang, &payload.content).await?;
+    Ok(JobSpec {
+        tier: tier.cloned(),
+        version,
+        submitter: submitter.clone(),
+        priority,
+        ..payload.into()
+    })
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/job-groups",
+    tag = "jobs",
+    request_body = GroupRequest,
+    params(
+        ("x-api-key" = Option<String>, Header, description = "Tenant key used to schedule jobs fairly and to select the caller's tier"),
+    ),
+    responses(
+        (status = 202, description = "Every job queued in a new group, whose progress GET /api/v1/job-groups/{id} reports", body = GroupStatus),
+        (status = 400, description = "Malformed request body, invalid fields, no or too many jobs, or a test naming a blob that is not stored", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "The API key's tier does not include background jobs or a program's language", body = ErrorResponse),
+        (status = 413, description = "Request body, code or stdin exceeds its size limit", body = ErrorResponse),
+        (status = 429, description = "Identical submission repeated too often, or the tier's rate limit was reached. Also sent, with Retry-After, while the server sheds load", body = ErrorResponse),
+        (status = 500, description = "The job group could not be saved", body = ErrorResponse),
+        (status = 503, description = "Compiled languages are paused while disk space is low", body = ErrorResponse),
+    )
+)]
+pub async fn submit_job_group(
+    headers: HeaderMap,
+    ClientIp(client_ip): ClientIp,
+    ValidJson(mut request): ValidJson<GroupRequest>,
+) -> Result<(StatusCode, Json<GroupStatus>), ApiError> {
+    let api_key = headers
+        .get(TENANT_HEADER)
+        .and_then(|value| value.to_str().ok());
+    let tier = admit_tier(api_key, &client_ip, &[Feature::Jobs]).await?;
+    let app_config = config().await;
+    let mut errors = check_group(&request, app_config.job_group_max_jobs());
+    if errors.is_empty() {
+        errors = resolve_tests(blob_store().await, &mut request.tests, "tests");
+    }
+    if !errors.is_empty() {
+        return Err(ApiError::ValidationError(errors));
+    }
+    let submitter = Submitter::new(api_key, &client_ip);
+    let GroupRequest {
+        name,
+        submission,
+        tests,
+        jobs,
+        priority,
+    } = request;
+
+    // Every job is admitted before any is queued, so a group is either
+    // queued whole or refused. Only the first program is throttled: a
+    // class's submissions may well repeat one another.
+    let mut queued = Vec::new();
+    if let Some(submission) = submission {
+        let spec = admit_job(submission, tier, &submitter, priority).await?;
+        for (index, test) in tests.into_iter().enumerate() {
+            check_limits("", &test.stdin, tier).await?;
+            let spec = JobSpec {
+                stdin: test.stdin,
+                expected_output: test.expected_output,
+                time_limit: test.time_limit_ms.map(Duration::from_millis),
+                memory_limit: test.memory_limit_bytes,
+                ..spec.clone()
+            };
+            queued.push((spec, None, Some(index)));
+        }
+    } else {
+        for job in jobs {
+            let spec = JobSpec {
+                expected_output: job.expected_output,
+                ..admit_job(job.submission, tier, &submitter, priority).await?
+            };
+            queued.push((spec, job.name, None));
+        }
+    }
+    if let Some((spec, _, _)) = queued.first() {
+        throttle_submission(&client_ip, &spec.lang, spec.content.as_bytes()).await?;
+    }
+
+    let queue = job_queue().await;
+    let tenant = &queue_tenant(tiers().await, api_key, &client_ip);
+    let mut group = JobGroup::new(name);
+    for (spec, name, test) in queued {
+        group.submit(queue, tenant, spec, name, test);
+    }
+    group
+        .save(store().await, app_config.job_retention())
+        .map_err(|err| ApiError::Internal(format!("failed to save the job group: {}", err)))?;
+    Ok((StatusCode::ACCEPTED, Json(group.status(queue))))
+}
+
+#[utoipa::path(
+    get,
+    path = "/api/v1/job-groups/{id}",
+    tag = "jobs",
+    params(("id" = String, Path, description = "Job group id returned when the group was started")),
+    responses(
+        (status = 200, description = "How many of the group's jobs are waiting, running and finished, each job's status and verdict, and once all have finished the group's verdict", body = GroupStatus),
+        (status = 404, description = "Unknown or expired job group", body = ErrorResponse),
+    )
+)]
+pub async fn get_job_group(Path(id): Path<String>) -> Result<Json<GroupStatus>, ApiError> {
+    let group = JobGroup::load(store().await, &id)
+        .ok_or_else(|| ApiError::NotFound(format!("job group {}", id)))?;
+    Ok(Json(group.status(job_queue().await)))
+}
+
+#[cfg(test)]
+mod groups_tests {
+    use super::*;
+
+    fn request(value: serde_json::Value) -> GroupRequest {
+        serde_json::from_value(value).unwrap()
+    }
+
+    fn rules(errors: Vec<FieldError>) -> Vec<(String, String)> {
+        errors
+            .into_iter()
+            .map(|err| (err.field, err.rule))
+            .collect()
+    }
+
+    #[test]
+    fn test_check_group_takes_a_submission_with_tests_or_jobs() {
+        let submission = serde_json::json!({"lang": "python", "content": "print(input())"});
+        let tested = request(serde_json::json!({
+            "submission": submission,
+            "tests": [{"stdin": "1", "expected_output": "1"}, {"stdin": "2"}],
+        }));
+        assert!(check_group(&tested, 4).is_empty());
+        let batch = request(serde_json::json!({"jobs": [submission, submission]}));
+        assert!(check_group(&batch, 4).is_empty());
+
+        assert_eq!(
+            rules(check_group(&tested, 1)),
+            vec![("tests".into(), "max_items".into())]
+        );
+        let both = request(serde_json::json!({"submission": submission, "jobs": [submission]}));
+        assert_eq!(
+            rules(check_group(&both, 4)),
+            vec![("jobs".into(), "exclusive".into())]
+        );
+        let untested = request(serde_json::json!({"tests": [{"stdin": "1"}]}));
+        assert_eq!(
+            rules(check_group(&untested, 4)),
+            vec![
+                ("tests".into(), "unsupported".into()),
+                ("jobs".into(), "required".into()),
+            ]
+        );
+    }
+}
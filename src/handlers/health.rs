@@ -1,11 +1,19 @@
 use axum::{response::IntoResponse, Json};
 use serde::Serialize;
+use utoipa::ToSchema;
 
-#[derive(Serialize)]
-struct Status {
+#[derive(Serialize, ToSchema)]
+pub struct Status {
+    #[schema(example = "Ok")]
     status: &'static str,
 }
 
+#[utoipa::path(
+    get,
+    path = "/api/v1/healthz",
+    tag = "health",
+    responses((status = 200, description = "Server is up", body = Status))
+)]
 pub async fn healthz() -> impl IntoResponse {
     let status = Status { status: "Ok" };
 
@@ -0,0 +1,202 @@
+use axum::Json;
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+use uuid::Uuid;
+
+use crate::config::config;
+use crate::infra::{
+    compile::compile_lang,
+    error::InfraError,
+    events::Submitter,
+    interactive::{Interaction, Judgement, Verdict, find_executable},
+    language::Language,
+    logs::logged,
+    runner::ExecContext,
+    tier::Feature,
+    toolchain::Toolchain,
+};
+
+use super::{
+    compile::{
+        admit, admit_run, admit_tier, check_compiler_flags, check_limits, screen_submission,
+        throttle_submission,
+    },
+    error::{ApiError, ErrorResponse, FieldError},
+    extract::{ApiKey, ClientIp, ValidJson},
+};
+
+#[derive(Deserialize, ToSchema)]
+pub struct InteractiveRequest {
+    #[schema(value_type = Language)]
+    pub lang: String,
+    #[schema(example = "print(500, flush=True)\nreply = input()\n")]
+    pub content: String,
+    // Name of one of the server's interactors.
+    #[schema(example = "guess")]
+    pub interactor: String,
+    // The test, written to the file the interactor reads it from; the
+    // program never sees it.
+    #[serde(default)]
+    #[schema(example = "737")]
+    pub input: String,
+    #[serde(default)]
+    pub compiler_flags: Vec<String>,
+}
+
+#[derive(Debug, Serialize, ToSchema)]
+pub struct InteractiveResponse {
+    pub verdict: Verdict,
+    #[schema(example = "ok found in 10 queries")]
+    pub message: String,
+    // Everything the program wrote to the interactor.
+    #[schema(example = "500\n750\n625\n")]
+    pub result: String,
+}
+
+async fn validate(payload: &InteractiveRequest) -> Result<Interaction, ApiError> {
+    let toolchain = admit(&payload.lang)?;
+    let mut errors = check_compiler_flags(toolchain, &payload.compiler_flags);
+    if let Toolchain::Builtin(language @ (Language::NIX | Language::SQL)) = toolchain {
+        errors.push(FieldError::new(
+            "lang",
+            "unsupported",
+            format!("{} programs cannot talk to an interactor", language),
+        ));
+    }
+    let interactor = find_executable(config().await.interactors_dir(), &payload.interactor);
+    if interactor.is_none() {
+        errors.push(FieldError::new(
+            "interactor",
+            "oneof",
+            format!("no interactor named {:?}", payload.interactor),
+        ));
+    }
+    match interactor {
+        Some(interactor) if errors.is_empty() => {
+            Ok(Interaction::new(interactor, &payload.input).map_err(InfraError::from)?)
+        }
+        _ => Err(ApiError::ValidationError(errors)),
+    }
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/interactive",
+    tag = "compile",
+    request_body = InteractiveRequest,
+    params(
+        ("x-api-key" = Option<String>, Header, description = "API key that selects the caller's tier"),
+    ),
+    responses(
+        (status = 200, description = "The program was judged; failures show in `verdict`", body = InteractiveResponse),
+        (status = 400, description = "Malformed request body, unknown interactor, or a language that cannot be judged interactively", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "The API key's tier does not include interactive judging or the program's language", body = ErrorResponse),
+        (status = 413, description = "Request body, code or input exceeds its size limit", body = ErrorResponse),
+        (status = 429, description = "Identical submission repeated too often, the tier's rate limit was reached, or too many of the caller's runs are in progress. Also sent, with Retry-After, while the server sheds load", body = ErrorResponse),
+        (status = 500, description = "Compilation failed", body = ErrorResponse),
+        (status = 503, description = "Compiled languages are paused while disk space is low", body = ErrorResponse),
+    )
+)]
+pub async fn judge_interactive(
+    ApiKey(api_key): ApiKey,
+    ClientIp(client_ip): ClientIp,
+    ValidJson(payload): ValidJson<InteractiveRequest>,
+) -> Result<Json<InteractiveResponse>, ApiError> {
+    let tier = admit_tier(api_key.as_deref(), &client_ip, &[Feature::Interactive]).await?;
+    check_limits(&payload.content, &payload.input, tier).await?;
+    let interaction = validate(&payload).await?;
+    let submitter = Submitter::new(api_key.as_deref(), &client_ip);
+    screen_submission(&submitter, &payload.lang, &payload.content).await?;
+    let _slot = admit_run(api_key.as_deref(), tier, admit(&payload.lang)?).await?;
+    throttle_submission(&client_ip, &payload.lang, payload.content.as_bytes()).await?;
+
+    let mut ctx = ExecContext::default();
+    if let Some(tier) = tier {
+        ctx = tier.apply(ctx);
+    }
+    let ctx = ctx
+        .with_compiler_flags(payload.compiler_flags.clone())
+        .with_interaction(interaction.clone());
+    let id = Uuid::new_v4().to_string();
+    let run = compile_lang(&payload.lang, &payload.content, "", &ctx);
+    let outcome = logged(&id, &payload.lang, &payload.content, &submitter, run).await;
+    let (result, judgement) = match outcome {
+        Ok(result) => {
+            // Runners that never start a process of their own, such as the
+            // embedded engines, have nothing to connect the interactor to.
+            let judgement = interaction.judgement().ok_or_else(|| {
+                InfraError::UnsupportedLanguage(format!(
+                    "{} programs cannot be judged interactively on this instance",
+                    payload.lang
+                ))
+            })?;
+            (result, judgement)
+        }
+        Err(InfraError::CompilationError(err)) => (
+            String::new(),
+            Judgement {
+                verdict: Verdict::RuntimeError,
+                message: err.to_string(),
+            },
+        ),
+        Err(InfraError::Timeout(limit, _)) => (
+            String::new(),
+            Judgement {
+                verdict: Verdict::TimeLimitExceeded,
+                message: format!("time limit of {}s exceeded", limit.as_secs_f64()),
+            },
+        ),
+        Err(err) => return Err(err.into()),
+    };
+    Ok(Json(InteractiveResponse {
+        verdict: judgement.verdict,
+        message: judgement.message,
+        result,
+    }))
+}
+
+#[cfg(test)]
+mod interactive_tests {
+    use super::*;
+
+    fn request(lang: &str, interactor: &str) -> InteractiveRequest {
+        InteractiveRequest {
+            lang: lang.to_string(),
+            content: String::new(),
+            interactor: interactor.to_string(),
+            input: String::new(),
+            compiler_flags: Vec::new(),
+        }
+    }
+
+    #[tokio::test]
+    async fn test_validate_checks_interactor_and_language() {
+        let rules = |err: ApiError| match err {
+            ApiError::ValidationError(errors) => errors
+                .into_iter()
+                .map(|err| (err.field, err.rule))
+                .collect::<Vec<_>>(),
+            other => panic!("unexpected error: {}", other),
+        };
+        assert_eq!(
+            rules(
+                validate(&request("python", "no-such-interactor"))
+                    .await
+                    .unwrap_err()
+            ),
+            vec![("interactor".into(), "oneof".into())]
+        );
+        assert_eq!(
+            rules(
+                validate(&request("sql", "../etc/passwd"))
+                    .await
+                    .unwrap_err()
+            ),
+            vec![
+                ("lang".into(), "unsupported".into()),
+                ("interactor".into(), "oneof".into()),
+            ]
+        );
+    }
+}
@@ -0,0 +1,440 @@
+use axum::{
+    Json,
+    extract::{Path, Query},
+    http::{HeaderMap, StatusCode},
+    response::{
+        IntoResponse, Response,
+        sse::{Event, KeepAlive, Sse},
+    },
+};
+use chrono::{DateTime, Utc};
+use serde::Deserialize;
+use tokio::sync::{broadcast, mpsc};
+use tokio_stream::wrappers::ReceiverStream;
+use utoipa::ToSchema;
+
+use crate::config::config;
+use crate::infra::{
+    events::Submitter,
+    history::{HistoryQuery, RunRecord, history},
+    jobs::{Job, JobEvent, JobSpec, Subscription, job_queue},
+    runner::OutputChunk,
+    scheduler::{ANONYMOUS_TENANT, IDEMPOTENCY_HEADER, Priority, TENANT_HEADER},
+    tenants::queue_tenant,
+    tier::{Feature, tiers},
+};
+
+use super::{
+    compile::{
+        CompilerRequest, admit, admit_language, admit_tier, check_dependencies, check_limits,
+        check_locale, resolve_version, screen_submission, throttle_submission, validate,
+    },
+    error::{ApiError, ErrorResponse, FieldError},
+    extract::{ClientIp, ResponseFormat, ValidBody},
+    formats::plain_text,
+    json::{EncodedLen, string_len},
+    msgpack::negotiated,
+};
+
+#[derive(Deserialize, ToSchema)]
+pub struct JobRequest {
+    #[serde(flatten)]
+    pub submission: CompilerRequest,
+    // Holds the job until this time, such as the start of a contest.
+    #[schema(example = "2026-11-01T09:00:00Z")]
+    pub run_at: Option<DateTime<Utc>>,
+    // Holds the job for this many seconds; an alternative to `run_at`.
+    #[schema(example = 300)]
+    pub delay_secs: Option<u64>,
+    // Workers take higher priority jobs first. Bulk work such as regrading
+    // a whole contest should ask for low, so live submissions are not kept
+    // waiting behind it.
+    #[serde(default)]
+    pub priority: Priority,
+}
+
+// When the job should run, if later than now.
+fn schedule(
+    run_at: Option<DateTime<Utc>>,
+    delay_secs: Option<u64>,
+    now: DateTime<Utc>,
+    max_delay: std::time::Duration,
+) -> Result<Option<DateTime<Utc>>, FieldError> {
+    let max_delay = chrono::Duration::from_std(max_delay).unwrap_or(chrono::Duration::MAX);
+    let at = match (run_at, delay_secs) {
+        (Some(_), Some(_)) => {
+            return Err(FieldError::new(
+                "delay_secs",
+                "exclusive",
+                "give either run_at or delay_secs, not both",
+            ));
+        }
+        (Some(at), None) => at,
+        (None, Some(secs)) => {
+            let delay = i64::try_from(secs)
+                .ok()
+                .and_then(chrono::Duration::try_seconds)
+                .unwrap_or(chrono::Duration::MAX);
+            now.checked_add_signed(delay)
+                .unwrap_or(DateTime::<Utc>::MAX_UTC)
+        }
+        (None, None) => return Ok(None),
+    };
+    if at - now > max_delay {
+        let field = match run_at {
+            Some(_) => "run_at",
+            None => "delay_secs",
+        };
+        return Err(FieldError::new(
+            field,
+            "range",
+            format!(
+                "jobs may be scheduled at most {} seconds ahead",
+                max_delay.num_seconds()
+            ),
+        ));
+    }
+    Ok(Some(at))
+}
+
+impl EncodedLen for Job {
+    fn encoded_len(&self) -> usize {
+        let result = self.result.as_deref().map_or(0, string_len);
+        let error = self.error.as_deref().map_or(0, string_len);
+        result + error + 256
+    }
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/jobs",
+    tag = "jobs",
+    request_body(content(
+        (JobRequest = "application/json"),
+        (JobRequest = "application/msgpack"),
+    )),
+    params(
+        ("x-api-key" = Option<String>, Header, description = "Tenant key used to schedule jobs fairly and to select the caller's tier"),
+        ("idempotency-key" = Option<String>, Header, description = "Repeated submissions with the same key return the original job"),
+    ),
+    responses(
+        (status = 202, description = "Job queued, or scheduled for later", content(
+            (Job = "application/json"),
+            (Job = "application/msgpack"),
+        )),
+        (status = 400, description = "Malformed request body or invalid fields", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "The API key's tier does not include background jobs or the program's language", body = ErrorResponse),
+        (status = 406, description = "The Accept header allows none of the formats a job can be sent in", body = ErrorResponse),
+        (status = 413, description = "Request body, code or stdin exceeds its size limit", body = ErrorResponse),
+        (status = 429, description = "Identical submission repeated too often, or the tier's rate limit was reached. Also sent, with Retry-After, while the server sheds load", body = ErrorResponse),
+        (status = 503, description = "Compiled languages are paused while disk space is low", body = ErrorResponse),
+    )
+)]
+pub async fn submit_job(
+    headers: HeaderMap,
+    ClientIp(client_ip): ClientIp,
+    format: ResponseFormat,
+    ValidBody(request): ValidBody<JobRequest>,
+) -> Result<(StatusCode, Response), ApiError> {
+    let JobRequest {
+        submission: payload,
+        run_at,
+        delay_secs,
+        priority,
+    } = request;
+    let api_key = headers
+        .get(TENANT_HEADER)
+        .and_then(|value| value.to_str().ok());
+    let tier = admit_tier(api_key, &client_ip, &[Feature::Jobs]).await?;
+    check_limits(&payload.content, &payload.stdin, tier).await?;
+    let toolchain = validate(&payload)?;
+    admit_language(tier, toolchain)?;
+    let run_at = schedule(
+        run_at,
+        delay_secs,
+        Utc::now(),
+        config().await.job_max_delay(),
+    )
+    .map_err(|err| ApiError::ValidationError(vec![err]))?;
+    let version = resolve_version(toolchain, payload.version.as_deref()).await?;
+    check_dependencies(toolchain, &payload.dependencies, tier).await?;
+    check_locale(&payload).await?;
+    let submitter = Submitter::new(api_key, &client_ip);
+    screen_submission(&submitter, &payload.lang, &payload.content).await?;
+    throttle_submission(&client_ip, &payload.lang, payload.content.as_bytes()).await?;
+    let tenant = &queue_tenant(tiers().await, api_key, &client_ip);
+    let spec = JobSpec {
+        tier: tier.cloned(),
+        version,
+        submitter,
+        run_at,
+        priority,
+        ..payload.into()
+    };
+    let queue = job_queue().await;
+    let job = match headers
+        .get(IDEMPOTENCY_HEADER)
+        .and_then(|value| value.to_str().ok())
+    {
+        Some(key) => queue.submit_once(key, tenant, spec),
+        None => queue.submit(tenant, spec),
+    };
+
+    Ok((StatusCode::ACCEPTED, negotiated(format, job)))
+}
+
+#[utoipa::path(
+    get,
+    path = "/api/v1/jobs/{id}",
+    tag = "jobs",
+    params(("id" = String, Path, description = "Job id returned on submission")),
+    responses(
+        (status = 200, description = "Current job state, with its place in the queue while it waits", content(
+            (Job = "application/json"),
+            (Job = "application/msgpack"),
+        )),
+        (status = 404, description = "Unknown or expired job", body = ErrorResponse),
+        (status = 406, description = "The Accept header allows none of the formats a job can be sent in", body = ErrorResponse),
+    )
+)]
+pub async fn get_job(format: ResponseFormat, Path(id): Path<String>) -> Result<Response, ApiError> {
+    job_queue()
+        .await
+        .get(&id)
+        .map(|job| negotiated(format, job))
+        .ok_or_else(|| ApiError::NotFound(format!("job {}", id)))
+}
+
+// One server-sent event per chunk: `compile` for what the compiler wrote,
+// `stdout` or `stderr` for the program, each with the text as a JSON
+// string, `usage` with a sample of what the program is using, and `end`
+// with the finished job.
+fn log_event(event: JobEvent) -> Result<Event, axum::Error> {
+    let (name, chunk) = match event {
+        JobEvent::Compiler(chunk) => ("compile", chunk),
+        JobEvent::Output(chunk @ OutputChunk::Stdout(_)) => ("stdout", chunk),
+        JobEvent::Output(chunk @ OutputChunk::Stderr(_)) => ("stderr", chunk),
+        JobEvent::Usage(sample) => return Event::default().event("usage").json_data(sample),
+        JobEvent::Finished(job) => return Event::default().event("end").json_data(job),
+    };
+    Event::default().event(name).json_data(chunk.text())
+}
+
+// Everything the job has written so far, then the rest as it is written,
+// until it finishes or the client goes away.
+fn tail(subscription: Subscription) -> impl IntoResponse {
+    let Subscription {
+        compile_history,
+        history,
+        finished,
+        mut events,
+    } = subscription;
+    let (tx, rx) = mpsc::channel(64);
+    tokio::spawn(async move {
+        let done = finished.is_some();
+        let replay = compile_history
+            .into_iter()
+            .map(JobEvent::Compiler)
+            .chain(history.into_iter().map(JobEvent::Output))
+            .chain(finished.map(JobEvent::Finished));
+        for event in replay {
+            if tx.send(log_event(event)).await.is_err() {
+                return;
+            }
+        }
+        if done {
+            return;
+        }
+
+        loop {
+            let event = match events.recv().await {
+                Ok(event) => event,
+                Err(broadcast::error::RecvError::Lagged(_)) => continue,
+                Err(broadcast::error::RecvError::Closed) => return,
+            };
+            let finished = matches!(event, JobEvent::Finished(_));
+            if tx.send(log_event(event)).await.is_err() || finished {
+                return;
+            }
+        }
+    });
+    Sse::new(ReceiverStream::new(rx)).keep_alive(KeepAlive::default())
+}
+
+#[utoipa::path(
+    get,
+    path = "/api/v1/jobs/{id}/logs",
+    tag = "jobs",
+    params(("id" = String, Path, description = "Job id returned on submission")),
+    responses(
+        (status = 200, description = "What the job's compiler and program have written so far. With `Accept: text/event-stream` the log is tailed instead: `compile`, `stdout` and `stderr` events carry the text as a JSON string as it is written, and an `end` event carries the finished job", content(
+            (String = "text/plain"),
+            (String = "text/event-stream"),
+        )),
+        (status = 404, description = "Unknown or expired job", body = ErrorResponse),
+        (status = 406, description = "The Accept header allows none of the formats the server answers in", body = ErrorResponse),
+    )
+)]
+pub async fn job_logs(
+    format: ResponseFormat,
+    Path(id): Path<String>,
+) -> Result<Response, ApiError> {
+    let subscription = job_queue()
+        .await
+        .subscribe(&id)
+        .ok_or_else(|| ApiError::NotFound(format!("job {}", id)))?;
+    if format == ResponseFormat::EventStream {
+        return Ok(tail(subscription).into_response());
+    }
+    let log = subscription
+        .compile_history
+        .iter()
+        .chain(&subscription.history)
+        .map(OutputChunk::text)
+        .collect();
+    Ok(plain_text(StatusCode::OK, log))
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/jobs/{id}/rerun",
+    tag = "jobs",
+    params(
+        ("id" = String, Path, description = "Id of the finished job to run again"),
+        ("x-api-key" = Option<String>, Header, description = "Tenant key the original job was submitted with"),
+    ),
+    responses(
+        (status = 202, description = "The original's code, stdin, flags and limits queued as a new job, whose `rerun_of` names the original", content(
+            (Job = "application/json"),
+            (Job = "application/msgpack"),
+        )),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "The API key's tier does not include background jobs or the program's language", body = ErrorResponse),
+        (status = 404, description = "Unknown or expired job, or one submitted with another key", body = ErrorResponse),
+        (status = 406, description = "The Accept header allows none of the formats a job can be sent in", body = ErrorResponse),
+        (status = 409, description = "The job has not finished yet", body = ErrorResponse),
+        (status = 429, description = "The tier's rate limit was reached. Also sent, with Retry-After, while the server sheds load", body = ErrorResponse),
+        (status = 503, description = "Compiled languages are paused while disk space is low", body = ErrorResponse),
+    )
+)]
+pub async fn rerun_job(
+    headers: HeaderMap,
+    ClientIp(client_ip): ClientIp,
+    format: ResponseFormat,
+    Path(id): Path<String>,
+) -> Result<(StatusCode, Response), ApiError> {
+    let api_key = headers
+        .get(TENANT_HEADER)
+        .and_then(|value| value.to_str().ok());
+    let tier = admit_tier(api_key, &client_ip, &[Feature::Jobs]).await?;
+    let queue = job_queue().await;
+    let not_found = || ApiError::NotFound(format!("job {}", id));
+    let original = queue.get(&id).ok_or_else(not_found)?;
+    if !original.status.is_finished() {
+        return Err(ApiError::Conflict(format!(
+            "job {} has not finished yet",
+            id
+        )));
+    }
+    admit_language(tier, admit(&original.lang)?)?;
+    let job = queue
+        .rerun(
+            &original,
+            &queue_tenant(tiers().await, api_key, &client_ip),
+            Submitter::new(api_key, &client_ip),
+            config().await.toolchain_versions(),
+        )
+        .map_err(|err| ApiError::Conflict(err.to_string()))?
+        .ok_or_else(not_found)?;
+
+    Ok((StatusCode::ACCEPTED, negotiated(format, job)))
+}
+
+#[utoipa::path(
+    get,
+    path = "/api/v1/jobs",
+    tag = "jobs",
+    params(HistoryQuery),
+    responses(
+        (status = 200, description = "Persisted runs, newest first", body = [RunRecord]),
+        (status = 404, description = "Run history is not persisted on this server", body = ErrorResponse),
+        (status = 500, description = "The history database could not be queried", body = ErrorResponse),
+    )
+)]
+pub async fn job_history(
+    Query(query): Query<HistoryQuery>,
+) -> Result<Json<Vec<RunRecord>>, ApiError> {
+    let history = history()
+        .await
+        .ok_or_else(|| ApiError::NotFound(String::from("run history is not persisted")))?;
+    history
+        .search(&query)
+        .map(Json)
+        .map_err(|err| ApiError::Internal(err.to_string()))
+}
+
+#[cfg(test)]
+mod jobs_tests {
+    use super::*;
+    use std::time::Duration;
+
+    const WEEK: Duration = Duration::from_secs(7 * 24 * 3600);
+
+    #[test]
+    fn test_schedule_takes_a_time_or_a_delay() {
+        let now = Utc::now();
+        assert_eq!(schedule(None, None, now, WEEK), Ok(None));
+        assert_eq!(
+            schedule(None, Some(300), now, WEEK),
+            Ok(Some(now + chrono::Duration::seconds(300)))
+        );
+        let at = now + chrono::Duration::hours(2);
+        assert_eq!(schedule(Some(at), None, now, WEEK), Ok(Some(at)));
+    }
+
+    #[tokio::test]
+    async fn test_job_logs_are_plain_text_unless_tailed() {
+        let spec = JobSpec {
+            lang: "python".into(),
+            content: "print(1)".into(),
+            ..Default::default()
+        };
+        let job = job_queue().await.submit(ANONYMOUS_TENANT, spec);
+        let response = job_logs(ResponseFormat::Json, Path(job.id)).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        assert_eq!(
+            response.headers()[axum::http::header::CONTENT_TYPE],
+            "text/plain; charset=utf-8"
+        );
+
+        let missing = job_logs(ResponseFormat::Json, Path(String::from("missing"))).await;
+        assert!(matches!(missing, Err(ApiError::NotFound(_))));
+    }
+
+    #[test]
+    fn test_schedule_rejects_both_or_too_far_ahead() {
+        let now = Utc::now();
+        let rule = |result: Result<Option<DateTime<Utc>>, FieldError>| {
+            let err = result.unwrap_err();
+            (err.field, err.rule)
+        };
+        assert_eq!(
+            rule(schedule(Some(now), Some(1), now, WEEK)),
+            ("delay_secs".into(), "exclusive".into())
+        );
+        assert_eq!(
+            rule(schedule(None, Some(u64::MAX), now, WEEK)),
+            ("delay_secs".into(), "range".into())
+        );
+        assert_eq!(
+            rule(schedule(
+                Some(now + chrono::Duration::days(8)),
+                None,
+                now,
+                WEEK
+            )),
+            ("run_at".into(), "range".into())
+        );
+    }
+}
@@ -0,0 +1,216 @@
+use std::{
+    io, mem,
+    sync::{Mutex, OnceLock},
+};
+
+use axum::{
+    body::{Body, Bytes},
+    http::{HeaderValue, StatusCode, header},
+    response::{IntoResponse, Response},
+};
+use serde::Serialize;
+
+// Buffers that grew past this are freed rather than pooled, so one very large
+// response does not keep its memory for the life of the process.
+const MAX_RETAINED_BYTES: usize = 4 << 20;
+const MAX_POOLED: usize = 64;
+
+// Roughly how many bytes a value encodes to as JSON. Responses are encoded
+// into a buffer of this size up front instead of growing it, which would copy
+// a large payload several times over.
+pub trait EncodedLen {
+    fn encoded_len(&self) -> usize;
+}
+
+// Escaping can grow a string; leave some room so typical output does not
+// need a second allocation.
+pub fn string_len(s: &str) -> usize {
+    s.len() + s.len() / 16 + 2
+}
+
+pub struct BufferPool {
+    buffers: Mutex<Vec<Vec<u8>>>,
+    max_pooled: usize,
+    max_retained_bytes: usize,
+}
+
+static BUFFER_POOL: OnceLock<BufferPool> = OnceLock::new();
+
+pub fn buffer_pool() -> &'static BufferPool {
+    BUFFER_POOL.get_or_init(|| BufferPool::new(MAX_POOLED, MAX_RETAINED_BYTES))
+}
+
+impl BufferPool {
+    pub fn new(max_pooled: usize, max_retained_bytes: usize) -> Self {
+        BufferPool {
+            buffers: Mutex::new(Vec::new()),
+            max_pooled,
+            max_retained_bytes,
+        }
+    }
+
+    // An empty buffer with room for at least `capacity` bytes, handed back
+    // to the pool when dropped.
+    pub fn take(&'static self, capacity: usize) -> PooledBuffer {
+        let mut buf = self.buffers.lock().unwrap().pop().unwrap_or_default();
+        buf.reserve(capacity);
+        PooledBuffer { buf, pool: self }
+    }
+
+    pub fn idle(&self) -> usize {
+        self.buffers.lock().unwrap().len()
+    }
+
+    fn give_back(&self, mut buf: Vec<u8>) {
+        if buf.capacity() > self.max_retained_bytes {
+            return;
+        }
+        buf.clear();
+        let mut buffers = self.buffers.lock().unwrap();
+        if buffers.len() < self.max_pooled {
+            buffers.push(buf);
+        }
+    }
+}
+
+pub struct PooledBuffer {
+    buf: Vec<u8>,
+    pool: &'static BufferPool,
+}
+
+impl PooledBuffer {
+    pub fn capacity(&self) -> usize {
+        self.buf.capacity()
+    }
+}
+
+impl AsRef<[u8]> for PooledBuffer {
+    fn as_ref(&self) -> &[u8] {
+        &self.buf
+    }
+}
+
+impl io::Write for PooledBuffer {
+    fn write(&mut self, bytes: &[u8]) -> io::Result<usize> {
+        self.buf.write(bytes)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+impl Drop for PooledBuffer {
+    fn drop(&mut self) {
+        self.pool.give_back(mem::take(&mut self.buf));
+    }
+}
+
+pub fn encode<T: Serialize + EncodedLen>(
+    pool: &'static BufferPool,
+    value: &T,
+) -> serde_json::Result<PooledBuffer> {
+    let mut pooled = pool.take(value.encoded_len());
+    serde_json::to_writer(&mut pooled.buf, value)?;
+    Ok(pooled)
+}
+
+// Like `axum::Json`, but encodes into a pre-sized pooled buffer. The body
+// borrows the buffer until the response has been written, so the output is
+// neither copied nor encoded again on the way out.
+pub struct PooledJson<T>(pub T);
+
+impl<T: Serialize + EncodedLen> IntoResponse for PooledJson<T> {
+    fn into_response(self) -> Response {
+        match encode(buffer_pool(), &self.0) {
+            Ok(buf) => (
+                [(
+                    header::CONTENT_TYPE,
+                    HeaderValue::from_static("application/json"),
+                )],
+                Body::from(Bytes::from_owner(buf)),
+            )
+                .into_response(),
+            Err(err) => (
+                StatusCode::INTERNAL_SERVER_ERROR,
+                [(
+                    header::CONTENT_TYPE,
+                    HeaderValue::from_static("text/plain; charset=utf-8"),
+                )],
+                err.to_string(),
+            )
+                .into_response(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod json_tests {
+    use super::*;
+
+    #[derive(Serialize)]
+    struct Output {
+        result: String,
+    }
+
+    impl EncodedLen for Output {
+        fn encoded_len(&self) -> usize {
+            string_len(&self.result) + 16
+        }
+    }
+
+    fn output(result: &str) -> Output {
+        Output {
+            result: result.to_string(),
+        }
+    }
+
+    fn pool(max_pooled: usize, max_retained_bytes: usize) -> &'static BufferPool {
+        Box::leak(Box::new(BufferPool::new(max_pooled, max_retained_bytes)))
+    }
+
+    #[test]
+    fn test_encode_matches_serde_json_in_a_single_allocation() {
+        let pool = pool(4, 1 << 20);
+        let value = output(&"test case 42 passed\n".repeat(1000));
+        let buf = encode(pool, &value).unwrap();
+        assert_eq!(buf.as_ref(), serde_json::to_vec(&value).unwrap());
+        assert_eq!(buf.capacity(), value.encoded_len());
+    }
+
+    #[test]
+    fn test_buffers_are_reused_once_dropped() {
+        let pool = pool(2, 1 << 20);
+        let first = encode(pool, &output(&"x".repeat(4096))).unwrap();
+        let capacity = first.capacity();
+        drop(first);
+        assert_eq!(pool.idle(), 1);
+
+        let second = pool.take(16);
+        assert_eq!(second.capacity(), capacity);
+        assert!(second.as_ref().is_empty());
+        assert_eq!(pool.idle(), 0);
+    }
+
+    #[test]
+    fn test_oversized_and_surplus_buffers_are_freed() {
+        let pool = pool(1, 1024);
+        drop(pool.take(4096));
+        assert_eq!(pool.idle(), 0);
+
+        let (a, b) = (pool.take(16), pool.take(16));
+        drop(a);
+        drop(b);
+        assert_eq!(pool.idle(), 1);
+    }
+
+    #[test]
+    fn test_bytes_keep_buffer_until_dropped() {
+        let pool = pool(2, 1 << 20);
+        let bytes = Bytes::from_owner(encode(pool, &output("hi")).unwrap());
+        assert_eq!(pool.idle(), 0);
+        assert_eq!(&bytes[..], br#"{"result":"hi"}"#);
+        drop(bytes);
+        assert_eq!(pool.idle(), 1);
+    }
+}
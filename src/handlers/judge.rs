@@ -0,0 +1,420 @@
+use std::time::Duration;
+
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+
+use crate::config::config;
+use crate::infra::{
+    blobs::blob_store,
+    compile::confine,
+    events::Submitter,
+    interactive::Verdict,
+    jobs::JobSpec,
+    judge::{Deterministic, TestCase, TestResult, run_tests},
+    limits::language_defaults,
+    regrade::keep_submission,
+    runner::ExecContext,
+    store::store,
+    tenants::queue_tenant,
+    tier::{Feature, Tier, tiers},
+    verdicts::VerdictReporter,
+};
+
+use super::{
+    blobs::resolve_tests,
+    compile::{
+        CompilerRequest, admit_run, admit_tier, check_dependencies, check_limits, check_locale,
+        screen_submission, throttle_submission, try_run_slot, validate,
+    },
+    error::{ApiError, ErrorResponse, FieldError},
+    extract::{ApiKey, ClientIp, ValidJson},
+    json::{EncodedLen, PooledJson, string_len},
+};
+
+#[derive(Deserialize, ToSchema)]
+pub struct JudgeRequest {
+    #[serde(flatten)]
+    pub submission: CompilerRequest,
+    pub tests: Vec<TestCase>,
+    // How many tests may run at once; capped by the server's setting, which
+    // is also the default.
+    #[schema(example = 4)]
+    pub parallelism: Option<usize>,
+    // Judge so that verdicts come out the same on every run and host: the
+    // program gets a fixed timezone, locale and seeds in its environment,
+    // overriding its own, time limits are on CPU time, and a test that runs
+    // out of time is run again a few times before it is judged so.
+    #[serde(default)]
+    pub deterministic: bool,
+    // Keeps the submission under this problem, so it can be judged again
+    // when the problem's tests change.
+    #[schema(example = "two-sum")]
+    pub problem: Option<String>,
+}
+
+#[derive(Serialize, ToSchema)]
+pub struct JudgeResponse {
+    // Names this judging in the verdicts posted to the server's judge
+    // webhook, when it has one.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = "0b9f7c1e-5d2a-4c1f-9a43-2f6de1b0c8a7")]
+    pub judging_id: Option<String>,
+    // What the submission is kept as under its problem.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub submission_id: Option<String>,
+    #[schema(example = "python")]
+    pub lang: String,
+    // The first test's verdict that is not accepted, or accepted when all
+    // of them are.
+    pub verdict: Verdict,
+    // Tests accepted against their expected output.
+    #[schema(example = 3)]
+    pub passed: usize,
+    // The slowest and hungriest tests, as judges report a submission.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = 120)]
+    pub max_time_ms: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = 9437184)]
+    pub max_memory_bytes: Option<u64>,
+    pub results: Vec<TestResult>,
+}
+
+impl EncodedLen for JudgeResponse {
+    fn encoded_len(&self) -> usize {
+        let results: usize = self
+            .results
+            .iter()
+            .map(|result| {
+                let output = result.output.as_deref().map_or(0, string_len);
+                let error = result.error.as_deref().map_or(0, string_len);
+                output + error + 128
+            })
+            .sum();
+        results + 64
+    }
+}
+
+// `limits` is the context the submission would run under; a test may only
+// tighten its limits.
+fn check_tests(payload: &JudgeRequest, max_tests: usize, limits: &ExecContext) -> Vec<FieldError> {
+    let submission = &payload.submission;
+    let mut errors: Vec<_> = [
+        ("stdin", !submission.stdin.is_empty()),
+        ("collect_files", submission.collect_files),
+        ("collect_images", submission.collect_images),
+        ("transcript", submission.transcript),
+        ("version", submission.version.is_some()),
+        ("coverage", submission.coverage),
+        ("debug", submission.debug),
+        ("profile", submission.profile),
+    ]
+    .into_iter()
+    .filter(|(_, requested)| *requested)
+    .map(|(field, _)| FieldError::new(field, "unsupported", "not available for judge runs"))
+    .collect();
+    if payload.tests.is_empty() {
+        errors.push(FieldError::new(
+            "tests",
+            "required",
+            "at least one test is required",
+        ));
+    }
+    if payload.tests.len() > max_tests {
+        errors.push(FieldError::new(
+            "tests",
+            "max_items",
+            format!("at most {} tests are allowed", max_tests),
+        ));
+    }
+    for (i, test) in payload.tests.iter().enumerate() {
+        let time_limit = test.time_limit_ms.map(Duration::from_millis);
+        if let (Some(requested), Some(limit)) = (time_limit, limits.timeout()) {
+            if requested.is_zero() || requested > limit {
+                errors.push(FieldError::new(
+                    &format!("tests[{}].time_limit_ms", i),
+                    "range",
+                    format!("must be between 1 and {}", limit.as_millis()),
+                ));
+            }
+        }
+        let memory_limit = limits.memory_limit().unwrap_or(u64::MAX);
+        if test
+            .memory_limit_bytes
+            .is_some_and(|bytes| bytes == 0 || bytes > memory_limit)
+        {
+            errors.push(FieldError::new(
+                &format!("tests[{}].memory_limit_bytes", i),
+                "range",
+                format!("must be between 1 and {}", memory_limit),
+            ));
+        }
+    }
+    if payload.problem.as_deref().is_some_and(str::is_empty) {
+        errors.push(FieldError::new(
+            "problem",
+            "required",
+            "problem must not be empty",
+        ));
+    }
+    if payload.parallelism == Some(0) {
+        errors.push(FieldError::new(
+            "parallelism",
+            "min",
+            "parallelism must be at least 1",
+        ));
+    }
+    errors
+}
+
+// Keeps what the submission runs under its problem, for regrading.
+async fn keep(
+    problem: &str,
+    lang: &str,
+    submission: &CompilerRequest,
+    tier: Option<&Tier>,
+    tenant: &str,
+    submitter: &Submitter,
+) -> Result<String, ApiError> {
+    let spec = JobSpec {
+        lang: lang.to_string(),
+        content: submission.content.clone(),
+        args: submission.args.clone(),
+        env: submission.env.clone(),
+        compiler_flags: submission.compiler_flags.clone(),
+        backend: submission.backend,
+        js_engine: submission.js_engine,
+        dependencies: submission.dependencies.clone(),
+        output_encoding: submission.output_encoding,
+        tier: tier.cloned(),
+        submitter: submitter.clone(),
+        ..Default::default()
+    };
+    let retention = Some(config().await.submission_retention()).filter(|ttl| !ttl.is_zero());
+    keep_submission(store().await, retention, problem, tenant, spec)
+        .map_err(|err| ApiError::Internal(format!("failed to keep submission: {}", err)))
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/judge",
+    tag = "compile",
+    request_body = JudgeRequest,
+    params(
+        ("x-api-key" = Option<String>, Header, description = "API key that selects the caller's tier"),
+    ),
+    responses(
+        (status = 200, description = "One result per test, in request order", body = JudgeResponse),
+        (status = 400, description = "Malformed request body, invalid fields, too many tests, or a test naming a blob that is not stored", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "The API key's tier does not include judge runs or the program's language", body = ErrorResponse),
+        (status = 413, description = "Request body, code or a test's stdin exceeds its size limit", body = ErrorResponse),
+        (status = 429, description = "Identical submission repeated too often, the tier's rate limit was reached, or too many of the caller's runs are in progress. Also sent, with Retry-After, while the server sheds load", body = ErrorResponse),
+        (status = 500, description = "The submission could not be kept under its problem", body = ErrorResponse),
+        (status = 503, description = "Compiled languages are paused while disk space is low", body = ErrorResponse),
+    )
+)]
+pub async fn judge(
+    ApiKey(api_key): ApiKey,
+    ClientIp(client_ip): ClientIp,
+    ValidJson(mut payload): ValidJson<JudgeRequest>,
+) -> Result<PooledJson<JudgeResponse>, ApiError> {
+    let submission = &payload.submission;
+    let tier = admit_tier(api_key.as_deref(), &client_ip, &[Feature::Judge]).await?;
+    check_limits(&submission.content, "", tier).await?;
+    for test in &payload.tests {
+        check_limits("", &test.stdin, tier).await?;
+    }
+    let toolchain = validate(submission)?;
+    let app_config = config().await;
+    let mut ctx = ExecContext::default();
+    if let Some(tier) = tier {
+        ctx = tier.apply(ctx);
+    }
+    let limits = confine(
+        ctx.clone(),
+        &toolchain,
+        app_config,
+        language_defaults().await,
+    );
+    let errors = check_tests(&payload, app_config.judge_max_tests(), &limits);
+    if !errors.is_empty() {
+        return Err(ApiError::ValidationError(errors));
+    }
+    // Tests given by hash are bounded by BLOB_MAX_FILE_BYTES rather than the
+    // stdin limit, as large inputs are what blobs are for.
+    let errors = resolve_tests(blob_store().await, &mut payload.tests, "tests");
+    if !errors.is_empty() {
+        return Err(ApiError::ValidationError(errors));
+    }
+    check_dependencies(toolchain, &submission.dependencies, tier).await?;
+    check_locale(submission).await?;
+    let submitter = Submitter::new(api_key.as_deref(), &client_ip);
+    screen_submission(&submitter, &submission.lang, &submission.content).await?;
+    let mut slots = vec![admit_run(api_key.as_deref(), tier, toolchain).await?];
+    throttle_submission(&client_ip, &submission.lang, submission.content.as_bytes()).await?;
+    let submission_id = match &payload.problem {
+        Some(problem) => {
+            let tenant = queue_tenant(tiers().await, api_key.as_deref(), &client_ip);
+            let lang = toolchain.as_str();
+            Some(keep(problem, lang, submission, tier, &tenant, &submitter).await?)
+        }
+        None => None,
+    };
+
+    let ctx = ctx
+        .with_args(submission.args.clone())
+        .with_envs(submission.env.clone())
+        .with_locale(submission.locale.clone())
+        .with_timezone(submission.timezone.clone())
+        .with_compiler_flags(submission.compiler_flags.clone())
+        .with_backend(submission.backend)
+        .with_js_engine(submission.js_engine)
+        .with_dependencies(submission.dependencies.clone())
+        .with_output_encoding(submission.output_encoding);
+    // Each test in flight holds one of the tenant's run slots, so tests run
+    // only as many at once as the tenant has slots free.
+    let parallelism = payload
+        .parallelism
+        .unwrap_or(usize::MAX)
+        .min(app_config.judge_parallelism())
+        .min(payload.tests.len());
+    while slots.len() < parallelism {
+        match try_run_slot(api_key.as_deref(), tier).await {
+            Some(slot) => slots.push(slot),
+            None => break,
+        }
+    }
+    let parallelism = slots.len();
+    let deterministic = payload.deterministic.then(|| Deterministic {
+        attempts: app_config.judge_tle_attempts(),
+    });
+    let lang = toolchain.as_str();
+    let reporter = VerdictReporter::start(lang, &submitter).await;
+    let results = run_tests(
+        lang,
+        &submission.content,
+        &payload.tests,
+        &ctx,
+        &submitter,
+        parallelism,
+        deterministic,
+        reporter.as_ref(),
+    )
+    .await;
+    let results = match results {
+        Ok(results) => results,
+        Err(err) => {
+            if let Some(reporter) = &reporter {
+                let tests = payload.tests.len();
+                reporter.summary(Verdict::JudgeError, 0, tests, Some(err.to_string()));
+            }
+            return Err(err.into());
+        }
+    };
+
+    let response = JudgeResponse {
+        judging_id: reporter
+            .as_ref()
+            .map(|reporter| reporter.judging_id().to_string()),
+        submission_id,
+        lang: lang.to_string(),
+        verdict: results
+            .iter()
+            .map(|result| result.verdict)
+            .find(|verdict| *verdict != Verdict::Accepted)
+            .unwrap_or(Verdict::Accepted),
+        max_time_ms: results.iter().filter_map(|result| result.time_ms).max(),
+        max_memory_bytes: results
+            .iter()
+            .filter_map(|result| result.memory_bytes)
+            .max(),
+        passed: results
+            .iter()
+            .filter(|result| result.passed == Some(true))
+            .count(),
+        results,
+    };
+    if let Some(reporter) = &reporter {
+        reporter.summary(
+            response.verdict,
+            response.passed,
+            response.results.len(),
+            None,
+        );
+    }
+    Ok(PooledJson(response))
+}
+
+#[cfg(test)]
+mod judge_tests {
+    use super::*;
+
+    fn request(tests: usize, stdin: &str, parallelism: Option<usize>) -> JudgeRequest {
+        JudgeRequest {
+            submission: serde_json::from_value(serde_json::json!({
+                "lang": "python",
+                "content": "print(input())",
+                "stdin": stdin,
+            }))
+            .unwrap(),
+            tests: vec![TestCase::default(); tests],
+            parallelism,
+            deterministic: false,
+            problem: None,
+        }
+    }
+
+    fn rules(errors: Vec<FieldError>) -> Vec<(String, String)> {
+        errors
+            .into_iter()
+            .map(|err| (err.field, err.rule))
+            .collect()
+    }
+
+    fn limits() -> ExecContext {
+        ExecContext::default().with_timeout(Duration::from_secs(2))
+    }
+
+    #[test]
+    fn test_check_tests_limits_tests_and_rejects_stdin() {
+        assert!(check_tests(&request(3, "", Some(2)), 4, &limits()).is_empty());
+        assert_eq!(
+            rules(check_tests(&request(5, "1", Some(0)), 4, &limits())),
+            vec![
+                ("stdin".into(), "unsupported".into()),
+                ("tests".into(), "max_items".into()),
+                ("parallelism".into(), "min".into()),
+            ]
+        );
+        assert_eq!(
+            rules(check_tests(&request(0, "", None), 4, &limits())),
+            vec![("tests".into(), "required".into())]
+        );
+    }
+
+    #[test]
+    fn test_check_tests_only_tightens_limits() {
+        let mut payload = request(3, "", None);
+        payload.tests[0].time_limit_ms = Some(500);
+        payload.tests[0].memory_limit_bytes = Some(64 << 20);
+        payload.tests[1].time_limit_ms = Some(5000);
+        payload.tests[2].memory_limit_bytes = Some(0);
+        assert_eq!(
+            rules(check_tests(&payload, 4, &limits())),
+            vec![
+                ("tests[1].time_limit_ms".into(), "range".into()),
+                ("tests[2].memory_limit_bytes".into(), "range".into()),
+            ]
+        );
+        let capped = limits().with_memory_limit(32 << 20);
+        assert_eq!(
+            rules(check_tests(&payload, 4, &capped)),
+            vec![
+                ("tests[0].memory_limit_bytes".into(), "range".into()),
+                ("tests[1].time_limit_ms".into(), "range".into()),
+                ("tests[2].memory_limit_bytes".into(), "range".into()),
+            ]
+        );
+    }
+}
@@ -0,0 +1,15 @@
+use axum::Json;
+
+use crate::infra::catalog::{LanguageInfo, languages};
+
+#[utoipa::path(
+    get,
+    path = "/api/v1/languages",
+    tag = "health",
+    responses(
+        (status = 200, description = "Languages this instance runs, with the version of each toolchain", body = [LanguageInfo]),
+    )
+)]
+pub async fn list_languages() -> Json<Vec<LanguageInfo>> {
+    Json(languages().await)
+}
@@ -0,0 +1,91 @@
+use axum::Json;
+use serde::Deserialize;
+use utoipa::ToSchema;
+
+use crate::config::config;
+use crate::infra::{
+    error::InfraError,
+    language::Language,
+    lint::{self, LintReport},
+    runner::ExecContext,
+    toolchain::Toolchain,
+};
+
+use super::{
+    compile::{admit, admit_run, admit_tier, check_limits},
+    error::{ApiError, ErrorResponse, FieldError},
+    extract::{ApiKey, ClientIp, ValidJson},
+};
+
+#[derive(Deserialize, ToSchema)]
+pub struct LintRequest {
+    #[schema(example = "python")]
+    pub lang: String,
+    #[schema(example = "import os\nprint('hi')\n")]
+    pub content: String,
+}
+
+fn linted_language(toolchain: Toolchain) -> Result<Language, ApiError> {
+    match toolchain {
+        Toolchain::Builtin(language) if lint::supports(language) => Ok(language),
+        _ => Err(ApiError::ValidationError(vec![FieldError::new(
+            "lang",
+            "unsupported",
+            format!("{} has no linter", toolchain),
+        )])),
+    }
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/lint",
+    tag = "compile",
+    request_body = LintRequest,
+    params(
+        ("x-api-key" = Option<String>, Header, description = "API key that selects the caller's tier"),
+    ),
+    responses(
+        (status = 200, description = "Diagnostics from the language's linter; the code is never run", body = LintReport),
+        (status = 400, description = "Malformed request body, or a language without a linter", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "The API key's tier does not include the program's language", body = ErrorResponse),
+        (status = 413, description = "Request body or code exceeds its size limit", body = ErrorResponse),
+        (status = 429, description = "The tier's rate limit was reached, or too many of the caller's runs are in progress. Also sent, with Retry-After, while the server sheds load", body = ErrorResponse),
+        (status = 503, description = "No linter for the language is installed", body = ErrorResponse),
+    )
+)]
+pub async fn lint(
+    ApiKey(api_key): ApiKey,
+    ClientIp(client_ip): ClientIp,
+    ValidJson(payload): ValidJson<LintRequest>,
+) -> Result<Json<LintReport>, ApiError> {
+    let tier = admit_tier(api_key.as_deref(), &client_ip, &[]).await?;
+    check_limits(&payload.content, "", tier).await?;
+    let language = linted_language(admit(&payload.lang)?)?;
+    let _slot = admit_run(api_key.as_deref(), tier, Toolchain::Builtin(language)).await?;
+
+    let ctx = ExecContext::default().with_timeout(config().await.exec_timeout());
+    match lint::lint(language, &payload.content, &ctx).await {
+        Ok(report) => Ok(Json(report)),
+        Err(InfraError::CompilerNotFound(_)) => Err(ApiError::ServiceUnavailable(format!(
+            "no linter for {} is installed",
+            language
+        ))),
+        Err(err) => Err(err.into()),
+    }
+}
+
+#[cfg(test)]
+mod lint_tests {
+    use super::*;
+
+    #[test]
+    fn test_linted_language_requires_a_linter() {
+        assert_eq!(linted_language(admit("go").unwrap()).unwrap(), Language::GO);
+        assert!(linted_language(admit("python").unwrap()).is_ok());
+        assert!(matches!(
+            linted_language(admit("ruby").unwrap()),
+            Err(ApiError::ValidationError(_))
+        ));
+    }
+}
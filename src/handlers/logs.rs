@@ -0,0 +1,16 @@
+use axum::{Json, extract::Query};
+
+use crate::infra::logs::{LogQuery, RunLog, run_logs};
+
+#[utoipa::path(
+    get,
+    path = "/api/v1/logs",
+    tag = "logs",
+    params(LogQuery),
+    responses(
+        (status = 200, description = "Matching runs, newest first", body = [RunLog]),
+    )
+)]
+pub async fn search_logs(Query(query): Query<LogQuery>) -> Json<Vec<RunLog>> {
+    Json(run_logs().await.search(&query))
+}
@@ -0,0 +1,229 @@
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+
+use crate::config::config;
+use crate::infra::{
+    events::Submitter,
+    matrix::{MatrixResult, ToolchainVersion, run_matrix},
+    runner::ExecContext,
+    tier::Feature,
+};
+
+use super::{
+    compile::{
+        CompilerRequest, admit_run, admit_tier, check_dependencies, check_limits, check_locale,
+        screen_submission, throttle_submission, validate,
+    },
+    error::{ApiError, ErrorResponse, FieldError},
+    extract::{ApiKey, ClientIp, ValidJson},
+    json::{EncodedLen, PooledJson, string_len},
+};
+
+#[derive(Deserialize, ToSchema)]
+pub struct MatrixRequest {
+    #[serde(flatten)]
+    pub submission: CompilerRequest,
+    // Versions to run against; every configured version when empty.
+    #[serde(default)]
+    #[schema(example = json!(["3.9", "3.11", "3.13"]))]
+    pub versions: Vec<String>,
+}
+
+#[derive(Serialize, ToSchema)]
+pub struct MatrixResponse {
+    #[schema(example = "python")]
+    pub lang: String,
+    pub results: Vec<MatrixResult>,
+}
+
+impl EncodedLen for MatrixResponse {
+    fn encoded_len(&self) -> usize {
+        let results: usize = self
+            .results
+            .iter()
+            .map(|result| {
+                let output = result.output.as_deref().map_or(0, string_len);
+                let error = result.error.as_deref().map_or(0, string_len);
+                output + error + 128
+            })
+            .sum();
+        results + 64
+    }
+}
+
+fn select_versions<'a>(
+    lang: &str,
+    available: &'a [ToolchainVersion],
+    requested: &[String],
+) -> Result<Vec<&'a ToolchainVersion>, Vec<FieldError>> {
+    if available.is_empty() {
+        return Err(vec![FieldError::new(
+            "lang",
+            "unsupported",
+            format!("no toolchain versions are configured for {}", lang),
+        )]);
+    }
+    if requested.is_empty() {
+        return Ok(available.iter().collect());
+    }
+
+    let mut selected = Vec::new();
+    let mut errors = Vec::new();
+    for (i, name) in requested.iter().enumerate() {
+        match available.iter().find(|version| version.name == *name) {
+            Some(version) if !selected.contains(&version) => selected.push(version),
+            Some(_) => errors.push(FieldError::new(
+                &format!("versions[{}]", i),
+                "unique",
+                format!("{} is listed more than once", name),
+            )),
+            None => errors.push(
+                FieldError::new(
+                    &format!("versions[{}]", i),
+                    "oneof",
+                    format!("{} {} is not installed", lang, name),
+                )
+                .allowed(available.iter().map(|version| &version.name)),
+            ),
+        }
+    }
+    if errors.is_empty() {
+        Ok(selected)
+    } else {
+        Err(errors)
+    }
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/matrix",
+    tag = "compile",
+    request_body = MatrixRequest,
+    params(
+        ("x-api-key" = Option<String>, Header, description = "API key that selects the caller's tier"),
+    ),
+    responses(
+        (status = 200, description = "One result per toolchain version, in request order", body = MatrixResponse),
+        (status = 400, description = "Malformed request body, invalid fields or unknown versions", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "The API key's tier does not include matrix runs or the program's language", body = ErrorResponse),
+        (status = 413, description = "Request body, code or stdin exceeds its size limit", body = ErrorResponse),
+        (status = 429, description = "Identical submission repeated too often, the tier's rate limit was reached, or too many of the caller's runs are in progress. Also sent, with Retry-After, while the server sheds load", body = ErrorResponse),
+        (status = 503, description = "Compiled languages are paused while disk space is low", body = ErrorResponse),
+    )
+)]
+pub async fn compile_matrix(
+    ApiKey(api_key): ApiKey,
+    ClientIp(client_ip): ClientIp,
+    ValidJson(payload): ValidJson<MatrixRequest>,
+) -> Result<PooledJson<MatrixResponse>, ApiError> {
+    let submission = &payload.submission;
+    let tier = admit_tier(api_key.as_deref(), &client_ip, &[Feature::Matrix]).await?;
+    check_limits(&submission.content, &submission.stdin, tier).await?;
+    let toolchain = validate(submission)?;
+    let unsupported: Vec<_> = [
+        ("collect_files", submission.collect_files),
+        ("collect_images", submission.collect_images),
+        ("transcript", submission.transcript),
+        ("version", submission.version.is_some()),
+        ("coverage", submission.coverage),
+        ("debug", submission.debug),
+        ("profile", submission.profile),
+    ]
+    .into_iter()
+    .filter(|(_, requested)| *requested)
+    .map(|(field, _)| FieldError::new(field, "unsupported", "not available for matrix runs"))
+    .collect();
+    if !unsupported.is_empty() {
+        return Err(ApiError::ValidationError(unsupported));
+    }
+    check_dependencies(toolchain, &submission.dependencies, tier).await?;
+    check_locale(submission).await?;
+    let submitter = Submitter::new(api_key.as_deref(), &client_ip);
+    screen_submission(&submitter, &submission.lang, &submission.content).await?;
+    let _slot = admit_run(api_key.as_deref(), tier, toolchain).await?;
+
+    let app_config = config().await;
+    let lang = toolchain.as_str();
+    let versions = select_versions(
+        lang,
+        app_config.toolchain_versions().for_lang(lang),
+        &payload.versions,
+    )
+    .map_err(ApiError::ValidationError)?;
+    throttle_submission(&client_ip, &submission.lang, submission.content.as_bytes()).await?;
+
+    let mut ctx = ExecContext::default();
+    if let Some(tier) = tier {
+        ctx = tier.apply(ctx);
+    }
+    let ctx = ctx
+        .with_args(submission.args.clone())
+        .with_envs(submission.env.clone())
+        .with_locale(submission.locale.clone())
+        .with_timezone(submission.timezone.clone())
+        .with_compiler_flags(submission.compiler_flags.clone())
+        .with_backend(submission.backend)
+        .with_js_engine(submission.js_engine)
+        .with_dependencies(submission.dependencies.clone())
+        .with_output_encoding(submission.output_encoding);
+    let results = run_matrix(
+        lang,
+        &submission.content,
+        &submission.stdin,
+        &ctx,
+        &submitter,
+        &versions,
+    )
+    .await;
+
+    Ok(PooledJson(MatrixResponse {
+        lang: lang.to_string(),
+        results,
+    }))
+}
+
+#[cfg(test)]
+mod matrix_tests {
+    use super::*;
+    use std::path::PathBuf;
+
+    fn installed(names: &[&str]) -> Vec<ToolchainVersion> {
+        names
+            .iter()
+            .map(|name| ToolchainVersion {
+                name: name.to_string(),
+                dir: PathBuf::from(format!("/opt/python{}/bin", name)),
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_select_versions_defaults_to_every_installed_version() {
+        let available = installed(&["3.9", "3.11"]);
+        let selected = select_versions("python", &available, &[]).unwrap();
+        assert_eq!(selected.len(), 2);
+
+        let selected = select_versions("python", &available, &["3.11".into()]).unwrap();
+        assert_eq!(selected[0].name, "3.11");
+    }
+
+    #[test]
+    fn test_select_versions_rejects_unknown_and_repeated_versions() {
+        let available = installed(&["3.9", "3.11"]);
+        let errors = select_versions(
+            "python",
+            &available,
+            &["3.9".into(), "2.7".into(), "3.9".into()],
+        )
+        .unwrap_err();
+        let rules: Vec<_> = errors
+            .iter()
+            .map(|err| (err.field.as_str(), err.rule.as_str()))
+            .collect();
+        assert_eq!(rules, [("versions[1]", "oneof"), ("versions[2]", "unique")]);
+
+        let errors = select_versions("go", &[], &[]).unwrap_err();
+        assert_eq!(errors[0].rule, "unsupported");
+    }
+}
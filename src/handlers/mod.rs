@@ -1,3 +1,33 @@
+pub mod admin;
+pub mod build;
 pub mod health;
+pub mod interactive;
+pub mod calibration;
+pub mod compare;
 pub mod compile;
 pub mod error;
+pub mod docs;
+pub mod estimate;
+pub mod jobs;
+pub mod judge;
+pub mod languages;
+pub mod archive;
+pub mod blobs;
+pub mod extract;
+pub mod formats;
+pub mod groups;
+pub mod json;
+pub mod lint;
+pub mod logs;
+pub mod matrix;
+pub mod metrics;
+pub mod msgpack;
+pub mod playground;
+pub mod recover;
+pub mod sessions;
+pub mod signature;
+pub mod snippets;
+pub mod trace;
+pub mod upload;
+pub mod usage;
+pub mod workers;
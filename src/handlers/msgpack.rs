@@ -0,0 +1,89 @@
+use axum::{
+    body::{Body, Bytes},
+    http::{HeaderValue, StatusCode, header},
+    response::{IntoResponse, Response},
+};
+use serde::Serialize;
+
+use super::{
+    extract::{MSGPACK, ResponseFormat},
+    json::{BufferPool, EncodedLen, PooledBuffer, PooledJson, buffer_pool},
+};
+
+// MessagePack is never longer than the same value as JSON, so the JSON
+// estimate leaves room for it too.
+pub fn encode_msgpack<T: Serialize + EncodedLen>(
+    pool: &'static BufferPool,
+    value: &T,
+) -> Result<PooledBuffer, rmp_serde::encode::Error> {
+    let mut pooled = pool.take(value.encoded_len());
+    rmp_serde::encode::write_named(&mut pooled, value)?;
+    Ok(pooled)
+}
+
+// `PooledJson` for clients that asked for MessagePack. Fields are encoded
+// by name, so the document has the same shape as the JSON one.
+pub struct PooledMsgpack<T>(pub T);
+
+impl<T: Serialize + EncodedLen> IntoResponse for PooledMsgpack<T> {
+    fn into_response(self) -> Response {
+        match encode_msgpack(buffer_pool(), &self.0) {
+            Ok(buf) => (
+                [(header::CONTENT_TYPE, HeaderValue::from_static(MSGPACK))],
+                Body::from(Bytes::from_owner(buf)),
+            )
+                .into_response(),
+            Err(err) => (
+                StatusCode::INTERNAL_SERVER_ERROR,
+                [(
+                    header::CONTENT_TYPE,
+                    HeaderValue::from_static("text/plain; charset=utf-8"),
+                )],
+                err.to_string(),
+            )
+                .into_response(),
+        }
+    }
+}
+
+// MessagePack if the client negotiated it, and JSON otherwise.
+pub fn negotiated<T: Serialize + EncodedLen>(format: ResponseFormat, value: T) -> Response {
+    match format {
+        ResponseFormat::MessagePack => PooledMsgpack(value).into_response(),
+        _ => PooledJson(value).into_response(),
+    }
+}
+
+#[cfg(test)]
+mod msgpack_tests {
+    use super::*;
+    use crate::handlers::json::string_len;
+
+    #[derive(Debug, PartialEq, Serialize, serde::Deserialize)]
+    struct Output {
+        result: String,
+        exit_code: Option<i32>,
+    }
+
+    impl EncodedLen for Output {
+        fn encoded_len(&self) -> usize {
+            string_len(&self.result) + 32
+        }
+    }
+
+    #[test]
+    fn test_msgpack_round_trips_by_field_name_in_a_single_allocation() {
+        let pool = Box::leak(Box::new(BufferPool::new(4, 1 << 20)));
+        let value = Output {
+            result: "line \"quoted\"\n".repeat(500),
+            exit_code: Some(3),
+        };
+        let buf = encode_msgpack(pool, &value).unwrap();
+        assert_eq!(buf.capacity(), value.encoded_len());
+        assert!(buf.as_ref().len() < serde_json::to_vec(&value).unwrap().len());
+        assert_eq!(
+            rmp_serde::from_slice::<Output>(buf.as_ref()).unwrap(),
+            value
+        );
+    }
+}
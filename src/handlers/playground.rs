@@ -0,0 +1,97 @@
+use axum::{
+    http::{HeaderValue, header},
+    response::{IntoResponse, Response},
+};
+
+// The built web playground, embedded by build.rs. Empty when the binary was
+// built without running `bun run build` in `web/` first.
+include!(concat!(env!("OUT_DIR"), "/playground.rs"));
+
+// A single dependency-free page served at / in place of a missing build, so
+// every binary has somewhere to try the API from.
+const BUILTIN: &[(&str, &[u8])] = &[("index.html", include_bytes!("../../assets/playground.html"))];
+
+pub fn playground_embedded() -> bool {
+    !PLAYGROUND.is_empty()
+}
+
+fn assets() -> &'static [(&'static str, &'static [u8])] {
+    if playground_embedded() {
+        PLAYGROUND
+    } else {
+        BUILTIN
+    }
+}
+
+fn content_type(path: &str) -> &'static str {
+    match path.rsplit_once('.').map(|(_, ext)| ext) {
+        Some("html") => "text/html; charset=utf-8",
+        Some("js") => "text/javascript; charset=utf-8",
+        Some("css") => "text/css; charset=utf-8",
+        Some("json") => "application/json",
+        Some("svg") => "image/svg+xml",
+        Some("png") => "image/png",
+        Some("ico") => "image/x-icon",
+        Some("woff2") => "font/woff2",
+        _ => "application/octet-stream",
+    }
+}
+
+fn find(table: &'static [(&str, &[u8])], path: &str) -> Option<(&'static str, &'static [u8])> {
+    let path = match path.trim_start_matches('/') {
+        "" => "index.html",
+        path => path,
+    };
+    table
+        .iter()
+        .find(|(name, _)| *name == path)
+        .map(|(name, bytes)| (*name, *bytes))
+}
+
+// Serves `path` from the embedded playground, if it is one of its files.
+pub fn playground_asset(path: &str) -> Option<Response> {
+    let (name, bytes) = find(assets(), path)?;
+    let content_type = HeaderValue::from_static(content_type(name));
+    Some(([(header::CONTENT_TYPE, content_type)], bytes).into_response())
+}
+
+#[cfg(test)]
+mod playground_tests {
+    use super::*;
+
+    const TABLE: &[(&str, &[u8])] = &[
+        ("index.html", b"<!doctype html>"),
+        ("assets/index-1a2b.js", b"console.log(1)"),
+    ];
+
+    #[test]
+    fn test_root_serves_index() {
+        assert_eq!(find(TABLE, "/").unwrap().0, "index.html");
+        assert_eq!(
+            find(TABLE, "/assets/index-1a2b.js").unwrap().1,
+            b"console.log(1)"
+        );
+        assert!(find(TABLE, "/assets/missing.js").is_none());
+        assert!(find(TABLE, "/api/v1/unknown").is_none());
+    }
+
+    #[test]
+    fn test_builtin_page_streams_from_the_compile_endpoint() {
+        let (name, page) = find(BUILTIN, "/").unwrap();
+        assert_eq!(content_type(name), "text/html; charset=utf-8");
+        let page = std::str::from_utf8(page).unwrap();
+        assert!(page.contains("\"/api/v1/compile\""));
+        assert!(page.contains("\"application/x-ndjson\""));
+        assert!(find(BUILTIN, "/assets/index-1a2b.js").is_none());
+    }
+
+    #[test]
+    fn test_content_type_follows_extension() {
+        assert_eq!(content_type("index.html"), "text/html; charset=utf-8");
+        assert_eq!(
+            content_type("assets/index-1a2b.js"),
+            "text/javascript; charset=utf-8"
+        );
+        assert_eq!(content_type("LICENSE"), "application/octet-stream");
+    }
+}
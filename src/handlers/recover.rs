@@ -0,0 +1,88 @@
+use std::{any::Any, backtrace::Backtrace, panic::AssertUnwindSafe};
+
+use axum::{
+    extract::Request,
+    http::{HeaderName, HeaderValue},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use futures_util::FutureExt;
+use uuid::Uuid;
+
+use super::error::ApiError;
+
+pub const REQUEST_ID_HEADER: &str = "x-request-id";
+
+tokio::task_local! {
+    static REQUEST_ID: String;
+}
+
+// Logs panics with a backtrace and, when raised while serving a request, the
+// id of that request.
+pub fn log_panics() {
+    std::panic::set_hook(Box::new(|info| {
+        let request_id = REQUEST_ID
+            .try_with(String::clone)
+            .unwrap_or_else(|_| String::from("-"));
+        tracing::error!(
+            request_id = %request_id,
+            "panic: {}\n{}",
+            info,
+            Backtrace::force_capture()
+        );
+    }));
+}
+
+fn panic_message(payload: &(dyn Any + Send)) -> &str {
+    payload
+        .downcast_ref::<&str>()
+        .copied()
+        .or_else(|| payload.downcast_ref::<String>().map(String::as_str))
+        .unwrap_or("unknown panic")
+}
+
+// Tags every request with an id and turns a panic in a handler into a JSON
+// 500 instead of a dropped connection.
+pub async fn recover_panics(req: Request, next: Next) -> Response {
+    let request_id = req
+        .headers()
+        .get(REQUEST_ID_HEADER)
+        .and_then(|value| value.to_str().ok())
+        .map(str::to_string)
+        .unwrap_or_else(|| Uuid::new_v4().to_string());
+
+    let run = AssertUnwindSafe(next.run(req)).catch_unwind();
+    let mut response = match REQUEST_ID.scope(request_id.clone(), run).await {
+        Ok(response) => response,
+        Err(payload) => ApiError::Internal(format!(
+            "request {} failed unexpectedly: {}",
+            request_id,
+            panic_message(payload.as_ref())
+        ))
+        .into_response(),
+    };
+
+    if let Ok(value) = HeaderValue::from_str(&request_id) {
+        response
+            .headers_mut()
+            .insert(HeaderName::from_static(REQUEST_ID_HEADER), value);
+    }
+    response
+}
+
+#[cfg(test)]
+mod recover_tests {
+    use super::*;
+
+    #[test]
+    fn test_panic_message_reads_str_and_string_payloads() {
+        let payload = std::panic::catch_unwind(|| panic!("boom")).unwrap_err();
+        assert_eq!(panic_message(payload.as_ref()), "boom");
+
+        let payload = std::panic::catch_unwind(|| panic!("{} {}", "formatted", 1)).unwrap_err();
+        assert_eq!(panic_message(payload.as_ref()), "formatted 1");
+
+        let payload = std::panic::catch_unwind(|| std::panic::panic_any(7)).unwrap_err();
+        assert_eq!(panic_message(payload.as_ref()), "unknown panic");
+    }
+}
@@ -0,0 +1,398 @@
+use std::{net::SocketAddr, sync::OnceLock};
+
+use axum::{
+    Json,
+    body::{Body, to_bytes},
+    extract::{ConnectInfo, Path, Request},
+    http::{HeaderMap, HeaderValue, StatusCode, header},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+
+use crate::config::config;
+use crate::infra::{
+    events::Submitter,
+    language::Language,
+    runner::ExecContext,
+    session::{CellOutput, forget_owner, record_owner, session_owner, sessions},
+    tier::Feature,
+};
+
+use super::{
+    compile::{admit, admit_language, admit_tier, check_limits, run_slot, screen_submission},
+    error::{ApiError, ErrorResponse, FieldError},
+    extract::{ApiKey, ClientIp, ValidJson},
+};
+
+// Marks a request one node passed to another, which must answer it itself.
+pub const FORWARDED_HEADER: &str = "x-comphub-forwarded";
+
+#[derive(Deserialize, ToSchema)]
+pub struct SessionRequest {
+    #[schema(value_type = Language)]
+    pub lang: String,
+}
+
+#[derive(Debug, Serialize, ToSchema)]
+pub struct SessionResponse {
+    #[schema(example = "9f1c2e7a4b3d4c5e8f6a7b8c9d0e1f2a")]
+    pub id: String,
+    #[schema(value_type = Language)]
+    pub lang: String,
+    // Pushed back by every cell; the session is closed if none arrives by
+    // then.
+    pub expires_at: DateTime<Utc>,
+}
+
+#[derive(Deserialize, ToSchema)]
+pub struct CellRequest {
+    #[schema(example = "def square(x):\n    return x * x")]
+    pub content: String,
+}
+
+#[derive(Debug, Serialize, ToSchema)]
+pub struct CellResponse {
+    #[schema(example = "49\n")]
+    pub result: String,
+    pub stderr: String,
+    // False when the cell raised or exited with an error. The session stays
+    // open either way.
+    pub ok: bool,
+    pub expires_at: DateTime<Utc>,
+}
+
+async fn expires_at() -> DateTime<Utc> {
+    let ttl = sessions().await.ttl();
+    Utc::now() + chrono::Duration::from_std(ttl).unwrap_or_default()
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/sessions",
+    tag = "sessions",
+    request_body = SessionRequest,
+    params(
+        ("x-api-key" = Option<String>, Header, description = "API key that selects the caller's tier"),
+    ),
+    responses(
+        (status = 201, description = "Session opened", body = SessionResponse),
+        (status = 400, description = "Malformed request body or unknown language", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "The API key's tier does not include sessions or the program's language", body = ErrorResponse),
+        (status = 429, description = "The tier's rate limit was reached. Also sent, with Retry-After, while the server sheds load", body = ErrorResponse),
+        (status = 503, description = "Sessions are turned off, or too many are open", body = ErrorResponse),
+    )
+)]
+pub async fn open_session(
+    ApiKey(api_key): ApiKey,
+    ClientIp(client_ip): ClientIp,
+    ValidJson(payload): ValidJson<SessionRequest>,
+) -> Result<(StatusCode, Json<SessionResponse>), ApiError> {
+    let tier = admit_tier(api_key.as_deref(), &client_ip, &[Feature::Sessions]).await?;
+    let toolchain = admit(&payload.lang)?;
+    admit_language(tier, toolchain)?;
+    let registry = sessions().await;
+    if registry.ttl().is_zero() {
+        return Err(ApiError::ServiceUnavailable(
+            "this instance does not keep sessions".into(),
+        ));
+    }
+
+    let mut ctx = ExecContext::default();
+    if let Some(tier) = tier {
+        ctx = tier.apply(ctx);
+    }
+    let id = registry.open(toolchain, ctx)?.ok_or_else(|| {
+        ApiError::ServiceUnavailable("too many sessions are open, try again later".into())
+    })?;
+    record_owner(&id, registry.ttl()).await;
+    Ok((
+        StatusCode::CREATED,
+        Json(SessionResponse {
+            id,
+            lang: payload.lang,
+            expires_at: expires_at().await,
+        }),
+    ))
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/sessions/{id}/cells",
+    tag = "sessions",
+    request_body = CellRequest,
+    params(
+        ("id" = String, Path, description = "Session id returned when it was opened"),
+        ("x-api-key" = Option<String>, Header, description = "API key that selects the caller's tier"),
+    ),
+    responses(
+        (status = 200, description = "The cell ran; `ok` tells whether it succeeded", body = CellResponse),
+        (status = 400, description = "Malformed request body, or code the submission or import policy refuses", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "The API key's tier does not include sessions", body = ErrorResponse),
+        (status = 404, description = "Unknown, closed or expired session", body = ErrorResponse),
+        (status = 408, description = "The cell exceeded the time limit; a Python session loses its state", body = ErrorResponse),
+        (status = 413, description = "Code exceeds its size limit", body = ErrorResponse),
+        (status = 429, description = "The tier's rate limit was reached, or too many of the caller's runs are in progress", body = ErrorResponse),
+        (status = 503, description = "Another node holds the session and cannot be reached", body = ErrorResponse),
+    )
+)]
+pub async fn run_cell(
+    ApiKey(api_key): ApiKey,
+    ClientIp(client_ip): ClientIp,
+    Path(id): Path<String>,
+    ValidJson(payload): ValidJson<CellRequest>,
+) -> Result<Json<CellResponse>, ApiError> {
+    let tier = admit_tier(api_key.as_deref(), &client_ip, &[Feature::Sessions]).await?;
+    check_limits(&payload.content, "", tier).await?;
+    let registry = sessions().await;
+    let session = registry
+        .get(&id)
+        .ok_or_else(|| ApiError::NotFound(format!("session {}", id)))?;
+    record_owner(&id, registry.ttl()).await;
+    let submitter = Submitter::new(api_key.as_deref(), &client_ip);
+    let lang = session.toolchain().as_str();
+    screen_submission(&submitter, lang, &payload.content).await?;
+    let _slot = run_slot(api_key.as_deref(), tier).await?;
+
+    let CellOutput { stdout, stderr, ok } = session.run(&payload.content, &submitter).await?;
+    Ok(Json(CellResponse {
+        result: stdout,
+        stderr,
+        ok,
+        expires_at: expires_at().await,
+    }))
+}
+
+#[utoipa::path(
+    delete,
+    path = "/api/v1/sessions/{id}",
+    tag = "sessions",
+    params(("id" = String, Path, description = "Session id returned when it was opened")),
+    responses(
+        (status = 204, description = "Session closed and its files removed"),
+        (status = 404, description = "Unknown or already closed session", body = ErrorResponse),
+        (status = 503, description = "Another node holds the session and cannot be reached", body = ErrorResponse),
+    )
+)]
+pub async fn close_session(Path(id): Path<String>) -> Result<StatusCode, ApiError> {
+    if sessions().await.close(&id) {
+        forget_owner(&id).await;
+        Ok(StatusCode::NO_CONTENT)
+    } else {
+        Err(ApiError::NotFound(format!("session {}", id)))
+    }
+}
+
+// The session a path under /api/v1/sessions/ names, if any.
+fn session_id(path: &str) -> Option<&str> {
+    let id = path.strip_prefix("/api/v1/sessions/")?.split('/').next()?;
+    (!id.is_empty()).then_some(id)
+}
+
+fn peer_client() -> &'static reqwest::Client {
+    static CLIENT: OnceLock<reqwest::Client> = OnceLock::new();
+    CLIENT.get_or_init(reqwest::Client::new)
+}
+
+// X-Forwarded-For as the next node should see it: the hops already listed,
+// then `peer`, whom this node heard the request from.
+fn forwarded_for(headers: &HeaderMap, peer: &str) -> String {
+    let mut hops: Vec<&str> = headers
+        .get_all("x-forwarded-for")
+        .iter()
+        .filter_map(|value| value.to_str().ok())
+        .collect();
+    hops.push(peer);
+    hops.join(", ")
+}
+
+// Passes `req` to the node at `owner` as it came, adding who sent it to
+// X-Forwarded-For, and answers with whatever that node answered.
+async fn forward(owner: &str, req: Request, limit: usize) -> Result<Response, ApiError> {
+    let (mut parts, body) = req.into_parts();
+    let Ok(body) = to_bytes(body, limit).await else {
+        return Err(ApiError::PayloadTooLarge(vec![FieldError::new(
+            "body",
+            "max_bytes",
+            format!("request body must be at most {} bytes", limit),
+        )]));
+    };
+    let forwarded = parts
+        .extensions
+        .get::<ConnectInfo<SocketAddr>>()
+        .map(|ConnectInfo(addr)| forwarded_for(&parts.headers, &addr.ip().to_string()))
+        .and_then(|hops| HeaderValue::from_str(&hops).ok());
+    if let Some(forwarded) = forwarded {
+        parts.headers.insert("x-forwarded-for", forwarded);
+    }
+    parts.headers.remove(header::HOST);
+    parts
+        .headers
+        .insert(FORWARDED_HEADER, HeaderValue::from_static("1"));
+    let path = parts.uri.path_and_query().map_or("/", |path| path.as_str());
+
+    let unreachable = |err: reqwest::Error| {
+        tracing::warn!("failed to reach session owner {}: {}", owner, err);
+        ApiError::ServiceUnavailable("the node holding this session cannot be reached".into())
+    };
+    let answer = peer_client()
+        .request(parts.method, format!("{}{}", owner, path))
+        .headers(parts.headers)
+        .body(body)
+        .send()
+        .await
+        .map_err(unreachable)?;
+    let status = answer.status();
+    let mut headers = answer.headers().clone();
+    let body = answer.bytes().await.map_err(unreachable)?;
+    headers.remove(header::TRANSFER_ENCODING);
+    headers.remove(header::CONNECTION);
+
+    let mut response = Response::new(Body::from(body));
+    *response.status_mut() = status;
+    *response.headers_mut() = headers;
+    Ok(response)
+}
+
+// A session lives on the node that opened it. Behind a load balancer
+// without sticky routing, a request for one held by another node is passed
+// on to that node before this one checks its signature or counts it
+// against a rate limit, so that the owner does both, once.
+pub async fn route_to_owner(req: Request, next: Next) -> Response {
+    let Some(id) = session_id(req.uri().path()).map(str::to_string) else {
+        return next.run(req).await;
+    };
+    let app_config = config().await;
+    let Some(node_url) = app_config.node_url() else {
+        return next.run(req).await;
+    };
+    if req.headers().contains_key(FORWARDED_HEADER) || sessions().await.get(&id).is_some() {
+        return next.run(req).await;
+    }
+    match session_owner(&id).await {
+        Some(owner) if owner != node_url => forward(&owner, req, app_config.request_max_bytes())
+            .await
+            .unwrap_or_else(IntoResponse::into_response),
+        _ => next.run(req).await,
+    }
+}
+
+#[cfg(test)]
+mod sessions_tests {
+    use super::*;
+    use tokio::{
+        io::{AsyncReadExt, AsyncWriteExt},
+        net::TcpListener,
+    };
+
+    async fn open(lang: &str) -> String {
+        let (status, Json(session)) = open_session(
+            ApiKey(None),
+            ClientIp(String::from("127.0.0.1")),
+            ValidJson(SessionRequest {
+                lang: lang.to_string(),
+            }),
+        )
+        .await
+        .unwrap();
+        assert_eq!(status, StatusCode::CREATED);
+        session.id
+    }
+
+    async fn cell(id: &str, content: &str) -> Result<CellResponse, ApiError> {
+        run_cell(
+            ApiKey(None),
+            ClientIp(String::from("127.0.0.1")),
+            Path(id.to_string()),
+            ValidJson(CellRequest {
+                content: content.to_string(),
+            }),
+        )
+        .await
+        .map(|Json(response)| response)
+    }
+
+    #[tokio::test]
+    async fn test_cells_build_on_earlier_ones_until_closed() {
+        let id = open("python").await;
+        let defined = cell(&id, "def greet(name):\n    return 'hi ' + name")
+            .await
+            .unwrap();
+        assert!(defined.ok, "{}", defined.stderr);
+        let called = cell(&id, "print(greet('there'))").await.unwrap();
+        assert_eq!(called.result, "hi there\n");
+
+        assert_eq!(
+            close_session(Path(id.clone())).await.unwrap(),
+            StatusCode::NO_CONTENT
+        );
+        assert!(matches!(
+            cell(&id, "greet('again')").await,
+            Err(ApiError::NotFound(_))
+        ));
+        assert!(matches!(
+            close_session(Path(id)).await,
+            Err(ApiError::NotFound(_))
+        ));
+    }
+
+    #[test]
+    fn test_session_id_is_read_from_session_paths_only() {
+        assert_eq!(session_id("/api/v1/sessions/abc/cells"), Some("abc"));
+        assert_eq!(session_id("/api/v1/sessions/abc"), Some("abc"));
+        assert_eq!(session_id("/api/v1/sessions"), None);
+        assert_eq!(session_id("/api/v1/sessions/"), None);
+        assert_eq!(session_id("/api/v1/jobs/abc"), None);
+    }
+
+    #[test]
+    fn test_forwarded_for_appends_the_peer() {
+        let mut headers = HeaderMap::new();
+        assert_eq!(forwarded_for(&headers, "10.0.0.9"), "10.0.0.9");
+        headers.append("x-forwarded-for", HeaderValue::from_static("1.2.3.4"));
+        headers.append("x-forwarded-for", HeaderValue::from_static("10.0.0.1"));
+        assert_eq!(
+            forwarded_for(&headers, "10.0.0.9"),
+            "1.2.3.4, 10.0.0.1, 10.0.0.9"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_forward_passes_the_request_on_as_it_came() {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let owner = format!("http://{}", listener.local_addr().unwrap());
+        let node = tokio::spawn(async move {
+            let (mut stream, _) = listener.accept().await.unwrap();
+            let mut received = Vec::new();
+            while !received.ends_with(b"print(1)\"}") {
+                let mut buf = [0u8; 1024];
+                let n = stream.read(&mut buf).await.unwrap();
+                received.extend_from_slice(&buf[..n]);
+            }
+            let answer = "HTTP/1.1 200 OK\r\ncontent-length: 9\r\n\r\n{\"ok\":1}\n";
+            stream.write_all(answer.as_bytes()).await.unwrap();
+            String::from_utf8(received).unwrap().to_lowercase()
+        });
+
+        let req = Request::builder()
+            .method("POST")
+            .uri("/api/v1/sessions/abc/cells?x=1")
+            .header("x-api-key", "key")
+            .body(Body::from(r#"{"content":"print(1)"}"#))
+            .unwrap();
+        let response = forward(&owner, req, 1024).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        assert_eq!(
+            to_bytes(response.into_body(), 1024).await.unwrap(),
+            "{\"ok\":1}\n"
+        );
+        let received = node.await.unwrap();
+        assert!(received.starts_with("post /api/v1/sessions/abc/cells?x=1 http/1.1\r\n"));
+        assert!(received.contains("x-api-key: key\r\n"));
+        assert!(received.contains("x-comphub-forwarded: 1\r\n"));
+    }
+}
@@ -0,0 +1,91 @@
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use axum::{
+    body::{Body, to_bytes},
+    extract::Request,
+    http::HeaderMap,
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+
+use crate::config::config;
+use crate::infra::{
+    signing::{SignatureError, SignedRequest},
+    store::store,
+};
+
+use super::error::{ApiError, FieldError};
+
+pub const KEY_ID_HEADER: &str = "x-signature-key";
+pub const TIMESTAMP_HEADER: &str = "x-signature-timestamp";
+pub const SIGNATURE_HEADER: &str = "x-signature";
+
+fn header<'a>(headers: &'a HeaderMap, name: &'static str) -> Result<&'a str, SignatureError> {
+    headers
+        .get(name)
+        .and_then(|value| value.to_str().ok())
+        .ok_or(SignatureError::MissingHeader(name))
+}
+
+fn unix_now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+// When signing keys are configured, submissions must carry an HMAC of their
+// timestamp, method, path and body made with one of those keys. Each
+// signature is accepted once; the store remembers it for as long as its
+// timestamp could still pass the window check.
+pub async fn require_signature(req: Request, next: Next) -> Response {
+    let app_config = config().await;
+    let keys = app_config.signing_keys();
+    if keys.is_empty() {
+        return next.run(req).await;
+    }
+
+    let limit = app_config
+        .request_max_bytes()
+        .max(app_config.upload_max_bytes());
+    let (parts, body) = req.into_parts();
+    let Ok(body) = to_bytes(body, limit).await else {
+        return ApiError::PayloadTooLarge(vec![FieldError::new(
+            "body",
+            "max_bytes",
+            format!("request body must be at most {} bytes", limit),
+        )])
+        .into_response();
+    };
+
+    let window = app_config.signature_window();
+    let verified = (|| {
+        let signature = header(&parts.headers, SIGNATURE_HEADER)?;
+        let request = SignedRequest {
+            key_id: header(&parts.headers, KEY_ID_HEADER)?,
+            timestamp: header(&parts.headers, TIMESTAMP_HEADER)?,
+            signature,
+            method: parts.method.as_str(),
+            path: parts.uri.path(),
+            body: &body,
+        };
+        keys.verify(&request, window, unix_now())?;
+        Ok::<_, SignatureError>(format!("signature:{}", signature.to_lowercase()))
+    })();
+    let key = match verified {
+        Ok(key) => key,
+        Err(err) => return ApiError::Unauthorized(err.to_string()).into_response(),
+    };
+
+    match store().await.put_if_absent(&key, &true, Some(window * 2)) {
+        Ok(None) => {}
+        Ok(Some(_)) => {
+            return ApiError::Unauthorized(SignatureError::Replayed.to_string()).into_response();
+        }
+        Err(err) => {
+            tracing::warn!("failed to record request signature: {}", err);
+        }
+    }
+
+    next.run(Request::from_parts(parts, Body::from(body))).await
+}
@@ -0,0 +1,219 @@
+use axum::{Json, extract::Path, http::StatusCode, response::Response};
+use base64::{Engine, engine::general_purpose::URL_SAFE_NO_PAD};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use utoipa::ToSchema;
+
+use crate::config::config;
+use crate::infra::{language::Language, runner::OutputEncoding, store::store, wasm::Backend};
+
+use super::{
+    compile::{CompilerRequest, CompilerResponse, check_limits, resolve_lang, respond},
+    error::{ApiError, ErrorResponse},
+    extract::{ApiKey, ClientIp, ResponseFormat, ValidJson},
+};
+
+const ID_LEN: usize = 11;
+
+// A program saved for sharing, with everything needed to run it again.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize, ToSchema)]
+pub struct Snippet {
+    #[schema(value_type = Language)]
+    pub lang: String,
+    #[schema(example = "print(\"hello world\")")]
+    pub content: String,
+    #[serde(default)]
+    pub stdin: String,
+}
+
+#[derive(Debug, Serialize, ToSchema)]
+pub struct SavedSnippet {
+    #[schema(example = "q2fT0kB9x1c")]
+    pub id: String,
+    // When the snippet is deleted, unless the server keeps them forever.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub expires_at: Option<DateTime<Utc>>,
+}
+
+impl From<Snippet> for CompilerRequest {
+    fn from(snippet: Snippet) -> Self {
+        CompilerRequest {
+            lang: snippet.lang,
+            content: snippet.content,
+            stdin: snippet.stdin,
+            args: Vec::new(),
+            env: Default::default(),
+            compiler_flags: Vec::new(),
+            collect_files: false,
+            file_contents: None,
+            collect_images: false,
+            transcript: false,
+            backend: Backend::Native,
+            js_engine: None,
+            version: None,
+            dependencies: Vec::new(),
+            setup: String::new(),
+            coverage: false,
+            debug: false,
+            profile: false,
+            output_encoding: OutputEncoding::Text,
+            inline_output_bytes: None,
+            locale: None,
+            timezone: None,
+        }
+    }
+}
+
+// Derived from the snippet itself, so saving the same program twice gives
+// the same link.
+fn snippet_id(snippet: &Snippet) -> String {
+    let mut hasher = Sha256::new();
+    for part in [&snippet.lang, &snippet.content, &snippet.stdin] {
+        hasher.update(part.as_bytes());
+        hasher.update([0]);
+    }
+    let mut id = URL_SAFE_NO_PAD.encode(hasher.finalize());
+    id.truncate(ID_LEN);
+    id
+}
+
+fn store_key(id: &str) -> String {
+    format!("snippet:{}", id)
+}
+
+async fn load(id: &str) -> Result<Snippet, ApiError> {
+    store()
+        .await
+        .get(&store_key(id))
+        .ok_or_else(|| ApiError::NotFound(format!("snippet {}", id)))
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/snippets",
+    tag = "snippets",
+    request_body = Snippet,
+    responses(
+        (status = 201, description = "Snippet saved", body = SavedSnippet),
+        (status = 400, description = "Malformed request body or unknown language", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 413, description = "Code or stdin exceeds its size limit", body = ErrorResponse),
+    )
+)]
+pub async fn save_snippet(
+    ValidJson(snippet): ValidJson<Snippet>,
+) -> Result<(StatusCode, Json<SavedSnippet>), ApiError> {
+    check_limits(&snippet.content, &snippet.stdin, None).await?;
+    resolve_lang(&snippet.lang)?;
+
+    let retention = Some(config().await.snippet_retention()).filter(|ttl| !ttl.is_zero());
+    let id = snippet_id(&snippet);
+    store()
+        .await
+        .put(&store_key(&id), &snippet, retention)
+        .map_err(|err| ApiError::Internal(format!("failed to save snippet: {}", err)))?;
+    let expires_at = retention
+        .and_then(|ttl| chrono::Duration::from_std(ttl).ok())
+        .map(|ttl| Utc::now() + ttl);
+
+    Ok((StatusCode::CREATED, Json(SavedSnippet { id, expires_at })))
+}
+
+#[utoipa::path(
+    get,
+    path = "/api/v1/snippets/{id}",
+    tag = "snippets",
+    params(("id" = String, Path, description = "Snippet id returned when it was saved")),
+    responses(
+        (status = 200, description = "The saved snippet", body = Snippet),
+        (status = 404, description = "Unknown or expired snippet", body = ErrorResponse),
+    )
+)]
+pub async fn get_snippet(Path(id): Path<String>) -> Result<Json<Snippet>, ApiError> {
+    load(&id).await.map(Json)
+}
+
+#[utoipa::path(
+    get,
+    path = "/api/v1/snippets/{id}/run",
+    tag = "snippets",
+    params(
+        ("id" = String, Path, description = "Snippet id returned when it was saved"),
+        ("x-api-key" = Option<String>, Header, description = "API key that selects the caller's tier"),
+    ),
+    responses(
+        (status = 200, description = "Program ran successfully. With `Accept: text/plain` the body is only the output; with `application/x-ndjson` output events are streamed as they are written, ending with a `result` or `error` event; with `text/event-stream` the same arrive as server-sent events named `stdout`, `stderr`, `result` and `error`; with `application/msgpack` the JSON document is encoded as MessagePack", content(
+            (CompilerResponse = "application/json"),
+            (String = "text/plain"),
+            (String = "application/x-ndjson"),
+            (String = "text/event-stream"),
+            (CompilerResponse = "application/msgpack"),
+        )),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "The API key's tier does not include the snippet's language", body = ErrorResponse),
+        (status = 404, description = "Unknown or expired snippet", body = ErrorResponse),
+        (status = 406, description = "The Accept header allows none of JSON, plain text, NDJSON, server-sent events or MessagePack", body = ErrorResponse),
+        (status = 408, description = "Execution exceeded the time limit; `timed_out` tells how long it ran and what it wrote until then", body = ErrorResponse),
+        (status = 429, description = "Identical submission repeated too often, the tier's rate limit was reached, or too many of the caller's runs are in progress. Also sent, with Retry-After, while the server sheds load", body = ErrorResponse),
+        (status = 500, description = "Compilation or execution failed; `crashed` tells how a program that ran ended and what it wrote", body = ErrorResponse),
+        (status = 503, description = "Compiled languages are paused while disk space is low", body = ErrorResponse),
+    )
+)]
+pub async fn run_snippet(
+    ApiKey(api_key): ApiKey,
+    ClientIp(client_ip): ClientIp,
+    format: ResponseFormat,
+    Path(id): Path<String>,
+) -> Result<Response, ApiError> {
+    let snippet = load(&id).await?;
+    respond(format, api_key.as_deref(), &client_ip, None, snippet.into()).await
+}
+
+#[cfg(test)]
+mod snippets_tests {
+    use super::*;
+    use crate::handlers::compile::run_submission;
+
+    fn snippet(stdin: &str) -> Snippet {
+        Snippet {
+            lang: "python".into(),
+            content: "print(input())".into(),
+            stdin: stdin.into(),
+        }
+    }
+
+    #[test]
+    fn test_snippet_id_depends_on_every_field() {
+        let id = snippet_id(&snippet("a"));
+        assert_eq!(id.len(), ID_LEN);
+        assert_eq!(id, snippet_id(&snippet("a")));
+        assert_ne!(id, snippet_id(&snippet("b")));
+    }
+
+    #[tokio::test]
+    async fn test_saved_snippet_can_be_loaded_and_run() {
+        let (status, Json(saved)) = save_snippet(ValidJson(snippet("shared"))).await.unwrap();
+        assert_eq!(status, StatusCode::CREATED);
+
+        let Json(loaded) = get_snippet(Path(saved.id.clone())).await.unwrap();
+        assert_eq!(loaded, snippet("shared"));
+
+        let response = run_submission(None, "127.0.0.1", None, loaded.into())
+            .await
+            .unwrap();
+        assert_eq!(response.result, "shared\n");
+        let response = run_snippet(
+            ApiKey(None),
+            ClientIp(String::from("127.0.0.1")),
+            ResponseFormat::Text,
+            Path(saved.id),
+        )
+        .await
+        .unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+
+        let missing = get_snippet(Path(String::from("missing"))).await;
+        assert!(matches!(missing, Err(ApiError::NotFound(_))));
+    }
+}
@@ -0,0 +1,16 @@
+use axum::{extract::Request, middleware::Next, response::Response};
+
+use crate::infra::trace::{TRACEPARENT_HEADER, is_traceparent, traced};
+
+// Serves the request as part of the trace in its traceparent header, which
+// is passed on to the jobs, webhooks and events the request leads to. A
+// malformed header is ignored, as the W3C spec asks.
+pub async fn propagate_trace(req: Request, next: Next) -> Response {
+    let traceparent = req
+        .headers()
+        .get(TRACEPARENT_HEADER)
+        .and_then(|value| value.to_str().ok())
+        .filter(|value| is_traceparent(value))
+        .map(str::to_string);
+    traced(traceparent, next.run(req)).await
+}
@@ -0,0 +1,237 @@
+use std::path::Path;
+
+use axum::extract::{Multipart, multipart::Field};
+use tempfile::TempDir;
+use tokio::{fs::File, io::AsyncWriteExt, sync::mpsc::Sender};
+use utoipa::ToSchema;
+use uuid::Uuid;
+
+use crate::{
+    config::config,
+    infra::{
+        compile::compile_lang,
+        disk::execution_zone,
+        error::InfraError,
+        events::Submitter,
+        language::Language,
+        logs::logged,
+        runner::{CompilerWarnings, ExecContext, StdinStream},
+        toolchain::Toolchain,
+    },
+};
+
+use super::{
+    archive::{read_field, text},
+    compile::{
+        CompilerResponse, admit, admit_run, admit_tier, check_limits, resolve_version,
+        screen_submission, throttle_submission,
+    },
+    error::{ApiError, ErrorResponse, FieldError},
+    extract::{ApiKey, ClientIp},
+    json::PooledJson,
+};
+
+#[derive(ToSchema)]
+pub struct StdinUpload {
+    #[schema(value_type = Language)]
+    pub lang: String,
+    #[schema(example = "import sys\nprint(sum(map(int, sys.stdin.read().split())))")]
+    pub content: String,
+    // Fed to the program as it reads, so it may be far larger than a JSON
+    // body is allowed to be. Sent after `lang` and `content`, it is piped
+    // into the program while it is still being uploaded, up to the tier's
+    // stdin limit or STDIN_STREAM_MAX_BYTES. Sent earlier, it is kept in a
+    // file until the code arrives, up to the tier's stdin limit or
+    // UPLOAD_MAX_BYTES.
+    #[schema(value_type = Option<String>, format = Binary)]
+    pub stdin: Option<Vec<u8>>,
+    #[schema(example = "3.12")]
+    pub version: Option<String>,
+}
+
+// How many received chunks may wait for a program to read them.
+const STDIN_STREAM_CHUNKS: usize = 8;
+
+fn stdin_too_large(limit: u64) -> ApiError {
+    ApiError::PayloadTooLarge(vec![FieldError::new(
+        "stdin",
+        "max_bytes",
+        format!("stdin must be at most {} bytes", limit),
+    )])
+}
+
+// Writes the field to `path` chunk by chunk, failing once it passes `limit`.
+async fn save_field(mut field: Field<'_>, path: &Path, limit: u64) -> Result<(), ApiError> {
+    let mut file = File::create(path).await.map_err(InfraError::from)?;
+    let mut written = 0;
+    while let Some(chunk) = field
+        .chunk()
+        .await
+        .map_err(|err| ApiError::BadRequest(err.to_string()))?
+    {
+        written += chunk.len() as u64;
+        if written > limit {
+            return Err(stdin_too_large(limit));
+        }
+        file.write_all(&chunk).await.map_err(InfraError::from)?;
+    }
+    file.flush().await.map_err(InfraError::from)?;
+    Ok(())
+}
+
+// Passes the field on to a running program as it arrives, waiting while the
+// program is behind. Stops early if the program no longer reads.
+async fn pipe_field(mut field: Field<'_>, tx: Sender<Vec<u8>>, limit: u64) -> Result<(), ApiError> {
+    let mut sent = 0;
+    while let Some(chunk) = field
+        .chunk()
+        .await
+        .map_err(|err| ApiError::BadRequest(err.to_string()))?
+    {
+        sent += chunk.len() as u64;
+        if sent > limit {
+            return Err(stdin_too_large(limit));
+        }
+        if tx.send(chunk.to_vec()).await.is_err() {
+            break;
+        }
+    }
+    Ok(())
+}
+
+#[utoipa::path(
+    post,
+    path = "/api/v1/compile/upload",
+    tag = "compile",
+    request_body(content = StdinUpload, content_type = "multipart/form-data"),
+    params(
+        ("x-api-key" = Option<String>, Header, description = "API key that selects the caller's tier"),
+    ),
+    responses(
+        (status = 200, description = "Program ran successfully", body = CompilerResponse),
+        (status = 400, description = "Malformed upload, or code the submission or import policy refuses", body = ErrorResponse),
+        (status = 401, description = "Missing, stale or replayed request signature", body = ErrorResponse),
+        (status = 403, description = "Program made a system call its seccomp profile blocks, or the API key's tier does not include the program's language", body = ErrorResponse),
+        (status = 408, description = "Execution exceeded the time limit; `timed_out` tells how long it ran and what it wrote until then", body = ErrorResponse),
+        (status = 413, description = "Code or the stdin file exceeds its size limit", body = ErrorResponse),
+        (status = 429, description = "Identical submission repeated too often, the tier's rate limit was reached, or too many of the caller's runs are in progress. Also sent, with Retry-After, while the server sheds load", body = ErrorResponse),
+        (status = 500, description = "Compilation or execution failed; `crashed` tells how a program that ran ended and what it wrote", body = ErrorResponse),
+        (status = 503, description = "Compiled languages are paused while disk space is low", body = ErrorResponse),
+        (status = 507, description = "Program wrote more than the per-execution disk quota or its language's output limit", body = ErrorResponse),
+    )
+)]
+pub async fn compile_upload(
+    ApiKey(api_key): ApiKey,
+    ClientIp(client_ip): ClientIp,
+    mut multipart: Multipart,
+) -> Result<PooledJson<CompilerResponse>, ApiError> {
+    let tier = admit_tier(api_key.as_deref(), &client_ip, &[]).await?;
+    let app_config = config().await;
+    let max_code_bytes = app_config.code_max_bytes();
+    let tier_stdin_bytes = tier.and_then(|tier| tier.max_stdin_bytes);
+    let max_stdin_bytes = tier_stdin_bytes.unwrap_or(app_config.upload_max_bytes());
+
+    // The stdin file stays outside the program's workspace, where only the
+    // runner reads it.
+    let uploads = TempDir::new_in(execution_zone()).map_err(InfraError::from)?;
+    let stdin_path = uploads.path().join("stdin");
+    let (mut lang, mut content, mut version, mut has_stdin) = (None, None, None, false);
+    let piped = loop {
+        let Some(field) = multipart
+            .next_field()
+            .await
+            .map_err(|err| ApiError::BadRequest(err.to_string()))?
+        else {
+            break None;
+        };
+        match field.name().unwrap_or_default() {
+            "lang" => lang = Some(text(read_field(field, max_code_bytes).await?, "lang")?),
+            "content" => content = Some(text(read_field(field, max_code_bytes).await?, "content")?),
+            "version" => version = Some(text(read_field(field, max_code_bytes).await?, "version")?),
+            // Later fields are ignored, since reading on would mean holding
+            // the whole of stdin.
+            "stdin" if lang.is_some() && content.is_some() => break Some(field),
+            "stdin" => {
+                save_field(field, &stdin_path, max_stdin_bytes as u64).await?;
+                has_stdin = true;
+            }
+            _ => {}
+        }
+    };
+
+    let lang = lang.ok_or_else(|| ApiError::BadRequest("missing field `lang`".into()))?;
+    let content = content.ok_or_else(|| ApiError::BadRequest("missing field `content`".into()))?;
+    check_limits(&content, "", tier).await?;
+    let toolchain = admit(&lang)?;
+    if matches!(toolchain, Toolchain::Builtin(Language::WASM)) && (has_stdin || piped.is_some()) {
+        return Err(ApiError::ValidationError(vec![FieldError::new(
+            "stdin",
+            "unsupported",
+            "stdin files are not available for wasm modules",
+        )]));
+    }
+    let version = resolve_version(toolchain, version.as_deref()).await?;
+    let submitter = Submitter::new(api_key.as_deref(), &client_ip);
+    screen_submission(&submitter, &lang, &content).await?;
+    let _slot = admit_run(api_key.as_deref(), tier, toolchain).await?;
+    throttle_submission(&client_ip, &lang, content.as_bytes()).await?;
+
+    let mut ctx = ExecContext::default();
+    if let Some(tier) = tier {
+        ctx = tier.apply(ctx);
+    }
+    if let Some(version) = version {
+        ctx = ctx.with_toolchain_dir(version.dir.clone());
+    }
+    if has_stdin {
+        ctx = ctx.with_stdin_file(stdin_path);
+    }
+    let warnings = CompilerWarnings::default();
+    ctx = ctx.with_compiler_warnings(warnings.clone());
+    let pipe = piped.map(|field| {
+        let (tx, stream) = StdinStream::channel(STDIN_STREAM_CHUNKS);
+        ctx = ctx.clone().with_stdin_stream(stream);
+        let limit =
+            tier_stdin_bytes.map_or(app_config.stdin_stream_max_bytes(), |bytes| bytes as u64);
+        pipe_field(field, tx, limit)
+    });
+    let id = Uuid::new_v4().to_string();
+    let run = logged(
+        &id,
+        &lang,
+        &content,
+        &submitter,
+        compile_lang(&lang, &content, "", &ctx),
+    );
+    // The run may finish before all of stdin is received, and then the rest
+    // is not waited for. A failed upload ends the run.
+    let res = match pipe {
+        Some(pipe) => {
+            tokio::pin!(run);
+            tokio::select! {
+                res = &mut run => res?,
+                piped = pipe => {
+                    piped?;
+                    run.await?
+                }
+            }
+        }
+        None => run.await?,
+    };
+
+    Ok(PooledJson(CompilerResponse {
+        id: Some(id),
+        lang: None,
+        result: res,
+        result_url: None,
+        result_bytes: None,
+        warnings: warnings.take(),
+        files: None,
+        images: None,
+        transcript: None,
+        version: version.map(|version| version.name.clone()),
+        coverage: None,
+        sanitizer: None,
+        profile: None,
+    }))
+}
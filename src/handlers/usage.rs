@@ -0,0 +1,48 @@
+use axum::Json;
+use serde::Serialize;
+use utoipa::ToSchema;
+
+use crate::infra::{
+    tenants::{TenantUsage, tenant_id, tenants},
+    tier::tiers,
+};
+
+use super::extract::ApiKey;
+
+#[derive(Serialize, ToSchema)]
+pub struct UsageResponse {
+    // The caller's tier and the limits it sets, when the server has a tier
+    // policy.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = "classroom")]
+    pub tier: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = 16)]
+    pub max_concurrent_runs: Option<usize>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub languages: Option<Vec<String>>,
+    #[serde(flatten)]
+    pub usage: TenantUsage,
+}
+
+#[utoipa::path(
+    get,
+    path = "/api/v1/usage",
+    tag = "health",
+    params(
+        ("x-api-key" = Option<String>, Header, description = "API key whose usage to report"),
+    ),
+    responses(
+        (status = 200, description = "Requests and runs made with the API key since the server started, and its tier's limits", body = UsageResponse),
+    )
+)]
+pub async fn get_usage(ApiKey(api_key): ApiKey) -> Json<UsageResponse> {
+    let policy = tiers().await;
+    let tier = policy.resolve(api_key.as_deref());
+    Json(UsageResponse {
+        tier: tier.map(|(name, _)| name.to_string()),
+        max_concurrent_runs: tier.and_then(|(_, tier)| tier.max_concurrent_runs),
+        languages: tier.and_then(|(_, tier)| tier.languages.clone()),
+        usage: tenants().usage(policy.tenant(&tenant_id(api_key.as_deref()))),
+    })
+}
@@ -0,0 +1,96 @@
+use axum::{
+    Json,
+    extract::Path,
+    http::{HeaderMap, StatusCode},
+    response::{IntoResponse, Response},
+};
+
+use crate::config::config;
+use crate::infra::{
+    dispatch::{Assignment, Completion, Registration, WORKER_TOKEN_HEADER, worker_registry},
+    jobs::job_queue,
+    signing::constant_time_eq,
+};
+
+use super::{error::ApiError, extract::ValidJson};
+
+// The endpoints remote workers use to pull and report jobs. They are not
+// part of the public API and only answer requests carrying WORKER_TOKEN.
+async fn authorize(headers: &HeaderMap) -> Result<(), ApiError> {
+    let Some(token) = config().await.worker_token() else {
+        return Err(ApiError::NotFound(String::from(
+            "remote workers are disabled",
+        )));
+    };
+    let presented = headers
+        .get(WORKER_TOKEN_HEADER)
+        .map(|value| value.as_bytes())
+        .unwrap_or_default();
+    if constant_time_eq(presented, token.as_bytes()) {
+        Ok(())
+    } else {
+        Err(ApiError::Unauthorized(String::from("invalid worker token")))
+    }
+}
+
+fn unknown_worker(worker_id: &str) -> ApiError {
+    ApiError::NotFound(format!("worker {}", worker_id))
+}
+
+pub async fn register_worker(headers: HeaderMap) -> Result<Json<Registration>, ApiError> {
+    authorize(&headers).await?;
+    let worker_id = worker_registry().await.register();
+    Ok(Json(Registration { worker_id }))
+}
+
+pub async fn worker_heartbeat(
+    headers: HeaderMap,
+    Path(worker_id): Path<String>,
+) -> Result<StatusCode, ApiError> {
+    authorize(&headers).await?;
+    if !worker_registry().await.heartbeat(&worker_id) {
+        return Err(unknown_worker(&worker_id));
+    }
+    Ok(StatusCode::NO_CONTENT)
+}
+
+pub async fn claim_job(
+    headers: HeaderMap,
+    Path(worker_id): Path<String>,
+) -> Result<Response, ApiError> {
+    authorize(&headers).await?;
+    let registry = worker_registry().await;
+    if !registry.heartbeat(&worker_id) {
+        return Err(unknown_worker(&worker_id));
+    }
+    let queue = job_queue().await;
+    let Some((job_id, spec)) = queue.claim() else {
+        return Ok(StatusCode::NO_CONTENT.into_response());
+    };
+    if !registry.assign(&worker_id, &job_id) {
+        queue.requeue(&job_id);
+        return Err(unknown_worker(&worker_id));
+    }
+    Ok(Json(Assignment::new(&job_id, spec)).into_response())
+}
+
+pub async fn complete_job(
+    headers: HeaderMap,
+    Path((worker_id, job_id)): Path<(String, String)>,
+    ValidJson(completion): ValidJson<Completion>,
+) -> Result<StatusCode, ApiError> {
+    authorize(&headers).await?;
+    // A job taken away from a worker presumed dead belongs to another one
+    // now, so a late report from the first is dropped.
+    if !worker_registry().await.release(&worker_id, &job_id) {
+        return Err(ApiError::NotFound(format!(
+            "job {} is not assigned to worker {}",
+            job_id, worker_id
+        )));
+    }
+    let verdict = completion.verdict;
+    job_queue()
+        .await
+        .complete(&job_id, completion.into_result(), verdict);
+    Ok(StatusCode::NO_CONTENT)
+}
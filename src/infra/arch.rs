@@ -0,0 +1,141 @@
+use std::{
+    collections::BTreeMap,
+    path::{Path, PathBuf},
+    str::FromStr,
+};
+
+use super::language::Language;
+
+// The name an architecture goes by here, whichever of the common spellings
+// it was given in: Rust's and Linux's, or Go's and Docker's.
+fn normalize(arch: &str) -> String {
+    match arch.trim().to_ascii_lowercase().as_str() {
+        "amd64" | "x64" | "x86-64" => String::from("x86_64"),
+        "arm64" => String::from("aarch64"),
+        other => other.to_string(),
+    }
+}
+
+// The architecture this server and the programs it runs are built for,
+// such as `x86_64` or `aarch64`.
+pub fn host_arch() -> &'static str {
+    std::env::consts::ARCH
+}
+
+// Whether programs in `language` can run on this host at all. Assembly
+// programs are written for x86-64; everything else is portable or built
+// for the host.
+pub fn runs_here(language: Language) -> bool {
+    language != Language::ASSEMBLY || host_arch() == "x86_64"
+}
+
+// Where to find each language's toolchain when it is not on PATH, parsed
+// from a comma-separated list of `lang=dir` and `lang@arch=dir` entries.
+// An entry naming an architecture only applies on hosts of that
+// architecture and is preferred there, so one config can serve a mixed
+// fleet.
+#[derive(Debug, Clone, Default)]
+pub struct ToolchainDirs {
+    dirs: BTreeMap<String, Vec<(Option<String>, PathBuf)>>,
+}
+
+impl FromStr for ToolchainDirs {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut dirs: BTreeMap<String, Vec<(Option<String>, PathBuf)>> = BTreeMap::new();
+        for entry in s
+            .split(',')
+            .map(str::trim)
+            .filter(|entry| !entry.is_empty())
+        {
+            let Some((key, dir)) = entry.split_once('=') else {
+                return Err(format!(
+                    "invalid toolchain dir {:?}, expected lang=dir or lang@arch=dir",
+                    entry
+                ));
+            };
+            let (lang, arch) = match key.split_once('@') {
+                Some((lang, arch)) => (lang, Some(normalize(arch))),
+                None => (key, None),
+            };
+            let lang = lang.trim().to_lowercase();
+            let dir = dir.trim();
+            let listed = dirs.entry(lang.clone()).or_default();
+            if lang.is_empty()
+                || dir.is_empty()
+                || arch.as_deref() == Some("")
+                || listed.iter().any(|(other, _)| *other == arch)
+            {
+                return Err(format!("invalid or duplicate toolchain dir {:?}", entry));
+            }
+            listed.push((arch, PathBuf::from(dir)));
+        }
+        Ok(ToolchainDirs { dirs })
+    }
+}
+
+impl ToolchainDirs {
+    fn for_arch(&self, lang: &str, arch: &str) -> Option<&Path> {
+        let listed = self.dirs.get(&lang.to_lowercase())?;
+        let matching = |wanted: Option<&str>| {
+            listed
+                .iter()
+                .find(|(arch, _)| arch.as_deref() == wanted)
+                .map(|(_, dir)| dir.as_path())
+        };
+        matching(Some(arch)).or_else(|| matching(None))
+    }
+
+    // The directory to run `lang`'s toolchain from on this host, if one is
+    // configured.
+    pub fn for_lang(&self, lang: &str) -> Option<&Path> {
+        self.for_arch(lang, host_arch())
+    }
+}
+
+#[cfg(test)]
+mod arch_tests {
+    use super::*;
+
+    #[test]
+    fn test_toolchain_dirs_prefer_the_host_architecture() {
+        let dirs: ToolchainDirs = "python=/opt/py/bin, Python@arm64=/opt/py-arm/bin, \
+                                   go@amd64=/opt/go-amd/bin"
+            .parse()
+            .unwrap();
+        assert_eq!(
+            dirs.for_arch("python", "aarch64"),
+            Some(Path::new("/opt/py-arm/bin"))
+        );
+        assert_eq!(
+            dirs.for_arch("python", "x86_64"),
+            Some(Path::new("/opt/py/bin"))
+        );
+        assert_eq!(
+            dirs.for_arch("go", "x86_64"),
+            Some(Path::new("/opt/go-amd/bin"))
+        );
+        assert_eq!(dirs.for_arch("go", "aarch64"), None);
+        assert_eq!(dirs.for_arch("ruby", "x86_64"), None);
+    }
+
+    #[test]
+    fn test_toolchain_dirs_reject_malformed_entries() {
+        assert!("".parse::<ToolchainDirs>().unwrap().dirs.is_empty());
+        assert!("python".parse::<ToolchainDirs>().is_err());
+        assert!("python@=/opt/py".parse::<ToolchainDirs>().is_err());
+        assert!(
+            "go@arm64=/a,go@aarch64=/b"
+                .parse::<ToolchainDirs>()
+                .is_err()
+        );
+        assert!("go=/a,go=/b".parse::<ToolchainDirs>().is_err());
+    }
+
+    #[test]
+    fn test_only_assembly_is_tied_to_an_architecture() {
+        assert!(runs_here(Language::Python));
+        assert_eq!(runs_here(Language::ASSEMBLY), host_arch() == "x86_64");
+    }
+}
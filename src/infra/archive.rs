@@ -0,0 +1,172 @@
+use std::{
+    fs::{self, File},
+    io::{self, Cursor, Read},
+    path::{Component, Path, PathBuf},
+};
+
+use zip::ZipArchive;
+
+use super::error::InfraError;
+
+const S_IFMT: u32 = 0o170000;
+const S_IFLNK: u32 = 0o120000;
+
+#[derive(Debug, Clone, Copy)]
+pub struct ArchiveLimits {
+    pub max_entries: usize,
+    pub max_extracted_bytes: u64,
+}
+
+pub fn extract_zip(bytes: &[u8], dest: &Path, limits: ArchiveLimits) -> Result<(), InfraError> {
+    let mut archive = ZipArchive::new(Cursor::new(bytes))
+        .map_err(|err| InfraError::InvalidArchive(err.to_string()))?;
+    if archive.len() > limits.max_entries {
+        return Err(InfraError::ArchiveTooLarge(format!(
+            "archive has {} entries, limit is {}",
+            archive.len(),
+            limits.max_entries
+        )));
+    }
+
+    let mut remaining = limits.max_extracted_bytes;
+    for index in 0..archive.len() {
+        let mut entry = archive
+            .by_index(index)
+            .map_err(|err| InfraError::InvalidArchive(err.to_string()))?;
+        let Some(relative) = entry.enclosed_name() else {
+            return Err(InfraError::InvalidArchive(format!(
+                "entry escapes the archive root: {}",
+                entry.name()
+            )));
+        };
+        if entry
+            .unix_mode()
+            .is_some_and(|mode| mode & S_IFMT == S_IFLNK)
+        {
+            return Err(InfraError::InvalidArchive(format!(
+                "symlinks are not allowed: {}",
+                entry.name()
+            )));
+        }
+
+        let path = dest.join(relative);
+        if entry.is_dir() {
+            fs::create_dir_all(&path)?;
+            continue;
+        }
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent)?;
+        }
+
+        // The declared size is attacker controlled, so count what is
+        // actually inflated instead of trusting it.
+        let mut file = File::create(&path)?;
+        let written = io::copy(&mut (&mut entry).take(remaining + 1), &mut file)?;
+        if written > remaining {
+            return Err(InfraError::ArchiveTooLarge(format!(
+                "archive expands to more than {} bytes",
+                limits.max_extracted_bytes
+            )));
+        }
+        remaining -= written;
+    }
+
+    Ok(())
+}
+
+pub fn resolve_entrypoint(root: &Path, entrypoint: &str) -> Result<PathBuf, InfraError> {
+    let relative = Path::new(entrypoint);
+    let is_safe = relative
+        .components()
+        .all(|component| matches!(component, Component::Normal(_) | Component::CurDir));
+    if entrypoint.is_empty() || !is_safe {
+        return Err(InfraError::InvalidArchive(format!(
+            "invalid entrypoint: {}",
+            entrypoint
+        )));
+    }
+
+    let path = root.join(relative);
+    if !path.is_file() {
+        return Err(InfraError::InvalidArchive(format!(
+            "entrypoint not found in archive: {}",
+            entrypoint
+        )));
+    }
+    Ok(path)
+}
+
+#[cfg(test)]
+mod archive_tests {
+    use super::*;
+    use std::io::Write;
+    use tempfile::TempDir;
+    use zip::{ZipWriter, write::SimpleFileOptions};
+
+    const LIMITS: ArchiveLimits = ArchiveLimits {
+        max_entries: 16,
+        max_extracted_bytes: 1024,
+    };
+
+    fn zip_of(files: &[(&str, &[u8])]) -> Vec<u8> {
+        let mut writer = ZipWriter::new(Cursor::new(Vec::new()));
+        for (name, data) in files {
+            writer
+                .start_file(name.to_string(), SimpleFileOptions::default())
+                .unwrap();
+            writer.write_all(data).unwrap();
+        }
+        writer.finish().unwrap().into_inner()
+    }
+
+    #[test]
+    fn test_extract_zip_writes_nested_files() {
+        let dir = TempDir::new().unwrap();
+        let archive = zip_of(&[("main.py", b"import lib"), ("pkg/lib.py", b"x = 1")]);
+        extract_zip(&archive, dir.path(), LIMITS).unwrap();
+
+        assert_eq!(fs::read(dir.path().join("pkg/lib.py")).unwrap(), b"x = 1");
+        assert!(resolve_entrypoint(dir.path(), "main.py").is_ok());
+    }
+
+    #[test]
+    fn test_extract_zip_rejects_path_traversal() {
+        let dir = TempDir::new().unwrap();
+        let archive = zip_of(&[("../escape.txt", b"pwned")]);
+        let err = extract_zip(&archive, dir.path(), LIMITS).unwrap_err();
+
+        assert!(matches!(err, InfraError::InvalidArchive(_)));
+        assert!(!dir.path().parent().unwrap().join("escape.txt").exists());
+    }
+
+    #[test]
+    fn test_extract_zip_enforces_size_limit() {
+        let dir = TempDir::new().unwrap();
+        let big = vec![0u8; 2048];
+        let archive = zip_of(&[("big.bin", &big)]);
+        let err = extract_zip(&archive, dir.path(), LIMITS).unwrap_err();
+
+        assert!(matches!(err, InfraError::ArchiveTooLarge(_)));
+        assert!(err.to_string().contains("more than 1024 bytes"));
+    }
+
+    #[test]
+    fn test_extract_zip_rejects_symlinks() {
+        let dir = TempDir::new().unwrap();
+        let mut writer = ZipWriter::new(Cursor::new(Vec::new()));
+        writer
+            .add_symlink("link", "/etc/passwd", SimpleFileOptions::default())
+            .unwrap();
+        let archive = writer.finish().unwrap().into_inner();
+
+        assert!(extract_zip(&archive, dir.path(), LIMITS).is_err());
+    }
+
+    #[test]
+    fn test_resolve_entrypoint_rejects_escapes() {
+        let dir = TempDir::new().unwrap();
+        assert!(resolve_entrypoint(dir.path(), "../main.py").is_err());
+        assert!(resolve_entrypoint(dir.path(), "/etc/passwd").is_err());
+        assert!(resolve_entrypoint(dir.path(), "missing.py").is_err());
+    }
+}
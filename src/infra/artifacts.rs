@@ -0,0 +1,128 @@
+use std::{
+    fs, io,
+    path::{Path, PathBuf},
+    sync::OnceLock,
+    time::Duration,
+};
+
+use uuid::Uuid;
+
+use super::disk::collect_garbage;
+
+// A file kept for download: a build, or a file a program wrote.
+#[derive(Debug)]
+pub struct Artifact {
+    pub file_name: String,
+    pub bytes: Vec<u8>,
+}
+
+static ARTIFACT_DIR: OnceLock<PathBuf> = OnceLock::new();
+
+// Kept builds, each in a directory named by its id. They live outside the
+// execution zone, whose garbage collection knows nothing of their TTL.
+pub fn artifact_dir() -> &'static Path {
+    ARTIFACT_DIR.get_or_init(|| {
+        let dir = std::env::temp_dir().join("comphub-artifacts");
+        if let Err(err) = fs::create_dir_all(&dir) {
+            tracing::error!("failed to create artifact directory {:?}: {}", dir, err);
+        }
+        dir
+    })
+}
+
+// Keeps `artifact` for a later download, returning the id it is kept under.
+pub fn keep(artifact: &Artifact) -> io::Result<String> {
+    let id = Uuid::new_v4().simple().to_string();
+    let dir = artifact_dir().join(&id);
+    fs::create_dir_all(&dir)?;
+    fs::write(dir.join(&artifact.file_name), &artifact.bytes)?;
+    Ok(id)
+}
+
+// Where the artifact kept under `id` is downloaded from.
+pub fn url(id: &str) -> String {
+    format!("/api/v1/artifacts/{}", id)
+}
+
+// Ids are generated here, so anything else names no artifact, least of all
+// a path outside the directory.
+fn is_id(id: &str) -> bool {
+    id.len() == 32 && id.bytes().all(|byte| byte.is_ascii_hexdigit())
+}
+
+// The artifact kept under `id`, unless there is none or it is older than
+// `ttl` and only waiting to be swept.
+pub fn load(id: &str, ttl: Duration) -> io::Result<Option<Artifact>> {
+    if !is_id(id) {
+        return Ok(None);
+    }
+    let mut entries = match fs::read_dir(artifact_dir().join(id)) {
+        Ok(entries) => entries,
+        Err(err) if err.kind() == io::ErrorKind::NotFound => return Ok(None),
+        Err(err) => return Err(err),
+    };
+    let Some(entry) = entries.next().transpose()? else {
+        return Ok(None);
+    };
+    let age = entry.metadata()?.modified()?.elapsed().unwrap_or_default();
+    if age >= ttl {
+        return Ok(None);
+    }
+    Ok(Some(Artifact {
+        file_name: entry.file_name().to_string_lossy().into_owned(),
+        bytes: fs::read(entry.path())?,
+    }))
+}
+
+// Removes artifacts once they are older than `ttl`, checking every
+// `interval`.
+pub async fn sweep_artifacts(ttl: Duration, interval: Duration) {
+    let mut ticker = tokio::time::interval(interval);
+    loop {
+        ticker.tick().await;
+        match tokio::task::spawn_blocking(move || collect_garbage(artifact_dir(), ttl)).await {
+            Ok(Ok(0)) => {}
+            Ok(Ok(removed)) => tracing::debug!("removed {} expired artifacts", removed),
+            Ok(Err(err)) => tracing::warn!("artifact sweep failed: {}", err),
+            Err(err) => tracing::warn!("artifact sweep task panicked: {}", err),
+        }
+    }
+}
+
+#[cfg(test)]
+mod artifacts_tests {
+    use super::*;
+
+    fn artifact() -> Artifact {
+        Artifact {
+            file_name: String::from("main.exe"),
+            bytes: b"MZ".to_vec(),
+        }
+    }
+
+    #[test]
+    fn test_load_returns_what_was_kept() {
+        let id = keep(&artifact()).unwrap();
+        let loaded = load(&id, Duration::from_secs(60)).unwrap().unwrap();
+        assert_eq!(loaded.file_name, "main.exe");
+        assert_eq!(loaded.bytes, b"MZ");
+    }
+
+    #[test]
+    fn test_load_treats_expired_artifacts_as_gone() {
+        let id = keep(&artifact()).unwrap();
+        assert!(load(&id, Duration::ZERO).unwrap().is_none());
+    }
+
+    #[test]
+    fn test_load_ignores_unknown_and_malformed_ids() {
+        let ttl = Duration::from_secs(60);
+        assert!(
+            load(&Uuid::new_v4().simple().to_string(), ttl)
+                .unwrap()
+                .is_none()
+        );
+        assert!(load("../../etc", ttl).unwrap().is_none());
+        assert!(load("", ttl).unwrap().is_none());
+    }
+}
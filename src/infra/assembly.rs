@@ -0,0 +1,169 @@
+use super::{
+    arch::runs_here,
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, limit_strictly, prepare, run_compiler, spawn_piped, supervise},
+    source::SourceFile,
+};
+use tokio::process::Command;
+
+// Beyond stdin, stdout and stderr, an exercise has no use for files.
+const MAX_OPEN_FILES: u64 = 8;
+
+// Assembles and links a freestanding Linux x86-64 program whose entry point
+// is `_start`; nothing else is linked in, so it talks to the kernel
+// directly.
+pub async fn compile_assembly(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    if !runs_here(Language::ASSEMBLY) {
+        return Err(InfraError::UnsupportedLanguage(String::from(
+            "assembly programs are x86-64 and this host is not",
+        )));
+    }
+    let source = SourceFile::create(Language::ASSEMBLY, content)?;
+    let source_path = source.path().to_path_buf();
+    let object_path = source.dir().join("main.o");
+    let executable_path = source.dir().join("main");
+
+    let mut assemble = ctx.command("nasm")?;
+    assemble
+        .args(["-f", "elf64", "-o"])
+        .arg(&object_path)
+        .arg(&source_path);
+    let assembled = run_compiler(&mut assemble, ctx).await?;
+    if !assembled.status.success() {
+        let stderr = String::from_utf8_lossy(&assembled.stderr);
+        return Err(InfraError::CompileError(format!(
+            "Assembly failed:\n{}",
+            stderr
+        )));
+    }
+    ctx.record_warnings(&assembled.stderr);
+
+    let mut link = ctx.command("ld")?;
+    link.arg("-o").arg(&executable_path).arg(&object_path);
+    let linked = run_compiler(&mut link, ctx).await?;
+    if !linked.status.success() {
+        let stderr = String::from_utf8_lossy(&linked.stderr);
+        return Err(InfraError::CompileError(format!(
+            "Linking failed:\n{}",
+            stderr
+        )));
+    }
+    ctx.record_warnings(&linked.stderr);
+
+    let mut cmd = Command::new(&executable_path);
+    let profile = prepare(&mut cmd, ctx)?;
+    limit_strictly(&mut cmd, ctx, MAX_OPEN_FILES);
+    let child = spawn_piped(&mut cmd)?;
+    let output = supervise(child, stdin_input, ctx, profile).await?;
+    match output.status.code() {
+        Some(0) => Ok(String::from_utf8(output.stdout)?),
+        Some(code) => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!(
+                    "Assembly program execution failed with status code: {}\nError: {}",
+                    code, stderr
+                )
+                .into(),
+            ))
+        }
+        None => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!("Assembly program terminated by signal\nError: {}", stderr).into(),
+            ))
+        }
+    }
+}
+
+#[cfg(test)]
+mod assembly_tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_simple_hello_world() {
+        let result =
+            compile_assembly(Language::ASSEMBLY.template(), "", &ExecContext::default()).await;
+        assert_eq!(result.unwrap(), "Hello, World!\n");
+    }
+
+    #[tokio::test]
+    async fn test_echoes_stdin() {
+        let asm_code = r#"
+section .bss
+    buf resb 64
+
+section .text
+    global _start
+
+_start:
+    mov rax, 0
+    mov rdi, 0
+    mov rsi, buf
+    mov rdx, 64
+    syscall
+
+    mov rdx, rax
+    mov rax, 1
+    mov rdi, 1
+    mov rsi, buf
+    syscall
+
+    mov rax, 60
+    xor rdi, rdi
+    syscall
+"#;
+
+        let result = compile_assembly(asm_code, "echo\n", &ExecContext::default()).await;
+        assert_eq!(result.unwrap(), "echo\n");
+    }
+
+    #[tokio::test]
+    async fn test_exit_status_is_reported() {
+        let asm_code = r#"
+section .text
+    global _start
+
+_start:
+    mov rax, 60
+    mov rdi, 3
+    syscall
+"#;
+
+        let result = compile_assembly(asm_code, "", &ExecContext::default()).await;
+        assert!(result.unwrap_err().to_string().contains("status code: 3"));
+    }
+
+    #[tokio::test]
+    async fn test_assembly_error() {
+        let asm_code = r#"
+section .text
+    global _start
+
+_start:
+    mov rax, rbx, rcx
+"#;
+
+        let result = compile_assembly(asm_code, "", &ExecContext::default()).await;
+        assert!(matches!(result, Err(InfraError::CompileError(_))));
+    }
+
+    #[tokio::test]
+    async fn test_missing_entry_point_is_a_link_error() {
+        let asm_code = r#"
+section .text
+    global main
+
+main:
+    ret
+"#;
+
+        let result = compile_assembly(asm_code, "", &ExecContext::default()).await;
+        assert!(matches!(result, Err(InfraError::CompileError(_))));
+    }
+}
@@ -0,0 +1,248 @@
+use std::{
+    fs::{self, File, OpenOptions},
+    io::{self, Write},
+    path::{Path, PathBuf},
+    sync::Mutex,
+};
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use tokio::sync::OnceCell;
+use utoipa::{IntoParams, ToSchema};
+
+use super::{error::InfraError, events::Submitter, hooks::AppliedHook, logs::RunStatus};
+use crate::config::config;
+
+const DEFAULT_AUDIT_LIMIT: usize = 100;
+const MAX_AUDIT_LIMIT: usize = 10_000;
+
+// Who ran what, and how it ended. The code itself is only recorded as a
+// hash, which is enough to tell whether a given program was run.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize, ToSchema)]
+pub struct AuditEntry {
+    pub id: String,
+    #[schema(example = "python")]
+    pub lang: String,
+    /// Hex-encoded SHA-256 of the submitted code
+    pub code_hash: String,
+    /// Source hooks the code went through before it was compiled, in order
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub hooks: Vec<AppliedHook>,
+    pub status: RunStatus,
+    pub submitter: Submitter,
+    pub started_at: DateTime<Utc>,
+    pub finished_at: DateTime<Utc>,
+}
+
+impl AuditEntry {
+    pub fn new(
+        id: &str,
+        lang: &str,
+        content: &str,
+        hooks: Vec<AppliedHook>,
+        submitter: &Submitter,
+        started_at: DateTime<Utc>,
+        result: &Result<String, InfraError>,
+    ) -> Self {
+        AuditEntry {
+            id: id.to_string(),
+            lang: lang.to_lowercase(),
+            code_hash: format!("{:x}", Sha256::digest(content.as_bytes())),
+            hooks,
+            status: RunStatus::of(result),
+            submitter: submitter.clone(),
+            started_at,
+            finished_at: Utc::now(),
+        }
+    }
+}
+
+#[derive(Debug, Default, Deserialize, IntoParams)]
+#[into_params(parameter_in = Query)]
+pub struct AuditQuery {
+    /// Only runs of this tenant: the SHA-256 of its API key, or `anonymous`
+    pub tenant: Option<String>,
+    pub client_ip: Option<String>,
+    pub language: Option<String>,
+    pub code_hash: Option<String>,
+    pub status: Option<RunStatus>,
+    /// Only runs started at or after this time (RFC 3339)
+    pub since: Option<DateTime<Utc>>,
+    /// Only runs started before this time (RFC 3339)
+    pub until: Option<DateTime<Utc>>,
+    pub limit: Option<usize>,
+}
+
+impl AuditQuery {
+    fn matches(&self, entry: &AuditEntry) -> bool {
+        self.tenant
+            .as_ref()
+            .is_none_or(|tenant| entry.submitter.tenant() == tenant)
+            && self
+                .client_ip
+                .as_ref()
+                .is_none_or(|ip| entry.submitter.client_ip.as_ref() == Some(ip))
+            && self
+                .language
+                .as_ref()
+                .is_none_or(|language| entry.lang.eq_ignore_ascii_case(language))
+            && self
+                .code_hash
+                .as_ref()
+                .is_none_or(|hash| entry.code_hash.eq_ignore_ascii_case(hash))
+            && self.status.is_none_or(|status| entry.status == status)
+            && self.since.is_none_or(|since| entry.started_at >= since)
+            && self.until.is_none_or(|until| entry.started_at < until)
+    }
+
+    fn limit(&self) -> usize {
+        self.limit
+            .unwrap_or(DEFAULT_AUDIT_LIMIT)
+            .min(MAX_AUDIT_LIMIT)
+    }
+}
+
+// An append-only file of JSON lines, one per finished run. Nothing in the
+// server rewrites or trims it; rotating it is left to the operator.
+pub struct AuditTrail {
+    path: PathBuf,
+    file: Mutex<File>,
+}
+
+impl AuditTrail {
+    // A line left unfinished by a crash is ended, so the next entry starts
+    // on a line of its own.
+    pub fn open(path: &Path) -> io::Result<Self> {
+        let torn = fs::read(path).is_ok_and(|text| text.last().is_some_and(|last| *last != b'\n'));
+        let mut file = OpenOptions::new().create(true).append(true).open(path)?;
+        if torn {
+            file.write_all(b"\n")?;
+        }
+        Ok(AuditTrail {
+            path: path.to_path_buf(),
+            file: Mutex::new(file),
+        })
+    }
+
+    pub fn append(&self, entry: &AuditEntry) -> io::Result<()> {
+        let mut line = serde_json::to_vec(entry)?;
+        line.push(b'\n');
+        // One write per entry, so concurrent runs never interleave lines.
+        self.file.lock().unwrap().write_all(&line)
+    }
+
+    // Returns matching runs, newest first. Lines cut short by a crash are
+    // skipped.
+    pub fn search(&self, query: &AuditQuery) -> io::Result<Vec<AuditEntry>> {
+        let text = fs::read_to_string(&self.path)?;
+        Ok(text
+            .lines()
+            .rev()
+            .filter_map(|line| serde_json::from_str::<AuditEntry>(line).ok())
+            .filter(|entry| query.matches(entry))
+            .take(query.limit())
+            .collect())
+    }
+}
+
+static AUDIT_TRAIL: OnceCell<Option<AuditTrail>> = OnceCell::const_new();
+
+// The audit trail, when the server is configured to keep one.
+pub async fn audit_trail() -> Option<&'static AuditTrail> {
+    AUDIT_TRAIL
+        .get_or_init(|| async {
+            let path = config().await.audit_log_file()?;
+            tracing::info!("appending the audit log to {}", path.display());
+            Some(AuditTrail::open(path).unwrap())
+        })
+        .await
+        .as_ref()
+}
+
+pub async fn record_audit(
+    id: &str,
+    lang: &str,
+    content: &str,
+    hooks: Vec<AppliedHook>,
+    submitter: &Submitter,
+    started_at: DateTime<Utc>,
+    result: &Result<String, InfraError>,
+) {
+    let Some(trail) = audit_trail().await else {
+        return;
+    };
+    let entry = AuditEntry::new(id, lang, content, hooks, submitter, started_at, result);
+    if let Err(err) = trail.append(&entry) {
+        tracing::error!("failed to audit run {}: {}", id, err);
+    }
+}
+
+#[cfg(test)]
+mod audit_tests {
+    use super::*;
+
+    fn entry(id: &str, api_key: Option<&str>, lang: &str, failed: bool) -> AuditEntry {
+        let result = if failed {
+            Err(InfraError::CompilationError("boom".into()))
+        } else {
+            Ok(String::new())
+        };
+        let submitter = Submitter::new(api_key, "10.0.0.1");
+        AuditEntry::new(id, lang, id, Vec::new(), &submitter, Utc::now(), &result)
+    }
+
+    fn ids(entries: Vec<AuditEntry>) -> Vec<String> {
+        entries.into_iter().map(|entry| entry.id).collect()
+    }
+
+    #[test]
+    fn test_appends_and_searches_newest_first() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("audit.jsonl");
+        let trail = AuditTrail::open(&path).unwrap();
+        trail
+            .append(&entry("a", Some("key"), "Python", false))
+            .unwrap();
+        trail.append(&entry("b", None, "go", true)).unwrap();
+        trail
+            .append(&entry("c", Some("key"), "python", true))
+            .unwrap();
+
+        assert_eq!(
+            ids(trail.search(&AuditQuery::default()).unwrap()),
+            ["c", "b", "a"]
+        );
+        let tenant = entry("x", Some("key"), "python", false)
+            .submitter
+            .tenant()
+            .to_string();
+        let query = AuditQuery {
+            tenant: Some(tenant),
+            ..AuditQuery::default()
+        };
+        assert_eq!(ids(trail.search(&query).unwrap()), ["c", "a"]);
+        let query = AuditQuery {
+            language: Some("python".into()),
+            status: Some(RunStatus::Failed),
+            ..AuditQuery::default()
+        };
+        assert_eq!(ids(trail.search(&query).unwrap()), ["c"]);
+        let query = AuditQuery {
+            code_hash: Some(entry("b", None, "go", true).code_hash),
+            limit: Some(1),
+            ..AuditQuery::default()
+        };
+        assert_eq!(ids(trail.search(&query).unwrap()), ["b"]);
+
+        // Reopening appends to what is there, and a torn line is skipped.
+        drop(trail);
+        fs::write(&path, fs::read_to_string(&path).unwrap() + "{\"id\":").unwrap();
+        let trail = AuditTrail::open(&path).unwrap();
+        trail.append(&entry("d", None, "go", false)).unwrap();
+        assert_eq!(
+            ids(trail.search(&AuditQuery::default()).unwrap()),
+            ["d", "c", "b", "a"]
+        );
+    }
+}
@@ -0,0 +1,120 @@
+use crate::config::config;
+
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, limit_strictly, prepare, spawn_piped, supervise},
+    source::SourceFile,
+};
+
+// A shell can reach anything installed on the host, so scripts run under
+// tighter limits than other programs: few open files and, when they run as
+// the sandbox user, few processes.
+const MAX_OPEN_FILES: u64 = 64;
+
+pub async fn compile_bash(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    if !config().await.bash_enabled() {
+        return Err(InfraError::UnsupportedLanguage(String::from(
+            "bash is disabled on this instance; set BASH_ENABLED=true to allow it",
+        )));
+    }
+    run_bash(content, stdin_input, ctx).await
+}
+
+// Runs the script in restricted mode, which stops it from changing
+// directory or PATH, running commands by path and redirecting output to
+// files.
+async fn run_bash(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::BASH, content)?;
+    let source_path = source.path().to_path_buf();
+
+    let mut cmd = ctx.command("bash")?;
+    cmd.args(["--restricted", "--noprofile", "--norc"])
+        .arg(source_path);
+    // Limits are set after `prepare`, which may rewrite the command to start
+    // through the seccomp launcher; they carry over when it execs bash.
+    let profile = prepare(&mut cmd, ctx)?;
+    limit_strictly(&mut cmd, ctx, MAX_OPEN_FILES);
+    let child = spawn_piped(&mut cmd)?;
+    let output = supervise(child, stdin_input, ctx, profile).await?;
+    match output.status.code() {
+        Some(0) => Ok(String::from_utf8(output.stdout)?),
+        Some(code) => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!(
+                    "Bash program execution failed with status code: {}\nError: {}",
+                    code, stderr
+                )
+                .into(),
+            ))
+        }
+        None => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!("Bash program terminated by signal\nError: {}", stderr).into(),
+            ))
+        }
+    }
+}
+
+#[cfg(test)]
+mod bash_tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_simple_hello_world() {
+        let result = run_bash("echo \"Hello, World!\"\n", "", &ExecContext::default()).await;
+        assert_eq!(result.unwrap(), "Hello, World!\n");
+    }
+
+    #[tokio::test]
+    async fn test_stdin_input() {
+        let bash_code = r#"
+read -r name
+echo "Hello, $name!"
+"#;
+
+        let result = run_bash(bash_code, "Alice\n", &ExecContext::default()).await;
+        assert_eq!(result.unwrap().trim(), "Hello, Alice!");
+    }
+
+    #[tokio::test]
+    async fn test_args_are_positional_parameters() {
+        let ctx = ExecContext::default().with_args(vec![String::from("one"), String::from("two")]);
+        let result = run_bash("echo \"$# $2\"\n", "", &ctx).await;
+        assert_eq!(result.unwrap().trim(), "2 two");
+    }
+
+    #[tokio::test]
+    async fn test_runtime_error() {
+        let result = run_bash("exit 3\n", "", &ExecContext::default()).await;
+        assert!(result.unwrap_err().to_string().contains("status code: 3"));
+    }
+
+    #[tokio::test]
+    async fn test_restricted_mode_blocks_redirecting_to_files() {
+        let result = run_bash("echo hi > out.txt\n", "", &ExecContext::default()).await;
+        assert!(result.unwrap_err().to_string().contains("restricted"));
+    }
+
+    #[tokio::test]
+    async fn test_restricted_mode_blocks_commands_by_path() {
+        let result = run_bash("/bin/echo hi\n", "", &ExecContext::default()).await;
+        assert!(result.unwrap_err().to_string().contains("restricted"));
+    }
+
+    #[tokio::test]
+    async fn test_open_files_are_limited() {
+        let result = run_bash("ulimit -n\n", "", &ExecContext::default()).await;
+        assert_eq!(result.unwrap().trim(), MAX_OPEN_FILES.to_string());
+    }
+}
@@ -0,0 +1,239 @@
+use std::{
+    collections::{BTreeMap, HashMap},
+    fs, io,
+    path::{Path, PathBuf},
+    sync::Mutex,
+};
+
+use sha2::{Digest, Sha256};
+use tokio::sync::OnceCell;
+use uuid::Uuid;
+
+use crate::config::config;
+
+struct Entry {
+    size: u64,
+    used: u64,
+}
+
+// Which blobs are on disk and how recently each was used. `order` maps the
+// use counter to the blob, so the least recently used comes first.
+#[derive(Default)]
+struct Index {
+    entries: HashMap<String, Entry>,
+    order: BTreeMap<u64, String>,
+    clock: u64,
+    total: u64,
+}
+
+impl Index {
+    fn touch(&mut self, hash: &str) {
+        self.clock += 1;
+        if let Some(entry) = self.entries.get_mut(hash) {
+            self.order.remove(&entry.used);
+            entry.used = self.clock;
+            self.order.insert(self.clock, hash.to_string());
+        }
+    }
+
+    fn insert(&mut self, hash: &str, size: u64) {
+        if self.entries.contains_key(hash) {
+            self.touch(hash);
+            return;
+        }
+        self.clock += 1;
+        let entry = Entry {
+            size,
+            used: self.clock,
+        };
+        self.entries.insert(hash.to_string(), entry);
+        self.order.insert(self.clock, hash.to_string());
+        self.total += size;
+    }
+
+    fn remove(&mut self, hash: &str) {
+        if let Some(entry) = self.entries.remove(hash) {
+            self.order.remove(&entry.used);
+            self.total -= entry.size;
+        }
+    }
+
+    // The least recently used blob, unless it is `keep`.
+    fn oldest(&self, keep: &str) -> Option<String> {
+        self.order.values().find(|hash| *hash != keep).cloned()
+    }
+}
+
+// Test inputs and expected outputs uploaded once and referred to by the
+// hex SHA-256 of their contents. Blobs are files named by their hash; once
+// together they pass `max_bytes`, the least recently used are evicted, and
+// a client finding one gone uploads it again.
+pub struct BlobStore {
+    dir: PathBuf,
+    max_bytes: u64,
+    index: Mutex<Index>,
+}
+
+static BLOB_STORE: OnceCell<BlobStore> = OnceCell::const_new();
+
+async fn init_blob_store() -> BlobStore {
+    let app_config = config().await;
+    let dir = app_config.blob_dir();
+    let blobs = BlobStore::open(dir, app_config.blob_max_bytes()).unwrap();
+    tracing::info!("opened blob store at {}", dir.display());
+    blobs
+}
+
+pub async fn blob_store() -> &'static BlobStore {
+    BLOB_STORE.get_or_init(init_blob_store).await
+}
+
+// Hashes are generated here, so anything else names no blob, least of all a
+// path outside the directory.
+pub fn is_hash(hash: &str) -> bool {
+    hash.len() == 64
+        && hash
+            .bytes()
+            .all(|byte| byte.is_ascii_digit() || (b'a'..=b'f').contains(&byte))
+}
+
+impl BlobStore {
+    // Opens the store at `dir`, picking up the blobs already there. They
+    // count as used in the order they were last written.
+    pub fn open(dir: &Path, max_bytes: u64) -> io::Result<Self> {
+        fs::create_dir_all(dir)?;
+        let mut found = Vec::new();
+        for entry in fs::read_dir(dir)? {
+            let entry = entry?;
+            let name = entry.file_name().to_string_lossy().into_owned();
+            if !is_hash(&name) {
+                continue;
+            }
+            let metadata = entry.metadata()?;
+            found.push((metadata.modified()?, name, metadata.len()));
+        }
+        found.sort();
+        let mut index = Index::default();
+        for (_, hash, size) in found {
+            index.insert(&hash, size);
+        }
+        let blobs = BlobStore {
+            dir: dir.to_path_buf(),
+            max_bytes,
+            index: Mutex::new(index),
+        };
+        blobs.evict("");
+        Ok(blobs)
+    }
+
+    fn path(&self, hash: &str) -> PathBuf {
+        self.dir.join(hash)
+    }
+
+    // Keeps `bytes`, returning their hash. Blobs are written aside and moved
+    // into place, so a reader never sees half of one.
+    pub fn put(&self, bytes: &[u8]) -> io::Result<String> {
+        let hash = format!("{:x}", Sha256::digest(bytes));
+        let path = self.path(&hash);
+        if !path.exists() {
+            let partial = self.dir.join(format!(".{}", Uuid::new_v4().simple()));
+            fs::write(&partial, bytes)?;
+            if let Err(err) = fs::rename(&partial, &path) {
+                let _ = fs::remove_file(&partial);
+                return Err(err);
+            }
+        }
+        self.index
+            .lock()
+            .unwrap()
+            .insert(&hash, bytes.len() as u64);
+        self.evict(&hash);
+        Ok(hash)
+    }
+
+    // The blob with this hash, unless there is none or it was evicted.
+    pub fn get(&self, hash: &str) -> io::Result<Option<Vec<u8>>> {
+        if !is_hash(hash) {
+            return Ok(None);
+        }
+        match fs::read(self.path(hash)) {
+            Ok(bytes) => {
+                self.index.lock().unwrap().touch(hash);
+                Ok(Some(bytes))
+            }
+            Err(err) if err.kind() == io::ErrorKind::NotFound => {
+                self.index.lock().unwrap().remove(hash);
+                Ok(None)
+            }
+            Err(err) => Err(err),
+        }
+    }
+
+    // Removes the least recently used blobs but `keep` until the rest fit.
+    fn evict(&self, keep: &str) {
+        let mut index = self.index.lock().unwrap();
+        while index.total > self.max_bytes {
+            let Some(hash) = index.oldest(keep) else {
+                return;
+            };
+            if let Err(err) = fs::remove_file(self.path(&hash)) {
+                if err.kind() != io::ErrorKind::NotFound {
+                    tracing::warn!("failed to evict blob {}: {}", hash, err);
+                    return;
+                }
+            }
+            index.remove(&hash);
+        }
+    }
+}
+
+#[cfg(test)]
+mod blobs_tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_put_returns_the_hash_blobs_are_fetched_by() {
+        let dir = TempDir::new().unwrap();
+        let blobs = BlobStore::open(dir.path(), 1024).unwrap();
+        let hash = blobs.put(b"print(1)").unwrap();
+        assert_eq!(
+            hash,
+            "d287bb7f9d15abdc5b6e98536263815744b6ef21c8f3c839fc434ca70d8efe99"
+        );
+        assert_eq!(blobs.put(b"print(1)").unwrap(), hash);
+        assert_eq!(blobs.get(&hash).unwrap().as_deref(), Some(&b"print(1)"[..]));
+        assert_eq!(blobs.get(&"0".repeat(64)).unwrap(), None);
+        assert_eq!(blobs.get("../etc/passwd").unwrap(), None);
+    }
+
+    #[test]
+    fn test_least_recently_used_blobs_are_evicted() {
+        let dir = TempDir::new().unwrap();
+        let blobs = BlobStore::open(dir.path(), 10).unwrap();
+        let a = blobs.put(b"aaaa").unwrap();
+        let b = blobs.put(b"bbbb").unwrap();
+        blobs.get(&a).unwrap();
+        let c = blobs.put(b"cccc").unwrap();
+        assert!(blobs.get(&a).unwrap().is_some());
+        assert!(blobs.get(&b).unwrap().is_none());
+        assert!(blobs.get(&c).unwrap().is_some());
+
+        // A blob larger than the store is still kept until the next one.
+        let large = blobs.put(&[b'x'; 16]).unwrap();
+        assert!(blobs.get(&large).unwrap().is_some());
+        assert!(blobs.get(&a).unwrap().is_none());
+    }
+
+    #[test]
+    fn test_reopening_finds_the_blobs_already_there() {
+        let dir = TempDir::new().unwrap();
+        let hash = BlobStore::open(dir.path(), 1024)
+            .unwrap()
+            .put(b"input")
+            .unwrap();
+        let blobs = BlobStore::open(dir.path(), 1024).unwrap();
+        assert_eq!(blobs.get(&hash).unwrap().as_deref(), Some(&b"input"[..]));
+        assert_eq!(blobs.index.lock().unwrap().total, 5);
+    }
+}
@@ -1,21 +1,26 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
-
-pub async fn compile_brainfuck(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".bf")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
-
-    let source_path = temp_file.path().to_path_buf();
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+};
+use tokio::process::Command;
+
+pub async fn compile_brainfuck(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::BRAINFUCK, content)?;
+    let source_path = source.path().to_path_buf();
     let source_stem = source_path.file_stem().unwrap().to_string_lossy();
     
-    let executable_path = std::env::current_dir()?.join(&*source_stem);
+    let executable_path = source.dir().join(&*source_stem);
 
-    let compile_output = Command::new(which("bfc")?)
+    let compile_output = ctx.command("bfc")?
         .arg(&source_path)
+        .current_dir(source.dir())
+        .kill_on_drop(true)
         .output()
         .await?;
 
@@ -27,24 +32,9 @@ pub async fn compile_brainfuck(content: &str, stdin_input: &str) -> Result<Strin
         ));
     }
 
-    let mut cmd = Command::new(&executable_path)
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
+    let mut cmd = Command::new(&executable_path);
+    let output = run_program(&mut cmd, stdin_input, ctx).await?;
 
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
-
-    let output = cmd.wait_with_output().await?;
-    
-    if executable_path.exists() {
-        std::fs::remove_file(&executable_path).ok();
-    }
-    
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
         Some(code) => {
@@ -79,7 +69,7 @@ mod brainfuck_tests {
 ------.--------.>+.>.
 "#;
 
-        let result = compile_brainfuck(bf_code, "").await;
+        let result = compile_brainfuck(bf_code, "", &ExecContext::default()).await;
         println!("{:?}", result);
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello World!");
@@ -90,7 +80,7 @@ mod brainfuck_tests {
         // Output the character 'A' (ASCII 65)
         let bf_code = "++++++++[>++++++++<-]>+.";
 
-        let result = compile_brainfuck(bf_code, "").await;
+        let result = compile_brainfuck(bf_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "A");
     }
@@ -100,7 +90,7 @@ mod brainfuck_tests {
         // Read one character and echo it back
         let bf_code = ",.";
 
-        let result = compile_brainfuck(bf_code, "X").await;
+        let result = compile_brainfuck(bf_code, "X", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "X");
     }
@@ -113,7 +103,7 @@ mod brainfuck_tests {
 ,>,,<[->+<]>.
 "#;
 
-        let result = compile_brainfuck(bf_code, "23").await;
+        let result = compile_brainfuck(bf_code, "23", &ExecContext::default()).await;
         assert!(result.is_ok());
         // The output will be the ASCII character for 5 (sum of 2+3)
     }
@@ -122,7 +112,7 @@ mod brainfuck_tests {
     async fn test_empty_program() {
         let bf_code = "";
 
-        let result = compile_brainfuck(bf_code, "").await;
+        let result = compile_brainfuck(bf_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
@@ -136,7 +126,7 @@ This is a comment
 More comments here
 "#;
 
-        let result = compile_brainfuck(bf_code, "").await;
+        let result = compile_brainfuck(bf_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "A");
     }
@@ -146,7 +136,7 @@ More comments here
         // Test nested loop structure
         let bf_code = "+++[>+++[>++<-]<-]>>.";
 
-        let result = compile_brainfuck(bf_code, "").await;
+        let result = compile_brainfuck(bf_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         // This should output a character (ASCII 18)
     }
@@ -158,7 +148,7 @@ More comments here
 ++++++++[>++++[>++>+++>+++>+<<<<-]>+>+>->>+[<]<-]>>.>---.+++++++..+++.>>.<-.<.+++.------.--------.>>+.>++.
 "#;
 
-        let result = compile_brainfuck(bf_code, "").await;
+        let result = compile_brainfuck(bf_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         // Should output "Hello World!" or similar
     }
@@ -168,7 +158,7 @@ More comments here
         // Read input and modify it before output
         let bf_code = ",+."; // Read char, increment by 1, output
 
-        let result = compile_brainfuck(bf_code, "A").await;
+        let result = compile_brainfuck(bf_code, "A", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "B"); // A + 1 = B
     }
@@ -178,7 +168,7 @@ More comments here
         // Test with unmatched brackets - this might be caught by bfc
         let bf_code = "[+";
 
-        let result = compile_brainfuck(bf_code, "").await;
+        let result = compile_brainfuck(bf_code, "", &ExecContext::default()).await;
         // This should either fail at compile time or runtime
         // The exact behavior depends on the bfc implementation
     }
@@ -188,7 +178,7 @@ More comments here
         // Test handling of zero bytes in memory
         let bf_code = "+[-]>++."; // Set cell to 1, clear it, move right, set to 2, output
 
-        let result = compile_brainfuck(bf_code, "").await;
+        let result = compile_brainfuck(bf_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         // Should output ASCII character 2
     }
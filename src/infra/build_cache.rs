@@ -0,0 +1,728 @@
+use std::{fmt, fs, io, os::unix::fs::PermissionsExt, path::Path, str::FromStr, time::Duration};
+
+use chrono::{DateTime, Utc};
+use futures_util::future::BoxFuture;
+use reqwest::{StatusCode, Url};
+use sha2::{Digest, Sha256};
+use tokio::{
+    io::{AsyncBufRead, AsyncBufReadExt, AsyncReadExt, AsyncWriteExt, BufStream},
+    net::TcpStream,
+    sync::{Mutex, OnceCell},
+};
+
+use super::{
+    catalog::builtin_version,
+    error::InfraError,
+    language::Language,
+    runner::ExecContext,
+    signing::{hmac_sha256, to_hex},
+};
+use crate::config::config;
+
+const REDIS_DEFAULT_PORT: u16 = 6379;
+const S3_DEFAULT_REGION: &str = "us-east-1";
+// A cache that answers slower than this costs more than the build it saves.
+const CACHE_TIMEOUT: Duration = Duration::from_secs(5);
+// Builds larger than this are not worth the round trip, and Redis refuses
+// very large values anyway.
+const MAX_ENTRY_BYTES: usize = 64 << 20;
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum CacheAddress {
+    Redis {
+        addr: String,
+        password: Option<String>,
+        db: u32,
+    },
+    S3 {
+        endpoint: String,
+        bucket: String,
+        region: String,
+    },
+}
+
+// Where builds are shared between replicas, parsed from a URL:
+// `redis://[:password@]host[:port][/db]`, or `s3://host[:port]/bucket` for
+// an S3-compatible store over https (`s3+http://` for plain http), with an
+// optional `?region=` defaulting to us-east-1.
+impl FromStr for CacheAddress {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let invalid = || {
+            format!(
+                "invalid build cache {:?}, expected redis://host[:port][/db] or s3://host/bucket",
+                s
+            )
+        };
+        if let Some(rest) = s.strip_prefix("redis://") {
+            let (password, rest) = match rest.rsplit_once('@') {
+                Some((userinfo, rest)) => {
+                    // Redis before ACLs has no user names, so only the part
+                    // after the colon counts.
+                    let password = userinfo.rsplit(':').next().unwrap_or_default();
+                    (Some(password.to_string()).filter(|p| !p.is_empty()), rest)
+                }
+                None => (None, rest),
+            };
+            let (host, db) = match rest.split_once('/') {
+                Some((host, "")) => (host, 0),
+                Some((host, db)) => (host, db.parse::<u32>().map_err(|_| invalid())?),
+                None => (rest, 0),
+            };
+            if host.is_empty() {
+                return Err(invalid());
+            }
+            let addr = if host.contains(':') {
+                host.to_string()
+            } else {
+                format!("{}:{}", host, REDIS_DEFAULT_PORT)
+            };
+            return Ok(CacheAddress::Redis { addr, password, db });
+        }
+
+        let (scheme, rest) = if let Some(rest) = s.strip_prefix("s3://") {
+            ("https", rest)
+        } else if let Some(rest) = s.strip_prefix("s3+http://") {
+            ("http", rest)
+        } else {
+            return Err(invalid());
+        };
+        let (rest, query) = rest.split_once('?').unwrap_or((rest, ""));
+        let (host, bucket) = rest
+            .split_once('/')
+            .map(|(host, bucket)| (host, bucket.trim_end_matches('/')))
+            .filter(|(host, bucket)| !host.is_empty() && !bucket.is_empty())
+            .ok_or_else(invalid)?;
+        let region = query
+            .split('&')
+            .find_map(|pair| pair.strip_prefix("region="))
+            .filter(|region| !region.is_empty())
+            .unwrap_or(S3_DEFAULT_REGION);
+        Ok(CacheAddress::S3 {
+            endpoint: format!("{}://{}", scheme, host),
+            bucket: bucket.to_string(),
+            region: region.to_string(),
+        })
+    }
+}
+
+// The key pair S3 requests are signed with.
+#[derive(Clone)]
+pub struct S3Credentials {
+    pub access_key: String,
+    pub secret_key: String,
+}
+
+impl fmt::Debug for S3Credentials {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("S3Credentials")
+            .field("access_key", &self.access_key)
+            .finish_non_exhaustive()
+    }
+}
+
+// Somewhere builds outlive the replica that compiled them. Implementations
+// report failures rather than retrying; a build that cannot be fetched is
+// simply compiled again.
+pub trait ArtifactCache: Send + Sync {
+    fn get<'a>(&'a self, key: &'a str) -> BoxFuture<'a, io::Result<Option<Vec<u8>>>>;
+
+    fn put<'a>(&'a self, key: &'a str, entry: &'a [u8]) -> BoxFuture<'a, io::Result<()>>;
+}
+
+pub fn connect(
+    address: &CacheAddress,
+    credentials: Option<&S3Credentials>,
+    ttl: Duration,
+) -> Result<Box<dyn ArtifactCache>, String> {
+    match address {
+        CacheAddress::Redis { addr, password, db } => Ok(Box::new(RedisCache::new(
+            addr,
+            password.as_deref(),
+            *db,
+            ttl,
+        ))),
+        CacheAddress::S3 {
+            endpoint,
+            bucket,
+            region,
+        } => {
+            let credentials = credentials.ok_or_else(|| {
+                String::from("an s3 build cache needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+            })?;
+            Ok(Box::new(S3Cache::new(
+                endpoint,
+                bucket,
+                region,
+                credentials.clone(),
+            )?))
+        }
+    }
+}
+
+#[derive(Debug, PartialEq, Eq)]
+enum Reply {
+    Status(String),
+    Integer(i64),
+    Bulk(Option<Vec<u8>>),
+}
+
+fn command(args: &[&[u8]]) -> Vec<u8> {
+    let mut frame = format!("*{}\r\n", args.len()).into_bytes();
+    for arg in args {
+        frame.extend_from_slice(format!("${}\r\n", arg.len()).as_bytes());
+        frame.extend_from_slice(arg);
+        frame.extend_from_slice(b"\r\n");
+    }
+    frame
+}
+
+// Reads one RESP reply. Arrays never answer the commands sent here, so they
+// are refused like any other reply this client does not expect.
+async fn read_reply<R: AsyncBufRead + Unpin>(reader: &mut R) -> io::Result<Reply> {
+    let mut line = Vec::new();
+    reader.read_until(b'\n', &mut line).await?;
+    let Some(line) = line.strip_suffix(b"\r\n") else {
+        return Err(io::ErrorKind::UnexpectedEof.into());
+    };
+    let invalid = || io::Error::new(io::ErrorKind::InvalidData, "malformed reply from redis");
+    let (kind, text) = line.split_first().ok_or_else(invalid)?;
+    let text = String::from_utf8_lossy(text);
+    match kind {
+        b'+' => Ok(Reply::Status(text.into_owned())),
+        b'-' => Err(io::Error::other(format!("redis: {}", text))),
+        b':' => Ok(Reply::Integer(text.parse().map_err(|_| invalid())?)),
+        b'$' => {
+            let len: i64 = text.parse().map_err(|_| invalid())?;
+            if len < 0 {
+                return Ok(Reply::Bulk(None));
+            }
+            let mut value = vec![0; len as usize + 2];
+            reader.read_exact(&mut value).await?;
+            value.truncate(len as usize);
+            Ok(Reply::Bulk(Some(value)))
+        }
+        _ => Err(invalid()),
+    }
+}
+
+// Speaks RESP on one long-lived connection, opened on first use. A
+// connection is taken out while a command is in flight and only put back
+// once its reply was read, so one abandoned midway is never reused.
+pub struct RedisCache {
+    addr: String,
+    password: Option<String>,
+    db: u32,
+    ttl: Duration,
+    conn: Mutex<Option<BufStream<TcpStream>>>,
+}
+
+impl RedisCache {
+    pub fn new(addr: &str, password: Option<&str>, db: u32, ttl: Duration) -> Self {
+        RedisCache {
+            addr: addr.to_string(),
+            password: password.map(str::to_string),
+            db,
+            ttl,
+            conn: Mutex::new(None),
+        }
+    }
+
+    async fn open(&self) -> io::Result<BufStream<TcpStream>> {
+        let mut stream = BufStream::new(TcpStream::connect(&self.addr).await?);
+        if let Some(password) = &self.password {
+            stream
+                .write_all(&command(&[b"AUTH", password.as_bytes()]))
+                .await?;
+            stream.flush().await?;
+            read_reply(&mut stream).await?;
+        }
+        if self.db != 0 {
+            stream
+                .write_all(&command(&[b"SELECT", self.db.to_string().as_bytes()]))
+                .await?;
+            stream.flush().await?;
+            read_reply(&mut stream).await?;
+        }
+        Ok(stream)
+    }
+
+    async fn call(&self, args: &[&[u8]]) -> io::Result<Reply> {
+        let mut conn = self.conn.lock().await;
+        let mut stream = match conn.take() {
+            Some(stream) => stream,
+            None => self.open().await?,
+        };
+        stream.write_all(&command(args)).await?;
+        stream.flush().await?;
+        let reply = read_reply(&mut stream).await?;
+        *conn = Some(stream);
+        Ok(reply)
+    }
+}
+
+impl ArtifactCache for RedisCache {
+    fn get<'a>(&'a self, key: &'a str) -> BoxFuture<'a, io::Result<Option<Vec<u8>>>> {
+        Box::pin(async move {
+            match self.call(&[b"GET", key.as_bytes()]).await? {
+                Reply::Bulk(value) => Ok(value),
+                other => Err(io::Error::other(format!(
+                    "unexpected reply to GET: {:?}",
+                    other
+                ))),
+            }
+        })
+    }
+
+    fn put<'a>(&'a self, key: &'a str, entry: &'a [u8]) -> BoxFuture<'a, io::Result<()>> {
+        Box::pin(async move {
+            let ttl = self.ttl.as_secs().max(1).to_string();
+            self.call(&[b"SET", key.as_bytes(), entry, b"EX", ttl.as_bytes()])
+                .await?;
+            Ok(())
+        })
+    }
+}
+
+fn signing_key(secret_key: &str, date: &str, region: &str, service: &str) -> [u8; 32] {
+    let key = hmac_sha256(format!("AWS4{}", secret_key).as_bytes(), date.as_bytes());
+    let key = hmac_sha256(&key, region.as_bytes());
+    let key = hmac_sha256(&key, service.as_bytes());
+    hmac_sha256(&key, b"aws4_request")
+}
+
+// Stores each build as an object with path-style URLs, so any S3-compatible
+// store works without DNS for its buckets. Objects are never expired here;
+// a lifecycle rule on the bucket takes care of that.
+pub struct S3Cache {
+    http: reqwest::Client,
+    endpoint: String,
+    bucket: String,
+    region: String,
+    credentials: S3Credentials,
+}
+
+impl S3Cache {
+    pub fn new(
+        endpoint: &str,
+        bucket: &str,
+        region: &str,
+        credentials: S3Credentials,
+    ) -> Result<Self, String> {
+        Url::parse(endpoint).map_err(|err| format!("invalid s3 endpoint {}: {}", endpoint, err))?;
+        Ok(S3Cache {
+            http: reqwest::Client::builder()
+                .timeout(CACHE_TIMEOUT)
+                .build()
+                .unwrap_or_default(),
+            endpoint: endpoint.trim_end_matches('/').to_string(),
+            bucket: bucket.to_string(),
+            region: region.to_string(),
+            credentials,
+        })
+    }
+
+    fn object_url(&self, key: &str) -> Url {
+        Url::parse(&format!("{}/{}/builds/{}", self.endpoint, self.bucket, key))
+            .expect("endpoint was checked when the cache was created")
+    }
+
+    // The headers that sign a request with AWS Signature Version 4.
+    fn sign(
+        &self,
+        method: &str,
+        url: &Url,
+        payload: &[u8],
+        now: DateTime<Utc>,
+    ) -> [(&'static str, String); 3] {
+        let amz_date = now.format("%Y%m%dT%H%M%SZ").to_string();
+        let date = &amz_date[..8];
+        let payload_hash = to_hex(&Sha256::digest(payload));
+        let host = match url.port() {
+            Some(port) => format!("{}:{}", url.host_str().unwrap_or_default(), port),
+            None => url.host_str().unwrap_or_default().to_string(),
+        };
+        let signed_headers = "host;x-amz-content-sha256;x-amz-date";
+        let canonical_request = format!(
+            "{}\n{}\n\nhost:{}\nx-amz-content-sha256:{}\nx-amz-date:{}\n\n{}\n{}",
+            method,
+            url.path(),
+            host,
+            payload_hash,
+            amz_date,
+            signed_headers,
+            payload_hash
+        );
+        let scope = format!("{}/{}/s3/aws4_request", date, self.region);
+        let string_to_sign = format!(
+            "AWS4-HMAC-SHA256\n{}\n{}\n{}",
+            amz_date,
+            scope,
+            to_hex(&Sha256::digest(canonical_request.as_bytes()))
+        );
+        let key = signing_key(&self.credentials.secret_key, date, &self.region, "s3");
+        let signature = to_hex(&hmac_sha256(&key, string_to_sign.as_bytes()));
+        let authorization = format!(
+            "AWS4-HMAC-SHA256 Credential={}/{}, SignedHeaders={}, Signature={}",
+            self.credentials.access_key, scope, signed_headers, signature
+        );
+        [
+            ("authorization", authorization),
+            ("x-amz-content-sha256", payload_hash),
+            ("x-amz-date", amz_date),
+        ]
+    }
+
+    fn request(
+        &self,
+        method: reqwest::Method,
+        key: &str,
+        payload: &[u8],
+    ) -> reqwest::RequestBuilder {
+        let url = self.object_url(key);
+        let headers = self.sign(method.as_str(), &url, payload, Utc::now());
+        headers
+            .into_iter()
+            .fold(self.http.request(method, url), |request, (name, value)| {
+                request.header(name, value)
+            })
+    }
+}
+
+impl ArtifactCache for S3Cache {
+    fn get<'a>(&'a self, key: &'a str) -> BoxFuture<'a, io::Result<Option<Vec<u8>>>> {
+        Box::pin(async move {
+            let response = self
+                .request(reqwest::Method::GET, key, b"")
+                .send()
+                .await
+                .map_err(io::Error::other)?;
+            if response.status() == StatusCode::NOT_FOUND {
+                return Ok(None);
+            }
+            let response = response.error_for_status().map_err(io::Error::other)?;
+            let body = response.bytes().await.map_err(io::Error::other)?;
+            Ok(Some(body.to_vec()))
+        })
+    }
+
+    fn put<'a>(&'a self, key: &'a str, entry: &'a [u8]) -> BoxFuture<'a, io::Result<()>> {
+        Box::pin(async move {
+            self.request(reqwest::Method::PUT, key, entry)
+                .body(entry.to_vec())
+                .send()
+                .await
+                .map_err(io::Error::other)?
+                .error_for_status()
+                .map_err(io::Error::other)?;
+            Ok(())
+        })
+    }
+}
+
+static CACHE: OnceCell<Option<Box<dyn ArtifactCache>>> = OnceCell::const_new();
+
+async fn init_cache() -> Option<Box<dyn ArtifactCache>> {
+    let app_config = config().await;
+    let address = app_config.build_cache()?;
+    match connect(
+        address,
+        app_config.s3_credentials(),
+        app_config.build_cache_ttl(),
+    ) {
+        Ok(cache) => Some(cache),
+        Err(err) => {
+            tracing::error!("build cache disabled: {}", err);
+            None
+        }
+    }
+}
+
+async fn shared_cache() -> Option<&'static dyn ArtifactCache> {
+    CACHE.get_or_init(init_cache).await.as_deref()
+}
+
+// Names a build by everything that decides what the compiler produces:
+// the source, where the executable goes (which tells a WebAssembly build
+// apart), the flags, the sanitizer, the toolchain and the machine. Builds
+// whose toolchain cannot be told apart from another version are not shared.
+async fn build_key(ctx: &ExecContext, source: &Path, executable: &Path) -> Option<String> {
+    let mut hasher = Sha256::new();
+    let content = tokio::fs::read(source).await.ok()?;
+    hasher.update(&content);
+    hasher.update([0]);
+    let names = [source.file_name()?, executable.file_name()?];
+    for name in names {
+        hasher.update(name.as_encoded_bytes());
+        hasher.update([0]);
+    }
+    for flag in ctx.compiler_flags() {
+        hasher.update(flag.as_bytes());
+        hasher.update([0]);
+    }
+    hasher.update([u8::from(ctx.sanitizer_dir().is_some())]);
+    match ctx.toolchain_dir() {
+        // Pinned toolchains are installed under directories named by
+        // version.
+        Some(dir) => hasher.update(dir.as_os_str().as_encoded_bytes()),
+        None => {
+            let extension = source.extension()?.to_str()?;
+            let version = builtin_version(Language::from_extension(extension)?).await?;
+            hasher.update(version.as_bytes());
+        }
+    }
+    hasher.update([0]);
+    hasher.update(std::env::consts::ARCH.as_bytes());
+    hasher.update(std::env::consts::OS.as_bytes());
+    Some(format!("build:{:x}", hasher.finalize()))
+}
+
+// An entry is the compiler's warnings, so a replica that reuses the build
+// reports them too, followed by the executable.
+fn encode_entry(warnings: &str, executable: &[u8]) -> Vec<u8> {
+    let mut entry = Vec::with_capacity(4 + warnings.len() + executable.len());
+    entry.extend_from_slice(&(warnings.len() as u32).to_be_bytes());
+    entry.extend_from_slice(warnings.as_bytes());
+    entry.extend_from_slice(executable);
+    entry
+}
+
+fn decode_entry(entry: &[u8]) -> Option<(&str, &[u8])> {
+    let (len, rest) = entry.split_first_chunk::<4>()?;
+    let len = u32::from_be_bytes(*len) as usize;
+    if rest.len() < len {
+        return None;
+    }
+    let (warnings, executable) = rest.split_at(len);
+    Some((std::str::from_utf8(warnings).ok()?, executable))
+}
+
+fn restore(ctx: &ExecContext, entry: &[u8], executable: &Path) -> io::Result<bool> {
+    let Some((warnings, bytes)) = decode_entry(entry) else {
+        return Ok(false);
+    };
+    fs::write(executable, bytes)?;
+    fs::set_permissions(executable, fs::Permissions::from_mode(0o755))?;
+    ctx.record_warnings(warnings.as_bytes());
+    Ok(true)
+}
+
+async fn build_through<F>(
+    cache: &'static dyn ArtifactCache,
+    ctx: &ExecContext,
+    source: &Path,
+    executable: &Path,
+    build: F,
+) -> Result<(), InfraError>
+where
+    F: Future<Output = Result<(), InfraError>>,
+{
+    let Some(key) = build_key(ctx, source, executable).await else {
+        return build.await;
+    };
+    match tokio::time::timeout(CACHE_TIMEOUT, cache.get(&key)).await {
+        Ok(Ok(Some(entry))) => match restore(ctx, &entry, executable) {
+            Ok(true) => return Ok(()),
+            Ok(false) => tracing::warn!("ignoring malformed build cache entry {}", key),
+            Err(err) => tracing::warn!("failed to restore cached build {}: {}", key, err),
+        },
+        Ok(Ok(None)) => {}
+        Ok(Err(err)) => tracing::warn!("build cache lookup failed: {}", err),
+        Err(_) => tracing::warn!("build cache lookup timed out"),
+    }
+
+    // Only a context that collects warnings knows which ones this build
+    // printed; a build shared without them would hide them from others.
+    let before = ctx.collected_warnings();
+    build.await?;
+    let (Some(before), Some(after)) = (before, ctx.collected_warnings()) else {
+        return Ok(());
+    };
+    let warnings = after.get(before.len()..).unwrap_or_default();
+    let bytes = fs::read(executable)?;
+    if bytes.len() > MAX_ENTRY_BYTES {
+        return Ok(());
+    }
+    let entry = encode_entry(warnings, &bytes);
+    // The run goes ahead while the build is uploaded.
+    tokio::spawn(async move {
+        match tokio::time::timeout(CACHE_TIMEOUT, cache.put(&key, &entry)).await {
+            Ok(Ok(())) => {}
+            Ok(Err(err)) => tracing::warn!("failed to share build {}: {}", key, err),
+            Err(_) => tracing::warn!("sharing build {} timed out", key),
+        }
+    });
+    Ok(())
+}
+
+// Runs `build`, which leaves its executable at `executable`, unless another
+// replica already built the same source and shared it through the
+// configured build cache.
+pub async fn cached_build<F>(
+    ctx: &ExecContext,
+    source: &Path,
+    executable: &Path,
+    build: F,
+) -> Result<(), InfraError>
+where
+    F: Future<Output = Result<(), InfraError>>,
+{
+    match shared_cache().await {
+        Some(cache) => Box::pin(build_through(cache, ctx, source, executable, build)).await,
+        None => build.await,
+    }
+}
+
+#[cfg(test)]
+mod build_cache_tests {
+    use super::*;
+    use crate::infra::runner::CompilerWarnings;
+    use std::{collections::HashMap, sync::Mutex as StdMutex};
+    use tempfile::TempDir;
+
+    #[derive(Default)]
+    struct MemoryCache(StdMutex<HashMap<String, Vec<u8>>>);
+
+    impl ArtifactCache for MemoryCache {
+        fn get<'a>(&'a self, key: &'a str) -> BoxFuture<'a, io::Result<Option<Vec<u8>>>> {
+            Box::pin(async move { Ok(self.0.lock().unwrap().get(key).cloned()) })
+        }
+
+        fn put<'a>(&'a self, key: &'a str, entry: &'a [u8]) -> BoxFuture<'a, io::Result<()>> {
+            Box::pin(async move {
+                self.0
+                    .lock()
+                    .unwrap()
+                    .insert(key.to_string(), entry.to_vec());
+                Ok(())
+            })
+        }
+    }
+
+    #[test]
+    fn test_parse_cache_addresses() {
+        assert_eq!(
+            "redis://:secret@cache:6380/2".parse(),
+            Ok(CacheAddress::Redis {
+                addr: "cache:6380".into(),
+                password: Some("secret".into()),
+                db: 2
+            })
+        );
+        assert_eq!(
+            "redis://cache".parse(),
+            Ok(CacheAddress::Redis {
+                addr: "cache:6379".into(),
+                password: None,
+                db: 0
+            })
+        );
+        assert_eq!(
+            "s3://minio:9000/builds?region=eu-west-1".parse(),
+            Ok(CacheAddress::S3 {
+                endpoint: "https://minio:9000".into(),
+                bucket: "builds".into(),
+                region: "eu-west-1".into()
+            })
+        );
+        assert_eq!(
+            "s3+http://minio/builds/".parse(),
+            Ok(CacheAddress::S3 {
+                endpoint: "http://minio".into(),
+                bucket: "builds".into(),
+                region: "us-east-1".into()
+            })
+        );
+        assert!("s3://minio".parse::<CacheAddress>().is_err());
+        assert!("redis://cache/db".parse::<CacheAddress>().is_err());
+        assert!("memcached://cache".parse::<CacheAddress>().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_read_reply_understands_what_get_and_set_answer() {
+        let mut replies: &[u8] = b"+OK\r\n$5\r\nMZ\r\n!\r\n$-1\r\n:3\r\n-ERR wrong\r\n";
+        assert_eq!(
+            read_reply(&mut replies).await.unwrap(),
+            Reply::Status("OK".into())
+        );
+        assert_eq!(
+            read_reply(&mut replies).await.unwrap(),
+            Reply::Bulk(Some(b"MZ\r\n!".to_vec()))
+        );
+        assert_eq!(read_reply(&mut replies).await.unwrap(), Reply::Bulk(None));
+        assert_eq!(read_reply(&mut replies).await.unwrap(), Reply::Integer(3));
+        assert!(read_reply(&mut replies).await.is_err());
+        assert_eq!(
+            command(&[b"GET", b"build:1"]),
+            b"*2\r\n$3\r\nGET\r\n$7\r\nbuild:1\r\n"
+        );
+    }
+
+    #[test]
+    fn test_signing_key_matches_the_aws_example() {
+        let key = signing_key(
+            "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+            "20120215",
+            "us-east-1",
+            "iam",
+        );
+        assert_eq!(
+            to_hex(&key),
+            "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_another_replica_reuses_the_build_and_its_warnings() {
+        let cache: &'static MemoryCache = Box::leak(Box::default());
+        let build = |dir: &Path| {
+            let source = dir.join("main.c");
+            fs::write(&source, "int main(void) { return 0; }").unwrap();
+            (source, dir.join("main"))
+        };
+        let flags = vec![String::from("-O2")];
+        let ctx = ExecContext::default()
+            .with_compiler_flags(flags.clone())
+            .with_toolchain_dir("/opt/toolchains/c-1".into());
+
+        let first = TempDir::new().unwrap();
+        let (source, executable) = build(first.path());
+        let warnings = CompilerWarnings::default();
+        let built = ctx.clone().with_compiler_warnings(warnings.clone());
+        build_through(cache, &built, &source, &executable, async {
+            fs::write(&executable, "binary")?;
+            built.record_warnings(b"warning: unused variable");
+            Ok(())
+        })
+        .await
+        .unwrap();
+        assert_eq!(warnings.take().unwrap(), "warning: unused variable");
+        // Sharing happens in the background.
+        while cache.0.lock().unwrap().is_empty() {
+            tokio::task::yield_now().await;
+        }
+
+        let second = TempDir::new().unwrap();
+        let (source, executable) = build(second.path());
+        let warnings = CompilerWarnings::default();
+        let reused = ctx.clone().with_compiler_warnings(warnings.clone());
+        build_through(cache, &reused, &source, &executable, async {
+            panic!("the shared build should have been reused")
+        })
+        .await
+        .unwrap();
+        assert_eq!(fs::read_to_string(&executable).unwrap(), "binary");
+        assert_eq!(warnings.take().unwrap(), "warning: unused variable");
+
+        let other = ctx.with_compiler_flags(vec![String::from("-O0")]);
+        let mut rebuilt = false;
+        build_through(cache, &other, &source, &executable, async {
+            rebuilt = true;
+            Ok(())
+        })
+        .await
+        .unwrap();
+        assert!(rebuilt);
+    }
+}
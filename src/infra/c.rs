@@ -1,49 +1,88 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
-
-pub async fn compile_c(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".c")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
-
-    let source_path = temp_file.path().to_path_buf();
-    let executable_file = NamedTempFile::new()?;
-    let executable_path = executable_file.path().to_path_buf();
-    drop(executable_file);
-
-    let compile_output = Command::new(which("zig")?)
-        .arg("cc")
-        .arg(source_path)
-        .arg("-o")
-        .arg(&executable_path)
-        .output()
-        .await?;
-
-    if !compile_output.status.success() {
-        let stderr = String::from_utf8_lossy(&compile_output.stderr);
-        return Err(InfraError::CompilationError(
-            format!("C compilation failed:\n{}", stderr).into(),
-        ));
-    }
-
-    let mut cmd = Command::new(&executable_path)
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
-
-    let output = cmd.wait_with_output().await?;
+use super::{
+    error::InfraError,
+    language::Language,
+    profile,
+    runner::{ExecContext, run_compiler},
+    sanitizer::{self, SANITIZE_FLAGS},
+    shared_build::build_once,
+    source::SourceFile,
+    wasm::{Backend, run_module},
+};
+
+pub async fn compile_c(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::C, content)?;
+    let source_path = source.path().to_path_buf();
+    let wasm = ctx.backend() == Backend::Wasm;
+    let executable_path = source.dir().join(if wasm { "main.wasm" } else { "main" });
+    let target: &[&str] = if wasm {
+        &["-target", "wasm32-wasi"]
+    } else {
+        &[]
+    };
+
+    build_once(ctx, source.path(), &executable_path, async {
+        // Zig's bundled clang has no AddressSanitizer runtime.
+        let mut compile = if ctx.sanitizer_dir().is_some() {
+            let mut cmd = ctx.command("clang")?;
+            cmd.args(SANITIZE_FLAGS);
+            cmd
+        } else {
+            let mut cmd = ctx.command("zig")?;
+            cmd.arg("cc");
+            cmd
+        };
+        let compile_output = compile
+            .arg(source_path)
+            .arg("-o")
+            .arg(&executable_path)
+            .args(target)
+            .args(ctx.compiler_flags())
+            .kill_on_drop(true)
+            .output()
+            .await?;
+
+        if !compile_output.status.success() {
+            let stderr = String::from_utf8_lossy(&compile_output.stderr);
+            return Err(InfraError::CompilationError(
+                format!("C compilation failed:\n{}", stderr).into(),
+            ));
+        }
+        ctx.record_warnings(&compile_output.stderr);
+        Ok(())
+    })
+    .await?;
+
+    let sanitized;
+    let ctx = match ctx.sanitizer_dir() {
+        Some(_) => {
+            sanitized = ctx.clone().with_envs(sanitizer::options_env());
+            &sanitized
+        }
+        None => ctx,
+    };
+    let output = if wasm {
+        let module = tokio::fs::read(&executable_path).await?;
+        run_module(module, stdin_input, ctx).await?
+    } else {
+        profile::run_native(&executable_path, stdin_input, ctx).await?
+    };
+    let reports = match ctx.sanitizer_dir() {
+        Some(dir) => sanitizer::collect(&output.stderr, source.dir(), dir)?,
+        None => Vec::new(),
+    };
     match output.status.code() {
-        Some(0) => Ok(String::from_utf8(output.stdout)?),
+        Some(0) => {
+            if let Some(dir) = ctx.profile_dir() {
+                profile::report_native(dir, ctx).await?;
+            }
+            Ok(String::from_utf8(output.stdout)?)
+        }
+        // The reports say why the sanitizer stopped the program.
+        _ if !reports.is_empty() => Ok(String::from_utf8_lossy(&output.stdout).into_owned()),
         Some(code) => {
             let stderr = String::from_utf8_lossy(&output.stderr);
             Err(InfraError::CompilationError(
@@ -63,6 +102,37 @@ pub async fn compile_c(content: &str, stdin_input: &str) -> Result<String, Infra
     }
 }
 
+// Builds without running, for `target`, a target triple zig knows, or for
+// this host when it is None, and returns the executable.
+pub async fn build_c(
+    content: &str,
+    target: Option<&str>,
+    ctx: &ExecContext,
+) -> Result<Vec<u8>, InfraError> {
+    let source = SourceFile::create(Language::C, content)?;
+    let executable_path = source.dir().join("main");
+
+    let mut build = ctx.command("zig")?;
+    build
+        .arg("cc")
+        .arg(source.path())
+        .arg("-o")
+        .arg(&executable_path)
+        .args(ctx.compiler_flags());
+    if let Some(target) = target {
+        build.args(["-target", target]);
+    }
+    let output = run_compiler(&mut build, ctx).await?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        return Err(InfraError::CompileError(format!(
+            "C compilation failed:\n{}",
+            stderr
+        )));
+    }
+    Ok(std::fs::read(executable_path)?)
+}
+
 #[cfg(test)]
 mod c_tests {
     use super::*;
@@ -77,7 +147,7 @@ int main() {
 }
 "#;
 
-        let result = compile_c(c_code, "").await;
+        let result = compile_c(c_code, "", &ExecContext::default()).await;
         println!("{:?}", result);
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
@@ -95,7 +165,7 @@ int main() {
 }
 "#;
 
-        let result = compile_c(c_code, "").await;
+        let result = compile_c(c_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "8");
     }
@@ -112,7 +182,7 @@ int main() {
 }
 "#;
 
-        let result = compile_c(c_code, "42").await;
+        let result = compile_c(c_code, "42", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "You entered: 42");
     }
@@ -129,7 +199,7 @@ int main() {
 }
 "#;
 
-        let result = compile_c(c_code, "Alice").await;
+        let result = compile_c(c_code, "Alice", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, Alice!");
     }
@@ -146,7 +216,7 @@ int main() {
 }
 "#;
 
-        let result = compile_c(c_code, "").await;
+        let result = compile_c(c_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Line 1"));
@@ -164,7 +234,7 @@ int main() {
 }
 "#;
 
-        let result = compile_c(invalid_c_code, "").await;
+        let result = compile_c(invalid_c_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -179,7 +249,7 @@ int main() {
 }
 "#;
 
-        let result = compile_c(c_code, "").await;
+        let result = compile_c(c_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -196,7 +266,7 @@ int main() {
 }
 "#;
 
-        let result = compile_c(c_code, "7 3").await;
+        let result = compile_c(c_code, "7 3", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Sum: 10"));
@@ -211,7 +281,7 @@ int main() {
 }
 "#;
 
-        let result = compile_c(c_code, "").await;
+        let result = compile_c(c_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
@@ -228,7 +298,7 @@ int main() {
 }
 "#;
 
-        let result = compile_c(c_code, "").await;
+        let result = compile_c(c_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Length: 5");
     }
@@ -245,7 +315,7 @@ int main() {
 }
 "#;
 
-        let result = compile_c(c_code, "").await;
+        let result = compile_c(c_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Square root of 16.000000 is 4.000000");
     }
@@ -265,8 +335,32 @@ int main() {
 }
 "#;
 
-        let result = compile_c(c_code, "").await;
+        let result = compile_c(c_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Thread running");
     }
+
+    #[tokio::test]
+    async fn test_debug_build_reports_heap_overflow() {
+        let c_code = r#"
+#include <stdio.h>
+#include <stdlib.h>
+int main() {
+    int *p = malloc(4 * sizeof(int));
+    printf("start\n");
+    fflush(stdout);
+    p[4] = 1;
+    free(p);
+    return 0;
+}
+"#;
+
+        let dir = tempfile::tempdir().unwrap();
+        let ctx = ExecContext::default().with_sanitizer_dir(dir.path().to_path_buf());
+        let result = compile_c(c_code, "", &ctx).await;
+        assert_eq!(result.unwrap().trim(), "start");
+        let reports = sanitizer::load(dir.path()).unwrap();
+        assert_eq!(reports[0].kind, "heap-buffer-overflow");
+        assert_eq!(reports[0].location.as_ref().unwrap().line, Some(8));
+    }
 }
@@ -0,0 +1,133 @@
+use std::time::{Duration, Instant};
+
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+use tokio::sync::OnceCell;
+use utoipa::ToSchema;
+
+use crate::config::config;
+
+const BENCHMARK_ROUNDS: usize = 64;
+const BENCHMARK_SAMPLES: usize = 3;
+const BLOCK_BYTES: usize = 1 << 20;
+const MIN_FACTOR: f64 = 0.25;
+const MAX_FACTOR: f64 = 4.0;
+
+// How this host compares to the reference machine time limits were chosen
+// on. A factor of 2 means the benchmark ran twice as slow here, so programs
+// are given twice as long.
+#[derive(Debug, Clone, Copy, Serialize, ToSchema)]
+pub struct Calibration {
+    #[schema(example = 1.0)]
+    pub factor: f64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub benchmark_ms: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub reference_ms: Option<u64>,
+}
+
+static CALIBRATION: OnceCell<Calibration> = OnceCell::const_new();
+
+async fn init_calibration() -> Calibration {
+    let app_config = config().await;
+    if !app_config.calibrate() {
+        return Calibration::uncalibrated();
+    }
+
+    let measured = tokio::task::spawn_blocking(|| run_benchmark(BENCHMARK_ROUNDS))
+        .await
+        .unwrap();
+    let calibration = Calibration::from_measurement(measured, app_config.calibration_reference());
+    tracing::info!(
+        "calibrated against reference: benchmark took {:?}, time limits scaled by {:.2}",
+        measured,
+        calibration.factor
+    );
+    calibration
+}
+
+pub async fn calibration() -> &'static Calibration {
+    CALIBRATION.get_or_init(init_calibration).await
+}
+
+// A fixed, single-threaded CPU workload. The fastest of a few samples is
+// kept so a noisy neighbour during startup does not inflate the factor.
+pub fn run_benchmark(rounds: usize) -> Duration {
+    let block = vec![0x5au8; BLOCK_BYTES];
+    (0..BENCHMARK_SAMPLES)
+        .map(|_| {
+            let started = Instant::now();
+            let mut digest = Sha256::digest(&block);
+            for _ in 1..rounds {
+                let mut hasher = Sha256::new();
+                hasher.update(digest);
+                hasher.update(&block);
+                digest = hasher.finalize();
+            }
+            std::hint::black_box(digest);
+            started.elapsed()
+        })
+        .min()
+        .unwrap_or_default()
+}
+
+impl Calibration {
+    pub fn uncalibrated() -> Self {
+        Calibration {
+            factor: 1.0,
+            benchmark_ms: None,
+            reference_ms: None,
+        }
+    }
+
+    // Without a reference only the measurement is reported, which is how the
+    // reference is obtained on the baseline machine in the first place.
+    pub fn from_measurement(measured: Duration, reference: Option<Duration>) -> Self {
+        let factor = match reference {
+            Some(reference) if !reference.is_zero() => {
+                (measured.as_secs_f64() / reference.as_secs_f64()).clamp(MIN_FACTOR, MAX_FACTOR)
+            }
+            _ => 1.0,
+        };
+        Calibration {
+            factor,
+            benchmark_ms: Some(measured.as_millis() as u64),
+            reference_ms: reference.map(|reference| reference.as_millis() as u64),
+        }
+    }
+
+    pub fn scale(&self, limit: Duration) -> Duration {
+        limit.mul_f64(self.factor)
+    }
+}
+
+#[cfg(test)]
+mod calibration_tests {
+    use super::*;
+
+    #[test]
+    fn test_factor_is_ratio_to_reference_within_bounds() {
+        let ms = Duration::from_millis;
+        let slower = Calibration::from_measurement(ms(400), Some(ms(200)));
+        assert_eq!(slower.factor, 2.0);
+        assert_eq!(slower.scale(Duration::from_secs(3)), Duration::from_secs(6));
+
+        assert_eq!(
+            Calibration::from_measurement(ms(10_000), Some(ms(200))).factor,
+            MAX_FACTOR
+        );
+        assert_eq!(
+            Calibration::from_measurement(ms(1), Some(ms(200))).factor,
+            MIN_FACTOR
+        );
+
+        let unreferenced = Calibration::from_measurement(ms(300), None);
+        assert_eq!(unreferenced.factor, 1.0);
+        assert_eq!(unreferenced.benchmark_ms, Some(300));
+    }
+
+    #[test]
+    fn test_benchmark_measures_elapsed_time() {
+        assert!(run_benchmark(2) > Duration::ZERO);
+    }
+}
@@ -0,0 +1,220 @@
+use std::{
+    collections::{BTreeMap, VecDeque},
+    str::FromStr,
+    sync::Mutex,
+};
+
+use chrono::{DateTime, Utc};
+use serde::Serialize;
+use tokio::sync::OnceCell;
+use utoipa::ToSchema;
+
+use super::{
+    compare::diff, compile::compile_lang, disk::execution_zone, load, matrix::ToolchainVersion,
+    metrics, runner::ExecContext, toolchain::Toolchain,
+};
+use crate::config::config;
+
+const CANARY_METRIC: &str = "comphub_canary_runs_total";
+// Comparisons kept for operators to review, oldest dropped first.
+const LOG_CAPACITY: usize = 500;
+
+// The version to try each language's runs on before switching to it,
+// parsed from a comma-separated list of `lang:version` entries naming
+// versions in TOOLCHAIN_VERSIONS.
+#[derive(Debug, Clone, Default)]
+pub struct CanaryVersions(BTreeMap<String, String>);
+
+impl FromStr for CanaryVersions {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut versions = BTreeMap::new();
+        for entry in s
+            .split(',')
+            .map(str::trim)
+            .filter(|entry| !entry.is_empty())
+        {
+            let Some((lang, name)) = entry.split_once(':') else {
+                return Err(format!(
+                    "invalid canary version {:?}, expected lang:version",
+                    entry
+                ));
+            };
+            let (lang, name) = (lang.trim().to_lowercase(), name.trim());
+            if lang.is_empty() || name.is_empty() || versions.contains_key(&lang) {
+                return Err(format!("invalid or duplicate canary version {:?}", entry));
+            }
+            versions.insert(lang, name.to_string());
+        }
+        Ok(CanaryVersions(versions))
+    }
+}
+
+// A run compared against its candidate version.
+#[derive(Debug, Clone, Serialize, ToSchema)]
+pub struct CanaryRun {
+    pub at: DateTime<Utc>,
+    // The id of the run on the current toolchain.
+    pub id: String,
+    #[schema(example = "go")]
+    pub lang: String,
+    #[schema(example = "1.23")]
+    pub candidate: String,
+    pub matched: bool,
+    // The lines that differ, `-` as the current toolchain wrote them and `+`
+    // as the candidate did. Errors are compared by their message.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub diff: Vec<String>,
+}
+
+// Runs a share of submissions a second time on a candidate toolchain
+// version, so an upgrade can be checked against real traffic before it
+// becomes the default. Only active when candidates are configured.
+pub struct Canary {
+    rate: f64,
+    candidates: BTreeMap<&'static str, &'static ToolchainVersion>,
+}
+
+static CANARY: OnceCell<Canary> = OnceCell::const_new();
+static LOG: Mutex<VecDeque<CanaryRun>> = Mutex::new(VecDeque::new());
+
+async fn init_canary() -> Canary {
+    let app_config = config().await;
+    let mut candidates = BTreeMap::new();
+    for (lang, name) in &app_config.canary_versions().0 {
+        let toolchain = Toolchain::resolve(lang).ok();
+        let version = toolchain.and_then(|toolchain| {
+            let version = app_config
+                .toolchain_versions()
+                .resolve(toolchain.as_str(), name)?;
+            Some((toolchain.as_str(), version))
+        });
+        match version {
+            Some((lang, version)) => {
+                candidates.insert(lang, version);
+            }
+            None => tracing::warn!(
+                "canary version {}:{} is not in TOOLCHAIN_VERSIONS, ignoring it",
+                lang,
+                name
+            ),
+        }
+    }
+    let rate = app_config.canary_rate();
+    if rate > 0.0 && !candidates.is_empty() {
+        tracing::info!(
+            "running {:.1}% of runs again on candidate versions: {:?}",
+            rate * 100.0,
+            candidates
+                .iter()
+                .map(|(lang, version)| format!("{}:{}", lang, version.name))
+                .collect::<Vec<_>>()
+        );
+    }
+    Canary { rate, candidates }
+}
+
+pub async fn canary() -> &'static Canary {
+    CANARY.get_or_init(init_canary).await
+}
+
+impl Canary {
+    // The candidate a run of `lang` on the current toolchain should also be
+    // tried on, if this run is picked. None while the server sheds load.
+    pub fn pick(&self, lang: &str) -> Option<&'static ToolchainVersion> {
+        if self.rate <= 0.0 || self.candidates.is_empty() || load::overloaded().is_some() {
+            return None;
+        }
+        let toolchain = Toolchain::resolve(lang).ok()?;
+        let candidate = self.candidates.get(toolchain.as_str())?;
+        (fastrand::f64() < self.rate).then_some(*candidate)
+    }
+}
+
+fn outcome_text(outcome: &Result<String, String>) -> String {
+    match outcome {
+        Ok(output) => output.clone(),
+        Err(err) => format!("error: {}", err),
+    }
+}
+
+fn record(run: CanaryRun) {
+    let outcome = if run.matched { "match" } else { "mismatch" };
+    metrics::increment(CANARY_METRIC, &[("lang", &run.lang), ("outcome", outcome)]);
+    if !run.matched {
+        tracing::warn!(
+            "run {} of {} differs on candidate version {}",
+            run.id,
+            run.lang,
+            run.candidate
+        );
+    }
+    let mut log = LOG.lock().unwrap();
+    if log.len() == LOG_CAPACITY {
+        log.pop_front();
+    }
+    log.push_back(run);
+}
+
+// Runs `content` again on `candidate` with the limits of `ctx`, and records
+// whether it ends the way `current` did on the current toolchain.
+pub async fn compare(
+    id: String,
+    lang: String,
+    content: String,
+    stdin: String,
+    ctx: ExecContext,
+    candidate: &'static ToolchainVersion,
+    current: Result<String, String>,
+) {
+    // A workspace of its own, as the run it repeats may already be over.
+    let workspace = match tempfile::TempDir::new_in(execution_zone()) {
+        Ok(workspace) => workspace,
+        Err(err) => {
+            tracing::warn!("skipping canary run of {}: {}", id, err);
+            return;
+        }
+    };
+    let ctx = ctx
+        .with_toolchain_dir(candidate.dir.clone())
+        .with_workspace(workspace.path().to_path_buf());
+    let outcome = compile_lang(&lang, &content, &stdin, &ctx)
+        .await
+        .map_err(|err| err.to_string());
+    let (current, outcome) = (outcome_text(&current), outcome_text(&outcome));
+    record(CanaryRun {
+        at: Utc::now(),
+        id,
+        lang,
+        candidate: candidate.name.clone(),
+        matched: current == outcome,
+        diff: diff(&current, &outcome),
+    });
+}
+
+// Newest first.
+pub fn canary_log() -> Vec<CanaryRun> {
+    LOG.lock().unwrap().iter().rev().cloned().collect()
+}
+
+#[cfg(test)]
+mod canary_tests {
+    use super::*;
+
+    #[test]
+    fn test_canary_versions_parse_lang_and_version() {
+        let versions: CanaryVersions = " Go:1.23 , python:3.13".parse().unwrap();
+        assert_eq!(versions.0.get("go").map(String::as_str), Some("1.23"));
+        assert_eq!(versions.0.get("python").map(String::as_str), Some("3.13"));
+        assert!("".parse::<CanaryVersions>().unwrap().0.is_empty());
+        assert!("go".parse::<CanaryVersions>().is_err());
+        assert!("go:1.23,go:1.24".parse::<CanaryVersions>().is_err());
+    }
+
+    #[test]
+    fn test_errors_are_compared_by_message() {
+        assert_eq!(outcome_text(&Err("boom".into())), "error: boom");
+        assert_eq!(outcome_text(&Ok("out".into())), "out");
+    }
+}
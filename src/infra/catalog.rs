@@ -0,0 +1,128 @@
+use std::time::Duration;
+
+use futures_util::future::join_all;
+use serde::Serialize;
+use tokio::sync::OnceCell;
+use utoipa::ToSchema;
+
+use super::{
+    arch, language::Language, plugin::plugins, runner::ExecContext, sandbox::as_sandbox_user,
+};
+use crate::config::config;
+
+const PROBE_TIMEOUT: Duration = Duration::from_secs(5);
+
+// A language this instance accepts, as listed by /api/v1/languages.
+#[derive(Debug, Clone, Serialize, ToSchema)]
+pub struct LanguageInfo {
+    #[schema(example = "dart")]
+    pub name: String,
+    pub compiled: bool,
+    // As the toolchain reports it; missing when it cannot be asked or is
+    // not installed.
+    #[schema(example = "Dart SDK version: 3.5.0 (stable)")]
+    pub version: Option<String>,
+    // The architecture programs run on, the host's.
+    #[schema(example = "aarch64")]
+    pub arch: &'static str,
+    // False for languages whose programs cannot run on this architecture.
+    pub available: bool,
+}
+
+// The first line the toolchain prints about its version. Some write it to
+// stderr rather than stdout.
+async fn probe_version(language: Language) -> Option<String> {
+    let (binary, args) = language.version_command()?;
+    let mut ctx = ExecContext::default();
+    if let Some(dir) = config().await.toolchain_dirs().for_lang(language.as_str()) {
+        ctx = ctx.with_toolchain_dir(dir.to_path_buf());
+    }
+    let mut cmd = ctx.command(binary).ok()?;
+    cmd.args(args).kill_on_drop(true);
+    let output = tokio::time::timeout(PROBE_TIMEOUT, cmd.output())
+        .await
+        .ok()?
+        .ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    [output.stdout, output.stderr]
+        .into_iter()
+        .find_map(|stream| {
+            String::from_utf8_lossy(&stream)
+                .lines()
+                .map(str::trim)
+                .find(|line| !line.is_empty())
+                .map(str::to_string)
+        })
+}
+
+// Toolchains are only replaced along with the server, so they are asked
+// once.
+static BUILTIN: OnceCell<Vec<LanguageInfo>> = OnceCell::const_new();
+
+async fn builtin_languages() -> Vec<LanguageInfo> {
+    let versions =
+        join_all(Language::ALL.map(|language| as_sandbox_user(probe_version(language)))).await;
+    Language::ALL
+        .into_iter()
+        .zip(versions)
+        .map(|(language, version)| LanguageInfo {
+            name: language.as_str().to_string(),
+            compiled: language.is_compiled(),
+            version,
+            arch: arch::host_arch(),
+            available: arch::runs_here(language),
+        })
+        .collect()
+}
+
+// What the installed toolchain for `language` reports about its version.
+pub async fn builtin_version(language: Language) -> Option<String> {
+    BUILTIN
+        .get_or_init(builtin_languages)
+        .await
+        .iter()
+        .find(|info| info.name == language.as_str())?
+        .version
+        .clone()
+}
+
+// Built-in languages, then the plugins registered right now.
+pub async fn languages() -> Vec<LanguageInfo> {
+    let mut languages = BUILTIN.get_or_init(builtin_languages).await.clone();
+    let registry = plugins();
+    languages.extend(registry.names().filter_map(|name| {
+        let description = registry.get(name)?.description();
+        Some(LanguageInfo {
+            name: name.to_string(),
+            compiled: description.compiled,
+            version: Some(description.version.clone()),
+            arch: arch::host_arch(),
+            available: true,
+        })
+    }));
+    languages
+}
+
+#[cfg(test)]
+mod catalog_tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_probe_version_reads_the_first_line() {
+        let version = probe_version(Language::Python).await.unwrap();
+        assert!(version.starts_with("Python 3"), "{}", version);
+        assert_eq!(probe_version(Language::WASM).await, None);
+    }
+
+    #[tokio::test]
+    async fn test_languages_lists_every_builtin() {
+        let languages = languages().await;
+        let dart = languages.iter().find(|info| info.name == "dart").unwrap();
+        assert!(dart.compiled);
+        for language in Language::ALL {
+            assert!(languages.iter().any(|info| info.name == language.as_str()));
+        }
+    }
+}
@@ -0,0 +1,125 @@
+use std::{future::Future, time::Duration};
+
+use tokio::sync::OnceCell;
+
+use super::{error::InfraError, metrics};
+use crate::config::config;
+
+const FAULTS_METRIC: &str = "comphub_chaos_faults_total";
+
+// Probabilities in [0, 1] for each kind of fault injected into a run.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct ChaosLimits {
+    pub failure_rate: f64,
+    pub slow_rate: f64,
+    pub max_delay: Duration,
+    pub partial_rate: f64,
+}
+
+// Randomly breaks executions so operators can exercise client retries and
+// alerting. Only active when explicitly enabled in the configuration.
+pub struct Chaos {
+    limits: Option<ChaosLimits>,
+}
+
+static CHAOS: OnceCell<Chaos> = OnceCell::const_new();
+
+async fn init_chaos() -> Chaos {
+    let limits = config().await.chaos_limits();
+    if let Some(limits) = limits {
+        tracing::warn!(
+            "chaos mode is enabled, executions will fail at random: {:?}",
+            limits
+        );
+    }
+    Chaos::new(limits)
+}
+
+pub async fn chaos() -> &'static Chaos {
+    CHAOS.get_or_init(init_chaos).await
+}
+
+fn roll(rate: f64) -> bool {
+    rate > 0.0 && fastrand::f64() < rate
+}
+
+impl Chaos {
+    pub fn new(limits: Option<ChaosLimits>) -> Self {
+        Chaos { limits }
+    }
+
+    pub async fn inject<F>(&self, run: F) -> Result<String, InfraError>
+    where
+        F: Future<Output = Result<String, InfraError>>,
+    {
+        let Some(limits) = self.limits else {
+            return run.await;
+        };
+
+        if roll(limits.failure_rate) {
+            metrics::increment(FAULTS_METRIC, &[("fault", "failure")]);
+            return Err(InfraError::InjectedFault("sandbox failed to start".into()));
+        }
+        if roll(limits.slow_rate) {
+            metrics::increment(FAULTS_METRIC, &[("fault", "slow")]);
+            let max = limits.max_delay.as_millis() as u64;
+            tokio::time::sleep(Duration::from_millis(fastrand::u64(0..=max))).await;
+        }
+
+        let mut output = run.await?;
+        if roll(limits.partial_rate) {
+            metrics::increment(FAULTS_METRIC, &[("fault", "partial")]);
+            let mut end = fastrand::usize(0..=output.len());
+            while !output.is_char_boundary(end) {
+                end -= 1;
+            }
+            output.truncate(end);
+        }
+        Ok(output)
+    }
+}
+
+#[cfg(test)]
+mod chaos_tests {
+    use super::*;
+
+    fn limits() -> ChaosLimits {
+        ChaosLimits {
+            max_delay: Duration::from_millis(10),
+            ..Default::default()
+        }
+    }
+
+    #[tokio::test]
+    async fn test_disabled_chaos_passes_results_through() {
+        let chaos = Chaos::new(None);
+        let result = chaos.inject(async { Ok("hello".to_string()) }).await;
+        assert_eq!(result.unwrap(), "hello");
+    }
+
+    #[tokio::test]
+    async fn test_failure_skips_the_run() {
+        let chaos = Chaos::new(Some(ChaosLimits {
+            failure_rate: 1.0,
+            ..limits()
+        }));
+        let result = chaos
+            .inject(async { panic!("run should not be polled") })
+            .await;
+        assert!(matches!(result, Err(InfraError::InjectedFault(_))));
+    }
+
+    #[tokio::test]
+    async fn test_partial_output_is_a_prefix() {
+        let chaos = Chaos::new(Some(ChaosLimits {
+            slow_rate: 1.0,
+            partial_rate: 1.0,
+            ..limits()
+        }));
+        let output = chaos
+            .inject(async { Ok("héllo wörld".to_string()) })
+            .await
+            .unwrap();
+        assert!("héllo wörld".starts_with(&output));
+    }
+}
@@ -0,0 +1,222 @@
+use std::{fs, io, os::unix::process::ExitStatusExt, path::Path, process::Stdio, time::Duration};
+
+use tempfile::TempDir;
+use tokio::process::Command;
+
+use super::{
+    disk::execution_zone,
+    interactive::{Judgement, Verdict},
+};
+
+// How many differing lines a diff quotes, and how much of each.
+const DIFF_MAX_LINES: usize = 20;
+const LINE_MAX_CHARS: usize = 200;
+// How long a checker has to make up its mind about one output.
+const CHECKER_TIMEOUT: Duration = Duration::from_secs(10);
+// Files a checker is pointed at, in the order testlib checkers take them on
+// their command line.
+const INPUT_FILE: &str = "input.txt";
+const OUTPUT_FILE: &str = "output.txt";
+const ANSWER_FILE: &str = "answer.txt";
+
+// How a program's output is held against the expected output. Output that
+// only a stricter mode rejects, for how it is spaced or split across lines,
+// is a presentation error.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Comparison {
+    // Byte for byte.
+    Exact,
+    // Line by line, ignoring trailing whitespace on each line and trailing
+    // blank lines. The judge compares this way.
+    Lines,
+    // Whitespace-separated tokens, however they are spaced.
+    Tokens,
+    // Tokens, with numbers accepted within `epsilon` of the expected one,
+    // absolutely or relative to it, whichever is looser.
+    Float { epsilon: f64 },
+}
+
+fn lines(text: &str) -> Vec<&str> {
+    let mut lines: Vec<_> = text.lines().map(str::trim_end).collect();
+    while lines.last().is_some_and(|line| line.is_empty()) {
+        lines.pop();
+    }
+    lines
+}
+
+fn close_enough(expected: &str, actual: &str, epsilon: f64) -> bool {
+    if expected == actual {
+        return true;
+    }
+    match (expected.parse::<f64>(), actual.parse::<f64>()) {
+        (Ok(expected), Ok(actual)) => {
+            (expected - actual).abs() <= epsilon * expected.abs().max(1.0)
+        }
+        _ => false,
+    }
+}
+
+impl Comparison {
+    pub fn verdict(&self, expected: &str, actual: &str) -> Verdict {
+        let same_tokens = || actual.split_whitespace().eq(expected.split_whitespace());
+        let accepted = match self {
+            Comparison::Exact => actual == expected,
+            Comparison::Lines => lines(actual) == lines(expected),
+            Comparison::Tokens => same_tokens(),
+            Comparison::Float { epsilon } => {
+                let (expected, actual): (Vec<_>, Vec<_>) = (
+                    expected.split_whitespace().collect(),
+                    actual.split_whitespace().collect(),
+                );
+                expected.len() == actual.len()
+                    && expected
+                        .iter()
+                        .zip(&actual)
+                        .all(|(expected, actual)| close_enough(expected, actual, *epsilon))
+            }
+        };
+        if accepted {
+            Verdict::Accepted
+        } else if matches!(self, Comparison::Exact | Comparison::Lines) && same_tokens() {
+            Verdict::PresentationError
+        } else {
+            Verdict::WrongAnswer
+        }
+    }
+}
+
+// The lines `after` differs from `before` in, compared line by line: each
+// line of `before` is quoted with a `-` and each of `after` with a `+`.
+pub fn diff(before: &str, after: &str) -> Vec<String> {
+    let quote = |sign: char, line: &str| {
+        let line: String = line.chars().take(LINE_MAX_CHARS).collect();
+        format!("{}{}", sign, line)
+    };
+    let (before, after): (Vec<_>, Vec<_>) = (before.lines().collect(), after.lines().collect());
+    let mut lines = Vec::new();
+    for i in 0..before.len().max(after.len()) {
+        let (old, new) = (before.get(i), after.get(i));
+        if old == new {
+            continue;
+        }
+        lines.extend(old.map(|line| quote('-', line)));
+        lines.extend(new.map(|line| quote('+', line)));
+        if lines.len() >= DIFF_MAX_LINES {
+            lines.truncate(DIFF_MAX_LINES);
+            break;
+        }
+    }
+    lines
+}
+
+// Has one of the operator's checkers judge `actual`, given the test's input
+// and the expected answer as files and answering with testlib's exit codes
+// and a message on stderr. Like interactors, checkers are trusted and run
+// outside the sandbox.
+pub async fn run_checker(
+    checker: &Path,
+    input: &str,
+    expected: &str,
+    actual: &str,
+) -> io::Result<Judgement> {
+    let dir = TempDir::new_in(execution_zone())?;
+    for (file, contents) in [
+        (INPUT_FILE, input),
+        (OUTPUT_FILE, actual),
+        (ANSWER_FILE, expected),
+    ] {
+        fs::write(dir.path().join(file), contents)?;
+    }
+    let run = Command::new(checker)
+        .current_dir(dir.path())
+        .args([INPUT_FILE, OUTPUT_FILE, ANSWER_FILE])
+        .kill_on_drop(true)
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        .stderr(Stdio::piped())
+        .output();
+    let Ok(output) = tokio::time::timeout(CHECKER_TIMEOUT, run).await else {
+        return Ok(Judgement {
+            verdict: Verdict::JudgeError,
+            message: format!(
+                "checker gave no verdict within {}s",
+                CHECKER_TIMEOUT.as_secs()
+            ),
+        });
+    };
+    let output = output?;
+
+    let mut message = String::from_utf8_lossy(&output.stderr).trim().to_string();
+    if let Some(signal) = output.status.signal() {
+        message = format!("checker killed by signal {}\n{}", signal, message)
+            .trim_end()
+            .to_string();
+    }
+    Ok(Judgement {
+        verdict: Verdict::from_status(output.status),
+        message,
+    })
+}
+
+#[cfg(test)]
+mod compare_tests {
+    use std::os::unix::fs::PermissionsExt;
+
+    use super::*;
+
+    #[test]
+    fn test_modes_differ_in_what_they_forgive() {
+        let lines = Comparison::Lines;
+        assert_eq!(lines.verdict("7\n8", "7  \n8\n\n"), Verdict::Accepted);
+        assert_eq!(lines.verdict("7\n8\n", "7 8\n"), Verdict::PresentationError);
+        assert_eq!(lines.verdict("7\n", " 7\n"), Verdict::PresentationError);
+        assert_eq!(lines.verdict("7\n8\n", "7\n9\n"), Verdict::WrongAnswer);
+
+        let exact = Comparison::Exact;
+        assert_eq!(exact.verdict("7\n", "7\n"), Verdict::Accepted);
+        assert_eq!(exact.verdict("7\n", "7"), Verdict::PresentationError);
+
+        let tokens = Comparison::Tokens;
+        assert_eq!(tokens.verdict("7\n8\n", " 7 8"), Verdict::Accepted);
+        assert_eq!(tokens.verdict("7 8", "7 8 9"), Verdict::WrongAnswer);
+    }
+
+    #[test]
+    fn test_float_mode_accepts_numbers_within_epsilon() {
+        let float = Comparison::Float { epsilon: 1e-6 };
+        assert_eq!(float.verdict("0.5 x", "0.5000001\nx"), Verdict::Accepted);
+        assert_eq!(float.verdict("1000000", "1000000.5"), Verdict::Accepted);
+        assert_eq!(float.verdict("0.5", "0.5001"), Verdict::WrongAnswer);
+        assert_eq!(float.verdict("0.5 1", "0.5"), Verdict::WrongAnswer);
+        assert_eq!(float.verdict("yes", "no"), Verdict::WrongAnswer);
+    }
+
+    #[test]
+    fn test_diff_quotes_only_the_lines_that_differ() {
+        assert!(diff("a\nb\n", "a\nb\n").is_empty());
+        assert_eq!(diff("a\nb\nc\n", "a\nB\nc\nd\n"), ["-b", "+B", "+d"]);
+        let long = "x\n".repeat(DIFF_MAX_LINES);
+        assert_eq!(diff(&long, "").len(), DIFF_MAX_LINES);
+    }
+
+    #[tokio::test]
+    async fn test_checker_judges_by_exit_code() {
+        let dir = TempDir::new().unwrap();
+        let checker = dir.path().join("sum");
+        fs::write(
+            &checker,
+            "#!/bin/sh\n\
+             [ \"$(cat output.txt)\" = \"$(cat answer.txt)\" ] && exit 0\n\
+             echo \"expected $(cat answer.txt) for $(cat input.txt)\" >&2\n\
+             exit 1\n",
+        )
+        .unwrap();
+        fs::set_permissions(&checker, fs::Permissions::from_mode(0o755)).unwrap();
+
+        let judgement = run_checker(&checker, "3 4", "7", "7").await.unwrap();
+        assert_eq!(judgement.verdict, Verdict::Accepted);
+        let judgement = run_checker(&checker, "3 4", "7", "8").await.unwrap();
+        assert_eq!(judgement.verdict, Verdict::WrongAnswer);
+        assert_eq!(judgement.message, "expected 7 for 3 4");
+    }
+}
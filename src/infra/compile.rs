@@ -1,33 +1,266 @@
+use std::time::Instant;
+
+use crate::config::{Config, config};
+
 use super::{
-    brainfuck::compile_brainfuck, c::compile_c, cpp::compile_cpp, crystal::compile_crystal, d::compile_d, dart::compile_dart, error::InfraError, go::compile_go, groovy::compile_groovy, haskell::compile_haskell, javascript::compile_javascript, julia::compile_julia, lua::compile_lua, nix::compile_nix, perl::compile_perl, python::compile_python, r::compile_r, ruby::compile_ruby, rust::compile_rust, scala::compile_scala, zig::compile_zig
+    assembly::compile_assembly, bash::compile_bash, brainfuck::compile_brainfuck, c::compile_c, calibration::calibration, chaos::chaos, cpp::compile_cpp, cpuset::core_pool, crystal::compile_crystal, d::compile_d, dart::compile_dart, elixir::compile_elixir, error::InfraError, fortran::compile_fortran, go::compile_go, language::Language, limits::{LanguageDefaults, language_defaults}, groovy::compile_groovy, haskell::compile_haskell, hooks::apply_hooks, interpreter::interpreter, javascript::{compile_javascript, compile_typescript}, lua::compile_lua, nix::compile_nix, ocaml::compile_ocaml, python::compile_python, r::compile_r, ruby::compile_ruby, runner::{ExecContext, PartialOutput}, rust::compile_rust, sandbox::{as_sandbox_user, sandbox_user}, scala::compile_scala, snippet::in_memory, sql::compile_sql, starlark::compile_starlark, swift::compile_swift, toolchain::Toolchain, wasm::compile_wasm, zig::compile_zig
 };
 
-pub async fn compile_lang(lang: &str, content: &str, stdin: &str) -> Result<String, InfraError> {
-    match lang {
-        "python" => compile_python(content, stdin).await,
-        "javascript" => compile_javascript(content, stdin).await,
-        "typescript" => compile_javascript(content, stdin).await,
-        "c" => compile_c(content, stdin).await,
-        "cpp" => compile_cpp(content, stdin).await,
-        "rust" => compile_rust(content, stdin).await,
-        "nix" => compile_nix(content, stdin).await,
-        "go" => compile_go(content, stdin).await,
-        "zig" => compile_zig(content, stdin).await,
-        "d" => compile_d(content, stdin).await,
-        "scala" => compile_scala(content, stdin).await,
-        "groovy" => compile_groovy(content, stdin).await,
-        "dart" => compile_dart(content, stdin).await,
-        "ruby" => compile_ruby(content, stdin).await,
-        "lua" => compile_lua(content, stdin).await,
-        "julia" => compile_julia(content, stdin).await,
-        "r" => compile_r(content, stdin).await,
-        "perl" => compile_perl(content, stdin).await,
-        "crystal" => compile_crystal(content, stdin).await,
-        "haskell" => compile_haskell(content, stdin).await,
-        "brainfuck" => compile_brainfuck(content, stdin).await,
-        _ => Err(InfraError::UnsupportedLanguage(format!(
-            "{} languages is not supported",
-            lang
-        ))),
+pub async fn compile_lang(
+    lang: &str,
+    content: &str,
+    stdin: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let toolchain = Toolchain::resolve(lang)?;
+    let content = &*apply_hooks(&toolchain, content).await?;
+    // Waiting for cores is not part of the run, so it happens before the
+    // timeout starts.
+    let lease = match core_pool().await {
+        Some(pool) => Some(pool.acquire().await),
+        None => None,
+    };
+    let mut confined = confine(ctx.clone(), &toolchain, config().await, language_defaults().await)
+        .with_partial_output(PartialOutput::default());
+    if let Some(lease) = &lease {
+        confined = confined.with_cpus(lease.cores().to_vec());
+    }
+    as_sandbox_user(run_confined(toolchain, content, stdin, &confined)).await
+}
+
+// Runs a program confined by `compile_lang` as the run's own sandbox user,
+// who is first handed the directories the run's tools write reports to.
+async fn run_confined(
+    toolchain: Toolchain,
+    content: &str,
+    stdin: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    if let Some(user) = sandbox_user()? {
+        for dir in [ctx.coverage_dir(), ctx.sanitizer_dir(), ctx.profile_dir()]
+            .into_iter()
+            .flatten()
+        {
+            user.grant(dir)?;
+        }
+    }
+    let run = chaos().await.inject(async move {
+        match toolchain {
+            Toolchain::Builtin(language) => dispatch(language, content, stdin, ctx).await,
+            Toolchain::Plugin(plugin) => plugin.execute(content, stdin, ctx).await,
+        }
+    });
+    let started = Instant::now();
+    let result = match ctx.timeout() {
+        Some(limit) => {
+            let limit = limit + ctx.compile_timeout().unwrap_or_default();
+            let limit = calibration().await.scale(limit);
+            tokio::time::timeout(limit, run).await.map_err(|_| {
+                InfraError::Timeout(limit, Box::new(ctx.partial_run(started.elapsed())))
+            })?
+        }
+        None => run.await,
+    };
+    result.map_err(|err| match err {
+        InfraError::CompilationError(err) => {
+            InfraError::CompilationError(ctx.crashed(err, started.elapsed()))
+        }
+        err => err,
+    })
+}
+
+// Adds the sandboxing and limits the server config requires for `toolchain`.
+pub fn confine(
+    mut ctx: ExecContext,
+    toolchain: &Toolchain,
+    app_config: &Config,
+    defaults: &LanguageDefaults,
+) -> ExecContext {
+    if let Some(seccomp) = app_config.seccomp() {
+        let mut profile = seccomp.profile_for(toolchain);
+        if ctx.is_offline() {
+            profile = profile.without_network();
+        }
+        ctx = ctx.with_syscall_profile(seccomp.launcher.clone(), profile);
+    }
+    // A version the request picked brings its own toolchain.
+    if ctx.toolchain_dir().is_none() {
+        if let Some(dir) = app_config.toolchain_dirs().for_lang(toolchain.as_str()) {
+            ctx = ctx.with_toolchain_dir(dir.to_path_buf());
+        }
+    }
+    // Limits already on the context come from the caller's tier; the
+    // language's defaults fill in the rest before the server-wide ones.
+    let limits = match toolchain {
+        Toolchain::Builtin(language) => defaults.for_language(*language),
+        Toolchain::Plugin(plugin) => plugin.limits(),
+    };
+    if let Some(limits) = limits {
+        ctx = limits.apply(ctx);
+    }
+    if ctx.timeout().is_none() {
+        ctx = ctx.with_timeout(app_config.exec_timeout());
+    }
+    // A compile step with a limit of its own comes on top of the timeout,
+    // which then bounds the program alone.
+    if let (Some(_), None, Some(timeout)) =
+        (ctx.compile_timeout(), ctx.program_timeout(), ctx.timeout())
+    {
+        ctx = ctx.with_program_timeout(timeout);
+    }
+    if let (None, Some(quota)) = (ctx.disk_quota(), app_config.disk_quota()) {
+        ctx = ctx.with_disk_quota(quota);
+    }
+    ctx
+}
+
+async fn dispatch(
+    language: Language,
+    content: &str,
+    stdin: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    // Short programs skip the source file, and its directory, altogether.
+    let max_bytes = config().await.snippet_max_bytes();
+    if let Some(snippet) = in_memory(language, content, stdin, ctx, max_bytes) {
+        return snippet.run(content, ctx).await;
+    }
+    match language {
+        Language::Python => compile_python(content, stdin, ctx).await,
+        Language::JAVASCRIPT => compile_javascript(content, stdin, ctx).await,
+        Language::TYPESCRIPT => compile_typescript(content, stdin, ctx).await,
+        Language::C => compile_c(content, stdin, ctx).await,
+        Language::CPP => compile_cpp(content, stdin, ctx).await,
+        Language::RUST => compile_rust(content, stdin, ctx).await,
+        Language::NIX => compile_nix(content, stdin, ctx).await,
+        Language::GO => compile_go(content, stdin, ctx).await,
+        Language::ZIG => compile_zig(content, stdin, ctx).await,
+        Language::D => compile_d(content, stdin, ctx).await,
+        Language::SWIFT => compile_swift(content, stdin, ctx).await,
+        Language::SCALA => compile_scala(content, stdin, ctx).await,
+        Language::GROOVY => compile_groovy(content, stdin, ctx).await,
+        Language::DART => compile_dart(content, stdin, ctx).await,
+        Language::RUBY => compile_ruby(content, stdin, ctx).await,
+        Language::LUA => compile_lua(content, stdin, ctx).await,
+        Language::R => compile_r(content, stdin, ctx).await,
+        Language::CRYSTAL => compile_crystal(content, stdin, ctx).await,
+        Language::HASKELL => compile_haskell(content, stdin, ctx).await,
+        Language::FORTRAN => compile_fortran(content, stdin, ctx).await,
+        Language::OCAML => compile_ocaml(content, stdin, ctx).await,
+        Language::ELIXIR => compile_elixir(content, stdin, ctx).await,
+        Language::BASH => compile_bash(content, stdin, ctx).await,
+        Language::ASSEMBLY => compile_assembly(content, stdin, ctx).await,
+        Language::SQL => compile_sql(content, stdin, ctx).await,
+        Language::BRAINFUCK => compile_brainfuck(content, stdin, ctx).await,
+        Language::WASM => compile_wasm(content, stdin, ctx).await,
+        Language::STARLARK => compile_starlark(content, stdin, ctx).await,
+        // Rows of the interpreter table.
+        Language::PERL | Language::PHP | Language::JULIA => match interpreter(language) {
+            Some(interpreter) => interpreter.run(content, stdin, ctx).await,
+            None => Err(InfraError::UnsupportedLanguage(format!(
+                "{} language is not supported",
+                language
+            ))),
+        },
+    }
+}
+
+#[cfg(test)]
+mod compile_tests {
+    use super::*;
+    use crate::infra::error::Crash;
+    use std::{
+        os::unix::process::ExitStatusExt,
+        time::{Duration, Instant},
+    };
+
+    #[tokio::test]
+    async fn test_compile_lang_enforces_timeout() {
+        let ctx = ExecContext::default().with_timeout(Duration::from_millis(200));
+        let started = Instant::now();
+        let err = compile_lang("python", "import time\ntime.sleep(30)", "", &ctx)
+            .await
+            .unwrap_err();
+
+        assert!(matches!(err, InfraError::Timeout(..)));
+        assert!(started.elapsed() < Duration::from_secs(5));
+    }
+
+    #[tokio::test]
+    async fn test_compile_step_is_not_cut_off_by_the_run_timeout() {
+        let dir = tempfile::TempDir::new().unwrap();
+        std::fs::write(
+            dir.path().join("slowsh.json"),
+            r#"{
+                "extension": "sh",
+                "compile": ["sh", "-c", "sleep 1 && cp {source} {exe}"],
+                "run": ["sh", "{exe}"],
+                "limits": {"compile_timeout_secs": 5}
+            }"#,
+        )
+        .unwrap();
+        let registry = crate::infra::plugin::PluginRegistry::discover(dir.path()).await;
+        let registry = Box::leak(Box::new(registry));
+        let toolchain = Toolchain::Plugin(registry.get("slowsh").unwrap());
+        let ctx = confine(
+            ExecContext::default().with_timeout(Duration::from_millis(500)),
+            &toolchain,
+            config().await,
+            &LanguageDefaults::default(),
+        );
+        assert_eq!(ctx.program_timeout(), Some(Duration::from_millis(500)));
+
+        let output = run_confined(toolchain, "echo built", "", &ctx)
+            .await
+            .unwrap();
+        assert_eq!(output, "built\n");
+
+        let started = Instant::now();
+        assert!(run_confined(toolchain, "sleep 30", "", &ctx).await.is_err());
+        assert!(started.elapsed() < Duration::from_secs(5));
+    }
+
+    #[tokio::test]
+    async fn test_compile_lang_reports_output_written_before_timeout() {
+        let ctx = ExecContext::default().with_timeout(Duration::from_millis(500));
+        let content = "import sys, time\nprint('started', flush=True)\n\
+                       print('warning', file=sys.stderr, flush=True)\ntime.sleep(30)";
+        let err = compile_lang("python", content, "", &ctx)
+            .await
+            .unwrap_err();
+
+        let InfraError::Timeout(limit, partial) = err else {
+            panic!("unexpected error: {}", err);
+        };
+        assert!(partial.elapsed >= limit);
+        assert_eq!(partial.stdout, "started\n");
+        assert_eq!(partial.stderr, "warning\n");
+    }
+
+    #[tokio::test]
+    async fn test_compile_lang_reports_output_written_before_crash() {
+        let ctx = ExecContext::default();
+        let content = "import os, signal\nprint('started', flush=True)\n\
+                       os.kill(os.getpid(), signal.SIGSEGV)";
+        let err = compile_lang("python", content, "", &ctx)
+            .await
+            .unwrap_err();
+
+        let InfraError::CompilationError(err) = err else {
+            panic!("unexpected error: {}", err);
+        };
+        let crash = err.downcast_ref::<Crash>().unwrap();
+        assert_eq!(crash.status.signal(), Some(libc::SIGSEGV));
+        assert_eq!(crash.output.stdout, "started\n");
+        assert!(err.to_string().contains("terminated by signal"));
+        assert!(err.to_string().contains("Signal: SIGSEGV (segmentation fault)"));
+
+        // Nothing ran, so there is nothing to add.
+        let err = compile_lang("rust", "fn main() { oops }", "", &ctx)
+            .await
+            .unwrap_err();
+        if let InfraError::CompilationError(err) = err {
+            assert!(err.downcast_ref::<Crash>().is_none());
+        }
     }
 }
@@ -0,0 +1,215 @@
+use std::{collections::BTreeMap, fs, io, path::Path};
+
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use utoipa::ToSchema;
+
+use super::{error::InfraError, language::Language};
+
+// Where a language's runner leaves the normalized report for the handler.
+const REPORT_FILE: &str = "report.json";
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize, ToSchema)]
+pub struct FileCoverage {
+    #[schema(example = "main.py")]
+    pub file: String,
+    // Statements, or lines for JavaScript, that ran at least once.
+    pub covered: u64,
+    pub total: u64,
+    #[schema(example = 87.5)]
+    pub percent: f64,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize, ToSchema)]
+pub struct CoverageReport {
+    #[schema(example = 87.5)]
+    pub percent: f64,
+    pub files: Vec<FileCoverage>,
+}
+
+// The languages whose runners can measure coverage, with the tool they use.
+pub fn supports(language: Language) -> bool {
+    matches!(
+        language,
+        Language::Python | Language::GO | Language::JAVASCRIPT
+    )
+}
+
+fn percent(covered: u64, total: u64) -> f64 {
+    if total == 0 {
+        return 100.0;
+    }
+    (covered as f64 * 10000.0 / total as f64).round() / 100.0
+}
+
+// Reports paths relative to the directory the program was written to, so
+// they read as the submitted file's name.
+fn relative(path: &str, source_dir: &Path) -> String {
+    Path::new(path)
+        .strip_prefix(source_dir)
+        .map(|path| path.to_string_lossy().into_owned())
+        .unwrap_or_else(|_| path.to_string())
+}
+
+fn invalid(tool: &str, reason: impl std::fmt::Display) -> InfraError {
+    InfraError::CompilationError(format!("unreadable {} coverage data: {}", tool, reason).into())
+}
+
+impl CoverageReport {
+    fn from_counts(counts: BTreeMap<String, (u64, u64)>) -> Self {
+        let (covered, total) = counts
+            .values()
+            .fold((0, 0), |(c, t), (covered, total)| (c + covered, t + total));
+        let files = counts
+            .into_iter()
+            .map(|(file, (covered, total))| FileCoverage {
+                file,
+                covered,
+                total,
+                percent: percent(covered, total),
+            })
+            .collect();
+        CoverageReport {
+            percent: percent(covered, total),
+            files,
+        }
+    }
+
+    // `go tool covdata textfmt` output: one `file:start,end statements count`
+    // line per block, repeated once per process that ran it.
+    pub fn from_go_profile(profile: &str, source_dir: &Path) -> Result<Self, InfraError> {
+        let mut blocks: BTreeMap<(&str, &str), (u64, bool)> = BTreeMap::new();
+        for line in profile.lines().filter(|line| !line.starts_with("mode:")) {
+            let mut fields = line.rsplitn(3, ' ');
+            let (Some(count), Some(statements), Some(block)) =
+                (fields.next(), fields.next(), fields.next())
+            else {
+                continue;
+            };
+            let (file, range) = block.rsplit_once(':').ok_or_else(|| invalid("go", line))?;
+            let statements = statements
+                .parse::<u64>()
+                .map_err(|err| invalid("go", err))?;
+            let ran = count.parse::<u64>().map_err(|err| invalid("go", err))? > 0;
+            let entry = blocks.entry((file, range)).or_insert((statements, false));
+            entry.1 |= ran;
+        }
+        let mut counts = BTreeMap::new();
+        for ((file, _), (statements, ran)) in blocks {
+            let entry: &mut (u64, u64) = counts.entry(relative(file, source_dir)).or_default();
+            entry.1 += statements;
+            if ran {
+                entry.0 += statements;
+            }
+        }
+        Ok(Self::from_counts(counts))
+    }
+
+    // `coverage json` output, counting statements.
+    pub fn from_coverage_py(json: &str, source_dir: &Path) -> Result<Self, InfraError> {
+        let report: Value = serde_json::from_str(json).map_err(|err| invalid("python", err))?;
+        let files = report["files"]
+            .as_object()
+            .ok_or_else(|| invalid("python", "missing files"))?;
+        let counts = files
+            .iter()
+            .map(|(file, data)| {
+                let summary = &data["summary"];
+                let covered = summary["covered_lines"].as_u64().unwrap_or_default();
+                let total = summary["num_statements"].as_u64().unwrap_or_default();
+                (relative(file, source_dir), (covered, total))
+            })
+            .collect();
+        Ok(Self::from_counts(counts))
+    }
+
+    // c8's `json-summary` report, counting lines. The `total` entry is
+    // recomputed rather than trusted.
+    pub fn from_c8_summary(json: &str, source_dir: &Path) -> Result<Self, InfraError> {
+        let report: Value = serde_json::from_str(json).map_err(|err| invalid("c8", err))?;
+        let files = report
+            .as_object()
+            .ok_or_else(|| invalid("c8", "expected an object"))?;
+        let counts = files
+            .iter()
+            .filter(|(file, _)| *file != "total")
+            .map(|(file, data)| {
+                let lines = &data["lines"];
+                let covered = lines["covered"].as_u64().unwrap_or_default();
+                let total = lines["total"].as_u64().unwrap_or_default();
+                (relative(file, source_dir), (covered, total))
+            })
+            .collect();
+        Ok(Self::from_counts(counts))
+    }
+
+    pub fn save(&self, dir: &Path) -> Result<(), InfraError> {
+        let json = serde_json::to_vec(self).map_err(|err| invalid("normalized", err))?;
+        fs::write(dir.join(REPORT_FILE), json)?;
+        Ok(())
+    }
+
+    // The report a run left in `dir`; none if the runner never got to write
+    // one.
+    pub fn load(dir: &Path) -> io::Result<Option<Self>> {
+        let json = match fs::read(dir.join(REPORT_FILE)) {
+            Ok(json) => json,
+            Err(err) if err.kind() == io::ErrorKind::NotFound => return Ok(None),
+            Err(err) => return Err(err),
+        };
+        serde_json::from_slice(&json)
+            .map(Some)
+            .map_err(|err| io::Error::new(io::ErrorKind::InvalidData, err))
+    }
+}
+
+#[cfg(test)]
+mod coverage_tests {
+    use super::*;
+
+    #[test]
+    fn test_go_profile_merges_blocks_across_processes() {
+        let profile = "mode: set\n\
+            /tmp/src/main.go:6.2,6.11 1 1\n\
+            /tmp/src/main.go:7.3,8.1 1 0\n\
+            /tmp/src/main.go:9.2,9.10 2 0\n\
+            /tmp/src/main.go:7.3,8.1 1 1\n";
+        let report = CoverageReport::from_go_profile(profile, Path::new("/tmp/src")).unwrap();
+        assert_eq!(report.percent, 50.0);
+        assert_eq!(
+            report.files,
+            [FileCoverage {
+                file: "main.go".into(),
+                covered: 2,
+                total: 4,
+                percent: 50.0,
+            }]
+        );
+    }
+
+    #[test]
+    fn test_coverage_py_and_c8_reports_are_normalized() {
+        let python = r#"{"files": {"/tmp/src/main.py": {"summary":
+            {"covered_lines": 2, "num_statements": 3, "percent_covered": 66.66}}},
+            "totals": {"percent_covered": 66.66}}"#;
+        let report = CoverageReport::from_coverage_py(python, Path::new("/tmp/src")).unwrap();
+        assert_eq!(report.percent, 66.67);
+        assert_eq!(report.files[0].file, "main.py");
+
+        let c8 = r#"{"total": {"lines": {"total": 99, "covered": 1}},
+            "/tmp/src/main.js": {"lines": {"total": 4, "covered": 3, "pct": 75}}}"#;
+        let report = CoverageReport::from_c8_summary(c8, Path::new("/tmp/src")).unwrap();
+        assert_eq!(report.percent, 75.0);
+        assert_eq!(report.files.len(), 1);
+        assert_eq!(report.files[0].total, 4);
+    }
+
+    #[test]
+    fn test_report_round_trips_through_dir() {
+        let dir = tempfile::tempdir().unwrap();
+        assert!(CoverageReport::load(dir.path()).unwrap().is_none());
+        let report = CoverageReport::from_counts(BTreeMap::from([("main.go".into(), (0, 0))]));
+        report.save(dir.path()).unwrap();
+        assert_eq!(CoverageReport::load(dir.path()).unwrap(), Some(report));
+    }
+}
@@ -1,48 +1,69 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
-
-pub async fn compile_cpp(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".cpp")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
-
-    let source_path = temp_file.path().to_path_buf();
-    let executable_file = NamedTempFile::new()?;
-    let executable_path = executable_file.path().to_path_buf();
-    drop(executable_file);
-
-    let compile_output = Command::new(which("clang++")?)
-        .arg(source_path)
-        .arg("-o")
-        .arg(&executable_path)
-        .output()
-        .await?;
-
-    if !compile_output.status.success() {
-        let stderr = String::from_utf8_lossy(&compile_output.stderr);
-        return Err(InfraError::CompilationError(
-            format!("C++ compilation failed:\n{}", stderr).into(),
-        ));
-    }
+use super::{
+    error::InfraError,
+    language::Language,
+    profile,
+    runner::ExecContext,
+    sanitizer::{self, SANITIZE_FLAGS},
+    shared_build::build_once,
+    source::SourceFile,
+};
 
-    let mut cmd = Command::new(&executable_path)
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
+pub async fn compile_cpp(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::CPP, content)?;
+    let source_path = source.path().to_path_buf();
+    let executable_path = source.dir().join("main");
 
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
+    build_once(ctx, source.path(), &executable_path, async {
+        let mut compile = ctx.command("clang++")?;
+        if ctx.sanitizer_dir().is_some() {
+            compile.args(SANITIZE_FLAGS);
+        }
+        let compile_output = compile
+            .arg(source_path)
+            .arg("-o")
+            .arg(&executable_path)
+            .args(ctx.compiler_flags())
+            .kill_on_drop(true)
+            .output()
+            .await?;
 
-    let output = cmd.wait_with_output().await?;
+        if !compile_output.status.success() {
+            let stderr = String::from_utf8_lossy(&compile_output.stderr);
+            return Err(InfraError::CompilationError(
+                format!("C++ compilation failed:\n{}", stderr).into(),
+            ));
+        }
+        ctx.record_warnings(&compile_output.stderr);
+        Ok(())
+    })
+    .await?;
+
+    let sanitized;
+    let ctx = match ctx.sanitizer_dir() {
+        Some(_) => {
+            sanitized = ctx.clone().with_envs(sanitizer::options_env());
+            &sanitized
+        }
+        None => ctx,
+    };
+    let output = profile::run_native(&executable_path, stdin_input, ctx).await?;
+    let reports = match ctx.sanitizer_dir() {
+        Some(dir) => sanitizer::collect(&output.stderr, source.dir(), dir)?,
+        None => Vec::new(),
+    };
     match output.status.code() {
-        Some(0) => Ok(String::from_utf8(output.stdout)?),
+        Some(0) => {
+            if let Some(dir) = ctx.profile_dir() {
+                profile::report_native(dir, ctx).await?;
+            }
+            Ok(String::from_utf8(output.stdout)?)
+        }
+        // The reports say why the sanitizer stopped the program.
+        _ if !reports.is_empty() => Ok(String::from_utf8_lossy(&output.stdout).into_owned()),
         Some(code) => {
             let stderr = String::from_utf8_lossy(&output.stderr);
             Err(InfraError::CompilationError(
@@ -75,7 +96,7 @@ int main() {
     return 0;
 }
 "#;
-        let result = compile_cpp(code, "").await;
+        let result = compile_cpp(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
     }
@@ -92,7 +113,7 @@ int main() {
     return 0;
 }
 "#;
-        let result = compile_cpp(code, "Alice").await;
+        let result = compile_cpp(code, "Alice", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, Alice!");
     }
@@ -108,7 +129,7 @@ int main() {
     return 0;
 }
 "#;
-        let result = compile_cpp(code, "5 3").await;
+        let result = compile_cpp(code, "5 3", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "8");
     }
@@ -126,7 +147,7 @@ int main() {
     return 0;
 }
 "#;
-        let result = compile_cpp(code, "Hello\nWorld").await;
+        let result = compile_cpp(code, "Hello\nWorld", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello World");
     }
@@ -140,7 +161,7 @@ int main() {
     return 0;
 }
 "#;
-        let result = compile_cpp(code, "").await;
+        let result = compile_cpp(code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -153,7 +174,7 @@ int main() {
     return 0;
 }
 "#;
-        let result = compile_cpp(code, "").await;
+        let result = compile_cpp(code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -166,7 +187,7 @@ int main() {
     return 1;
 }
 "#;
-        let result = compile_cpp(code, "").await;
+        let result = compile_cpp(code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -180,7 +201,7 @@ int main() {
     return 0;
 }
 "#;
-        let result = compile_cpp(code, "").await;
+        let result = compile_cpp(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "stdout message");
     }
@@ -197,7 +218,7 @@ int main() {
     return 0;
 }
 "#;
-        let result = compile_cpp(code, "").await;
+        let result = compile_cpp(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "1 2 3");
     }
@@ -217,7 +238,7 @@ int main() {
     return 0;
 }
 "#;
-        let result = compile_cpp(code, "").await;
+        let result = compile_cpp(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "15");
     }
@@ -229,7 +250,7 @@ int main() {
     return 0;
 }
 "#;
-        let result = compile_cpp(code, "").await;
+        let result = compile_cpp(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
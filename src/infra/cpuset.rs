@@ -0,0 +1,175 @@
+use std::{str::FromStr, sync::Mutex, time::Instant};
+
+use tokio::sync::{Notify, OnceCell};
+
+use super::metrics;
+use crate::config::config;
+
+const PINNED_METRIC: &str = "comphub_pinned_runs_total";
+const WAIT_METRIC: &str = "comphub_core_wait_ms_total";
+
+// CPU numbers as Linux lists them, such as `2-5,8`.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct CoreList(pub Vec<usize>);
+
+impl FromStr for CoreList {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut cores = Vec::new();
+        for part in s.split(',').map(str::trim).filter(|part| !part.is_empty()) {
+            let invalid = || format!("invalid core list entry {:?}", part);
+            let (first, last) = match part.split_once('-') {
+                Some((first, last)) => (first.trim(), last.trim()),
+                None => (part, part),
+            };
+            let first = first.parse::<usize>().map_err(|_| invalid())?;
+            let last = last.parse::<usize>().map_err(|_| invalid())?;
+            if first > last {
+                return Err(invalid());
+            }
+            for core in first..=last {
+                if cores.contains(&core) {
+                    return Err(format!("core {} is listed twice", core));
+                }
+                cores.push(core);
+            }
+        }
+        Ok(CoreList(cores))
+    }
+}
+
+// Which cores runs are pinned to, and how many each one gets to itself.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct CpuPinning {
+    pub cores: CoreList,
+    pub per_run: usize,
+}
+
+// Hands out the configured cores so that no two runs share one. A run that
+// finds too few free waits for one in progress to give its cores back.
+pub struct CorePool {
+    free: Mutex<Vec<usize>>,
+    released: Notify,
+    per_run: usize,
+}
+
+static POOL: OnceCell<Option<CorePool>> = OnceCell::const_new();
+
+// None unless CPU_PIN_CORES is set.
+pub async fn core_pool() -> Option<&'static CorePool> {
+    POOL.get_or_init(|| async {
+        let pinning = config().await.cpu_pinning()?;
+        tracing::info!(
+            "pinning runs to {} of cores {:?}",
+            pinning.per_run,
+            pinning.cores.0
+        );
+        Some(CorePool::new(pinning))
+    })
+    .await
+    .as_ref()
+}
+
+impl CorePool {
+    fn new(pinning: &CpuPinning) -> Self {
+        CorePool {
+            free: Mutex::new(pinning.cores.0.clone()),
+            released: Notify::new(),
+            per_run: pinning.per_run.clamp(1, pinning.cores.0.len().max(1)),
+        }
+    }
+
+    fn take(&'static self) -> Option<CoreLease> {
+        let mut free = self.free.lock().unwrap();
+        if free.len() < self.per_run {
+            return None;
+        }
+        let cores = free.drain(..self.per_run).collect();
+        Some(CoreLease { pool: self, cores })
+    }
+
+    // Cores for one run, waiting until enough are free.
+    pub async fn acquire(&'static self) -> CoreLease {
+        let started = Instant::now();
+        let lease = loop {
+            let released = self.released.notified();
+            if let Some(lease) = self.take() {
+                break lease;
+            }
+            released.await;
+        };
+        let cores = lease
+            .cores
+            .iter()
+            .map(usize::to_string)
+            .collect::<Vec<_>>()
+            .join(",");
+        metrics::increment(PINNED_METRIC, &[("cores", &cores)]);
+        metrics::add(WAIT_METRIC, &[], started.elapsed().as_millis() as u64);
+        lease
+    }
+}
+
+// Cores held by one run, given back when it is dropped.
+pub struct CoreLease {
+    pool: &'static CorePool,
+    cores: Vec<usize>,
+}
+
+impl CoreLease {
+    pub fn cores(&self) -> &[usize] {
+        &self.cores
+    }
+}
+
+impl Drop for CoreLease {
+    fn drop(&mut self) {
+        let mut free = self.pool.free.lock().unwrap();
+        free.extend(self.cores.drain(..));
+        free.sort_unstable();
+        drop(free);
+        self.pool.released.notify_waiters();
+    }
+}
+
+#[cfg(test)]
+mod cpuset_tests {
+    use std::time::Duration;
+
+    use super::*;
+
+    fn pool(cores: &str, per_run: usize) -> &'static CorePool {
+        Box::leak(Box::new(CorePool::new(&CpuPinning {
+            cores: cores.parse().unwrap(),
+            per_run,
+        })))
+    }
+
+    #[test]
+    fn test_core_list_parses_ranges() {
+        assert_eq!("2-4, 8".parse::<CoreList>().unwrap().0, [2, 3, 4, 8]);
+        assert!("".parse::<CoreList>().unwrap().0.is_empty());
+        assert!("4-2".parse::<CoreList>().is_err());
+        assert!("1,1".parse::<CoreList>().is_err());
+        assert!("a".parse::<CoreList>().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_runs_wait_for_cores_to_be_given_back() {
+        let pool = pool("0-2", 2);
+        let first = pool.acquire().await;
+        assert_eq!(first.cores(), [0, 1]);
+
+        let waiting = tokio::spawn(async move { pool.acquire().await.cores().to_vec() });
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        assert!(!waiting.is_finished());
+
+        drop(first);
+        let cores = tokio::time::timeout(Duration::from_secs(1), waiting)
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(cores, [0, 1]);
+    }
+}
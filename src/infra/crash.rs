@@ -0,0 +1,237 @@
+use std::{
+    fs::File,
+    io::{Read, Seek, SeekFrom},
+    os::{fd::AsRawFd, unix::process::ExitStatusExt},
+    path::Path,
+    process::{ExitStatus, Output},
+    sync::OnceLock,
+};
+
+use libc::c_int;
+use tokio::process::Command;
+
+use super::{error::InfraError, runner::ExecContext, sandbox::sandbox_user};
+
+// The signals programs most often die of, with what they usually mean.
+const SIGNALS: &[(i32, &str, &str)] = &[
+    (libc::SIGSEGV, "SIGSEGV", "segmentation fault"),
+    (libc::SIGFPE, "SIGFPE", "arithmetic error, e.g. x / 0"),
+    (libc::SIGABRT, "SIGABRT", "aborted, e.g. by a failed assert"),
+    (libc::SIGBUS, "SIGBUS", "bus error"),
+    (libc::SIGILL, "SIGILL", "illegal instruction"),
+    (libc::SIGTRAP, "SIGTRAP", "trace or breakpoint trap"),
+    (libc::SIGSYS, "SIGSYS", "bad system call"),
+    (libc::SIGPIPE, "SIGPIPE", "broken pipe"),
+    (libc::SIGXCPU, "SIGXCPU", "CPU time limit exceeded"),
+    (libc::SIGXFSZ, "SIGXFSZ", "file size limit exceeded"),
+    (libc::SIGKILL, "SIGKILL", "killed"),
+    (libc::SIGTERM, "SIGTERM", "terminated"),
+];
+
+// How many of the innermost frames a backtrace keeps.
+const BACKTRACE_FRAMES: usize = 16;
+
+// The descriptor gdb is handed its log on.
+const GDB_LOG_FD: c_int = 3;
+
+pub fn signal_name(signal: i32) -> Option<&'static str> {
+    SIGNALS
+        .iter()
+        .find(|(number, _, _)| *number == signal)
+        .map(|(_, name, _)| *name)
+}
+
+// `SIGSEGV (segmentation fault)`, or the number for a signal not listed.
+pub fn describe_signal(signal: i32) -> String {
+    match SIGNALS.iter().find(|(number, _, _)| *number == signal) {
+        Some((_, name, meaning)) => format!("{} ({})", name, meaning),
+        None => format!("signal {}", signal),
+    }
+}
+
+static BACKTRACES: OnceLock<bool> = OnceLock::new();
+
+// Called once at startup. Programs run under a debugger are slower, and it
+// needs ptrace, so runs whose seccomp profile denies ptrace go without.
+pub fn init_backtraces(enabled: bool) {
+    if enabled {
+        tracing::info!("running native programs under gdb for crash backtraces");
+    }
+    if BACKTRACES.set(enabled).is_err() {
+        tracing::warn!("crash backtraces were already initialised");
+    }
+}
+
+fn backtraces() -> bool {
+    BACKTRACES.get().copied().unwrap_or(false)
+}
+
+// Where gdb writes what it saw of a run: a file of the server's without a
+// name, handed to gdb as an open descriptor. Nothing in the run's
+// directories stands for it, so a program cannot put a link to some other
+// file in its place for the server to read back.
+pub struct GdbLog(File);
+
+impl GdbLog {
+    fn new() -> Result<Self, InfraError> {
+        let file = tempfile::tempfile()?;
+        if let Some(user) = sandbox_user()? {
+            std::os::unix::fs::fchown(&file, Some(user.uid()), Some(user.gid()))?;
+        }
+        Ok(GdbLog(file))
+    }
+
+    // Has `cmd` start with the log at `GDB_LOG_FD`. dup2 leaves a
+    // descriptor already in place alone, close-on-exec flag and all.
+    fn hand_to(&self, cmd: &mut Command) {
+        let fd = self.0.as_raw_fd();
+        unsafe {
+            cmd.pre_exec(move || {
+                let ret = if fd == GDB_LOG_FD {
+                    libc::fcntl(fd, libc::F_SETFD, 0)
+                } else {
+                    libc::dup2(fd, GDB_LOG_FD)
+                };
+                if ret < 0 {
+                    return Err(std::io::Error::last_os_error());
+                }
+                Ok(())
+            });
+        }
+    }
+
+    fn read(mut self) -> Option<String> {
+        let mut log = String::new();
+        self.0.seek(SeekFrom::Start(0)).ok()?;
+        self.0.read_to_string(&mut log).ok()?;
+        Some(log)
+    }
+}
+
+// The command that runs a native executable under gdb in batch mode, and the
+// log gdb writes to, when crash backtraces are on, the run's seccomp profile
+// allows ptrace and no sanitizer reports on the run instead. gdb's own
+// output goes to the log, so the program's streams stay its own; a program
+// that crashes is continued afterwards so it still dies of its signal.
+pub fn debugged_command(
+    executable: &Path,
+    ctx: &ExecContext,
+) -> Result<Option<(Command, GdbLog)>, InfraError> {
+    let ptrace_denied = ctx
+        .syscall_profile()
+        .is_some_and(|profile| profile.denied().contains(&"ptrace"));
+    if !backtraces() || ptrace_denied || ctx.sanitizer_dir().is_some() {
+        return Ok(None);
+    }
+    let log = GdbLog::new()?;
+    let mut cmd = ctx.command("gdb")?;
+    log.hand_to(&mut cmd);
+    cmd.args(["-q", "-nx", "-batch", "-return-child-result"]);
+    for command in [
+        "set startup-with-shell off".to_string(),
+        "set disable-randomization off".to_string(),
+        "set pagination off".to_string(),
+        format!("set logging file /dev/fd/{}", GDB_LOG_FD),
+        "set logging overwrite on".to_string(),
+        "set logging redirect on".to_string(),
+        "set logging enabled on".to_string(),
+        "run".to_string(),
+        format!("backtrace {}", BACKTRACE_FRAMES),
+        "continue".to_string(),
+    ] {
+        cmd.arg("-ex").arg(command);
+    }
+    cmd.arg("--args").arg(executable);
+    Ok(Some((cmd, log)))
+}
+
+// The signal gdb saw the program die of and the frames it printed, innermost
+// first, from its log. A signal the program received but handled does not
+// count.
+fn parse_gdb_log(log: &str) -> (Option<i32>, Vec<String>) {
+    let mut signal = None;
+    let mut frames = Vec::new();
+    for line in log.lines() {
+        let line = line.trim();
+        if let Some(rest) = line.strip_prefix("Program terminated with signal ") {
+            let name = rest.split([',', ' ']).next().unwrap_or_default();
+            signal = SIGNALS
+                .iter()
+                .find(|(_, known, _)| *known == name)
+                .map(|(number, _, _)| *number);
+        } else if line.starts_with('#') && frames.len() < BACKTRACE_FRAMES {
+            frames.push(line.to_string());
+        }
+    }
+    (signal, frames)
+}
+
+// Reads what gdb saw of a program run under `debugged_command`. gdb exits
+// with the program's own status only when the program exits, so one it saw
+// die of a signal is given that status back, and its backtrace is kept
+// for the crash report.
+pub fn examine(log: GdbLog, output: &mut Output, ctx: &ExecContext) {
+    let Some(log) = log.read() else {
+        return;
+    };
+    let (signal, backtrace) = parse_gdb_log(&log);
+    if let Some(signal) = signal {
+        output.status = ExitStatus::from_raw(signal);
+        ctx.record_crash(output.status, backtrace);
+    }
+}
+
+#[cfg(test)]
+mod crash_tests {
+    use super::*;
+
+    #[test]
+    fn test_describe_signal_names_common_crashes() {
+        assert_eq!(signal_name(libc::SIGSEGV), Some("SIGSEGV"));
+        assert_eq!(
+            describe_signal(libc::SIGABRT),
+            "SIGABRT (aborted, e.g. by a failed assert)"
+        );
+        assert_eq!(describe_signal(64), "signal 64");
+    }
+
+    #[tokio::test]
+    async fn test_gdb_log_is_handed_over_as_a_descriptor() {
+        let log = GdbLog::new().unwrap();
+        let mut cmd = Command::new("sh");
+        cmd.args([
+            "-c",
+            "echo 'Program terminated with signal SIGSEGV, Segmentation fault.' >&3",
+        ]);
+        log.hand_to(&mut cmd);
+        assert!(cmd.status().await.unwrap().success());
+        assert_eq!(parse_gdb_log(&log.read().unwrap()).0, Some(libc::SIGSEGV));
+    }
+
+    #[test]
+    fn test_parse_gdb_log_keeps_signal_and_frames() {
+        let log = "\n\
+            Program received signal SIGFPE, Arithmetic exception.\n\
+            0x0000555555555131 in divide (a=1, b=0) at main.c:3\n\
+            3\t    return a / b;\n\
+            #0  0x0000555555555131 in divide (a=1, b=0) at main.c:3\n\
+            #1  0x0000555555555156 in main () at main.c:7\n\
+            \n\
+            Program terminated with signal SIGFPE, Arithmetic exception.\n\
+            The program no longer exists.\n";
+        let (signal, frames) = parse_gdb_log(log);
+        assert_eq!(signal, Some(libc::SIGFPE));
+        assert_eq!(
+            frames,
+            vec![
+                "#0  0x0000555555555131 in divide (a=1, b=0) at main.c:3",
+                "#1  0x0000555555555156 in main () at main.c:7",
+            ]
+        );
+
+        let handled = "Program received signal SIGSEGV, Segmentation fault.\n\
+            #0  0x0000555555555131 in main () at main.c:9\n\
+            [Inferior 1 (process 7) exited with code 01]\n";
+        assert_eq!(parse_gdb_log(handled).0, None);
+    }
+}
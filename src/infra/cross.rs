@@ -0,0 +1,147 @@
+use super::{
+    artifacts::Artifact, c::build_c, error::InfraError, go::build_go, language::Language,
+    runner::ExecContext, sandbox::as_sandbox_user,
+};
+
+// What compile-only requests may build for: GOOS/GOARCH pairs for Go and
+// target triples for C, which zig brings the libraries for.
+const GO_TARGETS: &[&str] = &[
+    "linux/amd64",
+    "linux/arm64",
+    "linux/arm",
+    "linux/386",
+    "linux/riscv64",
+    "darwin/amd64",
+    "darwin/arm64",
+    "windows/amd64",
+    "windows/arm64",
+    "freebsd/amd64",
+    "wasip1/wasm",
+];
+const C_TARGETS: &[&str] = &[
+    "x86_64-linux-gnu",
+    "x86_64-linux-musl",
+    "aarch64-linux-gnu",
+    "aarch64-linux-musl",
+    "arm-linux-musleabihf",
+    "riscv64-linux-musl",
+    "x86_64-windows-gnu",
+    "aarch64-windows-gnu",
+    "x86_64-macos",
+    "aarch64-macos",
+    "wasm32-wasi",
+];
+
+// The targets `language` can be built for; empty if it cannot be built
+// for download at all.
+pub fn targets(language: Language) -> &'static [&'static str] {
+    match language {
+        Language::GO => GO_TARGETS,
+        Language::C => C_TARGETS,
+        _ => &[],
+    }
+}
+
+fn file_name(target: Option<&str>) -> &'static str {
+    match target {
+        Some(target) if target.contains("windows") => "main.exe",
+        Some(target) if target.contains("wasm") => "main.wasm",
+        _ => "main",
+    }
+}
+
+// Compiles `content` for `target`, which must be one of `targets`, or for
+// this host when it is None. The compiler runs as a sandbox user of its own.
+pub async fn build(
+    language: Language,
+    content: &str,
+    target: Option<&str>,
+    ctx: &ExecContext,
+) -> Result<Artifact, InfraError> {
+    let bytes = match language {
+        Language::GO => as_sandbox_user(build_go(content, target, ctx)).await?,
+        Language::C => as_sandbox_user(build_c(content, target, ctx)).await?,
+        _ => {
+            return Err(InfraError::UnsupportedLanguage(format!(
+                "{} programs cannot be built for download",
+                language
+            )));
+        }
+    };
+    Ok(Artifact {
+        file_name: file_name(target).to_string(),
+        bytes,
+    })
+}
+
+#[cfg(test)]
+mod cross_tests {
+    use super::*;
+
+    const HELLO_GO: &str =
+        "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"hi\")\n}\n";
+
+    #[test]
+    fn test_file_name_follows_the_target() {
+        assert_eq!(file_name(None), "main");
+        assert_eq!(file_name(Some("linux/arm64")), "main");
+        assert_eq!(file_name(Some("windows/amd64")), "main.exe");
+        assert_eq!(file_name(Some("x86_64-windows-gnu")), "main.exe");
+        assert_eq!(file_name(Some("wasm32-wasi")), "main.wasm");
+    }
+
+    #[tokio::test]
+    async fn test_build_go_for_another_platform() {
+        let artifact = build(
+            Language::GO,
+            HELLO_GO,
+            Some("windows/arm64"),
+            &ExecContext::default(),
+        )
+        .await
+        .unwrap();
+        assert_eq!(artifact.file_name, "main.exe");
+        assert!(artifact.bytes.starts_with(b"MZ"));
+
+        let artifact = build(
+            Language::GO,
+            HELLO_GO,
+            Some("linux/arm64"),
+            &ExecContext::default(),
+        )
+        .await
+        .unwrap();
+        assert!(artifact.bytes.starts_with(b"\x7fELF"));
+    }
+
+    #[tokio::test]
+    async fn test_build_go_reports_compile_errors() {
+        let result = build(
+            Language::GO,
+            "package main\n\nfunc main() {\n\tundefined()\n}\n",
+            None,
+            &ExecContext::default(),
+        )
+        .await;
+        assert!(matches!(result, Err(InfraError::CompileError(_))));
+    }
+
+    #[tokio::test]
+    async fn test_build_go_rejects_third_party_packages() {
+        let content =
+            "package main\n\nimport \"github.com/google/uuid\"\n\nfunc main() {\n\tuuid.New()\n}\n";
+        let result = build(Language::GO, content, None, &ExecContext::default()).await;
+        assert!(
+            result
+                .unwrap_err()
+                .to_string()
+                .contains("github.com/google/uuid")
+        );
+    }
+
+    #[tokio::test]
+    async fn test_build_rejects_other_languages() {
+        let result = build(Language::Python, "print(1)", None, &ExecContext::default()).await;
+        assert!(matches!(result, Err(InfraError::UnsupportedLanguage(_))));
+    }
+}
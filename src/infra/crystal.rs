@@ -1,24 +1,27 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
-
-pub async fn compile_crystal(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".cr")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
-
-    let source_path = temp_file.path().to_path_buf();
-    let executable_file = NamedTempFile::new()?;
-    let executable_path = executable_file.path().to_path_buf();
-    drop(executable_file);
-
-    let compile_output = Command::new(which("crystal")?)
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+};
+use tokio::process::Command;
+
+pub async fn compile_crystal(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::CRYSTAL, content)?;
+    let source_path = source.path().to_path_buf();
+    let executable_path = source.dir().join("main");
+
+    let compile_output = ctx.command("crystal")?
         .arg("build")
         .arg(&source_path)
         .arg("-o")
         .arg(&executable_path)
+        .args(ctx.compiler_flags())
+        .kill_on_drop(true)
         .output()
         .await?;
 
@@ -28,20 +31,10 @@ pub async fn compile_crystal(content: &str, stdin_input: &str) -> Result<String,
             format!("Crystal compilation failed:\n{}", stderr).into(),
         ));
     }
+    ctx.record_warnings(&compile_output.stderr);
 
-    let mut cmd = Command::new(&executable_path)
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
-
-    let output = cmd.wait_with_output().await?;
+    let mut cmd = Command::new(&executable_path);
+    let output = run_program(&mut cmd, stdin_input, ctx).await?;
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
         Some(code) => {
@@ -73,7 +66,7 @@ mod crystal_tests {
 puts "Hello, World!"
 "#;
 
-        let result = compile_crystal(crystal_code, "").await;
+        let result = compile_crystal(crystal_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
     }
@@ -86,7 +79,7 @@ b = 3
 puts (a + b)
 "#;
 
-        let result = compile_crystal(crystal_code, "").await;
+        let result = compile_crystal(crystal_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "8");
     }
@@ -98,7 +91,7 @@ num = gets.not_nil!.to_i
 puts "You entered: #{num}"
 "#;
 
-        let result = compile_crystal(crystal_code, "42\n").await;
+        let result = compile_crystal(crystal_code, "42\n", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "You entered: 42");
     }
@@ -110,7 +103,7 @@ name = gets.not_nil!.chomp
 puts "Hello, #{name}!"
 "#;
 
-        let result = compile_crystal(crystal_code, "Alice\n").await;
+        let result = compile_crystal(crystal_code, "Alice\n", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, Alice!");
     }
@@ -123,7 +116,7 @@ puts "Hello, #{name}!"
 end
 "#;
 
-        let result = compile_crystal(crystal_code, "").await;
+        let result = compile_crystal(crystal_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Line 1"));
@@ -137,7 +130,7 @@ end
 exit(1)  # This should cause a runtime error
 "#;
 
-        let result = compile_crystal(crystal_code, "").await;
+        let result = compile_crystal(crystal_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -151,7 +144,7 @@ puts "Sum: #{a + b}"
 puts "Product: #{a * b}"
 "#;
 
-        let result = compile_crystal(crystal_code, "7 3\n").await;
+        let result = compile_crystal(crystal_code, "7 3\n", &ExecContext::default()).await;
         println!("{:?}", result);
         assert!(result.is_ok());
         let output = result.unwrap();
@@ -165,7 +158,7 @@ puts "Product: #{a * b}"
 # Empty Crystal program
 "#;
 
-        let result = compile_crystal(crystal_code, "").await;
+        let result = compile_crystal(crystal_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
@@ -178,7 +171,7 @@ str = "Hello"
 puts "Length: #{str.size}"
 "#;
 
-        let result = compile_crystal(crystal_code, "").await;
+        let result = compile_crystal(crystal_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Length: 5");
     }
@@ -191,7 +184,7 @@ x = 16.0
 puts "Square root of #{x} is #{Math.sqrt(x)}"
 "#;
 
-        let result = compile_crystal(crystal_code, "").await;
+        let result = compile_crystal(crystal_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Square root of 16.0 is 4.0");
     }
@@ -205,7 +198,7 @@ end
 Fiber.yield
 "#;
 
-        let result = compile_crystal(crystal_code, "").await;
+        let result = compile_crystal(crystal_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Thread running");
     }
@@ -1,34 +1,24 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+};
 
-pub async fn compile_d(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".d")?;
+pub async fn compile_d(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
     let modified_content = format!("module temp;\n{}", content);
-    temp_file.write_all(modified_content.as_bytes())?;
-    temp_file.flush()?;
-    let source_path = temp_file.path().to_path_buf();
+    let source = SourceFile::create(Language::D, &modified_content)?;
+    let source_path = source.path().to_path_buf();
 
-    let executable_file = NamedTempFile::new()?;
-    drop(executable_file);
-
-    let mut cmd = Command::new(which("dmd")?)
+    let mut cmd = ctx.command("dmd")?;
+    cmd.args(ctx.compiler_flags())
         .arg("-run")
-        .arg(&source_path)
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
-
-    let output = cmd.wait_with_output().await?;
+        .arg(&source_path);
+    let output = run_program(&mut cmd, stdin_input, ctx).await?;
 
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
@@ -53,7 +43,7 @@ pub async fn compile_d(content: &str, stdin_input: &str) -> Result<String, Infra
 
 #[cfg(test)]
 mod tests {
-    use super::{InfraError, compile_d};
+    use super::{ExecContext, InfraError, compile_d};
     use tokio;
 
     #[tokio::test]
@@ -64,7 +54,7 @@ void main() {
     writeln("Hello, D!");
 }
 "#;
-        let result = compile_d(d_code, "").await;
+        let result = compile_d(d_code, "", &ExecContext::default()).await;
         assert!(
             result.is_ok(),
             "Expected successful execution, got {:?}",
@@ -81,7 +71,7 @@ void main() {
     writeln("Hello, D!"; // Missing closing parenthesis
 }
 "#;
-        let result = compile_d(invalid_d_code, "").await;
+        let result = compile_d(invalid_d_code, "", &ExecContext::default()).await;
         assert!(
             matches!(result, Err(InfraError::CompilationError(_))),
             "Expected compilation error, got {:?}",
@@ -98,7 +88,7 @@ void main() {
     writeln(arr[0]); // Access out of bounds
 }
 "#;
-        let result = compile_d(d_code, "").await;
+        let result = compile_d(d_code, "", &ExecContext::default()).await;
         assert!(
             matches!(result, Err(InfraError::CompilationError(_))),
             "Expected runtime error, got {:?}",
@@ -117,7 +107,7 @@ void main() {
 }
 "#;
         let input = "Test Input\n";
-        let result = compile_d(d_code, input).await;
+        let result = compile_d(d_code, input, &ExecContext::default()).await;
         assert!(
             result.is_ok(),
             "Expected successful execution with stdin, got {:?}",
@@ -1,48 +1,40 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
-
-pub async fn compile_dart(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".dart")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
-
-    let source_path = temp_file.path().to_path_buf();
-    let executable_file = NamedTempFile::new()?;
-    let executable_path = executable_file.path().to_path_buf();
-    drop(executable_file);
-
-    let compile_output = Command::new(which("dart")?)
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_compiler, run_program},
+    source::SourceFile,
+};
+use tokio::process::Command;
+
+pub async fn compile_dart(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::DART, content)?;
+    let source_path = source.path().to_path_buf();
+    let executable_path = source.dir().join("main");
+
+    let mut compile_cmd = ctx.command("dart")?;
+    compile_cmd
         .arg("compile")
         .arg("exe")
         .arg(&source_path)
         .arg("-o")
-        .arg(&executable_path)
-        .output()
-        .await?;
+        .arg(&executable_path);
+    let compile_output = run_compiler(&mut compile_cmd, ctx).await?;
 
     if !compile_output.status.success() {
         let stderr = String::from_utf8_lossy(&compile_output.stderr);
-        return Err(InfraError::CompilationError(
-            format!("Dart compilation failed:\n{}", stderr).into(),
-        ));
+        return Err(InfraError::CompileError(format!(
+            "Dart compilation failed:\n{}",
+            stderr
+        )));
     }
+    ctx.record_warnings(&compile_output.stderr);
 
-    let mut cmd = Command::new(&executable_path)
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
-
-    let output = cmd.wait_with_output().await?;
+    let mut cmd = Command::new(&executable_path);
+    let output = run_program(&mut cmd, stdin_input, ctx).await?;
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
         Some(code) => {
@@ -76,7 +68,7 @@ void main() {
 }
 "#;
 
-        let result = compile_dart(dart_code, "").await;
+        let result = compile_dart(dart_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
     }
@@ -91,7 +83,7 @@ void main() {
 }
 "#;
 
-        let result = compile_dart(dart_code, "").await;
+        let result = compile_dart(dart_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "8");
     }
@@ -106,7 +98,7 @@ void main() {
 }
 "#;
 
-        let result = compile_dart(dart_code, "42").await;
+        let result = compile_dart(dart_code, "42", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "You entered: 42");
     }
@@ -121,7 +113,7 @@ void main() {
 }
 "#;
 
-        let result = compile_dart(dart_code, "Alice").await;
+        let result = compile_dart(dart_code, "Alice", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, Alice!");
     }
@@ -136,7 +128,7 @@ void main() {
 }
 "#;
 
-        let result = compile_dart(dart_code, "").await;
+        let result = compile_dart(dart_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Line 1"));
@@ -152,8 +144,8 @@ void main() {
 }
 "#;
 
-        let result = compile_dart(invalid_dart_code, "").await;
-        assert!(result.is_err());
+        let result = compile_dart(invalid_dart_code, "", &ExecContext::default()).await;
+        assert!(matches!(result, Err(InfraError::CompileError(_))));
     }
 
     #[tokio::test]
@@ -164,7 +156,7 @@ void main() {
 }
 "#;
 
-        let result = compile_dart(dart_code, "").await;
+        let result = compile_dart(dart_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -181,7 +173,7 @@ void main() {
 }
 "#;
 
-        let result = compile_dart(dart_code, "7 3").await;
+        let result = compile_dart(dart_code, "7 3", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Sum: 10"));
@@ -194,7 +186,7 @@ void main() {
 void main() {}
 "#;
 
-        let result = compile_dart(dart_code, "").await;
+        let result = compile_dart(dart_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
@@ -208,7 +200,7 @@ void main() {
 }
 "#;
 
-        let result = compile_dart(dart_code, "").await;
+        let result = compile_dart(dart_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Length: 5");
     }
@@ -223,7 +215,7 @@ void main() {
 }
 "#;
 
-        let result = compile_dart(dart_code, "").await;
+        let result = compile_dart(dart_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Square root of 16.0 is 4.0");
     }
@@ -237,7 +229,7 @@ void main() async {
 }
 "#;
 
-        let result = compile_dart(dart_code, "").await;
+        let result = compile_dart(dart_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Future running");
     }
@@ -0,0 +1,284 @@
+use super::language::Language;
+
+// Telltale pieces of code, weighted by how surely they point at a language.
+// Markers are matched as substrings, so each counts once however often it
+// appears.
+const MARKERS: &[(Language, &[(&str, u32)])] = &[
+    (
+        Language::Python,
+        &[
+            ("def ", 2),
+            ("elif ", 3),
+            ("print(", 1),
+            ("import ", 1),
+            ("self.", 2),
+            ("__name__", 3),
+            ("None", 1),
+        ],
+    ),
+    (
+        Language::JAVASCRIPT,
+        &[
+            ("console.log(", 3),
+            ("function ", 2),
+            ("const ", 1),
+            ("let ", 1),
+            ("=> ", 1),
+            ("require(", 3),
+            ("===", 2),
+        ],
+    ),
+    (
+        Language::TYPESCRIPT,
+        &[
+            ("console.log(", 2),
+            ("interface ", 2),
+            (": string", 3),
+            (": number", 3),
+            (": boolean", 3),
+            ("=> ", 1),
+        ],
+    ),
+    (
+        Language::RUST,
+        &[
+            ("fn main()", 5),
+            ("println!(", 4),
+            ("let mut ", 3),
+            ("impl ", 2),
+            ("use std::", 3),
+        ],
+    ),
+    (
+        Language::GROOVY,
+        &[
+            ("public class ", 3),
+            ("public static void main", 4),
+            ("System.out.println", 4),
+        ],
+    ),
+    (
+        Language::SCALA,
+        &[
+            ("object ", 2),
+            ("extends App", 4),
+            ("def main(args: Array[String])", 5),
+            ("val ", 1),
+        ],
+    ),
+    (
+        Language::SWIFT,
+        &[
+            ("import Foundation", 4),
+            ("func ", 1),
+            ("var ", 1),
+            ("guard ", 3),
+        ],
+    ),
+    (
+        Language::RUBY,
+        &[
+            ("puts ", 3),
+            ("end\n", 1),
+            ("require '", 2),
+            ("attr_accessor", 4),
+            (".each do", 4),
+        ],
+    ),
+    (
+        Language::LUA,
+        &[("local ", 3), ("end\n", 1), ("then\n", 1), ("io.write(", 4)],
+    ),
+    (
+        Language::HASKELL,
+        &[
+            ("main :: IO ()", 5),
+            ("module Main", 5),
+            ("putStrLn ", 3),
+            (" <- ", 1),
+        ],
+    ),
+    (
+        Language::OCAML,
+        &[("let () =", 5), ("print_endline ", 3), ("Printf.printf", 4)],
+    ),
+    (
+        Language::ELIXIR,
+        &[("defmodule ", 5), ("IO.puts", 4), ("do\n", 1)],
+    ),
+    (
+        Language::DART,
+        &[("void main()", 3), ("import 'dart:", 5), ("print(", 1)],
+    ),
+    (
+        Language::ZIG,
+        &[("@import(\"std\")", 5), ("pub fn main()", 4)],
+    ),
+    (
+        Language::FORTRAN,
+        &[("end program", 5), ("implicit none", 4), ("print *,", 4)],
+    ),
+    (
+        Language::JULIA,
+        &[("println(", 2), ("function ", 1), ("end\n", 1)],
+    ),
+    (Language::R, &[(" <- ", 2), ("cat(", 2), ("library(", 3)]),
+    (
+        Language::PERL,
+        &[("use strict;", 5), ("my $", 4), ("print \"", 1)],
+    ),
+    (
+        Language::ASSEMBLY,
+        &[("section .text", 5), ("global _start", 5), ("syscall", 2)],
+    ),
+];
+
+// The language of the interpreter a `#!` line names, such as
+// `#!/usr/bin/env python3`.
+fn from_shebang(line: &str) -> Option<Language> {
+    let command = line.strip_prefix("#!")?;
+    let mut words = command.split_whitespace();
+    let mut program = words.next()?.rsplit('/').next()?;
+    if program == "env" {
+        program = words.find(|word| !word.starts_with('-'))?;
+    }
+    let program = program.trim_end_matches(|c: char| c.is_ascii_digit() || c == '.');
+    match program {
+        "python" => Some(Language::Python),
+        "node" | "bun" | "deno" => Some(Language::JAVASCRIPT),
+        "ts-node" | "tsx" => Some(Language::TYPESCRIPT),
+        "bash" | "sh" | "zsh" => Some(Language::BASH),
+        "Rscript" => Some(Language::R),
+        other => other.parse().ok(),
+    }
+}
+
+fn is_brainfuck(content: &str) -> bool {
+    let mut ops = content.chars().filter(|c| !c.is_whitespace()).peekable();
+    ops.peek().is_some() && ops.all(|c| "+-<>[].,".contains(c))
+}
+
+fn is_sql(content: &str) -> bool {
+    let first = content
+        .split_whitespace()
+        .next()
+        .unwrap_or_default()
+        .to_ascii_uppercase();
+    ["SELECT", "CREATE", "INSERT", "WITH"].contains(&first.as_str())
+}
+
+// Guesses the language of `content`: a shebang or a construct only one
+// language has settles it, and otherwise the language whose markers weigh
+// most wins. Returns None when nothing points anywhere, or two languages
+// tie.
+pub fn detect(content: &str) -> Option<Language> {
+    let content = content.trim_start_matches('\u{feff}');
+    if let Some(language) = content.lines().next().and_then(from_shebang) {
+        return Some(language);
+    }
+    if content.trim_start().starts_with("<?php") {
+        return Some(Language::PHP);
+    }
+    if content.lines().any(|line| line.trim() == "package main") {
+        return Some(Language::GO);
+    }
+    if content
+        .lines()
+        .any(|line| line.trim_start().starts_with("#include"))
+    {
+        let cpp = ["iostream", "std::", "namespace ", "template<", "class "];
+        return Some(if cpp.iter().any(|marker| content.contains(marker)) {
+            Language::CPP
+        } else {
+            Language::C
+        });
+    }
+    if is_brainfuck(content) {
+        return Some(Language::BRAINFUCK);
+    }
+    if is_sql(content) {
+        return Some(Language::SQL);
+    }
+
+    let mut scores: Vec<(Language, u32)> = MARKERS
+        .iter()
+        .map(|(language, markers)| {
+            let score = markers
+                .iter()
+                .filter(|(marker, _)| content.contains(marker))
+                .map(|(_, weight)| weight)
+                .sum();
+            (*language, score)
+        })
+        .collect();
+    scores.sort_by(|a, b| b.1.cmp(&a.1));
+    match scores.as_slice() {
+        [(language, best), rest @ ..]
+            if *best > 0 && rest.first().is_none_or(|(_, next)| next < best) =>
+        {
+            Some(*language)
+        }
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+mod detect_tests {
+    use super::*;
+
+    #[test]
+    fn test_shebang_names_the_interpreter() {
+        assert_eq!(
+            detect("#!/usr/bin/env python3\nprint(1)"),
+            Some(Language::Python)
+        );
+        assert_eq!(detect("#!/bin/bash\necho hi"), Some(Language::BASH));
+        assert_eq!(
+            detect("#!/usr/bin/env -S node\n"),
+            Some(Language::JAVASCRIPT)
+        );
+        assert_eq!(detect("#!/usr/bin/ruby\nputs 1"), Some(Language::RUBY));
+    }
+
+    #[test]
+    fn test_constructs_only_one_language_has_settle_it() {
+        assert_eq!(
+            detect("package main\n\nfunc main() {}\n"),
+            Some(Language::GO)
+        );
+        assert_eq!(
+            detect("#include <stdio.h>\nint main() { return 0; }\n"),
+            Some(Language::C)
+        );
+        assert_eq!(
+            detect("#include <iostream>\nint main() { std::cout << 1; }\n"),
+            Some(Language::CPP)
+        );
+        assert_eq!(detect("<?php echo 1;"), Some(Language::PHP));
+        assert_eq!(detect("++[>+<-]."), Some(Language::BRAINFUCK));
+        assert_eq!(detect("select 1;"), Some(Language::SQL));
+    }
+
+    #[test]
+    fn test_markers_pick_the_likeliest_language() {
+        assert_eq!(
+            detect("def greet(name):\n    print(name)\n"),
+            Some(Language::Python)
+        );
+        assert_eq!(
+            detect("fn main() {\n    println!(\"hi\");\n}\n"),
+            Some(Language::RUST)
+        );
+        assert_eq!(
+            detect("public class Main {\n  public static void main(String[] a) {}\n}\n"),
+            Some(Language::GROOVY)
+        );
+        assert_eq!(
+            detect("const x = 1;\nconsole.log(x === 1);\n"),
+            Some(Language::JAVASCRIPT)
+        );
+        assert_eq!(detect("defmodule M do\nend\n"), Some(Language::ELIXIR));
+        assert_eq!(detect("hello there"), None);
+        assert_eq!(detect(""), None);
+    }
+}
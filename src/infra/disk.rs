@@ -0,0 +1,215 @@
+use std::{
+    fs, io,
+    os::unix::fs::MetadataExt,
+    path::{Path, PathBuf},
+    sync::{
+        OnceLock,
+        atomic::{AtomicBool, Ordering},
+    },
+    time::{Duration, SystemTime},
+};
+
+use nix::{
+    mount::{MsFlags, mount},
+    sys::{
+        statfs::{TMPFS_MAGIC, statfs},
+        statvfs::statvfs,
+    },
+};
+
+static EXECUTION_ZONE: OnceLock<PathBuf> = OnceLock::new();
+static DISK_PRESSURE: AtomicBool = AtomicBool::new(false);
+
+// Whether `dir` has a tmpfs of its own mounted on it, rather than merely
+// lying on one.
+fn is_tmpfs_mount(dir: &Path) -> io::Result<bool> {
+    let parent = fs::metadata(dir.join(".."))?;
+    if fs::metadata(dir)?.dev() == parent.dev() {
+        return Ok(false);
+    }
+    Ok(statfs(dir).map_err(io::Error::from)?.filesystem_type() == TMPFS_MAGIC)
+}
+
+// Creates the zone at `dir`. With `tmpfs_bytes`, it is kept in memory: a
+// tmpfs of that size is mounted there, or when one already is, whatever an
+// earlier server left in it is removed.
+fn prepare_execution_zone(dir: &Path, tmpfs_bytes: Option<u64>) -> io::Result<()> {
+    fs::create_dir_all(dir)?;
+    let Some(bytes) = tmpfs_bytes else {
+        return Ok(());
+    };
+    if is_tmpfs_mount(dir)? {
+        let removed = collect_garbage(dir, Duration::ZERO)?;
+        tracing::info!(
+            "execution zone {:?} already is a tmpfs, removed {} stale entries",
+            dir,
+            removed
+        );
+        return Ok(());
+    }
+    let options = format!("size={},mode=0755", bytes);
+    mount(
+        Some("tmpfs"),
+        dir,
+        Some("tmpfs"),
+        MsFlags::MS_NOSUID | MsFlags::MS_NODEV,
+        Some(options.as_str()),
+    )
+    .map_err(io::Error::from)?;
+    tracing::info!("mounted a {} byte tmpfs at execution zone {:?}", bytes, dir);
+    Ok(())
+}
+
+// Must run before anything uses the zone; until then it defaults to
+// comphub in the system's temporary directory.
+pub fn init_execution_zone(dir: &Path, tmpfs_bytes: Option<u64>) -> io::Result<()> {
+    prepare_execution_zone(dir, tmpfs_bytes)?;
+    EXECUTION_ZONE
+        .set(dir.to_path_buf())
+        .map_err(|_| io::Error::other("the execution zone is already in use"))
+}
+
+pub fn execution_zone() -> &'static Path {
+    EXECUTION_ZONE.get_or_init(|| {
+        let dir = std::env::temp_dir().join("comphub");
+        if let Err(err) = fs::create_dir_all(&dir) {
+            tracing::error!("failed to create execution zone {:?}: {}", dir, err);
+        }
+        dir
+    })
+}
+
+pub fn under_pressure() -> bool {
+    DISK_PRESSURE.load(Ordering::Relaxed)
+}
+
+pub fn usage_ratio(path: &Path) -> io::Result<f64> {
+    let stat = statvfs(path).map_err(io::Error::from)?;
+    let total = stat.blocks() as f64;
+    if total == 0.0 {
+        return Ok(0.0);
+    }
+    Ok(1.0 - stat.blocks_available() as f64 / total)
+}
+
+pub fn collect_garbage(dir: &Path, max_age: Duration) -> io::Result<usize> {
+    let now = SystemTime::now();
+    let mut removed = 0;
+
+    for entry in fs::read_dir(dir)? {
+        let entry = entry?;
+        let metadata = entry.metadata()?;
+        let age = metadata
+            .modified()
+            .ok()
+            .and_then(|modified| now.duration_since(modified).ok())
+            .unwrap_or_default();
+        if age < max_age {
+            continue;
+        }
+
+        let path = entry.path();
+        let result = if metadata.is_dir() {
+            fs::remove_dir_all(&path)
+        } else {
+            fs::remove_file(&path)
+        };
+        match result {
+            Ok(()) => removed += 1,
+            Err(err) => tracing::warn!("failed to remove {:?}: {}", path, err),
+        }
+    }
+
+    Ok(removed)
+}
+
+pub async fn watch_execution_zone(high_watermark: f64, gc_max_age: Duration, interval: Duration) {
+    let zone = execution_zone();
+    let mut ticker = tokio::time::interval(interval);
+
+    loop {
+        ticker.tick().await;
+
+        let usage = match usage_ratio(zone) {
+            Ok(usage) => usage,
+            Err(err) => {
+                tracing::warn!("failed to stat execution zone {:?}: {}", zone, err);
+                continue;
+            }
+        };
+
+        let pressured = usage >= high_watermark;
+        let was_pressured = DISK_PRESSURE.swap(pressured, Ordering::Relaxed);
+
+        if !pressured {
+            if was_pressured {
+                tracing::info!(
+                    "execution zone usage back to {:.1}%, accepting compiled languages again",
+                    usage * 100.0
+                );
+            }
+            continue;
+        }
+
+        if !was_pressured {
+            tracing::warn!(
+                "execution zone usage at {:.1}%, rejecting compiled languages",
+                usage * 100.0
+            );
+        }
+
+        match tokio::task::spawn_blocking(move || collect_garbage(zone, gc_max_age)).await {
+            Ok(Ok(removed)) => tracing::info!("disk pressure gc removed {} stale entries", removed),
+            Ok(Err(err)) => tracing::warn!("disk pressure gc failed: {}", err),
+            Err(err) => tracing::warn!("disk pressure gc task panicked: {}", err),
+        }
+    }
+}
+
+#[cfg(test)]
+mod disk_tests {
+    use super::*;
+    use std::fs::File;
+
+    #[test]
+    fn test_execution_zone_exists() {
+        assert!(execution_zone().is_dir());
+    }
+
+    #[test]
+    fn test_prepare_execution_zone_creates_the_directory() {
+        let dir = tempfile::tempdir().unwrap();
+        let zone = dir.path().join("zone").join("comphub");
+        prepare_execution_zone(&zone, None).unwrap();
+        assert!(zone.is_dir());
+        assert!(!is_tmpfs_mount(&zone).unwrap());
+    }
+
+    #[test]
+    fn test_usage_ratio_is_a_fraction() {
+        let usage = usage_ratio(execution_zone()).unwrap();
+        assert!((0.0..=1.0).contains(&usage));
+    }
+
+    #[test]
+    fn test_collect_garbage_removes_everything_with_zero_age() {
+        let dir = tempfile::tempdir().unwrap();
+        File::create(dir.path().join("binary")).unwrap();
+        fs::create_dir(dir.path().join("workspace")).unwrap();
+        File::create(dir.path().join("workspace").join("main.c")).unwrap();
+
+        let removed = collect_garbage(dir.path(), Duration::ZERO).unwrap();
+        assert_eq!(removed, 2);
+        assert_eq!(fs::read_dir(dir.path()).unwrap().count(), 0);
+    }
+
+    #[test]
+    fn test_collect_garbage_keeps_fresh_entries() {
+        let dir = tempfile::tempdir().unwrap();
+        File::create(dir.path().join("binary")).unwrap();
+
+        let removed = collect_garbage(dir.path(), Duration::from_secs(3600)).unwrap();
+        assert_eq!(removed, 0);
+        assert!(dir.path().join("binary").exists());
+    }
+}
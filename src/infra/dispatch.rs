@@ -0,0 +1,493 @@
+use std::{
+    collections::{BTreeMap, HashMap, HashSet},
+    str::FromStr,
+    sync::{Arc, Mutex},
+    time::{Duration, Instant},
+};
+
+use reqwest::{StatusCode, header::CONTENT_TYPE};
+use serde::{Deserialize, Serialize, de::DeserializeOwned};
+use tokio::sync::{OnceCell, Semaphore};
+use uuid::Uuid;
+
+use super::{
+    compile::compile_lang,
+    error::InfraError,
+    events::Submitter,
+    interactive::Verdict,
+    jobs::{JobQueue, JobSpec},
+    logs::logged,
+    matrix::ToolchainVersions,
+    quickjs::JsEngine,
+    runner::OutputEncoding,
+    scheduler::Priority,
+    tier::Tier,
+    trace::traced,
+    wasm::Backend,
+};
+use crate::config::config;
+
+pub const WORKER_TOKEN_HEADER: &str = "x-worker-token";
+
+const IDLE_POLL: Duration = Duration::from_secs(1);
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum JobDispatch {
+    Local,
+    Remote,
+}
+
+impl FromStr for JobDispatch {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_lowercase().as_str() {
+            "local" => Ok(JobDispatch::Local),
+            "remote" => Ok(JobDispatch::Remote),
+            other => Err(format!("unknown job dispatch mode: {}", other)),
+        }
+    }
+}
+
+// A job handed to a remote worker. The toolchain version travels by name
+// and is resolved against the worker's own configuration, which must list
+// the same versions as the API node's.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Assignment {
+    pub job_id: String,
+    pub lang: String,
+    pub content: String,
+    pub stdin: String,
+    pub args: Vec<String>,
+    pub env: BTreeMap<String, String>,
+    pub compiler_flags: Vec<String>,
+    pub backend: Backend,
+    pub js_engine: Option<JsEngine>,
+    pub dependencies: Vec<String>,
+    #[serde(default)]
+    pub setup: String,
+    #[serde(default)]
+    pub output_encoding: OutputEncoding,
+    pub version: Option<String>,
+    pub tier: Option<Tier>,
+    pub submitter: Submitter,
+    #[serde(default)]
+    pub group: Option<String>,
+    #[serde(default)]
+    pub expected_output: Option<String>,
+    #[serde(default)]
+    pub time_limit_ms: Option<u64>,
+    #[serde(default)]
+    pub memory_limit_bytes: Option<u64>,
+    #[serde(default)]
+    pub locale: Option<String>,
+    #[serde(default)]
+    pub timezone: Option<String>,
+    #[serde(default)]
+    pub traceparent: Option<String>,
+}
+
+impl Assignment {
+    pub fn new(job_id: &str, spec: JobSpec) -> Self {
+        Assignment {
+            job_id: job_id.to_string(),
+            version: spec.version.map(|version| version.name.clone()),
+            lang: spec.lang,
+            content: spec.content,
+            stdin: spec.stdin,
+            args: spec.args,
+            env: spec.env,
+            compiler_flags: spec.compiler_flags,
+            backend: spec.backend,
+            js_engine: spec.js_engine,
+            dependencies: spec.dependencies,
+            setup: spec.setup,
+            output_encoding: spec.output_encoding,
+            tier: spec.tier,
+            submitter: spec.submitter,
+            group: spec.group,
+            expected_output: spec.expected_output,
+            time_limit_ms: spec.time_limit.map(|limit| limit.as_millis() as u64),
+            memory_limit_bytes: spec.memory_limit,
+            locale: spec.locale,
+            timezone: spec.timezone,
+            traceparent: spec.traceparent,
+        }
+    }
+
+    // The job to run. A version named has to be installed here: running the
+    // default toolchain instead would report results it never produced.
+    pub fn into_spec(self, versions: &'static ToolchainVersions) -> Result<JobSpec, InfraError> {
+        let version = self
+            .version
+            .as_ref()
+            .map(|name| {
+                versions
+                    .resolve(&self.lang, name)
+                    .ok_or_else(|| InfraError::UnknownVersion(format!("{} {}", self.lang, name)))
+            })
+            .transpose()?;
+        Ok(JobSpec {
+            lang: self.lang,
+            content: self.content,
+            stdin: self.stdin,
+            args: self.args,
+            env: self.env,
+            compiler_flags: self.compiler_flags,
+            backend: self.backend,
+            js_engine: self.js_engine,
+            dependencies: self.dependencies,
+            setup: self.setup,
+            output_encoding: self.output_encoding,
+            version,
+            tier: self.tier,
+            submitter: self.submitter,
+            run_at: None,
+            priority: Priority::default(),
+            rerun_of: None,
+            group: self.group,
+            expected_output: self.expected_output,
+            time_limit: self.time_limit_ms.map(Duration::from_millis),
+            memory_limit: self.memory_limit_bytes,
+            locale: self.locale,
+            timezone: self.timezone,
+            traceparent: self.traceparent,
+        })
+    }
+}
+
+// What a worker reports back once a job has run.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Completion {
+    pub result: Option<String>,
+    pub error: Option<String>,
+    // Given for a job in a group.
+    #[serde(default)]
+    pub verdict: Option<Verdict>,
+}
+
+impl Completion {
+    pub fn into_result(self) -> Result<String, String> {
+        match self.error {
+            Some(error) => Err(error),
+            None => Ok(self.result.unwrap_or_default()),
+        }
+    }
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct Registration {
+    pub worker_id: String,
+}
+
+struct Worker {
+    last_seen: Instant,
+    jobs: HashSet<String>,
+}
+
+// Remote workers known to the API node and the jobs each is running. A
+// worker that misses heartbeats for `timeout` is forgotten and its jobs are
+// handed to others.
+pub struct WorkerRegistry {
+    workers: Mutex<HashMap<String, Worker>>,
+    timeout: Duration,
+}
+
+static WORKER_REGISTRY: OnceCell<WorkerRegistry> = OnceCell::const_new();
+
+pub async fn worker_registry() -> &'static WorkerRegistry {
+    WORKER_REGISTRY
+        .get_or_init(|| async { WorkerRegistry::new(config().await.worker_timeout()) })
+        .await
+}
+
+impl WorkerRegistry {
+    pub fn new(timeout: Duration) -> Self {
+        WorkerRegistry {
+            workers: Mutex::new(HashMap::new()),
+            timeout,
+        }
+    }
+
+    pub fn register(&self) -> String {
+        let id = Uuid::new_v4().to_string();
+        let worker = Worker {
+            last_seen: Instant::now(),
+            jobs: HashSet::new(),
+        };
+        self.workers.lock().unwrap().insert(id.clone(), worker);
+        tracing::info!("registered worker {}", id);
+        id
+    }
+
+    // Returns false for a worker that is not registered, which has to
+    // register again.
+    pub fn heartbeat(&self, worker_id: &str) -> bool {
+        match self.workers.lock().unwrap().get_mut(worker_id) {
+            Some(worker) => {
+                worker.last_seen = Instant::now();
+                true
+            }
+            None => false,
+        }
+    }
+
+    pub fn assign(&self, worker_id: &str, job_id: &str) -> bool {
+        match self.workers.lock().unwrap().get_mut(worker_id) {
+            Some(worker) => worker.jobs.insert(job_id.to_string()),
+            None => false,
+        }
+    }
+
+    // Returns whether `job_id` was still assigned to the worker.
+    pub fn release(&self, worker_id: &str, job_id: &str) -> bool {
+        self.workers
+            .lock()
+            .unwrap()
+            .get_mut(worker_id)
+            .is_some_and(|worker| worker.jobs.remove(job_id))
+    }
+
+    // Forgets workers that stopped sending heartbeats and returns the jobs
+    // they were running.
+    pub fn reap(&self) -> Vec<String> {
+        let mut lost = Vec::new();
+        self.workers.lock().unwrap().retain(|id, worker| {
+            if worker.last_seen.elapsed() < self.timeout {
+                return true;
+            }
+            tracing::warn!("worker {} stopped responding", id);
+            lost.extend(worker.jobs.drain());
+            false
+        });
+        lost
+    }
+}
+
+pub async fn reassign_from_dead_workers(queue: &'static JobQueue, registry: &WorkerRegistry) {
+    let period = (registry.timeout / 2).max(Duration::from_secs(1));
+    let mut interval = tokio::time::interval(period);
+    loop {
+        interval.tick().await;
+        for job_id in registry.reap() {
+            queue.requeue(&job_id);
+        }
+    }
+}
+
+// The worker side of the protocol: an HTTP client for the API node's
+// worker endpoints.
+struct Dispatcher {
+    http: reqwest::Client,
+    url: String,
+    token: String,
+    worker_id: Mutex<String>,
+}
+
+impl Dispatcher {
+    async fn post<T: Serialize, R: DeserializeOwned>(
+        &self,
+        path: &str,
+        body: &T,
+    ) -> Result<Option<R>, String> {
+        let body = serde_json::to_vec(body).map_err(|err| err.to_string())?;
+        let response = self
+            .http
+            .post(format!("{}{}", self.url, path))
+            .header(WORKER_TOKEN_HEADER, &self.token)
+            .header(CONTENT_TYPE, "application/json")
+            .body(body)
+            .send()
+            .await
+            .map_err(|err| err.to_string())?;
+        let status = response.status();
+        let bytes = response.bytes().await.map_err(|err| err.to_string())?;
+        match status {
+            StatusCode::NO_CONTENT => Ok(None),
+            status if status.is_success() => serde_json::from_slice(&bytes)
+                .map(Some)
+                .map_err(|err| err.to_string()),
+            status => Err(format!(
+                "{} {}: {}",
+                path,
+                status,
+                String::from_utf8_lossy(&bytes)
+            )),
+        }
+    }
+
+    fn worker_id(&self) -> String {
+        self.worker_id.lock().unwrap().clone()
+    }
+
+    async fn register(&self) -> Result<(), String> {
+        let registration: Registration = self
+            .post("/api/v1/workers", &())
+            .await?
+            .ok_or_else(|| String::from("dispatcher returned no worker id"))?;
+        tracing::info!("registered as worker {}", registration.worker_id);
+        *self.worker_id.lock().unwrap() = registration.worker_id;
+        Ok(())
+    }
+
+    // Registers again when the API node no longer knows this worker, for
+    // example after it restarted.
+    async fn heartbeat(&self) {
+        let path = format!("/api/v1/workers/{}/heartbeat", self.worker_id());
+        if let Err(err) = self.post::<_, ()>(&path, &()).await {
+            tracing::warn!("heartbeat failed: {}", err);
+            if let Err(err) = self.register().await {
+                tracing::warn!("registering again failed: {}", err);
+            }
+        }
+    }
+
+    async fn claim(&self) -> Result<Option<Assignment>, String> {
+        let path = format!("/api/v1/workers/{}/claim", self.worker_id());
+        self.post(&path, &()).await
+    }
+
+    async fn complete(&self, job_id: &str, completion: &Completion) -> Result<(), String> {
+        let path = format!("/api/v1/workers/{}/jobs/{}", self.worker_id(), job_id);
+        self.post::<_, ()>(&path, completion).await.map(|_| ())
+    }
+}
+
+async fn execute(assignment: Assignment, versions: &'static ToolchainVersions) -> Completion {
+    let job_id = assignment.job_id.clone();
+    let spec = match assignment.into_spec(versions) {
+        Ok(spec) => spec,
+        Err(err) => {
+            return Completion {
+                result: None,
+                error: Some(err.to_string()),
+                verdict: None,
+            };
+        }
+    };
+    let ctx = spec.context();
+    let run = logged(
+        &job_id,
+        &spec.lang,
+        &spec.content,
+        &spec.submitter,
+        compile_lang(&spec.lang, &spec.content, &spec.stdin, &ctx),
+    );
+    let result = traced(spec.traceparent.clone(), run).await;
+    let verdict = spec.judged(&result);
+    match result {
+        Ok(output) => Completion {
+            result: Some(output),
+            error: None,
+            verdict,
+        },
+        Err(err) => Completion {
+            result: None,
+            error: Some(err.to_string()),
+            verdict,
+        },
+    }
+}
+
+// Runs this process as a worker for the API node at `url`, executing up to
+// `slots` claimed jobs at a time. Only returns if the first registration
+// fails.
+pub async fn run_worker(url: &str, token: &str, slots: usize) -> Result<(), String> {
+    let dispatcher = Arc::new(Dispatcher {
+        http: reqwest::Client::new(),
+        url: url.trim_end_matches('/').to_string(),
+        token: token.to_string(),
+        worker_id: Mutex::new(String::new()),
+    });
+    dispatcher.register().await?;
+
+    let heartbeats = dispatcher.clone();
+    let interval = (config().await.worker_timeout() / 3).max(Duration::from_secs(1));
+    tokio::spawn(async move {
+        let mut interval = tokio::time::interval(interval);
+        loop {
+            interval.tick().await;
+            heartbeats.heartbeat().await;
+        }
+    });
+
+    let versions = config().await.toolchain_versions();
+    let slots = Arc::new(Semaphore::new(slots.max(1)));
+    loop {
+        let permit = slots.clone().acquire_owned().await.unwrap();
+        let assignment = match dispatcher.claim().await {
+            Ok(Some(assignment)) => assignment,
+            Ok(None) => {
+                tokio::time::sleep(IDLE_POLL).await;
+                continue;
+            }
+            Err(err) => {
+                tracing::warn!("claiming a job failed: {}", err);
+                tokio::time::sleep(IDLE_POLL).await;
+                continue;
+            }
+        };
+        let dispatcher = dispatcher.clone();
+        tokio::spawn(async move {
+            let job_id = assignment.job_id.clone();
+            let completion = execute(assignment, versions).await;
+            if let Err(err) = dispatcher.complete(&job_id, &completion).await {
+                tracing::warn!("reporting job {} failed: {}", job_id, err);
+            }
+            drop(permit);
+        });
+    }
+}
+
+#[cfg(test)]
+mod dispatch_tests {
+    use super::*;
+
+    #[test]
+    fn test_reap_returns_jobs_of_silent_workers() {
+        let registry = WorkerRegistry::new(Duration::ZERO);
+        let worker = registry.register();
+        assert!(registry.assign(&worker, "job"));
+        assert!(!registry.assign("unknown", "job"));
+
+        assert_eq!(registry.reap(), ["job"]);
+        assert!(!registry.heartbeat(&worker));
+        assert!(!registry.release(&worker, "job"));
+    }
+
+    #[test]
+    fn test_assignment_keeps_its_version_or_fails() {
+        let versions: &'static ToolchainVersions =
+            Box::leak(Box::new("python:3.12=/opt/py312/bin".parse().unwrap()));
+        let assignment = |version: &str| Assignment {
+            version: Some(version.to_string()),
+            ..Assignment::new(
+                "job",
+                JobSpec {
+                    lang: "python".into(),
+                    ..Default::default()
+                },
+            )
+        };
+        let spec = assignment("3.12").into_spec(versions).unwrap();
+        assert_eq!(
+            spec.version.map(|version| version.name.as_str()),
+            Some("3.12")
+        );
+        assert!(matches!(
+            assignment("3.8").into_spec(versions),
+            Err(InfraError::UnknownVersion(_))
+        ));
+    }
+
+    #[test]
+    fn test_live_worker_keeps_its_jobs() {
+        let registry = WorkerRegistry::new(Duration::from_secs(60));
+        let worker = registry.register();
+        registry.assign(&worker, "job");
+        assert!(registry.heartbeat(&worker));
+        assert!(registry.reap().is_empty());
+        assert!(registry.release(&worker, "job"));
+        assert!(!registry.release(&worker, "job"));
+    }
+}
@@ -0,0 +1,130 @@
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, limit_processes, prepare, spawn_piped, supervise},
+    source::SourceFile,
+};
+
+// Elixir processes live inside one BEAM, but the BEAM starts OS threads for
+// its schedulers by the number of cores, and those count against the
+// sandbox user's process limit. One scheduler of each kind is plenty for a
+// script and keeps the count small on large hosts.
+const BEAM_FLAGS: &str = "+S 1:1 +SDcpu 1:1 +SDio 1";
+
+pub async fn compile_elixir(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::ELIXIR, content)?;
+    let source_path = source.path().to_path_buf();
+
+    let mut cmd = ctx.command("elixir")?;
+    cmd.arg("--erl").arg(BEAM_FLAGS).arg(source_path);
+    let profile = prepare(&mut cmd, ctx)?;
+    limit_processes(&mut cmd);
+    let child = spawn_piped(&mut cmd)?;
+    let output = supervise(child, stdin_input, ctx, profile).await?;
+    match output.status.code() {
+        Some(0) => Ok(String::from_utf8(output.stdout)?),
+        Some(code) => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!(
+                    "Elixir program execution failed with status code: {}\nError: {}",
+                    code, stderr
+                )
+                .into(),
+            ))
+        }
+        None => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!("Elixir program terminated by signal\nError: {}", stderr).into(),
+            ))
+        }
+    }
+}
+
+#[cfg(test)]
+mod elixir_tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_simple_hello_world() {
+        let elixir_code = r#"
+IO.puts("Hello, World!")
+"#;
+
+        let result = compile_elixir(elixir_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Hello, World!");
+    }
+
+    #[tokio::test]
+    async fn test_stdin_input() {
+        let elixir_code = r#"
+name = IO.gets("") |> String.trim()
+IO.puts("Hello, #{name}!")
+"#;
+
+        let result = compile_elixir(elixir_code, "Alice\n", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Hello, Alice!");
+    }
+
+    #[tokio::test]
+    async fn test_complex_stdin_processing() {
+        let elixir_code = r#"
+[a, b] =
+  IO.read(:stdio, :eof)
+  |> String.split()
+  |> Enum.map(&String.to_integer/1)
+
+IO.puts("Sum: #{a + b}")
+IO.puts("Product: #{a * b}")
+"#;
+
+        let result = compile_elixir(elixir_code, "7 3\n", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        let output = result.unwrap();
+        assert!(output.contains("Sum: 10"));
+        assert!(output.contains("Product: 21"));
+    }
+
+    #[tokio::test]
+    async fn test_many_processes_run_on_one_scheduler() {
+        let elixir_code = r#"
+1..10_000
+|> Enum.map(fn i -> Task.async(fn -> i end) end)
+|> Enum.map(&Task.await/1)
+|> Enum.sum()
+|> IO.puts()
+
+IO.puts(System.schedulers_online())
+"#;
+
+        let result = compile_elixir(elixir_code, "", &ExecContext::default()).await;
+        assert_eq!(result.unwrap(), "50005000\n1\n");
+    }
+
+    #[tokio::test]
+    async fn test_compilation_error() {
+        let elixir_code = r#"
+IO.puts("Missing parenthesis"
+"#;
+
+        let result = compile_elixir(elixir_code, "", &ExecContext::default()).await;
+        assert!(result.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_runtime_error() {
+        let elixir_code = r#"
+raise "Runtime error"
+"#;
+
+        let result = compile_elixir(elixir_code, "", &ExecContext::default()).await;
+        assert!(result.is_err());
+    }
+}
@@ -1,13 +1,58 @@
+use std::{os::unix::process::ExitStatusExt, process::ExitStatus, time::Duration};
+
+use base64::{Engine, engine::general_purpose::STANDARD};
 use thiserror::Error;
 
+use super::{crash::describe_signal, runner::OutputEncoding};
+
+// How much of each stream a run that timed out or crashed reports.
+pub const PARTIAL_OUTPUT_MAX_BYTES: usize = 64 << 10;
+
 #[derive(Error, Debug)]
 pub enum InfraError {
     #[error("Compilation failed: {0}")]
     CompilationError(#[source] Box<dyn std::error::Error + Send + Sync>),
 
+    // The compiler rejected the program, as opposed to the program failing
+    // once it ran. Holds the compiler's diagnostics.
+    #[error("Compilation failed: {0}")]
+    CompileError(String),
+
+    // The limit, and how far the program got before it was stopped.
+    #[error("Time limit of {}s exceeded", .0.as_secs_f64())]
+    Timeout(Duration, Box<PartialRun>),
+
+    #[error("Injected fault: {0}")]
+    InjectedFault(String),
+
+    #[error("Invalid archive: {0}")]
+    InvalidArchive(String),
+
+    #[error("Archive too large: {0}")]
+    ArchiveTooLarge(String),
+
+    #[error("Blocked system call: {0}")]
+    BlockedSyscall(String),
+
+    #[error("Disk quota of {0} bytes exceeded")]
+    DiskQuotaExceeded(u64),
+
+    #[error("Output limit of {0} bytes exceeded")]
+    OutputLimitExceeded(usize),
+
+    #[error("Execution was killed by an operator")]
+    Killed,
+
+    #[error("Plugin error: {0}")]
+    Plugin(String),
+
     #[error("Language not supported: {0}")]
     UnsupportedLanguage(String),
 
+    // A toolchain version asked for by name that is not installed here.
+    #[error("Unknown version: {0}")]
+    UnknownVersion(String),
+
     #[error("Failed to convert string: {0}")]
     StringParseError(#[from] std::string::FromUtf8Error),
 
@@ -17,3 +62,84 @@ pub enum InfraError {
     #[error("Failed to find the binary: {0}")]
     CompilerNotFound(#[from] which::Error),
 }
+
+impl InfraError {
+    // A timeout that has no output to report, as for a compiler.
+    pub fn timeout(limit: Duration) -> Self {
+        InfraError::Timeout(limit, Box::new(PartialRun::empty(limit)))
+    }
+}
+
+// What a program had written by the time it ran out of time or died, up to
+// PARTIAL_OUTPUT_MAX_BYTES of each stream. Stdout is encoded as the run
+// asked for; stderr is always text.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct PartialRun {
+    pub elapsed: Duration,
+    pub stdout: String,
+    pub stderr: String,
+}
+
+impl PartialRun {
+    pub fn new(elapsed: Duration, stdout: &[u8], stderr: &[u8], encoding: OutputEncoding) -> Self {
+        fn head(bytes: &[u8]) -> &[u8] {
+            &bytes[..bytes.len().min(PARTIAL_OUTPUT_MAX_BYTES)]
+        }
+        PartialRun {
+            elapsed,
+            stdout: match encoding {
+                OutputEncoding::Text => String::from_utf8_lossy(head(stdout)).into_owned(),
+                OutputEncoding::Base64 => STANDARD.encode(head(stdout)),
+            },
+            stderr: String::from_utf8_lossy(head(stderr)).into_owned(),
+        }
+    }
+
+    pub fn empty(elapsed: Duration) -> Self {
+        PartialRun {
+            elapsed,
+            ..PartialRun::default()
+        }
+    }
+}
+
+// A program that ran and exited unsuccessfully, wrapping the error its
+// language reported. A program killed by a signal has the signal named
+// after it, and the backtrace a debugger took, if any.
+#[derive(Error, Debug)]
+#[error("{source}{}", crash_details(.status, .stack))]
+pub struct Crash {
+    pub status: ExitStatus,
+    pub output: PartialRun,
+    // The backtrace a debugger took, innermost frame first.
+    pub stack: Vec<String>,
+    source: Box<dyn std::error::Error + Send + Sync>,
+}
+
+impl Crash {
+    pub fn new(
+        status: ExitStatus,
+        output: PartialRun,
+        stack: Vec<String>,
+        source: Box<dyn std::error::Error + Send + Sync>,
+    ) -> Self {
+        Crash {
+            status,
+            output,
+            stack,
+            source,
+        }
+    }
+}
+
+fn crash_details(status: &ExitStatus, stack: &[String]) -> String {
+    let mut details = String::new();
+    if let Some(signal) = status.signal() {
+        details.push_str(&format!("\nSignal: {}", describe_signal(signal)));
+    }
+    if !stack.is_empty() {
+        details.push_str("\nBacktrace:\n");
+        details.push_str(&stack.join("\n"));
+    }
+    details
+}
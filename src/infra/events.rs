@@ -0,0 +1,367 @@
+use std::{io, str::FromStr, time::Duration};
+
+use chrono::{DateTime, Utc};
+use futures_util::future::{BoxFuture, join_all};
+use reqwest::header::CONTENT_TYPE;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use tokio::{
+    io::AsyncWriteExt,
+    net::TcpStream,
+    sync::{Mutex, OnceCell, mpsc},
+};
+use utoipa::ToSchema;
+
+use super::{error::InfraError, logs::RunStatus, scheduler::ANONYMOUS_TENANT, trace::traceparent};
+use crate::config::config;
+
+// Events waiting for slow sinks beyond this are dropped rather than holding
+// up runs.
+const EVENT_BUFFER: usize = 1024;
+const WEBHOOK_TIMEOUT: Duration = Duration::from_secs(10);
+const NATS_DEFAULT_PORT: u16 = 4222;
+
+// Who submitted a run. The API key is only ever published as a hash.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+pub struct Submitter {
+    pub api_key_hash: Option<String>,
+    pub client_ip: Option<String>,
+}
+
+impl Submitter {
+    pub fn new(api_key: Option<&str>, client_ip: &str) -> Self {
+        Submitter {
+            api_key_hash: api_key.map(|key| format!("{:x}", Sha256::digest(key.as_bytes()))),
+            client_ip: Some(client_ip.to_string()),
+        }
+    }
+    // The tenant the run counts against, as `tenants::tenant_id` names it.
+    pub fn tenant(&self) -> &str {
+        self.api_key_hash.as_deref().unwrap_or(ANONYMOUS_TENANT)
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ExecutionEvent {
+    pub id: String,
+    pub lang: String,
+    pub status: RunStatus,
+    pub submitter: Submitter,
+    pub started_at: DateTime<Utc>,
+    pub finished_at: DateTime<Utc>,
+    pub duration_ms: u64,
+    // The W3C trace of the request or job the run was part of.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub traceparent: Option<String>,
+}
+
+impl ExecutionEvent {
+    pub fn new(
+        id: &str,
+        lang: &str,
+        submitter: &Submitter,
+        started_at: DateTime<Utc>,
+        result: &Result<String, InfraError>,
+    ) -> Self {
+        let finished_at = Utc::now();
+        ExecutionEvent {
+            id: id.to_string(),
+            lang: lang.to_lowercase(),
+            status: RunStatus::of(result),
+            submitter: submitter.clone(),
+            started_at,
+            finished_at,
+            duration_ms: (finished_at - started_at).num_milliseconds().max(0) as u64,
+            traceparent: traceparent(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum SinkAddress {
+    Webhook(String),
+    Nats { addr: String, subject: String },
+}
+
+// Where execution events go, parsed from a comma-separated list of URLs:
+// `http://` and `https://` URLs receive each event as a JSON POST, and
+// `nats://host:port/subject` publishes it on that subject. Every event is
+// sent to every sink.
+#[derive(Debug, Clone, Default)]
+pub struct EventSinks {
+    sinks: Vec<SinkAddress>,
+}
+
+impl FromStr for EventSinks {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut sinks = Vec::new();
+        for entry in s
+            .split(',')
+            .map(str::trim)
+            .filter(|entry| !entry.is_empty())
+        {
+            if entry.starts_with("http://") || entry.starts_with("https://") {
+                sinks.push(SinkAddress::Webhook(entry.to_string()));
+                continue;
+            }
+            let nats = entry
+                .strip_prefix("nats://")
+                .and_then(|rest| rest.split_once('/'))
+                .filter(|(host, subject)| !host.is_empty() && !subject.is_empty());
+            let Some((host, subject)) = nats else {
+                return Err(format!(
+                    "invalid event sink {:?}, expected an http(s) URL or nats://host/subject",
+                    entry
+                ));
+            };
+            let addr = if host.contains(':') {
+                host.to_string()
+            } else {
+                format!("{}:{}", host, NATS_DEFAULT_PORT)
+            };
+            sinks.push(SinkAddress::Nats {
+                addr,
+                subject: subject.to_string(),
+            });
+        }
+        Ok(EventSinks { sinks })
+    }
+}
+
+impl EventSinks {
+    pub fn addresses(&self) -> &[SinkAddress] {
+        &self.sinks
+    }
+}
+
+// A destination for serialized events. Implementations deliver at most once
+// and report failures rather than retrying.
+pub trait EventSink: Send + Sync {
+    fn publish<'a>(&'a self, payload: &'a [u8]) -> BoxFuture<'a, io::Result<()>>;
+}
+
+pub fn connect(address: &SinkAddress) -> Box<dyn EventSink> {
+    match address {
+        SinkAddress::Webhook(url) => Box::new(WebhookSink::new(url)),
+        SinkAddress::Nats { addr, subject } => Box::new(NatsSink::new(addr, subject)),
+    }
+}
+
+pub struct WebhookSink {
+    http: reqwest::Client,
+    url: String,
+}
+
+impl WebhookSink {
+    pub fn new(url: &str) -> Self {
+        WebhookSink {
+            http: reqwest::Client::builder()
+                .timeout(WEBHOOK_TIMEOUT)
+                .build()
+                .unwrap_or_default(),
+            url: url.to_string(),
+        }
+    }
+}
+
+impl EventSink for WebhookSink {
+    fn publish<'a>(&'a self, payload: &'a [u8]) -> BoxFuture<'a, io::Result<()>> {
+        Box::pin(async move {
+            let response = self
+                .http
+                .post(&self.url)
+                .header(CONTENT_TYPE, "application/json")
+                .body(payload.to_vec())
+                .send()
+                .await
+                .map_err(io::Error::other)?;
+            response.error_for_status().map_err(io::Error::other)?;
+            Ok(())
+        })
+    }
+}
+
+// Publishes over the NATS text protocol on one long-lived connection, opened
+// on first use and again whenever the server drops it.
+pub struct NatsSink {
+    addr: String,
+    subject: String,
+    conn: Mutex<Option<TcpStream>>,
+}
+
+impl NatsSink {
+    pub fn new(addr: &str, subject: &str) -> Self {
+        NatsSink {
+            addr: addr.to_string(),
+            subject: subject.to_string(),
+            conn: Mutex::new(None),
+        }
+    }
+
+    async fn open(&self) -> io::Result<TcpStream> {
+        let mut stream = TcpStream::connect(&self.addr).await?;
+        // The server's INFO greeting holds nothing a publisher needs.
+        stream
+            .write_all(b"CONNECT {\"verbose\":false,\"pedantic\":false}\r\n")
+            .await?;
+        Ok(stream)
+    }
+
+    fn frame(&self, payload: &[u8], pong: bool) -> Vec<u8> {
+        let mut frame = Vec::with_capacity(payload.len() + self.subject.len() + 32);
+        if pong {
+            frame.extend_from_slice(b"PONG\r\n");
+        }
+        frame.extend_from_slice(format!("PUB {} {}\r\n", self.subject, payload.len()).as_bytes());
+        frame.extend_from_slice(payload);
+        frame.extend_from_slice(b"\r\n");
+        frame
+    }
+}
+
+// Reads whatever the server sent since the last publish without waiting.
+// Returns whether it pinged, and fails if it closed the connection, so a
+// dead connection is replaced before an event is written into it.
+fn read_pending(stream: &TcpStream) -> io::Result<bool> {
+    let mut pinged = false;
+    let mut buf = [0u8; 4096];
+    loop {
+        match stream.try_read(&mut buf) {
+            Ok(0) => return Err(io::ErrorKind::UnexpectedEof.into()),
+            Ok(n) => pinged |= buf[..n].windows(4).any(|window| window == b"PING"),
+            Err(err) if err.kind() == io::ErrorKind::WouldBlock => return Ok(pinged),
+            Err(err) => return Err(err),
+        }
+    }
+}
+
+impl EventSink for NatsSink {
+    fn publish<'a>(&'a self, payload: &'a [u8]) -> BoxFuture<'a, io::Result<()>> {
+        Box::pin(async move {
+            let mut conn = self.conn.lock().await;
+            let pinged = match conn.as_ref().map(read_pending) {
+                Some(Ok(pinged)) => pinged,
+                _ => {
+                    *conn = Some(self.open().await?);
+                    false
+                }
+            };
+            let stream = conn.as_mut().unwrap();
+            if let Err(err) = stream.write_all(&self.frame(payload, pinged)).await {
+                *conn = None;
+                return Err(err);
+            }
+            Ok(())
+        })
+    }
+}
+
+static PUBLISHER: OnceCell<Option<mpsc::Sender<Vec<u8>>>> = OnceCell::const_new();
+
+async fn init_publisher() -> Option<mpsc::Sender<Vec<u8>>> {
+    let sinks: Vec<Box<dyn EventSink>> = config()
+        .await
+        .event_sinks()
+        .addresses()
+        .iter()
+        .map(connect)
+        .collect();
+    if sinks.is_empty() {
+        return None;
+    }
+    let (tx, rx) = mpsc::channel(EVENT_BUFFER);
+    tokio::spawn(fan_out(rx, sinks));
+    Some(tx)
+}
+
+async fn fan_out(mut events: mpsc::Receiver<Vec<u8>>, sinks: Vec<Box<dyn EventSink>>) {
+    while let Some(payload) = events.recv().await {
+        for result in join_all(sinks.iter().map(|sink| sink.publish(&payload))).await {
+            if let Err(err) = result {
+                tracing::warn!("failed to publish execution event: {}", err);
+            }
+        }
+    }
+}
+
+// Queues `event` for every configured sink without waiting for delivery.
+pub async fn publish(event: &ExecutionEvent) {
+    let Some(events) = PUBLISHER.get_or_init(init_publisher).await else {
+        return;
+    };
+    let payload = match serde_json::to_vec(event) {
+        Ok(payload) => payload,
+        Err(err) => {
+            tracing::warn!("failed to encode execution event {}: {}", event.id, err);
+            return;
+        }
+    };
+    if events.try_send(payload).is_err() {
+        tracing::warn!("event sinks are falling behind, dropped event {}", event.id);
+    }
+}
+
+#[cfg(test)]
+mod events_tests {
+    use super::*;
+    use tokio::{io::AsyncReadExt, net::TcpListener};
+
+    #[test]
+    fn test_parse_sinks_by_scheme() {
+        let sinks: EventSinks =
+            "https://example.com/runs, nats://nats:4223/runs.done,nats://nats/runs"
+                .parse()
+                .unwrap();
+        assert_eq!(
+            sinks.addresses(),
+            [
+                SinkAddress::Webhook("https://example.com/runs".into()),
+                SinkAddress::Nats {
+                    addr: "nats:4223".into(),
+                    subject: "runs.done".into()
+                },
+                SinkAddress::Nats {
+                    addr: "nats:4222".into(),
+                    subject: "runs".into()
+                },
+            ]
+        );
+        assert!("".parse::<EventSinks>().unwrap().addresses().is_empty());
+        assert!("kafka://broker/runs".parse::<EventSinks>().is_err());
+        assert!("nats://nats".parse::<EventSinks>().is_err());
+    }
+
+    #[test]
+    fn test_submitter_hashes_the_api_key() {
+        let submitter = Submitter::new(Some("secret"), "10.0.0.1");
+        assert_eq!(
+            submitter.api_key_hash.as_deref(),
+            Some("2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b")
+        );
+        assert_eq!(submitter.client_ip.as_deref(), Some("10.0.0.1"));
+        assert_eq!(Submitter::new(None, "10.0.0.1").api_key_hash, None);
+    }
+
+    #[tokio::test]
+    async fn test_nats_sink_publishes_on_subject() {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let sink = NatsSink::new(&listener.local_addr().unwrap().to_string(), "runs");
+        let server = tokio::spawn(async move {
+            let (mut stream, _) = listener.accept().await.unwrap();
+            let mut received = Vec::new();
+            while !received.ends_with(b"{}\r\n") {
+                let mut buf = [0u8; 256];
+                let n = stream.read(&mut buf).await.unwrap();
+                received.extend_from_slice(&buf[..n]);
+            }
+            String::from_utf8(received).unwrap()
+        });
+
+        sink.publish(b"{}").await.unwrap();
+        let received = server.await.unwrap();
+        assert!(received.starts_with("CONNECT "));
+        assert!(received.ends_with("PUB runs 2\r\n{}\r\n"));
+    }
+}
@@ -0,0 +1,337 @@
+use std::{
+    collections::BTreeMap,
+    fs,
+    future::Future,
+    sync::{
+        Arc, Mutex,
+        atomic::{AtomicU32, Ordering},
+    },
+    time::{Duration, Instant},
+};
+
+use chrono::{DateTime, Utc};
+use serde::Serialize;
+use tokio::sync::Notify;
+use utoipa::ToSchema;
+
+use super::{error::InfraError, events::Submitter, tenants::tenants, tier::tiers};
+
+tokio::task_local! {
+    static CURRENT: Arc<Execution>;
+}
+
+// A run in progress in this process. Runs handed to remote workers are
+// listed by the worker running them, not here.
+struct Execution {
+    id: String,
+    lang: String,
+    submitter: Submitter,
+    started_at: DateTime<Utc>,
+    // The program or compiler currently running for it, 0 between steps. It
+    // leads a process group of its own, holding whatever it started.
+    pid: AtomicU32,
+    killed: Notify,
+    // Every program it runs, for its tenant's usage.
+    meter: UsageMeter,
+}
+
+static RUNNING: Mutex<BTreeMap<String, Arc<Execution>>> = Mutex::new(BTreeMap::new());
+
+#[derive(Debug, Clone, Serialize, ToSchema)]
+pub struct ExecutionInfo {
+    pub id: String,
+    pub lang: String,
+    pub submitter: Submitter,
+    pub started_at: DateTime<Utc>,
+    pub elapsed_ms: u64,
+    /// Usage of the process currently running, absent between compiling
+    /// and running or for languages executed in-process
+    pub usage: Option<ProcessUsage>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, ToSchema)]
+pub struct ProcessUsage {
+    pub pid: u32,
+    pub cpu_ms: u64,
+    pub memory_bytes: u64,
+}
+
+impl ProcessUsage {
+    // Reads CPU time and resident memory from /proc, so only the process
+    // itself is counted and not anything it started.
+    pub(super) fn read(pid: u32) -> Option<Self> {
+        let stat = fs::read_to_string(format!("/proc/{}/stat", pid)).ok()?;
+        // The command name can hold spaces; the fields after it cannot.
+        let fields: Vec<&str> = stat.rsplit_once(')')?.1.split_whitespace().collect();
+        let field = |index: usize| fields.get(index)?.parse::<u64>().ok();
+        let (utime, stime, rss) = (field(11)?, field(12)?, field(21)?);
+        let ticks = unsafe { libc::sysconf(libc::_SC_CLK_TCK) }.max(1) as u64;
+        let page = unsafe { libc::sysconf(libc::_SC_PAGESIZE) }.max(1) as u64;
+        Some(ProcessUsage {
+            pid,
+            cpu_ms: (utime + stime) * 1000 / ticks,
+            memory_bytes: rss * page,
+        })
+    }
+}
+
+// Collects the run time and peak resident memory of the programs started
+// with a context carrying it. Only programs the runner starts as processes
+// are measured, not languages executed in-process.
+#[derive(Debug, Clone, Default)]
+pub struct UsageMeter(Arc<Mutex<Measured>>);
+
+#[derive(Debug, Clone, Copy, Default)]
+struct Measured {
+    time_ms: Option<u64>,
+    cpu_ms: Option<u64>,
+    memory_bytes: Option<u64>,
+    memory_byte_seconds: f64,
+}
+
+impl UsageMeter {
+    // Wall time, summed over every program run.
+    pub fn time_ms(&self) -> Option<u64> {
+        self.0.lock().unwrap().time_ms
+    }
+
+    // CPU time of the program that spent the most, as of the last sample
+    // taken before it exited.
+    pub fn cpu_ms(&self) -> Option<u64> {
+        self.0.lock().unwrap().cpu_ms
+    }
+
+    // The most any one program held at once.
+    pub fn memory_bytes(&self) -> Option<u64> {
+        self.0.lock().unwrap().memory_bytes
+    }
+
+    // Resident memory integrated over the time it was held, which is what a
+    // run costs the host better than its peak does.
+    pub fn memory_mib_seconds(&self) -> f64 {
+        self.0.lock().unwrap().memory_byte_seconds / (1 << 20) as f64
+    }
+
+    pub(super) fn record_time(&self, elapsed: Duration) {
+        let mut measured = self.0.lock().unwrap();
+        measured.time_ms = Some(measured.time_ms.unwrap_or_default() + elapsed.as_millis() as u64);
+    }
+
+    // Reads the high-water mark of `pid`'s resident memory, which the kernel
+    // keeps itself, so samples taken now and then still see the peak between
+    // them. Nothing is left to read once the process has exited. The memory
+    // resident now is counted as held for all of `interval`, the time until
+    // the next sample. The CPU time spent so far is read alongside.
+    pub(super) fn sample_memory(&self, pid: u32, interval: Duration) {
+        let Ok(status) = fs::read_to_string(format!("/proc/{}/status", pid)) else {
+            return;
+        };
+        let cpu_ms = ProcessUsage::read(pid).map(|usage| usage.cpu_ms);
+        let kb = |field: &str| {
+            status
+                .lines()
+                .find_map(|line| line.strip_prefix(field))
+                .and_then(|value| value.trim().strip_suffix("kB"))
+                .and_then(|kb| kb.trim().parse::<u64>().ok())
+        };
+        let mut measured = self.0.lock().unwrap();
+        measured.cpu_ms = measured.cpu_ms.max(cpu_ms);
+        if let Some(peak) = kb("VmHWM:") {
+            measured.memory_bytes = measured.memory_bytes.max(Some(peak * 1024));
+        }
+        if let Some(resident) = kb("VmRSS:") {
+            measured.memory_byte_seconds += (resident * 1024) as f64 * interval.as_secs_f64();
+        }
+    }
+}
+
+// Removes an execution from the list however its run ends, including when
+// the request that started it goes away.
+struct Listed(Arc<Execution>);
+
+impl Drop for Listed {
+    fn drop(&mut self) {
+        let mut running = RUNNING.lock().unwrap();
+        if running
+            .get(&self.0.id)
+            .is_some_and(|execution| Arc::ptr_eq(execution, &self.0))
+        {
+            running.remove(&self.0.id);
+        }
+    }
+}
+
+// Runs `run` as the execution `id`, listed while it runs and ended early if
+// it is killed. What it used is added to the submitter's tenant.
+pub async fn tracked<F>(
+    id: &str,
+    lang: &str,
+    submitter: &Submitter,
+    run: F,
+) -> Result<String, InfraError>
+where
+    F: Future<Output = Result<String, InfraError>>,
+{
+    let execution = Arc::new(Execution {
+        id: id.to_string(),
+        lang: lang.to_lowercase(),
+        submitter: submitter.clone(),
+        started_at: Utc::now(),
+        pid: AtomicU32::new(0),
+        killed: Notify::new(),
+        meter: UsageMeter::default(),
+    });
+    RUNNING
+        .lock()
+        .unwrap()
+        .insert(id.to_string(), execution.clone());
+    let _listed = Listed(execution.clone());
+
+    // Dropping `run` drops the child process, which kills it.
+    let started = Instant::now();
+    let result = tokio::select! {
+        result = CURRENT.scope(execution.clone(), run) => result,
+        _ = execution.killed.notified() => Err(InfraError::Killed),
+    };
+    tenants().record(
+        tiers().await.tenant(submitter.tenant()),
+        started.elapsed(),
+        execution.meter.memory_mib_seconds(),
+        result.is_err(),
+    );
+    result
+}
+
+pub fn in_progress() -> usize {
+    RUNNING.lock().unwrap().len()
+}
+
+pub fn running() -> Vec<ExecutionInfo> {
+    let now = Utc::now();
+    RUNNING
+        .lock()
+        .unwrap()
+        .values()
+        .map(|execution| {
+            let pid = execution.pid.load(Ordering::Relaxed);
+            ExecutionInfo {
+                id: execution.id.clone(),
+                lang: execution.lang.clone(),
+                submitter: execution.submitter.clone(),
+                started_at: execution.started_at,
+                elapsed_ms: (now - execution.started_at).num_milliseconds().max(0) as u64,
+                usage: (pid != 0).then(|| ProcessUsage::read(pid)).flatten(),
+            }
+        })
+        .collect()
+}
+
+// Returns false if no execution `id` is running.
+pub fn kill(id: &str) -> bool {
+    match RUNNING.lock().unwrap().get(id) {
+        Some(execution) => {
+            tracing::warn!("killing execution {}", id);
+            // Ending the run kills its process group too; signalling it now
+            // stops the program even while the run is not being polled.
+            let pid = execution.pid.load(Ordering::Relaxed);
+            if pid != 0 {
+                unsafe {
+                    libc::killpg(pid as libc::pid_t, libc::SIGKILL);
+                }
+            }
+            execution.killed.notify_one();
+            true
+        }
+        None => false,
+    }
+}
+
+// Records `pid` as the process the current execution is waiting on, until
+// the returned guard is dropped.
+pub fn attach(pid: Option<u32>) -> Attached {
+    let execution = CURRENT.try_with(Arc::clone).ok();
+    if let (Some(execution), Some(pid)) = (&execution, pid) {
+        execution.pid.store(pid, Ordering::Relaxed);
+    }
+    Attached(execution)
+}
+
+pub struct Attached(Option<Arc<Execution>>);
+
+impl Attached {
+    // The current execution's own meter, fed alongside the context's.
+    pub fn meter(&self) -> Option<&UsageMeter> {
+        self.0.as_ref().map(|execution| &execution.meter)
+    }
+}
+
+impl Drop for Attached {
+    fn drop(&mut self) {
+        if let Some(execution) = &self.0 {
+            execution.pid.store(0, Ordering::Relaxed);
+        }
+    }
+}
+
+#[cfg(test)]
+mod executions_tests {
+    use super::*;
+    use tokio::process::Command;
+
+    use crate::infra::runner::{ExecContext, run_program};
+
+    #[tokio::test]
+    async fn test_running_execution_is_listed_and_can_be_killed() {
+        let run = async {
+            let mut cmd = Command::new("sleep");
+            cmd.arg("30");
+            run_program(&mut cmd, "", &ExecContext::default())
+                .await
+                .map(|_| String::new())
+        };
+        let handle =
+            tokio::spawn(
+                async move { tracked("exec-kill", "Bash", &Submitter::default(), run).await },
+            );
+
+        let listed = loop {
+            let found = running().into_iter().find(|info| info.id == "exec-kill");
+            if let Some(info) = found.filter(|info| info.usage.is_some()) {
+                break info;
+            }
+            tokio::time::sleep(Duration::from_millis(10)).await;
+        };
+        assert_eq!(listed.lang, "bash");
+
+        assert!(kill("exec-kill"));
+        let result = tokio::time::timeout(Duration::from_secs(5), handle)
+            .await
+            .unwrap()
+            .unwrap();
+        assert!(matches!(result, Err(InfraError::Killed)));
+        assert!(!running().iter().any(|info| info.id == "exec-kill"));
+        assert!(!kill("exec-kill"));
+    }
+
+    #[test]
+    fn test_meter_keeps_the_peak_and_sums_time() {
+        let meter = UsageMeter::default();
+        assert_eq!((meter.time_ms(), meter.memory_bytes()), (None, None));
+        meter.sample_memory(std::process::id(), Duration::from_secs(2));
+        meter.sample_memory(u32::MAX, Duration::from_secs(2));
+        assert!(meter.memory_bytes().unwrap() > 0);
+        let resident = meter.memory_bytes().unwrap() as f64 / (1 << 20) as f64;
+        assert!(meter.memory_mib_seconds() > 0.0);
+        assert!(meter.memory_mib_seconds() <= resident * 2.0);
+        meter.record_time(Duration::from_millis(30));
+        meter.record_time(Duration::from_millis(12));
+        assert_eq!(meter.time_ms(), Some(42));
+    }
+
+    #[test]
+    fn test_usage_reads_this_process() {
+        let usage = ProcessUsage::read(std::process::id()).unwrap();
+        assert!(usage.memory_bytes > 0);
+        assert!(ProcessUsage::read(u32::MAX).is_none());
+    }
+}
@@ -0,0 +1,129 @@
+use super::{
+    error::InfraError,
+    language::Language,
+    profile,
+    runner::{ExecContext, run_compiler},
+    shared_build::build_once,
+    source::SourceFile,
+};
+
+pub async fn compile_fortran(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::FORTRAN, content)?;
+    let source_path = source.path().to_path_buf();
+    let executable_path = source.dir().join("main");
+
+    build_once(ctx, source.path(), &executable_path, async {
+        // gfortran writes .mod files for the program's modules to the working
+        // directory, so it compiles from the source's own.
+        let mut compile = ctx.command("gfortran")?;
+        compile
+            .current_dir(source.dir())
+            .arg(&source_path)
+            .arg("-o")
+            .arg(&executable_path)
+            .args(ctx.compiler_flags());
+        let compile_output = run_compiler(&mut compile, ctx).await?;
+        if !compile_output.status.success() {
+            let stderr = String::from_utf8_lossy(&compile_output.stderr);
+            return Err(InfraError::CompileError(format!(
+                "Fortran compilation failed:\n{}",
+                stderr
+            )));
+        }
+        ctx.record_warnings(&compile_output.stderr);
+        Ok(())
+    })
+    .await?;
+
+    let output = profile::run_native(&executable_path, stdin_input, ctx).await?;
+    match output.status.code() {
+        Some(0) => {
+            if let Some(dir) = ctx.profile_dir() {
+                profile::report_native(dir, ctx).await?;
+            }
+            Ok(String::from_utf8(output.stdout)?)
+        }
+        Some(code) => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!(
+                    "Fortran program execution failed with status code: {}\nError: {}",
+                    code, stderr
+                )
+                .into(),
+            ))
+        }
+        None => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!("Fortran program terminated by signal\nError: {}", stderr).into(),
+            ))
+        }
+    }
+}
+
+#[cfg(test)]
+mod fortran_tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_simple_hello_world() {
+        let result =
+            compile_fortran(Language::FORTRAN.template(), "", &ExecContext::default()).await;
+        assert_eq!(result.unwrap().trim(), "Hello, World!");
+    }
+
+    #[tokio::test]
+    async fn test_stdin_input() {
+        let fortran_code = r#"
+program sum
+    implicit none
+    integer :: a, b
+    read (*, *) a, b
+    print '(i0)', a + b
+end program sum
+"#;
+        let result = compile_fortran(fortran_code, "2 3\n", &ExecContext::default()).await;
+        assert_eq!(result.unwrap().trim(), "5");
+    }
+
+    #[tokio::test]
+    async fn test_modules() {
+        let fortran_code = r#"
+module geometry
+    implicit none
+contains
+    real function area(r)
+        real, intent(in) :: r
+        area = 3.0 * r * r
+    end function area
+end module geometry
+
+program main
+    use geometry
+    implicit none
+    print '(f0.1)', area(2.0)
+end program main
+"#;
+        let result = compile_fortran(fortran_code, "", &ExecContext::default()).await;
+        assert_eq!(result.unwrap().trim(), "12.0");
+    }
+
+    #[tokio::test]
+    async fn test_compilation_error() {
+        let fortran_code = "program main\n    print *, undefined_name\nend program main\n";
+        let result = compile_fortran(fortran_code, "", &ExecContext::default()).await;
+        assert!(matches!(result, Err(InfraError::CompileError(_))));
+    }
+
+    #[tokio::test]
+    async fn test_runtime_error() {
+        let fortran_code = "program main\n    error stop 3\nend program main\n";
+        let result = compile_fortran(fortran_code, "", &ExecContext::default()).await;
+        assert!(result.unwrap_err().to_string().contains("status code: 3"));
+    }
+}
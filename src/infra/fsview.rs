@@ -0,0 +1,314 @@
+use std::{
+    collections::BTreeSet,
+    ffi::{CStr, CString},
+    fs, io,
+    os::unix::{ffi::OsStrExt, fs::MetadataExt},
+    path::{Path, PathBuf},
+    sync::OnceLock,
+};
+
+use libc::{
+    AT_FDCWD, AT_RECURSIVE, CLONE_NEWNS, CLONE_NEWUSER, MOUNT_ATTR_RDONLY, MOVE_MOUNT_F_EMPTY_PATH,
+    MS_NODEV, MS_NOSUID, MS_PRIVATE, MS_REC, O_CLOEXEC, O_WRONLY, OPEN_TREE_CLOEXEC,
+    OPEN_TREE_CLONE, SYS_mount_setattr, SYS_move_mount, SYS_open_tree, c_int, c_long, mount_attr,
+};
+use nix::unistd::{getegid, geteuid};
+use tokio::process::Command;
+
+use super::sandbox::{SandboxUser, sandboxed};
+
+// What executed programs see of the filesystem: every mount read-only, the
+// hidden paths empty, and of the execution zone only the run's own
+// directories, which stay writable. Built from a user and mount namespace
+// the program enters before it starts, so it needs no privileges beyond
+// what unprivileged user namespaces allow, and the server is unaffected.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct FilesystemView {
+    zone: PathBuf,
+    hidden: Vec<PathBuf>,
+}
+
+impl FilesystemView {
+    // `hidden` is a colon-separated list of directories. None may hold the
+    // execution zone, since programs run from it.
+    pub fn new(zone: &Path, hidden: &str) -> Result<Self, String> {
+        let hidden: Vec<_> = hidden
+            .split(':')
+            .map(str::trim)
+            .filter(|path| !path.is_empty())
+            .map(PathBuf::from)
+            .collect();
+        for path in &hidden {
+            if !path.is_absolute() {
+                return Err(format!("hidden path {} is not absolute", path.display()));
+            }
+            if zone.starts_with(path) {
+                return Err(format!(
+                    "hidden path {} holds the execution zone",
+                    path.display()
+                ));
+            }
+        }
+        Ok(FilesystemView {
+            zone: zone.to_path_buf(),
+            hidden,
+        })
+    }
+
+    // The run's own directories in the zone: its workspace, and those handed
+    // to its sandbox user, such as the one holding its source. Nothing the
+    // command names is trusted, since a request picks its own arguments,
+    // compiler flags and environment.
+    fn kept(&self, workspace: Option<&Path>, user: Option<SandboxUser>) -> BTreeSet<PathBuf> {
+        let mut kept = BTreeSet::new();
+        if let Some(entry) = workspace
+            .and_then(|workspace| workspace.strip_prefix(&self.zone).ok())
+            .and_then(|rest| rest.components().next())
+        {
+            kept.insert(self.zone.join(entry));
+        }
+        if let (Some(user), Ok(entries)) = (user, fs::read_dir(&self.zone)) {
+            for entry in entries.flatten() {
+                // Not followed, so a link to another run's directory is not
+                // taken for the run's own.
+                let Ok(metadata) = entry.metadata() else {
+                    continue;
+                };
+                if metadata.is_dir() && metadata.uid() == user.uid() {
+                    kept.insert(entry.path());
+                }
+            }
+        }
+        kept.retain(|dir| dir.is_dir());
+        kept
+    }
+
+    // Has `cmd` enter the view just before it starts, once it runs as
+    // `user` or as the server's own user, keeping `workspace`. Call it
+    // after everything else about the command is settled.
+    pub fn apply(
+        &self,
+        cmd: &mut Command,
+        user: Option<SandboxUser>,
+        workspace: Option<&Path>,
+    ) -> io::Result<()> {
+        let (uid, gid) = match user {
+            Some(user) => (user.uid(), user.gid()),
+            None => (geteuid().as_raw(), getegid().as_raw()),
+        };
+        let kept = self.kept(workspace, user);
+        let mut entry = Entry {
+            uid_map: format!("{} {} 1", uid, uid),
+            gid_map: format!("{} {} 1", gid, gid),
+            hidden: self
+                .hidden
+                .iter()
+                .filter(|path| path.is_dir())
+                .map(|path| c_path(path))
+                .collect::<io::Result<_>>()?,
+            zone: c_path(&self.zone)?,
+            kept: kept
+                .iter()
+                .map(|dir| c_path(dir))
+                .collect::<io::Result<_>>()?,
+            trees: Vec::with_capacity(kept.len()),
+            cwd: c_path(cmd.as_std().get_current_dir().unwrap_or(Path::new("/")))?,
+        };
+        unsafe {
+            cmd.pre_exec(move || entry.enter());
+        }
+        Ok(())
+    }
+}
+
+fn c_path(path: &Path) -> io::Result<CString> {
+    CString::new(path.as_os_str().as_bytes()).map_err(io::Error::from)
+}
+
+// Everything the started process needs to enter the view, prepared in the
+// server so that nothing is allocated after the fork.
+struct Entry {
+    uid_map: String,
+    gid_map: String,
+    hidden: Vec<CString>,
+    zone: CString,
+    kept: Vec<CString>,
+    trees: Vec<c_int>,
+    cwd: CString,
+}
+
+fn check(ret: c_long) -> io::Result<c_long> {
+    if ret < 0 {
+        Err(io::Error::last_os_error())
+    } else {
+        Ok(ret)
+    }
+}
+
+impl Entry {
+    fn enter(&mut self) -> io::Result<()> {
+        unsafe {
+            check(libc::unshare(CLONE_NEWUSER | CLONE_NEWNS) as c_long)?;
+            write_proc(c"/proc/self/setgroups", b"deny")?;
+            write_proc(c"/proc/self/uid_map", self.uid_map.as_bytes())?;
+            write_proc(c"/proc/self/gid_map", self.gid_map.as_bytes())?;
+            check(libc::mount(
+                std::ptr::null(),
+                c"/".as_ptr(),
+                std::ptr::null(),
+                MS_REC | MS_PRIVATE,
+                std::ptr::null(),
+            ) as c_long)?;
+
+            // The run's directories are detached before the zone is covered,
+            // and put back in the empty zone after.
+            self.trees.clear();
+            for dir in &self.kept {
+                let flags = OPEN_TREE_CLONE | OPEN_TREE_CLOEXEC | AT_RECURSIVE as u32;
+                let tree = libc::syscall(SYS_open_tree, AT_FDCWD, dir.as_ptr(), flags);
+                self.trees.push(check(tree)? as c_int);
+            }
+            for dir in self.hidden.iter().chain(std::iter::once(&self.zone)) {
+                check(libc::mount(
+                    c"tmpfs".as_ptr(),
+                    dir.as_ptr(),
+                    c"tmpfs".as_ptr(),
+                    MS_NOSUID | MS_NODEV,
+                    c"mode=0755".as_ptr().cast(),
+                ) as c_long)?;
+            }
+            for (dir, tree) in self.kept.iter().zip(&self.trees) {
+                check(libc::mkdir(dir.as_ptr(), 0o755) as c_long)?;
+                check(libc::syscall(
+                    SYS_move_mount,
+                    *tree,
+                    c"".as_ptr(),
+                    AT_FDCWD,
+                    dir.as_ptr(),
+                    MOVE_MOUNT_F_EMPTY_PATH,
+                ))?;
+                libc::close(*tree);
+            }
+
+            set_mount_attr(c"/", MOUNT_ATTR_RDONLY, 0)?;
+            for dir in &self.kept {
+                set_mount_attr(dir, 0, MOUNT_ATTR_RDONLY)?;
+            }
+            // The old working directory is now out of sight, and read-only.
+            check(libc::chdir(self.cwd.as_ptr()) as c_long)?;
+        }
+        Ok(())
+    }
+}
+
+unsafe fn write_proc(path: &CStr, contents: &[u8]) -> io::Result<()> {
+    unsafe {
+        let fd = check(libc::open(path.as_ptr(), O_WRONLY | O_CLOEXEC) as c_long)? as c_int;
+        let written = libc::write(fd, contents.as_ptr().cast(), contents.len());
+        libc::close(fd);
+        check(written as c_long)?;
+    }
+    Ok(())
+}
+
+unsafe fn set_mount_attr(path: &CStr, set: u64, clear: u64) -> io::Result<()> {
+    let attr = mount_attr {
+        attr_set: set,
+        attr_clr: clear,
+        propagation: 0,
+        userns_fd: 0,
+    };
+    unsafe {
+        check(libc::syscall(
+            SYS_mount_setattr,
+            AT_FDCWD,
+            path.as_ptr(),
+            AT_RECURSIVE,
+            &attr as *const mount_attr,
+            size_of::<mount_attr>(),
+        ))?;
+    }
+    Ok(())
+}
+
+static FILESYSTEM_VIEW: OnceLock<Option<FilesystemView>> = OnceLock::new();
+
+pub fn filesystem_view() -> Option<&'static FilesystemView> {
+    FILESYSTEM_VIEW.get().and_then(Option::as_ref)
+}
+
+// Called once at startup, after the execution zone and the sandbox users
+// are in place. A program left with root's uid keeps every capability in
+// the namespace it enters, and could simply unmount what covers the zone,
+// so the view is refused unless programs run as sandbox users.
+pub fn init_filesystem_view(view: Option<FilesystemView>) {
+    if let Some(view) = &view {
+        assert!(
+            sandboxed(),
+            "READONLY_ROOT_ENABLED is set but SANDBOX_USER is not, so programs would run as root"
+        );
+        tracing::info!(
+            "running submissions on a read-only filesystem, hiding {:?}",
+            view.hidden
+        );
+    }
+    if FILESYSTEM_VIEW.set(view).is_err() {
+        tracing::warn!("filesystem view was already initialised");
+    }
+}
+
+#[cfg(test)]
+mod fsview_tests {
+    use super::*;
+    use std::fs;
+
+    #[test]
+    fn test_new_rejects_paths_it_cannot_hide() {
+        let zone = Path::new("/var/lib/comphub/zone");
+        let view = FilesystemView::new(zone, "/srv/comphub: /etc/comphub:").unwrap();
+        assert_eq!(
+            view.hidden,
+            [PathBuf::from("/srv/comphub"), PathBuf::from("/etc/comphub")]
+        );
+        assert!(FilesystemView::new(zone, "etc").is_err());
+        assert!(FilesystemView::new(zone, "/var/lib").is_err());
+    }
+
+    #[tokio::test]
+    async fn test_programs_write_only_their_own_directories() {
+        let zone = tempfile::tempdir().unwrap();
+        let hidden = tempfile::tempdir().unwrap();
+        fs::write(hidden.path().join("secret"), "key").unwrap();
+        let workspace = zone.path().join("workspace");
+        let other = zone.path().join("other");
+        fs::create_dir(&workspace).unwrap();
+        fs::create_dir(&other).unwrap();
+        fs::write(other.join("theirs"), "x").unwrap();
+
+        let view = FilesystemView::new(zone.path(), &hidden.path().to_string_lossy()).unwrap();
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c")
+            .arg(
+                "echo ok > mine && cat mine; ls \"$1\"; ls \"$2\"; touch \"$3/x\" 2>/dev/null \
+                 || echo read-only",
+            )
+            .arg("sh")
+            .arg(hidden.path())
+            .arg(zone.path())
+            .arg(hidden.path().parent().unwrap())
+            .current_dir(&workspace);
+        view.apply(&mut cmd, None, Some(&workspace)).unwrap();
+        let output = match cmd.output().await {
+            Ok(output) => output,
+            // Without user namespaces there is nothing to test.
+            Err(err) if err.raw_os_error() == Some(libc::EPERM) => return,
+            Err(err) => panic!("{}", err),
+        };
+        assert_eq!(
+            String::from_utf8_lossy(&output.stdout),
+            "ok\nworkspace\nread-only\n"
+        );
+        assert_eq!(fs::read_to_string(workspace.join("mine")).unwrap(), "ok\n");
+        assert!(!hidden.path().parent().unwrap().join("x").exists());
+    }
+}
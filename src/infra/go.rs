@@ -1,16 +1,278 @@
-use super::error::InfraError;
-use std::{fs::File, io::Write, process::Stdio};
-use tempfile::{TempDir};
-use tokio::{fs::metadata, io::AsyncWriteExt, process::Command};
-use which::which;
+use std::{
+    fs,
+    path::{Path, PathBuf},
+    str::FromStr,
+};
+
+use crate::config::config;
+
+use super::{
+    coverage::CoverageReport,
+    error::InfraError,
+    language::Language,
+    profile::{self, GO_HOOK_FILE},
+    runner::{ExecContext, run_compiler, run_program},
+    sandbox::sandbox_user,
+    source::SourceFile,
+};
+use tokio::{fs::metadata, process::Command};
+
+// A module submissions may import, optionally pinned to a version; unpinned
+// modules resolve to the newest version in the module cache.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct GoModule {
+    pub path: String,
+    pub version: Option<String>,
+}
+
+// The allow-list of third-party modules, parsed from a comma-separated list
+// of `path` or `path@version` entries.
+#[derive(Debug, Clone, Default)]
+pub struct GoModules {
+    modules: Vec<GoModule>,
+}
+
+impl FromStr for GoModules {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut modules = Vec::new();
+        for entry in s
+            .split(',')
+            .map(str::trim)
+            .filter(|entry| !entry.is_empty())
+        {
+            let (path, version) = match entry.split_once('@') {
+                Some((path, version)) => (path, Some(version.to_string())),
+                None => (entry, None),
+            };
+            if !path
+                .split('/')
+                .next()
+                .is_some_and(|host| host.contains('.'))
+                || version
+                    .as_deref()
+                    .is_some_and(|version| !version.starts_with('v'))
+            {
+                return Err(format!(
+                    "invalid go module {:?}, expected path[@vX.Y.Z]",
+                    entry
+                ));
+            }
+            modules.push(GoModule {
+                path: path.to_string(),
+                version,
+            });
+        }
+        Ok(GoModules { modules })
+    }
+}
+
+impl GoModules {
+    // The module providing the package `import`, if it is allowed.
+    pub fn providing(&self, import: &str) -> Option<&GoModule> {
+        self.modules.iter().find(|module| {
+            import == module.path
+                || import
+                    .strip_prefix(&module.path)
+                    .is_some_and(|rest| rest.starts_with('/'))
+        })
+    }
+
+    pub fn names(&self) -> Vec<&str> {
+        self.modules
+            .iter()
+            .map(|module| module.path.as_str())
+            .collect()
+    }
+}
+
+// Import paths in the file's import declarations, which Go requires to come
+// before anything else.
+fn imports(content: &str) -> Vec<String> {
+    let mut imports = Vec::new();
+    let mut in_block = false;
+    for line in content.lines().map(str::trim) {
+        let spec = if in_block {
+            if line.starts_with(')') {
+                in_block = false;
+                continue;
+            }
+            line
+        } else if let Some(rest) = line.strip_prefix("import") {
+            let rest = rest.trim_start();
+            if rest.starts_with('(') {
+                in_block = true;
+                &rest[1..]
+            } else {
+                rest
+            }
+        } else if ["func", "type", "var", "const"]
+            .iter()
+            .any(|kw| line.starts_with(kw))
+        {
+            break;
+        } else {
+            continue;
+        };
+        let mut quoted = spec.split(['"', '`']);
+        if let (Some(_), Some(path)) = (quoted.next(), quoted.next()) {
+            if !path.is_empty() {
+                imports.push(path.to_string());
+            }
+        }
+    }
+    imports
+}
+
+// Standard library packages never have a dot in their first element.
+fn is_third_party(import: &str) -> bool {
+    import
+        .split('/')
+        .next()
+        .is_some_and(|host| host.contains('.'))
+}
+
+fn go_mod(required: &[&GoModule]) -> String {
+    let mut go_mod = String::from("module main\n");
+    let pinned: Vec<_> = required
+        .iter()
+        .filter_map(|module| Some((&module.path, module.version.as_ref()?)))
+        .collect();
+    if !pinned.is_empty() {
+        go_mod.push_str("\nrequire (\n");
+        for (path, version) in pinned {
+            go_mod.push_str(&format!("\t{} {}\n", path, version));
+        }
+        go_mod.push_str(")\n");
+    }
+    go_mod
+}
+
+// Resolves modules from the pre-downloaded cache alone: it doubles as the
+// proxy, and nothing may be fetched or checked against the network.
+fn offline_go(cmd: &mut Command, cache: &Path) {
+    let proxy = format!("file://{}", cache.join("cache/download").display());
+    cmd.env("GOMODCACHE", cache)
+        .env("GOPROXY", proxy)
+        .env("GOFLAGS", "-mod=mod")
+        .env("GOSUMDB", "off")
+        .env("GOTOOLCHAIN", "local");
+}
+
+async fn go_step(
+    ctx: &ExecContext,
+    dir: &Path,
+    cache: &Path,
+    args: &[&str],
+) -> Result<(), InfraError> {
+    let mut cmd = ctx.command("go")?;
+    cmd.args(args).current_dir(dir).kill_on_drop(true);
+    offline_go(&mut cmd, cache);
+    let output = cmd.output().await?;
+    if output.status.success() {
+        return Ok(());
+    }
+    Err(InfraError::CompilationError(
+        format!(
+            "go {} failed:\n{}",
+            args[0],
+            String::from_utf8_lossy(&output.stderr)
+        )
+        .into(),
+    ))
+}
 
-pub async fn compile_go(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let temp_dir = TempDir::new()?;
-    let temp_file_path = temp_dir.path().join("program.go");
+// Programs importing third-party packages are built as a module of their
+// own, against the allow-listed modules in the cache, and then run.
+async fn build_module(
+    source: &SourceFile,
+    third_party: &[String],
+    ctx: &ExecContext,
+) -> Result<PathBuf, InfraError> {
+    let app_config = config().await;
+    let allowed = app_config.go_modules();
+    let mut required: Vec<&GoModule> = Vec::new();
+    for import in third_party {
+        match allowed.providing(import) {
+            Some(module) if !required.contains(&module) => required.push(module),
+            Some(_) => {}
+            None => {
+                return Err(InfraError::CompilationError(
+                    format!(
+                        "package {} is not available; allowed modules: {}",
+                        import,
+                        allowed.names().join(", ")
+                    )
+                    .into(),
+                ));
+            }
+        }
+    }
+    let Some(cache) = app_config.go_module_cache() else {
+        return Err(InfraError::CompilationError(
+            "third-party Go packages are not available on this instance".into(),
+        ));
+    };
+
+    let dir = source.dir();
+    let go_mod_path = dir.join("go.mod");
+    fs::write(&go_mod_path, go_mod(&required))?;
+    // `go mod tidy` rewrites it as the sandbox user.
+    if let Some(user) = sandbox_user()? {
+        user.grant(&go_mod_path)?;
+    }
+    go_step(ctx, dir, cache, &["mod", "tidy"]).await?;
+    let executable_path = dir.join("main");
+    let executable = executable_path.to_string_lossy();
+    let mut build = vec!["build", "-o", &executable];
+    if ctx.coverage_dir().is_some() {
+        build.push("-cover");
+    }
+    build.extend(ctx.compiler_flags().iter().map(String::as_str));
+    build.push(".");
+    go_step(ctx, dir, cache, &build).await?;
+    Ok(executable_path)
+}
 
-    let mut temp_file = File::create(&temp_file_path)?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
+// Turns the counters a `-cover` binary left in `dir` into a report.
+async fn report_coverage(
+    dir: &Path,
+    source: &SourceFile,
+    ctx: &ExecContext,
+) -> Result<(), InfraError> {
+    let profile = dir.join("cover.out");
+    let output = ctx
+        .command("go")?
+        .args(["tool", "covdata", "textfmt"])
+        .arg(format!("-i={}", dir.display()))
+        .arg(format!("-o={}", profile.display()))
+        .kill_on_drop(true)
+        .output()
+        .await?;
+    if !output.status.success() {
+        return Err(InfraError::CompilationError(
+            format!(
+                "go tool covdata failed:\n{}",
+                String::from_utf8_lossy(&output.stderr)
+            )
+            .into(),
+        ));
+    }
+    let profile = fs::read_to_string(profile)?;
+    CoverageReport::from_go_profile(&profile, source.dir())?.save(dir)
+}
+
+pub async fn compile_go(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let profiled = ctx
+        .profile_dir()
+        .and_then(|_| profile::go_profiled_source(content));
+    let source = SourceFile::create(Language::GO, profiled.as_deref().unwrap_or(content))?;
+    let temp_file_path = source.path().to_path_buf();
 
     if !temp_file_path.exists() {
         return Err(InfraError::CompilationError(
@@ -28,24 +290,53 @@ pub async fn compile_go(content: &str, stdin_input: &str) -> Result<String, Infr
     eprintln!("Executing go run on file: {:?}", temp_file_path);
     eprintln!("File content: {}", content);
 
-    let mut cmd = Command::new(which("go")?)
-        .arg("run")
-        .arg(&temp_file_path)
-        .current_dir(temp_dir.path())
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
-
-    let output = cmd.wait_with_output().await?;
+    let third_party: Vec<_> = imports(content)
+        .into_iter()
+        .filter(|import| is_third_party(import))
+        .collect();
+    let covered;
+    let ctx = match ctx.coverage_dir() {
+        Some(dir) => {
+            covered = ctx.clone().with_env("GOCOVERDIR", &dir.to_string_lossy());
+            &covered
+        }
+        None => ctx,
+    };
+    let hooked;
+    let ctx = match (ctx.profile_dir(), &profiled) {
+        (Some(dir), Some(_)) => {
+            hooked = profile::hook_go(source.dir(), dir, ctx)?;
+            &hooked
+        }
+        _ => ctx,
+    };
+    let output = if third_party.is_empty() {
+        let mut cmd = ctx.command("go")?;
+        cmd.arg("run");
+        if ctx.coverage_dir().is_some() {
+            cmd.arg("-cover");
+        }
+        cmd.arg(&temp_file_path);
+        if profiled.is_some() {
+            cmd.arg(source.dir().join(GO_HOOK_FILE));
+        }
+        cmd.current_dir(source.dir());
+        run_program(&mut cmd, stdin_input, ctx).await?
+    } else {
+        let executable = build_module(&source, &third_party, ctx).await?;
+        let mut cmd = Command::new(&executable);
+        run_program(&mut cmd, stdin_input, ctx).await?
+    };
     match output.status.code() {
-        Some(0) => Ok(String::from_utf8(output.stdout)?),
+        Some(0) => {
+            if let Some(dir) = ctx.coverage_dir() {
+                report_coverage(dir, &source, ctx).await?;
+            }
+            if let (Some(dir), Some(_)) = (ctx.profile_dir(), &profiled) {
+                profile::report_go(dir, ctx).await?;
+            }
+            Ok(String::from_utf8(output.stdout)?)
+        }
         Some(code) => {
             let stderr = String::from_utf8_lossy(&output.stderr);
             Err(InfraError::CompilationError(
@@ -65,6 +356,49 @@ pub async fn compile_go(content: &str, stdin_input: &str) -> Result<String, Infr
     }
 }
 
+// Builds without running, for `target`, a GOOS/GOARCH pair, or for this host
+// when it is None, and returns the executable. Only the standard library
+// is available: the module cache holds sources for this host's build alone.
+pub async fn build_go(
+    content: &str,
+    target: Option<&str>,
+    ctx: &ExecContext,
+) -> Result<Vec<u8>, InfraError> {
+    if let Some(import) = imports(content)
+        .into_iter()
+        .find(|import| is_third_party(import))
+    {
+        return Err(InfraError::CompileError(format!(
+            "package {} is not available in builds; only the standard library is",
+            import
+        )));
+    }
+    let source = SourceFile::create(Language::GO, content)?;
+    let executable_path = source.dir().join("main");
+
+    let mut build = ctx.command("go")?;
+    build
+        .args(["build", "-o"])
+        .arg(&executable_path)
+        .args(ctx.compiler_flags())
+        .arg(source.path())
+        .current_dir(source.dir())
+        .env("CGO_ENABLED", "0")
+        .env("GOTOOLCHAIN", "local");
+    if let Some((os, arch)) = target.and_then(|target| target.split_once('/')) {
+        build.env("GOOS", os).env("GOARCH", arch);
+    }
+    let output = run_compiler(&mut build, ctx).await?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        return Err(InfraError::CompileError(format!(
+            "Go compilation failed:\n{}",
+            stderr
+        )));
+    }
+    Ok(fs::read(executable_path)?)
+}
+
 #[cfg(test)]
 mod test {
     use super::*;
@@ -80,7 +414,7 @@ func main() {
     fmt.Println("Hello, World!")
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         println!("{:?}", result);
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
@@ -99,7 +433,7 @@ func main() {
     fmt.Printf("Hello, %s!\n", name)
 }
 "#;
-        let result = compile_go(code, "Alice\n").await;
+        let result = compile_go(code, "Alice\n", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, Alice!");
     }
@@ -117,7 +451,7 @@ func main() {
     fmt.Println(a + b)
 }
 "#;
-        let result = compile_go(code, "5 3\n").await;
+        let result = compile_go(code, "5 3\n", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "8");
     }
@@ -142,7 +476,7 @@ func main() {
     fmt.Printf("%s %s\n", line1, line2)
 }
 "#;
-        let result = compile_go(code, "Hello\nWorld\n").await;
+        let result = compile_go(code, "Hello\nWorld\n", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello World");
     }
@@ -158,7 +492,7 @@ func main() {
     undefinedFunction()
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -173,7 +507,7 @@ func main() {
     fmt.Println("Missing closing quote)
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -192,7 +526,7 @@ func main() {
     os.Exit(1)
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -211,7 +545,7 @@ func main() {
     fmt.Fprintln(os.Stderr, "stderr message")
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "stdout message");
     }
@@ -230,7 +564,7 @@ func main() {
     fmt.Println()
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "1 2 3");
     }
@@ -251,7 +585,7 @@ func main() {
     fmt.Println(sum)
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "15");
     }
@@ -264,7 +598,7 @@ package main
 func main() {
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
@@ -288,7 +622,7 @@ func main() {
     }
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "other");
     }
@@ -310,7 +644,7 @@ func main() {
     fmt.Printf("Name: %s, Age: %d\n", p.Name, p.Age)
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Name: Alice, Age: 30");
     }
@@ -335,7 +669,7 @@ func main() {
     fmt.Println(result)
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "13");
     }
@@ -354,7 +688,7 @@ func main() {
     fmt.Println(m["hello"] + m["world"])
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "15");
     }
@@ -379,7 +713,7 @@ func main() {
     fmt.Println(result)
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "10");
     }
@@ -404,7 +738,7 @@ func main() {
     fmt.Println(num * 2)
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "246");
     }
@@ -433,8 +767,139 @@ func main() {
     fmt.Printf("%.0f\n", s.Area())
 }
 "#;
-        let result = compile_go(code, "").await;
+        let result = compile_go(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "15");
     }
+
+    #[test]
+    fn test_imports_reads_single_and_grouped_imports() {
+        let code = r#"
+package main
+
+import "fmt"
+import (
+    "strings"
+    u "github.com/google/uuid"
+    _ "golang.org/x/text/language"
+)
+
+func main() {
+    fmt.Println("import \"os\"")
+}
+"#;
+        let found = imports(code);
+        assert_eq!(
+            found,
+            [
+                "fmt",
+                "strings",
+                "github.com/google/uuid",
+                "golang.org/x/text/language"
+            ]
+        );
+        let third_party: Vec<_> = found.iter().filter(|i| is_third_party(i)).collect();
+        assert_eq!(
+            third_party,
+            ["github.com/google/uuid", "golang.org/x/text/language"]
+        );
+    }
+
+    #[test]
+    fn test_go_modules_allow_packages_within_modules() {
+        let modules = "github.com/google/uuid@v1.6.0, golang.org/x/text"
+            .parse::<GoModules>()
+            .unwrap();
+        assert_eq!(
+            modules
+                .providing("golang.org/x/text/language")
+                .unwrap()
+                .path,
+            "golang.org/x/text"
+        );
+        assert!(modules.providing("github.com/google/uuid").is_some());
+        assert!(modules.providing("github.com/google/uuidx").is_none());
+        assert_eq!(
+            go_mod(&[modules.providing("github.com/google/uuid").unwrap()]),
+            "module main\n\nrequire (\n\tgithub.com/google/uuid v1.6.0\n)\n"
+        );
+        assert!("fmt".parse::<GoModules>().is_err());
+        assert!("github.com/google/uuid@1.6.0".parse::<GoModules>().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_unlisted_module_is_rejected() {
+        let code = r#"
+package main
+
+import (
+    "fmt"
+    "github.com/example/unlisted"
+)
+
+func main() {
+    fmt.Println(unlisted.Name)
+}
+"#;
+        let Err(InfraError::CompilationError(err)) =
+            compile_go(code, "", &ExecContext::default()).await
+        else {
+            panic!("expected a compilation error");
+        };
+        assert!(err.to_string().contains("github.com/example/unlisted"));
+    }
+
+    #[tokio::test]
+    async fn test_coverage_report_counts_statements_run() {
+        let code = r#"
+package main
+
+import "fmt"
+
+func sign(x int) string {
+    if x < 0 {
+        return "negative"
+    }
+    return "positive"
+}
+
+func main() {
+    fmt.Println(sign(1))
+}
+"#;
+        let dir = tempfile::tempdir().unwrap();
+        let ctx = ExecContext::default().with_coverage_dir(dir.path().to_path_buf());
+        let result = compile_go(code, "", &ctx).await.unwrap();
+        assert_eq!(result.trim(), "positive");
+        let report = CoverageReport::load(dir.path()).unwrap().unwrap();
+        assert_eq!(report.percent, 75.0);
+        assert_eq!(report.files[0].file, "main.go");
+    }
+
+    #[tokio::test]
+    async fn test_profile_reports_hottest_function() {
+        let code = r#"
+package main
+
+import "fmt"
+
+func fib(n int) int {
+    if n < 2 {
+        return n
+    }
+    return fib(n-1) + fib(n-2)
+}
+
+func main() {
+    fmt.Println(fib(35))
+}
+"#;
+        let dir = tempfile::tempdir().unwrap();
+        let ctx = ExecContext::default().with_profile_dir(dir.path().to_path_buf());
+        let result = compile_go(code, "", &ctx).await.unwrap();
+        assert_eq!(result.trim(), "9227465");
+        let report = profile::ProfileReport::load(dir.path()).unwrap().unwrap();
+        assert_eq!(report.profiler, "pprof");
+        assert_eq!(report.hotspots[0].function, "main.fib");
+    }
 }
@@ -1,26 +1,30 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
-
-pub async fn compile_groovy(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".groovy")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
-
-    let source_path = temp_file.path().to_path_buf();
-    let output_dir = tempfile::tempdir()?;
+use super::{
+    disk::execution_zone,
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_compiler, run_program},
+    source::SourceFile,
+};
+use tokio::process::Command;
+
+pub async fn compile_groovy(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::GROOVY, content)?;
+    let source_path = source.path().to_path_buf();
+    let output_dir = tempfile::tempdir_in(execution_zone())?;
     let output_path = output_dir.path();
 
-    let compile_output = Command::new(which("groovyc")?)
+    let mut compile_cmd = ctx.command("groovyc")?;
+    compile_cmd
         .arg(&source_path)
         .arg("--classpath")
         .arg(output_path)
         .arg("-d")
-        .arg(output_path)
-        .output()
-        .await?;
+        .arg(output_path);
+    let compile_output = run_compiler(&mut compile_cmd, ctx).await?;
 
     if !compile_output.status.success() {
         let stderr = String::from_utf8_lossy(&compile_output.stderr);
@@ -28,23 +32,13 @@ pub async fn compile_groovy(content: &str, stdin_input: &str) -> Result<String,
             format!("Groovy compilation failed:\n{}", stderr).into(),
         ));
     }
+    ctx.record_warnings(&compile_output.stderr);
 
-    let mut cmd = Command::new("groovy")
-        .arg("-cp")
+    let mut cmd = Command::new("groovy");
+    cmd.arg("-cp")
         .arg(output_path)
-        .arg(&source_path)
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
-
-    let output = cmd.wait_with_output().await?;
+        .arg(&source_path);
+    let output = run_program(&mut cmd, stdin_input, ctx).await?;
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
         Some(code) => {
@@ -76,7 +70,7 @@ mod groovy_tests {
 println "Hello, World!"
 "#;
 
-        let result = compile_groovy(groovy_code, "").await;
+        let result = compile_groovy(groovy_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
     }
@@ -89,7 +83,7 @@ def b = 3
 println a + b
 "#;
 
-        let result = compile_groovy(groovy_code, "").await;
+        let result = compile_groovy(groovy_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "8");
     }
@@ -101,7 +95,7 @@ def num = System.in.newReader().readLine().toInteger()
 println "You entered: $num"
 "#;
 
-        let result = compile_groovy(groovy_code, "42").await;
+        let result = compile_groovy(groovy_code, "42", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "You entered: 42");
     }
@@ -113,7 +107,7 @@ def name = System.in.newReader().readLine()
 println "Hello, $name!"
 "#;
 
-        let result = compile_groovy(groovy_code, "Alice").await;
+        let result = compile_groovy(groovy_code, "Alice", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, Alice!");
     }
@@ -126,7 +120,7 @@ println "Hello, $name!"
 }
 "#;
 
-        let result = compile_groovy(groovy_code, "").await;
+        let result = compile_groovy(groovy_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Line 1"));
@@ -141,7 +135,7 @@ println "Missing closing brace" // This should cause a compilation error
 def x = {
 "#;
 
-        let result = compile_groovy(invalid_groovy_code, "").await;
+        let result = compile_groovy(invalid_groovy_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -151,7 +145,7 @@ def x = {
 throw new Exception("Runtime error")
 "#;
 
-        let result = compile_groovy(groovy_code, "").await;
+        let result = compile_groovy(groovy_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -163,7 +157,7 @@ println "Sum: ${a + b}"
 println "Product: ${a * b}"
 "#;
 
-        let result = compile_groovy(groovy_code, "7 3").await;
+        let result = compile_groovy(groovy_code, "7 3", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Sum: 10"));
@@ -175,7 +169,7 @@ println "Product: ${a * b}"
         let groovy_code = r#"
 "#;
 
-        let result = compile_groovy(groovy_code, "").await;
+        let result = compile_groovy(groovy_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
@@ -187,7 +181,7 @@ def str = "Hello"
 println "Length: ${str.length()}"
 "#;
 
-        let result = compile_groovy(groovy_code, "").await;
+        let result = compile_groovy(groovy_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Length: 5");
     }
@@ -199,7 +193,7 @@ def x = 16.0
 println "Square root of $x is ${Math.sqrt(x)}"
 "#;
 
-        let result = compile_groovy(groovy_code, "").await;
+        let result = compile_groovy(groovy_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Square root of 16.0 is 4.0");
     }
@@ -214,7 +208,7 @@ thread.start()
 thread.join()
 "#;
 
-        let result = compile_groovy(groovy_code, "").await;
+        let result = compile_groovy(groovy_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Thread running");
     }
@@ -0,0 +1,199 @@
+use std::{io, time::Duration};
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+use uuid::Uuid;
+
+use super::{
+    interactive::Verdict,
+    jobs::{JobQueue, JobSpec, JobStatus},
+    store::Store,
+};
+
+// A job of a group, and what it stands for within the group.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct GroupMember {
+    pub job_id: String,
+    // The submission the job runs and which of the tests, for groups that
+    // run submissions against tests.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub submission: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub test: Option<usize>,
+}
+
+// Related jobs submitted together, kept in the store as long as the jobs
+// themselves are.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct JobGroup {
+    pub id: String,
+    pub name: Option<String>,
+    pub created_at: DateTime<Utc>,
+    pub members: Vec<GroupMember>,
+}
+
+#[derive(Debug, Clone, Serialize, ToSchema)]
+pub struct MemberStatus {
+    pub job_id: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub submission: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = 0)]
+    pub test: Option<usize>,
+    pub status: JobStatus,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub verdict: Option<Verdict>,
+}
+
+#[derive(Debug, Clone, Serialize, ToSchema)]
+pub struct GroupStatus {
+    #[schema(example = "6f1c2b9e-8f4d-4a51-9d0e-3b7a5c2e1f90")]
+    pub id: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = "regrade:two-sum")]
+    pub name: Option<String>,
+    pub created_at: DateTime<Utc>,
+    // Jobs in the group, and how many of them are yet to start, running and
+    // finished. A job that has expired is counted in none but the total.
+    #[schema(example = 50)]
+    pub total: usize,
+    #[schema(example = 30)]
+    pub waiting: usize,
+    #[schema(example = 4)]
+    pub running: usize,
+    #[schema(example = 16)]
+    pub finished: usize,
+    #[schema(example = 15)]
+    pub accepted: usize,
+    // Once every job has finished: the first job's verdict that is not
+    // accepted, or accepted when all of them are. A job that finished
+    // without being judged, such as one interrupted by a restart, counts as
+    // a judge error.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub verdict: Option<Verdict>,
+    pub jobs: Vec<MemberStatus>,
+}
+
+fn group_key(id: &str) -> String {
+    format!("group:{}", id)
+}
+
+impl JobGroup {
+    pub fn new(name: Option<String>) -> Self {
+        JobGroup {
+            id: Uuid::new_v4().to_string(),
+            name,
+            created_at: Utc::now(),
+            members: Vec::new(),
+        }
+    }
+
+    // Queues `spec` as one of the group's jobs.
+    pub fn submit(
+        &mut self,
+        queue: &JobQueue,
+        tenant: &str,
+        spec: JobSpec,
+        submission: Option<String>,
+        test: Option<usize>,
+    ) {
+        let spec = JobSpec {
+            group: Some(self.id.clone()),
+            ..spec
+        };
+        let job = queue.submit(tenant, spec);
+        self.members.push(GroupMember {
+            job_id: job.id,
+            submission,
+            test,
+        });
+    }
+
+    pub fn load(store: &Store, id: &str) -> Option<Self> {
+        store.get(&group_key(id))
+    }
+
+    pub fn save(&self, store: &Store, retention: Duration) -> io::Result<()> {
+        store.put(&group_key(&self.id), self, Some(retention))
+    }
+
+    // Where each of the group's jobs stands, in the order they were added.
+    pub fn status(&self, queue: &JobQueue) -> GroupStatus {
+        let jobs: Vec<_> = self
+            .members
+            .iter()
+            .filter_map(|member| {
+                let job = queue.get(&member.job_id)?;
+                Some(MemberStatus {
+                    job_id: member.job_id.clone(),
+                    submission: member.submission.clone(),
+                    test: member.test,
+                    status: job.status,
+                    verdict: job.verdict,
+                })
+            })
+            .collect();
+        let count = |f: fn(JobStatus) -> bool| jobs.iter().filter(|job| f(job.status)).count();
+        let finished = count(|status| status.is_finished());
+        let verdict = (finished == self.members.len() && finished > 0).then(|| {
+            jobs.iter()
+                .map(|job| job.verdict.unwrap_or(Verdict::JudgeError))
+                .find(|verdict| *verdict != Verdict::Accepted)
+                .unwrap_or(Verdict::Accepted)
+        });
+        GroupStatus {
+            id: self.id.clone(),
+            name: self.name.clone(),
+            created_at: self.created_at,
+            total: self.members.len(),
+            waiting: count(|status| matches!(status, JobStatus::Scheduled | JobStatus::Queued)),
+            running: count(|status| status == JobStatus::Running),
+            finished,
+            accepted: jobs
+                .iter()
+                .filter(|job| job.verdict == Some(Verdict::Accepted))
+                .count(),
+            verdict,
+            jobs,
+        }
+    }
+}
+
+#[cfg(test)]
+mod groups_tests {
+    use super::*;
+
+    fn spec(content: &str) -> JobSpec {
+        JobSpec {
+            lang: "python".into(),
+            content: content.into(),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_verdict_waits_for_every_job_and_takes_the_first_rejection() {
+        let store: &'static Store = Box::leak(Box::new(Store::memory()));
+        let queue = JobQueue::new(Duration::from_secs(3600), store);
+        let mut group = JobGroup::new(Some("class".into()));
+        for name in ["ada", "alan", "grace"] {
+            group.submit(&queue, "tenant", spec("print(1)"), Some(name.into()), None);
+        }
+        group.save(store, Duration::from_secs(3600)).unwrap();
+
+        let verdicts = [Verdict::Accepted, Verdict::WrongAnswer, Verdict::RuntimeError];
+        for (i, verdict) in verdicts.into_iter().enumerate() {
+            let status = JobGroup::load(store, &group.id).unwrap().status(&queue);
+            assert_eq!((status.finished, status.verdict), (i, None));
+            let (id, claimed) = queue.claim().unwrap();
+            assert_eq!(claimed.group.as_deref(), Some(group.id.as_str()));
+            assert!(queue.complete(&id, Ok(String::new()), Some(verdict)));
+        }
+
+        let status = group.status(&queue);
+        assert_eq!((status.total, status.finished, status.accepted), (3, 3, 1));
+        assert_eq!(status.verdict, Some(Verdict::WrongAnswer));
+        assert_eq!(status.jobs[2].submission.as_deref(), Some("grace"));
+    }
+}
@@ -1,46 +1,40 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
-
-pub async fn compile_haskell(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".hs")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
-
-    let source_path = temp_file.path().to_path_buf();
-    let executable_file = NamedTempFile::new()?;
-    let executable_path = executable_file.path().to_path_buf();
-    drop(executable_file);
-
-    let compile_output = Command::new(which("ghc")?)
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+};
+use tokio::process::Command;
+
+pub async fn compile_haskell(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::HASKELL, content)?;
+    let source_path = source.path().to_path_buf();
+    let executable_path = source.dir().join("main");
+
+    let compile_output = ctx.command("ghc")?
         .arg("-o")
         .arg(&executable_path)
         .arg(&source_path)
+        .args(ctx.compiler_flags())
+        .kill_on_drop(true)
         .output()
         .await?;
 
     if !compile_output.status.success() {
         let stderr = String::from_utf8_lossy(&compile_output.stderr);
-        return Err(InfraError::CompilationError(
-            format!("Haskell compilation failed:\n{}", stderr).into(),
-        ));
+        return Err(InfraError::CompileError(format!(
+            "Haskell compilation failed:\n{}",
+            stderr
+        )));
     }
+    ctx.record_warnings(&compile_output.stderr);
 
-    let mut cmd = Command::new(&executable_path)
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
-
-    let output = cmd.wait_with_output().await?;
+    let mut cmd = Command::new(&executable_path);
+    let output = run_program(&mut cmd, stdin_input, ctx).await?;
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
         Some(code) => {
@@ -72,7 +66,7 @@ mod haskell_tests {
 main :: IO ()
 main = putStrLn "Hello, World!"
 "#;
-        let result = compile_haskell(haskell_code, "").await;
+        let result = compile_haskell(haskell_code, "", &ExecContext::default()).await;
         println!("{:?}", result);
         assert!(result.is_ok(), "Failed to compile or execute simple hello world program");
         assert_eq!(result.unwrap().trim(), "Hello, World!", "Expected output 'Hello, World!' but got different output");
@@ -88,7 +82,7 @@ main = do
     print (a + b)
 "#;
 
-        let result = compile_haskell(haskell_code, "").await;
+        let result = compile_haskell(haskell_code, "", &ExecContext::default()).await;
         assert!(result.is_ok(), "Failed to compile or execute simple arithmetic program");
         assert_eq!(result.unwrap().trim(), "8", "Expected output '8' but got different output");
     }
@@ -102,7 +96,7 @@ main = do
     putStrLn $ "You entered: " ++ show num
 "#;
 
-        let result = compile_haskell(haskell_code, "42\n").await;
+        let result = compile_haskell(haskell_code, "42\n", &ExecContext::default()).await;
         assert!(result.is_ok(), "Failed to compile or execute program with stdin input");
         assert_eq!(result.unwrap().trim(), "You entered: 42", "Expected output 'You entered: 42' but got different output");
     }
@@ -116,7 +110,7 @@ main = do
     putStrLn $ "Hello, " ++ name ++ "!"
 "#;
 
-        let result = compile_haskell(haskell_code, "Alice\n").await;
+        let result = compile_haskell(haskell_code, "Alice\n", &ExecContext::default()).await;
         assert!(result.is_ok(), "Failed to compile or execute program with string input");
         assert_eq!(result.unwrap().trim(), "Hello, Alice!", "Expected output 'Hello, Alice!' but got different output");
     }
@@ -128,7 +122,7 @@ main :: IO ()
 main = mapM_ (\i -> putStrLn $ "Line " ++ show i) [1..3]
 "#;
 
-        let result = compile_haskell(haskell_code, "").await;
+        let result = compile_haskell(haskell_code, "", &ExecContext::default()).await;
         assert!(result.is_ok(), "Failed to compile or execute program with multiple lines output");
         let output = result.unwrap();
         assert!(output.contains("Line 1"), "Output does not contain 'Line 1'");
@@ -144,10 +138,24 @@ main :: IO ()
 main = exitWith (ExitFailure 1)  -- This should cause a runtime error
 "#;
 
-        let result = compile_haskell(haskell_code, "").await;
+        let result = compile_haskell(haskell_code, "", &ExecContext::default()).await;
         assert!(result.is_err(), "Expected runtime error due to exitWith (ExitFailure 1) but program executed successfully");
     }
 
+    #[tokio::test]
+    async fn test_compilation_error() {
+        let haskell_code = r#"
+main :: IO ()
+main = putStrLn (1 + "one")
+"#;
+
+        let result = compile_haskell(haskell_code, "", &ExecContext::default()).await;
+        assert!(
+            matches!(result, Err(InfraError::CompileError(_))),
+            "Expected a type error to be reported as a compile error"
+        );
+    }
+
     #[tokio::test]
     async fn test_complex_stdin_processing() {
         let haskell_code = r#"
@@ -159,7 +167,7 @@ main = do
     putStrLn $ "Product: " ++ show (a * b)
 "#;
 
-        let result = compile_haskell(haskell_code, "7 3\n").await;
+        let result = compile_haskell(haskell_code, "7 3\n", &ExecContext::default()).await;
         assert!(result.is_ok(), "Failed to compile or execute program with complex stdin processing");
         let output = result.unwrap();
         assert!(output.contains("Sum: 10"), "Output does not contain 'Sum: 10'");
@@ -173,7 +181,7 @@ main :: IO ()
 main = return ()
 "#;
 
-        let result = compile_haskell(haskell_code, "").await;
+        let result = compile_haskell(haskell_code, "", &ExecContext::default()).await;
         assert!(result.is_ok(), "Failed to compile or execute empty program");
         assert_eq!(result.unwrap().trim(), "", "Expected empty output but got different output");
     }
@@ -188,7 +196,7 @@ main = do
     putStrLn $ "Length: " ++ show (length str)
 "#;
 
-        let result = compile_haskell(haskell_code, "").await;
+        let result = compile_haskell(haskell_code, "", &ExecContext::default()).await;
         assert!(result.is_ok(), "Failed to compile or execute program with Data.List import");
         assert_eq!(result.unwrap().trim(), "Length: 5", "Expected output 'Length: 5' but got different output");
     }
@@ -204,7 +212,7 @@ main = do
     putStrLn $ "Square root of " ++ show x ++ " is " ++ show (P.sqrt x)
 "#;
 
-        let result = compile_haskell(haskell_code, "").await;
+        let result = compile_haskell(haskell_code, "", &ExecContext::default()).await;
         assert!(result.is_ok(), "Failed to compile or execute program with math operations");
         assert_eq!(result.unwrap().trim(), "Square root of 16.0 is 4.0", "Expected output 'Square root of 16.0 is 4.0' but got different output");
     }
@@ -219,7 +227,7 @@ main = do
     threadDelay 100000  -- Allow thread to execute
 "#;
 
-        let result = compile_haskell(haskell_code, "").await;
+        let result = compile_haskell(haskell_code, "", &ExecContext::default()).await;
         assert!(result.is_ok(), "Failed to compile or execute program with Control.Concurrent");
         assert_eq!(result.unwrap().trim(), "Thread running", "Expected output 'Thread running' but got different output");
     }
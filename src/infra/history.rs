@@ -0,0 +1,145 @@
+use std::io;
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use utoipa::{IntoParams, ToSchema};
+
+use super::{
+    error::InfraError,
+    logs::{RunStatus, truncate},
+    store::store,
+};
+use crate::config::config;
+
+const DEFAULT_HISTORY_LIMIT: usize = 50;
+const MAX_HISTORY_LIMIT: usize = 1000;
+
+// A finished run as kept in the store's database. Unlike the in-memory run
+// logs this outlives restarts, so it records a hash of the code rather than
+// the code itself.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize, ToSchema)]
+pub struct RunRecord {
+    pub id: String,
+    pub lang: String,
+    /// Hex-encoded SHA-256 of the submitted code
+    pub code_hash: String,
+    pub status: RunStatus,
+    pub output: Option<String>,
+    pub error: Option<String>,
+    pub started_at: DateTime<Utc>,
+    pub finished_at: DateTime<Utc>,
+    pub duration_ms: u64,
+}
+
+impl RunRecord {
+    pub fn new(
+        id: &str,
+        lang: &str,
+        content: &str,
+        started_at: DateTime<Utc>,
+        result: &Result<String, InfraError>,
+        max_output_bytes: usize,
+    ) -> Self {
+        let finished_at = Utc::now();
+        let (output, error) = match result {
+            Ok(output) => (Some(truncate(output, max_output_bytes)), None),
+            Err(err) => (None, Some(truncate(&err.to_string(), max_output_bytes))),
+        };
+        RunRecord {
+            id: id.to_string(),
+            lang: lang.to_lowercase(),
+            code_hash: format!("{:x}", Sha256::digest(content.as_bytes())),
+            status: RunStatus::of(result),
+            output,
+            error,
+            started_at,
+            finished_at,
+            duration_ms: (finished_at - started_at).num_milliseconds().max(0) as u64,
+        }
+    }
+}
+
+#[derive(Debug, Default, Deserialize, IntoParams)]
+#[into_params(parameter_in = Query)]
+pub struct HistoryQuery {
+    pub language: Option<String>,
+    pub status: Option<RunStatus>,
+    /// Only runs started at or after this time (RFC 3339)
+    pub since: Option<DateTime<Utc>>,
+    /// Only runs started before this time (RFC 3339)
+    pub until: Option<DateTime<Utc>>,
+    pub limit: Option<usize>,
+}
+
+impl HistoryQuery {
+    pub fn language(&self) -> Option<String> {
+        self.language
+            .as_ref()
+            .map(|language| language.to_lowercase())
+    }
+
+    pub fn limit(&self) -> usize {
+        self.limit
+            .unwrap_or(DEFAULT_HISTORY_LIMIT)
+            .min(MAX_HISTORY_LIMIT)
+    }
+}
+
+// Implemented by store drivers backed by a database that can be queried.
+pub trait HistoryDriver: Send + Sync {
+    fn insert(&self, run: &RunRecord) -> io::Result<()>;
+
+    // Returns matching runs, newest first.
+    fn search(&self, query: &HistoryQuery) -> io::Result<Vec<RunRecord>>;
+}
+
+// The run history, when the server is configured to persist it and its
+// store backend supports it.
+pub async fn history() -> Option<&'static dyn HistoryDriver> {
+    if !config().await.run_log_persist() {
+        return None;
+    }
+    store().await.history()
+}
+
+pub async fn persist(
+    id: &str,
+    lang: &str,
+    content: &str,
+    started_at: DateTime<Utc>,
+    result: &Result<String, InfraError>,
+) {
+    let Some(history) = history().await else {
+        return;
+    };
+    let max_output_bytes = config().await.run_log_max_output();
+    let run = RunRecord::new(id, lang, content, started_at, result, max_output_bytes);
+    if let Err(err) = history.insert(&run) {
+        tracing::warn!("failed to persist run {}: {}", id, err);
+    }
+}
+
+#[cfg(test)]
+mod history_tests {
+    use super::*;
+
+    #[test]
+    fn test_record_hashes_code_and_truncates_output() {
+        let started_at = Utc::now();
+        let run = RunRecord::new("a", "Python", "print(1)", started_at, &Ok("123".into()), 2);
+        assert_eq!(run.lang, "python");
+        assert_eq!(
+            run.code_hash,
+            "d287bb7f9d15abdc5b6e98536263815744b6ef21c8f3c839fc434ca70d8efe99"
+        );
+        assert_eq!(run.status, RunStatus::Succeeded);
+        assert!(run.output.unwrap().starts_with("12"));
+        assert!(run.finished_at >= started_at);
+
+        let failed = Err(InfraError::CompilationError("boom".into()));
+        let run = RunRecord::new("b", "python", "", started_at, &failed, 1024);
+        assert_eq!(run.status, RunStatus::Failed);
+        assert!(run.error.unwrap().contains("boom"));
+    }
+}
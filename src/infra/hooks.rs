@@ -0,0 +1,251 @@
+use std::{
+    borrow::Cow,
+    future::Future,
+    path::Path,
+    process::Stdio,
+    str::FromStr,
+    sync::{Arc, Mutex},
+    time::Duration,
+};
+
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use tokio::{io::AsyncWriteExt, process::Command};
+use utoipa::ToSchema;
+
+use super::{
+    error::InfraError, interactive::find_executable, metrics, runner::INHERITED_ENV,
+    toolchain::Toolchain,
+};
+use crate::config::config;
+
+const HOOK_METRIC: &str = "comphub_source_hooks_total";
+// How long a hook has to hand back the source it was given.
+const HOOK_TIMEOUT: Duration = Duration::from_secs(10);
+// The exit code a hook refuses the program with, its reason on stderr.
+// Any other failure is the hook's own.
+const REFUSED: i32 = 1;
+
+tokio::task_local! {
+    static APPLIED: Arc<Mutex<Vec<AppliedHook>>>;
+}
+
+// Which source hooks run for which languages, parsed from a comma-separated
+// list of `lang=hook` entries naming executables in SOURCE_HOOKS_DIR. A
+// `*` entry applies to every language. Hooks run in the order listed, each
+// given what the one before it returned.
+#[derive(Debug, Clone, Default)]
+pub struct SourceHooks {
+    hooks: Vec<(String, String)>,
+}
+
+impl FromStr for SourceHooks {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut hooks = Vec::new();
+        for entry in s
+            .split(',')
+            .map(str::trim)
+            .filter(|entry| !entry.is_empty())
+        {
+            let (lang, hook) = entry
+                .split_once('=')
+                .map(|(lang, hook)| (lang.trim().to_lowercase(), hook.trim().to_string()))
+                .filter(|(lang, hook)| !lang.is_empty() && !hook.is_empty())
+                .ok_or_else(|| format!("invalid source hook {:?}, expected lang=hook", entry))?;
+            hooks.push((lang, hook));
+        }
+        Ok(SourceHooks { hooks })
+    }
+}
+
+impl SourceHooks {
+    // The hooks `lang`'s programs go through, in order.
+    pub fn for_lang<'a>(&'a self, lang: &'a str) -> impl Iterator<Item = &'a str> {
+        self.hooks
+            .iter()
+            .filter(move |(hooked, _)| hooked == "*" || hooked.eq_ignore_ascii_case(lang))
+            .map(|(_, hook)| hook.as_str())
+    }
+}
+
+// A hook a run's program went through, and the code it came out as.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize, ToSchema)]
+pub struct AppliedHook {
+    #[schema(example = "ban-headers")]
+    pub hook: String,
+    /// Hex-encoded SHA-256 of the code the hook returned
+    pub code_hash: String,
+}
+
+// Runs `run`, collecting the hooks the programs it compiles go through.
+pub async fn recording_hooks<F: Future>(run: F) -> (F::Output, Vec<AppliedHook>) {
+    let applied = Arc::new(Mutex::new(Vec::new()));
+    let output = APPLIED.scope(applied.clone(), run).await;
+    let applied = std::mem::take(&mut *applied.lock().unwrap());
+    (output, applied)
+}
+
+// Passes `content` through each of the hooks configured for `toolchain`.
+// A hook gets the language as its argument and the program on stdin, and
+// prints the program to run in its place; exiting with 1 refuses the
+// program, which fails the run as a compiler would. Hooks are the
+// operator's own and run outside the sandbox.
+pub async fn apply_hooks<'a>(
+    toolchain: &Toolchain,
+    content: &'a str,
+) -> Result<Cow<'a, str>, InfraError> {
+    let app_config = config().await;
+    let lang = toolchain.as_str();
+    let mut content = Cow::Borrowed(content);
+    for name in app_config.source_hooks().for_lang(lang) {
+        let hook = find_executable(app_config.source_hooks_dir(), name)
+            .ok_or_else(|| InfraError::Plugin(format!("no source hook named {:?}", name)))?;
+        let rewritten = match run_hook(&hook, name, lang, &content).await {
+            Ok(rewritten) => rewritten,
+            Err(err) => {
+                let outcome = match err {
+                    InfraError::CompileError(_) => "refused",
+                    _ => "failed",
+                };
+                metrics::increment(HOOK_METRIC, &[("hook", name), ("outcome", outcome)]);
+                return Err(err);
+            }
+        };
+        let outcome = if rewritten == *content {
+            "unchanged"
+        } else {
+            "rewritten"
+        };
+        metrics::increment(HOOK_METRIC, &[("hook", name), ("outcome", outcome)]);
+        let _ = APPLIED.try_with(|applied| {
+            applied.lock().unwrap().push(AppliedHook {
+                hook: name.to_string(),
+                code_hash: format!("{:x}", Sha256::digest(rewritten.as_bytes())),
+            })
+        });
+        content = Cow::Owned(rewritten);
+    }
+    Ok(content)
+}
+
+async fn run_hook(
+    hook: &Path,
+    name: &str,
+    lang: &str,
+    content: &str,
+) -> Result<String, InfraError> {
+    let mut cmd = Command::new(hook);
+    cmd.arg(lang).env_clear();
+    for key in INHERITED_ENV {
+        if let Some(value) = std::env::var_os(key) {
+            cmd.env(key, value);
+        }
+    }
+    let mut child = cmd
+        .kill_on_drop(true)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()?;
+
+    // Fed while the output is read, so a hook that writes before it has
+    // read everything does not stall. One that stops reading early is
+    // judged by what it prints.
+    let mut stdin = child.stdin.take().expect("stdin is piped");
+    let feed = async move {
+        let _ = stdin.write_all(content.as_bytes()).await;
+    };
+    let run = async { tokio::join!(feed, child.wait_with_output()).1 };
+    let output = tokio::time::timeout(HOOK_TIMEOUT, run)
+        .await
+        .map_err(|_| {
+            InfraError::Plugin(format!(
+                "source hook {} gave no answer within {}s",
+                name,
+                HOOK_TIMEOUT.as_secs()
+            ))
+        })??;
+
+    let stderr = String::from_utf8_lossy(&output.stderr).trim().to_string();
+    match output.status.code() {
+        Some(0) => String::from_utf8(output.stdout).map_err(|_| {
+            InfraError::Plugin(format!(
+                "source hook {} returned code that is not UTF-8",
+                name
+            ))
+        }),
+        Some(REFUSED) => Err(InfraError::CompileError(format!(
+            "refused by source hook {}: {}",
+            name, stderr
+        ))),
+        _ => Err(InfraError::Plugin(format!(
+            "source hook {} failed with {}: {}",
+            name, output.status, stderr
+        ))),
+    }
+}
+
+#[cfg(test)]
+mod hooks_tests {
+    use std::{fs, os::unix::fs::PermissionsExt};
+
+    use tempfile::TempDir;
+
+    use super::*;
+
+    fn hook(dir: &TempDir, name: &str, script: &str) -> std::path::PathBuf {
+        let path = dir.path().join(name);
+        fs::write(&path, format!("#!/bin/sh\n{}", script)).unwrap();
+        fs::set_permissions(&path, fs::Permissions::from_mode(0o755)).unwrap();
+        path
+    }
+
+    #[test]
+    fn test_hooks_apply_in_order_to_their_languages() {
+        let hooks: SourceHooks = "C=ban-headers, *=instrument, python=harness"
+            .parse()
+            .unwrap();
+        assert_eq!(
+            hooks.for_lang("c").collect::<Vec<_>>(),
+            ["ban-headers", "instrument"]
+        );
+        assert_eq!(
+            hooks.for_lang("python").collect::<Vec<_>>(),
+            ["instrument", "harness"]
+        );
+        assert_eq!(hooks.for_lang("go").collect::<Vec<_>>(), ["instrument"]);
+        assert!("".parse::<SourceHooks>().unwrap().hooks.is_empty());
+        assert!("python".parse::<SourceHooks>().is_err());
+        assert!("python=".parse::<SourceHooks>().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_hook_rewrites_or_refuses_the_program() {
+        let dir = TempDir::new().unwrap();
+        let harness = hook(&dir, "harness", "echo \"# $1\"; cat\n");
+        let rewritten = run_hook(&harness, "harness", "python", "print(1)\n")
+            .await
+            .unwrap();
+        assert_eq!(rewritten, "# python\nprint(1)\n");
+
+        let ban = hook(
+            &dir,
+            "ban-headers",
+            "code=$(cat)\n\
+             case \"$code\" in *'#include <sys/'*) echo 'sys headers are banned' >&2; exit 1;; esac\n\
+             printf '%s\\n' \"$code\"\n",
+        );
+        let refused = run_hook(&ban, "ban-headers", "c", "#include <sys/socket.h>\n").await;
+        assert!(matches!(
+            refused,
+            Err(InfraError::CompileError(message))
+                if message == "refused by source hook ban-headers: sys headers are banned"
+        ));
+
+        let broken = hook(&dir, "broken", "exit 3\n");
+        let failed = run_hook(&broken, "broken", "c", "int main() {}\n").await;
+        assert!(matches!(failed, Err(InfraError::Plugin(_))));
+    }
+}
@@ -0,0 +1,121 @@
+use std::time::Duration;
+
+use serde::{Deserialize, Serialize, de::DeserializeOwned};
+
+use super::store::Store;
+
+// What is kept under an idempotency key: a digest of the request that
+// claimed it and, once that request has finished, its response.
+#[derive(Serialize, Deserialize)]
+struct Entry<T> {
+    fingerprint: String,
+    response: Option<T>,
+}
+
+pub enum Claim<'a, T> {
+    // The key is new: run the request, then `finish` the reservation.
+    Reserved(Reservation<'a>),
+    // The same request already finished; this is its response.
+    Replay(T),
+    // The same request is still running.
+    InProgress,
+    // The key was used for a different request.
+    Mismatch,
+}
+
+// Holds a key while its request runs. Dropping it unfinished releases the
+// key, so a request that failed can be retried.
+pub struct Reservation<'a> {
+    store: &'a Store,
+    key: Option<String>,
+    fingerprint: String,
+}
+
+// Claims `key` for the request with `fingerprint`. The claim lapses after
+// `lease` if the request never finishes, for instance because the process
+// died while it ran.
+pub fn claim<'a, T: Serialize + DeserializeOwned>(
+    store: &'a Store,
+    key: String,
+    fingerprint: &str,
+    lease: Duration,
+) -> Claim<'a, T> {
+    let pending = Entry::<T> {
+        fingerprint: fingerprint.to_string(),
+        response: None,
+    };
+    let recorded = match store.put_if_absent(&key, &pending, Some(lease)) {
+        Ok(None) => Some(key),
+        Ok(Some(entry)) if entry.fingerprint != fingerprint => return Claim::Mismatch,
+        Ok(Some(Entry {
+            response: Some(response),
+            ..
+        })) => return Claim::Replay(response),
+        Ok(Some(_)) => return Claim::InProgress,
+        Err(err) => {
+            tracing::warn!("failed to record idempotency key: {}", err);
+            None
+        }
+    };
+    Claim::Reserved(Reservation {
+        store,
+        key: recorded,
+        fingerprint: fingerprint.to_string(),
+    })
+}
+
+impl Reservation<'_> {
+    // Keeps `response` for retries of the request for `ttl`.
+    pub fn finish<T: Serialize>(mut self, response: &T, ttl: Duration) {
+        let Some(key) = self.key.take() else {
+            return;
+        };
+        let entry = Entry {
+            fingerprint: self.fingerprint.clone(),
+            response: Some(response),
+        };
+        if let Err(err) = self.store.put(&key, &entry, Some(ttl)) {
+            tracing::warn!("failed to store idempotent response: {}", err);
+            let _ = self.store.remove(&key);
+        }
+    }
+}
+
+impl Drop for Reservation<'_> {
+    fn drop(&mut self) {
+        if let Some(key) = self.key.take() {
+            let _ = self.store.remove(&key);
+        }
+    }
+}
+
+#[cfg(test)]
+mod idempotency_tests {
+    use super::*;
+
+    const LEASE: Duration = Duration::from_secs(60);
+
+    fn claim_once<'a>(store: &'a Store, fingerprint: &str) -> Claim<'a, String> {
+        claim(store, String::from("replay:key"), fingerprint, LEASE)
+    }
+
+    #[test]
+    fn test_finished_response_is_replayed_to_the_same_request() {
+        let store = Store::memory();
+        let Claim::Reserved(reservation) = claim_once(&store, "a") else {
+            panic!("a new key should be reserved");
+        };
+        assert!(matches!(claim_once(&store, "a"), Claim::InProgress));
+
+        reservation.finish(&String::from("done"), LEASE);
+        assert!(matches!(claim_once(&store, "a"), Claim::Replay(response) if response == "done"));
+        assert!(matches!(claim_once(&store, "b"), Claim::Mismatch));
+    }
+
+    #[test]
+    fn test_unfinished_reservation_releases_the_key() {
+        let store = Store::memory();
+        assert!(matches!(claim_once(&store, "a"), Claim::Reserved(_)));
+        assert!(matches!(claim_once(&store, "b"), Claim::Reserved(_)));
+    }
+}
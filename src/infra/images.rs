@@ -0,0 +1,102 @@
+use std::{fs, io, path::Path};
+
+use base64::{Engine, engine::general_purpose::STANDARD};
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+
+use super::workspace::FileEntry;
+
+// Environment that steers plotting libraries towards writing files instead of
+// opening a window, for runs that collect images. R plots to a PDF by
+// default; as PNGs they come back as Rplot001.png and so on.
+pub const HEADLESS_ENV: &[(&str, &str)] = &[("MPLBACKEND", "Agg"), ("R_DEFAULT_DEVICE", "png")];
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+pub struct ImageAttachment {
+    #[schema(example = "plot.png")]
+    pub path: String,
+    #[schema(example = "image/png")]
+    pub media_type: String,
+    pub size: u64,
+    // Base64-encoded file contents, ready for a `data:` URL.
+    pub data: String,
+}
+
+pub fn media_type(path: &Path) -> Option<&'static str> {
+    let extension = path.extension()?.to_str()?.to_lowercase();
+    match extension.as_str() {
+        "png" => Some("image/png"),
+        "jpg" | "jpeg" => Some("image/jpeg"),
+        "gif" => Some("image/gif"),
+        "webp" => Some("image/webp"),
+        "svg" => Some("image/svg+xml"),
+        _ => None,
+    }
+}
+
+// Reads the images among `changes`, which are relative to `root`. Once
+// `max_bytes` would be exceeded the remaining images are left out rather
+// than truncated, so every attachment returned is complete.
+pub fn collect_images(
+    root: &Path,
+    changes: &[FileEntry],
+    max_bytes: u64,
+) -> io::Result<Vec<ImageAttachment>> {
+    let mut images = Vec::new();
+    let mut total = 0;
+    for entry in changes {
+        let Some(media_type) = media_type(Path::new(&entry.path)) else {
+            continue;
+        };
+        if total + entry.size > max_bytes {
+            tracing::debug!("skipping image {}: attachment limit reached", entry.path);
+            continue;
+        }
+        let contents = fs::read(root.join(&entry.path))?;
+        total += entry.size;
+        images.push(ImageAttachment {
+            path: entry.path.clone(),
+            media_type: media_type.to_string(),
+            size: entry.size,
+            data: STANDARD.encode(contents),
+        });
+    }
+    Ok(images)
+}
+
+#[cfg(test)]
+mod images_tests {
+    use super::*;
+    use crate::infra::workspace::Snapshot;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_media_type_by_extension() {
+        assert_eq!(media_type(Path::new("plot.PNG")), Some("image/png"));
+        assert_eq!(
+            media_type(Path::new("out/chart.svg")),
+            Some("image/svg+xml")
+        );
+        assert_eq!(media_type(Path::new("photo.jpeg")), Some("image/jpeg"));
+        assert_eq!(media_type(Path::new("results.csv")), None);
+        assert_eq!(media_type(Path::new("Makefile")), None);
+    }
+
+    #[test]
+    fn test_collect_images_encodes_new_images_within_limit() {
+        let dir = TempDir::new().unwrap();
+        let before = Snapshot::take(dir.path()).unwrap();
+        fs::write(dir.path().join("a.png"), b"\x89PNG").unwrap();
+        fs::write(dir.path().join("b.svg"), "<svg/>").unwrap();
+        fs::write(dir.path().join("c.gif"), [0u8; 64]).unwrap();
+        fs::write(dir.path().join("notes.txt"), "not an image").unwrap();
+        let changes = Snapshot::take(dir.path()).unwrap().changes_since(&before);
+
+        let images = collect_images(dir.path(), &changes, 16).unwrap();
+        let paths: Vec<_> = images.iter().map(|image| image.path.as_str()).collect();
+        assert_eq!(paths, ["a.png", "b.svg"]);
+        assert_eq!(images[0].data, "iVBORw==");
+        assert_eq!(images[1].media_type, "image/svg+xml");
+        assert_eq!(images[1].data, "PHN2Zy8+");
+    }
+}
@@ -0,0 +1,448 @@
+use std::{collections::HashMap, fmt, fs, path::Path, sync::RwLock};
+
+use regex::Regex;
+use serde::Deserialize;
+
+use crate::config::config;
+
+use super::{language::Language, toolchain::Toolchain};
+
+// How each language pulls in a module or header. `names` is a comma- or
+// line-separated list; each item is its first word, or what it quotes.
+// `from` prefixes every item, as in Python's `from os import system`.
+const IMPORT_PATTERNS: &[(Language, &str)] = &[
+    (
+        Language::Python,
+        r"(?m)^[ \t]*import[ \t]+(?P<names>[\w.]+(?:[ \t]+as[ \t]+\w+)?(?:[ \t]*,[ \t]*[\w.]+(?:[ \t]+as[ \t]+\w+)?)*)",
+    ),
+    (
+        Language::Python,
+        r"(?m)^[ \t]*from[ \t]+(?P<from>[\w.]+)[ \t]+import[ \t]+\(?(?P<names>[\w \t,*]+)",
+    ),
+    (
+        Language::Python,
+        r#"\b(?:__import__|import_module)\(\s*['"](?P<names>[\w.]+)['"]"#,
+    ),
+    (
+        Language::C,
+        r#"(?m)^[ \t]*#[ \t]*include[ \t]*[<"](?P<names>[^>"]+)[>"]"#,
+    ),
+    (
+        Language::CPP,
+        r#"(?m)^[ \t]*#[ \t]*include[ \t]*[<"](?P<names>[^>"]+)[>"]"#,
+    ),
+    (
+        Language::JAVASCRIPT,
+        r#"\b(?:require|import)\s*\(\s*['"`](?:node:)?(?P<names>[^'"`]+)['"`]"#,
+    ),
+    (
+        Language::JAVASCRIPT,
+        r#"(?m)^[ \t]*(?:import|export)\b[^'"\n;]*?['"](?:node:)?(?P<names>[^'"]+)['"]"#,
+    ),
+    (
+        Language::TYPESCRIPT,
+        r#"\b(?:require|import)\s*\(\s*['"`](?:node:)?(?P<names>[^'"`]+)['"`]"#,
+    ),
+    (
+        Language::TYPESCRIPT,
+        r#"(?m)^[ \t]*(?:import|export)\b[^'"\n;]*?['"](?:node:)?(?P<names>[^'"]+)['"]"#,
+    ),
+    (
+        Language::GO,
+        r#"(?m)^[ \t]*import[ \t]+(?:[\w.]+[ \t]+)?(?P<names>"[^"]+")"#,
+    ),
+    (Language::GO, r"(?m)^[ \t]*import[ \t]*\((?P<names>[^)]*)\)"),
+    (
+        Language::RUST,
+        r"(?m)^[ \t]*(?:pub[ \t]+)?use[ \t]+(?P<names>[\w:]+)",
+    ),
+    (Language::RUST, r"\bextern[ \t]+crate[ \t]+(?P<names>\w+)"),
+    (
+        Language::RUBY,
+        r#"\b(?:require|require_relative|load)\s*\(?\s*['"](?P<names>[^'"]+)['"]"#,
+    ),
+    (
+        Language::PERL,
+        r"(?m)^[ \t]*(?:use|require)[ \t]+(?P<names>[\w:]+)",
+    ),
+    (
+        Language::LUA,
+        r#"\brequire\s*\(?\s*['"](?P<names>[^'"]+)['"]"#,
+    ),
+    (
+        Language::JULIA,
+        r"(?m)^[ \t]*(?:using|import)[ \t]+(?P<names>[\w.]+(?:[ \t]*,[ \t]*[\w.]+)*)",
+    ),
+    (
+        Language::R,
+        r#"\b(?:library|require|requireNamespace)\s*\(\s*['"]?(?P<names>[\w.]+)"#,
+    ),
+];
+
+// One language's entry in the import policy file. Names are modules or
+// headers as the language writes them, such as `subprocess`, `os/exec` or
+// `<cstdlib>`, and cover what is under them. A dotted name such as
+// `os.system`, or a plain one such as `system()`, is also refused where
+// the program refers to or calls it.
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ListSpec {
+    // When given, the only modules programs may import.
+    allow: Option<Vec<String>>,
+    #[serde(default)]
+    deny: Vec<String>,
+}
+
+#[derive(Debug)]
+struct Denied {
+    name: String,
+    // Where the program refers to it, for names that can be written in code.
+    usage: Option<Regex>,
+}
+
+#[derive(Debug)]
+struct ImportList {
+    imports: Vec<Regex>,
+    allow: Option<Vec<String>>,
+    deny: Vec<Denied>,
+}
+
+// `<cstdlib>` and `system()` name `cstdlib` and `system`.
+fn normalize(name: &str) -> String {
+    name.trim()
+        .trim_start_matches('<')
+        .trim_end_matches('>')
+        .trim_end_matches("()")
+        .to_string()
+}
+
+// `os.system` is matched as `os.system` or `os::system` wherever it
+// appears, and `system` only where it is called, not as a method.
+fn usage_pattern(name: &str) -> Option<Regex> {
+    if name.contains('/') || name.ends_with(".h") {
+        return None;
+    }
+    let segments: Vec<_> = name
+        .split("::")
+        .flat_map(|part| part.split('.'))
+        .map(regex::escape)
+        .collect();
+    let pattern = match segments.as_slice() {
+        [name] => format!(r"(?:^|[^\w.>])(?P<name>{})\s*\(", name),
+        _ => format!(
+            r"(?:^|[^\w.>])(?P<name>{})\b",
+            segments.join(r"\s*(?:\.|::)\s*")
+        ),
+    };
+    Regex::new(&pattern).ok()
+}
+
+// Whether `entry` names `module` or a module under it.
+fn covers(entry: &str, module: &str) -> bool {
+    module
+        .strip_prefix(entry)
+        .is_some_and(|rest| rest.is_empty() || rest.starts_with(['.', '/', ':']))
+}
+
+impl ImportList {
+    fn from_spec(lang: &str, language: Option<Language>, spec: ListSpec) -> Result<Self, String> {
+        let imports = IMPORT_PATTERNS
+            .iter()
+            .filter(|(pattern_language, _)| Some(*pattern_language) == language)
+            .map(|(_, pattern)| Regex::new(pattern).unwrap())
+            .collect::<Vec<_>>();
+        if spec.allow.is_some() && imports.is_empty() {
+            return Err(format!(
+                "{} imports are not recognised, so it cannot have an allow list",
+                lang
+            ));
+        }
+        Ok(ImportList {
+            imports,
+            allow: spec
+                .allow
+                .map(|allow| allow.iter().map(String::as_str).map(normalize).collect()),
+            deny: spec
+                .deny
+                .iter()
+                .map(String::as_str)
+                .map(normalize)
+                .map(|name| Denied {
+                    usage: usage_pattern(&name),
+                    name,
+                })
+                .collect(),
+        })
+    }
+
+    // Every module `content` imports, with the byte it is imported at.
+    fn imported(&self, content: &str) -> Vec<(String, usize)> {
+        let mut modules = Vec::new();
+        for pattern in &self.imports {
+            for captures in pattern.captures_iter(content) {
+                let names = captures.name("names").unwrap();
+                let from = captures.name("from").map(|from| from.as_str());
+                let mut at = names.start();
+                for item in names.as_str().split([',', '\n', ';']) {
+                    let item_at = at;
+                    at += item.len() + 1;
+                    let name = match item.split('"').nth(1) {
+                        Some(quoted) => quoted,
+                        None => item.split_whitespace().next().unwrap_or_default(),
+                    };
+                    let name = name.trim_matches(['(', ')', ':']);
+                    if name.is_empty() {
+                        continue;
+                    }
+                    let name = match from {
+                        Some(from) => format!("{}.{}", from, name),
+                        None => name.to_string(),
+                    };
+                    modules.push((name, item_at));
+                }
+            }
+        }
+        modules
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Refusal {
+    // A denied module was imported.
+    Denied,
+    // A denied name was referred to or called.
+    Used,
+    // A module off the allow list was imported.
+    NotAllowed,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Violation {
+    pub refusal: Refusal,
+    pub lang: &'static str,
+    pub name: String,
+    pub line: usize,
+}
+
+impl fmt::Display for Violation {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self.refusal {
+            Refusal::Denied => write!(
+                f,
+                "`{}` is not allowed in {} programs: imported on line {}",
+                self.name, self.lang, self.line
+            ),
+            Refusal::Used => write!(
+                f,
+                "`{}` is not allowed in {} programs: used on line {}",
+                self.name, self.lang, self.line
+            ),
+            Refusal::NotAllowed => write!(
+                f,
+                "`{}` is not among the modules {} programs may import: imported on line {}",
+                self.name, self.lang, self.line
+            ),
+        }
+    }
+}
+
+fn line_of(content: &str, at: usize) -> usize {
+    content[..at].matches('\n').count() + 1
+}
+
+// Modules and headers each language's programs may or may not use. Only
+// a screen against the obvious: code can reach a module in ways no pattern
+// sees, and the sandbox is what actually contains it.
+#[derive(Debug, Default)]
+pub struct ImportPolicy {
+    // By canonical toolchain name.
+    lists: HashMap<&'static str, ImportList>,
+}
+
+impl ImportPolicy {
+    // `{"python": {"deny": ["subprocess", "os.system"]}, "c": {"allow":
+    // ["stdio.h", "stdlib.h"]}}`, keyed by names as in requests.
+    pub fn from_json(text: &str) -> Result<Self, String> {
+        let specs: HashMap<String, ListSpec> =
+            serde_json::from_str(text).map_err(|err| format!("invalid import policy: {}", err))?;
+        let mut lists = HashMap::new();
+        for (lang, spec) in specs {
+            let toolchain = Toolchain::resolve(&lang)
+                .map_err(|_| format!("import policy names unknown language {}", lang))?;
+            let language = match toolchain {
+                Toolchain::Builtin(language) => Some(language),
+                Toolchain::Plugin(_) => None,
+            };
+            lists.insert(
+                toolchain.as_str(),
+                ImportList::from_spec(toolchain.as_str(), language, spec)?,
+            );
+        }
+        Ok(ImportPolicy { lists })
+    }
+
+    pub fn read(path: Option<&Path>) -> Result<Self, String> {
+        match path {
+            Some(path) => ImportPolicy::from_json(
+                &fs::read_to_string(path)
+                    .map_err(|err| format!("cannot read {}: {}", path.display(), err))?,
+            ),
+            None => Ok(ImportPolicy::default()),
+        }
+    }
+
+    // Every module `content` in `lang` may not import and every denied name
+    // it uses, in the order they appear.
+    pub fn check(&self, lang: &str, content: &str) -> Vec<Violation> {
+        let Some((lang, list)) = Toolchain::resolve(lang)
+            .ok()
+            .and_then(|toolchain| self.lists.get_key_value(toolchain.as_str()))
+        else {
+            return Vec::new();
+        };
+        let mut found = Vec::new();
+        for (module, at) in list.imported(content) {
+            let refusal = if list.deny.iter().any(|denied| covers(&denied.name, &module)) {
+                Refusal::Denied
+            } else if list
+                .allow
+                .as_ref()
+                .is_some_and(|allow| !allow.iter().any(|entry| covers(entry, &module)))
+            {
+                Refusal::NotAllowed
+            } else {
+                continue;
+            };
+            found.push((at, refusal, module));
+        }
+        for denied in &list.deny {
+            let used = denied
+                .usage
+                .as_ref()
+                .and_then(|usage| usage.captures(content)?.name("name"));
+            if let Some(used) = used {
+                found.push((used.start(), Refusal::Used, denied.name.clone()));
+            }
+        }
+        found.sort_by_key(|(at, _, _)| *at);
+        found
+            .into_iter()
+            .map(|(at, refusal, name)| Violation {
+                refusal,
+                lang,
+                name,
+                line: line_of(content, at),
+            })
+            .collect()
+    }
+}
+
+// Replaced wholesale on reload, like the submission policy.
+static POLICY: RwLock<Option<&'static ImportPolicy>> = RwLock::new(None);
+
+pub async fn import_policy() -> &'static ImportPolicy {
+    if let Some(policy) = *POLICY.read().unwrap() {
+        return policy;
+    }
+    let policy = ImportPolicy::read(config().await.import_policy_file()).unwrap();
+    let mut current = POLICY.write().unwrap();
+    *current.get_or_insert(Box::leak(Box::new(policy)))
+}
+
+// Rereads the import policy file, keeping the current policy if it is
+// invalid.
+pub async fn reload_import_policy() -> Result<(), String> {
+    let policy = ImportPolicy::read(config().await.import_policy_file())?;
+    *POLICY.write().unwrap() = Some(Box::leak(Box::new(policy)));
+    Ok(())
+}
+
+#[cfg(test)]
+mod imports_tests {
+    use super::*;
+
+    fn refused(policy: &ImportPolicy, lang: &str, content: &str) -> Vec<(Refusal, String, usize)> {
+        policy
+            .check(lang, content)
+            .into_iter()
+            .map(|violation| (violation.refusal, violation.name, violation.line))
+            .collect()
+    }
+
+    #[test]
+    fn test_denied_modules_and_calls_are_found() {
+        let policy = ImportPolicy::from_json(
+            r#"{
+                "Python": {"deny": ["subprocess", "os.system", "ctypes"]},
+                "cpp": {"deny": ["<cstdlib>", "system()", "sys/socket.h"]},
+                "go": {"deny": ["os/exec"]}
+            }"#,
+        )
+        .unwrap();
+
+        let python = "import os, subprocess as sp\nfrom ctypes.util import find_library\n\
+                      os.system('ls')\nprint(os.path.join('a', 'b'))\n";
+        assert_eq!(
+            refused(&policy, "python", python),
+            vec![
+                (Refusal::Denied, "subprocess".into(), 1),
+                (Refusal::Denied, "ctypes.util.find_library".into(), 2),
+                (Refusal::Used, "os.system".into(), 3),
+            ]
+        );
+        assert_eq!(
+            refused(&policy, "python", "from os import system\nsystem('ls')"),
+            vec![(Refusal::Denied, "os.system".into(), 1)]
+        );
+        assert!(refused(&policy, "python", "import os\nprint(os.getcwd())").is_empty());
+
+        let cpp = "#include <iostream>\n#include <cstdlib>\n#include <sys/socket.h>\n\
+                   int main() { std::system(\"ls\"); shell.system(); }";
+        assert_eq!(
+            refused(&policy, "cpp", cpp),
+            vec![
+                (Refusal::Denied, "cstdlib".into(), 2),
+                (Refusal::Denied, "sys/socket.h".into(), 3),
+                (Refusal::Used, "system".into(), 4),
+            ]
+        );
+
+        let go = "package main\nimport (\n\t\"fmt\"\n\tx \"os/exec\"\n)\n";
+        assert_eq!(
+            refused(&policy, "go", go),
+            vec![(Refusal::Denied, "os/exec".into(), 4)]
+        );
+        assert!(refused(&policy, "ruby", "system('ls')").is_empty());
+    }
+
+    #[test]
+    fn test_allow_list_refuses_everything_else() {
+        let policy = ImportPolicy::from_json(
+            r#"{"c": {"allow": ["stdio.h", "stdlib.h"], "deny": ["system"]},
+                "javascript": {"allow": ["fs", "readline"]}}"#,
+        )
+        .unwrap();
+        let c = "#include <stdio.h>\n#include <unistd.h>\nint main() { system(\"ls\"); }";
+        assert_eq!(
+            refused(&policy, "c", c),
+            vec![
+                (Refusal::NotAllowed, "unistd.h".into(), 2),
+                (Refusal::Used, "system".into(), 3),
+            ]
+        );
+        let js = "const fs = require('node:fs');\nimport { exec } from 'child_process';\n\
+                  const p = require('fs/promises');";
+        assert_eq!(
+            refused(&policy, "javascript", js),
+            vec![(Refusal::NotAllowed, "child_process".into(), 2)]
+        );
+        assert_eq!(
+            policy.check("c", c)[0].to_string(),
+            "`unistd.h` is not among the modules c programs may import: imported on line 2"
+        );
+
+        assert!(ImportPolicy::from_json(r#"{"cobol": {"deny": ["x"]}}"#).is_err());
+        assert!(ImportPolicy::from_json(r#"{"php": {"allow": ["json"]}}"#).is_err());
+        assert!(ImportPolicy::from_json(r#"{"python": {"block": ["x"]}}"#).is_err());
+    }
+}
@@ -0,0 +1,282 @@
+use std::{
+    fs, io,
+    os::unix::{fs::PermissionsExt, process::ExitStatusExt},
+    path::{Path, PathBuf},
+    process::{ExitStatus, Stdio},
+    sync::{Arc, Mutex},
+};
+
+use serde::{Deserialize, Serialize};
+use tempfile::TempDir;
+use tokio::{
+    io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt},
+    process::{ChildStdin, ChildStdout, Command},
+};
+use utoipa::ToSchema;
+
+use super::{disk::execution_zone, runner::ExecContext};
+
+// Files the interactor is pointed at, in the order testlib interactors take
+// them on their command line.
+const INPUT_FILE: &str = "input.txt";
+const OUTPUT_FILE: &str = "output.txt";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+#[serde(rename_all = "snake_case")]
+pub enum Verdict {
+    Accepted,
+    WrongAnswer,
+    PresentationError,
+    CompileError,
+    RuntimeError,
+    TimeLimitExceeded,
+    MemoryLimitExceeded,
+    // The interactor itself failed, or exited in a way it should not.
+    JudgeError,
+}
+
+impl Verdict {
+    // Interactors follow testlib's exit codes.
+    pub(super) fn from_status(status: ExitStatus) -> Self {
+        match status.code() {
+            Some(0) => Verdict::Accepted,
+            Some(1) => Verdict::WrongAnswer,
+            Some(2) => Verdict::PresentationError,
+            _ => Verdict::JudgeError,
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct Judgement {
+    pub verdict: Verdict,
+    // What the interactor printed to stderr.
+    pub message: String,
+}
+
+// Interactors, checkers and source hooks are executables the operator
+// places in a directory of their own and names; the name is all a request
+// or the config can choose.
+pub fn find_executable(dir: &Path, name: &str) -> Option<PathBuf> {
+    let valid = !name.is_empty()
+        && !name.starts_with('.')
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '-' | '_' | '.'));
+    if !valid {
+        return None;
+    }
+    let path = dir.join(name);
+    let metadata = fs::metadata(&path).ok()?;
+    (metadata.is_file() && metadata.permissions().mode() & 0o111 != 0).then_some(path)
+}
+
+// A program's stdin and stdout handed to an interactor instead of being
+// fed the submitted input and collected. The interactor is trusted and runs
+// outside the sandbox, but within the program's time limit.
+#[derive(Debug, Clone)]
+pub struct Interaction {
+    interactor: PathBuf,
+    dir: Arc<TempDir>,
+    judgement: Arc<Mutex<Option<Judgement>>>,
+}
+
+impl Interaction {
+    pub fn new(interactor: PathBuf, input: &str) -> io::Result<Self> {
+        let dir = TempDir::new_in(execution_zone())?;
+        fs::write(dir.path().join(INPUT_FILE), input)?;
+        Ok(Interaction {
+            interactor,
+            dir: Arc::new(dir),
+            judgement: Arc::new(Mutex::new(None)),
+        })
+    }
+
+    // The interactor's verdict, once it has exited.
+    pub fn judgement(&self) -> Option<Judgement> {
+        self.judgement.lock().unwrap().clone()
+    }
+
+    // Starts the interactor with its stdout feeding the program's stdin and
+    // the program's stdout feeding its stdin, until both sides are done.
+    // Returns what the program wrote, which counts against its output cap.
+    pub(super) async fn converse(
+        &self,
+        program_stdin: Option<ChildStdin>,
+        program_stdout: Option<ChildStdout>,
+        ctx: &ExecContext,
+    ) -> io::Result<Vec<u8>> {
+        let mut interactor = Command::new(&self.interactor)
+            .current_dir(self.dir.path())
+            .arg(INPUT_FILE)
+            .arg(OUTPUT_FILE)
+            .kill_on_drop(true)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()?;
+        let (said, _, message) = tokio::try_join!(
+            relay(program_stdout, interactor.stdin.take(), ctx.max_output()),
+            relay(interactor.stdout.take(), program_stdin, None),
+            relay(interactor.stderr.take(), None::<ChildStdin>, None),
+        )?;
+        let status = interactor.wait().await?;
+
+        let mut message = String::from_utf8_lossy(&message).trim().to_string();
+        if let Some(signal) = status.signal() {
+            message = format!("interactor killed by signal {}\n{}", signal, message)
+                .trim_end()
+                .to_string();
+        }
+        *self.judgement.lock().unwrap() = Some(Judgement {
+            verdict: Verdict::from_status(status),
+            message,
+        });
+        Ok(said)
+    }
+}
+
+// Copies `reader` into `writer` until it ends, returning what was read.
+// A writer that has gone away is no reason to stop reading: the other side
+// may still be writing, and must not block on a full pipe. Dropping the
+// writer at the end tells the other side nothing more is coming.
+async fn relay<R, W>(
+    reader: Option<R>,
+    writer: Option<W>,
+    cap: Option<usize>,
+) -> io::Result<Vec<u8>>
+where
+    R: AsyncRead + Unpin,
+    W: AsyncWrite + Unpin,
+{
+    let Some(mut reader) = reader else {
+        return Ok(Vec::new());
+    };
+    let mut writer = writer;
+    let mut read = Vec::new();
+    let mut buf = [0u8; 8192];
+    loop {
+        let n = reader.read(&mut buf).await?;
+        if n == 0 {
+            break;
+        }
+        read.extend_from_slice(&buf[..n]);
+        if cap.is_some_and(|limit| read.len() > limit) {
+            return Err(io::ErrorKind::FileTooLarge.into());
+        }
+        let Some(open) = writer.as_mut() else {
+            continue;
+        };
+        let sent = async {
+            open.write_all(&buf[..n]).await?;
+            open.flush().await
+        };
+        match sent.await {
+            Ok(()) => {}
+            Err(err) if err.kind() == io::ErrorKind::BrokenPipe => writer = None,
+            Err(err) => return Err(err),
+        }
+    }
+    Ok(read)
+}
+
+#[cfg(test)]
+mod interactive_tests {
+    use super::*;
+    use crate::infra::{error::InfraError, runner::run_program};
+
+    // Picks a number from the input file and answers guesses with <, > or =,
+    // allowing at most 10 of them.
+    const GUESSING_INTERACTOR: &str = r#"#!/usr/bin/env python3
+import sys
+secret = int(open(sys.argv[1]).read())
+for queries in range(1, 11):
+    line = sys.stdin.readline()
+    if not line:
+        print("wrong answer: no guess", file=sys.stderr)
+        sys.exit(1)
+    guess = int(line)
+    if guess == secret:
+        print("=", flush=True)
+        print(f"ok found in {queries} queries", file=sys.stderr)
+        sys.exit(0)
+    print("<" if secret < guess else ">", flush=True)
+print("wrong answer: too many queries", file=sys.stderr)
+sys.exit(1)
+"#;
+
+    const BINARY_SEARCH: &str = r#"
+lo, hi = 1, 1000
+while True:
+    mid = (lo + hi) // 2
+    print(mid, flush=True)
+    reply = input()
+    if reply == "=":
+        break
+    if reply == "<":
+        hi = mid - 1
+    else:
+        lo = mid + 1
+"#;
+
+    fn interactor(dir: &TempDir) -> PathBuf {
+        let path = dir.path().join("guess");
+        fs::write(&path, GUESSING_INTERACTOR).unwrap();
+        fs::set_permissions(&path, fs::Permissions::from_mode(0o755)).unwrap();
+        path
+    }
+
+    async fn judge(program: &str, secret: &str) -> (Result<String, InfraError>, Option<Judgement>) {
+        let dir = TempDir::new().unwrap();
+        let interaction = Interaction::new(interactor(&dir), secret).unwrap();
+        let ctx = ExecContext::default().with_interaction(interaction.clone());
+        let mut cmd = Command::new("python3");
+        cmd.arg("-c").arg(program);
+        let output = run_program(&mut cmd, "", &ctx)
+            .await
+            .map(|output| String::from_utf8_lossy(&output.stdout).into_owned());
+        (output, interaction.judgement())
+    }
+
+    #[test]
+    fn test_find_executable_only_finds_executables_by_name() {
+        let dir = TempDir::new().unwrap();
+        let path = interactor(&dir);
+        fs::write(dir.path().join("notes"), "").unwrap();
+        assert_eq!(find_executable(dir.path(), "guess"), Some(path));
+        assert_eq!(find_executable(dir.path(), "notes"), None);
+        assert_eq!(find_executable(dir.path(), "missing"), None);
+        assert_eq!(find_executable(dir.path(), "../guess"), None);
+        assert_eq!(find_executable(dir.path(), ".."), None);
+    }
+
+    #[tokio::test]
+    async fn test_program_talks_to_interactor() {
+        let (output, judgement) = judge(BINARY_SEARCH, "737").await;
+        assert!(output.unwrap().starts_with("500\n"));
+        let judgement = judgement.unwrap();
+        assert_eq!(judgement.verdict, Verdict::Accepted);
+        assert!(
+            judgement.message.starts_with("ok found in"),
+            "{}",
+            judgement.message
+        );
+    }
+
+    #[tokio::test]
+    async fn test_interactor_rejects_a_wrong_strategy() {
+        let (output, judgement) = judge(
+            "for i in range(1, 20):\n    print(i, flush=True)\n    input()",
+            "500",
+        )
+        .await;
+        assert!(output.is_ok());
+        assert_eq!(
+            judgement.unwrap(),
+            Judgement {
+                verdict: Verdict::WrongAnswer,
+                message: String::from("wrong answer: too many queries"),
+            }
+        );
+    }
+}
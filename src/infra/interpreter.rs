@@ -0,0 +1,545 @@
+use std::process::Output;
+
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+};
+
+// A language whose programs run by handing the source file to its
+// interpreter, with nothing to build or set up first. Such languages are a
+// row in `INTERPRETERS` rather than a module of their own.
+#[derive(Debug)]
+pub struct Interpreter {
+    pub language: Language,
+    // The language as error messages name it.
+    pub name: &'static str,
+    pub binary: &'static str,
+    // Passed before the source file, whose own arguments follow it.
+    pub args: &'static [&'static str],
+    // Tell the interpreter to read the program from stdin instead, for
+    // `snippet` to pipe short programs to it.
+    pub stdin_args: Option<&'static [&'static str]>,
+}
+
+const INTERPRETERS: &[Interpreter] = &[
+    Interpreter {
+        language: Language::PERL,
+        name: "Perl",
+        binary: "perl",
+        args: &[],
+        stdin_args: Some(&["-"]),
+    },
+    // The CLI prints errors to stdout by default, mixing them into the
+    // program's output.
+    Interpreter {
+        language: Language::PHP,
+        name: "PHP",
+        binary: "php",
+        args: &["-d", "display_errors=stderr"],
+        stdin_args: Some(&["-d", "display_errors=stderr", "--"]),
+    },
+    // Julia takes `-` for the REPL, but reads a file to the end before it
+    // runs any of it.
+    Interpreter {
+        language: Language::JULIA,
+        name: "Julia",
+        binary: "julia",
+        args: &[],
+        stdin_args: Some(&["/dev/stdin"]),
+    },
+];
+
+pub fn interpreter(language: Language) -> Option<&'static Interpreter> {
+    INTERPRETERS
+        .iter()
+        .find(|interpreter| interpreter.language == language)
+}
+
+impl Interpreter {
+    pub async fn run(
+        &self,
+        content: &str,
+        stdin_input: &str,
+        ctx: &ExecContext,
+    ) -> Result<String, InfraError> {
+        let source = SourceFile::create(self.language, content)?;
+        let source_path = source.path().to_path_buf();
+
+        let mut cmd = ctx.command(self.binary)?;
+        cmd.args(self.args).arg(source_path);
+        let output = run_program(&mut cmd, stdin_input, ctx).await?;
+        self.program_result(output)
+    }
+
+    pub fn program_result(&self, output: Output) -> Result<String, InfraError> {
+        match output.status.code() {
+            Some(0) => Ok(String::from_utf8(output.stdout)?),
+            Some(code) => {
+                let stderr = String::from_utf8_lossy(&output.stderr);
+                Err(InfraError::CompilationError(
+                    format!(
+                        "{} program execution failed with status code: {}\nError: {}",
+                        self.name, code, stderr
+                    )
+                    .into(),
+                ))
+            }
+            None => {
+                let stderr = String::from_utf8_lossy(&output.stderr);
+                Err(InfraError::CompilationError(
+                    format!(
+                        "{} program terminated by signal\nError: {}",
+                        self.name, stderr
+                    )
+                    .into(),
+                ))
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod interpreter_tests {
+    use super::*;
+
+    #[test]
+    fn test_each_language_has_one_interpreter() {
+        for language in Language::ALL {
+            let rows = INTERPRETERS
+                .iter()
+                .filter(|interpreter| interpreter.language == language)
+                .count();
+            assert!(rows <= 1, "{} has {} interpreters", language, rows);
+        }
+        for language in [Language::PERL, Language::PHP, Language::JULIA] {
+            assert!(
+                interpreter(language).is_some(),
+                "{} has no interpreter",
+                language
+            );
+        }
+        assert!(interpreter(Language::Python).is_none());
+    }
+}
+
+#[cfg(test)]
+mod perl_tests {
+    use super::*;
+
+    async fn compile_perl(
+        content: &str,
+        stdin_input: &str,
+        ctx: &ExecContext,
+    ) -> Result<String, InfraError> {
+        let interpreter = interpreter(Language::PERL).unwrap();
+        interpreter.run(content, stdin_input, ctx).await
+    }
+
+    #[tokio::test]
+    async fn test_simple_hello_world() {
+        let perl_code = r#"
+print "Hello, World!\n";
+"#;
+
+        let result = compile_perl(perl_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Hello, World!");
+    }
+
+    #[tokio::test]
+    async fn test_simple_arithmetic() {
+        let perl_code = r#"
+my $a = 5;
+my $b = 3;
+print $a + $b, "\n";
+"#;
+
+        let result = compile_perl(perl_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "8");
+    }
+
+    #[tokio::test]
+    async fn test_stdin_input() {
+        let perl_code = r#"
+my $num = <STDIN>;
+chomp($num);
+print "You entered: $num\n";
+"#;
+
+        let result = compile_perl(perl_code, "42\n", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "You entered: 42");
+    }
+
+    #[tokio::test]
+    async fn test_string_input() {
+        let perl_code = r#"
+my $name = <STDIN>;
+chomp($name);
+print "Hello, $name!\n";
+"#;
+
+        let result = compile_perl(perl_code, "Alice\n", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Hello, Alice!");
+    }
+
+    #[tokio::test]
+    async fn test_multiple_lines_output() {
+        let perl_code = r#"
+for my $i (1..3) {
+    print "Line $i\n";
+}
+"#;
+
+        let result = compile_perl(perl_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        let output = result.unwrap();
+        assert!(output.contains("Line 1"));
+        assert!(output.contains("Line 2"));
+        assert!(output.contains("Line 3"));
+    }
+
+    #[tokio::test]
+    async fn test_runtime_error() {
+        let perl_code = r#"
+exit(1);  # This should cause a runtime error
+"#;
+
+        let result = compile_perl(perl_code, "", &ExecContext::default()).await;
+        assert!(result.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_complex_stdin_processing() {
+        let perl_code = r#"
+my ($a, $b) = split(' ', <STDIN>);
+chomp($a, $b);
+print "Sum: ", $a + $b, "\n";
+print "Product: ", $a * $b, "\n";
+"#;
+
+        let result = compile_perl(perl_code, "7 3\n", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        let output = result.unwrap();
+        assert!(output.contains("Sum: 10"));
+        assert!(output.contains("Product: 21"));
+    }
+
+    #[tokio::test]
+    async fn test_empty_program() {
+        let perl_code = r#"
+# Empty Perl program
+"#;
+
+        let result = compile_perl(perl_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "");
+    }
+
+    #[tokio::test]
+    async fn test_program_with_includes() {
+        let perl_code = r#"
+use strict;
+use warnings;
+my $str = "Hello";
+print "Length: ", length($str), "\n";
+"#;
+
+        let result = compile_perl(perl_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Length: 5");
+    }
+
+    #[tokio::test]
+    async fn test_program_with_math_includes() {
+        let perl_code = r#"
+use strict;
+use warnings;
+use Math::Trig;
+my $x = 16.0;
+print "Square root of $x is ", sqrt($x), "\n";
+"#;
+
+        let result = compile_perl(perl_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Square root of 16 is 4");
+    }
+
+    #[tokio::test]
+    async fn test_program_with_threads() {
+        let perl_code = r#"
+use strict;
+use warnings;
+use threads;
+my $thread = threads->create(sub { print "Thread running\n"; });
+$thread->join();
+"#;
+
+        let result = compile_perl(perl_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Thread running");
+    }
+}
+
+#[cfg(test)]
+mod php_tests {
+    use super::*;
+
+    async fn compile_php(
+        content: &str,
+        stdin_input: &str,
+        ctx: &ExecContext,
+    ) -> Result<String, InfraError> {
+        let interpreter = interpreter(Language::PHP).unwrap();
+        interpreter.run(content, stdin_input, ctx).await
+    }
+
+    #[tokio::test]
+    async fn test_simple_hello_world() {
+        let php_code = r#"<?php
+echo "Hello, World!\n";
+"#;
+
+        let result = compile_php(php_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Hello, World!");
+    }
+
+    #[tokio::test]
+    async fn test_stdin_input() {
+        let php_code = r#"<?php
+$num = trim(fgets(STDIN));
+echo "You entered: $num\n";
+"#;
+
+        let result = compile_php(php_code, "42\n", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "You entered: 42");
+    }
+
+    #[tokio::test]
+    async fn test_complex_stdin_processing() {
+        let php_code = r#"<?php
+[$a, $b] = array_map('intval', explode(' ', trim(fgets(STDIN))));
+echo "Sum: ", $a + $b, "\n";
+echo "Product: ", $a * $b, "\n";
+"#;
+
+        let result = compile_php(php_code, "7 3\n", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        let output = result.unwrap();
+        assert!(output.contains("Sum: 10"));
+        assert!(output.contains("Product: 21"));
+    }
+
+    #[tokio::test]
+    async fn test_program_args() {
+        let php_code = r#"<?php
+echo implode(",", array_slice($argv, 1)), "\n";
+"#;
+
+        let ctx = ExecContext::default().with_args(vec![String::from("a"), String::from("b c")]);
+        let result = compile_php(php_code, "", &ctx).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "a,b c");
+    }
+
+    #[tokio::test]
+    async fn test_text_outside_php_tags_is_printed() {
+        let php_code = "Hello, <?php echo 'World'; ?>!\n";
+
+        let result = compile_php(php_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Hello, World!");
+    }
+
+    #[tokio::test]
+    async fn test_runtime_error() {
+        let php_code = r#"<?php
+exit(3);
+"#;
+
+        let err = compile_php(php_code, "", &ExecContext::default())
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("status code: 3"));
+    }
+
+    #[tokio::test]
+    async fn test_fatal_error_goes_to_stderr() {
+        let php_code = r#"<?php
+echo "before\n";
+undefined_function();
+"#;
+
+        let err = compile_php(php_code, "", &ExecContext::default())
+            .await
+            .unwrap_err();
+        let message = err.to_string();
+        assert!(message.contains("undefined_function"));
+        assert!(message.contains("status code: 255"));
+    }
+
+    #[tokio::test]
+    async fn test_syntax_error() {
+        let php_code = r#"<?php
+echo "Missing semicolon"
+"#;
+
+        let result = compile_php(php_code, "", &ExecContext::default()).await;
+        assert!(result.is_err());
+    }
+}
+
+#[cfg(test)]
+mod julia_tests {
+    use super::*;
+
+    async fn compile_julia(
+        content: &str,
+        stdin_input: &str,
+        ctx: &ExecContext,
+    ) -> Result<String, InfraError> {
+        let interpreter = interpreter(Language::JULIA).unwrap();
+        interpreter.run(content, stdin_input, ctx).await
+    }
+
+    #[tokio::test]
+    async fn test_simple_hello_world() {
+        let julia_code = r#"
+println("Hello, World!")
+"#;
+
+        let result = compile_julia(julia_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Hello, World!");
+    }
+
+    #[tokio::test]
+    async fn test_simple_arithmetic() {
+        let julia_code = r#"
+a = 5
+b = 3
+println(a + b)
+"#;
+
+        let result = compile_julia(julia_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "8");
+    }
+
+    #[tokio::test]
+    async fn test_stdin_input() {
+        let julia_code = r#"
+num = parse(Int, readline())
+println("You entered: $num")
+"#;
+
+        let result = compile_julia(julia_code, "42", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "You entered: 42");
+    }
+
+    #[tokio::test]
+    async fn test_multiple_lines_output() {
+        let julia_code = r#"
+for i in 1:3
+    println("Line $i")
+end
+"#;
+
+        let result = compile_julia(julia_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        let output = result.unwrap();
+        assert!(output.contains("Line 1"));
+        assert!(output.contains("Line 2"));
+        assert!(output.contains("Line 3"));
+    }
+
+    #[tokio::test]
+    async fn test_compilation_error() {
+        let invalid_julia_code = r#"
+println("Missing closing quote
+"#;
+
+        let result = compile_julia(invalid_julia_code, "", &ExecContext::default()).await;
+        assert!(result.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_compiletime_error() {
+        let julia_code = r#"
+throw(ErrorException("compiletime error"))
+"#;
+
+        let result = compile_julia(julia_code, "", &ExecContext::default()).await;
+        assert!(result.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_complex_stdin_processing() {
+        let julia_code = r#"
+a, b = parse.(Int, split(readline()))
+println("Sum: $(a + b)")
+println("Product: $(a * b)")
+"#;
+
+        let result = compile_julia(julia_code, "7 3", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        let output = result.unwrap();
+        assert!(output.contains("Sum: 10"));
+        assert!(output.contains("Product: 21"));
+    }
+
+    #[tokio::test]
+    async fn test_empty_program() {
+        let julia_code = r#"
+"#;
+
+        let result = compile_julia(julia_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "");
+    }
+
+    #[tokio::test]
+    async fn test_program_with_stdlib() {
+        let julia_code = r#"
+str = "Hello"
+println("Length: $(length(str))")
+"#;
+
+        let result = compile_julia(julia_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Length: 5");
+    }
+
+    #[tokio::test]
+    async fn test_program_with_math() {
+        let julia_code = r#"
+x = 16.0
+println("Square root of $x is $(sqrt(x))")
+"#;
+
+        let result = compile_julia(julia_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Square root of 16.0 is 4.0");
+    }
+
+    #[tokio::test]
+    async fn test_program_with_tasks() {
+        let julia_code = r#"
+@async begin
+    println("Task compilening")
+end
+sleep(0.1)
+"#;
+
+        let result = compile_julia(julia_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Task compilening");
+    }
+}
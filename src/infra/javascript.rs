@@ -1,36 +1,227 @@
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use super::error::InfraError;
-use which::which;
+use std::{fs, io, os::unix::fs::symlink, path::Path, process::Output, str::FromStr};
+
+use crate::config::config;
+
+use super::{
+    coverage::CoverageReport,
+    error::InfraError,
+    language::Language,
+    profile,
+    quickjs::{JsEngine, run_embedded},
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+};
+
+// npm packages submissions may declare as dependencies, each installed in
+// the instance's curated node_modules directory.
+#[derive(Debug, Clone, Default)]
+pub struct NodePackages {
+    names: Vec<String>,
+}
+
+fn is_package_name(name: &str) -> bool {
+    let unscoped = match name.strip_prefix('@') {
+        Some(scoped) => match scoped.split_once('/') {
+            Some((scope, rest)) if !scope.is_empty() => rest,
+            _ => return false,
+        },
+        None => name,
+    };
+    !unscoped.is_empty()
+        && !unscoped.starts_with('.')
+        && unscoped.chars().all(|c| {
+            c.is_ascii_lowercase() || c.is_ascii_digit() || matches!(c, '-' | '_' | '.')
+        })
+}
+
+impl FromStr for NodePackages {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut names = Vec::new();
+        for name in s.split(',').map(str::trim).filter(|name| !name.is_empty()) {
+            if !is_package_name(name) {
+                return Err(format!("invalid npm package name {:?}", name));
+            }
+            names.push(name.to_string());
+        }
+        Ok(NodePackages { names })
+    }
+}
 
-pub async fn compile_javascript(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::new()?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
+impl NodePackages {
+    pub fn contains(&self, name: &str) -> bool {
+        self.names.iter().any(|allowed| allowed == name)
+    }
 
-    let mut cmd = Command::new(which("bun")?)
-        .arg(temp_file.path())
-        .stdout(Stdio::piped())
-        .stdin(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
+    pub fn names(&self) -> &[String] {
+        &self.names
+    }
+}
+
+// Links each declared package from the curated directory into a
+// node_modules next to the program. The directory belongs to the server, so
+// the program can neither swap the links nor add packages of its own.
+fn link_packages(modules: &Path, packages: &[String], dir: &Path) -> io::Result<()> {
+    let node_modules = dir.join("node_modules");
+    for package in packages {
+        let link = node_modules.join(package);
+        if let Some(parent) = link.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        symlink(modules.join(package), link)?;
+    }
+    Ok(())
+}
 
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
+// Plain scripts run on whichever engine the request, or failing that the
+// instance, asks for.
+pub async fn compile_javascript(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let app_config = config().await;
+    let engine = match ctx.js_engine().unwrap_or(app_config.js_engine()) {
+        // c8 measures coverage with Node's own instrumentation, and only
+        // Node has a sampling profiler to ask for.
+        _ if ctx.coverage_dir().is_some() || ctx.profile_dir().is_some() => JsEngine::Node,
+        // Only a runtime can load packages.
+        JsEngine::Auto if !ctx.dependencies().is_empty() => JsEngine::Bun,
+        engine => engine,
+    };
+    match engine.pick(content) {
+        JsEngine::Embedded if !ctx.dependencies().is_empty() => Err(InfraError::CompilationError(
+            "the embedded engine cannot load npm packages".into(),
+        )),
+        JsEngine::Embedded => {
+            // A language default for JavaScript replaces the instance's.
+            let memory_bytes = ctx
+                .memory_limit()
+                .map_or(app_config.js_memory_bytes(), |bytes| bytes as usize);
+            let output = run_embedded(content, stdin_input, ctx, memory_bytes).await?;
+            program_result(Language::JAVASCRIPT, output)
+        }
+        runtime => run_script(runtime, Language::JAVASCRIPT, content, stdin_input, ctx).await,
     }
+}
+
+pub async fn compile_typescript(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let engine = ctx.js_engine().unwrap_or(config().await.js_engine());
+    let runtime = if engine.runs_typescript() {
+        engine
+    } else {
+        JsEngine::Bun
+    };
+    run_script(runtime, Language::TYPESCRIPT, content, stdin_input, ctx).await
+}
 
-    let output = cmd.wait_with_output().await?;
+// Deno grants nothing unless asked, so the program gets back only its own
+// workspace and the variables the request set. Remote and npm imports would
+// be fetched regardless of network permissions, so they are refused too.
+fn deno_permissions(ctx: &ExecContext) -> Vec<String> {
+    let mut flags = vec![
+        String::from("--quiet"),
+        String::from("--no-prompt"),
+        String::from("--no-remote"),
+        String::from("--no-npm"),
+    ];
+    if let Some(workspace) = ctx.workspace() {
+        flags.push(format!("--allow-read={}", workspace.display()));
+        flags.push(format!("--allow-write={}", workspace.display()));
+    }
+    let keys: Vec<&str> = ctx.envs().iter().map(|(key, _)| key.as_str()).collect();
+    if !keys.is_empty() {
+        flags.push(format!("--allow-env={}", keys.join(",")));
+    }
+    flags
+}
 
+async fn run_script(
+    runtime: JsEngine,
+    language: Language,
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(language, content)?;
+    if !ctx.dependencies().is_empty() {
+        let app_config = config().await;
+        let allowed = app_config.node_packages();
+        if let Some(name) = ctx.dependencies().iter().find(|name| !allowed.contains(name)) {
+            return Err(InfraError::CompilationError(
+                format!(
+                    "package {} is not available; allowed packages: {}",
+                    name,
+                    allowed.names().join(", ")
+                )
+                .into(),
+            ));
+        }
+        let Some(modules) = app_config.node_modules_dir() else {
+            return Err(InfraError::CompilationError(
+                "npm packages are not available on this instance".into(),
+            ));
+        };
+        if !runtime.loads_packages() {
+            return Err(InfraError::CompilationError(
+                format!("the {} engine cannot load npm packages", runtime).into(),
+            ));
+        }
+        link_packages(modules, ctx.dependencies(), source.dir())?;
+    }
+
+    let mut cmd = match runtime {
+        JsEngine::Node => match ctx.coverage_dir() {
+            Some(dir) => {
+                let mut cmd = ctx.command("c8")?;
+                cmd.args(["--reporter=json-summary", "--allowExternal"])
+                    .arg(format!("--report-dir={}", dir.display()))
+                    .arg(format!("--temp-directory={}", dir.join("v8").display()))
+                    .arg(format!("--include={}", source.path().display()))
+                    .arg(ctx.which("node")?);
+                cmd
+            }
+            None => {
+                let mut cmd = ctx.command("node")?;
+                if let Some(dir) = ctx.profile_dir() {
+                    cmd.args(profile::node_flags(dir));
+                }
+                cmd
+            }
+        },
+        JsEngine::Deno => {
+            let mut cmd = ctx.command("deno")?;
+            cmd.arg("run").args(deno_permissions(ctx));
+            cmd
+        }
+        _ => ctx.command("bun")?,
+    };
+    cmd.arg(source.path());
+    let output = run_program(&mut cmd, stdin_input, ctx).await?;
+    let result = program_result(language, output)?;
+    if let Some(dir) = ctx.coverage_dir() {
+        let summary = fs::read_to_string(dir.join("coverage-summary.json"))?;
+        CoverageReport::from_c8_summary(&summary, source.dir())?.save(dir)?;
+    }
+    if let Some(dir) = ctx.profile_dir() {
+        profile::report_node(dir, source.dir(), ctx).await?;
+    }
+    Ok(result)
+}
+
+fn program_result(language: Language, output: Output) -> Result<String, InfraError> {
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
         Some(code) => {
             let stderr = String::from_utf8(output.stderr)?;
             Err(InfraError::CompilationError(format!(
-                "Failed to compile javascript. Program returned with Error code: {}, stderr: {}",
-                code, stderr
+                "Failed to compile {}. Program returned with Error code: {}, stderr: {}",
+                language, code, stderr
             ).into()))
         }
         None => Err(InfraError::CompilationError(
@@ -43,17 +234,27 @@ pub async fn compile_javascript(content: &str, stdin_input: &str) -> Result<Stri
 mod js_tests {
     use super::*;
 
+    #[tokio::test]
+    async fn test_typescript_type_annotations() {
+        let code = r#"
+const greet = (name: string): string => `Hello, ${name}!`;
+console.log(greet("World"));
+"#;
+        let result = compile_typescript(code, "", &ExecContext::default()).await;
+        assert_eq!(result.unwrap().trim(), "Hello, World!");
+    }
+
     #[tokio::test]
     async fn test_compile_js_basic_output() {
         let content = r#"console.log('hello world')"#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "hello world");
     }
 
     #[tokio::test]
     async fn test_compile_js_with_empty_content() {
         let content = "";
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "");
     }
 
@@ -64,7 +265,7 @@ mod js_tests {
             console.log('line 2');
             console.log('line 3');
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "line 1\nline 2\nline 3");
     }
 
@@ -75,7 +276,7 @@ mod js_tests {
             console.log('Received: ' + input.trim());
         "#;
         let stdin_input = "hello";
-        let res = compile_javascript(content, stdin_input).await.unwrap();
+        let res = compile_javascript(content, stdin_input, &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Received: hello");
     }
 
@@ -86,7 +287,7 @@ mod js_tests {
             console.log('Input length: ' + input.length);
         "#;
         let stdin_input = "";
-        let res = compile_javascript(content, stdin_input).await.unwrap();
+        let res = compile_javascript(content, stdin_input, &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Input length: 0");
     }
 
@@ -98,14 +299,14 @@ mod js_tests {
             console.log('Lines: ' + lines.length);
         "#;
         let stdin_input = "line1\nline2\nline3";
-        let res = compile_javascript(content, stdin_input).await.unwrap();
+        let res = compile_javascript(content, stdin_input, &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Lines: 3");
     }
 
     #[tokio::test]
     async fn test_compile_js_syntax_error() {
         let content = r#"console.log('unclosed string"#;
-        let result = compile_javascript(content, "").await;
+        let result = compile_javascript(content, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -116,14 +317,14 @@ mod js_tests {
             throw new Error('test error');
             console.log('after error');
         "#;
-        let result = compile_javascript(content, "").await;
+        let result = compile_javascript(content, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
     #[tokio::test]
     async fn test_compile_js_reference_error() {
         let content = r#"console.log(undefinedVariable)"#;
-        let result = compile_javascript(content, "").await;
+        let result = compile_javascript(content, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -134,7 +335,7 @@ mod js_tests {
             console.log(3.14);
             console.log(-10);
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "42\n3.14\n-10");
     }
 
@@ -144,7 +345,7 @@ mod js_tests {
             console.log(true);
             console.log(false);
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "true\nfalse");
     }
 
@@ -154,7 +355,7 @@ mod js_tests {
             const arr = [1, 2, 3];
             console.log(JSON.stringify(arr));
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "[1,2,3]");
     }
 
@@ -164,7 +365,7 @@ mod js_tests {
             const obj = { name: 'test', value: 42 };
             console.log(JSON.stringify(obj));
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), r#"{"name":"test","value":42}"#);
     }
 
@@ -176,7 +377,7 @@ mod js_tests {
             }
             console.log(greet('World'));
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Hello, World!");
     }
 
@@ -186,7 +387,7 @@ mod js_tests {
             const add = (a, b) => a + b;
             console.log(add(5, 3));
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "8");
     }
 
@@ -204,7 +405,7 @@ mod js_tests {
             
             main();
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "async completed");
     }
 
@@ -218,7 +419,7 @@ mod js_tests {
                 console.log('lesser');
             }
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "greater");
     }
 
@@ -229,7 +430,7 @@ mod js_tests {
                 console.log('iteration ' + i);
             }
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "iteration 0\niteration 1\niteration 2");
     }
 
@@ -240,7 +441,7 @@ mod js_tests {
             const [first, second] = arr;
             console.log(first + ' ' + second);
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "1 2");
     }
 
@@ -251,7 +452,7 @@ mod js_tests {
             const version = 2024;
             console.log(`Hello ${name} ${version}!`);
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Hello JavaScript 2024!");
     }
 
@@ -271,21 +472,21 @@ mod js_tests {
             const person = new Person('Alice');
             console.log(person.greet());
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Hello, I am Alice");
     }
 
     #[tokio::test]
     async fn test_compile_js_unicode() {
         let content = r#"console.log('Hello 世界 🌍')"#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Hello 世界 🌍");
     }
 
     #[tokio::test]
     async fn test_compile_js_escape_sequences() {
         let content = r#"console.log('Line 1\nLine 2\tTabbed')"#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Line 1\nLine 2\tTabbed");
     }
 
@@ -296,7 +497,7 @@ mod js_tests {
             const parsed = JSON.parse(json);
             console.log(parsed.key + ' ' + parsed.number);
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "value 42");
     }
 
@@ -307,7 +508,7 @@ mod js_tests {
                 console.log(i);
             }
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         let lines: Vec<&str> = res.trim().split('\n').collect();
         assert_eq!(lines.len(), 1000);
         assert_eq!(lines[0], "0");
@@ -322,7 +523,7 @@ mod js_tests {
             const result = x + y;
             // No console.log
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "");
     }
 
@@ -332,7 +533,7 @@ mod js_tests {
             console.log(typeof Bun);
             console.log(Bun.version);
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         let lines: Vec<&str> = res.trim().split('\n').collect();
         assert_eq!(lines[0], "object");
         assert!(lines[1].contains("1."));
@@ -344,7 +545,7 @@ mod js_tests {
             const fs = require('fs');
             console.log(typeof fs.readFileSync);
         "#;
-        let res = compile_javascript(content, "").await.unwrap();
+        let res = compile_javascript(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "function");
     }
 
@@ -355,7 +556,72 @@ mod js_tests {
             process.exit(2);
             console.log('after exit');
         "#;
-        let result = compile_javascript(content, "").await;
+        let result = compile_javascript(content, "", &ExecContext::default()).await;
+        assert!(result.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_compile_js_on_node() {
+        let content = r#"console.log(process.release.name, process.argv.slice(2).join(' '))"#;
+        let ctx = ExecContext::default()
+            .with_js_engine(Some(JsEngine::Node))
+            .with_args(vec!["a".into(), "b".into()]);
+        let res = compile_javascript(content, "", &ctx).await.unwrap();
+        assert_eq!(res.trim(), "node a b");
+    }
+
+    #[tokio::test]
+    async fn test_profile_runs_on_node_and_finds_hot_function() {
+        let content = r#"
+function fib(n) { return n < 2 ? n : fib(n - 1) + fib(n - 2); }
+console.log(fib(30));
+"#;
+        let dir = tempfile::tempdir().unwrap();
+        let ctx = ExecContext::default()
+            .with_js_engine(Some(JsEngine::Bun))
+            .with_profile_dir(dir.path().to_path_buf());
+        let res = compile_javascript(content, "", &ctx).await.unwrap();
+        assert_eq!(res.trim(), "832040");
+        let report = profile::ProfileReport::load(dir.path()).unwrap().unwrap();
+        assert_eq!(report.profiler, "node");
+        assert!(report.hotspots.iter().any(|hotspot| hotspot.function.starts_with("fib ")));
+    }
+
+    #[test]
+    fn test_deno_is_granted_only_workspace_and_request_env() {
+        let flags = deno_permissions(&ExecContext::default());
+        assert!(flags.iter().all(|flag| !flag.starts_with("--allow")));
+
+        let ctx = ExecContext::default()
+            .with_workspace("/tmp/ws".into())
+            .with_env("MODE", "test");
+        let flags = deno_permissions(&ctx);
+        assert!(flags.contains(&String::from("--allow-read=/tmp/ws")));
+        assert!(flags.contains(&String::from("--allow-write=/tmp/ws")));
+        assert!(flags.contains(&String::from("--allow-env=MODE")));
+        assert!(!flags.iter().any(|flag| flag.starts_with("--allow-net")));
+    }
+
+    #[tokio::test]
+    async fn test_compile_js_auto_engine_keeps_node_apis_on_bun() {
+        let content = r#"console.log(require('path').join('a', 'b'))"#;
+        let ctx = ExecContext::default().with_js_engine(Some(JsEngine::Auto));
+        let res = compile_javascript(content, "", &ctx).await.unwrap();
+        assert_eq!(res.trim(), "a/b");
+    }
+
+    #[cfg(feature = "quickjs")]
+    #[tokio::test]
+    async fn test_compile_js_embedded_engine() {
+        let content = r#"
+            const n = Number(readline());
+            console.log([...Array(n).keys()].map(i => i * i).join(','));
+        "#;
+        let ctx = ExecContext::default().with_js_engine(Some(JsEngine::Embedded));
+        let res = compile_javascript(content, "4", &ctx).await.unwrap();
+        assert_eq!(res.trim(), "0,1,4,9");
+
+        let result = compile_javascript("undefinedVariable", "", &ctx).await;
         assert!(result.is_err());
     }
 
@@ -367,7 +633,7 @@ mod js_tests {
             console.log(data.name + ' is ' + data.age + ' years old');
         "#;
         let stdin_input = r#"{"name": "John", "age": 30}"#;
-        let res = compile_javascript(content, stdin_input).await.unwrap();
+        let res = compile_javascript(content, stdin_input, &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "John is 30 years old");
     }
 
@@ -380,7 +646,34 @@ mod js_tests {
             console.log('Sum: ' + sum);
         "#;
         let stdin_input = "10\n20\n30";
-        let res = compile_javascript(content, stdin_input).await.unwrap();
+        let res = compile_javascript(content, stdin_input, &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Sum: 60");
     }
+
+    #[test]
+    fn test_node_packages_accept_npm_names() {
+        let packages = "lodash, @babel/core, date-fns".parse::<NodePackages>().unwrap();
+        assert!(packages.contains("@babel/core"));
+        assert!(!packages.contains("@babel/parser"));
+        assert!("Lodash".parse::<NodePackages>().is_err());
+        assert!("../etc".parse::<NodePackages>().is_err());
+        assert!("@/core".parse::<NodePackages>().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_linked_packages_resolve_from_script() {
+        let modules = tempfile::tempdir().unwrap();
+        let package = modules.path().join("@acme/greet");
+        fs::create_dir_all(&package).unwrap();
+        fs::write(package.join("index.js"), "exports.hi = () => 'hi';").unwrap();
+
+        let source = SourceFile::create(Language::JAVASCRIPT, "").unwrap();
+        link_packages(modules.path(), &["@acme/greet".into()], source.dir()).unwrap();
+        let mut cmd = ExecContext::default().command("node").unwrap();
+        cmd.arg("-e")
+            .arg("console.log(require('@acme/greet').hi())")
+            .current_dir(source.dir());
+        let output = cmd.output().await.unwrap();
+        assert_eq!(String::from_utf8(output.stdout).unwrap().trim(), "hi");
+    }
 }
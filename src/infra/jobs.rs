@@ -0,0 +1,1211 @@
+use std::{
+    collections::{BTreeMap, HashMap, VecDeque},
+    sync::Mutex,
+    time::Duration,
+};
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use tokio::sync::{Notify, OnceCell, broadcast, mpsc};
+use utoipa::ToSchema;
+use uuid::Uuid;
+
+use super::{
+    compile::compile_lang,
+    dispatch::{Assignment, JobDispatch, reassign_from_dead_workers, worker_registry},
+    error::InfraError,
+    events::Submitter,
+    interactive::Verdict,
+    judge::grade,
+    logs::logged,
+    matrix::{ToolchainVersion, ToolchainVersions},
+    quickjs::JsEngine,
+    runner::{ExecContext, OutputChunk, OutputEncoding, UsageSample},
+    scheduler::{Priority, PriorityScheduler, Timetable},
+    store::{Store, store},
+    tier::Tier,
+    trace::{traced, traceparent},
+    wasm::Backend,
+};
+use crate::config::config;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+#[serde(rename_all = "lowercase")]
+pub enum JobStatus {
+    // Waiting for the time it was submitted to run at.
+    Scheduled,
+    Queued,
+    Running,
+    Completed,
+    Failed,
+    // Was running when the server restarted; it is not run again.
+    Interrupted,
+}
+
+impl JobStatus {
+    pub fn is_finished(&self) -> bool {
+        matches!(
+            self,
+            JobStatus::Completed | JobStatus::Failed | JobStatus::Interrupted
+        )
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, ToSchema)]
+pub struct Job {
+    pub id: String,
+    pub lang: String,
+    pub status: JobStatus,
+    pub result: Option<String>,
+    pub error: Option<String>,
+    pub created_at: DateTime<Utc>,
+    pub started_at: Option<DateTime<Utc>>,
+    pub finished_at: Option<DateTime<Utc>>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub version: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub scheduled_for: Option<DateTime<Utc>>,
+    #[serde(default)]
+    pub priority: Priority,
+    // While the job is queued: how many jobs will start before it, and when
+    // it should start judging by how long recent jobs ran.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub queue_position: Option<usize>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub estimated_start: Option<DateTime<Utc>>,
+    // The finished job this one runs again.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub rerun_of: Option<String>,
+    // The group the job was submitted in. Jobs in a group are judged once
+    // they finish, against their expected output if they have one.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub group: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub verdict: Option<Verdict>,
+    // The W3C trace the job was submitted in, passed on to the events its
+    // run publishes.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub traceparent: Option<String>,
+}
+
+#[derive(Debug, Clone)]
+pub enum JobEvent {
+    // What the job's compiler wrote while building the program.
+    Compiler(OutputChunk),
+    Output(OutputChunk),
+    // What the program is using while it runs. Only sent live; a late
+    // subscriber does not get earlier samples.
+    Usage(UsageSample),
+    Finished(Job),
+}
+
+pub struct Subscription {
+    pub compile_history: Vec<OutputChunk>,
+    pub history: Vec<OutputChunk>,
+    pub finished: Option<Job>,
+    pub events: broadcast::Receiver<JobEvent>,
+}
+
+#[derive(Debug, Clone, Default)]
+pub struct JobSpec {
+    pub lang: String,
+    pub content: String,
+    pub stdin: String,
+    pub args: Vec<String>,
+    pub env: BTreeMap<String, String>,
+    pub compiler_flags: Vec<String>,
+    pub backend: Backend,
+    pub js_engine: Option<JsEngine>,
+    pub dependencies: Vec<String>,
+    pub setup: String,
+    pub output_encoding: OutputEncoding,
+    pub version: Option<&'static ToolchainVersion>,
+    pub tier: Option<Tier>,
+    pub submitter: Submitter,
+    // Holds the job back until then; it is queued at once if this is unset
+    // or already past.
+    pub run_at: Option<DateTime<Utc>>,
+    pub priority: Priority,
+    pub rerun_of: Option<String>,
+    pub group: Option<String>,
+    // What a judged job should print, and the limits of the test it runs.
+    pub expected_output: Option<String>,
+    pub time_limit: Option<Duration>,
+    pub memory_limit: Option<u64>,
+    pub locale: Option<String>,
+    pub timezone: Option<String>,
+    // Taken from the request that submits the job when unset.
+    pub traceparent: Option<String>,
+}
+
+impl JobSpec {
+    pub fn context(&self) -> ExecContext {
+        let mut ctx = ExecContext::default();
+        if let Some(tier) = &self.tier {
+            ctx = tier.apply(ctx);
+        }
+        if let Some(version) = self.version {
+            ctx = ctx.with_toolchain_dir(version.dir.clone());
+        }
+        if let Some(limit) = self.time_limit {
+            ctx = ctx.with_program_timeout(limit);
+        }
+        if let Some(bytes) = self.memory_limit {
+            ctx = ctx.with_memory_limit(bytes);
+        }
+        ctx.with_args(self.args.clone())
+            .with_envs(self.env.clone())
+            .with_locale(self.locale.clone())
+            .with_timezone(self.timezone.clone())
+            .with_compiler_flags(self.compiler_flags.clone())
+            .with_backend(self.backend)
+            .with_js_engine(self.js_engine)
+            .with_dependencies(self.dependencies.clone())
+            .with_setup(self.setup.clone())
+            .with_output_encoding(self.output_encoding)
+    }
+
+    // The verdict on the job's run, for a job in a group.
+    pub fn judged(&self, result: &Result<String, InfraError>) -> Option<Verdict> {
+        self.group.as_ref()?;
+        Some(grade(result, self.expected_output.as_deref()))
+    }
+}
+
+struct JobEntry {
+    job: Job,
+    tenant: String,
+    // Kept until the job finishes so it can be handed out again if the
+    // worker running it disappears.
+    spec: JobSpec,
+    compile_log: Vec<OutputChunk>,
+    output: Vec<OutputChunk>,
+    events: broadcast::Sender<JobEvent>,
+}
+
+// A job as kept in the store until it finishes, so that it survives a
+// restart. Each is kept under its node's prefix, which a restarted node
+// lists to find its own.
+#[derive(Serialize, Deserialize)]
+struct UnfinishedJob {
+    job: Job,
+    tenant: String,
+    assignment: Assignment,
+}
+
+// What a finished job ran, kept as long as the job so it can be run again.
+#[derive(Serialize, Deserialize)]
+struct FinishedSpec {
+    tenant: String,
+    assignment: Assignment,
+}
+
+// How many finished jobs the start estimate averages over.
+const RECENT_RUNS: usize = 50;
+
+// The node running this queue, when several share the store.
+const DEFAULT_NODE: &str = "comphub";
+
+fn unfinished_prefix(node: &str) -> String {
+    format!("unfinished:{}:", node)
+}
+
+fn rerun_key(id: &str) -> String {
+    format!("rerun:{}", id)
+}
+
+pub struct JobQueue {
+    entries: Mutex<HashMap<String, JobEntry>>,
+    pending: Mutex<PriorityScheduler<String>>,
+    notify: Notify,
+    scheduled: Mutex<Timetable<String>>,
+    rescheduled: Notify,
+    node: String,
+    // How long the most recently finished jobs ran, newest last.
+    recent_runs: Mutex<VecDeque<Duration>>,
+    retention: Duration,
+    store: &'static Store,
+}
+
+static JOB_QUEUE: OnceCell<JobQueue> = OnceCell::const_new();
+
+async fn init_job_queue() -> JobQueue {
+    let app_config = config().await;
+    JobQueue::new(app_config.job_retention(), store().await).on_node(app_config.node_name())
+}
+
+pub async fn job_queue() -> &'static JobQueue {
+    JOB_QUEUE.get_or_init(init_job_queue).await
+}
+
+pub async fn start_workers() {
+    let queue = job_queue().await;
+    let app_config = config().await;
+    queue.restore(app_config.toolchain_versions());
+    tokio::spawn(queue.release_scheduled());
+    if app_config.job_dispatch() == JobDispatch::Remote {
+        tokio::spawn(reassign_from_dead_workers(queue, worker_registry().await));
+        tracing::info!("dispatching jobs to remote workers");
+        return;
+    }
+    let workers = app_config.job_workers();
+    for _ in 0..workers {
+        tokio::spawn(queue.work());
+    }
+    tracing::info!("started {} job workers", workers);
+}
+
+impl JobQueue {
+    pub(super) fn new(retention: Duration, store: &'static Store) -> Self {
+        JobQueue {
+            entries: Mutex::new(HashMap::new()),
+            pending: Mutex::new(PriorityScheduler::new()),
+            notify: Notify::new(),
+            scheduled: Mutex::new(Timetable::new()),
+            rescheduled: Notify::new(),
+            node: DEFAULT_NODE.to_string(),
+            recent_runs: Mutex::new(VecDeque::with_capacity(RECENT_RUNS)),
+            retention,
+            store,
+        }
+    }
+
+    pub(super) fn on_node(mut self, node: &str) -> Self {
+        self.node = node.to_string();
+        self
+    }
+
+    fn unfinished_key(&self, id: &str) -> String {
+        format!("{}{}", unfinished_prefix(&self.node), id)
+    }
+
+    // `tenant` is the caller's `queue_tenant`, never the API key itself, since
+    // it is kept in the store with the job.
+    pub fn submit(&self, tenant: &str, spec: JobSpec) -> Job {
+        self.enqueue(Uuid::new_v4().to_string(), tenant, spec)
+    }
+
+    // Submits at most one job per (tenant, key) pair while the key is
+    // retained; repeated submissions return the original job.
+    pub fn submit_once(&self, key: &str, tenant: &str, spec: JobSpec) -> Job {
+        let id = Uuid::new_v4().to_string();
+        let store_key = format!("idempotency:{}:{}", tenant, key);
+        match self
+            .store
+            .put_if_absent(&store_key, &id, Some(self.retention))
+        {
+            Ok(Some(existing)) => {
+                if let Some(job) = self.get(&existing) {
+                    return job;
+                }
+                let _ = self.store.put(&store_key, &id, Some(self.retention));
+            }
+            Ok(None) => {}
+            Err(err) => tracing::warn!("failed to record idempotency key: {}", err),
+        }
+        self.enqueue(id, tenant, spec)
+    }
+
+    fn enqueue(&self, id: String, tenant: &str, mut spec: JobSpec) -> Job {
+        if spec.traceparent.is_none() {
+            spec.traceparent = traceparent();
+        }
+        let created_at = Utc::now();
+        let scheduled_for = spec.run_at.filter(|at| *at > created_at);
+        let job = Job {
+            id,
+            lang: spec.lang.clone(),
+            status: match scheduled_for {
+                Some(_) => JobStatus::Scheduled,
+                None => JobStatus::Queued,
+            },
+            result: None,
+            error: None,
+            created_at,
+            started_at: None,
+            finished_at: None,
+            version: spec.version.map(|version| version.name.clone()),
+            scheduled_for,
+            priority: spec.priority,
+            queue_position: None,
+            estimated_start: None,
+            rerun_of: spec.rerun_of.clone(),
+            group: spec.group.clone(),
+            verdict: None,
+            traceparent: spec.traceparent.clone(),
+        };
+        let id = job.id.clone();
+        let priority = spec.priority;
+        self.insert(job.clone(), tenant, spec);
+        self.save(&id);
+        if let Some(at) = scheduled_for {
+            self.scheduled.lock().unwrap().insert(at, id);
+            self.rescheduled.notify_one();
+            return job;
+        }
+
+        self.pending.lock().unwrap().push(priority, tenant, id);
+        self.notify.notify_one();
+        self.estimate_start(job)
+    }
+
+    fn insert(&self, job: Job, tenant: &str, spec: JobSpec) {
+        let (events, _) = broadcast::channel(1024);
+        let mut entries = self.entries.lock().unwrap();
+        self.prune(&mut entries);
+        entries.insert(
+            job.id.clone(),
+            JobEntry {
+                job,
+                tenant: tenant.to_string(),
+                spec,
+                compile_log: Vec::new(),
+                output: Vec::new(),
+                events,
+            },
+        );
+    }
+
+    // Records the current state of an unfinished job in the store.
+    fn save(&self, id: &str) {
+        let unfinished = self.update(id, |entry| UnfinishedJob {
+            job: entry.job.clone(),
+            tenant: entry.tenant.clone(),
+            assignment: Assignment::new(id, entry.spec.clone()),
+        });
+        let Some(unfinished) = unfinished else {
+            return;
+        };
+        if let Err(err) = self.store.put(&self.unfinished_key(id), &unfinished, None) {
+            tracing::warn!("failed to persist job {}: {}", id, err);
+        }
+    }
+
+    fn forget(&self, id: &str) {
+        if let Err(err) = self.store.remove(&self.unfinished_key(id)) {
+            tracing::warn!("failed to remove finished job {}: {}", id, err);
+        }
+    }
+
+    // Keeps a finished job in the store for as long as jobs are retained,
+    // along with what it ran.
+    fn keep(&self, job: &Job, tenant: &str, assignment: Assignment) {
+        let key = format!("job:{}", job.id);
+        if let Err(err) = self.store.put(&key, job, Some(self.retention)) {
+            tracing::warn!("failed to persist job {}: {}", job.id, err);
+        }
+        let spec = FinishedSpec {
+            tenant: tenant.to_string(),
+            assignment,
+        };
+        if let Err(err) = self
+            .store
+            .put(&rerun_key(&job.id), &spec, Some(self.retention))
+        {
+            tracing::warn!("failed to persist what job {} ran: {}", job.id, err);
+        }
+    }
+
+    // Queues the code, input, flags and limits `original` ran with again, as
+    // a new job of `tenant`'s that links back to it. Returns None once the
+    // original is no longer retained, or if it is another tenant's, and an
+    // error if it ran a toolchain version no longer installed.
+    pub fn rerun(
+        &self,
+        original: &Job,
+        tenant: &str,
+        submitter: Submitter,
+        versions: &'static ToolchainVersions,
+    ) -> Result<Option<Job>, InfraError> {
+        let Some(kept) = self.store.get::<FinishedSpec>(&rerun_key(&original.id)) else {
+            return Ok(None);
+        };
+        if kept.tenant != tenant {
+            return Ok(None);
+        }
+        let spec = JobSpec {
+            submitter,
+            priority: original.priority,
+            rerun_of: Some(original.id.clone()),
+            group: None,
+            traceparent: None,
+            ..kept.assignment.into_spec(versions)?
+        };
+        Ok(Some(self.submit(tenant, spec)))
+    }
+
+    // Picks up the jobs a previous run of the server left unfinished, oldest
+    // first. Scheduled and queued jobs wait as they did; a job that was
+    // running is reported as interrupted rather than run a second time.
+    // Toolchain versions are resolved again by name, and a job whose version
+    // is no longer installed fails.
+    fn restore(&self, versions: &'static ToolchainVersions) {
+        let keys = self.store.keys(&unfinished_prefix(&self.node));
+        let mut saved: Vec<UnfinishedJob> = keys
+            .iter()
+            .filter_map(|key| {
+                let saved = self.store.get(key);
+                if saved.is_none() {
+                    tracing::warn!("unfinished job {} could not be read from the store", key);
+                }
+                saved
+            })
+            .collect();
+        saved.sort_by_key(|saved| saved.job.created_at);
+
+        let mut restored = 0;
+        let mut interrupted = 0;
+        let mut failed = 0;
+        for UnfinishedJob {
+            mut job,
+            tenant,
+            assignment,
+        } in saved
+        {
+            let id = job.id.clone();
+            let spec = match job.status {
+                JobStatus::Scheduled | JobStatus::Queued => assignment
+                    .clone()
+                    .into_spec(versions)
+                    .map_err(|err| (JobStatus::Failed, err.to_string())),
+                _ => Err((
+                    JobStatus::Interrupted,
+                    String::from("the server restarted while the job was running"),
+                )),
+            };
+            let mut spec = match spec {
+                Ok(spec) => spec,
+                Err((status, error)) => {
+                    if status == JobStatus::Interrupted {
+                        interrupted += 1;
+                    } else {
+                        failed += 1;
+                    }
+                    job.status = status;
+                    job.error = Some(error);
+                    job.finished_at = Some(Utc::now());
+                    self.keep(&job, &tenant, assignment);
+                    if let Err(err) = self.store.remove(&self.unfinished_key(&id)) {
+                        tracing::warn!("failed to remove unfinished job {}: {}", id, err);
+                    }
+                    continue;
+                }
+            };
+            if job.status == JobStatus::Scheduled {
+                let at = job.scheduled_for.unwrap_or(job.created_at);
+                self.scheduled.lock().unwrap().insert(at, id.clone());
+            } else {
+                self.pending
+                    .lock()
+                    .unwrap()
+                    .push(job.priority, &tenant, id.clone());
+            }
+            spec.run_at = job.scheduled_for;
+            spec.priority = job.priority;
+            self.insert(job, &tenant, spec);
+            restored += 1;
+        }
+        if restored > 0 || interrupted > 0 || failed > 0 {
+            tracing::info!(
+                "restored {} unfinished jobs, {} interrupted by the restart, {} on versions no \
+                 longer installed",
+                restored,
+                interrupted,
+                failed
+            );
+        }
+    }
+
+    // Queues scheduled jobs as they fall due, returning when the next one
+    // does.
+    fn release_due(&self, now: DateTime<Utc>) -> Option<DateTime<Utc>> {
+        let mut timetable = self.scheduled.lock().unwrap();
+        for id in timetable.take_due(now) {
+            let queued = self.update(&id, |entry| {
+                entry.job.status = JobStatus::Queued;
+                (entry.spec.priority, entry.tenant.clone())
+            });
+            let Some((priority, tenant)) = queued else {
+                continue;
+            };
+            self.save(&id);
+            self.pending.lock().unwrap().push(priority, &tenant, id);
+            self.notify.notify_one();
+        }
+        timetable.next_due()
+    }
+
+    async fn release_scheduled(&'static self) {
+        loop {
+            let Some(next) = self.release_due(Utc::now()) else {
+                self.rescheduled.notified().await;
+                continue;
+            };
+            let wait = (next - Utc::now()).to_std().unwrap_or_default();
+            tokio::select! {
+                _ = tokio::time::sleep(wait) => {}
+                _ = self.rescheduled.notified() => {}
+            }
+        }
+    }
+
+    // Jobs queued and not yet claimed by a worker.
+    pub fn waiting(&self) -> usize {
+        self.pending.lock().unwrap().len()
+    }
+
+    pub fn get(&self, id: &str) -> Option<Job> {
+        let entries = self.entries.lock().unwrap();
+        let job = entries.get(id).map(|entry| entry.job.clone());
+        drop(entries);
+        match job {
+            Some(job) => Some(self.estimate_start(job)),
+            None => self.store.get(&format!("job:{}", id)),
+        }
+    }
+
+    // Fills in where a queued job stands. Jobs only wait while every worker
+    // is busy, so the number running is taken as how many run at once; the
+    // start is then estimated as if they finish at the recent average pace.
+    fn estimate_start(&self, mut job: Job) -> Job {
+        if job.status != JobStatus::Queued {
+            return job;
+        }
+        let Some(position) = self.pending.lock().unwrap().position(&job.id) else {
+            return job;
+        };
+        job.queue_position = Some(position);
+        let Some(wait) = self.wait_at(position) else {
+            return job;
+        };
+        job.estimated_start = chrono::Duration::from_std(wait)
+            .ok()
+            .and_then(|wait| Utc::now().checked_add_signed(wait));
+        job
+    }
+
+    // How long the job at `position` in the queue should wait for a worker,
+    // unknown until a job has finished.
+    fn wait_at(&self, position: usize) -> Option<Duration> {
+        let recent_runs = self.recent_runs.lock().unwrap();
+        if recent_runs.is_empty() {
+            return None;
+        }
+        let average = recent_runs.iter().sum::<Duration>() / recent_runs.len() as u32;
+        drop(recent_runs);
+        let running = self
+            .entries
+            .lock()
+            .unwrap()
+            .values()
+            .filter(|entry| entry.job.status == JobStatus::Running)
+            .count()
+            .max(1);
+        Some(average.mul_f64((position + 1) as f64 / running as f64))
+    }
+
+    // How long a job submitted now should wait for a worker.
+    pub fn expected_wait(&self) -> Option<Duration> {
+        self.wait_at(self.waiting())
+    }
+
+    pub fn subscribe(&self, id: &str) -> Option<Subscription> {
+        let entries = self.entries.lock().unwrap();
+        let entry = entries.get(id)?;
+        Some(Subscription {
+            compile_history: entry.compile_log.clone(),
+            history: entry.output.clone(),
+            finished: entry.job.status.is_finished().then(|| entry.job.clone()),
+            events: entry.events.subscribe(),
+        })
+    }
+
+    fn prune(&self, entries: &mut HashMap<String, JobEntry>) {
+        let Ok(retention) = chrono::Duration::from_std(self.retention) else {
+            return;
+        };
+        let cutoff = Utc::now() - retention;
+        entries.retain(|_, entry| entry.job.finished_at.is_none_or(|at| at > cutoff));
+    }
+
+    async fn next(&self) -> String {
+        loop {
+            if let Some(id) = self.pending.lock().unwrap().pop() {
+                return id;
+            }
+            self.notify.notified().await;
+        }
+    }
+
+    async fn work(&'static self) {
+        loop {
+            let id = self.next().await;
+            self.run(&id).await;
+        }
+    }
+
+    // Marks a queued job as running and returns what to run.
+    fn start(&self, id: &str) -> Option<JobSpec> {
+        let spec = self.update(id, |entry| {
+            entry.job.status = JobStatus::Running;
+            entry.job.started_at = Some(Utc::now());
+            entry.spec.clone()
+        })?;
+        self.save(id);
+        Some(spec)
+    }
+
+    // Hands the next queued job to a remote worker, if there is one.
+    pub fn claim(&self) -> Option<(String, JobSpec)> {
+        let id = self.pending.lock().unwrap().pop()?;
+        let spec = self.start(&id)?;
+        Some((id, spec))
+    }
+
+    // Queues a running job again after its worker was lost.
+    pub fn requeue(&self, id: &str) {
+        let queued = self.update(id, |entry| {
+            if entry.job.status != JobStatus::Running {
+                return None;
+            }
+            entry.job.status = JobStatus::Queued;
+            entry.job.started_at = None;
+            Some((entry.spec.priority, entry.tenant.clone()))
+        });
+        if let Some(Some((priority, tenant))) = queued {
+            tracing::info!("requeueing job {} from a lost worker", id);
+            self.save(id);
+            self.pending
+                .lock()
+                .unwrap()
+                .push(priority, &tenant, id.to_string());
+            self.notify.notify_one();
+        }
+    }
+
+    async fn run(&self, id: &str) {
+        let Some(spec) = self.start(id) else {
+            return;
+        };
+
+        let (tx, mut rx) = mpsc::unbounded_channel();
+        let (log_tx, mut log_rx) = mpsc::unbounded_channel();
+        let (usage_tx, mut usage_rx) = mpsc::unbounded_channel();
+        let ctx = spec
+            .context()
+            .with_output(tx)
+            .with_compile_log(log_tx)
+            .with_usage_stream(usage_tx);
+        let record = async {
+            while let Some(chunk) = rx.recv().await {
+                self.update(id, |entry| {
+                    entry.output.push(chunk.clone());
+                    let _ = entry.events.send(JobEvent::Output(chunk));
+                });
+            }
+        };
+        let record_log = async {
+            while let Some(chunk) = log_rx.recv().await {
+                self.update(id, |entry| {
+                    entry.compile_log.push(chunk.clone());
+                    let _ = entry.events.send(JobEvent::Compiler(chunk));
+                });
+            }
+        };
+        let execute = async {
+            let run = logged(
+                id,
+                &spec.lang,
+                &spec.content,
+                &spec.submitter,
+                compile_lang(&spec.lang, &spec.content, &spec.stdin, &ctx),
+            );
+            let result = traced(spec.traceparent.clone(), run).await;
+            drop(ctx);
+            result
+        };
+        let record_usage = async {
+            while let Some(sample) = usage_rx.recv().await {
+                self.update(id, |entry| {
+                    let _ = entry.events.send(JobEvent::Usage(sample));
+                });
+            }
+        };
+        let (result, _, _, _) = tokio::join!(execute, record, record_log, record_usage);
+        let verdict = spec.judged(&result);
+        self.complete(id, result.map_err(|err| err.to_string()), verdict);
+    }
+
+    // Records the outcome of a running job. Returns false if the job is not
+    // running, for example because it was already handed to another worker.
+    pub fn finish(&self, id: &str, result: Result<String, String>) -> bool {
+        self.complete(id, result, None)
+    }
+
+    // As finish, along with the verdict of a judged job, which whoever ran
+    // it works out.
+    pub fn complete(
+        &self,
+        id: &str,
+        result: Result<String, String>,
+        verdict: Option<Verdict>,
+    ) -> bool {
+        let finished = self.update(id, |entry| {
+            if entry.job.status != JobStatus::Running {
+                return None;
+            }
+            entry.job.verdict = verdict;
+            match result {
+                Ok(output) => {
+                    entry.job.status = JobStatus::Completed;
+                    entry.job.result = Some(output);
+                }
+                Err(err) => {
+                    entry.job.status = JobStatus::Failed;
+                    entry.job.error = Some(err);
+                }
+            }
+            entry.job.finished_at = Some(Utc::now());
+            let spec = std::mem::take(&mut entry.spec);
+            let _ = entry.events.send(JobEvent::Finished(entry.job.clone()));
+            Some((entry.job.clone(), entry.tenant.clone(), spec))
+        });
+
+        let Some(Some((job, tenant, spec))) = finished else {
+            return false;
+        };
+        if let Some(ran) = job
+            .started_at
+            .zip(job.finished_at)
+            .and_then(|(started, finished)| (finished - started).to_std().ok())
+        {
+            let mut recent_runs = self.recent_runs.lock().unwrap();
+            if recent_runs.len() == RECENT_RUNS {
+                recent_runs.pop_front();
+            }
+            recent_runs.push_back(ran);
+        }
+        self.keep(&job, &tenant, Assignment::new(id, spec));
+        self.forget(id);
+        true
+    }
+
+    fn update<T>(&self, id: &str, f: impl FnOnce(&mut JobEntry) -> T) -> Option<T> {
+        let mut entries = self.entries.lock().unwrap();
+        entries.get_mut(id).map(f)
+    }
+}
+
+#[cfg(test)]
+mod jobs_tests {
+    use super::*;
+
+    fn spec(content: &str) -> JobSpec {
+        JobSpec {
+            lang: "python".into(),
+            content: content.into(),
+            ..Default::default()
+        }
+    }
+
+    fn queue() -> &'static JobQueue {
+        let store = Box::leak(Box::new(Store::memory()));
+        Box::leak(Box::new(JobQueue::new(Duration::from_secs(3600), store)))
+    }
+
+    #[tokio::test]
+    async fn test_submit_queues_job() {
+        let queue = queue();
+        let job = queue.submit("tenant", spec("print(1)"));
+        assert_eq!(job.status, JobStatus::Queued);
+        assert_eq!(queue.get(&job.id).unwrap().status, JobStatus::Queued);
+        assert!(queue.get("missing").is_none());
+    }
+
+    #[tokio::test]
+    async fn test_worker_completes_job_and_records_output() {
+        let queue = queue();
+        let job = queue.submit("tenant", spec("print('hello')"));
+        let mut subscription = queue.subscribe(&job.id).unwrap();
+        tokio::spawn(queue.work());
+
+        let finished = loop {
+            match subscription.events.recv().await.unwrap() {
+                JobEvent::Finished(job) => break job,
+                JobEvent::Compiler(_) | JobEvent::Output(_) | JobEvent::Usage(_) => {}
+            }
+        };
+
+        assert_eq!(finished.status, JobStatus::Completed);
+        assert_eq!(finished.result.as_deref(), Some("hello\n"));
+        let replay = queue.subscribe(&job.id).unwrap();
+        let stdout: String = replay
+            .history
+            .iter()
+            .map(|chunk| match chunk {
+                OutputChunk::Stdout(data) => data.as_str(),
+                OutputChunk::Stderr(_) => "",
+            })
+            .collect();
+        assert_eq!(stdout, "hello\n");
+        assert!(replay.finished.is_some());
+    }
+
+    #[tokio::test]
+    async fn test_compiler_output_is_kept_apart_from_the_program_output() {
+        let queue = queue();
+        let job = queue.submit(
+            "tenant",
+            JobSpec {
+                lang: "rust".into(),
+                content: "fn main() { let unused = 1; println!(\"hi\"); }".into(),
+                ..Default::default()
+            },
+        );
+        let id = queue.pending.lock().unwrap().pop().unwrap();
+        queue.run(&id).await;
+
+        let replay = queue.subscribe(&job.id).unwrap();
+        let log: String = replay
+            .compile_history
+            .iter()
+            .map(OutputChunk::text)
+            .collect();
+        assert!(log.contains("unused variable"), "{}", log);
+        let output: String = replay.history.iter().map(OutputChunk::text).collect();
+        assert_eq!(output, "hi\n");
+    }
+
+    #[tokio::test]
+    async fn test_failed_job_reports_error() {
+        let queue = queue();
+        let job = queue.submit("tenant", spec("raise SystemExit(3)"));
+        let mut subscription = queue.subscribe(&job.id).unwrap();
+        tokio::spawn(queue.work());
+
+        let finished = loop {
+            if let JobEvent::Finished(job) = subscription.events.recv().await.unwrap() {
+                break job;
+            }
+        };
+        assert_eq!(finished.status, JobStatus::Failed);
+        assert!(finished.error.unwrap().contains("status code: 3"));
+    }
+
+    #[tokio::test]
+    async fn test_finished_job_outlives_pruning_via_store() {
+        let store = Box::leak(Box::new(Store::memory()));
+        let queue = JobQueue::new(Duration::from_secs(3600), store);
+        let job = queue.submit("tenant", spec("print(1)"));
+        let id = queue.pending.lock().unwrap().pop().unwrap();
+        queue.run(&id).await;
+        queue.entries.lock().unwrap().clear();
+
+        assert_eq!(queue.get(&job.id).unwrap().status, JobStatus::Completed);
+    }
+
+    #[test]
+    fn test_claimed_job_can_be_requeued_and_finished_once() {
+        let queue = queue();
+        let job = queue.submit("tenant", spec("print(1)"));
+        let (id, claimed) = queue.claim().unwrap();
+        assert_eq!(id, job.id);
+        assert_eq!(claimed.content, "print(1)");
+        assert!(queue.claim().is_none());
+
+        queue.requeue(&id);
+        assert_eq!(queue.get(&id).unwrap().status, JobStatus::Queued);
+        let (id, _) = queue.claim().unwrap();
+        assert_eq!(queue.get(&id).unwrap().status, JobStatus::Running);
+
+        assert!(queue.finish(&id, Ok("1\n".into())));
+        assert!(!queue.finish(&id, Err("late".into())));
+        let finished = queue.get(&id).unwrap();
+        assert_eq!(finished.status, JobStatus::Completed);
+        assert_eq!(finished.result.as_deref(), Some("1\n"));
+    }
+
+    #[test]
+    fn test_submit_once_deduplicates_by_key() {
+        let queue = queue();
+        let first = queue.submit_once("key", "tenant", spec("print(1)"));
+        let second = queue.submit_once("key", "tenant", spec("print(1)"));
+        let other = queue.submit_once("key", "someone-else", spec("print(1)"));
+
+        assert_eq!(first.id, second.id);
+        assert_ne!(first.id, other.id);
+    }
+
+    #[test]
+    fn test_live_jobs_are_claimed_before_a_queued_regrade() {
+        let queue = queue();
+        let regrade: Vec<_> = (0..3)
+            .map(|i| {
+                let spec = JobSpec {
+                    priority: Priority::Low,
+                    ..spec(&format!("print({})", i))
+                };
+                queue.submit("grader", spec).id
+            })
+            .collect();
+        let live = queue.submit("student", spec("print('live')"));
+        assert_eq!(live.priority, Priority::Normal);
+
+        let (id, _) = queue.claim().unwrap();
+        assert_eq!(id, live.id);
+        let rest: Vec<_> = std::iter::from_fn(|| queue.claim().map(|(id, _)| id)).collect();
+        assert_eq!(rest, regrade);
+
+        queue.requeue(&regrade[1]);
+        queue.submit("student", spec("print('again')"));
+        let (id, claimed) = queue.claim().unwrap();
+        assert_eq!(claimed.content, "print('again')");
+        assert_eq!(queue.claim().unwrap().0, regrade[1]);
+        assert_ne!(id, regrade[1]);
+    }
+
+    #[test]
+    fn test_queued_job_reports_position_and_estimated_start() {
+        let queue = queue();
+        let ids: Vec<_> = (0..3)
+            .map(|i| queue.submit("tenant", spec(&format!("print({})", i))).id)
+            .collect();
+        let positions: Vec<_> = ids
+            .iter()
+            .map(|id| queue.get(id).unwrap().queue_position)
+            .collect();
+        assert_eq!(positions, [Some(0), Some(1), Some(2)]);
+        assert!(queue.get(&ids[2]).unwrap().estimated_start.is_none());
+        assert_eq!(queue.expected_wait(), None);
+
+        let (id, _) = queue.claim().unwrap();
+        queue.update(&id, |entry| {
+            entry.job.started_at = Some(Utc::now() - chrono::Duration::seconds(10));
+        });
+        queue.finish(&id, Ok(String::new()));
+        let finished = queue.get(&id).unwrap();
+        assert_eq!(finished.queue_position, None);
+        assert_eq!(finished.estimated_start, None);
+
+        let last = queue.get(&ids[2]).unwrap();
+        assert_eq!(last.queue_position, Some(1));
+        let wait = last.estimated_start.unwrap() - Utc::now();
+        assert!((19..=20).contains(&wait.num_seconds()), "{}", wait);
+        let wait = queue.expected_wait().unwrap();
+        assert!((30..=31).contains(&wait.as_secs()), "{:?}", wait);
+    }
+
+    #[test]
+    fn test_scheduled_job_is_queued_once_due() {
+        let queue = queue();
+        let at = Utc::now() + chrono::Duration::seconds(60);
+        let job = queue.submit(
+            "tenant",
+            JobSpec {
+                run_at: Some(at),
+                ..spec("print(1)")
+            },
+        );
+        assert_eq!(job.status, JobStatus::Scheduled);
+        assert_eq!(job.scheduled_for, Some(at));
+        assert!(queue.claim().is_none());
+
+        assert_eq!(queue.release_due(Utc::now()), Some(at));
+        assert!(queue.claim().is_none());
+        assert_eq!(queue.release_due(at), None);
+        assert_eq!(queue.get(&job.id).unwrap().status, JobStatus::Queued);
+        let (id, claimed) = queue.claim().unwrap();
+        assert_eq!(id, job.id);
+        assert_eq!(claimed.content, "print(1)");
+    }
+
+    #[test]
+    fn test_past_run_at_queues_at_once() {
+        let queue = queue();
+        let job = queue.submit(
+            "tenant",
+            JobSpec {
+                run_at: Some(Utc::now() - chrono::Duration::seconds(5)),
+                ..spec("print(1)")
+            },
+        );
+        assert_eq!(job.status, JobStatus::Queued);
+        assert_eq!(job.scheduled_for, None);
+        assert!(queue.claim().is_some());
+    }
+
+    #[tokio::test]
+    async fn test_job_keeps_the_trace_it_was_submitted_in() {
+        let queue = queue();
+        let traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01";
+        let job = traced(Some(traceparent.into()), async {
+            queue.submit("tenant", spec("print(1)"))
+        })
+        .await;
+        assert_eq!(job.traceparent.as_deref(), Some(traceparent));
+        let (_, claimed) = queue.claim().unwrap();
+        assert_eq!(claimed.traceparent.as_deref(), Some(traceparent));
+
+        assert_eq!(queue.submit("tenant", spec("print(2)")).traceparent, None);
+    }
+
+    #[test]
+    fn test_rerun_queues_what_the_original_ran() {
+        let queue = queue();
+        let original = queue.submit(
+            "tenant",
+            JobSpec {
+                stdin: "input".into(),
+                compiler_flags: vec!["-O2".into()],
+                priority: Priority::Low,
+                ..spec("print(input())")
+            },
+        );
+        let (id, _) = queue.claim().unwrap();
+        assert!(
+            queue
+                .rerun(&original, "tenant", Submitter::default(), versions())
+                .unwrap()
+                .is_none()
+        );
+        assert!(queue.finish(&id, Ok("input\n".into())));
+        let original = queue.get(&id).unwrap();
+
+        assert!(
+            queue
+                .rerun(&original, "other", Submitter::default(), versions())
+                .unwrap()
+                .is_none()
+        );
+        let rerun = queue
+            .rerun(&original, "tenant", Submitter::default(), versions())
+            .unwrap()
+            .unwrap();
+        assert_ne!(rerun.id, original.id);
+        assert_eq!(rerun.rerun_of.as_deref(), Some(original.id.as_str()));
+        assert_eq!(rerun.priority, Priority::Low);
+        let (id, claimed) = queue.claim().unwrap();
+        assert_eq!(id, rerun.id);
+        assert_eq!(
+            (claimed.content.as_str(), claimed.stdin.as_str()),
+            ("print(input())", "input")
+        );
+        assert_eq!(claimed.compiler_flags, ["-O2"]);
+    }
+
+    fn versions() -> &'static ToolchainVersions {
+        Box::leak(Box::default())
+    }
+
+    fn restart(store: &'static Store) -> &'static JobQueue {
+        let queue: &'static JobQueue =
+            Box::leak(Box::new(JobQueue::new(Duration::from_secs(3600), store)));
+        queue.restore(versions());
+        queue
+    }
+
+    #[test]
+    fn test_schedule_survives_a_restart() {
+        let store: &'static Store = Box::leak(Box::new(Store::memory()));
+        let at = Utc::now() + chrono::Duration::seconds(60);
+        let job = JobQueue::new(Duration::from_secs(3600), store).submit(
+            "tenant",
+            JobSpec {
+                run_at: Some(at),
+                ..spec("print(2)")
+            },
+        );
+
+        let restarted = restart(store);
+        assert_eq!(restarted.get(&job.id).unwrap().status, JobStatus::Scheduled);
+        assert_eq!(restarted.release_due(at), None);
+        let (id, claimed) = restarted.claim().unwrap();
+        assert_eq!(
+            (id.as_str(), claimed.content.as_str()),
+            (job.id.as_str(), "print(2)")
+        );
+        assert!(restarted.finish(&id, Ok("2\n".into())));
+        assert!(
+            store
+                .get::<UnfinishedJob>(&restarted.unfinished_key(&job.id))
+                .is_none()
+        );
+        assert!(store.keys(&unfinished_prefix(DEFAULT_NODE)).is_empty());
+    }
+
+    #[test]
+    fn test_restart_restores_only_its_own_nodes_jobs() {
+        let store: &'static Store = Box::leak(Box::new(Store::memory()));
+        let retention = Duration::from_secs(3600);
+        let first = JobQueue::new(retention, store).on_node("a");
+        let mine = first.submit("tenant", spec("print(1)"));
+        let second = JobQueue::new(retention, store).on_node("b");
+        let theirs = second.submit("tenant", spec("print(2)"));
+
+        let restarted: &'static JobQueue =
+            Box::leak(Box::new(JobQueue::new(retention, store).on_node("a")));
+        restarted.restore(versions());
+        assert_eq!(restarted.get(&mine.id).unwrap().status, JobStatus::Queued);
+        assert!(restarted.get(&theirs.id).is_none());
+        assert_eq!(store.keys(&unfinished_prefix("b")).len(), 1);
+    }
+
+    #[test]
+    fn test_restart_requeues_waiting_jobs_and_interrupts_running_ones() {
+        let store: &'static Store = Box::leak(Box::new(Store::memory()));
+        let queue = JobQueue::new(Duration::from_secs(3600), store);
+        let running = queue.submit("a", spec("print(1)"));
+        let low = queue.submit(
+            "b",
+            JobSpec {
+                priority: Priority::Low,
+                ..spec("print(2)")
+            },
+        );
+        let queued = queue.submit("b", spec("print(3)"));
+        let done = queue.submit("a", spec("print(4)"));
+        assert_eq!(queue.claim().unwrap().0, running.id);
+        assert_eq!(queue.claim().unwrap().0, queued.id);
+        assert!(queue.finish(&queued.id, Ok("3\n".into())));
+        assert_eq!(queue.claim().unwrap().0, done.id);
+        assert!(queue.finish(&done.id, Ok("4\n".into())));
+        queue.requeue(&running.id);
+        assert_eq!(queue.claim().unwrap().0, running.id);
+
+        let restarted = restart(store);
+        let interrupted = restarted.get(&running.id).unwrap();
+        assert_eq!(interrupted.status, JobStatus::Interrupted);
+        assert!(interrupted.finished_at.is_some());
+        assert_eq!(
+            restarted.get(&done.id).unwrap().status,
+            JobStatus::Completed
+        );
+        let waiting = restarted.get(&low.id).unwrap();
+        assert_eq!(waiting.status, JobStatus::Queued);
+        assert_eq!(waiting.queue_position, Some(0));
+        let (id, claimed) = restarted.claim().unwrap();
+        assert_eq!((id, claimed.priority), (low.id.clone(), Priority::Low));
+        assert!(restarted.claim().is_none());
+        assert_eq!(
+            store.keys(&unfinished_prefix(DEFAULT_NODE)),
+            vec![restarted.unfinished_key(&low.id)]
+        );
+
+        // The claimed job is running now, so a second restart interrupts it.
+        let again = restart(store);
+        assert_eq!(again.get(&low.id).unwrap().status, JobStatus::Interrupted);
+        assert!(store.keys(&unfinished_prefix(DEFAULT_NODE)).is_empty());
+    }
+
+    #[test]
+    fn test_prune_drops_expired_jobs() {
+        let queue = JobQueue::new(Duration::ZERO, Box::leak(Box::new(Store::memory())));
+        let job = queue.submit("tenant", spec(""));
+        queue.update(&job.id, |entry| {
+            entry.job.status = JobStatus::Completed;
+            entry.job.finished_at = Some(Utc::now() - chrono::Duration::seconds(1));
+        });
+        queue.submit("tenant", spec(""));
+        assert!(queue.get(&job.id).is_none());
+    }
+}
@@ -0,0 +1,421 @@
+use std::time::{Duration, Instant};
+
+use futures_util::{StreamExt, stream};
+use serde::{Deserialize, Serialize};
+use tempfile::TempDir;
+use utoipa::ToSchema;
+use uuid::Uuid;
+
+use super::{
+    compare::Comparison,
+    compile::compile_lang,
+    disk::execution_zone,
+    error::InfraError,
+    events::Submitter,
+    executions::UsageMeter,
+    interactive::Verdict,
+    logs::{RunStatus, logged},
+    runner::ExecContext,
+    shared_build::SharedBuild,
+    verdicts::VerdictReporter,
+};
+
+// Environment that settles what commonly differs between hosts and runs:
+// the timezone, the locale and randomized hashing. `SEED` is a hint for
+// programs that seed their own generator.
+const DETERMINISTIC_ENV: &[(&str, &str)] = &[
+    ("TZ", "UTC"),
+    ("LANG", "C.UTF-8"),
+    ("LC_ALL", "C.UTF-8"),
+    ("PYTHONHASHSEED", "0"),
+    ("PERL_HASH_SEED", "0"),
+    ("PERL_PERTURB_KEYS", "0"),
+    ("SEED", "0"),
+];
+
+// How much longer than its CPU time limit a deterministic run may take by
+// the clock, so one that sleeps or blocks still ends.
+const WALL_TIME_FACTOR: u32 = 3;
+
+// Judging that gives a submission the same verdicts on any host, however
+// busy: programs run in a fixed environment, time limits are on CPU time
+// rather than wall time, and a test that still runs out of time is run
+// again before it is judged so.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Deterministic {
+    // Runs a test gets at most, counting the first.
+    pub attempts: usize,
+}
+
+#[derive(Debug, Clone, Default, Deserialize, ToSchema)]
+pub struct TestCase {
+    #[serde(default)]
+    #[schema(example = "3 4\n")]
+    pub stdin: String,
+    // What the program should print. Trailing whitespace on each line and
+    // trailing blank lines are ignored.
+    #[schema(example = "7\n")]
+    pub expected_output: Option<String>,
+    // Hashes of blobs uploaded to /api/v1/blobs to take the stdin or the
+    // expected output from, in place of giving them here.
+    #[schema(example = "d287bb7f9d15abdc5b6e98536263815744b6ef21c8f3c839fc434ca70d8efe99")]
+    pub stdin_hash: Option<String>,
+    pub expected_output_hash: Option<String>,
+    // Limits for this test alone, no looser than the submission's own. The
+    // time limit is on the program's run, not on building it.
+    #[schema(example = 1000)]
+    pub time_limit_ms: Option<u64>,
+    #[schema(example = 268435456)]
+    pub memory_limit_bytes: Option<u64>,
+}
+
+#[derive(Debug, Clone, Serialize, ToSchema)]
+pub struct TestResult {
+    pub id: String,
+    pub verdict: Verdict,
+    pub status: RunStatus,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub output: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+    // Whether the test was accepted, for tests that gave an expected output.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub passed: Option<bool>,
+    // Wall time of the program alone, or its CPU time when judged
+    // deterministically, and the most resident memory it held. Absent for
+    // languages executed in-process.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub time_ms: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub memory_bytes: Option<u64>,
+    // Including the build, for the test that ran it.
+    pub duration_ms: u64,
+    // How many times the test ran, when it was run again for exceeding its
+    // time limit. The result is that of its best run.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub attempts: Option<usize>,
+}
+
+// A program that reached its memory limit is judged on that whether or not
+// it survived: memory limits are enforced on the data segment, so running
+// out usually shows as a failed allocation before resident memory reaches
+// the limit, and is then a runtime error.
+fn judge(
+    result: &Result<String, InfraError>,
+    expected: Option<&str>,
+    memory_bytes: Option<u64>,
+    memory_limit: Option<u64>,
+) -> Verdict {
+    let over_memory = memory_bytes
+        .zip(memory_limit)
+        .is_some_and(|(used, limit)| used >= limit);
+    match result {
+        Err(InfraError::Timeout(..)) => Verdict::TimeLimitExceeded,
+        _ if over_memory => Verdict::MemoryLimitExceeded,
+        Ok(output) => expected.map_or(Verdict::Accepted, |expected| {
+            Comparison::Lines.verdict(expected, output)
+        }),
+        Err(InfraError::CompileError(_)) => Verdict::CompileError,
+        Err(
+            InfraError::CompilationError(_)
+            | InfraError::BlockedSyscall(_)
+            | InfraError::DiskQuotaExceeded(_)
+            | InfraError::OutputLimitExceeded(_),
+        ) => Verdict::RuntimeError,
+        Err(_) => Verdict::JudgeError,
+    }
+}
+
+// The verdict of a run whose memory was not measured, such as a job's.
+pub fn grade(result: &Result<String, InfraError>, expected: Option<&str>) -> Verdict {
+    judge(result, expected, None, None)
+}
+
+async fn run_test(
+    lang: &str,
+    content: &str,
+    test: &TestCase,
+    ctx: &ExecContext,
+    submitter: &Submitter,
+    deterministic: Option<Deterministic>,
+) -> Result<TestResult, InfraError> {
+    let id = Uuid::new_v4().to_string();
+    let workspace = TempDir::new_in(execution_zone())?;
+    let meter = UsageMeter::default();
+    let mut ctx = ctx
+        .clone()
+        .with_workspace(workspace.path().to_path_buf())
+        .with_meter(meter.clone());
+    if let Some(limit) = test.time_limit_ms.map(Duration::from_millis) {
+        ctx = match deterministic {
+            Some(_) => ctx
+                .with_cpu_time_limit(limit)
+                .with_program_timeout(limit * WALL_TIME_FACTOR),
+            None => ctx.with_program_timeout(limit),
+        };
+    }
+    if let Some(bytes) = test.memory_limit_bytes {
+        ctx = ctx.with_memory_limit(bytes);
+    }
+    let started = Instant::now();
+    let run = compile_lang(lang, content, &test.stdin, &ctx);
+    let result = logged(&id, lang, content, submitter, run).await;
+    let duration_ms = started.elapsed().as_millis() as u64;
+
+    let status = RunStatus::of(&result);
+    let memory_bytes = meter.memory_bytes();
+    let verdict = judge(
+        &result,
+        test.expected_output.as_deref(),
+        memory_bytes,
+        ctx.memory_limit(),
+    );
+    let (output, error) = match result {
+        Ok(output) => (Some(output), None),
+        Err(err) => (None, Some(err.to_string())),
+    };
+    Ok(TestResult {
+        id,
+        verdict,
+        status,
+        output,
+        error,
+        passed: test
+            .expected_output
+            .as_ref()
+            .map(|_| verdict == Verdict::Accepted),
+        time_ms: match deterministic {
+            Some(_) => meter.cpu_ms(),
+            None => meter.time_ms(),
+        },
+        memory_bytes,
+        duration_ms,
+        attempts: None,
+    })
+}
+
+// Runs a test again while it exceeds its time limit, up to the attempts
+// allowed, so a run slowed by something besides the program is not held
+// against it. The first run within the limit is kept, or else the fastest.
+async fn run_judged(
+    lang: &str,
+    content: &str,
+    test: &TestCase,
+    ctx: &ExecContext,
+    submitter: &Submitter,
+    deterministic: Option<Deterministic>,
+) -> Result<TestResult, InfraError> {
+    let attempts = deterministic.map_or(1, |deterministic| deterministic.attempts);
+    let mut best = run_test(lang, content, test, ctx, submitter, deterministic).await?;
+    let mut runs = 1;
+    while runs < attempts && best.verdict == Verdict::TimeLimitExceeded {
+        let result = run_test(lang, content, test, ctx, submitter, deterministic).await?;
+        runs += 1;
+        if result.verdict != Verdict::TimeLimitExceeded || result.time_ms < best.time_ms {
+            best = result;
+        }
+    }
+    if runs > 1 {
+        best.attempts = Some(runs);
+    }
+    Ok(best)
+}
+
+// Runs the submission once per test case, up to `parallelism` at a time, and
+// returns the results in the order the tests were given. Each run gets a
+// working directory of its own; compiled languages build once and every run
+// starts from a copy of that executable. `reporter` hears of each result as
+// soon as it is in.
+pub async fn run_tests(
+    lang: &str,
+    content: &str,
+    tests: &[TestCase],
+    ctx: &ExecContext,
+    submitter: &Submitter,
+    parallelism: usize,
+    deterministic: Option<Deterministic>,
+    reporter: Option<&VerdictReporter>,
+) -> Result<Vec<TestResult>, InfraError> {
+    let mut ctx = ctx.clone().with_shared_build(SharedBuild::new()?);
+    if deterministic.is_some() {
+        let env = DETERMINISTIC_ENV
+            .iter()
+            .map(|(key, value)| (key.to_string(), value.to_string()));
+        ctx = ctx.with_envs(env);
+    }
+    let ctx = &ctx;
+    let runs: Vec<_> = tests
+        .iter()
+        .enumerate()
+        .map(|(index, test)| async move {
+            // Boxed, as a run's future is too large to nest in another on the
+            // stack.
+            let run = run_judged(lang, content, test, ctx, submitter, deterministic);
+            let result = Box::pin(run).await?;
+            if let Some(reporter) = reporter {
+                reporter.test(index, &result);
+            }
+            Ok(result)
+        })
+        .collect();
+    stream::iter(runs)
+        .buffered(parallelism.max(1))
+        .collect::<Vec<_>>()
+        .await
+        .into_iter()
+        .collect()
+}
+
+#[cfg(test)]
+mod judge_tests {
+    use super::*;
+
+    fn test(stdin: &str, expected_output: Option<&str>) -> TestCase {
+        TestCase {
+            stdin: stdin.to_string(),
+            expected_output: expected_output.map(str::to_string),
+            ..TestCase::default()
+        }
+    }
+
+    #[test]
+    fn test_judge_puts_limits_before_output() {
+        let timeout = Err(InfraError::timeout(Duration::from_secs(1)));
+        assert_eq!(
+            judge(&timeout, Some("7"), Some(1 << 30), Some(1 << 20)),
+            Verdict::TimeLimitExceeded
+        );
+        let ok = Ok(String::from("7\n"));
+        assert_eq!(
+            judge(&ok, Some("7"), Some(1 << 30), Some(1 << 20)),
+            Verdict::MemoryLimitExceeded
+        );
+        assert_eq!(
+            judge(&ok, Some("7"), Some(1 << 10), Some(1 << 20)),
+            Verdict::Accepted
+        );
+        assert_eq!(judge(&ok, None, None, None), Verdict::Accepted);
+        let rejected = Err(InfraError::CompileError(String::from("syntax error")));
+        assert_eq!(
+            judge(&rejected, Some("7"), None, None),
+            Verdict::CompileError
+        );
+    }
+
+    #[tokio::test]
+    async fn test_runs_tests_concurrently_in_order() {
+        // Each run sleeps for the given time, so sequential runs would take
+        // well over a second.
+        let program = "import time\nn = float(input())\ntime.sleep(n)\nprint(n)";
+        let tests: Vec<_> = ["0.4", "0.1", "0.3", "0.2"]
+            .into_iter()
+            .map(|n| test(n, Some(&format!("{}\n", n))))
+            .collect();
+        let started = Instant::now();
+        let results = run_tests(
+            "python",
+            program,
+            &tests,
+            &ExecContext::default(),
+            &Submitter::new(None, "127.0.0.1"),
+            4,
+            None,
+            None,
+        )
+        .await
+        .unwrap();
+        assert!(started.elapsed() < Duration::from_secs(1));
+        let outputs: Vec<_> = results
+            .iter()
+            .map(|result| result.output.as_deref().unwrap())
+            .collect();
+        assert_eq!(outputs, ["0.4\n", "0.1\n", "0.3\n", "0.2\n"]);
+        assert!(results.iter().all(|result| result.passed == Some(true)));
+    }
+
+    #[tokio::test]
+    async fn test_reports_failures_per_test() {
+        let program = "n = int(input())\nprint(10 // n)";
+        let tests = [test("2", Some("5")), test("3", Some("4")), test("0", None)];
+        let results = run_tests(
+            "python",
+            program,
+            &tests,
+            &ExecContext::default(),
+            &Submitter::new(None, "127.0.0.1"),
+            2,
+            None,
+            None,
+        )
+        .await
+        .unwrap();
+        assert_eq!(results[0].passed, Some(true));
+        assert_eq!(results[1].passed, Some(false));
+        assert_eq!(results[1].verdict, Verdict::WrongAnswer);
+        assert_eq!(results[2].status, RunStatus::Failed);
+        assert_eq!(results[2].verdict, Verdict::RuntimeError);
+        assert_eq!(results[2].passed, None);
+    }
+
+    #[tokio::test]
+    async fn test_limits_apply_to_their_own_test() {
+        let program = "import time\nn = float(input())\ntime.sleep(n)\nprint(n)";
+        let tests = [
+            TestCase {
+                time_limit_ms: Some(200),
+                ..test("1", Some("1.0"))
+            },
+            test("0.3", Some("0.3")),
+        ];
+        let results = run_tests(
+            "python",
+            program,
+            &tests,
+            &ExecContext::default(),
+            &Submitter::new(None, "127.0.0.1"),
+            2,
+            None,
+            None,
+        )
+        .await
+        .unwrap();
+        assert_eq!(results[0].verdict, Verdict::TimeLimitExceeded);
+        assert!(results[0].time_ms.unwrap() < 1000);
+        assert_eq!(results[1].verdict, Verdict::Accepted, "{:?}", results[1]);
+        assert!(results[1].time_ms.unwrap() >= 300);
+        assert!(results[1].memory_bytes.unwrap() > 0);
+    }
+
+    #[tokio::test]
+    async fn test_deterministic_runs_are_limited_on_cpu_time() {
+        let program = "import os, time\nif input() == 'spin':\n    while True: pass\n\
+                       time.sleep(0.6)\nprint(os.environ['TZ'], os.environ['SEED'])";
+        let tests = [
+            TestCase {
+                time_limit_ms: Some(500),
+                ..test("wait", Some("UTC 0"))
+            },
+            TestCase {
+                time_limit_ms: Some(500),
+                ..test("spin", None)
+            },
+        ];
+        let results = run_tests(
+            "python",
+            program,
+            &tests,
+            &ExecContext::default().with_envs([("TZ".into(), "Asia/Tokyo".into())]),
+            &Submitter::new(None, "127.0.0.1"),
+            2,
+            Some(Deterministic { attempts: 2 }),
+            None,
+        )
+        .await
+        .unwrap();
+        assert_eq!(results[0].verdict, Verdict::Accepted, "{:?}", results[0]);
+        assert!(results[0].time_ms.unwrap() < 500);
+        assert_eq!(results[0].attempts, None);
+        assert_eq!(results[1].verdict, Verdict::TimeLimitExceeded);
+        assert_eq!(results[1].attempts, Some(2));
+    }
+}
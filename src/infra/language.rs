@@ -0,0 +1,390 @@
+use std::{fmt, path::Path, str::FromStr};
+
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+
+use super::error::InfraError;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize, ToSchema)]
+#[serde(rename_all = "lowercase")]
+pub enum Language {
+    Python,
+    JAVASCRIPT,
+    TYPESCRIPT,
+    C,
+    CPP,
+    RUST,
+    NIX,
+    GO,
+    ZIG,
+    D,
+    SWIFT,
+    SCALA,
+    GROOVY,
+    DART,
+    RUBY,
+    LUA,
+    JULIA,
+    R,
+    PERL,
+    PHP,
+    CRYSTAL,
+    HASKELL,
+    FORTRAN,
+    OCAML,
+    ELIXIR,
+    BASH,
+    ASSEMBLY,
+    SQL,
+    BRAINFUCK,
+    WASM,
+    STARLARK,
+}
+
+impl Language {
+    pub const ALL: [Language; 31] = [
+        Language::Python,
+        Language::JAVASCRIPT,
+        Language::TYPESCRIPT,
+        Language::C,
+        Language::CPP,
+        Language::RUST,
+        Language::NIX,
+        Language::GO,
+        Language::ZIG,
+        Language::D,
+        Language::SWIFT,
+        Language::SCALA,
+        Language::GROOVY,
+        Language::DART,
+        Language::RUBY,
+        Language::LUA,
+        Language::JULIA,
+        Language::R,
+        Language::PERL,
+        Language::PHP,
+        Language::CRYSTAL,
+        Language::HASKELL,
+        Language::FORTRAN,
+        Language::OCAML,
+        Language::ELIXIR,
+        Language::BASH,
+        Language::ASSEMBLY,
+        Language::SQL,
+        Language::BRAINFUCK,
+        Language::WASM,
+        Language::STARLARK,
+    ];
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Language::Python => "python",
+            Language::JAVASCRIPT => "javascript",
+            Language::TYPESCRIPT => "typescript",
+            Language::C => "c",
+            Language::CPP => "cpp",
+            Language::RUST => "rust",
+            Language::NIX => "nix",
+            Language::GO => "go",
+            Language::ZIG => "zig",
+            Language::D => "d",
+            Language::SWIFT => "swift",
+            Language::SCALA => "scala",
+            Language::GROOVY => "groovy",
+            Language::DART => "dart",
+            Language::RUBY => "ruby",
+            Language::LUA => "lua",
+            Language::JULIA => "julia",
+            Language::R => "r",
+            Language::PERL => "perl",
+            Language::PHP => "php",
+            Language::CRYSTAL => "crystal",
+            Language::HASKELL => "haskell",
+            Language::FORTRAN => "fortran",
+            Language::OCAML => "ocaml",
+            Language::ELIXIR => "elixir",
+            Language::BASH => "bash",
+            Language::ASSEMBLY => "assembly",
+            Language::SQL => "sql",
+            Language::BRAINFUCK => "brainfuck",
+            Language::WASM => "wasm",
+            Language::STARLARK => "starlark",
+        }
+    }
+
+    pub fn is_compiled(&self) -> bool {
+        matches!(
+            self,
+            Language::C
+                | Language::CPP
+                | Language::RUST
+                | Language::GO
+                | Language::ZIG
+                | Language::D
+                | Language::SWIFT
+                | Language::SCALA
+                | Language::GROOVY
+                | Language::DART
+                | Language::CRYSTAL
+                | Language::HASKELL
+                | Language::FORTRAN
+                | Language::ASSEMBLY
+                | Language::BRAINFUCK
+        )
+    }
+
+    pub fn allowed_compiler_flags(&self) -> &'static [&'static str] {
+        match self {
+            Language::C => &[
+                "-O0", "-O1", "-O2", "-O3", "-Os", "-Wall", "-Wextra", "-std=c99", "-std=c11",
+                "-std=c17", "-lm",
+            ],
+            Language::CPP => &[
+                "-O0",
+                "-O1",
+                "-O2",
+                "-O3",
+                "-Os",
+                "-Wall",
+                "-Wextra",
+                "-std=c++11",
+                "-std=c++14",
+                "-std=c++17",
+                "-std=c++20",
+                "-std=c++23",
+            ],
+            Language::RUST => &[
+                "-O",
+                "--edition=2015",
+                "--edition=2018",
+                "--edition=2021",
+                "--edition=2024",
+                "-Copt-level=0",
+                "-Copt-level=1",
+                "-Copt-level=2",
+                "-Copt-level=3",
+            ],
+            Language::D => &["-O", "-release", "-inline", "-boundscheck=off"],
+            Language::SWIFT => &["-Onone", "-O", "-Osize"],
+            Language::HASKELL => &["-O0", "-O1", "-O2", "-Wall"],
+            Language::CRYSTAL => &["--release", "--no-debug"],
+            Language::FORTRAN => &[
+                "-O0",
+                "-O1",
+                "-O2",
+                "-O3",
+                "-Wall",
+                "-fcheck=all",
+                "-std=f95",
+                "-std=f2003",
+                "-std=f2008",
+                "-std=f2018",
+            ],
+            _ => &[],
+        }
+    }
+
+    pub fn module_path_env(&self) -> Option<&'static str> {
+        match self {
+            Language::Python => Some("PYTHONPATH"),
+            Language::JAVASCRIPT | Language::TYPESCRIPT => Some("NODE_PATH"),
+            Language::RUBY => Some("RUBYLIB"),
+            Language::PERL => Some("PERL5LIB"),
+            _ => None,
+        }
+    }
+
+    // Some toolchains derive module or class names from the file name, so
+    // sources are written under the name each language expects.
+    pub fn source_file_name(&self) -> &'static str {
+        match self {
+            Language::Python => "main.py",
+            Language::JAVASCRIPT => "main.js",
+            Language::TYPESCRIPT => "main.ts",
+            Language::C => "main.c",
+            Language::CPP => "main.cpp",
+            Language::RUST => "main.rs",
+            Language::NIX => "main.nix",
+            Language::GO => "main.go",
+            Language::ZIG => "main.zig",
+            Language::D => "main.d",
+            Language::SWIFT => "main.swift",
+            Language::SCALA => "Main.scala",
+            Language::GROOVY => "Main.groovy",
+            Language::DART => "main.dart",
+            Language::RUBY => "main.rb",
+            Language::LUA => "main.lua",
+            Language::JULIA => "main.jl",
+            Language::R => "main.R",
+            Language::PERL => "main.pl",
+            Language::PHP => "main.php",
+            Language::CRYSTAL => "main.cr",
+            Language::HASKELL => "Main.hs",
+            Language::FORTRAN => "main.f90",
+            Language::OCAML => "main.ml",
+            Language::ELIXIR => "main.exs",
+            Language::BASH => "main.sh",
+            Language::ASSEMBLY => "main.asm",
+            Language::SQL => "main.sql",
+            Language::BRAINFUCK => "main.bf",
+            Language::WASM => "main.wat",
+            Language::STARLARK => "main.star",
+        }
+    }
+
+    // The language a file is written in, judging by its extension: the one
+    // its source file is written under, or a common alternative.
+    pub fn from_extension(extension: &str) -> Option<Language> {
+        let alias = match extension.to_ascii_lowercase().as_str() {
+            "mjs" | "cjs" => Some(Language::JAVASCRIPT),
+            "cc" | "cxx" => Some(Language::CPP),
+            "f" | "f95" | "f03" | "f08" => Some(Language::FORTRAN),
+            "bzl" | "bazel" => Some(Language::STARLARK),
+            _ => None,
+        };
+        alias.or_else(|| {
+            Language::ALL.into_iter().find(|language| {
+                Path::new(language.source_file_name())
+                    .extension()
+                    .is_some_and(|ext| ext.eq_ignore_ascii_case(extension))
+            })
+        })
+    }
+
+    // The toolchain binary and arguments that print its version, for
+    // languages whose toolchain has a stable way to.
+    pub fn version_command(&self) -> Option<(&'static str, &'static [&'static str])> {
+        match self {
+            Language::Python => Some(("python3", &["--version"])),
+            Language::RUST => Some(("rustc", &["--version"])),
+            Language::GO => Some(("go", &["version"])),
+            Language::ZIG => Some(("zig", &["version"])),
+            Language::SWIFT => Some(("swiftc", &["--version"])),
+            Language::DART => Some(("dart", &["--version"])),
+            Language::RUBY => Some(("ruby", &["--version"])),
+            Language::LUA => Some(("lua", &["-v"])),
+            Language::PHP => Some(("php", &["--version"])),
+            Language::CRYSTAL => Some(("crystal", &["--version"])),
+            Language::HASKELL => Some(("ghc", &["--version"])),
+            Language::FORTRAN => Some(("gfortran", &["--version"])),
+            Language::OCAML => Some(("ocaml", &["-version"])),
+            Language::BASH => Some(("bash", &["--version"])),
+            Language::ASSEMBLY => Some(("nasm", &["-v"])),
+            Language::SQL => Some(("sqlite3", &["-version"])),
+            _ => None,
+        }
+    }
+
+    // A hello-world program, embedded from `assets/templates`.
+    pub fn template(&self) -> &'static str {
+        match self {
+            Language::Python => include_str!("../../assets/templates/main.py"),
+            Language::JAVASCRIPT => include_str!("../../assets/templates/main.js"),
+            Language::TYPESCRIPT => include_str!("../../assets/templates/main.ts"),
+            Language::C => include_str!("../../assets/templates/main.c"),
+            Language::CPP => include_str!("../../assets/templates/main.cpp"),
+            Language::RUST => include_str!("../../assets/templates/main.rs"),
+            Language::NIX => include_str!("../../assets/templates/main.nix"),
+            Language::GO => include_str!("../../assets/templates/main.go"),
+            Language::ZIG => include_str!("../../assets/templates/main.zig"),
+            Language::D => include_str!("../../assets/templates/main.d"),
+            Language::SWIFT => include_str!("../../assets/templates/main.swift"),
+            Language::SCALA => include_str!("../../assets/templates/Main.scala"),
+            Language::GROOVY => include_str!("../../assets/templates/Main.groovy"),
+            Language::DART => include_str!("../../assets/templates/main.dart"),
+            Language::RUBY => include_str!("../../assets/templates/main.rb"),
+            Language::LUA => include_str!("../../assets/templates/main.lua"),
+            Language::JULIA => include_str!("../../assets/templates/main.jl"),
+            Language::R => include_str!("../../assets/templates/main.R"),
+            Language::PERL => include_str!("../../assets/templates/main.pl"),
+            Language::PHP => include_str!("../../assets/templates/main.php"),
+            Language::CRYSTAL => include_str!("../../assets/templates/main.cr"),
+            Language::HASKELL => include_str!("../../assets/templates/Main.hs"),
+            Language::FORTRAN => include_str!("../../assets/templates/main.f90"),
+            Language::OCAML => include_str!("../../assets/templates/main.ml"),
+            Language::ELIXIR => include_str!("../../assets/templates/main.exs"),
+            Language::BASH => include_str!("../../assets/templates/main.sh"),
+            Language::ASSEMBLY => include_str!("../../assets/templates/main.asm"),
+            Language::SQL => include_str!("../../assets/templates/main.sql"),
+            Language::BRAINFUCK => include_str!("../../assets/templates/main.bf"),
+            Language::WASM => include_str!("../../assets/templates/main.wat"),
+            Language::STARLARK => include_str!("../../assets/templates/main.star"),
+        }
+    }
+}
+
+// Other names a language is accepted under in requests.
+const ALIASES: &[(&str, Language)] = &[
+    ("rb", Language::RUBY),
+    ("asm", Language::ASSEMBLY),
+    ("nasm", Language::ASSEMBLY),
+];
+
+impl FromStr for Language {
+    type Err = InfraError;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        Language::ALL
+            .into_iter()
+            .find(|language| language.as_str().eq_ignore_ascii_case(s))
+            .or_else(|| {
+                ALIASES
+                    .iter()
+                    .find(|(alias, _)| alias.eq_ignore_ascii_case(s))
+                    .map(|(_, language)| *language)
+            })
+            .ok_or_else(|| {
+                InfraError::UnsupportedLanguage(format!("{} language is not supported", s))
+            })
+    }
+}
+
+impl fmt::Display for Language {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+#[cfg(test)]
+mod language_tests {
+    use super::*;
+
+    #[test]
+    fn test_from_str_round_trips_every_language() {
+        for language in Language::ALL {
+            assert_eq!(language.as_str().parse::<Language>().unwrap(), language);
+            assert_eq!(
+                serde_json::to_value(language).unwrap(),
+                serde_json::json!(language.as_str())
+            );
+        }
+        assert_eq!("Python".parse::<Language>().unwrap(), Language::Python);
+        assert_eq!("rb".parse::<Language>().unwrap(), Language::RUBY);
+        assert!("cobol".parse::<Language>().is_err());
+    }
+
+    #[test]
+    fn test_source_file_names_carry_language_extension() {
+        assert_eq!(Language::TYPESCRIPT.source_file_name(), "main.ts");
+        for language in Language::ALL {
+            let name = Path::new(language.source_file_name());
+            assert!(name.extension().is_some(), "{}", language);
+        }
+    }
+
+    #[test]
+    fn test_from_extension_matches_source_file_names() {
+        assert_eq!(Language::from_extension("go"), Some(Language::GO));
+        assert_eq!(Language::from_extension("r"), Some(Language::R));
+        assert_eq!(Language::from_extension("mjs"), Some(Language::JAVASCRIPT));
+        assert_eq!(Language::from_extension("txt"), None);
+    }
+
+    #[test]
+    fn test_every_language_has_a_template() {
+        for language in Language::ALL {
+            assert!(!language.template().trim().is_empty(), "{}", language);
+        }
+        assert!(Language::RUST.template().contains("Hello, World!"));
+    }
+}
@@ -0,0 +1,188 @@
+use std::{collections::HashMap, fs, path::Path, sync::RwLock, time::Duration};
+
+use serde::Deserialize;
+
+use crate::config::config;
+
+use super::{language::Language, runner::ExecContext};
+
+// Defaults for one language's programs. Anything left unset falls back to
+// the server-wide setting; a tier's limits and a request's own compiler
+// flags take precedence over all of these.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct LanguageLimits {
+    pub timeout_secs: Option<u64>,
+    // For toolchains that compile in a step of their own, which is otherwise
+    // not time limited. It comes on top of `timeout_secs`, which then bounds
+    // the program alone.
+    pub compile_timeout_secs: Option<u64>,
+    // Enforced as the program's data segment limit, which leaves runtimes
+    // that reserve address space up front, like the JVM and Go, unaffected.
+    pub memory_bytes: Option<u64>,
+    // Per stream; a program that writes more is stopped.
+    pub max_output_bytes: Option<usize>,
+    pub compiler_flags: Option<Vec<String>>,
+}
+
+impl LanguageLimits {
+    // Fills in what `ctx` does not already set.
+    pub fn apply(&self, mut ctx: ExecContext) -> ExecContext {
+        if let (None, Some(secs)) = (ctx.timeout(), self.timeout_secs) {
+            ctx = ctx.with_timeout(Duration::from_secs(secs));
+        }
+        if let (None, Some(secs)) = (ctx.compile_timeout(), self.compile_timeout_secs) {
+            ctx = ctx.with_compile_timeout(Duration::from_secs(secs));
+        }
+        if let (None, Some(bytes)) = (ctx.memory_limit(), self.memory_bytes) {
+            ctx = ctx.with_memory_limit(bytes);
+        }
+        if let (None, Some(bytes)) = (ctx.max_output(), self.max_output_bytes) {
+            ctx = ctx.with_max_output(bytes);
+        }
+        match &self.compiler_flags {
+            Some(flags) if ctx.compiler_flags().is_empty() => {
+                ctx.with_compiler_flags(flags.clone())
+            }
+            _ => ctx,
+        }
+    }
+}
+
+// Languages that need more than the server-wide defaults: JVM languages
+// start slowly and compile more slowly still, GHC is a slow compiler and Go
+// compiles before every run.
+pub fn presets() -> HashMap<Language, LanguageLimits> {
+    let slow_start = LanguageLimits {
+        timeout_secs: Some(60),
+        ..LanguageLimits::default()
+    };
+    let jvm = LanguageLimits {
+        compile_timeout_secs: Some(120),
+        ..slow_start.clone()
+    };
+    HashMap::from([
+        (Language::SCALA, jvm.clone()),
+        (Language::GROOVY, jvm),
+        (Language::HASKELL, slow_start),
+        (
+            Language::GO,
+            LanguageLimits {
+                timeout_secs: Some(45),
+                ..LanguageLimits::default()
+            },
+        ),
+    ])
+}
+
+// Every language's defaults: the presets, with entries from the languages
+// file replacing the preset for the same language.
+#[derive(Debug, Default)]
+pub struct LanguageDefaults {
+    languages: HashMap<Language, LanguageLimits>,
+}
+
+impl LanguageDefaults {
+    // `{"scala": {"timeout_secs": 90}}`: language names as in requests, each
+    // mapped to its `LanguageLimits`.
+    pub fn from_json(text: &str) -> Result<Self, String> {
+        let file: HashMap<Language, LanguageLimits> = serde_json::from_str(text)
+            .map_err(|err| format!("invalid language defaults: {}", err))?;
+        let mut languages = presets();
+        languages.extend(file);
+        Ok(LanguageDefaults { languages })
+    }
+
+    pub fn read(path: Option<&Path>) -> Result<Self, String> {
+        let text = match path {
+            Some(path) => fs::read_to_string(path)
+                .map_err(|err| format!("cannot read {}: {}", path.display(), err))?,
+            None => String::from("{}"),
+        };
+        LanguageDefaults::from_json(&text)
+    }
+
+    pub fn for_language(&self, language: Language) -> Option<&LanguageLimits> {
+        self.languages.get(&language)
+    }
+}
+
+// Replaced wholesale on reload. Programs already running keep the defaults
+// they were confined with, so replaced ones are never freed.
+static LANGUAGE_DEFAULTS: RwLock<Option<&'static LanguageDefaults>> = RwLock::new(None);
+
+pub async fn language_defaults() -> &'static LanguageDefaults {
+    if let Some(defaults) = *LANGUAGE_DEFAULTS.read().unwrap() {
+        return defaults;
+    }
+    let defaults = LanguageDefaults::read(config().await.languages_file()).unwrap();
+    let mut current = LANGUAGE_DEFAULTS.write().unwrap();
+    *current.get_or_insert(Box::leak(Box::new(defaults)))
+}
+
+// Rereads the languages file, keeping the current defaults if it is invalid.
+pub async fn reload_language_defaults() -> Result<(), String> {
+    let defaults = LanguageDefaults::read(config().await.languages_file())?;
+    *LANGUAGE_DEFAULTS.write().unwrap() = Some(Box::leak(Box::new(defaults)));
+    Ok(())
+}
+
+#[cfg(test)]
+mod limits_tests {
+    use super::*;
+
+    #[test]
+    fn test_file_replaces_presets_and_rejects_unknown_keys() {
+        let defaults = LanguageDefaults::from_json(
+            r#"{
+                "go": {"memory_bytes": 536870912},
+                "cpp": {"max_output_bytes": 65536, "compiler_flags": ["-O2"]}
+            }"#,
+        )
+        .unwrap();
+        let go = defaults.for_language(Language::GO).unwrap();
+        assert_eq!(go.timeout_secs, None);
+        assert_eq!(go.memory_bytes, Some(536_870_912));
+        let scala = defaults.for_language(Language::SCALA).unwrap();
+        assert_eq!(scala.timeout_secs, Some(60));
+        assert_eq!(scala.compile_timeout_secs, Some(120));
+        assert!(defaults.for_language(Language::RUBY).is_none());
+
+        assert!(LanguageDefaults::from_json(r#"{"cobol": {}}"#).is_err());
+        assert!(LanguageDefaults::from_json(r#"{"go": {"timeout": 5}}"#).is_err());
+    }
+
+    #[test]
+    fn test_apply_keeps_what_the_context_already_sets() {
+        let limits = LanguageLimits {
+            timeout_secs: Some(45),
+            compile_timeout_secs: None,
+            memory_bytes: Some(1 << 30),
+            max_output_bytes: None,
+            compiler_flags: Some(vec!["-O2".into()]),
+        };
+        let ctx = limits.apply(ExecContext::default());
+        assert_eq!(ctx.timeout(), Some(Duration::from_secs(45)));
+        assert_eq!(ctx.memory_limit(), Some(1 << 30));
+        assert_eq!(ctx.max_output(), None);
+        assert_eq!(ctx.compiler_flags(), ["-O2"]);
+
+        let ctx = limits.apply(
+            ExecContext::default()
+                .with_timeout(Duration::from_secs(5))
+                .with_compiler_flags(vec!["-O0".into()]),
+        );
+        assert_eq!(ctx.timeout(), Some(Duration::from_secs(5)));
+        assert_eq!(ctx.compiler_flags(), ["-O0"]);
+    }
+
+    #[test]
+    fn test_read_without_a_file_keeps_the_presets() {
+        let defaults = LanguageDefaults::read(None).unwrap();
+        assert_eq!(
+            defaults.for_language(Language::GO).unwrap().timeout_secs,
+            Some(45)
+        );
+        assert!(LanguageDefaults::read(Some(Path::new("/nonexistent/languages.json"))).is_err());
+    }
+}
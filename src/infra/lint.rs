@@ -0,0 +1,505 @@
+use std::process::Output;
+
+use serde::Serialize;
+use serde_json::Value;
+use utoipa::ToSchema;
+
+use super::{
+    error::InfraError, language::Language, runner::ExecContext, sandbox::as_sandbox_user,
+    source::SourceFile,
+};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, ToSchema)]
+#[serde(rename_all = "lowercase")]
+pub enum Severity {
+    Error,
+    Warning,
+    Info,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, ToSchema)]
+pub struct Diagnostic {
+    #[schema(example = "main.py")]
+    pub file: String,
+    pub line: u32,
+    pub column: u32,
+    pub severity: Severity,
+    #[schema(example = "`os` imported but unused")]
+    pub message: String,
+    // The linter's name for the check, where it has one.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = "F401")]
+    pub rule: Option<String>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, ToSchema)]
+pub struct LintReport {
+    #[schema(example = "ruff")]
+    pub linter: String,
+    pub diagnostics: Vec<Diagnostic>,
+}
+
+// Each language's linters, in order of preference: the first one installed
+// is used.
+fn linters(language: Language) -> &'static [&'static str] {
+    match language {
+        Language::Python => &["ruff", "pylint"],
+        Language::GO => &["go"],
+        Language::JAVASCRIPT | Language::TYPESCRIPT => &["eslint"],
+        Language::C | Language::CPP => &["clang-tidy"],
+        Language::OCAML => &["ocamlc"],
+        _ => &[],
+    }
+}
+
+pub fn supports(language: Language) -> bool {
+    !linters(language).is_empty()
+}
+
+// Lints `content` without running it. Linters read the submitted code, so
+// they run as a sandbox user of their own like a program would.
+pub async fn lint(
+    language: Language,
+    content: &str,
+    ctx: &ExecContext,
+) -> Result<LintReport, InfraError> {
+    as_sandbox_user(run_linter(language, content, ctx)).await
+}
+
+async fn run_linter(
+    language: Language,
+    content: &str,
+    ctx: &ExecContext,
+) -> Result<LintReport, InfraError> {
+    let candidates = linters(language);
+    let Some(linter) = candidates
+        .iter()
+        .find(|linter| ctx.which(linter).is_ok())
+        .or(candidates.first())
+    else {
+        return Err(InfraError::UnsupportedLanguage(language.to_string()));
+    };
+    let source = SourceFile::create(language, content)?;
+    let path = source.path();
+    let mut cmd = ctx.command(linter)?;
+    match *linter {
+        "ruff" => cmd
+            .args(["check", "--output-format=json", "--no-cache", "--exit-zero"])
+            .arg(path),
+        "pylint" => cmd
+            .args(["--output-format=json", "--exit-zero", "--persistent=n"])
+            .arg(path),
+        "go" => cmd.args(["vet", "-json"]).arg(path),
+        "eslint" => cmd.args(["--format", "json"]).arg(path),
+        // Type checks without generating code.
+        "ocamlc" => cmd.args(["-stop-after", "typing", "-c"]).arg(path),
+        _ => {
+            let std = if language == Language::C {
+                "-std=c17"
+            } else {
+                "-std=c++20"
+            };
+            cmd.arg(path).arg("--").arg(std)
+        }
+    };
+    let output = cmd
+        .current_dir(source.dir())
+        .kill_on_drop(true)
+        .output()
+        .await?;
+    let file = language.source_file_name();
+    let diagnostics = match *linter {
+        "ruff" => from_ruff(&stdout(linter, &output)?, file)?,
+        "pylint" => from_pylint(&stdout(linter, &output)?, file)?,
+        // Releases disagree on which stream the JSON goes to.
+        "go" => {
+            let streams = [&output.stdout, &output.stderr].map(|s| String::from_utf8_lossy(s));
+            from_go_vet(&streams.join("\n"), file)
+        }
+        "eslint" => from_eslint(&stdout(linter, &output)?, file)?,
+        "ocamlc" => from_ocaml(&String::from_utf8_lossy(&output.stderr), file),
+        _ => from_clang(&String::from_utf8_lossy(&output.stdout), file),
+    };
+    Ok(LintReport {
+        linter: linter.to_string(),
+        diagnostics,
+    })
+}
+
+// The JSON report a linter printed, or the reason it printed none.
+fn stdout(linter: &str, output: &Output) -> Result<String, InfraError> {
+    if output.stdout.is_empty() && !output.status.success() {
+        return Err(InfraError::CompilationError(
+            format!(
+                "{} failed: {}",
+                linter,
+                String::from_utf8_lossy(&output.stderr)
+            )
+            .into(),
+        ));
+    }
+    Ok(String::from_utf8(output.stdout.clone())?)
+}
+
+fn unreadable(linter: &str, err: serde_json::Error) -> InfraError {
+    InfraError::CompilationError(format!("unreadable {} report: {}", linter, err).into())
+}
+
+fn number(value: &Value) -> u32 {
+    value.as_u64().unwrap_or_default() as u32
+}
+
+fn text(value: &Value) -> String {
+    value.as_str().unwrap_or_default().to_string()
+}
+
+fn from_ruff(json: &str, file: &str) -> Result<Vec<Diagnostic>, InfraError> {
+    let report: Vec<Value> = serde_json::from_str(json).map_err(|err| unreadable("ruff", err))?;
+    Ok(report
+        .iter()
+        .map(|item| {
+            let rule = item["code"].as_str().map(str::to_string);
+            Diagnostic {
+                file: file.to_string(),
+                line: number(&item["location"]["row"]),
+                column: number(&item["location"]["column"]),
+                // Ruff reports syntax errors without a rule code.
+                severity: if rule.is_none() {
+                    Severity::Error
+                } else {
+                    Severity::Warning
+                },
+                message: text(&item["message"]),
+                rule,
+            }
+        })
+        .collect())
+}
+
+fn from_pylint(json: &str, file: &str) -> Result<Vec<Diagnostic>, InfraError> {
+    let report: Vec<Value> = serde_json::from_str(json).map_err(|err| unreadable("pylint", err))?;
+    Ok(report
+        .iter()
+        .map(|item| Diagnostic {
+            file: file.to_string(),
+            line: number(&item["line"]),
+            // Pylint counts columns from zero.
+            column: number(&item["column"]) + 1,
+            severity: match item["type"].as_str() {
+                Some("error" | "fatal") => Severity::Error,
+                Some("warning") => Severity::Warning,
+                _ => Severity::Info,
+            },
+            message: text(&item["message"]),
+            rule: item["symbol"].as_str().map(str::to_string),
+        })
+        .collect())
+}
+
+fn from_eslint(json: &str, file: &str) -> Result<Vec<Diagnostic>, InfraError> {
+    let report: Vec<Value> = serde_json::from_str(json).map_err(|err| unreadable("eslint", err))?;
+    Ok(report
+        .iter()
+        .filter_map(|result| result["messages"].as_array())
+        .flatten()
+        .map(|message| Diagnostic {
+            file: file.to_string(),
+            line: number(&message["line"]),
+            column: number(&message["column"]),
+            severity: if message["severity"].as_u64() == Some(2) {
+                Severity::Error
+            } else {
+                Severity::Warning
+            },
+            message: text(&message["message"]),
+            rule: message["ruleId"].as_str().map(str::to_string),
+        })
+        .collect())
+}
+
+// `path:line:col: rest`, as compilers and most text-mode linters print.
+fn location(line: &str) -> Option<(u32, u32, &str)> {
+    let mut parts = line.splitn(4, ':');
+    let _path = parts.next()?;
+    let line = parts.next()?.trim().parse().ok()?;
+    let column = parts.next()?.trim().parse().ok()?;
+    Some((line, column, parts.next()?.trim()))
+}
+
+// `go vet -json` reports analyzer findings as JSON, but type errors stop it
+// before any analyzer runs and come out as plain compiler errors instead.
+fn from_go_vet(output: &str, file: &str) -> Vec<Diagnostic> {
+    let mut diagnostics = Vec::new();
+    let mut json = String::new();
+    for line in output.lines() {
+        if line.starts_with('#') {
+            continue;
+        }
+        if !json.is_empty() || line.starts_with('{') {
+            json.push_str(line);
+            json.push('\n');
+            continue;
+        }
+        let line = line.strip_prefix("vet: ").unwrap_or(line);
+        if let Some((line, column, message)) = location(line) {
+            diagnostics.push(Diagnostic {
+                file: file.to_string(),
+                line,
+                column,
+                severity: Severity::Error,
+                message: message.to_string(),
+                rule: None,
+            });
+        }
+    }
+    // `{"package": {"analyzer": [{"posn": "path:line:col", "message": ..}]}}`,
+    // one object per package.
+    let stream = serde_json::Deserializer::from_str(&json).into_iter::<Value>();
+    for packages in stream.flatten() {
+        let analyzers = packages
+            .as_object()
+            .into_iter()
+            .flat_map(|packages| packages.values())
+            .filter_map(Value::as_object)
+            .flatten();
+        for (analyzer, findings) in analyzers {
+            for finding in findings.as_array().into_iter().flatten() {
+                let posn = format!("{}: ", finding["posn"].as_str().unwrap_or_default());
+                let Some((line, column, _)) = location(&posn) else {
+                    continue;
+                };
+                diagnostics.push(Diagnostic {
+                    file: file.to_string(),
+                    line,
+                    column,
+                    severity: Severity::Warning,
+                    message: text(&finding["message"]),
+                    rule: Some(analyzer.clone()),
+                });
+            }
+        }
+    }
+    diagnostics
+}
+
+fn from_clang(stdout: &str, file: &str) -> Vec<Diagnostic> {
+    stdout
+        .lines()
+        .filter_map(location)
+        .filter_map(|(line, column, rest)| {
+            let (severity, message) = rest.split_once(':')?;
+            let severity = match severity.trim() {
+                "error" | "fatal error" => Severity::Error,
+                "warning" => Severity::Warning,
+                "note" => Severity::Info,
+                _ => return None,
+            };
+            let message = message.trim();
+            let (message, rule) = match message.rsplit_once(" [") {
+                Some((message, rule)) if rule.ends_with(']') => {
+                    (message, Some(rule.trim_end_matches(']').to_string()))
+                }
+                _ => (message, None),
+            };
+            Some(Diagnostic {
+                file: file.to_string(),
+                line,
+                column,
+                severity,
+                message: message.to_string(),
+                rule,
+            })
+        })
+        .collect()
+}
+
+// The start of an OCaml report: `File "main.ml", line 3, characters 8-15:`,
+// or `lines 3-5` when it spans several. Characters count from zero.
+fn ocaml_location(line: &str) -> Option<(u32, u32)> {
+    let rest = line.strip_prefix("File \"")?;
+    let (_path, rest) = rest.split_once("\", ")?;
+    let rest = rest.trim_end_matches(':');
+    let mut parts = rest.split(", ");
+    let lines = parts.next()?;
+    let line = lines
+        .strip_prefix("line ")
+        .or_else(|| lines.strip_prefix("lines "))?
+        .split('-')
+        .next()?
+        .parse()
+        .ok()?;
+    let column = match parts
+        .next()
+        .and_then(|chars| chars.strip_prefix("characters "))
+    {
+        Some(chars) => chars.split('-').next()?.parse::<u32>().ok()? + 1,
+        None => 1,
+    };
+    Some((line, column))
+}
+
+// `Error: message`, `Warning 26 [unused-var]: message` or, for a warning
+// turned into an error, `Error (warning 8 [partial-match]): message`.
+fn ocaml_message(line: &str) -> Option<(Severity, Option<String>, &str)> {
+    let (head, message) = line.split_once(": ")?;
+    let (severity, kind) = if let Some(kind) = head.strip_prefix("Error") {
+        (Severity::Error, kind)
+    } else if let Some(kind) = head.strip_prefix("Warning") {
+        (Severity::Warning, kind)
+    } else if let Some(kind) = head.strip_prefix("Alert") {
+        (Severity::Info, kind)
+    } else {
+        return None;
+    };
+    let kind = kind.trim().trim_start_matches('(').trim_end_matches(')');
+    let rule = match kind.split_once('[') {
+        Some((_, name)) => Some(name.trim_end_matches(']').to_string()),
+        None => kind
+            .split_whitespace()
+            .last()
+            .filter(|word| !word.is_empty())
+            .map(str::to_string),
+    };
+    Some((severity, rule, message.trim()))
+}
+
+// OCaml's compiler and toplevel print each report as a location line, an
+// excerpt of the source, then the message, whose continuation lines are
+// indented.
+pub fn from_ocaml(output: &str, file: &str) -> Vec<Diagnostic> {
+    let mut diagnostics: Vec<Diagnostic> = Vec::new();
+    let mut location = None;
+    let mut continues = false;
+    for line in output.lines() {
+        if let Some(found) = ocaml_location(line) {
+            location = Some(found);
+            continues = false;
+            continue;
+        }
+        if continues && line.starts_with(' ') {
+            if let Some(last) = diagnostics.last_mut() {
+                last.message.push('\n');
+                last.message.push_str(line.trim());
+            }
+            continue;
+        }
+        continues = false;
+        let Some((line_number, column)) = location else {
+            continue;
+        };
+        let Some((severity, rule, message)) = ocaml_message(line) else {
+            continue;
+        };
+        diagnostics.push(Diagnostic {
+            file: file.to_string(),
+            line: line_number,
+            column,
+            severity,
+            message: message.to_string(),
+            rule,
+        });
+        location = None;
+        continues = true;
+    }
+    diagnostics
+}
+
+#[cfg(test)]
+mod lint_tests {
+    use super::*;
+
+    #[test]
+    fn test_ruff_and_pylint_reports() {
+        let ruff = r#"[{"code": "F401", "message": "`os` imported but unused",
+            "location": {"row": 1, "column": 8}},
+            {"code": null, "message": "SyntaxError: Expected ')'",
+            "location": {"row": 3, "column": 10}}]"#;
+        let diagnostics = from_ruff(ruff, "main.py").unwrap();
+        assert_eq!(diagnostics[0].rule.as_deref(), Some("F401"));
+        assert_eq!(diagnostics[0].severity, Severity::Warning);
+        assert_eq!(diagnostics[1].severity, Severity::Error);
+
+        let pylint = r#"[{"type": "convention", "line": 1, "column": 0,
+            "symbol": "missing-module-docstring", "message": "Missing module docstring"}]"#;
+        let diagnostics = from_pylint(pylint, "main.py").unwrap();
+        assert_eq!((diagnostics[0].line, diagnostics[0].column), (1, 1));
+        assert_eq!(diagnostics[0].severity, Severity::Info);
+    }
+
+    #[test]
+    fn test_eslint_and_clang_tidy_reports() {
+        let eslint = r#"[{"filePath": "/tmp/x/main.js", "messages": [
+            {"ruleId": "no-unused-vars", "severity": 2, "message": "'x' is assigned a value but never used.",
+             "line": 1, "column": 5}]}]"#;
+        let diagnostics = from_eslint(eslint, "main.js").unwrap();
+        assert_eq!(diagnostics[0].rule.as_deref(), Some("no-unused-vars"));
+        assert_eq!(diagnostics[0].severity, Severity::Error);
+
+        let clang = "/tmp/x/main.c:4:10: warning: Value stored to 'y' is never read \
+            [clang-analyzer-deadcode.DeadStores]\n    4 |   int y = 2;\n";
+        let diagnostics = from_clang(clang, "main.c");
+        assert_eq!(diagnostics.len(), 1);
+        assert_eq!(diagnostics[0].line, 4);
+        assert_eq!(
+            diagnostics[0].rule.as_deref(),
+            Some("clang-analyzer-deadcode.DeadStores")
+        );
+    }
+
+    #[test]
+    fn test_ocaml_reports() {
+        let output = r#"File "main.ml", line 2, characters 6-7:
+2 |   let x = 1 in
+          ^
+Warning 26 [unused-var]: unused variable x.
+File "main.ml", lines 4-5, characters 9-20:
+4 | let () = print_int
+5 |   "one"
+Error: This expression has type string but an expression was expected of type
+         int
+"#;
+        let diagnostics = from_ocaml(output, "main.ml");
+        assert_eq!(diagnostics.len(), 2);
+        assert_eq!((diagnostics[0].line, diagnostics[0].column), (2, 7));
+        assert_eq!(diagnostics[0].severity, Severity::Warning);
+        assert_eq!(diagnostics[0].rule.as_deref(), Some("unused-var"));
+        assert_eq!((diagnostics[1].line, diagnostics[1].column), (4, 10));
+        assert_eq!(diagnostics[1].severity, Severity::Error);
+        assert_eq!(diagnostics[1].rule, None);
+        assert!(diagnostics[1].message.ends_with("expected of type\nint"));
+
+        let partial = "File \"main.ml\", line 1, characters 0-3:\n\
+            Error (warning 8 [partial-match]): this pattern-matching is not exhaustive.\n";
+        let diagnostics = from_ocaml(partial, "main.ml");
+        assert_eq!(diagnostics[0].severity, Severity::Error);
+        assert_eq!(diagnostics[0].rule.as_deref(), Some("partial-match"));
+    }
+
+    #[tokio::test]
+    async fn test_go_vet_reports_findings_without_running() {
+        let code = r#"
+package main
+
+import "fmt"
+
+func main() {
+    fmt.Printf("%d\n", "not a number")
+    panic("never runs")
+}
+"#;
+        let report = lint(Language::GO, code, &ExecContext::default())
+            .await
+            .unwrap();
+        assert_eq!(report.linter, "go");
+        assert_eq!(report.diagnostics.len(), 1);
+        assert_eq!(report.diagnostics[0].line, 7);
+        assert_eq!(report.diagnostics[0].rule.as_deref(), Some("printf"));
+
+        let broken = "package main\n\nfunc main() {\n    undefined()\n}\n";
+        let report = lint(Language::GO, broken, &ExecContext::default())
+            .await
+            .unwrap();
+        assert_eq!(report.diagnostics[0].severity, Severity::Error);
+        assert_eq!(report.diagnostics[0].line, 4);
+    }
+}
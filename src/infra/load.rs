@@ -0,0 +1,233 @@
+use std::{fs, sync::Mutex, time::Duration};
+
+use super::{executions, jobs::job_queue};
+
+// When new runs are turned away: CPU and memory use as fractions of the
+// host's, and runs in progress plus jobs waiting for a worker. A limit left
+// unset never sheds.
+#[derive(Debug, Clone, Copy)]
+pub struct LoadLimits {
+    pub cpu: Option<f64>,
+    pub memory: Option<f64>,
+    pub queue_depth: Option<usize>,
+    pub retry_after: Duration,
+    pub interval: Duration,
+}
+
+impl LoadLimits {
+    pub fn is_enabled(&self) -> bool {
+        self.cpu.is_some() || self.memory.is_some() || self.queue_depth.is_some()
+    }
+
+    // The first limit `sample` reaches, checking the one that takes the
+    // host down soonest first.
+    fn exceeded(&self, sample: &LoadSample) -> Option<Pressure> {
+        if self.memory.is_some_and(|limit| sample.memory >= limit) {
+            Some(Pressure::Memory)
+        } else if self.cpu.is_some_and(|limit| sample.cpu >= limit) {
+            Some(Pressure::Cpu)
+        } else if self
+            .queue_depth
+            .is_some_and(|limit| sample.queue_depth >= limit)
+        {
+            Some(Pressure::Queue)
+        } else {
+            None
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Pressure {
+    Cpu,
+    Memory,
+    Queue,
+}
+
+impl Pressure {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Pressure::Cpu => "cpu",
+            Pressure::Memory => "memory",
+            Pressure::Queue => "queue",
+        }
+    }
+
+    pub fn describe(&self) -> &'static str {
+        match self {
+            Pressure::Cpu => "CPU is saturated",
+            Pressure::Memory => "memory is nearly exhausted",
+            Pressure::Queue => "too many runs are queued",
+        }
+    }
+}
+
+// Why new runs are being turned away, and when to try again.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Overload {
+    pub pressure: Pressure,
+    pub retry_after: Duration,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+struct LoadSample {
+    cpu: f64,
+    memory: f64,
+    queue_depth: usize,
+}
+
+static OVERLOAD: Mutex<Option<Overload>> = Mutex::new(None);
+
+// Set while the last sample was over a limit.
+pub fn overloaded() -> Option<Overload> {
+    *OVERLOAD.lock().unwrap()
+}
+
+// Jiffies spent busy and in total since boot, from the first line of
+// /proc/stat. Guest time is already counted as user time, so only the
+// first eight columns are added up, and waiting on I/O counts as idle.
+fn cpu_times(stat: &str) -> Option<(u64, u64)> {
+    let fields = stat
+        .lines()
+        .next()?
+        .strip_prefix("cpu ")?
+        .split_whitespace()
+        .take(8)
+        .map(|field| field.parse::<u64>().ok())
+        .collect::<Option<Vec<_>>>()?;
+    let total = fields.iter().sum::<u64>();
+    let idle = fields.get(3)? + fields.get(4).copied().unwrap_or(0);
+    Some((total.saturating_sub(idle), total))
+}
+
+// The share of memory not available to new processes, from /proc/meminfo.
+fn memory_used(meminfo: &str) -> Option<f64> {
+    let field = |name: &str| {
+        meminfo
+            .lines()
+            .find_map(|line| line.strip_prefix(name)?.strip_prefix(':'))?
+            .split_whitespace()
+            .next()?
+            .parse::<f64>()
+            .ok()
+    };
+    let total = field("MemTotal")?;
+    let available = field("MemAvailable")?;
+    (total > 0.0).then(|| 1.0 - available / total)
+}
+
+// Samples the host every `limits.interval` and sheds new runs while a
+// sample is over a limit. CPU use is measured between samples, so the first
+// one only counts memory and the queue.
+pub async fn watch_load(limits: LoadLimits) {
+    let mut ticker = tokio::time::interval(limits.interval);
+    let mut last_times = None;
+
+    loop {
+        ticker.tick().await;
+
+        let times = fs::read_to_string("/proc/stat")
+            .ok()
+            .as_deref()
+            .and_then(cpu_times);
+        let cpu = match (last_times, times) {
+            (Some((busy_before, total_before)), Some((busy, total))) if total > total_before => {
+                busy.saturating_sub(busy_before) as f64 / (total - total_before) as f64
+            }
+            _ => 0.0,
+        };
+        last_times = times.or(last_times);
+        let sample = LoadSample {
+            cpu,
+            memory: fs::read_to_string("/proc/meminfo")
+                .ok()
+                .as_deref()
+                .and_then(memory_used)
+                .unwrap_or(0.0),
+            queue_depth: executions::in_progress() + job_queue().await.waiting(),
+        };
+
+        let overload = limits.exceeded(&sample).map(|pressure| Overload {
+            pressure,
+            retry_after: limits.retry_after,
+        });
+        let was = std::mem::replace(&mut *OVERLOAD.lock().unwrap(), overload);
+        match (was, overload) {
+            (None, Some(overload)) => tracing::warn!(
+                "shedding new runs, {}: cpu {:.0}%, memory {:.0}%, {} runs queued",
+                overload.pressure.describe(),
+                sample.cpu * 100.0,
+                sample.memory * 100.0,
+                sample.queue_depth
+            ),
+            (Some(_), None) => tracing::info!(
+                "load back to cpu {:.0}%, memory {:.0}%, {} runs queued, accepting runs again",
+                sample.cpu * 100.0,
+                sample.memory * 100.0,
+                sample.queue_depth
+            ),
+            _ => {}
+        }
+    }
+}
+
+#[cfg(test)]
+mod load_tests {
+    use super::*;
+
+    fn limits() -> LoadLimits {
+        LoadLimits {
+            cpu: Some(0.9),
+            memory: Some(0.8),
+            queue_depth: Some(10),
+            retry_after: Duration::from_secs(5),
+            interval: Duration::from_secs(1),
+        }
+    }
+
+    #[test]
+    fn test_cpu_times_count_iowait_as_idle_and_skip_guest_time() {
+        let stat = "cpu  100 20 30 400 50 5 5 10 70 0\ncpu0 1 2 3 4 5 6 7 8 9 0\n";
+        assert_eq!(cpu_times(stat), Some((170, 620)));
+        assert_eq!(cpu_times("intr 1 2 3\n"), None);
+    }
+
+    #[test]
+    fn test_memory_used_leaves_out_what_is_available() {
+        let meminfo = "MemTotal:       1000 kB\nMemFree:         100 kB\nMemAvailable:    250 kB\n";
+        assert_eq!(memory_used(meminfo), Some(0.75));
+        assert_eq!(memory_used("MemTotal: 1000 kB\n"), None);
+    }
+
+    #[test]
+    fn test_exceeded_names_the_pressing_limit() {
+        let limits = limits();
+        let calm = LoadSample {
+            cpu: 0.5,
+            memory: 0.5,
+            queue_depth: 2,
+        };
+        assert_eq!(limits.exceeded(&calm), None);
+        let busy = LoadSample { cpu: 0.95, ..calm };
+        assert_eq!(limits.exceeded(&busy), Some(Pressure::Cpu));
+        let swamped = LoadSample {
+            memory: 0.85,
+            ..busy
+        };
+        assert_eq!(limits.exceeded(&swamped), Some(Pressure::Memory));
+        let queued = LoadSample {
+            queue_depth: 10,
+            ..calm
+        };
+        assert_eq!(limits.exceeded(&queued), Some(Pressure::Queue));
+
+        let unlimited = LoadLimits {
+            cpu: None,
+            memory: None,
+            queue_depth: None,
+            ..limits
+        };
+        assert!(!unlimited.is_enabled());
+        assert_eq!(unlimited.exceeded(&swamped), None);
+    }
+}
@@ -0,0 +1,58 @@
+use std::str::FromStr;
+
+// Locales or timezones a request may run its program under, parsed from a
+// comma-separated list such as `C.UTF-8,de_DE.UTF-8` or `UTC,Europe/Berlin`.
+// Names compare exactly, as the C library looks them up.
+#[derive(Debug, Clone, Default)]
+pub struct AllowList {
+    names: Vec<String>,
+}
+
+impl FromStr for AllowList {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut names = Vec::new();
+        for name in s.split(',').map(str::trim).filter(|name| !name.is_empty()) {
+            // A timezone name is also a path under the zoneinfo directory.
+            let valid = name.chars().all(|c| {
+                c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '+' | '.' | '/' | '@')
+            }) && !name.starts_with('/')
+                && !name.split('/').any(|part| part == "..");
+            if !valid {
+                return Err(format!("invalid locale or timezone {:?}", name));
+            }
+            names.push(name.to_string());
+        }
+        Ok(AllowList { names })
+    }
+}
+
+impl AllowList {
+    pub fn contains(&self, name: &str) -> bool {
+        self.names.iter().any(|allowed| allowed == name)
+    }
+
+    pub fn names(&self) -> &[String] {
+        &self.names
+    }
+}
+
+#[cfg(test)]
+mod locale_tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_allow_list() {
+        let zones: AllowList = " UTC, America/New_York,Etc/GMT+5 ,".parse().unwrap();
+        assert_eq!(zones.names(), ["UTC", "America/New_York", "Etc/GMT+5"]);
+        assert!(zones.contains("America/New_York"));
+        assert!(!zones.contains("utc"));
+
+        let locales: AllowList = "C.UTF-8,de_DE.UTF-8@euro".parse().unwrap();
+        assert!(locales.contains("de_DE.UTF-8@euro"));
+        assert!("../../etc/passwd".parse::<AllowList>().is_err());
+        assert!("/etc/localtime".parse::<AllowList>().is_err());
+        assert!("en US".parse::<AllowList>().is_err());
+    }
+}
@@ -0,0 +1,294 @@
+use std::{collections::VecDeque, future::Future, sync::Mutex};
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use tokio::sync::OnceCell;
+use utoipa::{IntoParams, ToSchema};
+
+use super::{
+    audit::record_audit,
+    error::InfraError,
+    events::{ExecutionEvent, Submitter, publish},
+    executions::tracked,
+    history::persist,
+    hooks::recording_hooks,
+};
+use crate::config::config;
+
+const DEFAULT_SEARCH_LIMIT: usize = 50;
+const MAX_SEARCH_LIMIT: usize = 500;
+const TRUNCATED_MARKER: &str = "\n[truncated]";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+#[serde(rename_all = "snake_case")]
+pub enum RunStatus {
+    Succeeded,
+    Failed,
+    CompileError,
+    TimedOut,
+    BlockedSyscall,
+    DiskQuotaExceeded,
+    OutputLimitExceeded,
+    Killed,
+}
+
+impl RunStatus {
+    pub fn of(result: &Result<String, InfraError>) -> Self {
+        match result {
+            Ok(_) => RunStatus::Succeeded,
+            Err(InfraError::CompileError(_)) => RunStatus::CompileError,
+            Err(InfraError::Timeout(..)) => RunStatus::TimedOut,
+            Err(InfraError::BlockedSyscall(_)) => RunStatus::BlockedSyscall,
+            Err(InfraError::DiskQuotaExceeded(_)) => RunStatus::DiskQuotaExceeded,
+            Err(InfraError::OutputLimitExceeded(_)) => RunStatus::OutputLimitExceeded,
+            Err(InfraError::Killed) => RunStatus::Killed,
+            Err(_) => RunStatus::Failed,
+        }
+    }
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            RunStatus::Succeeded => "succeeded",
+            RunStatus::Failed => "failed",
+            RunStatus::CompileError => "compile_error",
+            RunStatus::TimedOut => "timed_out",
+            RunStatus::BlockedSyscall => "blocked_syscall",
+            RunStatus::DiskQuotaExceeded => "disk_quota_exceeded",
+            RunStatus::OutputLimitExceeded => "output_limit_exceeded",
+            RunStatus::Killed => "killed",
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize, ToSchema)]
+pub struct RunLog {
+    pub id: String,
+    pub lang: String,
+    pub status: RunStatus,
+    pub output: Option<String>,
+    pub error: Option<String>,
+    pub started_at: DateTime<Utc>,
+    pub duration_ms: u64,
+}
+
+#[derive(Debug, Default, Deserialize, IntoParams)]
+#[into_params(parameter_in = Query)]
+pub struct LogQuery {
+    /// Submission or job id
+    pub id: Option<String>,
+    pub lang: Option<String>,
+    pub status: Option<RunStatus>,
+    /// Only runs started at or after this time (RFC 3339)
+    pub since: Option<DateTime<Utc>>,
+    /// Only runs started before this time (RFC 3339)
+    pub until: Option<DateTime<Utc>>,
+    pub limit: Option<usize>,
+}
+
+impl LogQuery {
+    fn matches(&self, log: &RunLog) -> bool {
+        self.id.as_ref().is_none_or(|id| *id == log.id)
+            && self
+                .lang
+                .as_ref()
+                .is_none_or(|lang| lang.eq_ignore_ascii_case(&log.lang))
+            && self.status.is_none_or(|status| status == log.status)
+            && self.since.is_none_or(|since| log.started_at >= since)
+            && self.until.is_none_or(|until| log.started_at < until)
+    }
+}
+
+// Keeps the most recent runs in memory, oldest evicted first, so failures can
+// be looked up after the fact without access to the workers.
+pub struct RunLogs {
+    entries: Mutex<VecDeque<RunLog>>,
+    capacity: usize,
+    max_output_bytes: usize,
+}
+
+static RUN_LOGS: OnceCell<RunLogs> = OnceCell::const_new();
+
+async fn init_run_logs() -> RunLogs {
+    let app_config = config().await;
+    RunLogs::new(
+        app_config.run_log_capacity(),
+        app_config.run_log_max_output(),
+    )
+}
+
+pub async fn run_logs() -> &'static RunLogs {
+    RUN_LOGS.get_or_init(init_run_logs).await
+}
+
+// Runs `run`, the program `content`, records its outcome under `id` and
+// publishes it to the configured event sinks.
+pub async fn logged<F>(
+    id: &str,
+    lang: &str,
+    content: &str,
+    submitter: &Submitter,
+    run: F,
+) -> Result<String, InfraError>
+where
+    F: Future<Output = Result<String, InfraError>>,
+{
+    let started_at = Utc::now();
+    let (result, hooks) = recording_hooks(tracked(id, lang, submitter, run)).await;
+    run_logs().await.record(id, lang, started_at, &result);
+    persist(id, lang, content, started_at, &result).await;
+    record_audit(id, lang, content, hooks, submitter, started_at, &result).await;
+    publish(&ExecutionEvent::new(id, lang, submitter, started_at, &result)).await;
+    result
+}
+
+impl RunLogs {
+    pub fn new(capacity: usize, max_output_bytes: usize) -> Self {
+        RunLogs {
+            entries: Mutex::new(VecDeque::new()),
+            capacity,
+            max_output_bytes,
+        }
+    }
+
+    pub fn record(
+        &self,
+        id: &str,
+        lang: &str,
+        started_at: DateTime<Utc>,
+        result: &Result<String, InfraError>,
+    ) {
+        if self.capacity == 0 {
+            return;
+        }
+
+        let (output, error) = match result {
+            Ok(output) => (Some(output.as_str()), None),
+            Err(err) => (None, Some(err.to_string())),
+        };
+        let log = RunLog {
+            id: id.to_string(),
+            lang: lang.to_string(),
+            status: RunStatus::of(result),
+            output: output.map(|output| truncate(output, self.max_output_bytes)),
+            error: error.map(|error| truncate(&error, self.max_output_bytes)),
+            started_at,
+            duration_ms: (Utc::now() - started_at).num_milliseconds().max(0) as u64,
+        };
+
+        let mut entries = self.entries.lock().unwrap();
+        while entries.len() >= self.capacity {
+            entries.pop_front();
+        }
+        entries.push_back(log);
+    }
+
+    // Returns matching runs, newest first.
+    pub fn search(&self, query: &LogQuery) -> Vec<RunLog> {
+        let limit = query
+            .limit
+            .unwrap_or(DEFAULT_SEARCH_LIMIT)
+            .min(MAX_SEARCH_LIMIT);
+        let entries = self.entries.lock().unwrap();
+        entries
+            .iter()
+            .rev()
+            .filter(|log| query.matches(log))
+            .take(limit)
+            .cloned()
+            .collect()
+    }
+}
+
+pub fn truncate(text: &str, max_bytes: usize) -> String {
+    if text.len() <= max_bytes {
+        return text.to_string();
+    }
+    let mut end = max_bytes;
+    while !text.is_char_boundary(end) {
+        end -= 1;
+    }
+    format!("{}{}", &text[..end], TRUNCATED_MARKER)
+}
+
+#[cfg(test)]
+mod logs_tests {
+    use super::*;
+    use std::time::Duration;
+
+    fn failed() -> Result<String, InfraError> {
+        Err(InfraError::CompilationError("boom".into()))
+    }
+
+    #[test]
+    fn test_search_filters_by_lang_and_status() {
+        let logs = RunLogs::new(10, 1024);
+        let now = Utc::now();
+        logs.record("a", "python", now, &Ok("1\n".into()));
+        logs.record("b", "python", now, &failed());
+        logs.record(
+            "c",
+            "rust",
+            now,
+            &Err(InfraError::timeout(Duration::from_secs(1))),
+        );
+
+        let query = LogQuery {
+            lang: Some("PYTHON".into()),
+            status: Some(RunStatus::Failed),
+            ..Default::default()
+        };
+        let found = logs.search(&query);
+        assert_eq!(found.len(), 1);
+        assert_eq!(found[0].id, "b");
+        assert!(found[0].error.as_ref().unwrap().contains("boom"));
+
+        let timed_out = LogQuery {
+            status: Some(RunStatus::TimedOut),
+            ..Default::default()
+        };
+        assert_eq!(logs.search(&timed_out)[0].id, "c");
+    }
+
+    #[test]
+    fn test_search_returns_newest_first_within_time_range() {
+        let logs = RunLogs::new(10, 1024);
+        let start = Utc::now();
+        for (i, id) in ["a", "b", "c"].into_iter().enumerate() {
+            logs.record(
+                id,
+                "python",
+                start + chrono::Duration::minutes(i as i64),
+                &Ok(String::new()),
+            );
+        }
+
+        let query = LogQuery {
+            since: Some(start + chrono::Duration::minutes(1)),
+            ..Default::default()
+        };
+        let ids: Vec<_> = logs.search(&query).into_iter().map(|log| log.id).collect();
+        assert_eq!(ids, ["c", "b"]);
+    }
+
+    #[test]
+    fn test_oldest_runs_are_evicted() {
+        let logs = RunLogs::new(2, 1024);
+        for id in ["a", "b", "c"] {
+            logs.record(id, "python", Utc::now(), &Ok(String::new()));
+        }
+        let ids: Vec<_> = logs
+            .search(&LogQuery::default())
+            .into_iter()
+            .map(|log| log.id)
+            .collect();
+        assert_eq!(ids, ["c", "b"]);
+    }
+
+    #[test]
+    fn test_output_is_truncated_on_char_boundary() {
+        let logs = RunLogs::new(1, 2);
+        logs.record("a", "python", Utc::now(), &Ok("héllo".into()));
+        let output = logs.search(&LogQuery::default())[0].output.clone().unwrap();
+        assert_eq!(output, format!("h{}", TRUNCATED_MARKER));
+    }
+}
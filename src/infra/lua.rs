@@ -1,30 +1,82 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
+use std::{fmt, process::Output, str::FromStr};
 
-pub async fn compile_lua(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".lua")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
+use crate::config::config;
 
-    let source_path = temp_file.path().to_path_buf();
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+    wasm::forward_output,
+};
 
-    let mut cmd = Command::new(which("lua")?)
-        .arg(&source_path)
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
+// Which interpreter runs Lua: the installed `lua`, or one embedded in the
+// server that needs nothing installed and enforces its budgets in-process.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum LuaEngine {
+    #[default]
+    External,
+    Embedded,
+}
+
+impl LuaEngine {
+    pub const AVAILABLE: bool = cfg!(feature = "embedded-lua");
 
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            LuaEngine::External => "external",
+            LuaEngine::Embedded => "embedded",
+        }
     }
+}
+
+impl FromStr for LuaEngine {
+    type Err = String;
 
-    let output = cmd.wait_with_output().await?;
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.trim().to_ascii_lowercase().as_str() {
+            "external" => Ok(LuaEngine::External),
+            "embedded" if LuaEngine::AVAILABLE => Ok(LuaEngine::Embedded),
+            "embedded" => Err(String::from(
+                "the embedded Lua engine requires building with the `embedded-lua` feature",
+            )),
+            other => Err(format!("unknown Lua engine: {}", other)),
+        }
+    }
+}
+
+impl fmt::Display for LuaEngine {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+pub async fn compile_lua(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let app_config = config().await;
+    let output = match app_config.lua_engine() {
+        LuaEngine::Embedded => {
+            // A language default for Lua replaces the instance's.
+            let budget = Budget {
+                memory_bytes: ctx
+                    .memory_limit()
+                    .map_or(app_config.lua_memory_bytes(), |bytes| bytes as usize),
+                instructions: app_config.lua_max_instructions(),
+            };
+            run_embedded(content, stdin_input, ctx, budget).await?
+        }
+        LuaEngine::External => {
+            let source = SourceFile::create(Language::LUA, content)?;
+            let source_path = source.path().to_path_buf();
+
+            let mut cmd = ctx.command("lua")?;
+            cmd.arg(&source_path);
+            run_program(&mut cmd, stdin_input, ctx).await?
+        }
+    };
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
         Some(code) => {
@@ -46,9 +98,411 @@ pub async fn compile_lua(content: &str, stdin_input: &str) -> Result<String, Inf
     }
 }
 
+// What one embedded run may use. No instruction limit if `instructions` is
+// None; the context's timeout applies either way.
+#[derive(Debug, Clone, Copy)]
+pub struct Budget {
+    pub memory_bytes: usize,
+    pub instructions: Option<u64>,
+}
+
+// Runs `content` in a fresh embedded interpreter with only the libraries
+// that cannot reach outside it: no `os` beyond the clock, no `package`, and
+// an `io` that only reads stdin and writes stdout.
+pub async fn run_embedded(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+    budget: Budget,
+) -> Result<Output, InfraError> {
+    let output = execute(content, stdin_input, ctx, budget).await?;
+    forward_output(&output, ctx);
+    Ok(ctx.output_encoding().encode(output))
+}
+
+#[cfg(feature = "embedded-lua")]
+async fn execute(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+    budget: Budget,
+) -> Result<Output, InfraError> {
+    let (source, stdin) = (content.to_string(), stdin_input.to_string());
+    let (args, timeout) = (ctx.args().to_vec(), ctx.timeout());
+    tokio::task::spawn_blocking(move || engine::run(&source, &stdin, args, timeout, budget))
+        .await
+        .map_err(|err| InfraError::CompilationError(err.into()))?
+}
+
+#[cfg(not(feature = "embedded-lua"))]
+async fn execute(
+    _content: &str,
+    _stdin_input: &str,
+    _ctx: &ExecContext,
+    _budget: Budget,
+) -> Result<Output, InfraError> {
+    Err(InfraError::UnsupportedLanguage(String::from(
+        "the embedded Lua engine requires building with the `embedded-lua` feature",
+    )))
+}
+
+#[cfg(feature = "embedded-lua")]
+mod engine {
+    use std::{
+        cell::{Cell, RefCell},
+        os::unix::process::ExitStatusExt,
+        process::{ExitStatus, Output},
+        rc::Rc,
+        time::{Duration, Instant},
+    };
+
+    use mlua::{
+        Function, HookTriggers, Lua, LuaOptions, MultiValue, StdLib, Table, Value, Variadic,
+        VmState,
+    };
+
+    use super::{Budget, InfraError};
+
+    // How often the hook checks the budgets. Coarse enough to cost little,
+    // fine enough that a tight loop is caught within microseconds.
+    const HOOK_INTERVAL: u32 = 1000;
+
+    type Buffer = Rc<RefCell<Vec<u8>>>;
+
+    fn lua_error(err: mlua::Error) -> InfraError {
+        InfraError::CompilationError(err.to_string().into())
+    }
+
+    // What is left of stdin, consumed by `io.read`.
+    struct Stdin {
+        text: String,
+        position: usize,
+    }
+
+    impl Stdin {
+        fn rest(&self) -> &str {
+            &self.text[self.position..]
+        }
+
+        // The next line, with its newline when `keep_newline` is set.
+        fn line(&mut self, keep_newline: bool) -> Option<String> {
+            let rest = self.rest();
+            if rest.is_empty() {
+                return None;
+            }
+            let end = rest.find('\n').map_or(rest.len(), |end| end + 1);
+            let line = &rest[..end];
+            let line = if keep_newline {
+                line.to_string()
+            } else {
+                line.trim_end_matches(['\n', '\r']).to_string()
+            };
+            self.position += end;
+            Some(line)
+        }
+
+        // Integers stay integers, as with the standalone interpreter.
+        fn number(&mut self) -> Option<Value> {
+            let rest = self.rest();
+            let start = rest.len() - rest.trim_start().len();
+            let token = rest[start..].split_whitespace().next()?;
+            let number = match token.parse::<i64>() {
+                Ok(integer) => Value::Integer(integer),
+                Err(_) => Value::Number(token.parse::<f64>().ok()?),
+            };
+            let consumed = start + token.len();
+            self.position += consumed;
+            Some(number)
+        }
+
+        fn all(&mut self) -> String {
+            let rest = self.rest().to_string();
+            self.position = self.text.len();
+            rest
+        }
+    }
+
+    fn write_values(
+        lua: &Lua,
+        buffer: &Buffer,
+        values: MultiValue,
+        separator: &[u8],
+    ) -> mlua::Result<()> {
+        // `tostring` can run a __tostring metamethod that prints, so the
+        // buffer is only borrowed once every value is converted.
+        let tostring: Function = lua.globals().get("tostring")?;
+        let mut line = Vec::new();
+        for (i, value) in values.into_iter().enumerate() {
+            if i > 0 {
+                line.extend_from_slice(separator);
+            }
+            let text: mlua::String = tostring.call(value)?;
+            line.extend_from_slice(&text.as_bytes());
+        }
+        buffer.borrow_mut().extend_from_slice(&line);
+        Ok(())
+    }
+
+    fn read(lua: &Lua, stdin: &RefCell<Stdin>, format: Option<Value>) -> mlua::Result<Value> {
+        let format = match format {
+            Some(Value::String(format)) => format.to_str()?.trim_start_matches('*').to_string(),
+            Some(Value::Integer(count)) => {
+                let mut stdin = stdin.borrow_mut();
+                let rest = stdin.rest();
+                if rest.is_empty() {
+                    return Ok(Value::Nil);
+                }
+                let end = rest
+                    .char_indices()
+                    .nth(count.max(0) as usize)
+                    .map_or(rest.len(), |(end, _)| end);
+                let chunk = rest[..end].to_string();
+                stdin.position += end;
+                return lua.create_string(chunk).map(Value::String);
+            }
+            _ => String::from("l"),
+        };
+        let mut stdin = stdin.borrow_mut();
+        match format.chars().next() {
+            Some('n') => Ok(stdin.number().unwrap_or(Value::Nil)),
+            Some('a') => lua.create_string(stdin.all()).map(Value::String),
+            Some('L') => match stdin.line(true) {
+                Some(line) => lua.create_string(line).map(Value::String),
+                None => Ok(Value::Nil),
+            },
+            _ => match stdin.line(false) {
+                Some(line) => lua.create_string(line).map(Value::String),
+                None => Ok(Value::Nil),
+            },
+        }
+    }
+
+    fn install_globals(
+        lua: &Lua,
+        stdin: &str,
+        args: Vec<String>,
+        stdout: &Buffer,
+        stderr: &Buffer,
+    ) -> mlua::Result<()> {
+        let globals = lua.globals();
+        // Both read files by name.
+        globals.set("dofile", Value::Nil)?;
+        globals.set("loadfile", Value::Nil)?;
+
+        let out = stdout.clone();
+        globals.set(
+            "print",
+            lua.create_function(move |lua, values: MultiValue| {
+                write_values(lua, &out, values, b"\t")?;
+                out.borrow_mut().push(b'\n');
+                Ok(())
+            })?,
+        )?;
+
+        let stdin = Rc::new(RefCell::new(Stdin {
+            text: stdin.to_string(),
+            position: 0,
+        }));
+        let io: Table = lua.create_table()?;
+        let out = stdout.clone();
+        io.set(
+            "write",
+            lua.create_function(move |lua, values: MultiValue| {
+                write_values(lua, &out, values, b"")
+            })?,
+        )?;
+        let input = stdin.clone();
+        io.set(
+            "read",
+            lua.create_function(move |lua, format: Option<Value>| read(lua, &input, format))?,
+        )?;
+        let lines = lua.create_function(move |lua, ()| {
+            let input = stdin.clone();
+            lua.create_function(move |lua, ()| read(lua, &input, None))
+        })?;
+        io.set("lines", lines)?;
+        let err = stderr.clone();
+        let stderr_table: Table = lua.create_table()?;
+        stderr_table.set(
+            "write",
+            lua.create_function(move |lua, values: Variadic<Value>| {
+                // Called as io.stderr:write(...), so the first value is the
+                // table itself.
+                let values = values.into_iter().skip(1).collect::<MultiValue>();
+                write_values(lua, &err, values, b"")
+            })?,
+        )?;
+        io.set("stderr", stderr_table)?;
+        globals.set("io", io)?;
+
+        let started = Instant::now();
+        let os: Table = lua.create_table()?;
+        os.set(
+            "clock",
+            lua.create_function(move |_, ()| Ok(started.elapsed().as_secs_f64()))?,
+        )?;
+        os.set(
+            "time",
+            lua.create_function(|_, ()| Ok(chrono::Utc::now().timestamp()))?,
+        )?;
+        globals.set("os", os)?;
+
+        let arg: Table = lua.create_table()?;
+        arg.set(0, "main.lua")?;
+        for (i, value) in args.into_iter().enumerate() {
+            arg.set(i + 1, value)?;
+        }
+        globals.set("arg", arg)?;
+        Ok(())
+    }
+
+    pub fn run(
+        source: &str,
+        stdin: &str,
+        args: Vec<String>,
+        timeout: Option<Duration>,
+        budget: Budget,
+    ) -> Result<Output, InfraError> {
+        let libs = StdLib::STRING | StdLib::TABLE | StdLib::MATH | StdLib::UTF8 | StdLib::COROUTINE;
+        let lua = Lua::new_with(libs, LuaOptions::default()).map_err(lua_error)?;
+        lua.set_memory_limit(budget.memory_bytes)
+            .map_err(lua_error)?;
+
+        let deadline = timeout.map(|limit| Instant::now() + limit);
+        let timed_out = Rc::new(Cell::new(false));
+        let executed = Cell::new(0u64);
+        let expired = timed_out.clone();
+        lua.set_hook(
+            HookTriggers::new().every_nth_instruction(HOOK_INTERVAL),
+            move |_, _| {
+                if deadline.is_some_and(|deadline| Instant::now() >= deadline) {
+                    expired.set(true);
+                    return Err(mlua::Error::runtime("time limit exceeded"));
+                }
+                executed.set(executed.get() + u64::from(HOOK_INTERVAL));
+                match budget.instructions {
+                    Some(limit) if executed.get() > limit => Err(mlua::Error::runtime(format!(
+                        "instruction limit of {} exceeded",
+                        limit
+                    ))),
+                    _ => Ok(VmState::Continue),
+                }
+            },
+        );
+
+        let stdout = Buffer::default();
+        let stderr = Buffer::default();
+        install_globals(&lua, stdin, args, &stdout, &stderr).map_err(lua_error)?;
+        let code = match lua.load(source).set_name("main.lua").exec() {
+            Ok(()) => 0,
+            Err(err) => {
+                let mut stderr = stderr.borrow_mut();
+                stderr.extend_from_slice(err.to_string().as_bytes());
+                stderr.push(b'\n');
+                1
+            }
+        };
+        if let (true, Some(limit)) = (timed_out.get(), timeout) {
+            return Err(InfraError::timeout(limit));
+        }
+
+        let (stdout, stderr) = (stdout.take(), stderr.take());
+        Ok(Output {
+            status: ExitStatus::from_raw(code << 8),
+            stdout,
+            stderr,
+        })
+    }
+}
+
 #[cfg(test)]
 mod lua_tests {
-    use crate::infra::lua::compile_lua;
+    use crate::infra::lua::{Budget, LuaEngine, compile_lua, run_embedded};
+    use crate::infra::runner::ExecContext;
+
+    const BUDGET: Budget = Budget {
+        memory_bytes: 16 << 20,
+        instructions: None,
+    };
+
+    #[test]
+    fn test_parse_engine() {
+        assert_eq!(
+            "External".parse::<LuaEngine>().unwrap(),
+            LuaEngine::External
+        );
+        assert_eq!(
+            "embedded".parse::<LuaEngine>().is_ok(),
+            LuaEngine::AVAILABLE
+        );
+        assert!("luajit".parse::<LuaEngine>().is_err());
+    }
+
+    #[cfg(not(feature = "embedded-lua"))]
+    #[tokio::test]
+    async fn test_embedded_needs_the_feature() {
+        let result = run_embedded("print(1)", "", &ExecContext::default(), BUDGET).await;
+        assert!(result.is_err());
+    }
+
+    #[cfg(feature = "embedded-lua")]
+    #[tokio::test]
+    async fn test_embedded_reads_stdin_and_args() {
+        let script = r#"
+for line in io.lines() do print(line:upper(), arg[1]) end
+io.write("done", "\n")
+"#;
+        let ctx = ExecContext::default().with_args(vec!["!".into()]);
+        let output = run_embedded(script, "a\nb\n", &ctx, BUDGET).await.unwrap();
+        assert_eq!(output.stdout, b"A\t!\nB\t!\ndone\n");
+        assert!(output.status.success());
+
+        let output = run_embedded("local n = io.read('n') print(n * 2)", " 21\n", &ctx, BUDGET)
+            .await
+            .unwrap();
+        assert_eq!(output.stdout, b"42\n");
+    }
+
+    #[cfg(feature = "embedded-lua")]
+    #[tokio::test]
+    async fn test_embedded_has_no_filesystem_or_processes() {
+        let ctx = ExecContext::default();
+        for script in [
+            "os.execute('id')",
+            "io.open('/etc/passwd')",
+            "dofile('/etc/passwd')",
+            "require('os')",
+        ] {
+            let output = run_embedded(script, "", &ctx, BUDGET).await.unwrap();
+            assert_eq!(output.status.code(), Some(1), "{}", script);
+        }
+    }
+
+    #[cfg(feature = "embedded-lua")]
+    #[tokio::test]
+    async fn test_embedded_enforces_budgets() {
+        let ctx = ExecContext::default().with_timeout(std::time::Duration::from_millis(100));
+        let err = run_embedded("while true do end", "", &ctx, BUDGET)
+            .await
+            .unwrap_err();
+        assert!(matches!(err, crate::infra::error::InfraError::Timeout(..)));
+
+        let counted = Budget {
+            instructions: Some(100_000),
+            ..BUDGET
+        };
+        let output = run_embedded("while true do end", "", &ExecContext::default(), counted)
+            .await
+            .unwrap();
+        assert_eq!(output.status.code(), Some(1));
+        assert!(String::from_utf8_lossy(&output.stderr).contains("instruction limit"));
+
+        let hog = "local t = {} while true do t[#t + 1] = string.rep('x', 1 << 20) end";
+        let output = run_embedded(hog, "", &ExecContext::default(), BUDGET)
+            .await
+            .unwrap();
+        assert_eq!(output.status.code(), Some(1));
+    }
 
     #[tokio::test]
     async fn test_simple_hello_world() {
@@ -56,7 +510,7 @@ mod lua_tests {
 print("Hello, World!")
 "#;
 
-        let result = compile_lua(lua_code, "").await;
+        let result = compile_lua(lua_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
     }
@@ -69,7 +523,7 @@ local b = 3
 print(a + b)
 "#;
 
-        let result = compile_lua(lua_code, "").await;
+        let result = compile_lua(lua_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "8");
     }
@@ -81,7 +535,7 @@ local num = io.read("*number")
 print("You entered: " .. num)
 "#;
 
-        let result = compile_lua(lua_code, "42").await;
+        let result = compile_lua(lua_code, "42", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "You entered: 42");
     }
@@ -93,7 +547,7 @@ local name = io.read()
 print("Hello, " .. name .. "!")
 "#;
 
-        let result = compile_lua(lua_code, "Alice").await;
+        let result = compile_lua(lua_code, "Alice", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, Alice!");
     }
@@ -106,7 +560,7 @@ for i = 1, 3 do
 end
 "#;
 
-        let result = compile_lua(lua_code, "").await;
+        let result = compile_lua(lua_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Line 1"));
@@ -120,7 +574,7 @@ end
 print("Missing closing quote
 "#;
 
-        let result = compile_lua(invalid_lua_code, "").await;
+        let result = compile_lua(invalid_lua_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -130,7 +584,7 @@ print("Missing closing quote
 error("compiletime error")
 "#;
 
-        let result = compile_lua(lua_code, "").await;
+        let result = compile_lua(lua_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -144,7 +598,7 @@ print("Sum: " .. (a + b))
 print("Product: " .. (a * b))
 "#;
 
-        let result = compile_lua(lua_code, "7 3").await;
+        let result = compile_lua(lua_code, "7 3", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Sum: 10"));
@@ -156,7 +610,7 @@ print("Product: " .. (a * b))
         let lua_code = r#"
 "#;
 
-        let result = compile_lua(lua_code, "").await;
+        let result = compile_lua(lua_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
@@ -168,7 +622,7 @@ local str = "Hello"
 print("Length: " .. #str)
 "#;
 
-        let result = compile_lua(lua_code, "").await;
+        let result = compile_lua(lua_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Length: 5");
     }
@@ -180,7 +634,7 @@ local x = 16.0
 print(string.format("Square root of %s is %s", x, math.sqrt(x)))
 "#;
 
-        let result = compile_lua(lua_code, "").await;
+        let result = compile_lua(lua_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Square root of 16 is 4");
     }
@@ -194,7 +648,7 @@ end)
 coroutine.resume(co)
 "#;
 
-        let result = compile_lua(lua_code, "").await;
+        let result = compile_lua(lua_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Coroutine compilening");
     }
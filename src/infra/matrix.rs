@@ -0,0 +1,208 @@
+use std::{collections::BTreeMap, path::PathBuf, str::FromStr, time::Instant};
+
+use futures_util::future::join_all;
+use serde::Serialize;
+use utoipa::ToSchema;
+use uuid::Uuid;
+
+use super::{
+    compile::compile_lang,
+    events::Submitter,
+    logs::{RunStatus, logged},
+    runner::ExecContext,
+};
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ToolchainVersion {
+    pub name: String,
+    pub dir: PathBuf,
+}
+
+// Installed versions per language, parsed from a comma-separated list of
+// `lang:version=dir` entries where `dir` holds that version's binaries.
+// Versions keep the order they were configured in.
+#[derive(Debug, Clone, Default)]
+pub struct ToolchainVersions {
+    versions: BTreeMap<String, Vec<ToolchainVersion>>,
+}
+
+impl FromStr for ToolchainVersions {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut versions: BTreeMap<String, Vec<ToolchainVersion>> = BTreeMap::new();
+        for entry in s.split(',').map(str::trim).filter(|entry| !entry.is_empty()) {
+            let parsed = entry
+                .split_once('=')
+                .and_then(|(key, dir)| Some((key.split_once(':')?, dir)));
+            let Some(((lang, name), dir)) = parsed else {
+                return Err(format!(
+                    "invalid toolchain version {:?}, expected lang:version=dir",
+                    entry
+                ));
+            };
+            let lang = lang.trim().to_lowercase();
+            let name = name.trim();
+            let listed = versions.entry(lang.clone()).or_default();
+            if lang.is_empty() || name.is_empty() || listed.iter().any(|v| v.name == name) {
+                return Err(format!("invalid or duplicate toolchain version {:?}", entry));
+            }
+            listed.push(ToolchainVersion {
+                name: name.to_string(),
+                dir: PathBuf::from(dir.trim()),
+            });
+        }
+        Ok(ToolchainVersions { versions })
+    }
+}
+
+impl ToolchainVersions {
+    pub fn for_lang(&self, lang: &str) -> &[ToolchainVersion] {
+        self.versions
+            .get(&lang.to_lowercase())
+            .map(Vec::as_slice)
+            .unwrap_or_default()
+    }
+
+    // The installed version `requested` names: an exact match, or else the
+    // newest one it is a prefix of, so "3.12" can stand for "3.12.4".
+    pub fn resolve(&self, lang: &str, requested: &str) -> Option<&ToolchainVersion> {
+        let installed = self.for_lang(lang);
+        let requested = requested.trim();
+        if let Some(exact) = installed.iter().find(|version| version.name == requested) {
+            return Some(exact);
+        }
+        let prefix = format!("{}.", requested);
+        installed
+            .iter()
+            .filter(|version| version.name.starts_with(&prefix))
+            .max_by_key(|version| version_key(&version.name))
+    }
+}
+
+fn version_key(name: &str) -> Vec<u64> {
+    name.split('.')
+        .map(|part| part.parse().unwrap_or_default())
+        .collect()
+}
+
+#[derive(Debug, Clone, Serialize, ToSchema)]
+pub struct MatrixResult {
+    pub id: String,
+    #[schema(example = "3.11")]
+    pub version: String,
+    pub status: RunStatus,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub output: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+    pub duration_ms: u64,
+}
+
+// Runs the same submission once per version, concurrently, returning the
+// results in the order the versions were given. A failing version does not
+// affect the others.
+pub async fn run_matrix(
+    lang: &str,
+    content: &str,
+    stdin: &str,
+    ctx: &ExecContext,
+    submitter: &Submitter,
+    versions: &[&ToolchainVersion],
+) -> Vec<MatrixResult> {
+    join_all(versions.iter().map(|version| async move {
+        let id = Uuid::new_v4().to_string();
+        let ctx = ctx.clone().with_toolchain_dir(version.dir.clone());
+        let started = Instant::now();
+        let run = compile_lang(lang, content, stdin, &ctx);
+        let result = logged(&id, lang, content, submitter, run).await;
+        let duration_ms = started.elapsed().as_millis() as u64;
+
+        let status = RunStatus::of(&result);
+        let (output, error) = match result {
+            Ok(output) => (Some(output), None),
+            Err(err) => (None, Some(err.to_string())),
+        };
+        MatrixResult {
+            id,
+            version: version.name.clone(),
+            status,
+            output,
+            error,
+            duration_ms,
+        }
+    }))
+    .await
+}
+
+#[cfg(test)]
+mod matrix_tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_parse_groups_versions_by_language_in_order() {
+        let versions: ToolchainVersions =
+            "python:3.11=/opt/py311/bin, Python:3.9=/opt/py39/bin,rust:1.80=/opt/rust/bin"
+                .parse()
+                .unwrap();
+        let names: Vec<_> = versions
+            .for_lang("python")
+            .iter()
+            .map(|v| v.name.as_str())
+            .collect();
+        assert_eq!(names, ["3.11", "3.9"]);
+        assert_eq!(versions.for_lang("rust")[0].dir, PathBuf::from("/opt/rust/bin"));
+        assert!(versions.for_lang("go").is_empty());
+
+        assert!("".parse::<ToolchainVersions>().unwrap().for_lang("python").is_empty());
+        assert!("python=/opt".parse::<ToolchainVersions>().is_err());
+        assert!("python:3.9=/a,python:3.9=/b".parse::<ToolchainVersions>().is_err());
+    }
+
+    #[test]
+    fn test_resolve_prefers_exact_then_newest_matching() {
+        let versions: ToolchainVersions =
+            "python:3.12.10=/a,python:3.12.9=/b,python:3.11=/c,python:3=/d"
+                .parse()
+                .unwrap();
+        let resolved = |requested| versions.resolve("python", requested).map(|v| &v.name[..]);
+        assert_eq!(resolved("3.11"), Some("3.11"));
+        assert_eq!(resolved("3.12"), Some("3.12.10"));
+        assert_eq!(resolved("3"), Some("3"));
+        assert_eq!(resolved("3.1"), None);
+        assert_eq!(resolved("2"), None);
+        assert!(versions.resolve("go", "1.22").is_none());
+    }
+
+    #[tokio::test]
+    async fn test_run_matrix_reports_each_version_separately() {
+        let python = which::which("python3").unwrap();
+        let installed = ToolchainVersion {
+            name: "installed".into(),
+            dir: python.parent().unwrap().to_path_buf(),
+        };
+        let empty = TempDir::new().unwrap();
+        let missing = ToolchainVersion {
+            name: "missing".into(),
+            dir: empty.path().to_path_buf(),
+        };
+
+        let results = run_matrix(
+            "python",
+            "print('hi')",
+            "",
+            &ExecContext::default(),
+            &Submitter::default(),
+            &[&installed, &missing],
+        )
+        .await;
+
+        assert_eq!(results[0].version, "installed");
+        assert_eq!(results[0].status, RunStatus::Succeeded);
+        assert_eq!(results[0].output.as_deref(), Some("hi\n"));
+        assert_eq!(results[1].version, "missing");
+        assert_eq!(results[1].status, RunStatus::Failed);
+        assert!(results[1].error.is_some());
+    }
+}
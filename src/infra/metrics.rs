@@ -0,0 +1,81 @@
+use std::{collections::BTreeMap, fmt::Write, sync::Mutex};
+
+type Labels = Vec<(String, String)>;
+
+static COUNTERS: Mutex<BTreeMap<&'static str, BTreeMap<Labels, u64>>> = Mutex::new(BTreeMap::new());
+
+fn owned(labels: &[(&str, &str)]) -> Labels {
+    labels
+        .iter()
+        .map(|(key, value)| (key.to_string(), value.to_string()))
+        .collect()
+}
+
+pub fn increment(name: &'static str, labels: &[(&str, &str)]) {
+    add(name, labels, 1);
+}
+
+pub fn add(name: &'static str, labels: &[(&str, &str)], value: u64) {
+    let mut counters = COUNTERS.lock().unwrap();
+    *counters
+        .entry(name)
+        .or_default()
+        .entry(owned(labels))
+        .or_default() += value;
+}
+
+pub fn counter(name: &'static str, labels: &[(&str, &str)]) -> u64 {
+    let counters = COUNTERS.lock().unwrap();
+    counters
+        .get(name)
+        .and_then(|series| series.get(&owned(labels)))
+        .copied()
+        .unwrap_or(0)
+}
+
+fn escape(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+// Renders every counter in the Prometheus text exposition format.
+pub fn render() -> String {
+    let counters = COUNTERS.lock().unwrap();
+    let mut out = String::new();
+    for (name, series) in counters.iter() {
+        let _ = writeln!(out, "# TYPE {} counter", name);
+        for (labels, value) in series {
+            if labels.is_empty() {
+                let _ = writeln!(out, "{} {}", name, value);
+                continue;
+            }
+            let labels = labels
+                .iter()
+                .map(|(key, value)| format!("{}=\"{}\"", key, escape(value)))
+                .collect::<Vec<_>>()
+                .join(",");
+            let _ = writeln!(out, "{}{{{}}} {}", name, labels, value);
+        }
+    }
+    out
+}
+
+#[cfg(test)]
+mod metrics_tests {
+    use super::*;
+
+    #[test]
+    fn test_render_groups_series_by_name() {
+        increment("metrics_test_total", &[("action", "a\"b")]);
+        add("metrics_test_total", &[("action", "a\"b")], 2);
+        increment("metrics_test_total", &[]);
+
+        assert_eq!(counter("metrics_test_total", &[("action", "a\"b")]), 3);
+        let text = render();
+        assert!(text.contains("# TYPE metrics_test_total counter\n"));
+        assert!(text.contains("metrics_test_total 1\n"));
+        assert!(text.contains("metrics_test_total{action=\"a\\\"b\"} 3\n"));
+    }
+}
@@ -1,22 +1,96 @@
+pub mod arch;
+pub mod archive;
+pub mod artifacts;
+pub mod audit;
+pub mod blobs;
+pub mod build_cache;
 mod c;
+pub mod calibration;
+pub mod canary;
+pub mod catalog;
+pub mod chaos;
+pub mod compare;
 pub mod compile;
+pub mod coverage;
+pub mod cpuset;
 mod cpp;
+pub mod crash;
+pub mod cross;
 mod crystal;
 mod d;
 mod dart;
+pub mod detect;
+pub mod disk;
+pub mod dispatch;
+mod elixir;
 pub mod error;
-mod go;
+pub mod events;
+pub mod fsview;
+pub mod executions;
+mod fortran;
+pub mod images;
+pub mod interactive;
+mod interpreter;
+pub mod go;
+pub mod groups;
+pub mod history;
+pub mod hooks;
+pub mod idempotency;
+pub mod imports;
 mod groovy;
-mod javascript;
-mod julia;
-mod lua;
+pub mod javascript;
+pub mod jobs;
+pub mod judge;
+pub mod language;
+pub mod limits;
+pub mod load;
+pub mod locale;
+pub mod logs;
+pub mod lint;
+pub mod lua;
+pub mod matrix;
+pub mod metrics;
 mod nix;
-mod perl;
-mod python;
+pub mod outputs;
+mod ocaml;
+pub mod plugin;
+pub mod policy;
+pub mod profile;
+pub mod python;
+pub mod quickjs;
 mod r;
+pub mod regrade;
+pub mod reload;
 mod ruby;
+pub mod runner;
 mod rust;
 mod scala;
+pub mod sandbox;
+pub mod sanitizer;
+pub mod scheduler;
+pub mod seccomp;
+pub mod session;
+pub mod shared_build;
+pub mod signing;
+mod snippet;
+pub mod source;
+pub mod store;
+mod swift;
+pub mod tenants;
+pub mod throttle;
+pub mod tier;
+pub mod tls;
+pub mod trace;
+pub mod toolchain;
+pub mod transcript;
+pub mod verdicts;
+pub mod warm;
+pub mod wasm;
+pub mod workspace;
 mod zig;
 mod haskell;
+mod bash;
+mod assembly;
+mod sql;
+mod starlark;
 mod brainfuck;
@@ -1,35 +1,24 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
-
-pub async fn compile_nix(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".nix")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
-
-    let source_path = temp_file.path().to_path_buf();
-
-    let eval_output = Command::new(which("nix")?)
-        .arg("eval")
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+};
+
+pub async fn compile_nix(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::NIX, content)?;
+    let source_path = source.path().to_path_buf();
+
+    let mut cmd = ctx.command("nix")?;
+    cmd.arg("eval")
         .arg("--file")
         .arg(&source_path)
-        .arg("--raw")
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    let mut cmd = eval_output;
-    
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
-
-    let output = cmd.wait_with_output().await?;
+        .arg("--raw");
+    let output = run_program(&mut cmd, stdin_input, ctx).await?;
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
         Some(code) => {
@@ -58,7 +47,7 @@ mod test {
     #[tokio::test]
     async fn test_simple_string() {
         let code = r#""Hello, World!""#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
     }
@@ -66,7 +55,7 @@ mod test {
     #[tokio::test]
     async fn test_arithmetic() {
         let code = r#"toString (5 + 3)"#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "8");
     }
@@ -80,7 +69,7 @@ let
 in
   toString sum
 "#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "15");
     }
@@ -93,7 +82,7 @@ let
 in
   "Hello, ${person.name}!"
 "#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, Alice!");
     }
@@ -106,7 +95,7 @@ let
 in
   greet "World"
 "#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
     }
@@ -119,7 +108,7 @@ let
 in
   if x > 3 then "greater" else "smaller"
 "#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "greater");
     }
@@ -133,7 +122,7 @@ let
 in
   "Using ${name} version ${version}"
 "#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Using Nix version 2.0");
     }
@@ -147,7 +136,7 @@ let
 in
   toString (builtins.foldl' (acc: x: acc + x) 0 doubled)
 "#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "12");
     }
@@ -160,7 +149,7 @@ let
 in
   with attrs; toString (x + y)
 "#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "30");
     }
@@ -174,7 +163,7 @@ let
 in
   toString (builtins.length words)
 "#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "3");
     }
@@ -188,7 +177,7 @@ let
 in
   x + y
 "#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -200,21 +189,21 @@ let
 in
   x
 "#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
     #[tokio::test]
     async fn test_type_error() {
         let code = r#"1 + "string""#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
     #[tokio::test]
     async fn test_empty_expression() {
         let code = r#""""#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
@@ -229,7 +218,7 @@ let
 in
   toString (compute 5)
 "#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "13");
     }
@@ -242,7 +231,7 @@ let
 in
   toString path
 "#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "/tmp/test.txt");
     }
@@ -256,7 +245,7 @@ let
 in
   toString (a && !b)
 "#;
-        let result = compile_nix(code, "").await;
+        let result = compile_nix(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "1");
     }
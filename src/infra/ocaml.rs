@@ -0,0 +1,119 @@
+use super::{
+    error::InfraError,
+    language::Language,
+    lint::{Severity, from_ocaml},
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+};
+
+// Runs the program in the toplevel's script mode, which type checks it as a
+// whole before running any of it. Both a rejected program and an uncaught
+// exception exit with status 2, so the two are told apart by whether the
+// toplevel reported an error at a location.
+pub async fn compile_ocaml(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::OCAML, content)?;
+    let source_path = source.path().to_path_buf();
+
+    let mut cmd = ctx.command("ocaml")?;
+    cmd.arg(source_path);
+    let output = run_program(&mut cmd, stdin_input, ctx).await?;
+    match output.status.code() {
+        Some(0) => Ok(String::from_utf8(output.stdout)?),
+        Some(code) => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            let file = Language::OCAML.source_file_name();
+            if from_ocaml(&stderr, file)
+                .iter()
+                .any(|diagnostic| diagnostic.severity == Severity::Error)
+            {
+                return Err(InfraError::CompileError(format!(
+                    "OCaml compilation failed:\n{}",
+                    stderr
+                )));
+            }
+            Err(InfraError::CompilationError(
+                format!(
+                    "OCaml program execution failed with status code: {}\nError: {}",
+                    code, stderr
+                )
+                .into(),
+            ))
+        }
+        None => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!("OCaml program terminated by signal\nError: {}", stderr).into(),
+            ))
+        }
+    }
+}
+
+#[cfg(test)]
+mod ocaml_tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_simple_hello_world() {
+        let ocaml_code = r#"
+let () = print_endline "Hello, World!"
+"#;
+
+        let result = compile_ocaml(ocaml_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Hello, World!");
+    }
+
+    #[tokio::test]
+    async fn test_stdin_input() {
+        let ocaml_code = r#"
+let () =
+  let name = read_line () in
+  Printf.printf "Hello, %s!\n" name
+"#;
+
+        let result = compile_ocaml(ocaml_code, "Alice\n", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Hello, Alice!");
+    }
+
+    #[tokio::test]
+    async fn test_complex_stdin_processing() {
+        let ocaml_code = r#"
+let () =
+  Scanf.scanf " %d %d" (fun a b ->
+    Printf.printf "Sum: %d\n" (a + b);
+    Printf.printf "Product: %d\n" (a * b))
+"#;
+
+        let result = compile_ocaml(ocaml_code, "7 3\n", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        let output = result.unwrap();
+        assert!(output.contains("Sum: 10"));
+        assert!(output.contains("Product: 21"));
+    }
+
+    #[tokio::test]
+    async fn test_type_error_is_a_compile_error() {
+        let ocaml_code = r#"
+let () = print_endline "printed before the error?"
+let () = print_int "not a number"
+"#;
+
+        let result = compile_ocaml(ocaml_code, "", &ExecContext::default()).await;
+        assert!(matches!(result, Err(InfraError::CompileError(_))));
+    }
+
+    #[tokio::test]
+    async fn test_runtime_error() {
+        let ocaml_code = r#"
+let () = failwith "Runtime error"
+"#;
+
+        let result = compile_ocaml(ocaml_code, "", &ExecContext::default()).await;
+        assert!(matches!(result, Err(InfraError::CompilationError(_))));
+    }
+}
@@ -0,0 +1,189 @@
+use std::{fs, io, path::Path};
+
+use base64::{Engine, engine::general_purpose::STANDARD};
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+
+use super::{
+    artifacts::{self, Artifact},
+    runner::OutputEncoding,
+    workspace::FileEntry,
+};
+
+// How the files a program wrote come back, beyond their metadata.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+#[serde(rename_all = "lowercase")]
+pub enum FileContents {
+    // Base64-encoded into the response.
+    Inline,
+    // Kept for download from /api/v1/artifacts/{id}.
+    Link,
+}
+
+impl FileContents {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            FileContents::Inline => "inline",
+            FileContents::Link => "link",
+        }
+    }
+}
+
+// Attaches the contents of `files`, which are relative to `root`. Once
+// `max_files` or `max_bytes` would be exceeded the remaining files keep
+// only their metadata, so every file that has contents has all of them.
+pub fn attach_contents(
+    root: &Path,
+    files: &mut [FileEntry],
+    contents: FileContents,
+    max_files: usize,
+    max_bytes: u64,
+) -> io::Result<()> {
+    let (mut count, mut total) = (0, 0);
+    for entry in files {
+        if count == max_files || total + entry.size > max_bytes {
+            tracing::debug!("leaving out {}: file contents limit reached", entry.path);
+            continue;
+        }
+        let bytes = fs::read(root.join(&entry.path))?;
+        count += 1;
+        total += entry.size;
+        match contents {
+            FileContents::Inline => entry.data = Some(STANDARD.encode(bytes)),
+            FileContents::Link => {
+                let file_name = Path::new(&entry.path)
+                    .file_name()
+                    .map(|name| name.to_string_lossy().into_owned())
+                    .unwrap_or_else(|| entry.path.clone());
+                let id = artifacts::keep(&Artifact { file_name, bytes })?;
+                entry.url = Some(artifacts::url(&id));
+            }
+        }
+    }
+    Ok(())
+}
+
+// Keeps all of `result` for download once it is longer than `inline_bytes`,
+// leaving only its start in `result`, and returns where it is downloaded
+// from. Base64 output is kept decoded and cut where its start still
+// decodes.
+pub fn spill_output(
+    result: &mut String,
+    inline_bytes: usize,
+    encoding: OutputEncoding,
+) -> io::Result<Option<String>> {
+    if result.len() <= inline_bytes {
+        return Ok(None);
+    }
+    let (artifact, mut end) = match encoding {
+        OutputEncoding::Text => (
+            Artifact {
+                file_name: String::from("output.txt"),
+                bytes: result.as_bytes().to_vec(),
+            },
+            inline_bytes,
+        ),
+        OutputEncoding::Base64 => (
+            Artifact {
+                file_name: String::from("output.bin"),
+                bytes: STANDARD
+                    .decode(result.as_bytes())
+                    .map_err(|err| io::Error::new(io::ErrorKind::InvalidData, err))?,
+            },
+            inline_bytes / 4 * 4,
+        ),
+    };
+    let id = artifacts::keep(&artifact)?;
+    while !result.is_char_boundary(end) {
+        end -= 1;
+    }
+    result.truncate(end);
+    Ok(Some(artifacts::url(&id)))
+}
+
+#[cfg(test)]
+mod outputs_tests {
+    use std::time::Duration;
+
+    use super::*;
+    use crate::infra::workspace::Snapshot;
+    use tempfile::TempDir;
+
+    fn written(files: &[(&str, &[u8])]) -> (TempDir, Vec<FileEntry>) {
+        let dir = TempDir::new().unwrap();
+        let before = Snapshot::take(dir.path()).unwrap();
+        for (path, contents) in files {
+            let path = dir.path().join(path);
+            fs::create_dir_all(path.parent().unwrap()).unwrap();
+            fs::write(path, contents).unwrap();
+        }
+        let changes = Snapshot::take(dir.path()).unwrap().changes_since(&before);
+        (dir, changes)
+    }
+
+    #[test]
+    fn test_inline_contents_stop_at_the_limits() {
+        let (dir, mut files) = written(&[
+            ("a.csv", b"x,y\n"),
+            ("b.txt", b"0123456789"),
+            ("c.txt", b"z"),
+        ]);
+        attach_contents(dir.path(), &mut files, FileContents::Inline, 8, 6).unwrap();
+        let data: Vec<_> = files.iter().map(|file| file.data.as_deref()).collect();
+        assert_eq!(data, [Some("eCx5Cg=="), None, Some("eg==")]);
+
+        let (dir, mut files) = written(&[("a.txt", b"a"), ("b.txt", b"b")]);
+        attach_contents(dir.path(), &mut files, FileContents::Inline, 1, 1024).unwrap();
+        assert!(files[0].data.is_some());
+        assert!(files[1].data.is_none());
+    }
+
+    #[test]
+    fn test_links_point_at_kept_artifacts() {
+        let (dir, mut files) = written(&[("out/results.csv", b"x,y\n1,2\n")]);
+        attach_contents(dir.path(), &mut files, FileContents::Link, 8, 1024).unwrap();
+        let url = files[0].url.as_deref().unwrap();
+        let id = url.strip_prefix("/api/v1/artifacts/").unwrap();
+        let artifact = artifacts::load(id, Duration::from_secs(60))
+            .unwrap()
+            .unwrap();
+        assert_eq!(artifact.file_name, "results.csv");
+        assert_eq!(artifact.bytes, b"x,y\n1,2\n");
+        assert!(files[0].data.is_none());
+    }
+
+    fn kept(url: &str) -> Artifact {
+        let id = url.strip_prefix("/api/v1/artifacts/").unwrap();
+        artifacts::load(id, Duration::from_secs(60))
+            .unwrap()
+            .unwrap()
+    }
+
+    #[test]
+    fn test_spill_output_keeps_long_output_and_its_start() {
+        let mut short = String::from("hi\n");
+        assert!(
+            spill_output(&mut short, 3, OutputEncoding::Text)
+                .unwrap()
+                .is_none()
+        );
+        assert_eq!(short, "hi\n");
+
+        // Never cut inside a character.
+        let mut long = String::from("aé€\n");
+        let url = spill_output(&mut long, 3, OutputEncoding::Text)
+            .unwrap()
+            .unwrap();
+        assert_eq!(long, "aé");
+        let artifact = kept(&url);
+        assert_eq!(artifact.file_name, "output.txt");
+        assert_eq!(artifact.bytes, "aé€\n".as_bytes());
+
+        let mut encoded = STANDARD.encode(b"0123456789");
+        let url = spill_output(&mut encoded, 6, OutputEncoding::Base64)
+            .unwrap()
+            .unwrap();
+        assert_eq!(STANDARD.decode(&encoded).unwrap(), b"012");
+        assert_eq!(kept(&url).bytes, b"0123456789");
+    }
+}
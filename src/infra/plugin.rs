@@ -0,0 +1,576 @@
+use std::{
+    collections::BTreeMap,
+    fs,
+    os::unix::fs::PermissionsExt,
+    path::{Path, PathBuf},
+    process::Stdio,
+    sync::RwLock,
+    time::Duration,
+};
+
+use serde::{Deserialize, Serialize, de::DeserializeOwned};
+use tokio::{io::AsyncWriteExt, process::Command};
+
+use super::{
+    error::InfraError,
+    language::Language,
+    limits::LanguageLimits,
+    runner::{ExecContext, INHERITED_ENV, run_program},
+    source::SourceFile,
+};
+
+// How long a plugin has to answer `describe` or `run`, which only report.
+const CALL_TIMEOUT: Duration = Duration::from_secs(10);
+// How long `compile` has when the language sets no compile timeout.
+const COMPILE_TIMEOUT: Duration = Duration::from_secs(120);
+
+// What a plugin reports about itself in response to `describe`.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct PluginDescription {
+    pub name: String,
+    pub version: String,
+    pub source_file: String,
+    #[serde(default)]
+    pub compiled: bool,
+    #[serde(default)]
+    pub compiler_flags: Vec<String>,
+}
+
+#[derive(Serialize)]
+struct BuildRequest<'a> {
+    source: &'a Path,
+    workdir: &'a Path,
+    compiler_flags: &'a [String],
+}
+
+#[derive(Deserialize)]
+struct CompileResponse {
+    ok: bool,
+    #[serde(default)]
+    message: String,
+}
+
+#[derive(Deserialize)]
+struct RunResponse {
+    command: Vec<String>,
+}
+
+// A language declared by a `<name>.json` file in the plugins directory
+// instead of an executable. Each argument of `compile` and `run` may refer
+// to `{source}`, `{dir}` and `{exe}`, the path the compiler should write the
+// program to; an argument that is exactly `{flags}` expands to the
+// request's compiler flags.
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct LanguageTemplate {
+    #[serde(default)]
+    pub version: String,
+    pub extension: String,
+    #[serde(default)]
+    pub compile: Vec<String>,
+    pub run: Vec<String>,
+    // The flags requests may pass, as in `PluginDescription`.
+    #[serde(default)]
+    pub compiler_flags: Vec<String>,
+    #[serde(default)]
+    pub limits: LanguageLimits,
+}
+
+#[derive(Debug)]
+enum Implementation {
+    Executable(PathBuf),
+    Template(LanguageTemplate),
+}
+
+// An out-of-tree toolchain. The executable is invoked with one of
+// `describe`, `compile` or `run` as its only argument, a JSON request on
+// stdin and a JSON response expected on stdout. `run` answers with the
+// command line comphub should execute, so the program itself runs under the
+// same limits as built-in languages. Declared languages skip the executable
+// and build their command lines from a `LanguageTemplate`.
+#[derive(Debug)]
+pub struct Plugin {
+    implementation: Implementation,
+    description: PluginDescription,
+}
+
+impl Plugin {
+    pub async fn load(path: &Path) -> Result<Self, InfraError> {
+        let mut description: PluginDescription = call(path, "describe", &(), CALL_TIMEOUT).await?;
+
+        description.name = description.name.to_lowercase();
+        if description.name.is_empty() {
+            return Err(InfraError::Plugin(format!("{} has no name", path.display())));
+        }
+        let file_name = Path::new(&description.source_file);
+        if file_name.file_name() != Some(file_name.as_os_str()) {
+            return Err(InfraError::Plugin(format!(
+                "{} declares an invalid source file name: {}",
+                path.display(),
+                description.source_file
+            )));
+        }
+        Ok(Plugin {
+            implementation: Implementation::Executable(path.to_path_buf()),
+            description,
+        })
+    }
+
+    pub fn declared(path: &Path) -> Result<Self, InfraError> {
+        let invalid =
+            |reason: String| InfraError::Plugin(format!("{}: {}", path.display(), reason));
+        let name = path
+            .file_stem()
+            .and_then(|stem| stem.to_str())
+            .unwrap_or_default()
+            .to_lowercase();
+        if name.is_empty() {
+            return Err(invalid(String::from("no language name")));
+        }
+        let text = fs::read_to_string(path)?;
+        let template: LanguageTemplate =
+            serde_json::from_str(&text).map_err(|err| invalid(err.to_string()))?;
+        if template.extension.is_empty() || template.extension.contains('/') {
+            return Err(invalid(format!("invalid extension: {}", template.extension)));
+        }
+        if template.run.is_empty() {
+            return Err(invalid(String::from("empty run command")));
+        }
+
+        let description = PluginDescription {
+            name,
+            version: template.version.clone(),
+            source_file: format!("main.{}", template.extension),
+            compiled: !template.compile.is_empty(),
+            compiler_flags: template.compiler_flags.clone(),
+        };
+        Ok(Plugin {
+            implementation: Implementation::Template(template),
+            description,
+        })
+    }
+
+    pub fn name(&self) -> &str {
+        &self.description.name
+    }
+
+    pub fn description(&self) -> &PluginDescription {
+        &self.description
+    }
+
+    // Defaults a declared language sets for its own programs.
+    pub fn limits(&self) -> Option<&LanguageLimits> {
+        match &self.implementation {
+            Implementation::Executable(_) => None,
+            Implementation::Template(template) => Some(&template.limits),
+        }
+    }
+
+    pub async fn execute(
+        &self,
+        content: &str,
+        stdin_input: &str,
+        ctx: &ExecContext,
+    ) -> Result<String, InfraError> {
+        let source = SourceFile::named(&self.description.source_file, content)?;
+        let mut cmd = match &self.implementation {
+            Implementation::Executable(path) => self.build(path, &source, ctx).await?,
+            Implementation::Template(template) => {
+                self.build_template(template, &source, ctx).await?
+            }
+        };
+        let output = run_program(&mut cmd, stdin_input, ctx).await?;
+        match output.status.code() {
+            Some(0) => Ok(String::from_utf8(output.stdout)?),
+            Some(code) => {
+                let stderr = String::from_utf8_lossy(&output.stderr);
+                Err(InfraError::CompilationError(
+                    format!(
+                        "{} program execution failed with status code: {}\nError: {}",
+                        self.name(),
+                        code,
+                        stderr
+                    )
+                    .into(),
+                ))
+            }
+            None => {
+                let stderr = String::from_utf8_lossy(&output.stderr);
+                Err(InfraError::CompilationError(
+                    format!(
+                        "{} program terminated by signal\nError: {}",
+                        self.name(),
+                        stderr
+                    )
+                    .into(),
+                ))
+            }
+        }
+    }
+
+    async fn build(
+        &self,
+        path: &Path,
+        source: &SourceFile,
+        ctx: &ExecContext,
+    ) -> Result<Command, InfraError> {
+        let request = BuildRequest {
+            source: source.path(),
+            workdir: source.dir(),
+            compiler_flags: ctx.compiler_flags(),
+        };
+
+        if self.description.compiled {
+            let limit = ctx.compile_timeout().unwrap_or(COMPILE_TIMEOUT);
+            let compiled: CompileResponse = call(path, "compile", &request, limit).await?;
+            if !compiled.ok {
+                return Err(InfraError::CompilationError(
+                    format!("{} compilation failed:\n{}", self.name(), compiled.message).into(),
+                ));
+            }
+        }
+
+        let run: RunResponse = call(path, "run", &request, CALL_TIMEOUT).await?;
+        let Some((program, args)) = run.command.split_first() else {
+            return Err(InfraError::Plugin(format!(
+                "{} returned an empty command",
+                self.name()
+            )));
+        };
+        let mut cmd = Command::new(program);
+        cmd.args(args);
+        Ok(cmd)
+    }
+
+    async fn build_template(
+        &self,
+        template: &LanguageTemplate,
+        source: &SourceFile,
+        ctx: &ExecContext,
+    ) -> Result<Command, InfraError> {
+        let executable = source.dir().join("main");
+        let expand = |command: &[String]| {
+            expand_template(command, source.path(), source.dir(), &executable, ctx.compiler_flags())
+        };
+
+        if let Some((program, args)) = expand(&template.compile).split_first() {
+            let output = ctx
+                .command(program)?
+                .args(args)
+                .current_dir(source.dir())
+                .kill_on_drop(true)
+                .output()
+                .await?;
+            if !output.status.success() {
+                let stderr = String::from_utf8_lossy(&output.stderr);
+                return Err(InfraError::CompilationError(
+                    format!("{} compilation failed:\n{}", self.name(), stderr).into(),
+                ));
+            }
+        }
+
+        let run = expand(&template.run);
+        let Some((program, args)) = run.split_first() else {
+            return Err(InfraError::Plugin(format!("{} has an empty run command", self.name())));
+        };
+        let mut cmd = ctx.command(program)?;
+        cmd.args(args).current_dir(source.dir());
+        Ok(cmd)
+    }
+}
+
+fn expand_template(
+    command: &[String],
+    source: &Path,
+    dir: &Path,
+    executable: &Path,
+    flags: &[String],
+) -> Vec<String> {
+    let mut expanded = Vec::new();
+    for arg in command {
+        if arg == "{flags}" {
+            expanded.extend(flags.iter().cloned());
+            continue;
+        }
+        expanded.push(
+            arg.replace("{source}", &source.to_string_lossy())
+                .replace("{dir}", &dir.to_string_lossy())
+                .replace("{exe}", &executable.to_string_lossy()),
+        );
+    }
+    expanded
+}
+
+async fn call<Req: Serialize, Resp: DeserializeOwned>(
+    path: &Path,
+    action: &str,
+    request: &Req,
+    limit: Duration,
+) -> Result<Resp, InfraError> {
+    let body = serde_json::to_vec(request).map_err(|err| InfraError::Plugin(err.to_string()))?;
+    let mut cmd = Command::new(path);
+    cmd.arg(action).env_clear();
+    for key in INHERITED_ENV {
+        if let Some(value) = std::env::var_os(key) {
+            cmd.env(key, value);
+        }
+    }
+    let mut child = cmd
+        .kill_on_drop(true)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()?;
+
+    // Fed while the output is read, so a plugin that answers before it has
+    // read the whole request does not stall.
+    let mut stdin = child.stdin.take().expect("stdin is piped");
+    let feed = async move {
+        let _ = stdin.write_all(&body).await;
+    };
+    let run = async { tokio::join!(feed, child.wait_with_output()).1 };
+    let output = tokio::time::timeout(limit, run).await.map_err(|_| {
+        InfraError::Plugin(format!(
+            "{} {} gave no answer within {}s",
+            path.display(),
+            action,
+            limit.as_secs()
+        ))
+    })??;
+    if !output.status.success() {
+        return Err(InfraError::Plugin(format!(
+            "{} {} failed: {}",
+            path.display(),
+            action,
+            String::from_utf8_lossy(&output.stderr)
+        )));
+    }
+    serde_json::from_slice(&output.stdout).map_err(|err| {
+        InfraError::Plugin(format!(
+            "{} {} returned an invalid response: {}",
+            path.display(),
+            action,
+            err
+        ))
+    })
+}
+
+#[derive(Debug, Default)]
+pub struct PluginRegistry {
+    plugins: BTreeMap<String, Plugin>,
+}
+
+static NO_PLUGINS: PluginRegistry = PluginRegistry {
+    plugins: BTreeMap::new(),
+};
+
+// Replaced wholesale on reload. Requests in flight keep using the plugins
+// they resolved, so replaced registries are never freed.
+static PLUGINS: RwLock<&'static PluginRegistry> = RwLock::new(&NO_PLUGINS);
+
+pub fn plugins() -> &'static PluginRegistry {
+    *PLUGINS.read().unwrap()
+}
+
+// Discovers the plugins in `dir` and replaces the registered ones with them.
+pub async fn load_plugins(dir: &Path) {
+    let registry = PluginRegistry::discover(dir).await;
+    for plugin in registry.plugins.values() {
+        tracing::info!(
+            "registered language plugin {} {}",
+            plugin.name(),
+            plugin.description.version
+        );
+    }
+    *PLUGINS.write().unwrap() = Box::leak(Box::new(registry));
+}
+
+fn is_executable(path: &Path) -> bool {
+    fs::metadata(path).is_ok_and(|meta| meta.is_file() && meta.permissions().mode() & 0o111 != 0)
+}
+
+fn is_declaration(path: &Path) -> bool {
+    path.is_file() && path.extension().is_some_and(|extension| extension == "json")
+}
+
+impl PluginRegistry {
+    pub async fn discover(dir: &Path) -> Self {
+        let mut registry = PluginRegistry::default();
+        let Ok(entries) = fs::read_dir(dir) else {
+            return registry;
+        };
+        let mut paths: Vec<_> = entries
+            .filter_map(|entry| entry.ok().map(|entry| entry.path()))
+            .filter(|path| is_declaration(path) || is_executable(path))
+            .collect();
+        paths.sort();
+
+        for path in paths {
+            let loaded = if is_declaration(&path) {
+                Plugin::declared(&path)
+            } else {
+                Plugin::load(&path).await
+            };
+            let plugin = match loaded {
+                Ok(plugin) => plugin,
+                Err(err) => {
+                    tracing::warn!("skipping plugin {}: {}", path.display(), err);
+                    continue;
+                }
+            };
+            let name = plugin.name().to_string();
+            if name.parse::<Language>().is_ok() || registry.plugins.contains_key(&name) {
+                tracing::warn!(
+                    "skipping plugin {}: language {} is already registered",
+                    path.display(),
+                    name
+                );
+                continue;
+            }
+            registry.plugins.insert(name, plugin);
+        }
+        registry
+    }
+
+    pub fn get(&self, name: &str) -> Option<&Plugin> {
+        self.plugins.get(&name.to_lowercase())
+    }
+
+    pub fn names(&self) -> impl Iterator<Item = &str> {
+        self.plugins.keys().map(String::as_str)
+    }
+}
+
+#[cfg(test)]
+mod plugin_tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn install(dir: &Path, name: &str, script: &str) {
+        let path = dir.join(name);
+        fs::write(&path, script).unwrap();
+        fs::set_permissions(&path, fs::Permissions::from_mode(0o755)).unwrap();
+    }
+
+    const SHOUT: &str = r#"#!/bin/sh
+cat > /dev/null
+case "$1" in
+  describe) echo '{"name":"Shout","version":"1.0","source_file":"main.txt"}' ;;
+  run) echo '{"command":["tr","a-z","A-Z"]}' ;;
+  *) exit 1 ;;
+esac
+"#;
+
+    #[tokio::test]
+    async fn test_discover_registers_plugins_and_skips_broken_ones() {
+        let dir = TempDir::new().unwrap();
+        install(dir.path(), "shout", SHOUT);
+        install(dir.path(), "broken", "#!/bin/sh\necho not json\n");
+        install(
+            dir.path(),
+            "python",
+            "#!/bin/sh\necho '{\"name\":\"python\",\"version\":\"0\",\"source_file\":\"x.py\"}'\n",
+        );
+        fs::write(dir.path().join("README"), "not executable").unwrap();
+
+        let registry = PluginRegistry::discover(dir.path()).await;
+        assert_eq!(registry.names().collect::<Vec<_>>(), ["shout"]);
+        assert!(registry.get("SHOUT").is_some());
+    }
+
+    #[tokio::test]
+    async fn test_call_gives_up_on_a_plugin_that_does_not_answer() {
+        let dir = TempDir::new().unwrap();
+        install(dir.path(), "stuck", "#!/bin/sh\nexec sleep 5\n");
+        let started = std::time::Instant::now();
+        let err = call::<_, PluginDescription>(
+            &dir.path().join("stuck"),
+            "describe",
+            &(),
+            Duration::from_millis(200),
+        )
+        .await
+        .unwrap_err();
+        assert!(err.to_string().contains("gave no answer"));
+        assert!(started.elapsed() < Duration::from_secs(2));
+    }
+
+    #[tokio::test]
+    async fn test_execute_runs_the_command_returned_by_the_plugin() {
+        let dir = TempDir::new().unwrap();
+        install(dir.path(), "shout", SHOUT);
+        let registry = PluginRegistry::discover(dir.path()).await;
+
+        let plugin = registry.get("shout").unwrap();
+        let output = plugin
+            .execute("ignored", "hello", &ExecContext::default())
+            .await
+            .unwrap();
+        assert_eq!(output, "HELLO");
+    }
+
+    #[tokio::test]
+    async fn test_failed_compile_is_reported() {
+        let dir = TempDir::new().unwrap();
+        install(
+            dir.path(),
+            "strict",
+            r#"#!/bin/sh
+cat > /dev/null
+case "$1" in
+  describe) echo '{"name":"strict","version":"1.0","source_file":"main.st","compiled":true}' ;;
+  compile) echo '{"ok":false,"message":"syntax error"}' ;;
+esac
+"#,
+        );
+        let registry = PluginRegistry::discover(dir.path()).await;
+
+        let err = registry
+            .get("strict")
+            .unwrap()
+            .execute("", "", &ExecContext::default())
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("syntax error"));
+    }
+
+    #[tokio::test]
+    async fn test_declared_language_compiles_and_runs_from_templates() {
+        let dir = TempDir::new().unwrap();
+        fs::write(
+            dir.path().join("TinyC.json"),
+            r#"{
+                "extension": "c",
+                "compile": ["gcc", "{flags}", "-o", "{exe}", "{source}"],
+                "run": ["{exe}"],
+                "compiler_flags": ["-DGREETING"],
+                "limits": {"timeout_secs": 5}
+            }"#,
+        )
+        .unwrap();
+        fs::write(dir.path().join("empty.json"), r#"{"extension": "x", "run": []}"#).unwrap();
+        let registry = PluginRegistry::discover(dir.path()).await;
+        assert_eq!(registry.names().collect::<Vec<_>>(), ["tinyc"]);
+
+        let plugin = registry.get("tinyc").unwrap();
+        assert!(plugin.description().compiled);
+        assert_eq!(plugin.description().source_file, "main.c");
+        assert_eq!(plugin.limits().unwrap().timeout_secs, Some(5));
+        let ctx = ExecContext::default().with_compiler_flags(vec!["-DGREETING".into()]);
+        let output = plugin
+            .execute(
+                "#include <stdio.h>\nint main() {\n#ifdef GREETING\nputs(\"hi\");\n#endif\n}\n",
+                "",
+                &ctx,
+            )
+            .await
+            .unwrap();
+        assert_eq!(output, "hi\n");
+
+        let err = plugin
+            .execute("int main() {", "", &ExecContext::default())
+            .await
+            .unwrap_err();
+        assert!(matches!(err, InfraError::CompilationError(_)));
+    }
+}
@@ -0,0 +1,311 @@
+use std::{
+    collections::VecDeque,
+    fs,
+    path::Path,
+    sync::{Mutex, RwLock},
+};
+
+use chrono::{DateTime, Utc};
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+
+use crate::config::config;
+
+use super::{events::Submitter, toolchain::Toolchain};
+
+// Matches kept for operators to review, oldest dropped first.
+const AUDIT_CAPACITY: usize = 1000;
+// How much of the matched code an audit entry quotes.
+const EXCERPT_MAX_CHARS: usize = 120;
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+#[serde(rename_all = "lowercase")]
+pub enum PolicyAction {
+    // The submission is refused before anything runs.
+    #[default]
+    Reject,
+    // The submission runs, and the match is only audited.
+    Flag,
+}
+
+// One entry of the policy file. `languages` are names as in requests; a
+// rule without them applies to every language.
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct RuleSpec {
+    name: String,
+    pattern: String,
+    languages: Option<Vec<String>>,
+    #[serde(default)]
+    action: PolicyAction,
+    reason: String,
+}
+
+#[derive(Debug)]
+pub struct Rule {
+    pub name: String,
+    pattern: Regex,
+    // Canonical toolchain names.
+    languages: Option<Vec<&'static str>>,
+    pub action: PolicyAction,
+    pub reason: String,
+}
+
+impl Rule {
+    fn from_spec(spec: RuleSpec) -> Result<Self, String> {
+        let pattern = Regex::new(&spec.pattern)
+            .map_err(|err| format!("rule {} has an invalid pattern: {}", spec.name, err))?;
+        let languages = spec
+            .languages
+            .map(|languages| {
+                languages
+                    .iter()
+                    .map(|name| {
+                        Toolchain::resolve(name)
+                            .map(|toolchain| toolchain.as_str())
+                            .map_err(|_| {
+                                format!("rule {} names unknown language {}", spec.name, name)
+                            })
+                    })
+                    .collect::<Result<Vec<_>, _>>()
+            })
+            .transpose()?;
+        Ok(Rule {
+            name: spec.name,
+            pattern,
+            languages,
+            action: spec.action,
+            reason: spec.reason,
+        })
+    }
+
+    fn applies_to(&self, lang: Option<&str>) -> bool {
+        match (&self.languages, lang) {
+            (None, _) => true,
+            (Some(languages), Some(lang)) => languages.contains(&lang),
+            (Some(_), None) => false,
+        }
+    }
+}
+
+// Rules every server starts with: programs that only try to destroy the
+// host or mine on it. Sockets are flagged rather than refused, since the
+// sandbox already blocks the network and such programs merely fail.
+const PRESETS: &str = r#"[
+    {
+        "name": "wipe-root",
+        "languages": ["go"],
+        "pattern": "os\\.RemoveAll\\(\\s*\"/\"\\s*\\)",
+        "reason": "deletes the filesystem root"
+    },
+    {
+        "name": "wipe-root",
+        "languages": ["python"],
+        "pattern": "shutil\\.rmtree\\(\\s*['\"]/['\"]",
+        "reason": "deletes the filesystem root"
+    },
+    {
+        "name": "wipe-root",
+        "languages": ["bash"],
+        "pattern": "rm\\s+-[a-zA-Z]*[rR][a-zA-Z]*\\s+(--no-preserve-root\\s+)?/(\\s|\\*|$)",
+        "reason": "deletes the filesystem root"
+    },
+    {
+        "name": "crypto-miner",
+        "pattern": "(?i)stratum\\+(tcp|ssl)://|xmrig|cryptonight",
+        "reason": "looks like a cryptocurrency miner"
+    },
+    {
+        "name": "socket",
+        "languages": ["python"],
+        "pattern": "(?m)^\\s*(import|from)\\s+socket\\b",
+        "action": "flag",
+        "reason": "opens sockets, which the sandbox blocks"
+    }
+]"#;
+
+#[derive(Debug)]
+pub struct SubmissionPolicy {
+    rules: Vec<Rule>,
+}
+
+impl SubmissionPolicy {
+    // `[{"name": ..., "pattern": ..., "reason": ...}]`, added to the
+    // presets. A file rule named like a preset replaces every preset of
+    // that name, so presets can be loosened or turned into flags.
+    pub fn from_json(text: &str) -> Result<Self, String> {
+        let parse = |text: &str| {
+            let specs: Vec<RuleSpec> = serde_json::from_str(text)
+                .map_err(|err| format!("invalid submission policy: {}", err))?;
+            specs
+                .into_iter()
+                .map(Rule::from_spec)
+                .collect::<Result<Vec<_>, _>>()
+        };
+        let file = parse(text)?;
+        let mut rules: Vec<_> = parse(PRESETS)?
+            .into_iter()
+            .filter(|preset| !file.iter().any(|rule| rule.name == preset.name))
+            .collect();
+        rules.extend(file);
+        Ok(SubmissionPolicy { rules })
+    }
+
+    pub fn read(path: Option<&Path>) -> Result<Self, String> {
+        let text = match path {
+            Some(path) => fs::read_to_string(path)
+                .map_err(|err| format!("cannot read {}: {}", path.display(), err))?,
+            None => String::from("[]"),
+        };
+        SubmissionPolicy::from_json(&text)
+    }
+
+    // Every rule `content` in `lang` matches, with the code it matched.
+    pub fn check<'a>(&self, lang: &str, content: &'a str) -> Vec<(&Rule, &'a str)> {
+        let lang = Toolchain::resolve(lang)
+            .ok()
+            .map(|toolchain| toolchain.as_str());
+        self.rules
+            .iter()
+            .filter(|rule| rule.applies_to(lang))
+            .filter_map(|rule| Some((rule, rule.pattern.find(content)?.as_str())))
+            .collect()
+    }
+}
+
+// Replaced wholesale on reload, like the language defaults.
+static POLICY: RwLock<Option<&'static SubmissionPolicy>> = RwLock::new(None);
+
+pub async fn submission_policy() -> &'static SubmissionPolicy {
+    if let Some(policy) = *POLICY.read().unwrap() {
+        return policy;
+    }
+    let policy = SubmissionPolicy::read(config().await.policy_file()).unwrap();
+    let mut current = POLICY.write().unwrap();
+    *current.get_or_insert(Box::leak(Box::new(policy)))
+}
+
+// Rereads the policy file, keeping the current policy if it is invalid.
+pub async fn reload_submission_policy() -> Result<(), String> {
+    let policy = SubmissionPolicy::read(config().await.policy_file())?;
+    *POLICY.write().unwrap() = Some(Box::leak(Box::new(policy)));
+    Ok(())
+}
+
+#[derive(Debug, Clone, Serialize, ToSchema)]
+pub struct PolicyMatch {
+    pub at: DateTime<Utc>,
+    #[schema(example = "crypto-miner")]
+    pub rule: String,
+    pub action: PolicyAction,
+    #[schema(example = "python")]
+    pub lang: String,
+    pub submitter: Submitter,
+    // The start of the code the rule matched.
+    #[schema(example = "stratum+tcp://")]
+    pub excerpt: String,
+}
+
+static AUDIT: Mutex<VecDeque<PolicyMatch>> = Mutex::new(VecDeque::new());
+
+pub fn audit(rule: &Rule, lang: &str, submitter: &Submitter, matched: &str) {
+    let mut audit = AUDIT.lock().unwrap();
+    if audit.len() == AUDIT_CAPACITY {
+        audit.pop_front();
+    }
+    audit.push_back(PolicyMatch {
+        at: Utc::now(),
+        rule: rule.name.clone(),
+        action: rule.action,
+        lang: lang.to_string(),
+        submitter: submitter.clone(),
+        excerpt: matched.chars().take(EXCERPT_MAX_CHARS).collect(),
+    });
+}
+
+// Newest first.
+pub fn audit_log() -> Vec<PolicyMatch> {
+    AUDIT.lock().unwrap().iter().rev().cloned().collect()
+}
+
+#[cfg(test)]
+mod policy_tests {
+    use super::*;
+
+    fn matched(
+        policy: &SubmissionPolicy,
+        lang: &str,
+        content: &str,
+    ) -> Vec<(String, PolicyAction)> {
+        policy
+            .check(lang, content)
+            .into_iter()
+            .map(|(rule, _)| (rule.name.clone(), rule.action))
+            .collect()
+    }
+
+    #[test]
+    fn test_presets_match_only_their_languages() {
+        let policy = SubmissionPolicy::from_json("[]").unwrap();
+        let wipe = "package main\nimport \"os\"\nfunc main() { os.RemoveAll( \"/\" ) }";
+        assert_eq!(
+            matched(&policy, "go", wipe),
+            [("wipe-root".to_string(), PolicyAction::Reject)]
+        );
+        assert!(matched(&policy, "python", wipe).is_empty());
+        assert!(matched(&policy, "go", "os.RemoveAll(\"/tmp/x\")").is_empty());
+        assert_eq!(matched(&policy, "bash", "rm -rf /").len(), 1);
+        assert!(matched(&policy, "bash", "rm -rf /tmp/x").is_empty());
+        assert_eq!(
+            matched(&policy, "javascript", "connect('stratum+tcp://pool:3333')"),
+            [("crypto-miner".to_string(), PolicyAction::Reject)]
+        );
+        assert_eq!(
+            matched(&policy, "python", "import os\nimport socket\n"),
+            [("socket".to_string(), PolicyAction::Flag)]
+        );
+        assert!(matched(&policy, "python", "print('hello')").is_empty());
+    }
+
+    #[test]
+    fn test_file_rules_add_to_and_replace_presets() {
+        let policy = SubmissionPolicy::from_json(
+            r#"[
+                {"name": "socket", "pattern": "import socket", "languages": ["Python"],
+                 "reason": "no networking"},
+                {"name": "fork-bomb", "pattern": ":\\(\\)\\s*\\{", "languages": ["bash"],
+                 "action": "flag", "reason": "forks until the host gives up"}
+            ]"#,
+        )
+        .unwrap();
+        assert_eq!(
+            matched(&policy, "python", "import socket"),
+            [("socket".to_string(), PolicyAction::Reject)]
+        );
+        assert_eq!(
+            matched(&policy, "bash", ":(){ :|:& };:"),
+            [("fork-bomb".to_string(), PolicyAction::Flag)]
+        );
+        assert_eq!(matched(&policy, "go", "os.RemoveAll(\"/\")").len(), 1);
+
+        let unknown = r#"[{"name": "x", "pattern": "x", "languages": ["cobol"], "reason": "x"}]"#;
+        assert!(SubmissionPolicy::from_json(unknown).is_err());
+        let invalid = r#"[{"name": "x", "pattern": "(", "reason": "x"}]"#;
+        assert!(SubmissionPolicy::from_json(invalid).is_err());
+    }
+
+    #[test]
+    fn test_audit_keeps_the_newest_matches() {
+        let policy = SubmissionPolicy::from_json("[]").unwrap();
+        let submitter = Submitter::new(Some("key"), "127.0.0.1");
+        let content = format!("# xmrig {}", "x".repeat(500));
+        for (rule, matched) in policy.check("python", &content) {
+            audit(rule, "python", &submitter, matched);
+        }
+        let newest = audit_log().into_iter().next().unwrap();
+        assert_eq!(newest.rule, "crypto-miner");
+        assert_eq!(newest.excerpt, "xmrig");
+        assert_eq!(newest.submitter, submitter);
+    }
+}
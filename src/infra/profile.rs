@@ -0,0 +1,404 @@
+use std::{collections::BTreeMap, fs, io, path::Path, process::Output};
+
+use serde::{Deserialize, Serialize};
+use tokio::process::Command;
+use utoipa::ToSchema;
+
+use super::{
+    crash::{GdbLog, debugged_command, examine},
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_program},
+};
+
+// Where a language's runner leaves the summarized profile for the handler.
+const REPORT_FILE: &str = "profile.json";
+
+// How many of the hottest functions a report keeps.
+pub const TOP_FUNCTIONS: usize = 20;
+
+// Samples per second for `perf record`; off the timer frequency so the
+// samples do not fall into step with periodic work.
+const PERF_FREQUENCY: &str = "997";
+
+// A profiled Go submission's `main` is renamed and called from a generated
+// one, in this file, that wraps it in a CPU profile. A program that calls
+// `os.Exit` skips the wrapper and leaves no profile.
+pub const GO_HOOK_FILE: &str = "comphub_profile.go";
+const GO_PROFILED_MAIN: &str = "comphubProfiledMain";
+const GO_HOOK: &str = r#"package main
+
+import (
+	"os"
+	"runtime/pprof"
+)
+
+func main() {
+	if f, err := os.Create(os.Getenv("COMPHUB_CPU_PROFILE")); err == nil {
+		pprof.StartCPUProfile(f)
+		defer pprof.StopCPUProfile()
+	}
+	comphubProfiledMain()
+}
+"#;
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize, ToSchema)]
+pub struct Hotspot {
+    #[schema(example = "main.fib")]
+    pub function: String,
+    // Samples taken while the function itself, not a callee, was running.
+    pub samples: u64,
+    #[schema(example = 62.5)]
+    pub percent: f64,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize, ToSchema)]
+pub struct ProfileReport {
+    #[schema(example = "pprof")]
+    pub profiler: String,
+    pub samples: u64,
+    pub hotspots: Vec<Hotspot>,
+}
+
+// The languages whose runners can profile: Go with pprof, JavaScript with
+// Node's sampling profiler and native binaries with perf.
+pub fn supports(language: Language) -> bool {
+    matches!(
+        language,
+        Language::GO
+            | Language::JAVASCRIPT
+            | Language::C
+            | Language::CPP
+            | Language::RUST
+            | Language::FORTRAN
+    )
+}
+
+fn percent(samples: u64, total: u64) -> f64 {
+    if total == 0 {
+        return 0.0;
+    }
+    (samples as f64 * 10000.0 / total as f64).round() / 100.0
+}
+
+fn invalid(profiler: &str, reason: impl std::fmt::Display) -> InfraError {
+    InfraError::CompilationError(format!("unreadable {} profile: {}", profiler, reason).into())
+}
+
+// `ticks` and one or more `%` columns, then the name, as in node's and
+// pprof's tables.
+fn table_row(line: &str) -> Option<(u64, &str)> {
+    let (count, rest) = line.trim().split_once(char::is_whitespace)?;
+    let count = count.parse().ok()?;
+    let mut rest = rest.trim_start();
+    while let Some((column, tail)) = rest.split_once(char::is_whitespace) {
+        if !column.ends_with('%') {
+            break;
+        }
+        rest = tail.trim_start();
+    }
+    Some((count, rest))
+}
+
+impl ProfileReport {
+    fn from_counts(profiler: &str, total: u64, counts: BTreeMap<String, u64>) -> Self {
+        let mut hotspots: Vec<Hotspot> = counts
+            .into_iter()
+            .filter(|(_, samples)| *samples > 0)
+            .map(|(function, samples)| Hotspot {
+                function,
+                samples,
+                percent: percent(samples, total),
+            })
+            .collect();
+        hotspots.sort_by(|a, b| b.samples.cmp(&a.samples));
+        hotspots.truncate(TOP_FUNCTIONS);
+        ProfileReport {
+            profiler: profiler.to_string(),
+            samples: total,
+            hotspots,
+        }
+    }
+
+    // `go tool pprof -top -sample_index=samples` output.
+    pub fn from_pprof_top(text: &str) -> Result<Self, InfraError> {
+        let total = text
+            .lines()
+            .find_map(|line| line.split_once("Total samples = "))
+            .and_then(|(_, total)| total.trim().parse().ok())
+            .ok_or_else(|| invalid("pprof", "missing sample count"))?;
+        let mut counts = BTreeMap::new();
+        for line in text
+            .lines()
+            .skip_while(|line| !line.trim_start().starts_with("flat"))
+        {
+            // `flat flat% sum% cum cum% name`; only the flat count matters.
+            let Some((flat, name)) = table_row(line).and_then(|(flat, rest)| {
+                let (_, name) = table_row(rest)?;
+                Some((flat, name))
+            }) else {
+                continue;
+            };
+            *counts.entry(name.to_string()).or_default() += flat;
+        }
+        Ok(Self::from_counts("pprof", total, counts))
+    }
+
+    // `node --prof-process` output: the per-function tables for JavaScript,
+    // C++ and shared libraries. Paths in the submission's directory are
+    // shortened to the file name.
+    pub fn from_node_prof(text: &str, source_dir: &Path) -> Result<Self, InfraError> {
+        let total = text
+            .lines()
+            .find_map(|line| line.split_once(" ticks,"))
+            .and_then(|(head, _)| head.rsplit_once('(')?.1.parse().ok())
+            .ok_or_else(|| invalid("node", "missing tick count"))?;
+        let prefix = format!("{}/", source_dir.display());
+        let mut counts = BTreeMap::new();
+        let mut in_table = false;
+        for line in text.lines() {
+            let heading = line.trim();
+            if heading.starts_with('[') {
+                in_table = matches!(heading, "[JavaScript]:" | "[C++]:" | "[Shared libraries]:");
+                continue;
+            }
+            if !in_table {
+                continue;
+            }
+            let Some((ticks, name)) = table_row(line) else {
+                continue;
+            };
+            // `JS: *fib /tmp/x/main.js:1:13`; the marker is V8's tier.
+            let name = name
+                .strip_prefix("JS: ")
+                .map(|name| name.trim_start_matches(['*', '^', '~', '+']))
+                .unwrap_or(name)
+                .replace(&prefix, "");
+            *counts.entry(name).or_default() += ticks;
+        }
+        Ok(Self::from_counts("node", total, counts))
+    }
+
+    // `perf report --stdio --sort symbol --fields sample,symbol` output:
+    // `  1234  [.] fib`, with `#` comment lines around the table.
+    pub fn from_perf_report(text: &str) -> Result<Self, InfraError> {
+        let mut counts = BTreeMap::new();
+        for line in text.lines().filter(|line| !line.starts_with('#')) {
+            let Some((samples, rest)) = table_row(line) else {
+                continue;
+            };
+            let symbol = match rest.split_once("] ") {
+                Some((_, symbol)) => symbol.trim(),
+                None => rest,
+            };
+            if !symbol.is_empty() {
+                *counts.entry(symbol.to_string()).or_default() += samples;
+            }
+        }
+        let total = counts.values().sum();
+        Ok(Self::from_counts("perf", total, counts))
+    }
+
+    pub fn save(&self, dir: &Path) -> Result<(), InfraError> {
+        let json = serde_json::to_vec(self).map_err(|err| invalid("summarized", err))?;
+        fs::write(dir.join(REPORT_FILE), json)?;
+        Ok(())
+    }
+
+    // The report a run left in `dir`; none if the runner never got to write
+    // one.
+    pub fn load(dir: &Path) -> io::Result<Option<Self>> {
+        let json = match fs::read(dir.join(REPORT_FILE)) {
+            Ok(json) => json,
+            Err(err) if err.kind() == io::ErrorKind::NotFound => return Ok(None),
+            Err(err) => return Err(err),
+        };
+        serde_json::from_slice(&json)
+            .map(Some)
+            .map_err(|err| io::Error::new(io::ErrorKind::InvalidData, err))
+    }
+}
+
+// Renames the submission's `main` so the hook in GO_HOOK_FILE can wrap it.
+// None if there is no `func main()` to rename.
+pub fn go_profiled_source(content: &str) -> Option<String> {
+    let start = if content.starts_with("func main()") {
+        0
+    } else {
+        content.find("\nfunc main()")? + 1
+    };
+    let name = start + "func ".len();
+    Some(format!(
+        "{}{}{}",
+        &content[..name],
+        GO_PROFILED_MAIN,
+        &content[name + "main".len()..]
+    ))
+}
+
+// Writes the hook next to a renamed Go `main` and points it at `dir`.
+pub fn hook_go(source_dir: &Path, dir: &Path, ctx: &ExecContext) -> io::Result<ExecContext> {
+    fs::write(source_dir.join(GO_HOOK_FILE), GO_HOOK)?;
+    let profile = dir.join("cpu.pprof");
+    Ok(ctx
+        .clone()
+        .with_env("COMPHUB_CPU_PROFILE", &profile.to_string_lossy()))
+}
+
+async fn tool_output(mut cmd: Command, tool: &str) -> Result<String, InfraError> {
+    let output = cmd.kill_on_drop(true).output().await?;
+    if !output.status.success() {
+        return Err(InfraError::CompilationError(
+            format!(
+                "{} failed:\n{}",
+                tool,
+                String::from_utf8_lossy(&output.stderr)
+            )
+            .into(),
+        ));
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
+
+// Summarizes the CPU profile a hooked Go program left in `dir`. The file
+// stays empty if the program exited before the hook could stop the profile.
+pub async fn report_go(dir: &Path, ctx: &ExecContext) -> Result<(), InfraError> {
+    let profile = dir.join("cpu.pprof");
+    if fs::metadata(&profile).map_or(true, |meta| meta.len() == 0) {
+        return Ok(());
+    }
+    let mut cmd = ctx.command("go")?;
+    cmd.args(["tool", "pprof", "-top", "-sample_index=samples"])
+        .arg(profile);
+    let top = tool_output(cmd, "go tool pprof").await?;
+    ProfileReport::from_pprof_top(&top)?.save(dir)
+}
+
+// Node's flags for writing its sampling profiler's log to `dir`.
+pub fn node_flags(dir: &Path) -> [String; 3] {
+    [
+        String::from("--prof"),
+        String::from("--no-logfile-per-isolate"),
+        format!("--logfile={}", dir.join("v8.log").display()),
+    ]
+}
+
+pub async fn report_node(
+    dir: &Path,
+    source_dir: &Path,
+    ctx: &ExecContext,
+) -> Result<(), InfraError> {
+    let mut cmd = ctx.command("node")?;
+    cmd.arg("--prof-process").arg(dir.join("v8.log"));
+    let text = tool_output(cmd, "node --prof-process").await?;
+    ProfileReport::from_node_prof(&text, source_dir)?.save(dir)
+}
+
+// The command that runs a native executable, under `perf record` when the
+// run is profiled, or else under gdb, with the log it writes, when crash
+// backtraces are on.
+fn native_command(
+    executable: &Path,
+    ctx: &ExecContext,
+) -> Result<(Command, Option<GdbLog>), InfraError> {
+    let Some(dir) = ctx.profile_dir() else {
+        return Ok(match debugged_command(executable, ctx)? {
+            Some((cmd, log)) => (cmd, Some(log)),
+            None => (Command::new(executable), None),
+        });
+    };
+    let mut cmd = ctx.command("perf")?;
+    cmd.args(["record", "--quiet", "-F", PERF_FREQUENCY, "-o"])
+        .arg(dir.join("perf.data"))
+        .arg("--")
+        .arg(executable);
+    Ok((cmd, None))
+}
+
+// Runs a native executable the way `native_command` sets it up.
+pub async fn run_native(
+    executable: &Path,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<Output, InfraError> {
+    let (mut cmd, log) = native_command(executable, ctx)?;
+    let mut output = run_program(&mut cmd, stdin_input, ctx).await?;
+    if let Some(log) = log {
+        examine(log, &mut output, ctx);
+    }
+    Ok(output)
+}
+
+pub async fn report_native(dir: &Path, ctx: &ExecContext) -> Result<(), InfraError> {
+    let mut cmd = ctx.command("perf")?;
+    cmd.args([
+        "report",
+        "--stdio",
+        "--sort=symbol",
+        "--fields=sample,symbol",
+        "-i",
+    ])
+    .arg(dir.join("perf.data"));
+    let text = tool_output(cmd, "perf report").await?;
+    ProfileReport::from_perf_report(&text)?.save(dir)
+}
+
+#[cfg(test)]
+mod profile_tests {
+    use super::*;
+
+    #[test]
+    fn test_pprof_top_keeps_flat_samples() {
+        let top = "File: main\n\
+            Type: samples\n\
+            Duration: 1.20s, Total samples = 8 \n\
+            Showing nodes accounting for 8, 100% of 8 total\n      \
+            flat  flat%   sum%        cum   cum%\n         \
+            5 62.50% 62.50%          5 62.50%  main.fib\n         \
+            3 37.50%   100%          3 37.50%  runtime.memmove\n         \
+            0     0%   100%          8   100%  main.main\n";
+        let report = ProfileReport::from_pprof_top(top).unwrap();
+        assert_eq!(report.samples, 8);
+        assert_eq!(report.hotspots.len(), 2);
+        assert_eq!(
+            report.hotspots[0],
+            Hotspot {
+                function: "main.fib".into(),
+                samples: 5,
+                percent: 62.5,
+            }
+        );
+    }
+
+    #[test]
+    fn test_node_and_perf_reports_are_summarized() {
+        let node = "Statistical profiling result from /tmp/p/v8.log, (40 ticks, 2 unaccounted, 0 excluded).\n\n \
+            [Shared libraries]:\n   ticks  total  nonlib   name\n      \
+            4   10.0%          /usr/lib/x86_64-linux-gnu/libc.so.6\n\n \
+            [JavaScript]:\n   ticks  total  nonlib   name\n     \
+            30   75.0%   83.3%  JS: *fib /tmp/src/main.js:1:13\n\n \
+            [Summary]:\n   ticks  total  nonlib   name\n     \
+            30   75.0%   83.3%  JavaScript\n";
+        let report = ProfileReport::from_node_prof(node, Path::new("/tmp/src")).unwrap();
+        assert_eq!(report.samples, 40);
+        assert_eq!(report.hotspots.len(), 2);
+        assert_eq!(report.hotspots[0].function, "fib main.js:1:13");
+        assert_eq!(report.hotspots[0].percent, 75.0);
+
+        let perf = "# Samples: 1K of event 'cpu-clock'\n#\n# Samples  Symbol\n#\n   \
+            750  [.] fib\n   250  [k] clear_page_erms\n\n#\n";
+        let report = ProfileReport::from_perf_report(perf).unwrap();
+        assert_eq!(report.samples, 1000);
+        assert_eq!(report.hotspots[1].function, "clear_page_erms");
+        assert_eq!(report.hotspots[1].percent, 25.0);
+    }
+
+    #[test]
+    fn test_go_profiled_source_renames_main() {
+        let source = "package main\n\nfunc mainLoop() {}\n\nfunc main() {\n\tmainLoop()\n}\n";
+        let renamed = go_profiled_source(source).unwrap();
+        assert!(renamed.contains("func mainLoop() {}"));
+        assert!(renamed.contains("func comphubProfiledMain() {\n\tmainLoop()"));
+        assert!(go_profiled_source("package main\n").is_none());
+    }
+}
@@ -1,31 +1,211 @@
-use super::error::InfraError;
-use std::io::Write;
-use std::process::Stdio;
-use tempfile::NamedTempFile;
-use tokio::io::AsyncWriteExt;
-use tokio::process::Command;
-use which::which;
-
-pub async fn compile_python(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::new()?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
-
-    let mut cmd = Command::new(which("python3")?)
-        .arg(temp_file.path())
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
-
-    let output = cmd.wait_with_output().await?;
+use std::{borrow::Cow, ffi::OsString, fs, path::Path, process::Output, str::FromStr};
+
+use crate::config::config;
+
+use super::{
+    coverage::CoverageReport,
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+    warm::warm_pool,
+};
+
+// Packages Python submissions may declare as dependencies, by their
+// normalized distribution name.
+#[derive(Debug, Clone, Default)]
+pub struct PythonPackages {
+    names: Vec<String>,
+}
+
+// PEP 503: names compare case-insensitively, with runs of `-`, `_` and `.`
+// treated alike.
+fn normalize(name: &str) -> String {
+    let mut normalized = String::with_capacity(name.len());
+    for part in name.split(['-', '_', '.']).filter(|part| !part.is_empty()) {
+        if !normalized.is_empty() {
+            normalized.push('-');
+        }
+        normalized.push_str(&part.to_ascii_lowercase());
+    }
+    normalized
+}
+
+impl FromStr for PythonPackages {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut names = Vec::new();
+        for name in s.split(',').map(str::trim).filter(|name| !name.is_empty()) {
+            if !name
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || matches!(c, '-' | '_' | '.'))
+            {
+                return Err(format!("invalid python package name {:?}", name));
+            }
+            names.push(normalize(name));
+        }
+        Ok(PythonPackages { names })
+    }
+}
 
+impl PythonPackages {
+    pub fn contains(&self, name: &str) -> bool {
+        self.names.contains(&normalize(name))
+    }
+
+    pub fn names(&self) -> &[String] {
+        &self.names
+    }
+}
+
+// Installs the declared packages next to the program from the wheel cache
+// alone; pip never reaches an index.
+async fn install_wheels(
+    wheels: &Path,
+    packages: &[String],
+    target: &Path,
+    ctx: &ExecContext,
+) -> Result<(), InfraError> {
+    let output = ctx
+        .command("python3")?
+        .args(["-m", "pip", "install", "--quiet", "--no-index"])
+        .args(["--disable-pip-version-check", "--no-cache-dir"])
+        .arg("--find-links")
+        .arg(wheels)
+        .arg("--target")
+        .arg(target)
+        .args(packages)
+        .kill_on_drop(true)
+        .output()
+        .await?;
+    if output.status.success() {
+        return Ok(());
+    }
+    Err(InfraError::CompilationError(
+        format!(
+            "Installing {} failed:\n{}",
+            packages.join(", "),
+            String::from_utf8_lossy(&output.stderr)
+        )
+        .into(),
+    ))
+}
+
+// The interpreter to run the program with, and the context to run it in,
+// once the declared dependencies are in place.
+async fn prepare_dependencies<'a>(
+    source: &SourceFile,
+    ctx: &'a ExecContext,
+) -> Result<(String, Cow<'a, ExecContext>), InfraError> {
+    let app_config = config().await;
+    let allowed = app_config.python_packages();
+    if let Some(name) = ctx.dependencies().iter().find(|name| !allowed.contains(name)) {
+        return Err(InfraError::CompilationError(
+            format!(
+                "package {} is not available; allowed packages: {}",
+                name,
+                allowed.names().join(", ")
+            )
+            .into(),
+        ));
+    }
+
+    if let Some(venv) = app_config.python_venv() {
+        let python = venv.join("bin/python3").to_string_lossy().into_owned();
+        return Ok((python, Cow::Borrowed(ctx)));
+    }
+    let Some(wheels) = app_config.python_wheels() else {
+        return Err(InfraError::CompilationError(
+            "Python packages are not available on this instance".into(),
+        ));
+    };
+    let site_packages = source.dir().join("site-packages");
+    install_wheels(wheels, ctx.dependencies(), &site_packages, ctx).await?;
+    let ctx = ctx
+        .clone()
+        .with_env("PYTHONPATH", &site_packages.to_string_lossy());
+    Ok((String::from("python3"), Cow::Owned(ctx)))
+}
+
+// Interpreter arguments that run the program, under coverage.py when the
+// request asked for a report.
+fn script_args(source: &SourceFile, ctx: &ExecContext) -> Vec<OsString> {
+    let mut args = Vec::new();
+    if let Some(dir) = ctx.coverage_dir() {
+        args.extend(["-m", "coverage", "run"].map(OsString::from));
+        args.push(format!("--data-file={}", dir.join(".coverage").display()).into());
+        args.push(format!("--include={}", source.path().display()).into());
+    }
+    args.push(source.path().into());
+    args
+}
+
+async fn report_coverage(
+    python: &str,
+    dir: &Path,
+    source: &SourceFile,
+    ctx: &ExecContext,
+) -> Result<(), InfraError> {
+    let report = dir.join("coverage.json");
+    let output = ctx
+        .command(python)?
+        .args(["-m", "coverage", "json", "--quiet"])
+        .arg(format!("--data-file={}", dir.join(".coverage").display()))
+        .arg("-o")
+        .arg(&report)
+        .kill_on_drop(true)
+        .output()
+        .await?;
+    if !output.status.success() {
+        return Err(InfraError::CompilationError(
+            format!(
+                "coverage json failed:\n{}",
+                String::from_utf8_lossy(&output.stderr)
+            )
+            .into(),
+        ));
+    }
+    let json = fs::read_to_string(report)?;
+    CoverageReport::from_coverage_py(&json, source.dir())?.save(dir)
+}
+
+pub async fn compile_python(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::Python, content)?;
+    let (python, ctx) = if ctx.dependencies().is_empty() {
+        (String::from("python3"), Cow::Borrowed(ctx))
+    } else {
+        prepare_dependencies(&source, ctx).await?
+    };
+
+    // Warm interpreters only have the standard library on their path, and
+    // are not running under coverage.py.
+    let warm = if ctx.dependencies().is_empty() && ctx.coverage_dir().is_none() {
+        warm_pool().and_then(|pool| pool.checkout(Language::Python, &ctx))
+    } else {
+        None
+    };
+    let output = match warm {
+        Some(process) => process.run(source.path(), stdin_input, &ctx).await?,
+        None => {
+            let mut cmd = ctx.command(&python)?;
+            cmd.args(script_args(&source, &ctx));
+            run_program(&mut cmd, stdin_input, &ctx).await?
+        }
+    };
+
+    let result = program_result(output)?;
+    if let Some(dir) = ctx.coverage_dir() {
+        report_coverage(&python, dir, &source, &ctx).await?;
+    }
+    Ok(result)
+}
+
+pub fn program_result(output: Output) -> Result<String, InfraError> {
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
         Some(code) => {
@@ -54,14 +234,14 @@ mod python_tests {
     #[tokio::test]
     async fn test_compile_python_basic_output() {
         let content = r#"print("hello world")"#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "hello world");
     }
 
     #[tokio::test]
     async fn test_compile_python_with_empty_content() {
         let content = "";
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "");
     }
 
@@ -72,7 +252,7 @@ print("line 1")
 print("line 2")
 print("line 3")
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "line 1\nline 2\nline 3");
     }
 
@@ -84,7 +264,7 @@ input_data = sys.stdin.read().strip()
 print(f"Received: {input_data}")
         "#;
         let stdin_input = "hello from stdin";
-        let res = compile_python(content, stdin_input).await.unwrap();
+        let res = compile_python(content, stdin_input, &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Received: hello from stdin");
     }
 
@@ -95,7 +275,7 @@ name = input("Enter your name: ")
 print(f"Hello, {name}!")
         "#;
         let stdin_input = "Alice";
-        let res = compile_python(content, stdin_input).await.unwrap();
+        let res = compile_python(content, stdin_input, &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Enter your name: Hello, Alice!");
     }
 
@@ -107,7 +287,7 @@ input_data = sys.stdin.read()
 print(f"Input length: {len(input_data)}")
         "#;
         let stdin_input = "";
-        let res = compile_python(content, stdin_input).await.unwrap();
+        let res = compile_python(content, stdin_input, &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Input length: 0");
     }
 
@@ -119,7 +299,7 @@ lines = sys.stdin.read().strip().split('\n')
 print(f"Lines: {len(lines)}")
         "#;
         let stdin_input = "line1\nline2\nline3";
-        let res = compile_python(content, stdin_input).await.unwrap();
+        let res = compile_python(content, stdin_input, &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Lines: 3");
     }
 
@@ -131,7 +311,7 @@ age = input()
 print(f"{name} is {age} years old")
         "#;
         let stdin_input = "John\n25";
-        let res = compile_python(content, stdin_input).await.unwrap();
+        let res = compile_python(content, stdin_input, &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "John is 25 years old");
     }
 
@@ -140,7 +320,7 @@ print(f"{name} is {age} years old")
         let content = r#"
 print("unclosed string
         "#;
-        let result = compile_python(content, "").await;
+        let result = compile_python(content, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -150,7 +330,7 @@ print("unclosed string
 if True:
 print("bad indentation")
         "#;
-        let result = compile_python(content, "").await;
+        let result = compile_python(content, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -161,21 +341,21 @@ print("before error")
 raise ValueError("test error")
 print("after error")
         "#;
-        let result = compile_python(content, "").await;
+        let result = compile_python(content, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
     #[tokio::test]
     async fn test_compile_python_name_error() {
         let content = r#"print(undefined_variable)"#;
-        let result = compile_python(content, "").await;
+        let result = compile_python(content, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
     #[tokio::test]
     async fn test_compile_python_import_error() {
         let content = r#"import nonexistent_module"#;
-        let result = compile_python(content, "").await;
+        let result = compile_python(content, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -186,7 +366,7 @@ print("before division")
 result = 10 / 0
 print("after division")
         "#;
-        let result = compile_python(content, "").await;
+        let result = compile_python(content, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -198,7 +378,7 @@ print(3.14)
 print(-10)
 print(2**10)
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "42\n3.14\n-10\n1024");
     }
 
@@ -210,7 +390,7 @@ print('single quotes')
 print("""triple quotes""")
 print(f"f-string: {2 + 3}")
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "double quotes\nsingle quotes\ntriple quotes\nf-string: 5");
     }
 
@@ -223,7 +403,7 @@ print(not True)
 print(True and False)
 print(True or False)
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "True\nFalse\nFalse\nFalse\nTrue");
     }
 
@@ -236,7 +416,7 @@ print(len(arr))
 print(arr[0])
 print(arr[-1])
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "[1, 2, 3, 4, 5]\n5\n1\n5");
     }
 
@@ -248,7 +428,7 @@ print(person)
 print(person["name"])
 print(len(person))
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "{'name': 'Alice', 'age': 30}\nAlice\n2");
     }
 
@@ -260,7 +440,7 @@ print(coords)
 print(coords[0])
 print(len(coords))
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "(10, 20)\n10\n2");
     }
 
@@ -272,7 +452,7 @@ print(len(numbers))
 print(3 in numbers)
 print(sorted(numbers))
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "5\nTrue\n[1, 2, 3, 4, 5]");
     }
 
@@ -284,7 +464,7 @@ def greet(name):
 
 print(greet("World"))
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Hello, World!");
     }
 
@@ -294,7 +474,7 @@ print(greet("World"))
 add = lambda x, y: x + y
 print(add(5, 3))
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "8");
     }
 
@@ -307,7 +487,7 @@ def greet(name, greeting="Hello"):
 print(greet("Alice"))
 print(greet("Bob", "Hi"))
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Hello, Alice!\nHi, Bob!");
     }
 
@@ -324,7 +504,7 @@ def print_info(**kwargs):
 print(sum_all(1, 2, 3, 4, 5))
 print_info(name="Alice", age=30)
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert!(res.contains("15"));
         assert!(res.contains("name: Alice"));
         assert!(res.contains("age: 30"));
@@ -339,7 +519,7 @@ if x > 5:
 else:
     print("lesser")
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "greater");
     }
 
@@ -356,7 +536,7 @@ elif score >= 70:
 else:
     print("F")
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "B");
     }
 
@@ -366,7 +546,7 @@ else:
 for i in range(3):
     print(f"iteration {i}")
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "iteration 0\niteration 1\niteration 2");
     }
 
@@ -378,7 +558,7 @@ while i < 3:
     print(f"count {i}")
     i += 1
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "count 0\ncount 1\ncount 2");
     }
 
@@ -388,7 +568,7 @@ while i < 3:
 squares = [x**2 for x in range(5)]
 print(squares)
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "[0, 1, 4, 9, 16]");
     }
 
@@ -399,7 +579,7 @@ items = ["apple", "banana", "cherry"]
 for i, item in enumerate(items):
     print(f"{i}: {item}")
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "0: apple\n1: banana\n2: cherry");
     }
 
@@ -417,7 +597,7 @@ class Person:
 person = Person("Alice", 30)
 print(person.greet())
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Hello, I'm Alice, 30 years old");
     }
 
@@ -438,7 +618,7 @@ class Dog(Animal):
 dog = Dog("Rex")
 print(dog.speak())
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Rex barks");
     }
 
@@ -450,7 +630,7 @@ print(math.pi)
 print(math.sqrt(16))
 print(math.factorial(5))
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         let lines: Vec<&str> = res.trim().split('\n').collect();
         assert!(lines[0].starts_with("3.14"));
         assert_eq!(lines[1], "4.0");
@@ -465,7 +645,7 @@ random.seed(42)
 print(random.randint(1, 10))
 print(random.choice(['a', 'b', 'c']))
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         // Results should be deterministic with seed
         let lines: Vec<&str> = res.trim().split('\n').collect();
         assert!(lines[0].parse::<i32>().is_ok());
@@ -482,7 +662,7 @@ print(now.strftime("%Y-%m-%d"))
 future = now + timedelta(days=1)
 print(future.day)
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "2024\n2024-01-01\n2");
     }
 
@@ -496,7 +676,7 @@ print(json_str)
 parsed = json.loads(json_str)
 print(parsed["name"])
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         let lines: Vec<&str> = res.trim().split('\n').collect();
         assert!(lines[0].contains("Alice"));
         assert!(lines[0].contains("30"));
@@ -511,7 +691,7 @@ try:
 except ZeroDivisionError:
     print("Cannot divide by zero")
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Cannot divide by zero");
     }
 
@@ -526,28 +706,28 @@ except ValueError as e:
 finally:
     print("finally executed")
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "trying\ncaught: test error\nfinally executed");
     }
 
     #[tokio::test]
     async fn test_compile_python_unicode() {
         let content = r#"print("Hello 世界 🐍")"#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Hello 世界 🐍");
     }
 
     #[tokio::test]
     async fn test_compile_python_escape_sequences() {
         let content = r#"print("Line 1\nLine 2\tTabbed")"#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Line 1\nLine 2\tTabbed");
     }
 
     #[tokio::test]
     async fn test_compile_python_raw_strings() {
         let content = r#"print(r"C:\path\to\file")"#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), r"C:\path\to\file");
     }
 
@@ -559,7 +739,7 @@ multiline
 string"""
 print(text)
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "This is a\nmultiline\nstring");
     }
 
@@ -575,7 +755,7 @@ def count_up_to(n):
 for num in count_up_to(3):
     print(num)
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "0\n1\n2");
     }
 
@@ -585,7 +765,7 @@ for num in count_up_to(3):
 squares = (x**2 for x in range(5))
 print(list(squares))
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "[0, 1, 4, 9, 16]");
     }
 
@@ -604,7 +784,7 @@ def greet(name):
 
 print(greet("alice"))
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "HELLO, ALICE");
     }
 
@@ -622,7 +802,7 @@ class MyContext:
 with MyContext() as ctx:
     print("inside context")
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "entering context\ninside context\nexiting context");
     }
 
@@ -632,7 +812,7 @@ with MyContext() as ctx:
 for i in range(1000):
     print(i)
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         let lines: Vec<&str> = res.trim().split('\n').collect();
         assert_eq!(lines.len(), 1000);
         assert_eq!(lines[0], "0");
@@ -647,7 +827,7 @@ y = 10
 result = x + y
 # No print statements
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "");
     }
 
@@ -660,7 +840,7 @@ data = json.loads(sys.stdin.read())
 print(f"{data['name']} is {data['age']} years old")
         "#;
         let stdin_input = r#"{"name": "John", "age": 30}"#;
-        let res = compile_python(content, stdin_input).await.unwrap();
+        let res = compile_python(content, stdin_input, &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "John is 30 years old");
     }
 
@@ -675,7 +855,7 @@ for line in lines:
 print(f"Sum: {total}")
         "#;
         let stdin_input = "10\n20\n30";
-        let res = compile_python(content, stdin_input).await.unwrap();
+        let res = compile_python(content, stdin_input, &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Sum: 60");
     }
 
@@ -688,7 +868,7 @@ words = text.split()
 print(f"Word count: {len(words)}")
         "#;
         let stdin_input = "hello world python programming";
-        let res = compile_python(content, stdin_input).await.unwrap();
+        let res = compile_python(content, stdin_input, &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Word count: 4");
     }
 
@@ -700,7 +880,7 @@ print("before exit")
 sys.exit(2)
 print("after exit")
         "#;
-        let result = compile_python(content, "").await;
+        let result = compile_python(content, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -715,7 +895,7 @@ def process_data(items: List[int]) -> Dict[str, int]:
 result = process_data([1, 2, 3, 4, 5])
 print(f"Count: {result['count']}, Sum: {result['sum']}")
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Count: 5, Sum: 15");
     }
 
@@ -734,7 +914,7 @@ async def main():
 
 asyncio.run(main())
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "Hello, Alice!");
     }
 
@@ -745,7 +925,7 @@ numbers = [1, 2, 3, 4, 5]
 if (n := len(numbers)) > 3:
     print(f"List has {n} items")
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "List has 5 items");
     }
 
@@ -757,7 +937,27 @@ age = 30
 print(f"{name.upper()} is {age * 12} months old")
 print(f"Next year: {age + 1}")
         "#;
-        let res = compile_python(content, "").await.unwrap();
+        let res = compile_python(content, "", &ExecContext::default()).await.unwrap();
         assert_eq!(res.trim(), "ALICE is 360 months old\nNext year: 31");
     }
+
+    #[test]
+    fn test_python_packages_match_normalized_names() {
+        let packages = "numpy, Pillow, typing_extensions".parse::<PythonPackages>().unwrap();
+        assert_eq!(packages.names(), ["numpy", "pillow", "typing-extensions"]);
+        assert!(packages.contains("pillow"));
+        assert!(packages.contains("Typing.Extensions"));
+        assert!(!packages.contains("requests"));
+        assert!("numpy>=2".parse::<PythonPackages>().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_compile_python_rejects_unlisted_dependency() {
+        let ctx = ExecContext::default().with_dependencies(vec!["left-pad".into()]);
+        let Err(InfraError::CompilationError(err)) = compile_python("print(1)", "", &ctx).await
+        else {
+            panic!("expected a compilation error");
+        };
+        assert!(err.to_string().contains("left-pad"));
+    }
 }
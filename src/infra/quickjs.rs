@@ -0,0 +1,325 @@
+use std::{fmt, process::Output, str::FromStr};
+
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+
+use super::{error::InfraError, runner::ExecContext, wasm::forward_output};
+
+// Globals only a full runtime provides. Scripts that mention any of them are
+// sent to bun when the engine is picked automatically.
+const RUNTIME_APIS: &[&str] = &[
+    "require(",
+    "import ",
+    "import(",
+    "process.",
+    "Bun.",
+    "Deno.",
+    "Buffer",
+    "fetch(",
+    "setTimeout",
+    "setInterval",
+    "setImmediate",
+];
+
+// Which engine runs JavaScript: one of the installed runtimes, the embedded
+// QuickJS interpreter, or the embedded one unless the script needs runtime
+// APIs it lacks.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+#[serde(rename_all = "lowercase")]
+pub enum JsEngine {
+    #[default]
+    Bun,
+    Node,
+    Deno,
+    Embedded,
+    Auto,
+}
+
+impl JsEngine {
+    pub const AVAILABLE: bool = cfg!(feature = "quickjs");
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            JsEngine::Bun => "bun",
+            JsEngine::Node => "node",
+            JsEngine::Deno => "deno",
+            JsEngine::Embedded => "embedded",
+            JsEngine::Auto => "auto",
+        }
+    }
+
+    // Node needs a flag, and on older releases cannot strip types at all.
+    pub fn runs_typescript(&self) -> bool {
+        matches!(self, JsEngine::Bun | JsEngine::Deno)
+    }
+
+    // Deno is run with npm resolution off, and the embedded engine has no
+    // module loader.
+    pub fn loads_packages(&self) -> bool {
+        matches!(self, JsEngine::Bun | JsEngine::Node)
+    }
+
+    // The engine a script actually runs on.
+    pub fn pick(&self, content: &str) -> JsEngine {
+        match self {
+            JsEngine::Auto if Self::AVAILABLE && !needs_runtime(content) => JsEngine::Embedded,
+            JsEngine::Auto => JsEngine::Bun,
+            engine => *engine,
+        }
+    }
+}
+
+impl FromStr for JsEngine {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.trim().to_ascii_lowercase().as_str() {
+            "bun" => Ok(JsEngine::Bun),
+            "node" => Ok(JsEngine::Node),
+            "deno" => Ok(JsEngine::Deno),
+            "embedded" if JsEngine::AVAILABLE => Ok(JsEngine::Embedded),
+            "embedded" => Err(String::from(
+                "the embedded JavaScript engine requires building with the `quickjs` feature",
+            )),
+            "auto" => Ok(JsEngine::Auto),
+            other => Err(format!("unknown JavaScript engine: {}", other)),
+        }
+    }
+}
+
+impl fmt::Display for JsEngine {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+pub fn needs_runtime(content: &str) -> bool {
+    RUNTIME_APIS.iter().any(|api| content.contains(api))
+}
+
+// Runs `content` in a fresh embedded interpreter. Scripts get `console`,
+// `readline()` returning the next line of stdin or null, and `scriptArgs`.
+pub async fn run_embedded(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+    memory_bytes: usize,
+) -> Result<Output, InfraError> {
+    let output = execute(content, stdin_input, ctx, memory_bytes).await?;
+    forward_output(&output, ctx);
+    Ok(ctx.output_encoding().encode(output))
+}
+
+#[cfg(feature = "quickjs")]
+async fn execute(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+    memory_bytes: usize,
+) -> Result<Output, InfraError> {
+    let (source, stdin) = (content.to_string(), stdin_input.to_string());
+    let (args, timeout) = (ctx.args().to_vec(), ctx.timeout());
+    tokio::task::spawn_blocking(move || engine::run(&source, &stdin, args, timeout, memory_bytes))
+        .await
+        .map_err(|err| InfraError::CompilationError(err.into()))?
+}
+
+#[cfg(not(feature = "quickjs"))]
+async fn execute(
+    _content: &str,
+    _stdin_input: &str,
+    _ctx: &ExecContext,
+    _memory_bytes: usize,
+) -> Result<Output, InfraError> {
+    Err(InfraError::UnsupportedLanguage(String::from(
+        "the embedded JavaScript engine requires building with the `quickjs` feature",
+    )))
+}
+
+#[cfg(feature = "quickjs")]
+mod engine {
+    use std::{
+        cell::RefCell,
+        collections::VecDeque,
+        os::unix::process::ExitStatusExt,
+        process::{ExitStatus, Output},
+        rc::Rc,
+        time::{Duration, Instant},
+    };
+
+    use rquickjs::{
+        CatchResultExt, CaughtError, Coerced, Context, Ctx, Function, Object, Runtime,
+        prelude::Rest,
+    };
+
+    use super::InfraError;
+
+    const MAX_STACK_BYTES: usize = 1 << 20;
+
+    type Buffer = Rc<RefCell<Vec<u8>>>;
+
+    fn js_error(err: rquickjs::Error) -> InfraError {
+        InfraError::CompilationError(err.into())
+    }
+
+    fn printer<'js>(ctx: &Ctx<'js>, buffer: &Buffer) -> rquickjs::Result<Function<'js>> {
+        let buffer = buffer.clone();
+        Function::new(ctx.clone(), move |args: Rest<Coerced<String>>| {
+            let line: Vec<_> = args.0.into_iter().map(|arg| arg.0).collect();
+            let mut buffer = buffer.borrow_mut();
+            buffer.extend_from_slice(line.join(" ").as_bytes());
+            buffer.push(b'\n');
+        })
+    }
+
+    fn install_globals(
+        ctx: &Ctx<'_>,
+        stdin: &str,
+        args: Vec<String>,
+        stdout: &Buffer,
+        stderr: &Buffer,
+    ) -> rquickjs::Result<()> {
+        let console = Object::new(ctx.clone())?;
+        for name in ["log", "info", "debug"] {
+            console.set(name, printer(ctx, stdout)?)?;
+        }
+        for name in ["error", "warn"] {
+            console.set(name, printer(ctx, stderr)?)?;
+        }
+        let globals = ctx.globals();
+        globals.set("console", console)?;
+
+        let lines: RefCell<VecDeque<String>> =
+            RefCell::new(stdin.lines().map(String::from).collect());
+        globals.set(
+            "readline",
+            Function::new(ctx.clone(), move || lines.borrow_mut().pop_front())?,
+        )?;
+        globals.set("scriptArgs", args)?;
+        Ok(())
+    }
+
+    pub fn run(
+        source: &str,
+        stdin: &str,
+        args: Vec<String>,
+        timeout: Option<Duration>,
+        memory_bytes: usize,
+    ) -> Result<Output, InfraError> {
+        let runtime = Runtime::new().map_err(js_error)?;
+        runtime.set_memory_limit(memory_bytes);
+        runtime.set_max_stack_size(MAX_STACK_BYTES);
+        let deadline = timeout.map(|limit| Instant::now() + limit);
+        runtime.set_interrupt_handler(Some(Box::new(move || {
+            deadline.is_some_and(|deadline| Instant::now() >= deadline)
+        })));
+        let context = Context::full(&runtime).map_err(js_error)?;
+
+        let stdout = Buffer::default();
+        let stderr = Buffer::default();
+        let code = context.with(|ctx| {
+            install_globals(&ctx, stdin, args, &stdout, &stderr)?;
+            let result = ctx.eval::<(), _>(source).catch(&ctx);
+            let message = match result {
+                Ok(()) => return Ok(0),
+                Err(CaughtError::Exception(exception)) => exception.to_string(),
+                Err(CaughtError::Value(value)) => format!("Uncaught {:?}", value),
+                Err(CaughtError::Error(err)) => err.to_string(),
+            };
+            let mut stderr = stderr.borrow_mut();
+            stderr.extend_from_slice(message.as_bytes());
+            stderr.push(b'\n');
+            Ok::<_, rquickjs::Error>(1)
+        });
+        let mut code = code.map_err(js_error)?;
+        // Settle promises the script left behind, so async functions get to
+        // print before the interpreter goes away.
+        while code == 0 && runtime.is_job_pending() {
+            if runtime.execute_pending_job().is_err() {
+                code = 1;
+            }
+        }
+        if let (Some(deadline), Some(limit)) = (deadline, timeout) {
+            if Instant::now() >= deadline {
+                return Err(InfraError::timeout(limit));
+            }
+        }
+
+        let (stdout, stderr) = (stdout.take(), stderr.take());
+        Ok(Output {
+            status: ExitStatus::from_raw(code << 8),
+            stdout,
+            stderr,
+        })
+    }
+}
+
+#[cfg(test)]
+mod quickjs_tests {
+    use super::*;
+
+    #[test]
+    fn test_needs_runtime_spots_node_apis() {
+        assert!(!needs_runtime("console.log([1, 2, 3].map(x => x * 2))"));
+        assert!(needs_runtime("const fs = require('fs')"));
+        assert!(needs_runtime("import { readFileSync } from 'fs'"));
+        assert!(needs_runtime("console.log(process.argv)"));
+        assert!(needs_runtime("setTimeout(() => console.log(1), 10)"));
+    }
+
+    #[test]
+    fn test_pick_falls_back_to_bun() {
+        assert_eq!(JsEngine::Bun.pick("console.log(1)"), JsEngine::Bun);
+        assert_eq!(JsEngine::Deno.pick("console.log(1)"), JsEngine::Deno);
+        assert_eq!(JsEngine::Auto.pick("require('os')"), JsEngine::Bun);
+        let expected = if JsEngine::AVAILABLE {
+            JsEngine::Embedded
+        } else {
+            JsEngine::Bun
+        };
+        assert_eq!(JsEngine::Auto.pick("console.log(1)"), expected);
+    }
+
+    #[test]
+    fn test_parse_engine() {
+        assert_eq!("Bun".parse::<JsEngine>().unwrap(), JsEngine::Bun);
+        assert_eq!("auto".parse::<JsEngine>().unwrap(), JsEngine::Auto);
+        assert_eq!("embedded".parse::<JsEngine>().is_ok(), JsEngine::AVAILABLE);
+        assert_eq!("deno".parse::<JsEngine>().unwrap(), JsEngine::Deno);
+        assert!("spidermonkey".parse::<JsEngine>().is_err());
+    }
+
+    #[cfg(feature = "quickjs")]
+    #[tokio::test]
+    async fn test_embedded_reads_stdin_and_reports_exceptions() {
+        let script = "let line; while ((line = readline()) !== null) console.log(line.toUpperCase(), scriptArgs[0]);";
+        let ctx = ExecContext::default().with_args(vec!["!".into()]);
+        let output = run_embedded(script, "a\nb\n", &ctx, 16 << 20)
+            .await
+            .unwrap();
+        assert_eq!(output.stdout, b"A !\nB !\n");
+        assert!(output.status.success());
+
+        let output = run_embedded("throw new Error('boom')", "", &ctx, 16 << 20)
+            .await
+            .unwrap();
+        assert_eq!(output.status.code(), Some(1));
+        assert!(String::from_utf8_lossy(&output.stderr).contains("boom"));
+    }
+
+    #[cfg(feature = "quickjs")]
+    #[tokio::test]
+    async fn test_embedded_enforces_time_and_memory_budgets() {
+        let ctx = ExecContext::default().with_timeout(std::time::Duration::from_millis(100));
+        let err = run_embedded("for (;;) {}", "", &ctx, 16 << 20)
+            .await
+            .unwrap_err();
+        assert!(matches!(err, InfraError::Timeout(..)));
+
+        let hog = "const parts = []; for (;;) parts.push('x'.repeat(1 << 20));";
+        let output = run_embedded(hog, "", &ExecContext::default(), 16 << 20)
+            .await
+            .unwrap();
+        assert_eq!(output.status.code(), Some(1));
+    }
+}
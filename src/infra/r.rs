@@ -1,30 +1,21 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
-
-pub async fn compile_r(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".R")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
-
-    let source_path = temp_file.path().to_path_buf();
-
-    let mut cmd = Command::new(which("Rscript")?)
-        .arg(&source_path)
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
-
-    let output = cmd.wait_with_output().await?;
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+};
+
+pub async fn compile_r(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::R, content)?;
+    let source_path = source.path().to_path_buf();
+
+    let mut cmd = ctx.command("Rscript")?;
+    cmd.arg(&source_path);
+    let output = run_program(&mut cmd, stdin_input, ctx).await?;
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
         Some(code) => {
@@ -49,6 +40,7 @@ pub async fn compile_r(content: &str, stdin_input: &str) -> Result<String, Infra
 #[cfg(test)]
 mod r_tests {
     use super::*;
+    use crate::infra::images::HEADLESS_ENV;
 
     #[tokio::test]
     async fn test_simple_hello_world() {
@@ -56,7 +48,7 @@ mod r_tests {
 cat("Hello, World!\n")
 "#;
 
-        let result = compile_r(r_code, "").await;
+        let result = compile_r(r_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
     }
@@ -69,7 +61,7 @@ b <- 3
 cat(a + b, "\n")
 "#;
 
-        let result = compile_r(r_code, "").await;
+        let result = compile_r(r_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "8");
     }
@@ -81,7 +73,7 @@ num <- as.integer(readLines("stdin", n=1))
 cat(sprintf("You entered: %d\n", num))
 "#;
 
-        let result = compile_r(r_code, "42").await;
+        let result = compile_r(r_code, "42", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "You entered: 42");
     }
@@ -93,7 +85,7 @@ name <- readLines("stdin", n=1)
 cat(sprintf("Hello, %s!\n", name))
 "#;
 
-        let result = compile_r(r_code, "Alice").await;
+        let result = compile_r(r_code, "Alice", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, Alice!");
     }
@@ -106,7 +98,7 @@ for (i in 1:3) {
 }
 "#;
 
-        let result = compile_r(r_code, "").await;
+        let result = compile_r(r_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Line 1"));
@@ -120,7 +112,7 @@ for (i in 1:3) {
 cat("Missing closing quote
 "#;
 
-        let result = compile_r(invalid_r_code, "").await;
+        let result = compile_r(invalid_r_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -130,7 +122,7 @@ cat("Missing closing quote
 stop("compiletime error")
 "#;
 
-        let result = compile_r(r_code, "").await;
+        let result = compile_r(r_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -144,7 +136,7 @@ cat(sprintf("Sum: %d\n", a + b))
 cat(sprintf("Product: %d\n", a * b))
 "#;
 
-        let result = compile_r(r_code, "7 3").await;
+        let result = compile_r(r_code, "7 3", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Sum: 10"));
@@ -156,7 +148,7 @@ cat(sprintf("Product: %d\n", a * b))
         let r_code = r#"
 "#;
 
-        let result = compile_r(r_code, "").await;
+        let result = compile_r(r_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
@@ -168,7 +160,7 @@ str <- "Hello"
 cat(sprintf("Length: %d\n", nchar(str)))
 "#;
 
-        let result = compile_r(r_code, "").await;
+        let result = compile_r(r_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Length: 5");
     }
@@ -180,8 +172,27 @@ x <- 16.0
 cat(sprintf("Square root of %s is %s\n", x, sqrt(x)))
 "#;
 
-        let result = compile_r(r_code, "").await;
+        let result = compile_r(r_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Square root of 16 is 4");
     }
+
+    #[tokio::test]
+    async fn test_headless_plots_are_written_as_png() {
+        let workspace = tempfile::TempDir::new().unwrap();
+        let ctx = ExecContext::default()
+            .with_workspace(workspace.path().to_path_buf())
+            .with_envs(
+                HEADLESS_ENV
+                    .iter()
+                    .map(|(key, value)| (key.to_string(), value.to_string())),
+            );
+        let r_code = r#"
+plot(c(1, 2, 3))
+"#;
+
+        let result = compile_r(r_code, "", &ctx).await;
+        assert!(result.is_ok());
+        assert!(workspace.path().join("Rplot001.png").is_file());
+    }
 }
@@ -0,0 +1,222 @@
+use std::{io, time::Duration};
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+use uuid::Uuid;
+
+use super::{
+    dispatch::Assignment,
+    groups::JobGroup,
+    jobs::{JobQueue, JobSpec},
+    judge::TestCase,
+    matrix::ToolchainVersions,
+    scheduler::Priority,
+    store::Store,
+};
+
+// A judged submission kept under its problem, so it can be judged again
+// when the problem's tests change. Each is a store entry of its own, found
+// by its problem's key prefix, so nodes keeping submissions at once do not
+// race over a shared list, and each expires on its own. What it ran travels as a job would to a
+// remote worker, its stdin left empty.
+#[derive(Debug, Serialize, Deserialize)]
+struct KeptSubmission {
+    id: String,
+    tenant: String,
+    submitted_at: DateTime<Utc>,
+    assignment: Assignment,
+}
+
+// Which of a problem's kept submissions to regrade.
+#[derive(Debug, Clone, Default, Deserialize, ToSchema)]
+pub struct RegradeFilter {
+    #[schema(example = "two-sum")]
+    pub problem: String,
+    // Only submissions in this language.
+    #[schema(example = "python")]
+    pub language: Option<String>,
+    // Only submissions judged at or after this time.
+    pub since: Option<DateTime<Utc>>,
+}
+
+impl RegradeFilter {
+    fn matches(&self, kept: &KeptSubmission) -> bool {
+        let language = self
+            .language
+            .as_ref()
+            .is_none_or(|language| language.eq_ignore_ascii_case(&kept.assignment.lang));
+        let since = self.since.is_none_or(|since| kept.submitted_at >= since);
+        language && since
+    }
+}
+
+fn submission_prefix(problem: &str) -> String {
+    format!("submission:{}:", problem)
+}
+
+fn submission_key(problem: &str, id: &str) -> String {
+    format!("{}{}", submission_prefix(problem), id)
+}
+
+// Keeps what `spec` runs under `problem` for `retention`, or indefinitely,
+// and returns the id it is kept under.
+pub fn keep_submission(
+    store: &Store,
+    retention: Option<Duration>,
+    problem: &str,
+    tenant: &str,
+    spec: JobSpec,
+) -> io::Result<String> {
+    let id = Uuid::new_v4().to_string();
+    let kept = KeptSubmission {
+        id: id.clone(),
+        tenant: tenant.to_string(),
+        submitted_at: Utc::now(),
+        assignment: Assignment::new(&id, spec),
+    };
+    store.put(&submission_key(problem, &id), &kept, retention)?;
+    Ok(id)
+}
+
+// The problem's kept submissions, oldest first. Keys with a colon past the
+// prefix belong to another problem whose name starts with this one's.
+fn submissions(store: &Store, problem: &str) -> Vec<KeptSubmission> {
+    let prefix = submission_prefix(problem);
+    let mut kept: Vec<KeptSubmission> = store
+        .keys(&prefix)
+        .iter()
+        .filter(|key| !key[prefix.len()..].contains(':'))
+        .filter_map(|key| store.get(key))
+        .collect();
+    kept.sort_by_key(|kept| kept.submitted_at);
+    kept
+}
+
+// Queues every kept submission the filter matches against each of `tests`,
+// one low priority job per submission and test so live submissions go
+// first, and returns the group they were queued in. Submissions on a
+// toolchain version no longer installed are left out.
+pub fn regrade(
+    queue: &JobQueue,
+    store: &Store,
+    retention: Duration,
+    filter: &RegradeFilter,
+    tests: &[TestCase],
+    versions: &'static ToolchainVersions,
+) -> io::Result<JobGroup> {
+    let mut group = JobGroup::new(Some(format!("regrade:{}", filter.problem)));
+    let mut regraded = 0;
+    for kept in submissions(store, &filter.problem) {
+        if !filter.matches(&kept) {
+            continue;
+        }
+        let ran = match kept.assignment.into_spec(versions) {
+            Ok(spec) => spec,
+            Err(err) => {
+                tracing::warn!("not regrading submission {}: {}", kept.id, err);
+                continue;
+            }
+        };
+        regraded += 1;
+        for (index, test) in tests.iter().enumerate() {
+            let spec = JobSpec {
+                stdin: test.stdin.clone(),
+                expected_output: test.expected_output.clone(),
+                time_limit: test.time_limit_ms.map(Duration::from_millis),
+                memory_limit: test.memory_limit_bytes,
+                priority: Priority::Low,
+                ..ran.clone()
+            };
+            let submission = Some(kept.id.clone());
+            group.submit(queue, &kept.tenant, spec, submission, Some(index));
+        }
+    }
+    group.save(store, retention)?;
+    tracing::info!(
+        "regrading {} submissions of {} in group {}",
+        regraded,
+        filter.problem,
+        group.id
+    );
+    Ok(group)
+}
+
+#[cfg(test)]
+mod regrade_tests {
+    use super::*;
+    use crate::infra::{interactive::Verdict, jobs::JobStatus};
+
+    fn spec(lang: &str, content: &str) -> JobSpec {
+        JobSpec {
+            lang: lang.into(),
+            content: content.into(),
+            ..Default::default()
+        }
+    }
+
+    fn test(stdin: &str, expected_output: &str) -> TestCase {
+        TestCase {
+            stdin: stdin.into(),
+            expected_output: Some(expected_output.into()),
+            ..TestCase::default()
+        }
+    }
+
+    #[test]
+    fn test_regrade_queues_matching_submissions_against_each_test() {
+        let store: &'static Store = Box::leak(Box::new(Store::memory()));
+        let queue = JobQueue::new(Duration::from_secs(3600), store);
+        let versions: &'static ToolchainVersions = Box::leak(Box::default());
+        let python = keep_submission(store, None, "sum", "a", spec("python", "print(1)")).unwrap();
+        keep_submission(store, None, "sum", "b", spec("ruby", "puts 1")).unwrap();
+        keep_submission(store, None, "other", "a", spec("python", "print(2)")).unwrap();
+
+        let filter = RegradeFilter {
+            problem: "sum".into(),
+            language: Some("Python".into()),
+            since: None,
+        };
+        let tests = [test("1", "1"), test("2", "2")];
+        let group = regrade(&queue, store, Duration::from_secs(3600), &filter, &tests, versions)
+            .unwrap();
+        assert_eq!(group.members.len(), 2);
+        assert!(
+            group
+                .members
+                .iter()
+                .all(|member| member.submission.as_deref() == Some(python.as_str()))
+        );
+
+        let (id, claimed) = queue.claim().unwrap();
+        assert_eq!(id, group.members[0].job_id);
+        assert_eq!(claimed.priority, Priority::Low);
+        assert_eq!(claimed.content, "print(1)");
+        assert_eq!(claimed.stdin, "1");
+        assert_eq!(claimed.group.as_deref(), Some(group.id.as_str()));
+        assert!(queue.complete(&id, Ok("1\n".into()), Some(Verdict::Accepted)));
+
+        let status = JobGroup::load(store, &group.id).unwrap().status(&queue);
+        assert_eq!(status.name.as_deref(), Some("regrade:sum"));
+        assert_eq!((status.total, status.waiting, status.finished), (2, 1, 1));
+        assert_eq!(status.jobs[0].status, JobStatus::Completed);
+        assert_eq!(status.jobs[0].verdict, Some(Verdict::Accepted));
+        assert_eq!(status.jobs[1].test, Some(1));
+    }
+
+    #[test]
+    fn test_submissions_are_listed_by_problem_until_they_expire() {
+        let store = Store::memory();
+        let first = keep_submission(&store, None, "sum", "a", spec("python", "")).unwrap();
+        let second = keep_submission(&store, None, "sum", "a", spec("ruby", "")).unwrap();
+        keep_submission(&store, None, "sum:2", "a", spec("python", "")).unwrap();
+        let ids: Vec<_> = submissions(&store, "sum")
+            .into_iter()
+            .map(|kept| kept.id)
+            .collect();
+        assert_eq!(ids, [first.clone(), second]);
+
+        store.remove(&submission_key("sum", &first)).unwrap();
+        assert_eq!(submissions(&store, "sum").len(), 1);
+    }
+}
@@ -0,0 +1,42 @@
+use tokio::signal::unix::{SignalKind, signal};
+
+use crate::config::config;
+
+use super::{
+    imports::reload_import_policy, limits::reload_language_defaults, plugin::load_plugins,
+    policy::reload_submission_policy, tls::load_tls,
+};
+
+// Reloads the language registry, the per-language limits, the submission
+// and import policies and the TLS certificate each time the server
+// receives SIGHUP, so operators can add a language, change its limits or
+// rules, or renew the certificate without a restart. Programs already running are not affected.
+pub async fn reload_on_hangup() {
+    let mut hangups = match signal(SignalKind::hangup()) {
+        Ok(hangups) => hangups,
+        Err(err) => {
+            tracing::warn!("cannot listen for SIGHUP, reloading is disabled: {}", err);
+            return;
+        }
+    };
+    while hangups.recv().await.is_some() {
+        tracing::info!("reloading configuration");
+        reload().await;
+    }
+}
+
+pub async fn reload() {
+    load_plugins(config().await.plugins_dir()).await;
+    if let Err(err) = reload_language_defaults().await {
+        tracing::error!("kept the previous language limits: {}", err);
+    }
+    if let Err(err) = reload_submission_policy().await {
+        tracing::error!("kept the previous submission policy: {}", err);
+    }
+    if let Err(err) = reload_import_policy().await {
+        tracing::error!("kept the previous import policy: {}", err);
+    }
+    if let Err(err) = load_tls().await {
+        tracing::error!("kept the previous TLS certificate: {}", err);
+    }
+}
@@ -1,30 +1,34 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
-
-pub async fn compile_ruby(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".rb")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
-
-    let source_path = temp_file.path().to_path_buf();
-
-    let mut cmd = Command::new(which("ruby")?)
-        .arg(&source_path)
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
+use std::process::Output;
+
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+    warm::warm_pool,
+};
+
+pub async fn compile_ruby(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::RUBY, content)?;
+    let source_path = source.path().to_path_buf();
+
+    let warm = warm_pool().and_then(|pool| pool.checkout(Language::RUBY, ctx));
+    let output = match warm {
+        Some(process) => process.run(&source_path, stdin_input, ctx).await?,
+        None => {
+            let mut cmd = ctx.command("ruby")?;
+            cmd.arg(&source_path);
+            run_program(&mut cmd, stdin_input, ctx).await?
+        }
+    };
+    program_result(output)
+}
 
-    let output = cmd.wait_with_output().await?;
+pub fn program_result(output: Output) -> Result<String, InfraError> {
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
         Some(code) => {
@@ -56,7 +60,7 @@ mod ruby_tests {
 puts "Hello, World!"
 "#;
 
-        let result = compile_ruby(ruby_code, "").await;
+        let result = compile_ruby(ruby_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
     }
@@ -69,7 +73,7 @@ b = 3
 puts a + b
 "#;
 
-        let result = compile_ruby(ruby_code, "").await;
+        let result = compile_ruby(ruby_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "8");
     }
@@ -81,7 +85,7 @@ num = gets.to_i
 puts "You entered: #{num}"
 "#;
 
-        let result = compile_ruby(ruby_code, "42").await;
+        let result = compile_ruby(ruby_code, "42", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "You entered: 42");
     }
@@ -93,7 +97,7 @@ name = gets.chomp
 puts "Hello, #{name}!"
 "#;
 
-        let result = compile_ruby(ruby_code, "Alice").await;
+        let result = compile_ruby(ruby_code, "Alice", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, Alice!");
     }
@@ -106,7 +110,7 @@ puts "Hello, #{name}!"
 end
 "#;
 
-        let result = compile_ruby(ruby_code, "").await;
+        let result = compile_ruby(ruby_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Line 1"));
@@ -120,7 +124,7 @@ end
 puts "Missing closing quote
 "#;
 
-        let result = compile_ruby(invalid_ruby_code, "").await;
+        let result = compile_ruby(invalid_ruby_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -130,10 +134,22 @@ puts "Missing closing quote
 raise "compiletime error"
 "#;
 
-        let result = compile_ruby(ruby_code, "").await;
+        let result = compile_ruby(ruby_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
+    #[tokio::test]
+    async fn test_program_args() {
+        let ruby_code = r#"
+puts ARGV.join(",")
+"#;
+
+        let ctx = ExecContext::default().with_args(vec![String::from("a"), String::from("b c")]);
+        let result = compile_ruby(ruby_code, "", &ctx).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "a,b c");
+    }
+
     #[tokio::test]
     async fn test_complex_stdin_processing() {
         let ruby_code = r#"
@@ -142,7 +158,7 @@ puts "Sum: #{a + b}"
 puts "Product: #{a * b}"
 "#;
 
-        let result = compile_ruby(ruby_code, "7 3").await;
+        let result = compile_ruby(ruby_code, "7 3", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Sum: 10"));
@@ -154,7 +170,7 @@ puts "Product: #{a * b}"
         let ruby_code = r#"
 "#;
 
-        let result = compile_ruby(ruby_code, "").await;
+        let result = compile_ruby(ruby_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
@@ -166,7 +182,7 @@ str = "Hello"
 puts "Length: #{str.length}"
 "#;
 
-        let result = compile_ruby(ruby_code, "").await;
+        let result = compile_ruby(ruby_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Length: 5");
     }
@@ -178,7 +194,7 @@ x = 16.0
 puts "Square root of #{x} is #{Math.sqrt(x)}"
 "#;
 
-        let result = compile_ruby(ruby_code, "").await;
+        let result = compile_ruby(ruby_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Square root of 16.0 is 4.0");
     }
@@ -190,7 +206,7 @@ thread = Thread.new { puts "Thread compilening" }
 thread.join
 "#;
 
-        let result = compile_ruby(ruby_code, "").await;
+        let result = compile_ruby(ruby_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Thread compilening");
     }
@@ -0,0 +1,1602 @@
+use std::{
+    env, io,
+    os::unix::process::ExitStatusExt,
+    path::{Path, PathBuf},
+    process::{ExitStatus, Output, Stdio},
+    sync::{
+        Arc, Mutex,
+        atomic::{AtomicU64, Ordering},
+    },
+    time::{Duration, Instant},
+};
+
+use base64::{Engine as _, engine::general_purpose::STANDARD};
+use nix::sys::resource::{Resource, setrlimit};
+
+use serde::{Deserialize, Serialize};
+use tokio::{
+    io::{AsyncRead, AsyncReadExt, AsyncWriteExt},
+    process::{Child, Command},
+    sync::mpsc::{self, UnboundedSender},
+};
+use utoipa::ToSchema;
+
+use super::{
+    calibration::calibration,
+    error::{Crash, InfraError, PARTIAL_OUTPUT_MAX_BYTES, PartialRun},
+    executions::{ProcessUsage, UsageMeter, attach},
+    fsview::filesystem_view,
+    interactive::Interaction,
+    quickjs::JsEngine,
+    sandbox::{sandbox_user, sandboxed},
+    seccomp::SyscallProfile,
+    shared_build::SharedBuild,
+    wasm::Backend,
+    workspace::disk_usage,
+};
+
+// Toolchains need these to locate themselves and their caches; everything
+// else in the server's environment, such as the tokens set for the API, is
+// withheld from compilers and user programs.
+pub const INHERITED_ENV: &[&str] = &[
+    "PATH",
+    "HOME",
+    "LANG",
+    "LC_ALL",
+    "TMPDIR",
+    "NIX_PATH",
+    "JAVA_HOME",
+    "GOCACHE",
+    "GOPATH",
+    "XDG_CACHE_HOME",
+    "DENO_DIR",
+];
+
+const QUOTA_POLL_INTERVAL: Duration = Duration::from_millis(100);
+const MEMORY_SAMPLE_INTERVAL: Duration = Duration::from_millis(10);
+const USAGE_SAMPLE_INTERVAL: Duration = Duration::from_millis(500);
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize, ToSchema)]
+#[serde(tag = "stream", content = "data", rename_all = "lowercase")]
+pub enum OutputChunk {
+    Stdout(String),
+    Stderr(String),
+}
+
+impl OutputChunk {
+    pub fn text(&self) -> &str {
+        match self {
+            OutputChunk::Stdout(text) | OutputChunk::Stderr(text) => text,
+        }
+    }
+}
+
+// What a running program is using, sent now and then to the context's usage
+// stream so a client can watch it near its limits.
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, ToSchema)]
+pub struct UsageSample {
+    #[schema(example = 1500)]
+    pub elapsed_ms: u64,
+    // Of one core since the last sample, so above 100 for a program busy
+    // on several.
+    #[schema(example = 98.5)]
+    pub cpu_percent: f64,
+    // Resident now, for the program itself and not what it started.
+    #[schema(example = 9437184)]
+    pub memory_bytes: u64,
+    // Written to stdout and stderr so far.
+    #[schema(example = 2048)]
+    pub output_bytes: u64,
+}
+
+// How a program's stdout is returned. Text must be valid UTF-8; base64
+// carries any bytes, such as an image written to stdout or Latin-1 text.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+#[serde(rename_all = "lowercase")]
+pub enum OutputEncoding {
+    #[default]
+    Text,
+    Base64,
+}
+
+impl OutputEncoding {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            OutputEncoding::Text => "text",
+            OutputEncoding::Base64 => "base64",
+        }
+    }
+
+    // Streamed chunks and stderr are left as text either way.
+    pub fn encode(&self, mut output: Output) -> Output {
+        if *self == OutputEncoding::Base64 {
+            output.stdout = STANDARD.encode(&output.stdout).into_bytes();
+        }
+        output
+    }
+}
+
+#[derive(Debug, Clone, Default)]
+pub struct ExecContext {
+    output: Option<UnboundedSender<OutputChunk>>,
+    usage_stream: Option<UnboundedSender<UsageSample>>,
+    workspace: Option<PathBuf>,
+    envs: Vec<(String, String)>,
+    locale: Option<String>,
+    timezone: Option<String>,
+    args: Vec<String>,
+    compiler_flags: Vec<String>,
+    timeout: Option<Duration>,
+    program_timeout: Option<Duration>,
+    cpu_time_limit: Option<Duration>,
+    compile_timeout: Option<Duration>,
+    memory_limit: Option<u64>,
+    max_output: Option<usize>,
+    toolchain_dir: Option<PathBuf>,
+    cpus: Vec<usize>,
+    seccomp: Option<(PathBuf, SyscallProfile)>,
+    offline: bool,
+    disk_quota: Option<u64>,
+    backend: Backend,
+    js_engine: Option<JsEngine>,
+    dependencies: Vec<String>,
+    setup: String,
+    coverage_dir: Option<PathBuf>,
+    sanitizer_dir: Option<PathBuf>,
+    profile_dir: Option<PathBuf>,
+    interaction: Option<Interaction>,
+    shared_build: Option<SharedBuild>,
+    meter: Option<UsageMeter>,
+    output_encoding: OutputEncoding,
+    stdin_file: Option<PathBuf>,
+    stdin_stream: Option<StdinStream>,
+    partial_output: Option<PartialOutput>,
+    compiler_warnings: Option<CompilerWarnings>,
+    compile_log: Option<UnboundedSender<OutputChunk>>,
+}
+
+// Chunks of stdin that arrive while the program runs, such as a request
+// body still being received. The channel is bounded, so a program that
+// reads slowly holds up the sender instead of its input piling up in
+// memory. Only the first program started takes the chunks.
+#[derive(Debug, Clone)]
+pub struct StdinStream(Arc<Mutex<Option<mpsc::Receiver<Vec<u8>>>>>);
+
+impl StdinStream {
+    pub fn channel(capacity: usize) -> (mpsc::Sender<Vec<u8>>, Self) {
+        let (tx, rx) = mpsc::channel(capacity);
+        (tx, StdinStream(Arc::new(Mutex::new(Some(rx)))))
+    }
+
+    fn take(&self) -> Option<mpsc::Receiver<Vec<u8>>> {
+        self.0.lock().unwrap().take()
+    }
+}
+
+// The start of what a run's programs have written, and how the last of
+// them exited, shared by clones of the context. A run stopped by its time
+// limit or a program that died still reports it.
+#[derive(Debug, Clone, Default)]
+pub struct PartialOutput(Arc<Mutex<Written>>);
+
+#[derive(Debug, Default)]
+struct Written {
+    stdout: Vec<u8>,
+    stderr: Vec<u8>,
+    status: Option<ExitStatus>,
+    backtrace: Vec<String>,
+}
+
+impl PartialOutput {
+    fn record(&self, stream: Stream, bytes: &[u8]) {
+        let mut written = self.0.lock().unwrap();
+        let kept = match stream {
+            Stream::Stdout => &mut written.stdout,
+            Stream::Stderr => &mut written.stderr,
+        };
+        let room = PARTIAL_OUTPUT_MAX_BYTES.saturating_sub(kept.len());
+        kept.extend_from_slice(&bytes[..bytes.len().min(room)]);
+    }
+
+    fn exited(&self, status: ExitStatus) {
+        self.0.lock().unwrap().status = Some(status);
+    }
+}
+
+// What compilers printed while still building the program, such as
+// warnings, collected for the response. Shared by clones of the context.
+#[derive(Debug, Clone, Default)]
+pub struct CompilerWarnings(Arc<Mutex<String>>);
+
+impl CompilerWarnings {
+    // Everything collected so far, or None if the compilers said nothing.
+    pub fn take(&self) -> Option<String> {
+        let warnings = std::mem::take(&mut *self.0.lock().unwrap());
+        (!warnings.trim().is_empty()).then_some(warnings)
+    }
+}
+
+impl ExecContext {
+    pub fn with_output(mut self, output: UnboundedSender<OutputChunk>) -> Self {
+        self.output = Some(output);
+        self
+    }
+
+    pub fn output(&self) -> Option<&UnboundedSender<OutputChunk>> {
+        self.output.as_ref()
+    }
+
+    pub fn with_usage_stream(mut self, usage: UnboundedSender<UsageSample>) -> Self {
+        self.usage_stream = Some(usage);
+        self
+    }
+
+    pub fn with_output_encoding(mut self, encoding: OutputEncoding) -> Self {
+        self.output_encoding = encoding;
+        self
+    }
+
+    pub fn output_encoding(&self) -> OutputEncoding {
+        self.output_encoding
+    }
+
+    pub fn with_workspace(mut self, workspace: PathBuf) -> Self {
+        self.workspace = Some(workspace);
+        self
+    }
+
+    pub fn with_timeout(mut self, timeout: Duration) -> Self {
+        self.timeout = Some(timeout);
+        self
+    }
+
+    pub fn timeout(&self) -> Option<Duration> {
+        self.timeout
+    }
+
+    // Bounds each program the run starts on its own, leaving out any build
+    // step before it, which `with_timeout` includes. Languages executed
+    // in-process only honour the overall timeout.
+    pub fn with_program_timeout(mut self, timeout: Duration) -> Self {
+        self.program_timeout = Some(timeout);
+        self
+    }
+
+    pub fn program_timeout(&self) -> Option<Duration> {
+        self.program_timeout
+    }
+
+    // Bounds the CPU time each program the run starts spends, rather than
+    // how long it takes, so a busy host does not push it over. Time spent
+    // by processes the program starts is not counted.
+    pub fn with_cpu_time_limit(mut self, limit: Duration) -> Self {
+        self.cpu_time_limit = Some(limit);
+        self
+    }
+
+    pub fn cpu_time_limit(&self) -> Option<Duration> {
+        self.cpu_time_limit
+    }
+
+    // Bounds a separate compile step on its own, apart from the run.
+    pub fn with_compile_timeout(mut self, timeout: Duration) -> Self {
+        self.compile_timeout = Some(timeout);
+        self
+    }
+
+    pub fn compile_timeout(&self) -> Option<Duration> {
+        self.compile_timeout
+    }
+
+    pub fn with_memory_limit(mut self, bytes: u64) -> Self {
+        self.memory_limit = Some(bytes);
+        self
+    }
+
+    pub fn memory_limit(&self) -> Option<u64> {
+        self.memory_limit
+    }
+
+    // Caps what the program may write to each of stdout and stderr.
+    pub fn with_max_output(mut self, bytes: usize) -> Self {
+        self.max_output = Some(bytes);
+        self
+    }
+
+    pub fn max_output(&self) -> Option<usize> {
+        self.max_output
+    }
+
+    pub fn workspace(&self) -> Option<&Path> {
+        self.workspace.as_deref()
+    }
+
+    pub fn with_args(mut self, args: Vec<String>) -> Self {
+        self.args = args;
+        self
+    }
+
+    pub fn args(&self) -> &[String] {
+        &self.args
+    }
+
+    pub fn with_compiler_flags(mut self, flags: Vec<String>) -> Self {
+        self.compiler_flags = flags;
+        self
+    }
+
+    pub fn compiler_flags(&self) -> &[String] {
+        &self.compiler_flags
+    }
+
+    // Pins the toolchain to the binaries in `dir`, used to run one
+    // submission against several installed versions.
+    pub fn with_toolchain_dir(mut self, dir: PathBuf) -> Self {
+        self.toolchain_dir = Some(dir);
+        self
+    }
+
+    pub fn toolchain_dir(&self) -> Option<&Path> {
+        self.toolchain_dir.as_deref()
+    }
+
+    // Keeps the compilers and the program on `cpus`, cores no other run is
+    // given meanwhile.
+    pub fn with_cpus(mut self, cpus: Vec<usize>) -> Self {
+        self.cpus = cpus;
+        self
+    }
+
+    pub fn cpus(&self) -> &[usize] {
+        &self.cpus
+    }
+
+    // Programs are started through `launcher`, which confines them to
+    // `profile` before exec. Compilers are not affected.
+    pub fn with_syscall_profile(mut self, launcher: PathBuf, profile: SyscallProfile) -> Self {
+        self.seccomp = Some((launcher, profile));
+        self
+    }
+
+    pub fn syscall_profile(&self) -> Option<SyscallProfile> {
+        self.seccomp.as_ref().map(|(_, profile)| *profile)
+    }
+
+    // Keeps programs off the network: the syscall profile they get is one
+    // that denies sockets. Has no effect without seccomp.
+    pub fn offline(mut self) -> Self {
+        self.offline = true;
+        self
+    }
+
+    pub fn is_offline(&self) -> bool {
+        self.offline
+    }
+
+    // Caps how much a program may write: no single file may grow past
+    // `bytes`, and the workspace as a whole is checked against it while the
+    // program runs.
+    pub fn with_disk_quota(mut self, bytes: u64) -> Self {
+        self.disk_quota = Some(bytes);
+        self
+    }
+
+    pub fn disk_quota(&self) -> Option<u64> {
+        self.disk_quota
+    }
+
+    pub fn with_backend(mut self, backend: Backend) -> Self {
+        self.backend = backend;
+        self
+    }
+
+    pub fn backend(&self) -> Backend {
+        self.backend
+    }
+
+    // Overrides the instance's configured JavaScript engine, if set.
+    pub fn with_js_engine(mut self, engine: Option<JsEngine>) -> Self {
+        self.js_engine = engine;
+        self
+    }
+
+    pub fn js_engine(&self) -> Option<JsEngine> {
+        self.js_engine
+    }
+
+    pub fn with_dependencies(mut self, dependencies: Vec<String>) -> Self {
+        self.dependencies = dependencies;
+        self
+    }
+
+    pub fn dependencies(&self) -> &[String] {
+        &self.dependencies
+    }
+
+    // Statements run before the program to prepare what it works on, such
+    // as the tables a SQL program queries.
+    pub fn with_setup(mut self, setup: String) -> Self {
+        self.setup = setup;
+        self
+    }
+
+    pub fn setup(&self) -> &str {
+        &self.setup
+    }
+
+    // Runners that support coverage collect it here and leave a
+    // `CoverageReport` behind.
+    pub fn with_coverage_dir(mut self, dir: PathBuf) -> Self {
+        self.coverage_dir = Some(dir);
+        self
+    }
+
+    pub fn coverage_dir(&self) -> Option<&Path> {
+        self.coverage_dir.as_deref()
+    }
+
+    // C and C++ builds with sanitizers, which log here; the runner leaves
+    // the parsed reports behind.
+    pub fn with_sanitizer_dir(mut self, dir: PathBuf) -> Self {
+        self.sanitizer_dir = Some(dir);
+        self
+    }
+
+    pub fn sanitizer_dir(&self) -> Option<&Path> {
+        self.sanitizer_dir.as_deref()
+    }
+
+    // Runners that can profile sample the program's CPU use here and leave
+    // a `ProfileReport` behind.
+    pub fn with_profile_dir(mut self, dir: PathBuf) -> Self {
+        self.profile_dir = Some(dir);
+        self
+    }
+
+    pub fn profile_dir(&self) -> Option<&Path> {
+        self.profile_dir.as_deref()
+    }
+
+    // The program talks to an interactor over stdin and stdout, and the
+    // stdin it is given is ignored.
+    pub fn with_interaction(mut self, interaction: Interaction) -> Self {
+        self.interaction = Some(interaction);
+        self
+    }
+
+    pub fn interaction(&self) -> Option<&Interaction> {
+        self.interaction.as_ref()
+    }
+
+    // Compiled runners build the executable once for every context cloned
+    // from this one, rather than once per run.
+    pub fn with_shared_build(mut self, shared: SharedBuild) -> Self {
+        self.shared_build = Some(shared);
+        self
+    }
+
+    pub fn shared_build(&self) -> Option<&SharedBuild> {
+        self.shared_build.as_ref()
+    }
+
+    pub fn with_meter(mut self, meter: UsageMeter) -> Self {
+        self.meter = Some(meter);
+        self
+    }
+
+    pub fn meter(&self) -> Option<&UsageMeter> {
+        self.meter.as_ref()
+    }
+
+    // Streams the file to each program's stdin after the stdin it is given,
+    // so large inputs never have to be held in memory.
+    pub fn with_stdin_file(mut self, path: PathBuf) -> Self {
+        self.stdin_file = Some(path);
+        self
+    }
+
+    pub fn stdin_file(&self) -> Option<&Path> {
+        self.stdin_file.as_deref()
+    }
+
+    // Streams the chunks to stdin after the stdin it is given and any file,
+    // closing it once the sender is dropped.
+    pub fn with_stdin_stream(mut self, stream: StdinStream) -> Self {
+        self.stdin_stream = Some(stream);
+        self
+    }
+
+    pub fn streams_stdin(&self) -> bool {
+        self.stdin_file.is_some() || self.stdin_stream.is_some()
+    }
+
+    pub fn with_partial_output(mut self, partial: PartialOutput) -> Self {
+        self.partial_output = Some(partial);
+        self
+    }
+
+    // What the context's programs had written by the time the run was
+    // stopped, `elapsed` in.
+    pub fn partial_run(&self, elapsed: Duration) -> PartialRun {
+        match &self.partial_output {
+            Some(partial) => {
+                let written = partial.0.lock().unwrap();
+                PartialRun::new(elapsed, &written.stdout, &written.stderr, self.output_encoding)
+            }
+            None => PartialRun::empty(elapsed),
+        }
+    }
+
+    // Adds what the program wrote to the error its language reported, when
+    // the run's last program exited unsuccessfully. Other failures, such as
+    // a compiler's, are returned as they are.
+    pub fn crashed(
+        &self,
+        err: Box<dyn std::error::Error + Send + Sync>,
+        elapsed: Duration,
+    ) -> Box<dyn std::error::Error + Send + Sync> {
+        let (status, backtrace) = match &self.partial_output {
+            Some(partial) => {
+                let written = partial.0.lock().unwrap();
+                (written.status, written.backtrace.clone())
+            }
+            None => (None, Vec::new()),
+        };
+        match status {
+            Some(status) if !status.success() => Box::new(Crash::new(
+                status,
+                self.partial_run(elapsed),
+                backtrace,
+                err,
+            )),
+            _ => err,
+        }
+    }
+
+    // How a program run under a debugger really ended, in place of the
+    // debugger's own status, and the frames it printed.
+    pub fn record_crash(&self, status: ExitStatus, backtrace: Vec<String>) {
+        if let Some(partial) = &self.partial_output {
+            let mut written = partial.0.lock().unwrap();
+            written.status = Some(status);
+            written.backtrace = backtrace;
+        }
+    }
+
+    pub fn with_compiler_warnings(mut self, warnings: CompilerWarnings) -> Self {
+        self.compiler_warnings = Some(warnings);
+        self
+    }
+
+    // Keeps what a compiler that succeeded printed to stderr, when the
+    // context collects warnings.
+    pub fn record_warnings(&self, stderr: &[u8]) {
+        if let Some(warnings) = &self.compiler_warnings {
+            warnings
+                .0
+                .lock()
+                .unwrap()
+                .push_str(&String::from_utf8_lossy(stderr));
+        }
+    }
+
+    // The warnings collected so far, left in place, or None if the context
+    // does not collect them.
+    pub fn collected_warnings(&self) -> Option<String> {
+        self.compiler_warnings
+            .as_ref()
+            .map(|warnings| warnings.0.lock().unwrap().clone())
+    }
+
+    // Receives what compilers run through `run_compiler` write, as they
+    // write it, apart from the program's own output.
+    pub fn with_compile_log(mut self, log: UnboundedSender<OutputChunk>) -> Self {
+        self.compile_log = Some(log);
+        self
+    }
+
+    // Leaves each program only the stdin it is given, without any file or
+    // stream.
+    pub fn without_streamed_stdin(mut self) -> Self {
+        self.stdin_file = None;
+        self.stdin_stream = None;
+        self
+    }
+
+    pub fn which(&self, binary: &str) -> Result<PathBuf, which::Error> {
+        match &self.toolchain_dir {
+            Some(dir) => which::which_in(binary, Some(dir), dir),
+            None => which::which(binary),
+        }
+    }
+
+    // A command for a toolchain binary. Compilers see the submitted code
+    // too, so they run as the run's sandbox user just like the program
+    // itself.
+    pub fn command(&self, binary: &str) -> Result<Command, InfraError> {
+        let mut cmd = Command::new(self.which(binary)?);
+        scrub_env(&mut cmd, self);
+        pin(&mut cmd, &self.cpus);
+        if let Some(user) = sandbox_user()? {
+            user.apply(&mut cmd);
+        }
+        Ok(cmd)
+    }
+
+    pub fn with_env(mut self, key: &str, value: &str) -> Self {
+        self.envs.push((key.to_string(), value.to_string()));
+        self
+    }
+
+    pub fn with_envs<I: IntoIterator<Item = (String, String)>>(mut self, envs: I) -> Self {
+        self.envs.extend(envs);
+        self
+    }
+
+    pub fn envs(&self) -> &[(String, String)] {
+        &self.envs
+    }
+
+    // Runs programs with LANG and LC_ALL set to `locale`, over any other
+    // value they would get.
+    pub fn with_locale(mut self, locale: Option<String>) -> Self {
+        self.locale = locale;
+        self
+    }
+
+    // Runs programs with TZ set to `timezone`, over any other value they
+    // would get.
+    pub fn with_timezone(mut self, timezone: Option<String>) -> Self {
+        self.timezone = timezone;
+        self
+    }
+
+    // The variables that put programs in the requested locale and timezone.
+    pub fn locale_env(&self) -> Vec<(&str, &str)> {
+        let mut env = Vec::new();
+        if let Some(locale) = &self.locale {
+            env.extend([("LANG", locale.as_str()), ("LC_ALL", locale.as_str())]);
+        }
+        if let Some(timezone) = &self.timezone {
+            env.push(("TZ", timezone.as_str()));
+        }
+        env
+    }
+
+    // Whether a program started under `other` is sandboxed and limited the
+    // same way as one started under this context.
+    pub fn same_confinement(&self, other: &ExecContext) -> bool {
+        self.seccomp == other.seccomp
+            && self.disk_quota == other.disk_quota
+            && self.memory_limit == other.memory_limit
+            && self.toolchain_dir == other.toolchain_dir
+    }
+}
+
+pub async fn run_program(
+    cmd: &mut Command,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<Output, InfraError> {
+    let profile = prepare(cmd, ctx)?;
+    let child = spawn_piped(cmd)?;
+    supervise(child, stdin_input, ctx, profile).await
+}
+
+// Replaces the server's environment in `cmd` with one built from scratch:
+// INHERITED_ENV, PATH led by the toolchain directory, and a UTF-8 locale
+// when the server sets none. Compilers keep the server's HOME, where
+// toolchains such as rustup install themselves; `prepare` moves a program's
+// to its working directory.
+fn scrub_env(cmd: &mut Command, ctx: &ExecContext) {
+    cmd.env_clear();
+    for key in INHERITED_ENV {
+        if let Some(value) = env::var_os(key) {
+            cmd.env(key, value);
+        }
+    }
+    if let Some(dir) = &ctx.toolchain_dir {
+        let inherited = env::var_os("PATH").unwrap_or_default();
+        let paths = std::iter::once(dir.clone()).chain(env::split_paths(&inherited));
+        if let Ok(path) = env::join_paths(paths) {
+            cmd.env("PATH", path);
+        }
+    }
+    if env::var_os("LANG").is_none() && env::var_os("LC_ALL").is_none() {
+        cmd.env("LANG", "C.UTF-8");
+    }
+}
+
+// Restricts `cmd`, and everything it starts, to `cpus`.
+fn pin(cmd: &mut Command, cpus: &[usize]) {
+    if cpus.is_empty() {
+        return;
+    }
+    let cpus = cpus.to_vec();
+    unsafe {
+        cmd.pre_exec(move || {
+            let mut set: libc::cpu_set_t = std::mem::zeroed();
+            for &cpu in &cpus {
+                libc::CPU_SET(cpu, &mut set);
+            }
+            if libc::sched_setaffinity(0, std::mem::size_of::<libc::cpu_set_t>(), &set) != 0 {
+                return Err(io::Error::last_os_error());
+            }
+            Ok(())
+        });
+    }
+}
+
+// Applies everything in `ctx` that has to be in place before the program
+// starts: sandboxing, environment, arguments and limits. Returns the seccomp
+// profile the program will run under, if any.
+pub fn prepare(cmd: &mut Command, ctx: &ExecContext) -> Result<Option<SyscallProfile>, InfraError> {
+    let profile = match &ctx.seccomp {
+        Some((launcher, profile)) if *profile != SyscallProfile::Unrestricted => {
+            *cmd = launch_with(launcher, *profile, cmd);
+            Some(*profile)
+        }
+        _ => None,
+    };
+    if let Some(workspace) = &ctx.workspace {
+        cmd.current_dir(workspace);
+    }
+    let user = sandbox_user()?;
+    if let Some(user) = user {
+        if let Some(workspace) = &ctx.workspace {
+            user.grant(workspace)?;
+        }
+        user.apply(cmd);
+    }
+    scrub_env(cmd, ctx);
+    // Toolchain caches stay where the server keeps them rather than moving
+    // into the working directory with HOME.
+    if env::var_os("XDG_CACHE_HOME").is_none() {
+        if let Some(home) = env::var_os("HOME") {
+            cmd.env("XDG_CACHE_HOME", Path::new(&home).join(".cache"));
+        }
+    }
+    let home = ctx.workspace.clone().unwrap_or_else(env::temp_dir);
+    cmd.env("HOME", home);
+    cmd.envs(ctx.envs.iter().map(|(key, value)| (key, value)));
+    cmd.envs(ctx.locale_env());
+    cmd.args(&ctx.args);
+    if let Some(quota) = ctx.disk_quota {
+        unsafe {
+            cmd.pre_exec(move || {
+                setrlimit(Resource::RLIMIT_FSIZE, quota, quota).map_err(io::Error::from)
+            });
+        }
+    }
+    if let Some(limit) = ctx.memory_limit {
+        unsafe {
+            cmd.pre_exec(move || {
+                setrlimit(Resource::RLIMIT_DATA, limit, limit).map_err(io::Error::from)
+            });
+        }
+    }
+    pin(cmd, &ctx.cpus);
+    if let Some(view) = filesystem_view() {
+        view.apply(cmd, user, ctx.workspace.as_deref())?;
+    }
+    Ok(profile)
+}
+
+// The process limit counts everything the run's sandbox user runs, threads
+// included, so it covers the compiler and tools as well as the program.
+pub const MAX_SANDBOX_PROCESSES: u64 = 256;
+
+// Caps the processes and threads a program may start, for languages that
+// make it easy to start many. Only applies when programs run as sandbox
+// users, since the limit is per user and each run has a user of its own.
+// Call it after `prepare`, which may replace the command.
+pub fn limit_processes(cmd: &mut Command) {
+    if !sandboxed() {
+        return;
+    }
+    unsafe {
+        cmd.pre_exec(|| {
+            setrlimit(
+                Resource::RLIMIT_NPROC,
+                MAX_SANDBOX_PROCESSES,
+                MAX_SANDBOX_PROCESSES,
+            )
+            .map_err(io::Error::from)
+        });
+    }
+}
+
+// Tighter limits for languages that put the whole machine within easy
+// reach: few open files, CPU time bounded by the timeout even if the wall
+// clock is not watched, and a process cap under the sandbox user. Call it
+// after `prepare`, like `limit_processes`.
+pub fn limit_strictly(cmd: &mut Command, ctx: &ExecContext, max_open_files: u64) {
+    let cpu_seconds = ctx.timeout.map(|timeout| timeout.as_secs() + 1);
+    unsafe {
+        cmd.pre_exec(move || {
+            setrlimit(Resource::RLIMIT_NOFILE, max_open_files, max_open_files)?;
+            if let Some(seconds) = cpu_seconds {
+                setrlimit(Resource::RLIMIT_CPU, seconds, seconds)?;
+            }
+            Ok(())
+        });
+    }
+    limit_processes(cmd);
+}
+
+// Runs a compiler to completion, failing with `Timeout` if it takes longer
+// than the context's compile timeout. Like programs, it runs in a process
+// group of its own, so helpers it forks end with it.
+pub async fn run_compiler(cmd: &mut Command, ctx: &ExecContext) -> Result<Output, InfraError> {
+    let mut child = cmd
+        .kill_on_drop(true)
+        .process_group(0)
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()?;
+    let _group = ProcessGroup::of(&child);
+    // Boxed for the same reason as in `supervise`: the capture buffers would
+    // otherwise be part of every compile future.
+    let output = Box::pin(async move {
+        let Some(log) = &ctx.compile_log else {
+            return child.wait_with_output().await;
+        };
+        let log = ExecContext {
+            output: Some(log.clone()),
+            ..ExecContext::default()
+        };
+        let (stdout, stderr) = (child.stdout.take(), child.stderr.take());
+        let (stdout, stderr, status) = tokio::try_join!(
+            capture(stdout, &log, Stream::Stdout, None),
+            capture(stderr, &log, Stream::Stderr, None),
+            child.wait(),
+        )?;
+        Ok(Output {
+            status,
+            stdout,
+            stderr,
+        })
+    });
+    match ctx.compile_timeout {
+        Some(limit) => tokio::time::timeout(limit, output)
+            .await
+            .map_err(|_| InfraError::timeout(limit))?
+            .map_err(InfraError::from),
+        None => Ok(output.await?),
+    }
+}
+
+// Each program leads a process group of its own, which `ProcessGroup` kills.
+pub fn spawn_piped(cmd: &mut Command) -> io::Result<Child> {
+    cmd.kill_on_drop(true)
+        .process_group(0)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+}
+
+// Everything a program started with `spawn_piped` runs, itself included.
+// Killing the program alone leaves what it forked running, such as the
+// binary `go run` builds, so dropping this kills the whole group, however
+// the run ended.
+pub struct ProcessGroup(Option<u32>);
+
+impl ProcessGroup {
+    pub fn of(child: &Child) -> Self {
+        ProcessGroup(child.id())
+    }
+}
+
+impl Drop for ProcessGroup {
+    fn drop(&mut self) {
+        if let Some(pgid) = self.0 {
+            unsafe {
+                libc::killpg(pgid as libc::pid_t, libc::SIGKILL);
+            }
+        }
+    }
+}
+
+// Feeds stdin to a started program and collects its output, enforcing the
+// limits in `ctx` while it runs.
+pub async fn supervise(
+    mut child: Child,
+    stdin_input: &str,
+    ctx: &ExecContext,
+    profile: Option<SyscallProfile>,
+) -> Result<Output, InfraError> {
+    let started = Instant::now();
+    let pid = child.id();
+    let _group = ProcessGroup::of(&child);
+    let attached = attach(pid);
+    let meters: Vec<&UsageMeter> = ctx.meter.iter().chain(attached.meter()).collect();
+    let _timed: Vec<_> = meters.iter().copied().map(Timed::start).collect();
+    let stdin = child.stdin.take();
+    let stdout = child.stdout.take();
+    let stderr = child.stderr.take();
+    let written = &AtomicU64::new(0);
+
+    // An interactor, when there is one, takes over both ends of the
+    // conversation in place of `stdin_input`.
+    let exchange = async move {
+        if let Some(interaction) = &ctx.interaction {
+            return interaction.converse(stdin, stdout, ctx).await;
+        }
+        let write_stdin = async move {
+            if let Some(mut stdin) = stdin {
+                let written = async {
+                    stdin.write_all(stdin_input.as_bytes()).await?;
+                    if let Some(path) = &ctx.stdin_file {
+                        let mut file = tokio::fs::File::open(path).await?;
+                        tokio::io::copy(&mut file, &mut stdin).await?;
+                    }
+                    let stream = ctx.stdin_stream.as_ref().and_then(StdinStream::take);
+                    if let Some(mut chunks) = stream {
+                        while let Some(chunk) = chunks.recv().await {
+                            stdin.write_all(&chunk).await?;
+                        }
+                    }
+                    stdin.flush().await
+                };
+                match written.await {
+                    Err(err) if err.kind() != io::ErrorKind::BrokenPipe => return Err(err),
+                    _ => {}
+                }
+            }
+            Ok::<(), io::Error>(())
+        };
+        let capture_stdout = capture(stdout, ctx, Stream::Stdout, Some(written));
+        tokio::pin!(write_stdin, capture_stdout);
+        // A program that has closed its output is done reading, so stdin
+        // still being streamed to it is not waited for.
+        tokio::select! {
+            written = &mut write_stdin => {
+                written?;
+                capture_stdout.await
+            }
+            stdout = &mut capture_stdout => stdout,
+        }
+    };
+
+    // Boxed to keep this future small; it is nested inside every language's
+    // compile future and debug builds otherwise overflow the stack. The
+    // first failure, such as output passing its cap, ends the run.
+    let finished = Box::pin(async {
+        let (stdout, stderr) =
+            tokio::try_join!(exchange, capture(stderr, ctx, Stream::Stderr, Some(written)))?;
+        Ok::<_, io::Error>((child.wait().await?, stdout, stderr))
+    });
+
+    // Leaving early drops the child, which kills it.
+    let (status, stdout, stderr) = tokio::select! {
+        finished = finished => match finished {
+            Err(err) if err.kind() == io::ErrorKind::FileTooLarge => {
+                return Err(InfraError::OutputLimitExceeded(ctx.max_output.unwrap_or_default()));
+            }
+            finished => finished?,
+        },
+        quota = quota_exceeded(ctx) => return Err(InfraError::DiskQuotaExceeded(quota)),
+        limit = program_timed_out(ctx) => {
+            return Err(InfraError::Timeout(limit, Box::new(ctx.partial_run(started.elapsed()))));
+        }
+        limit = cpu_time_exceeded(pid, ctx) => {
+            return Err(InfraError::Timeout(limit, Box::new(ctx.partial_run(started.elapsed()))));
+        }
+        () = sample_memory(pid, &meters) => unreachable!("memory sampling never finishes"),
+        () = stream_usage(pid, ctx, started, written) => unreachable!("usage samples never end"),
+    };
+    if let Some(partial) = &ctx.partial_output {
+        partial.exited(status);
+    }
+
+    if let Some(quota) = ctx.disk_quota {
+        let over_quota = match &ctx.workspace {
+            Some(workspace) => !status.success() && disk_usage(workspace)? >= quota,
+            None => false,
+        };
+        if status.signal() == Some(libc::SIGXFSZ) || over_quota {
+            return Err(InfraError::DiskQuotaExceeded(quota));
+        }
+    }
+    if let Some(profile) = profile {
+        if status.signal() == Some(libc::SIGSYS) {
+            return Err(InfraError::BlockedSyscall(format!(
+                "program made a system call not permitted by the {} profile",
+                profile
+            )));
+        }
+    }
+    Ok(ctx.output_encoding.encode(Output {
+        status,
+        stdout,
+        stderr,
+    }))
+}
+
+// Resolves with the quota once the workspace grows past it. Many small files
+// get around the per-file limit, so this is what bounds the total.
+async fn quota_exceeded(ctx: &ExecContext) -> u64 {
+    let (Some(workspace), Some(quota)) = (&ctx.workspace, ctx.disk_quota) else {
+        return std::future::pending().await;
+    };
+    loop {
+        tokio::time::sleep(QUOTA_POLL_INTERVAL).await;
+        let workspace = workspace.clone();
+        let usage = tokio::task::spawn_blocking(move || disk_usage(&workspace)).await;
+        if let Ok(Ok(usage)) = usage {
+            if usage > quota {
+                return quota;
+            }
+        }
+    }
+}
+
+// Resolves with the scaled limit once the program has run for longer than
+// the context's program timeout.
+async fn program_timed_out(ctx: &ExecContext) -> Duration {
+    let Some(limit) = ctx.program_timeout else {
+        return std::future::pending().await;
+    };
+    let limit = calibration().await.scale(limit);
+    tokio::time::sleep(limit).await;
+    limit
+}
+
+// Resolves with the scaled limit once the program has spent more CPU time
+// than the context allows, checked as often as memory is sampled.
+async fn cpu_time_exceeded(pid: Option<u32>, ctx: &ExecContext) -> Duration {
+    let (Some(pid), Some(limit)) = (pid, ctx.cpu_time_limit) else {
+        return std::future::pending().await;
+    };
+    let limit = calibration().await.scale(limit);
+    let mut samples = tokio::time::interval(MEMORY_SAMPLE_INTERVAL);
+    loop {
+        samples.tick().await;
+        let spent = ProcessUsage::read(pid).map(|usage| Duration::from_millis(usage.cpu_ms));
+        if spent.is_some_and(|spent| spent >= limit) {
+            return limit;
+        }
+    }
+}
+
+// Feeds the meters until the program is done with, which ends this with it.
+async fn sample_memory(pid: Option<u32>, meters: &[&UsageMeter]) {
+    let Some(pid) = pid.filter(|_| !meters.is_empty()) else {
+        return std::future::pending().await;
+    };
+    let mut samples = tokio::time::interval(MEMORY_SAMPLE_INTERVAL);
+    loop {
+        samples.tick().await;
+        for meter in meters {
+            meter.sample_memory(pid, MEMORY_SAMPLE_INTERVAL);
+        }
+    }
+}
+
+// Sends what the program is using to the context's usage stream until it is
+// done with, which ends this with it.
+async fn stream_usage(
+    pid: Option<u32>,
+    ctx: &ExecContext,
+    started: Instant,
+    written: &AtomicU64,
+) {
+    let (Some(pid), Some(usage)) = (pid, &ctx.usage_stream) else {
+        return std::future::pending().await;
+    };
+    let mut samples = tokio::time::interval_at(
+        (started + USAGE_SAMPLE_INTERVAL).into(),
+        USAGE_SAMPLE_INTERVAL,
+    );
+    let (mut last_at, mut last_cpu_ms) = (started, 0);
+    loop {
+        samples.tick().await;
+        let Some(now) = ProcessUsage::read(pid) else {
+            continue;
+        };
+        let at = Instant::now();
+        let wall_ms = at.duration_since(last_at).as_millis().max(1) as f64;
+        let cpu_ms = now.cpu_ms.saturating_sub(last_cpu_ms) as f64;
+        (last_at, last_cpu_ms) = (at, now.cpu_ms);
+        let _ = usage.send(UsageSample {
+            elapsed_ms: started.elapsed().as_millis() as u64,
+            cpu_percent: (cpu_ms * 1000.0 / wall_ms).round() / 10.0,
+            memory_bytes: now.memory_bytes,
+            output_bytes: written.load(Ordering::Relaxed),
+        });
+    }
+}
+
+// Adds the time from `start` to when it is dropped to the meter, so a run
+// cut short by a timeout is counted too.
+struct Timed<'a> {
+    meter: &'a UsageMeter,
+    started: Instant,
+}
+
+impl<'a> Timed<'a> {
+    fn start(meter: &'a UsageMeter) -> Self {
+        Timed {
+            meter,
+            started: Instant::now(),
+        }
+    }
+}
+
+impl Drop for Timed<'_> {
+    fn drop(&mut self) {
+        self.meter.record_time(self.started.elapsed());
+    }
+}
+
+// Rewrites `cmd` to run through the seccomp launcher, keeping its
+// arguments, working directory and environment.
+fn launch_with(launcher: &PathBuf, profile: SyscallProfile, cmd: &Command) -> Command {
+    let original = cmd.as_std();
+    let mut wrapped = Command::new(launcher);
+    wrapped
+        .arg(profile.as_str())
+        .arg("--")
+        .arg(original.get_program())
+        .args(original.get_args());
+    if let Some(dir) = original.get_current_dir() {
+        wrapped.current_dir(dir);
+    }
+    for (key, value) in original.get_envs() {
+        match value {
+            Some(value) => wrapped.env(key, value),
+            None => wrapped.env_remove(key),
+        };
+    }
+    wrapped
+}
+
+#[derive(Debug, Clone, Copy)]
+enum Stream {
+    Stdout,
+    Stderr,
+}
+
+impl Stream {
+    fn chunk(self, text: String) -> OutputChunk {
+        match self {
+            Stream::Stdout => OutputChunk::Stdout(text),
+            Stream::Stderr => OutputChunk::Stderr(text),
+        }
+    }
+}
+
+// Collects one of the program's output streams, forwarding it to the
+// context's sink as it arrives and counting it in `written`. Fails with
+// `FileTooLarge` once the stream passes the context's output cap.
+async fn capture<R: AsyncRead + Unpin>(
+    reader: Option<R>,
+    ctx: &ExecContext,
+    stream: Stream,
+    written: Option<&AtomicU64>,
+) -> io::Result<Vec<u8>> {
+    let Some(mut reader) = reader else {
+        return Ok(Vec::new());
+    };
+    let sink = ctx.output.as_ref();
+
+    let mut captured = Vec::new();
+    let mut pending = Vec::new();
+    let mut buf = [0u8; 8192];
+
+    loop {
+        let n = reader.read(&mut buf).await?;
+        if n == 0 {
+            break;
+        }
+        captured.extend_from_slice(&buf[..n]);
+        if let Some(written) = written {
+            written.fetch_add(n as u64, Ordering::Relaxed);
+        }
+        if let Some(partial) = &ctx.partial_output {
+            partial.record(stream, &buf[..n]);
+        }
+        if ctx.max_output.is_some_and(|limit| captured.len() > limit) {
+            return Err(io::ErrorKind::FileTooLarge.into());
+        }
+
+        if let Some(sink) = sink {
+            pending.extend_from_slice(&buf[..n]);
+            let text = take_utf8(&mut pending);
+            if !text.is_empty() {
+                let _ = sink.send(stream.chunk(text));
+            }
+        }
+    }
+
+    if let Some(sink) = sink {
+        if !pending.is_empty() {
+            let _ = sink.send(stream.chunk(String::from_utf8_lossy(&pending).into_owned()));
+        }
+    }
+
+    Ok(captured)
+}
+
+// Decodes as much of `pending` as possible, leaving an incomplete trailing
+// UTF-8 sequence in place so it can be completed by the next read.
+fn take_utf8(pending: &mut Vec<u8>) -> String {
+    let keep = match std::str::from_utf8(pending) {
+        Ok(_) => 0,
+        Err(err) if err.error_len().is_none() => pending.len() - err.valid_up_to(),
+        Err(_) => 0,
+    };
+    let rest = pending.split_off(pending.len() - keep);
+    let text = String::from_utf8_lossy(pending).into_owned();
+    *pending = rest;
+    text
+}
+
+#[cfg(test)]
+mod runner_tests {
+    use super::*;
+    use tokio::sync::mpsc;
+
+    #[tokio::test]
+    async fn test_run_program_captures_stdout_and_stderr() {
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("echo out; echo err >&2");
+        let output = run_program(&mut cmd, "", &ExecContext::default())
+            .await
+            .unwrap();
+        assert!(output.status.success());
+        assert_eq!(output.stdout, b"out\n");
+        assert_eq!(output.stderr, b"err\n");
+    }
+
+    #[tokio::test]
+    async fn test_timed_out_program_takes_what_it_started_with_it() {
+        let dir = tempfile::tempdir().unwrap();
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("sleep 30 & echo $! > pid; wait");
+        let ctx = ExecContext::default()
+            .with_workspace(dir.path().to_path_buf())
+            .with_program_timeout(Duration::from_millis(300));
+        let result = run_program(&mut cmd, "", &ctx).await;
+        assert!(matches!(result, Err(InfraError::Timeout(..))));
+
+        let pid = std::fs::read_to_string(dir.path().join("pid")).unwrap();
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        // Killed, though perhaps not yet reaped by whoever inherited it.
+        if let Ok(stat) = std::fs::read_to_string(format!("/proc/{}/stat", pid.trim())) {
+            assert!(stat.contains(") Z "), "{}", stat);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_run_program_feeds_stdin() {
+        let mut cmd = Command::new("cat");
+        let output = run_program(&mut cmd, "hello", &ExecContext::default())
+            .await
+            .unwrap();
+        assert_eq!(output.stdout, b"hello");
+    }
+
+    #[tokio::test]
+    async fn test_base64_encoding_keeps_bytes_that_are_not_utf8() {
+        let mut cmd = Command::new("printf");
+        cmd.arg(r"\377\000\n");
+        let ctx = ExecContext::default().with_output_encoding(OutputEncoding::Base64);
+        let output = run_program(&mut cmd, "", &ctx).await.unwrap();
+        assert_eq!(output.stdout, b"/wAK");
+    }
+
+    #[tokio::test]
+    async fn test_run_program_ignores_unread_stdin() {
+        let mut cmd = Command::new("true");
+        let input = "x".repeat(1 << 20);
+        let output = run_program(&mut cmd, &input, &ExecContext::default())
+            .await
+            .unwrap();
+        assert!(output.status.success());
+    }
+
+    #[tokio::test]
+    async fn test_run_program_streams_stdin_file_after_input() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("stdin");
+        std::fs::write(&path, "line\n".repeat(100_000)).unwrap();
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("read first; echo \"$first\"; wc -l");
+        let ctx = ExecContext::default().with_stdin_file(path);
+        let output = run_program(&mut cmd, "spec\n", &ctx).await.unwrap();
+        let stdout = String::from_utf8(output.stdout).unwrap();
+        assert_eq!(
+            stdout.split_whitespace().collect::<Vec<_>>(),
+            ["spec", "100000"]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_run_program_reads_stdin_as_it_is_streamed() {
+        let (tx, stream) = StdinStream::channel(1);
+        let sender = tokio::spawn(async move {
+            for _ in 0..1000 {
+                tx.send(vec![b'x'; 1024]).await.unwrap();
+            }
+        });
+        let mut cmd = Command::new("wc");
+        cmd.arg("-c");
+        let ctx = ExecContext::default().with_stdin_stream(stream);
+        let output = run_program(&mut cmd, "", &ctx).await.unwrap();
+        sender.await.unwrap();
+        assert_eq!(String::from_utf8(output.stdout).unwrap().trim(), "1024000");
+
+        // A program that stops reading drops the stream, so its sender
+        // gives up instead of waiting forever.
+        let (tx, stream) = StdinStream::channel(1);
+        let ctx = ExecContext::default().with_stdin_stream(stream);
+        run_program(&mut Command::new("true"), "", &ctx)
+            .await
+            .unwrap();
+        assert!(tx.send(vec![b'x']).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_run_program_streams_chunks() {
+        let (tx, mut rx) = mpsc::unbounded_channel();
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("printf hi; printf oops >&2");
+        run_program(&mut cmd, "", &ExecContext::default().with_output(tx))
+            .await
+            .unwrap();
+
+        let mut chunks = Vec::new();
+        while let Ok(chunk) = rx.try_recv() {
+            chunks.push(chunk);
+        }
+        assert!(chunks.contains(&OutputChunk::Stdout("hi".into())));
+        assert!(chunks.contains(&OutputChunk::Stderr("oops".into())));
+    }
+
+    #[tokio::test]
+    async fn test_run_program_is_pinned_to_its_cpus() {
+        let mut cmd = Command::new("grep");
+        cmd.args(["Cpus_allowed_list", "/proc/self/status"]);
+        let ctx = ExecContext::default().with_cpus(vec![0]);
+        let output = run_program(&mut cmd, "", &ctx).await.unwrap();
+        let status = String::from_utf8(output.stdout).unwrap();
+        assert_eq!(status.split_whitespace().last(), Some("0"));
+    }
+
+    #[tokio::test]
+    async fn test_run_program_uses_workspace_as_cwd() {
+        let workspace = tempfile::TempDir::new().unwrap();
+        let mut cmd = Command::new("pwd");
+        let ctx = ExecContext::default().with_workspace(workspace.path().to_path_buf());
+        let output = run_program(&mut cmd, "", &ctx).await.unwrap();
+        assert_eq!(
+            String::from_utf8(output.stdout).unwrap().trim(),
+            workspace.path().to_str().unwrap()
+        );
+    }
+
+    #[tokio::test]
+    async fn test_run_compiler_logs_apart_from_program_output() {
+        let (output, mut program) = mpsc::unbounded_channel();
+        let (log, mut compile_log) = mpsc::unbounded_channel();
+        let ctx = ExecContext::default()
+            .with_output(output)
+            .with_compile_log(log);
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("printf built; printf 'warning: x' >&2");
+        let output = run_compiler(&mut cmd, &ctx).await.unwrap();
+        assert_eq!(output.stdout, b"built");
+        assert_eq!(output.stderr, b"warning: x");
+
+        let mut chunks = Vec::new();
+        while let Ok(chunk) = compile_log.try_recv() {
+            chunks.push(chunk);
+        }
+        assert!(chunks.contains(&OutputChunk::Stdout("built".into())));
+        assert!(chunks.contains(&OutputChunk::Stderr("warning: x".into())));
+        assert!(program.try_recv().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_command_withholds_server_environment_from_compilers() {
+        let ctx = ExecContext::default().with_env("GREETING", "hi");
+        let mut cmd = ctx.command("env").unwrap();
+        let output = run_compiler(&mut cmd, &ctx).await.unwrap();
+        let env = String::from_utf8(output.stdout).unwrap();
+
+        assert!(!env.is_empty());
+        for line in env.lines() {
+            let key = line.split('=').next().unwrap();
+            assert!(INHERITED_ENV.contains(&key), "{}", line);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_requested_locale_and_timezone_win_over_env() {
+        let ctx = ExecContext::default()
+            .with_envs([("TZ".into(), "UTC".into())])
+            .with_locale(Some("C.UTF-8".into()))
+            .with_timezone(Some("Asia/Tokyo".into()));
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("echo $LANG $LC_ALL $TZ");
+        let output = run_program(&mut cmd, "", &ctx).await.unwrap();
+        assert_eq!(output.stdout, b"C.UTF-8 C.UTF-8 Asia/Tokyo\n");
+    }
+
+    #[tokio::test]
+    async fn test_run_compiler_stops_at_compile_timeout() {
+        let ctx = ExecContext::default().with_compile_timeout(Duration::from_millis(200));
+        let mut cmd = Command::new("sleep");
+        cmd.arg("30");
+        let result = run_compiler(&mut cmd, &ctx).await;
+        assert!(matches!(result, Err(InfraError::Timeout(..))));
+
+        let mut cmd = Command::new("true");
+        assert!(run_compiler(&mut cmd, &ctx).await.unwrap().status.success());
+    }
+
+    #[tokio::test]
+    async fn test_run_program_passes_args_to_program() {
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("printf '%s|' \"$@\"").arg("sh");
+        let ctx = ExecContext::default().with_args(vec!["a b".into(), "--flag".into()]);
+        let output = run_program(&mut cmd, "", &ctx).await.unwrap();
+        assert_eq!(output.stdout, b"a b|--flag|");
+    }
+
+    #[tokio::test]
+    async fn test_run_program_withholds_server_environment() {
+        let workspace = tempfile::TempDir::new().unwrap();
+        let mut cmd = Command::new("env");
+        let ctx = ExecContext::default()
+            .with_workspace(workspace.path().to_path_buf())
+            .with_env("GREETING", "hi");
+        let output = run_program(&mut cmd, "", &ctx).await.unwrap();
+        let env = String::from_utf8(output.stdout).unwrap();
+
+        assert!(env.lines().any(|line| line == "GREETING=hi"));
+        let home = format!("HOME={}", workspace.path().display());
+        assert!(env.lines().any(|line| line == home), "{}", env);
+        assert!(env.lines().any(|line| line.starts_with("LANG=")));
+        for line in env.lines() {
+            let key = line.split('=').next().unwrap();
+            assert!(
+                key == "GREETING" || INHERITED_ENV.contains(&key),
+                "{}",
+                line
+            );
+        }
+    }
+
+    #[tokio::test]
+    async fn test_run_program_limits_file_size_to_disk_quota() {
+        let workspace = tempfile::TempDir::new().unwrap();
+        let ctx = ExecContext::default()
+            .with_workspace(workspace.path().to_path_buf())
+            .with_disk_quota(1000);
+
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("head -c 500 /dev/zero > small");
+        assert!(run_program(&mut cmd, "", &ctx).await.unwrap().status.success());
+
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("head -c 5000 /dev/zero > big");
+        let err = run_program(&mut cmd, "", &ctx).await.unwrap_err();
+        assert!(matches!(err, InfraError::DiskQuotaExceeded(1000)), "{}", err);
+    }
+
+    #[tokio::test]
+    async fn test_run_program_stops_workspace_growing_past_disk_quota() {
+        let workspace = tempfile::TempDir::new().unwrap();
+        let ctx = ExecContext::default()
+            .with_workspace(workspace.path().to_path_buf())
+            .with_disk_quota(1000);
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c")
+            .arg("for i in 1 2 3 4 5 6 7 8; do head -c 400 /dev/zero > $i; done; sleep 30");
+
+        let started = std::time::Instant::now();
+        let err = run_program(&mut cmd, "", &ctx).await.unwrap_err();
+        assert!(matches!(err, InfraError::DiskQuotaExceeded(1000)), "{}", err);
+        assert!(started.elapsed() < Duration::from_secs(10));
+    }
+
+    #[tokio::test]
+    async fn test_run_program_stops_output_past_its_limit() {
+        let ctx = ExecContext::default().with_max_output(1000);
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("head -c 500 /dev/zero");
+        assert_eq!(run_program(&mut cmd, "", &ctx).await.unwrap().stdout.len(), 500);
+
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("yes; sleep 30");
+        let started = std::time::Instant::now();
+        let err = run_program(&mut cmd, "", &ctx).await.unwrap_err();
+        assert!(matches!(err, InfraError::OutputLimitExceeded(1000)), "{}", err);
+        assert!(started.elapsed() < Duration::from_secs(10));
+    }
+
+    #[tokio::test]
+    async fn test_run_program_limits_memory() {
+        let ctx = ExecContext::default().with_memory_limit(64 << 20);
+        let mut cmd = Command::new("python3");
+        cmd.arg("-c").arg("b = bytearray(16 << 20)");
+        assert!(run_program(&mut cmd, "", &ctx).await.unwrap().status.success());
+
+        let mut cmd = Command::new("python3");
+        cmd.arg("-c").arg("b = bytearray(256 << 20)");
+        let output = run_program(&mut cmd, "", &ctx).await.unwrap();
+        assert!(!output.status.success());
+        assert!(String::from_utf8_lossy(&output.stderr).contains("MemoryError"));
+    }
+
+    #[tokio::test]
+    async fn test_run_program_meters_time_and_memory() {
+        let meter = UsageMeter::default();
+        let ctx = ExecContext::default().with_meter(meter.clone());
+        let mut cmd = Command::new("python3");
+        cmd.arg("-c")
+            .arg("import time\nb = bytearray(64 << 20)\ntime.sleep(0.2)");
+        assert!(run_program(&mut cmd, "", &ctx).await.unwrap().status.success());
+        assert!(meter.time_ms().unwrap() >= 200);
+        assert!(meter.memory_bytes().unwrap() >= 64 << 20);
+    }
+
+    #[tokio::test]
+    async fn test_run_program_stops_at_program_timeout() {
+        let ctx = ExecContext::default().with_program_timeout(Duration::from_millis(200));
+        let mut cmd = Command::new("sleep");
+        cmd.arg("30");
+        let started = std::time::Instant::now();
+        let err = run_program(&mut cmd, "", &ctx).await.unwrap_err();
+        assert!(matches!(err, InfraError::Timeout(..)), "{}", err);
+        assert!(started.elapsed() < Duration::from_secs(10));
+    }
+
+    #[tokio::test]
+    async fn test_cpu_time_limit_ignores_time_spent_waiting() {
+        let ctx = ExecContext::default().with_cpu_time_limit(Duration::from_millis(200));
+        let mut cmd = Command::new("sleep");
+        cmd.arg("0.5");
+        assert!(run_program(&mut cmd, "", &ctx).await.unwrap().status.success());
+
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("while :; do :; done");
+        let started = std::time::Instant::now();
+        let err = run_program(&mut cmd, "", &ctx).await.unwrap_err();
+        assert!(matches!(err, InfraError::Timeout(..)), "{}", err);
+        assert!(started.elapsed() < Duration::from_secs(10));
+    }
+
+    #[tokio::test]
+    async fn test_usage_is_sampled_while_the_program_runs() {
+        let (tx, mut rx) = mpsc::unbounded_channel();
+        let ctx = ExecContext::default().with_usage_stream(tx);
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("echo hello; sleep 1.2");
+        assert!(run_program(&mut cmd, "", &ctx).await.unwrap().status.success());
+
+        let mut samples = Vec::new();
+        while let Ok(sample) = rx.try_recv() {
+            samples.push(sample);
+        }
+        assert!(samples.len() >= 2, "{:?}", samples);
+        assert!(samples.windows(2).all(|pair| pair[0].elapsed_ms < pair[1].elapsed_ms));
+        let last = samples.last().unwrap();
+        assert_eq!(last.output_bytes, 6);
+        assert!(last.memory_bytes > 0);
+        assert!(last.cpu_percent < 50.0, "{:?}", last);
+    }
+
+    #[test]
+    fn test_take_utf8_keeps_incomplete_sequence() {
+        let mut pending = "é".as_bytes()[..1].to_vec();
+        assert_eq!(take_utf8(&mut pending), "");
+        pending.push("é".as_bytes()[1]);
+        assert_eq!(take_utf8(&mut pending), "é");
+        assert!(pending.is_empty());
+    }
+}
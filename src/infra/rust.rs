@@ -1,50 +1,64 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
+use super::{
+    error::InfraError,
+    language::Language,
+    profile,
+    runner::{ExecContext, run_compiler},
+    shared_build::build_once,
+    source::SourceFile,
+    wasm::{Backend, run_module},
+};
 
-pub async fn compile_rust(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".rs")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
+pub async fn compile_rust(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::RUST, content)?;
+    let source_path = source.path().to_path_buf();
+    let wasm = ctx.backend() == Backend::Wasm;
+    let executable_path = source.dir().join(if wasm { "main.wasm" } else { "main" });
+    let target: &[&str] = if wasm {
+        &["--target", "wasm32-wasip1"]
+    } else {
+        &[]
+    };
 
-    let source_path = temp_file.path().to_path_buf();
-    let executable_file = NamedTempFile::new()?;
-    let executable_path = executable_file.path().to_path_buf();
-    drop(executable_file);
+    build_once(ctx, source.path(), &executable_path, async {
+        let mut build = ctx.command("rustc")?;
+        build
+            .arg(source_path)
+            .arg("--crate-name")
+            .arg("temp")
+            .arg("-o")
+            .arg(&executable_path)
+            .args(target)
+            .args(ctx.compiler_flags());
+        let compile_output = run_compiler(&mut build, ctx).await?;
 
-    let compile_output = Command::new(which("rustc")?)
-        .arg(source_path)
-        .arg("--crate-name")
-        .arg("temp")
-        .arg("-o")
-        .arg(&executable_path)
-        .output()
-        .await?;
-
-    if !compile_output.status.success() {
-        let stderr = String::from_utf8_lossy(&compile_output.stderr);
-        return Err(InfraError::CompilationError(
-            format!("Rust compilation failed:\n{}", stderr).into(),
-        ));
-    }
-
-    let mut cmd = Command::new(&executable_path)
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
+        if !compile_output.status.success() {
+            let stderr = String::from_utf8_lossy(&compile_output.stderr);
+            return Err(InfraError::CompilationError(
+                format!("Rust compilation failed:\n{}", stderr).into(),
+            ));
+        }
+        ctx.record_warnings(&compile_output.stderr);
+        Ok(())
+    })
+    .await?;
 
-    let output = cmd.wait_with_output().await?;
+    let output = if wasm {
+        let module = tokio::fs::read(&executable_path).await?;
+        run_module(module, stdin_input, ctx).await?
+    } else {
+        profile::run_native(&executable_path, stdin_input, ctx).await?
+    };
     match output.status.code() {
-        Some(0) => Ok(String::from_utf8(output.stdout)?),
+        Some(0) => {
+            if let Some(dir) = ctx.profile_dir() {
+                profile::report_native(dir, ctx).await?;
+            }
+            Ok(String::from_utf8(output.stdout)?)
+        }
         Some(code) => {
             let stderr = String::from_utf8_lossy(&output.stderr);
             Err(InfraError::CompilationError(
@@ -75,11 +89,23 @@ fn main() {
     println!("Hello, World!");
 }
 "#;
-        let result = compile_rust(code, "").await;
+        let result = compile_rust(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
     }
 
+    #[tokio::test]
+    async fn test_compiler_flags_are_passed_to_rustc() {
+        let code = r#"
+fn main() {
+    println!("{}", cfg!(debug_assertions));
+}
+"#;
+        let ctx = ExecContext::default().with_compiler_flags(vec!["-O".into()]);
+        let result = compile_rust(code, "", &ctx).await;
+        assert_eq!(result.unwrap().trim(), "false");
+    }
+
     #[tokio::test]
     async fn test_program_with_input() {
         let code = r#"
@@ -92,7 +118,7 @@ fn main() {
     println!("Hello, {}!", name);
 }
 "#;
-        let result = compile_rust(code, "Alice\n").await;
+        let result = compile_rust(code, "Alice\n", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, Alice!");
     }
@@ -115,7 +141,7 @@ fn main() {
     println!("{}", sum);
 }
 "#;
-        let result = compile_rust(code, "5 3\n").await;
+        let result = compile_rust(code, "5 3\n", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "8");
     }
@@ -135,7 +161,7 @@ fn main() {
     println!("{} {}", line1.trim(), line2.trim());
 }
 "#;
-        let result = compile_rust(code, "Hello\nWorld\n").await;
+        let result = compile_rust(code, "Hello\nWorld\n", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello World");
     }
@@ -147,7 +173,7 @@ fn main() {
     undefined_function();
 }
 "#;
-        let result = compile_rust(code, "").await;
+        let result = compile_rust(code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -159,7 +185,7 @@ fn main() {
     println!("Missing semicolon")
 }
 "#;
-        let result = compile_rust(code, "").await;
+        let result = compile_rust(code, "", &ExecContext::default()).await;
         println!("{:?}", result);
         assert!(result.is_err());
     }
@@ -174,7 +200,7 @@ fn main() {
     process::exit(1);
 }
 "#;
-        let result = compile_rust(code, "").await;
+        let result = compile_rust(code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -186,7 +212,7 @@ fn main() {
     eprintln!("stderr message");
 }
 "#;
-        let result = compile_rust(code, "").await;
+        let result = compile_rust(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "stdout message");
     }
@@ -201,7 +227,7 @@ fn main() {
     println!();
 }
 "#;
-        let result = compile_rust(code, "").await;
+        let result = compile_rust(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "1 2 3");
     }
@@ -215,7 +241,7 @@ fn main() {
     println!("{}", sum);
 }
 "#;
-        let result = compile_rust(code, "").await;
+        let result = compile_rust(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "15");
     }
@@ -226,7 +252,7 @@ fn main() {
 fn main() {
 }
 "#;
-        let result = compile_rust(code, "").await;
+        let result = compile_rust(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
@@ -243,7 +269,7 @@ fn main() {
     }
 }
 "#;
-        let result = compile_rust(code, "").await;
+        let result = compile_rust(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "other");
     }
@@ -257,7 +283,7 @@ fn main() {
     println!("Length: {}", len);
 }
 "#;
-        let result = compile_rust(code, "").await;
+        let result = compile_rust(code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Length: 5");
     }
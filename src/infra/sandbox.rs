@@ -0,0 +1,377 @@
+use std::{
+    future::Future,
+    io,
+    os::unix::process::CommandExt,
+    path::Path,
+    process::Stdio,
+    str::FromStr,
+    sync::{Mutex, OnceLock},
+};
+
+use nix::unistd::{Gid, Uid, User, chown, geteuid};
+use tokio::{process::Command, sync::Semaphore};
+
+// The account one run executes as. The server has to run as root to switch
+// to it; everything a program needs (its source directory and workspace) is
+// handed over to this user first.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct SandboxUser {
+    uid: u32,
+    gid: u32,
+}
+
+impl SandboxUser {
+    pub fn uid(&self) -> u32 {
+        self.uid
+    }
+
+    pub fn gid(&self) -> u32 {
+        self.gid
+    }
+
+    pub fn apply(&self, cmd: &mut Command) {
+        cmd.uid(self.uid).gid(self.gid);
+    }
+
+    pub fn grant(&self, path: &Path) -> io::Result<()> {
+        chown(
+            path,
+            Some(Uid::from_raw(self.uid)),
+            Some(Gid::from_raw(self.gid)),
+        )
+        .map_err(io::Error::from)
+    }
+
+    // Kills every process running as this user: kill(-1) sent from the
+    // user's own uid reaches exactly those. Repeated while it finds any, so
+    // processes forked while it ran do not survive it.
+    fn kill_all(&self) {
+        for _ in 0..MAX_KILL_ROUNDS {
+            let found = std::process::Command::new("kill")
+                .args(["-s", "KILL", "--", "-1"])
+                .uid(self.uid)
+                .gid(self.gid)
+                .stdout(Stdio::null())
+                .stderr(Stdio::null())
+                .status();
+            match found {
+                Ok(status) if status.success() => continue,
+                Ok(_) => return,
+                Err(err) => {
+                    tracing::error!("failed to kill processes of uid {}: {}", self.uid, err);
+                    return;
+                }
+            }
+        }
+        tracing::warn!("uid {} still had processes after killing them", self.uid);
+    }
+}
+
+const MAX_KILL_ROUNDS: usize = 8;
+
+// The uids runs execute as, one run to a uid at a time, so nothing a program
+// can do to its own user's processes and files (signal them all, read their
+// memory and working directories through /proc, use up the per-user process
+// limit) reaches another run. Each uid runs with the group of the same id
+// unless a group is given.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct SandboxUsers {
+    first: u32,
+    last: u32,
+    gid: Option<u32>,
+}
+
+impl FromStr for SandboxUsers {
+    type Err = String;
+
+    // Accepts a uid range `first-last`, or a single user as a name, a numeric
+    // uid or `uid:gid`; runs take turns with a single user. Root is refused,
+    // since programs would then run with the server's own privileges.
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let nonzero = |id: u32| match id {
+            0 => Err("sandbox user and group ids must not be 0".to_string()),
+            id => Ok(id),
+        };
+        let numeric = |id: &str| {
+            id.trim()
+                .parse::<u32>()
+                .map_err(|_| format!("invalid sandbox user id: {}", id))
+                .and_then(nonzero)
+        };
+        let is_id = |id: &str| !id.is_empty() && id.bytes().all(|b| b.is_ascii_digit());
+        if let Some((first, last)) = s.split_once('-').filter(|(a, b)| is_id(a) && is_id(b)) {
+            let (first, last) = (numeric(first)?, numeric(last)?);
+            if first > last {
+                return Err(format!("sandbox uid range {} is empty", s));
+            }
+            return Ok(SandboxUsers {
+                first,
+                last,
+                gid: None,
+            });
+        }
+        let single = |uid, gid| SandboxUsers {
+            first: uid,
+            last: uid,
+            gid: Some(gid),
+        };
+        if let Some((uid, gid)) = s.split_once(':') {
+            return Ok(single(numeric(uid)?, numeric(gid)?));
+        }
+        if is_id(s) {
+            let uid = numeric(s)?;
+            return Ok(single(uid, uid));
+        }
+        match User::from_name(s) {
+            Ok(Some(user)) => Ok(single(
+                nonzero(user.uid.as_raw())?,
+                nonzero(user.gid.as_raw())?,
+            )),
+            Ok(None) => Err(format!("sandbox user {} does not exist", s)),
+            Err(err) => Err(format!("failed to look up sandbox user {}: {}", s, err)),
+        }
+    }
+}
+
+impl SandboxUsers {
+    pub fn count(&self) -> usize {
+        (self.last - self.first) as usize + 1
+    }
+
+    fn user(&self, uid: u32) -> SandboxUser {
+        SandboxUser {
+            uid,
+            gid: self.gid.unwrap_or(uid),
+        }
+    }
+}
+
+// The uids no run holds, and a permit for each.
+struct UserPool {
+    users: SandboxUsers,
+    free: Mutex<Vec<u32>>,
+    available: Semaphore,
+}
+
+impl UserPool {
+    fn new(users: SandboxUsers) -> Self {
+        UserPool {
+            users,
+            free: Mutex::new((users.first..=users.last).rev().collect()),
+            available: Semaphore::new(users.count()),
+        }
+    }
+
+    fn take(&'static self) -> UserLease {
+        let uid = self
+            .free
+            .lock()
+            .unwrap()
+            .pop()
+            .expect("a permit is only taken for a free uid");
+        UserLease {
+            user: self.users.user(uid),
+            pool: self,
+        }
+    }
+
+    async fn lease(&'static self) -> UserLease {
+        self.available
+            .acquire()
+            .await
+            .expect("the user pool is never closed")
+            .forget();
+        self.take()
+    }
+
+    fn try_lease(&'static self) -> Option<UserLease> {
+        self.available.try_acquire().ok()?.forget();
+        Some(self.take())
+    }
+
+    fn release(&self, uid: u32) {
+        self.free.lock().unwrap().push(uid);
+        self.available.add_permits(1);
+    }
+}
+
+// A uid held for one run, or for a session or warm interpreter that runs
+// as one user for its whole life. Whatever was left running as it, in the
+// run's process group or not, is killed before it goes to another run.
+pub struct UserLease {
+    user: SandboxUser,
+    pool: &'static UserPool,
+}
+
+impl UserLease {
+    pub fn user(&self) -> SandboxUser {
+        self.user
+    }
+
+    // Runs `fut` with this as the user `sandbox_user` returns.
+    pub async fn scope<F: Future>(&self, fut: F) -> F::Output {
+        RUN_USER.scope(self.user, fut).await
+    }
+
+    pub fn sync_scope<R>(&self, f: impl FnOnce() -> R) -> R {
+        RUN_USER.sync_scope(self.user, f)
+    }
+}
+
+impl Drop for UserLease {
+    fn drop(&mut self) {
+        let (user, pool) = (self.user, self.pool);
+        std::thread::spawn(move || {
+            user.kill_all();
+            pool.release(user.uid);
+        });
+    }
+}
+
+tokio::task_local! {
+    static RUN_USER: SandboxUser;
+}
+
+static USER_POOL: OnceLock<Option<UserPool>> = OnceLock::new();
+
+fn user_pool() -> Option<&'static UserPool> {
+    USER_POOL.get().and_then(Option::as_ref)
+}
+
+// Whether programs run as sandbox users at all.
+pub fn sandboxed() -> bool {
+    user_pool().is_some()
+}
+
+// The user the current run executes as, or None when programs run with the
+// server's own privileges. Spawning a program outside a run's scope while
+// sandboxed is an error rather than a program running as root.
+pub fn sandbox_user() -> io::Result<Option<SandboxUser>> {
+    match RUN_USER.try_with(|user| *user) {
+        Ok(user) => Ok(Some(user)),
+        Err(_) if sandboxed() => Err(io::Error::other("no sandbox user was leased for this run")),
+        Err(_) => Ok(None),
+    }
+}
+
+// Takes a uid without waiting for one, for processes started ahead of the
+// runs they serve. None when programs are not sandboxed.
+pub fn try_lease_user() -> io::Result<Option<UserLease>> {
+    match user_pool() {
+        Some(pool) => pool
+            .try_lease()
+            .map(Some)
+            .ok_or_else(|| io::Error::other("every sandbox uid is in use")),
+        None => Ok(None),
+    }
+}
+
+// Runs `fut` as a user of its own, waiting for a free uid, unless it is
+// part of a run that already has one.
+pub async fn as_sandbox_user<F: Future>(fut: F) -> F::Output {
+    if RUN_USER.try_with(|_| ()).is_ok() {
+        return fut.await;
+    }
+    match user_pool() {
+        Some(pool) => pool.lease().await.scope(fut).await,
+        None => fut.await,
+    }
+}
+
+// Called once at startup. Refuses to start rather than silently running
+// submissions with the server's own privileges.
+pub fn init_sandbox(users: Option<SandboxUsers>) {
+    if let Some(users) = users {
+        assert!(
+            geteuid().is_root(),
+            "SANDBOX_USER is set but the server is not running as root"
+        );
+        tracing::info!(
+            "running submissions as uids {}-{}, one run to each",
+            users.first,
+            users.last
+        );
+    }
+    if USER_POOL.set(users.map(UserPool::new)).is_err() {
+        tracing::warn!("sandbox users were already initialised");
+    }
+}
+
+#[cfg(test)]
+mod sandbox_tests {
+    use super::*;
+    use std::time::Duration;
+
+    #[test]
+    fn test_parse_accepts_ranges_ids_and_names() {
+        assert_eq!(
+            "20000-20999".parse::<SandboxUsers>(),
+            Ok(SandboxUsers {
+                first: 20000,
+                last: 20999,
+                gid: None
+            })
+        );
+        assert_eq!("20000-20999".parse::<SandboxUsers>().unwrap().count(), 1000);
+        assert_eq!(
+            "1000:100".parse::<SandboxUsers>(),
+            Ok(SandboxUsers {
+                first: 1000,
+                last: 1000,
+                gid: Some(100)
+            })
+        );
+        assert_eq!(
+            "1000".parse::<SandboxUsers>().unwrap().user(1000),
+            SandboxUser {
+                uid: 1000,
+                gid: 1000
+            }
+        );
+        assert!("20999-20000".parse::<SandboxUsers>().is_err());
+        assert!("no-such-user-here".parse::<SandboxUsers>().is_err());
+        assert!("1000:staff".parse::<SandboxUsers>().is_err());
+    }
+
+    #[test]
+    fn test_parse_refuses_root() {
+        assert!("root".parse::<SandboxUsers>().is_err());
+        assert!("0".parse::<SandboxUsers>().is_err());
+        assert!("1000:0".parse::<SandboxUsers>().is_err());
+        assert!("0-999".parse::<SandboxUsers>().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_lease_gives_each_holder_its_own_uid() {
+        let pool: &'static UserPool =
+            Box::leak(Box::new(UserPool::new("20000-20001".parse().unwrap())));
+        let first = pool.lease().await;
+        let second = pool.lease().await;
+        assert_ne!(first.user(), second.user());
+        assert!(pool.try_lease().is_none());
+
+        let uid = first.user().uid();
+        drop(first);
+        let third = tokio::time::timeout(Duration::from_secs(5), pool.lease())
+            .await
+            .unwrap();
+        assert_eq!(third.user().uid(), uid);
+        assert_eq!(third.scope(async { RUN_USER.get() }).await, third.user());
+    }
+
+    #[tokio::test]
+    async fn test_apply_runs_command_as_sandbox_user() {
+        if !geteuid().is_root() {
+            return;
+        }
+        let user = SandboxUser {
+            uid: 65534,
+            gid: 65534,
+        };
+        let mut cmd = Command::new("sh");
+        cmd.args(["-c", "id -u; id -G"]);
+        user.apply(&mut cmd);
+        let output = cmd.output().await.unwrap();
+        assert_eq!(String::from_utf8_lossy(&output.stdout), "65534\n65534\n");
+    }
+}
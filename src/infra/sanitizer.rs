@@ -0,0 +1,272 @@
+use std::{fs, io, path::Path};
+
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+
+use super::error::InfraError;
+
+pub const SANITIZE_FLAGS: &[&str] = &[
+    "-fsanitize=address,undefined",
+    "-fno-sanitize-recover=undefined",
+    "-fno-omit-frame-pointer",
+    "-g",
+];
+
+// Where a runner leaves the parsed reports for the handler.
+const REPORT_FILE: &str = "reports.json";
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+pub struct StackFrame {
+    #[schema(example = "main")]
+    pub function: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[schema(example = "main.c")]
+    pub file: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub line: Option<u32>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub column: Option<u32>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+pub struct SanitizerReport {
+    #[schema(example = "AddressSanitizer")]
+    pub sanitizer: String,
+    #[schema(example = "heap-buffer-overflow")]
+    pub kind: String,
+    #[schema(example = "heap-buffer-overflow on address 0x602000000020 at pc 0x4c3a1b")]
+    pub message: String,
+    // The innermost frame in the submitted code.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub location: Option<StackFrame>,
+    pub stack: Vec<StackFrame>,
+}
+
+// Both sanitizers report on stderr; UBSan is made to stop at the first
+// undefined behaviour the way ASan stops at the first memory error.
+pub fn options_env() -> [(String, String); 2] {
+    [
+        ("ASAN_OPTIONS", "detect_leaks=1"),
+        ("UBSAN_OPTIONS", "print_stacktrace=1:halt_on_error=1"),
+    ]
+    .map(|(key, value)| (key.to_string(), value.to_string()))
+}
+
+// `path:line:col` or `path:line`, with the path made relative to the
+// submission.
+fn split_location(location: &str, source_dir: &Path) -> (Option<String>, Option<u32>, Option<u32>) {
+    let Some((rest, last)) = location
+        .rsplit_once(':')
+        .and_then(|(rest, last)| Some((rest, last.parse::<u32>().ok()?)))
+    else {
+        return (Some(relative(location, source_dir)), None, None);
+    };
+    match rest
+        .rsplit_once(':')
+        .and_then(|(file, line)| Some((file, line.parse::<u32>().ok()?)))
+    {
+        Some((file, line)) => (Some(relative(file, source_dir)), Some(line), Some(last)),
+        None => (Some(relative(rest, source_dir)), Some(last), None),
+    }
+}
+
+fn relative(file: &str, source_dir: &Path) -> String {
+    Path::new(file)
+        .strip_prefix(source_dir)
+        .map(|file| file.to_string_lossy().into_owned())
+        .unwrap_or_else(|_| file.to_string())
+}
+
+// `#0 0x4c3a1b in main /tmp/x/main.c:5:10`; frames in libraries carry a
+// `(module+offset)` instead of a source location.
+fn parse_frame(line: &str, source_dir: &Path) -> Option<StackFrame> {
+    let rest = line.trim_start().strip_prefix('#')?;
+    let (_, rest) = rest.split_once(' ')?;
+    let rest = rest
+        .split_once(' ')
+        .map_or("", |(_, rest)| rest.trim_start());
+    // Function names can contain spaces; the location never does.
+    let (function, location) = match rest.strip_prefix("in ") {
+        Some(rest) => rest.rsplit_once(' ').unwrap_or((rest, "")),
+        None => ("??", rest),
+    };
+    let (file, line, column) = if location.is_empty() || location.starts_with('(') {
+        (None, None, None)
+    } else {
+        split_location(location, source_dir)
+    };
+    Some(StackFrame {
+        function: function.to_string(),
+        file,
+        line,
+        column,
+    })
+}
+
+fn new_report(line: &str, source_dir: &Path) -> Option<SanitizerReport> {
+    // `==123==ERROR: AddressSanitizer: heap-buffer-overflow on address ...`
+    if let Some((_, error)) = line.split_once("==ERROR: ") {
+        let (sanitizer, detail) = error.split_once(": ")?;
+        let kind = if detail.starts_with("detected memory leaks") {
+            "memory-leak"
+        } else {
+            detail.split_whitespace().next().unwrap_or(detail)
+        };
+        return Some(SanitizerReport {
+            sanitizer: sanitizer.to_string(),
+            kind: kind.to_string(),
+            message: detail.to_string(),
+            location: None,
+            stack: Vec::new(),
+        });
+    }
+    // `/tmp/x/main.c:4:15: runtime error: signed integer overflow: ...`
+    let (location, error) = line.split_once(": runtime error: ")?;
+    let (file, line, column) = split_location(location, source_dir);
+    Some(SanitizerReport {
+        sanitizer: String::from("UndefinedBehaviorSanitizer"),
+        kind: error.split(':').next().unwrap_or(error).to_string(),
+        message: error.to_string(),
+        location: Some(StackFrame {
+            function: String::new(),
+            file,
+            line,
+            column,
+        }),
+        stack: Vec::new(),
+    })
+}
+
+// Splits a sanitizer log into reports. Only the first stack of each report
+// is kept: that is where the error happened, later ones show where the
+// memory involved was allocated or freed.
+pub fn parse_log(log: &str, source_dir: &Path) -> Vec<SanitizerReport> {
+    let mut reports: Vec<SanitizerReport> = Vec::new();
+    let mut stack_done = false;
+    for line in log.lines() {
+        if let Some(report) = new_report(line, source_dir) {
+            reports.push(report);
+            stack_done = false;
+            continue;
+        }
+        let Some(report) = reports.last_mut() else {
+            continue;
+        };
+        match parse_frame(line, source_dir) {
+            Some(frame) if !stack_done => report.stack.push(frame),
+            Some(_) => {}
+            None => stack_done |= !report.stack.is_empty(),
+        }
+    }
+    for report in &mut reports {
+        // Paths outside the submission stay absolute, or relative to
+        // wherever the sanitizer runtime was built.
+        let in_source = report.stack.iter().find(|frame| {
+            frame
+                .file
+                .as_deref()
+                .is_some_and(|file| !file.starts_with('/') && !file.starts_with(".."))
+        });
+        if let Some(frame) = in_source {
+            report.location = Some(frame.clone());
+        }
+    }
+    reports
+}
+
+// Parses the reports out of the program's stderr and stores them in `dir`
+// for `load`.
+pub fn collect(
+    stderr: &[u8],
+    source_dir: &Path,
+    dir: &Path,
+) -> Result<Vec<SanitizerReport>, InfraError> {
+    let reports = parse_log(&String::from_utf8_lossy(stderr), source_dir);
+    let json = serde_json::to_vec(&reports).map_err(|err| {
+        InfraError::CompilationError(format!("unwritable sanitizer reports: {}", err).into())
+    })?;
+    fs::write(dir.join(REPORT_FILE), json)?;
+    Ok(reports)
+}
+
+pub fn load(dir: &Path) -> io::Result<Vec<SanitizerReport>> {
+    let json = match fs::read(dir.join(REPORT_FILE)) {
+        Ok(json) => json,
+        Err(err) if err.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(err) => return Err(err),
+    };
+    serde_json::from_slice(&json).map_err(|err| io::Error::new(io::ErrorKind::InvalidData, err))
+}
+
+#[cfg(test)]
+mod sanitizer_tests {
+    use super::*;
+
+    const ASAN_LOG: &str = "\
+=================================================================
+==4242==ERROR: AddressSanitizer: heap-buffer-overflow on address 0x602000000020 at pc 0x4c3a1b
+WRITE of size 4 at 0x602000000020 thread T0
+    #0 0x4c3a1b in fill /tmp/run/main.c:5:14
+    #1 0x4c3b02 in main /tmp/run/main.c:11:5
+    #2 0x7f0e1c  (/lib/x86_64-linux-gnu/libc.so.6+0x27249)
+
+0x602000000020 is located 0 bytes to the right of 16-byte region
+allocated by thread T0 here:
+    #0 0x7f4b44eb89cf in __interceptor_malloc ../../../../src/libsanitizer/asan/asan_malloc_linux.cpp:69
+    #1 0x4c3ae1 in main /tmp/run/main.c:10:14
+
+SUMMARY: AddressSanitizer: heap-buffer-overflow /tmp/run/main.c:5:14 in fill
+";
+
+    #[test]
+    fn test_parse_asan_report_keeps_the_faulting_stack() {
+        let reports = parse_log(ASAN_LOG, Path::new("/tmp/run"));
+        assert_eq!(reports.len(), 1);
+        let report = &reports[0];
+        assert_eq!(report.sanitizer, "AddressSanitizer");
+        assert_eq!(report.kind, "heap-buffer-overflow");
+        assert_eq!(report.stack.len(), 3);
+        assert_eq!(report.stack[2].function, "??");
+        assert_eq!(report.stack[2].file, None);
+        assert_eq!(
+            report.location,
+            Some(StackFrame {
+                function: "fill".into(),
+                file: Some("main.c".into()),
+                line: Some(5),
+                column: Some(14),
+            })
+        );
+    }
+
+    #[test]
+    fn test_parse_ubsan_and_leak_reports() {
+        let log = "/tmp/run/main.cpp:4:15: runtime error: signed integer overflow: \
+            2147483647 + 1 cannot be represented in type 'int'\n\
+            \x20   #0 0x4c3a1b in add(int, int) /tmp/run/main.cpp:4:15\n\
+            SUMMARY: UndefinedBehaviorSanitizer: undefined-behavior /tmp/run/main.cpp:4:15\n\
+            ==7==ERROR: LeakSanitizer: detected memory leaks\n\
+            Direct leak of 4 byte(s) in 1 object(s) allocated from:\n\
+            \x20   #0 0x493d6d in malloc (/tmp/run/main+0x493d6d)\n\
+            \x20   #1 0x4c3ae1 in main /tmp/run/main.cpp:9\n";
+        let reports = parse_log(log, Path::new("/tmp/run"));
+        assert_eq!(reports.len(), 2);
+        assert_eq!(reports[0].kind, "signed integer overflow");
+        let location = reports[0].location.as_ref().unwrap();
+        assert_eq!(location.function, "add(int, int)");
+        assert_eq!(location.file.as_deref(), Some("main.cpp"));
+        assert_eq!(reports[1].kind, "memory-leak");
+        assert_eq!(reports[1].location.as_ref().unwrap().line, Some(9));
+        assert_eq!(reports[1].location.as_ref().unwrap().column, None);
+    }
+
+    #[test]
+    fn test_collect_round_trips_through_dir() {
+        let dir = tempfile::tempdir().unwrap();
+        assert!(load(dir.path()).unwrap().is_empty());
+        let stderr = format!("start\n{}", ASAN_LOG);
+        let reports = collect(stderr.as_bytes(), Path::new("/tmp/run"), dir.path()).unwrap();
+        assert_eq!(reports.len(), 1);
+        assert_eq!(load(dir.path()).unwrap(), reports);
+    }
+}
@@ -1,48 +1,42 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
-
-pub async fn compile_scala(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".scala")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
-
-    let source_path = temp_file.path().to_path_buf();
-    let output_dir = tempfile::tempdir()?;
+use super::{
+    disk::execution_zone,
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_compiler, run_program},
+    source::SourceFile,
+};
+
+pub async fn compile_scala(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::SCALA, content)?;
+    let source_path = source.path().to_path_buf();
+    let output_dir = tempfile::tempdir_in(execution_zone())?;
     let output_path = output_dir.path();
 
-    let compile_output = Command::new(which("scalac")?)
+    let mut compile_cmd = ctx.command("scalac")?;
+    compile_cmd
         .arg(&source_path)
         .arg("-d")
-        .arg(output_path)
-        .output()
-        .await?;
+        .arg(output_path);
+    let compile_output = run_compiler(&mut compile_cmd, ctx).await?;
 
     if !compile_output.status.success() {
         let stderr = String::from_utf8_lossy(&compile_output.stderr);
-        return Err(InfraError::CompilationError(
-            format!("Scala compilation failed:\n{}", stderr).into(),
-        ));
+        return Err(InfraError::CompileError(format!(
+            "Scala compilation failed:\n{}",
+            stderr
+        )));
     }
+    ctx.record_warnings(&compile_output.stderr);
 
-    let mut cmd = Command::new("scala")
-        .arg("-cp")
+    let mut cmd = ctx.command("scala")?;
+    cmd.arg("-cp")
         .arg(output_path)
-        .arg("Main")
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
-
-    let output = cmd.wait_with_output().await?;
+        .arg("Main");
+    let output = run_program(&mut cmd, stdin_input, ctx).await?;
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
         Some(code) => {
@@ -78,7 +72,7 @@ object Main {
 }
 "#;
 
-        let result = compile_scala(scala_code, "").await;
+        let result = compile_scala(scala_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
     }
@@ -95,7 +89,7 @@ object Main {
 }
 "#;
 
-        let result = compile_scala(scala_code, "").await;
+        let result = compile_scala(scala_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "8");
     }
@@ -111,7 +105,7 @@ object Main {
 }
 "#;
 
-        let result = compile_scala(scala_code, "42").await;
+        let result = compile_scala(scala_code, "42", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "You entered: 42");
     }
@@ -127,7 +121,7 @@ object Main {
 }
 "#;
 
-        let result = compile_scala(scala_code, "Alice").await;
+        let result = compile_scala(scala_code, "Alice", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, Alice!");
     }
@@ -144,7 +138,7 @@ object Main {
 }
 "#;
 
-        let result = compile_scala(scala_code, "").await;
+        let result = compile_scala(scala_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Line 1"));
@@ -160,8 +154,8 @@ object Main {
     println("Missing closing brace" // This should cause a compilation error
 "#;
 
-        let result = compile_scala(invalid_scala_code, "").await;
-        assert!(result.is_err());
+        let result = compile_scala(invalid_scala_code, "", &ExecContext::default()).await;
+        assert!(matches!(result, Err(InfraError::CompileError(_))));
     }
 
     #[tokio::test]
@@ -174,7 +168,7 @@ object Main {
 }
 "#;
 
-        let result = compile_scala(scala_code, "").await;
+        let result = compile_scala(scala_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -190,7 +184,7 @@ object Main {
 }
 "#;
 
-        let result = compile_scala(scala_code, "7 3").await;
+        let result = compile_scala(scala_code, "7 3", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Sum: 10"));
@@ -205,7 +199,7 @@ object Main {
 }
 "#;
 
-        let result = compile_scala(scala_code, "").await;
+        let result = compile_scala(scala_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
@@ -221,7 +215,7 @@ object Main {
 }
 "#;
 
-        let result = compile_scala(scala_code, "").await;
+        let result = compile_scala(scala_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Length: 5");
     }
@@ -237,7 +231,7 @@ object Main {
 }
 "#;
 
-        let result = compile_scala(scala_code, "").await;
+        let result = compile_scala(scala_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Square root of 16.0 is 4.0");
     }
@@ -255,7 +249,7 @@ object Main {
 }
 "#;
 
-        let result = compile_scala(scala_code, "").await;
+        let result = compile_scala(scala_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Future running");
     }
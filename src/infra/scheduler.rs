@@ -0,0 +1,284 @@
+use std::collections::{BTreeMap, BTreeSet, HashMap, VecDeque};
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+
+// The caller's API key. The job queue is fair between the keys the tier
+// policy knows, and between client addresses for everyone else.
+pub const TENANT_HEADER: &str = "x-api-key";
+pub const ANONYMOUS_TENANT: &str = "anonymous";
+pub const IDEMPOTENCY_HEADER: &str = "idempotency-key";
+
+#[derive(Debug, Default)]
+pub struct FairScheduler<T> {
+    queues: HashMap<String, VecDeque<T>>,
+    rotation: VecDeque<String>,
+}
+
+impl<T> FairScheduler<T> {
+    pub fn new() -> Self {
+        FairScheduler {
+            queues: HashMap::new(),
+            rotation: VecDeque::new(),
+        }
+    }
+
+    pub fn push(&mut self, tenant: &str, item: T) {
+        let queue = self.queues.entry(tenant.to_string()).or_default();
+        if queue.is_empty() {
+            self.rotation.push_back(tenant.to_string());
+        }
+        queue.push_back(item);
+    }
+
+    pub fn pop(&mut self) -> Option<T> {
+        let tenant = self.rotation.pop_front()?;
+        let queue = self.queues.get_mut(&tenant)?;
+        let item = queue.pop_front();
+        if queue.is_empty() {
+            self.queues.remove(&tenant);
+        } else {
+            self.rotation.push_back(tenant);
+        }
+        item
+    }
+
+    pub fn len(&self) -> usize {
+        self.queues.values().map(VecDeque::len).sum()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.rotation.is_empty()
+    }
+}
+
+impl<T: PartialEq> FairScheduler<T> {
+    // How many items `pop` would hand out before `item`, if nothing else is
+    // pushed meanwhile. Every tenant ahead in the rotation gets one more
+    // turn than the rounds `item` waits for its own tenant's earlier items.
+    pub fn position(&self, item: &T) -> Option<usize> {
+        let queue_len = |tenant: &String| self.queues.get(tenant).map_or(0, VecDeque::len);
+        let (turn, index) = self
+            .rotation
+            .iter()
+            .enumerate()
+            .find_map(|(turn, tenant)| {
+                let queue = self.queues.get(tenant)?;
+                queue
+                    .iter()
+                    .position(|queued| queued == item)
+                    .map(|index| (turn, index))
+            })?;
+        let ahead = self
+            .rotation
+            .iter()
+            .enumerate()
+            .map(|(other, tenant)| {
+                let len = queue_len(tenant);
+                len.min(index) + usize::from(other < turn && len > index)
+            })
+            .sum();
+        Some(ahead)
+    }
+}
+
+// How urgently a job wants a worker. Live requests should not wait behind
+// a bulk regrade, which can ask for low priority.
+#[derive(
+    Debug, Clone, Copy, Default, PartialEq, Eq, PartialOrd, Ord, Serialize, Deserialize, ToSchema,
+)]
+#[serde(rename_all = "lowercase")]
+pub enum Priority {
+    High,
+    #[default]
+    Normal,
+    Low,
+}
+
+// Hands out items of the highest priority waiting, fairly across tenants
+// within each priority.
+#[derive(Debug, Default)]
+pub struct PriorityScheduler<T> {
+    levels: BTreeMap<Priority, FairScheduler<T>>,
+}
+
+impl<T> PriorityScheduler<T> {
+    pub fn new() -> Self {
+        PriorityScheduler {
+            levels: BTreeMap::new(),
+        }
+    }
+
+    pub fn push(&mut self, priority: Priority, tenant: &str, item: T) {
+        self.levels
+            .entry(priority)
+            .or_insert_with(FairScheduler::new)
+            .push(tenant, item);
+    }
+
+    pub fn pop(&mut self) -> Option<T> {
+        let mut level = self.levels.first_entry()?;
+        let item = level.get_mut().pop();
+        if level.get().is_empty() {
+            level.remove();
+        }
+        item
+    }
+
+    pub fn len(&self) -> usize {
+        self.levels.values().map(FairScheduler::len).sum()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.levels.is_empty()
+    }
+}
+
+impl<T: PartialEq> PriorityScheduler<T> {
+    pub fn position(&self, item: &T) -> Option<usize> {
+        let mut ahead = 0;
+        for level in self.levels.values() {
+            if let Some(position) = level.position(item) {
+                return Some(ahead + position);
+            }
+            ahead += level.len();
+        }
+        None
+    }
+}
+
+// Items held back until a set time, kept in the order they fall due.
+#[derive(Debug)]
+pub struct Timetable<T> {
+    due: BTreeSet<(DateTime<Utc>, T)>,
+}
+
+impl<T: Ord + Clone> Timetable<T> {
+    pub fn new() -> Self {
+        Timetable {
+            due: BTreeSet::new(),
+        }
+    }
+
+    pub fn insert(&mut self, at: DateTime<Utc>, item: T) {
+        self.due.insert((at, item));
+    }
+
+    // When the earliest item falls due.
+    pub fn next_due(&self) -> Option<DateTime<Utc>> {
+        self.due.first().map(|(at, _)| *at)
+    }
+
+    // Removes and returns every item due at or before `now`, earliest first.
+    pub fn take_due(&mut self, now: DateTime<Utc>) -> Vec<T> {
+        let mut taken = Vec::new();
+        while self.due.first().is_some_and(|(at, _)| *at <= now) {
+            taken.extend(self.due.pop_first().map(|(_, item)| item));
+        }
+        taken
+    }
+
+    pub fn items(&self) -> impl Iterator<Item = &T> {
+        self.due.iter().map(|(_, item)| item)
+    }
+
+    pub fn len(&self) -> usize {
+        self.due.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.due.is_empty()
+    }
+}
+
+#[cfg(test)]
+mod scheduler_tests {
+    use super::*;
+
+    #[test]
+    fn test_pop_round_robins_across_tenants() {
+        let mut scheduler = FairScheduler::new();
+        for i in 0..3 {
+            scheduler.push("bulk", format!("bulk-{}", i));
+        }
+        scheduler.push("small", "small-0".to_string());
+        scheduler.push("other", "other-0".to_string());
+
+        let order: Vec<_> = std::iter::from_fn(|| scheduler.pop()).collect();
+        assert_eq!(
+            order,
+            vec!["bulk-0", "small-0", "other-0", "bulk-1", "bulk-2"]
+        );
+        assert!(scheduler.is_empty());
+    }
+
+    #[test]
+    fn test_tenant_rejoins_rotation_after_draining() {
+        let mut scheduler = FairScheduler::new();
+        scheduler.push("a", 1);
+        scheduler.push("b", 2);
+        assert_eq!(scheduler.pop(), Some(1));
+        scheduler.push("a", 3);
+        assert_eq!(scheduler.len(), 2);
+        assert_eq!(scheduler.pop(), Some(2));
+        assert_eq!(scheduler.pop(), Some(3));
+        assert_eq!(scheduler.pop(), None);
+    }
+
+    #[test]
+    fn test_higher_priority_goes_first_and_stays_fair_within_it() {
+        let mut scheduler = PriorityScheduler::new();
+        scheduler.push(Priority::Low, "regrade", "low-0");
+        scheduler.push(Priority::Normal, "a", "a-0");
+        scheduler.push(Priority::Normal, "a", "a-1");
+        scheduler.push(Priority::Normal, "b", "b-0");
+        scheduler.push(Priority::High, "b", "high-0");
+        assert_eq!(scheduler.len(), 5);
+
+        let order: Vec<_> = std::iter::from_fn(|| scheduler.pop()).collect();
+        assert_eq!(order, vec!["high-0", "a-0", "b-0", "a-1", "low-0"]);
+        assert!(scheduler.is_empty());
+    }
+
+    #[test]
+    fn test_position_matches_pop_order() {
+        let mut scheduler = PriorityScheduler::new();
+        for i in 0..3 {
+            scheduler.push(Priority::Normal, "bulk", format!("bulk-{}", i));
+        }
+        scheduler.push(Priority::Normal, "small", "small-0".to_string());
+        scheduler.push(Priority::Low, "regrade", "low-0".to_string());
+        scheduler.push(Priority::High, "small", "high-0".to_string());
+        assert_eq!(scheduler.pop().as_deref(), Some("high-0"));
+        scheduler.push(Priority::Normal, "other", "other-0".to_string());
+        assert_eq!(scheduler.position(&"high-0".to_string()), None);
+
+        let positions: Vec<_> = ["bulk-0", "bulk-1", "bulk-2", "small-0", "other-0", "low-0"]
+            .into_iter()
+            .map(|item| (item.to_string(), scheduler.position(&item.to_string())))
+            .collect();
+        let order: Vec<_> = std::iter::from_fn(|| scheduler.pop()).collect();
+        for (item, position) in positions {
+            assert_eq!(order.iter().position(|popped| *popped == item), position);
+        }
+    }
+
+    #[test]
+    fn test_timetable_releases_items_once_due() {
+        let now = Utc::now();
+        let mut timetable = Timetable::new();
+        timetable.insert(now + chrono::Duration::seconds(60), "later");
+        timetable.insert(now - chrono::Duration::seconds(1), "overdue");
+        timetable.insert(now, "now");
+        assert_eq!(
+            timetable.next_due(),
+            Some(now - chrono::Duration::seconds(1))
+        );
+
+        assert_eq!(timetable.take_due(now), vec!["overdue", "now"]);
+        assert_eq!(timetable.items().collect::<Vec<_>>(), vec![&"later"]);
+        assert!(timetable.take_due(now).is_empty());
+        assert_eq!(timetable.len(), 1);
+    }
+}
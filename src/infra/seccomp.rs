@@ -0,0 +1,432 @@
+use std::{collections::BTreeMap, fmt, io, path::PathBuf, str::FromStr};
+
+use libc::{
+    BPF_ABS, BPF_JEQ, BPF_JMP, BPF_JSET, BPF_K, BPF_LD, BPF_RET, BPF_W, SECCOMP_RET_ALLOW,
+    SECCOMP_RET_ERRNO, SECCOMP_RET_KILL_PROCESS, c_char, c_long, sock_filter, sock_fprog,
+};
+
+use super::{language::Language, toolchain::Toolchain};
+
+#[cfg(target_arch = "x86_64")]
+const AUDIT_ARCH: u32 = 0xc000_003e;
+#[cfg(target_arch = "aarch64")]
+const AUDIT_ARCH: u32 = 0xc000_00b7;
+
+// x32 syscalls share the x86_64 audit arch but are numbered from here, so
+// they would otherwise slip past every rule below.
+#[cfg(target_arch = "x86_64")]
+const X32_SYSCALL_BIT: u32 = 0x4000_0000;
+
+// Offsets into `struct seccomp_data`.
+const NR_OFFSET: u32 = 0;
+const ARCH_OFFSET: u32 = 4;
+const ARG0_OFFSET: u32 = 16;
+
+// The clone flags that make new namespaces.
+const NAMESPACE_FLAGS: u32 = (libc::CLONE_NEWNS
+    | libc::CLONE_NEWCGROUP
+    | libc::CLONE_NEWUTS
+    | libc::CLONE_NEWIPC
+    | libc::CLONE_NEWUSER
+    | libc::CLONE_NEWPID
+    | libc::CLONE_NEWNET
+    | libc::CLONE_NEWTIME) as u32;
+
+const SYSCALLS: &[(&str, c_long)] = &[
+    ("socket", libc::SYS_socket),
+    ("connect", libc::SYS_connect),
+    ("bind", libc::SYS_bind),
+    ("listen", libc::SYS_listen),
+    ("accept", libc::SYS_accept),
+    ("accept4", libc::SYS_accept4),
+    ("execve", libc::SYS_execve),
+    ("execveat", libc::SYS_execveat),
+    ("ptrace", libc::SYS_ptrace),
+    ("mount", libc::SYS_mount),
+    ("umount2", libc::SYS_umount2),
+    ("pivot_root", libc::SYS_pivot_root),
+    ("chroot", libc::SYS_chroot),
+    ("setns", libc::SYS_setns),
+    ("unshare", libc::SYS_unshare),
+    ("reboot", libc::SYS_reboot),
+    ("swapon", libc::SYS_swapon),
+    ("swapoff", libc::SYS_swapoff),
+    ("init_module", libc::SYS_init_module),
+    ("finit_module", libc::SYS_finit_module),
+    ("delete_module", libc::SYS_delete_module),
+    ("kexec_load", libc::SYS_kexec_load),
+    ("bpf", libc::SYS_bpf),
+    ("perf_event_open", libc::SYS_perf_event_open),
+    ("keyctl", libc::SYS_keyctl),
+    ("add_key", libc::SYS_add_key),
+    ("request_key", libc::SYS_request_key),
+    ("io_uring_setup", libc::SYS_io_uring_setup),
+    ("io_uring_enter", libc::SYS_io_uring_enter),
+    ("io_uring_register", libc::SYS_io_uring_register),
+    ("clone", libc::SYS_clone),
+    ("clone3", libc::SYS_clone3),
+];
+
+// io_uring carries out socket and file calls of its own, out of the filter's
+// sight. clone and clone3 are only denied the namespace flags, which would
+// otherwise get around setns and unshare.
+const SYSTEM_ADMIN: &[&str] = &[
+    "ptrace",
+    "mount",
+    "umount2",
+    "pivot_root",
+    "chroot",
+    "setns",
+    "unshare",
+    "reboot",
+    "swapon",
+    "swapoff",
+    "init_module",
+    "finit_module",
+    "delete_module",
+    "kexec_load",
+    "bpf",
+    "perf_event_open",
+    "keyctl",
+    "add_key",
+    "request_key",
+    "io_uring_setup",
+    "io_uring_enter",
+    "io_uring_register",
+    "clone",
+    "clone3",
+];
+
+const NETWORK: &[&str] = &["socket", "connect", "bind", "listen", "accept", "accept4"];
+
+const EXEC: &[&str] = &["execve", "execveat"];
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SyscallProfile {
+    // No filter at all.
+    Unrestricted,
+    // Blocks system administration calls. Suits interpreters and toolchain
+    // drivers such as `go run`, which need to spawn processes.
+    Default,
+    // Additionally blocks networking. Suits shells, which cannot work
+    // without starting other programs but have no business on the network.
+    Offline,
+    // Additionally blocks networking and starting other programs. Suits
+    // compiled binaries that run on their own.
+    Strict,
+}
+
+impl SyscallProfile {
+    pub fn for_language(language: Language) -> Self {
+        match language {
+            Language::C
+            | Language::CPP
+            | Language::RUST
+            | Language::DART
+            | Language::CRYSTAL
+            | Language::HASKELL
+            | Language::FORTRAN
+            | Language::ASSEMBLY
+            | Language::SQL
+            | Language::BRAINFUCK => SyscallProfile::Strict,
+            Language::BASH => SyscallProfile::Offline,
+            _ => SyscallProfile::Default,
+        }
+    }
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            SyscallProfile::Unrestricted => "none",
+            SyscallProfile::Default => "default",
+            SyscallProfile::Offline => "offline",
+            SyscallProfile::Strict => "strict",
+        }
+    }
+
+    pub fn denied(&self) -> Vec<&'static str> {
+        match self {
+            SyscallProfile::Unrestricted => Vec::new(),
+            SyscallProfile::Default => SYSTEM_ADMIN.to_vec(),
+            SyscallProfile::Offline => [SYSTEM_ADMIN, NETWORK].concat(),
+            SyscallProfile::Strict => [SYSTEM_ADMIN, NETWORK, EXEC].concat(),
+        }
+    }
+
+    // The profile to use instead when programs may not reach the network.
+    pub fn without_network(self) -> Self {
+        match self {
+            SyscallProfile::Unrestricted | SyscallProfile::Default => SyscallProfile::Offline,
+            profile => profile,
+        }
+    }
+
+    pub fn denied_numbers(&self) -> Vec<c_long> {
+        self.denied()
+            .into_iter()
+            .filter_map(syscall_number)
+            .collect()
+    }
+}
+
+impl FromStr for SyscallProfile {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_lowercase().as_str() {
+            "none" => Ok(SyscallProfile::Unrestricted),
+            "default" => Ok(SyscallProfile::Default),
+            "offline" => Ok(SyscallProfile::Offline),
+            "strict" => Ok(SyscallProfile::Strict),
+            other => Err(format!("unknown syscall profile: {}", other)),
+        }
+    }
+}
+
+impl fmt::Display for SyscallProfile {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+// Seccomp settings from the server config. Programs are started through
+// `launcher`, which installs the filter for their language's profile and
+// then execs them.
+#[derive(Debug, Clone)]
+pub struct SeccompConfig {
+    pub launcher: PathBuf,
+    pub overrides: BTreeMap<String, SyscallProfile>,
+}
+
+impl SeccompConfig {
+    // Overrides are a comma-separated list of `lang:profile` pairs.
+    pub fn new(launcher: PathBuf, overrides: &str) -> Result<Self, String> {
+        let mut parsed = BTreeMap::new();
+        for entry in overrides
+            .split(',')
+            .map(str::trim)
+            .filter(|entry| !entry.is_empty())
+        {
+            let (lang, profile) = entry
+                .split_once(':')
+                .ok_or_else(|| format!("invalid syscall profile override: {}", entry))?;
+            parsed.insert(lang.trim().to_lowercase(), profile.trim().parse()?);
+        }
+        Ok(SeccompConfig {
+            launcher,
+            overrides: parsed,
+        })
+    }
+
+    pub fn profile_for(&self, toolchain: &Toolchain) -> SyscallProfile {
+        if let Some(profile) = self.overrides.get(toolchain.as_str()) {
+            return *profile;
+        }
+        match toolchain {
+            Toolchain::Builtin(language) => SyscallProfile::for_language(*language),
+            Toolchain::Plugin(_) => SyscallProfile::Default,
+        }
+    }
+}
+
+pub fn syscall_number(name: &str) -> Option<c_long> {
+    SYSCALLS
+        .iter()
+        .find(|(known, _)| *known == name)
+        .map(|(_, nr)| *nr)
+}
+
+fn stmt(code: u32, k: u32) -> sock_filter {
+    sock_filter {
+        code: code as u16,
+        jt: 0,
+        jf: 0,
+        k,
+    }
+}
+
+fn jump_if(op: u32, k: u32, jt: u8, jf: u8) -> sock_filter {
+    sock_filter {
+        code: (BPF_JMP | op | BPF_K) as u16,
+        jt,
+        jf,
+        k,
+    }
+}
+
+fn jump(k: u32, jt: u8, jf: u8) -> sock_filter {
+    jump_if(BPF_JEQ, k, jt, jf)
+}
+
+fn load(offset: u32) -> sock_filter {
+    stmt(BPF_LD | BPF_W | BPF_ABS, offset)
+}
+
+// Kills the process on any of `denied`. If execve is denied, a single
+// exception is made for a call whose path argument is exactly `exec_path`,
+// which lets the launcher exec the program after installing the filter.
+// A denied clone only kills when it asks for a new namespace, and a denied
+// clone3, whose flags are out of the filter's reach, fails with ENOSYS so
+// that libc falls back to clone.
+pub fn build_filter(denied: &[c_long], exec_path: *const c_char) -> Vec<sock_filter> {
+    let kill = stmt(BPF_RET | BPF_K, SECCOMP_RET_KILL_PROCESS);
+    let allow = stmt(BPF_RET | BPF_K, SECCOMP_RET_ALLOW);
+    let unsupported = stmt(BPF_RET | BPF_K, SECCOMP_RET_ERRNO | libc::ENOSYS as u32);
+    let mut filter = vec![
+        load(ARCH_OFFSET),
+        jump(AUDIT_ARCH, 1, 0),
+        kill,
+        load(NR_OFFSET),
+    ];
+    #[cfg(target_arch = "x86_64")]
+    filter.extend([jump_if(libc::BPF_JGE, X32_SYSCALL_BIT, 0, 1), kill]);
+
+    if denied.contains(&libc::SYS_execve) {
+        let path = exec_path as u64;
+        filter.extend([
+            jump(libc::SYS_execve as u32, 0, 6),
+            load(ARG0_OFFSET),
+            jump(path as u32, 0, 3),
+            load(ARG0_OFFSET + 4),
+            jump((path >> 32) as u32, 0, 1),
+            allow,
+            kill,
+        ]);
+    }
+    if denied.contains(&libc::SYS_clone) {
+        filter.extend([
+            jump(libc::SYS_clone as u32, 0, 4),
+            load(ARG0_OFFSET),
+            jump_if(BPF_JSET, NAMESPACE_FLAGS, 0, 1),
+            kill,
+            allow,
+        ]);
+    }
+    if denied.contains(&libc::SYS_clone3) {
+        filter.extend([jump(libc::SYS_clone3 as u32, 0, 1), unsupported]);
+    }
+    let restricted = [libc::SYS_execve, libc::SYS_clone, libc::SYS_clone3];
+    for nr in denied.iter().filter(|nr| !restricted.contains(nr)) {
+        filter.extend([jump(*nr as u32, 0, 1), kill]);
+    }
+    filter.push(allow);
+    filter
+}
+
+// Applies the filter to the calling thread and everything it execs. Cannot
+// be undone.
+pub fn install(denied: &[c_long], exec_path: *const c_char) -> io::Result<()> {
+    let filter = build_filter(denied, exec_path);
+    let program = sock_fprog {
+        len: filter.len() as u16,
+        filter: filter.as_ptr() as *mut sock_filter,
+    };
+    unsafe {
+        if libc::prctl(libc::PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0) != 0 {
+            return Err(io::Error::last_os_error());
+        }
+        if libc::prctl(
+            libc::PR_SET_SECCOMP,
+            libc::SECCOMP_MODE_FILTER,
+            &program as *const sock_fprog,
+        ) != 0
+        {
+            return Err(io::Error::last_os_error());
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod seccomp_tests {
+    use std::os::unix::process::{CommandExt, ExitStatusExt};
+    use std::process::Command;
+
+    use super::*;
+
+    fn run_filtered(denied: &'static [&'static str], script: &str) -> std::process::ExitStatus {
+        let numbers: Vec<c_long> = denied
+            .iter()
+            .filter_map(|name| syscall_number(name))
+            .collect();
+        let mut cmd = Command::new("python3");
+        cmd.args(["-c", script]);
+        unsafe {
+            cmd.pre_exec(move || install(&numbers, std::ptr::null()));
+        }
+        cmd.status().unwrap()
+    }
+
+    #[test]
+    fn test_denied_syscall_kills_with_sigsys() {
+        let status = run_filtered(&["socket"], "import socket; socket.socket()");
+        assert_eq!(status.signal(), Some(libc::SIGSYS));
+
+        let status = run_filtered(&["socket"], "print('no network needed')");
+        assert!(status.success());
+    }
+
+    #[test]
+    fn test_denied_execve_blocks_exec_without_matching_path() {
+        let status = run_filtered(&["execve"], "");
+        assert_eq!(status.signal(), Some(libc::SIGSYS));
+    }
+
+    #[test]
+    fn test_clone_cannot_make_namespaces() {
+        let denied = &["clone", "clone3"];
+        let fork = "import os\nos._exit(0 if os.fork() == 0 else os.wait()[1])";
+        assert!(run_filtered(denied, fork).success());
+
+        let new_user = format!(
+            "import ctypes\nctypes.CDLL(None).syscall({}, {}, 0, 0, 0, 0)",
+            libc::SYS_clone,
+            libc::CLONE_NEWUSER | libc::SIGCHLD
+        );
+        let status = run_filtered(denied, &new_user);
+        assert_eq!(status.signal(), Some(libc::SIGSYS));
+
+        let clone3 = format!(
+            "import ctypes, sys\nlibc = ctypes.CDLL(None, use_errno=True)\n\
+             libc.syscall({}, 0, 0)\nsys.exit(ctypes.get_errno() != {})",
+            libc::SYS_clone3,
+            libc::ENOSYS
+        );
+        assert!(run_filtered(denied, &clone3).success());
+    }
+
+    #[test]
+    fn test_profiles_and_overrides() {
+        assert!(SyscallProfile::Strict.denied().contains(&"execve"));
+        assert!(!SyscallProfile::Default.denied().contains(&"execve"));
+        assert!(SyscallProfile::Offline.denied().contains(&"socket"));
+        assert!(!SyscallProfile::Offline.denied().contains(&"execve"));
+        assert!(SyscallProfile::Unrestricted.denied().is_empty());
+        assert_eq!(
+            SyscallProfile::Default.without_network(),
+            SyscallProfile::Offline
+        );
+        assert_eq!(
+            SyscallProfile::Strict.without_network(),
+            SyscallProfile::Strict
+        );
+        for name in SyscallProfile::Strict.denied() {
+            assert!(syscall_number(name).is_some(), "{}", name);
+        }
+
+        let config =
+            SeccompConfig::new(PathBuf::from("launcher"), "python:strict, c:none").unwrap();
+        assert_eq!(
+            config.profile_for(&Toolchain::Builtin(Language::Python)),
+            SyscallProfile::Strict
+        );
+        assert_eq!(
+            config.profile_for(&Toolchain::Builtin(Language::C)),
+            SyscallProfile::Unrestricted
+        );
+        assert_eq!(
+            config.profile_for(&Toolchain::Builtin(Language::RUST)),
+            SyscallProfile::Strict
+        );
+        assert!(SeccompConfig::new(PathBuf::from("launcher"), "python:lax").is_err());
+    }
+}
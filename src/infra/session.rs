@@ -0,0 +1,514 @@
+use std::{
+    collections::HashMap,
+    fs,
+    path::{Path, PathBuf},
+    sync::{Arc, Mutex, OnceLock},
+    time::{Duration, Instant},
+};
+
+use serde::Deserialize;
+use serde_json::json;
+use tempfile::TempDir;
+use tokio::{
+    io::{AsyncBufReadExt, AsyncReadExt, AsyncWriteExt, BufReader},
+    process::{Child, ChildStdin, ChildStdout},
+    sync::OnceCell,
+};
+use uuid::Uuid;
+
+use crate::config::config;
+
+use super::{
+    calibration::calibration,
+    compile::{compile_lang, confine},
+    error::InfraError,
+    events::Submitter,
+    language::Language,
+    limits::language_defaults,
+    logs::logged,
+    runner::{ExecContext, ProcessGroup, prepare, spawn_piped},
+    sandbox::{UserLease, try_lease_user},
+    store::store,
+    toolchain::Toolchain,
+};
+
+// Runs cells sent as JSON lines on stdin in one shared namespace, answering
+// each with a JSON line on the stdout it started with. A cell's own output
+// is sent to temporary files at the descriptor level, so output from child
+// processes is caught too and nothing a cell prints can reach the replies.
+// A cell ending in an expression prints its repr, as a notebook would.
+const PYTHON_KERNEL: &str = r#"
+import ast, json, os, sys, tempfile, traceback
+control = os.fdopen(os.dup(0), "r")
+replies = os.fdopen(os.dup(1), "w")
+quiet = os.open(os.devnull, os.O_RDWR)
+for fd in (0, 1, 2):
+    os.dup2(quiet, fd)
+namespace = {"__name__": "__main__", "__builtins__": __builtins__}
+
+def run(code):
+    tree = ast.parse(code, "<cell>")
+    last = None
+    if tree.body and isinstance(tree.body[-1], ast.Expr):
+        last = ast.Expression(tree.body.pop().value)
+    exec(compile(tree, "<cell>", "exec"), namespace)
+    if last is not None:
+        value = eval(compile(last, "<cell>", "eval"), namespace)
+        if value is not None:
+            print(repr(value))
+
+for line in control:
+    cell = json.loads(line)
+    captured = [tempfile.TemporaryFile(), tempfile.TemporaryFile()]
+    for fd, file in zip((1, 2), captured):
+        os.dup2(file.fileno(), fd)
+    ok = True
+    try:
+        run(cell["code"])
+    except SystemExit:
+        pass
+    except BaseException as error:
+        ok = False
+        tb = error.__traceback__
+        while tb is not None and tb.tb_frame.f_code.co_filename != "<cell>":
+            tb = tb.tb_next
+        traceback.print_exception(type(error), error, tb)
+    sys.stdout.flush()
+    sys.stderr.flush()
+    for fd in (1, 2):
+        os.dup2(quiet, fd)
+    output = []
+    for file in captured:
+        file.seek(0)
+        output.append(file.read().decode(errors="replace"))
+        file.close()
+    replies.write(json.dumps({"stdout": output[0], "stderr": output[1], "ok": ok}) + "\n")
+    replies.flush()
+"#;
+
+// The most a kernel may print for one cell when the language sets no output
+// limit of its own.
+const MAX_REPLY_BYTES: usize = 1 << 20;
+
+// What one cell printed. A cell that fails leaves its session usable, so
+// failure is reported here rather than as an error.
+#[derive(Debug, Deserialize)]
+pub struct CellOutput {
+    pub stdout: String,
+    pub stderr: String,
+    pub ok: bool,
+}
+
+// A live interpreter holding the state cells build up.
+struct Kernel {
+    child: Child,
+    // Kills anything the cells left running once the session ends.
+    _group: ProcessGroup,
+    stdin: ChildStdin,
+    stdout: BufReader<ChildStdout>,
+}
+
+impl Kernel {
+    fn start(ctx: &ExecContext) -> Result<Self, InfraError> {
+        let mut cmd = ctx.command("python3")?;
+        cmd.args(["-c", PYTHON_KERNEL]);
+        prepare(&mut cmd, ctx)?;
+        let mut child = spawn_piped(&mut cmd)?;
+        let stdin = child.stdin.take().expect("stdin is piped");
+        let stdout = child.stdout.take().expect("stdout is piped");
+        Ok(Kernel {
+            _group: ProcessGroup::of(&child),
+            child,
+            stdin,
+            stdout: BufReader::new(stdout),
+        })
+    }
+
+    async fn run(&mut self, code: &str, max_reply: usize) -> Result<CellOutput, InfraError> {
+        let request = format!("{}\n", json!({ "code": code }));
+        self.stdin.write_all(request.as_bytes()).await?;
+        self.stdin.flush().await?;
+
+        let mut reply = Vec::new();
+        (&mut self.stdout)
+            .take(max_reply as u64 + 1)
+            .read_until(b'\n', &mut reply)
+            .await?;
+        if !reply.ends_with(b"\n") {
+            if reply.len() > max_reply {
+                return Err(InfraError::OutputLimitExceeded(max_reply));
+            }
+            let status = self.child.wait().await?;
+            return Err(InfraError::CompilationError(
+                format!("Python session exited with {}", status).into(),
+            ));
+        }
+        serde_json::from_slice(&reply).map_err(|err| InfraError::CompilationError(err.into()))
+    }
+}
+
+static SESSION_DIR: OnceLock<PathBuf> = OnceLock::new();
+
+// Session workspaces sit outside the execution zone, whose garbage
+// collection would remove the files of a session left idle for a while.
+fn session_dir() -> &'static Path {
+    SESSION_DIR.get_or_init(|| {
+        let dir = std::env::temp_dir().join("comphub-sessions");
+        if let Err(err) = fs::create_dir_all(&dir) {
+            tracing::error!("failed to create session directory {:?}: {}", dir, err);
+        }
+        dir
+    })
+}
+
+// Successive cells sharing a working directory. Python cells also share a
+// live interpreter; other languages run each cell as a program of its own
+// that sees the files earlier cells left behind. Every cell runs as the one
+// sandbox user the session holds for its whole life.
+pub struct Session {
+    toolchain: Toolchain,
+    workspace: TempDir,
+    ctx: ExecContext,
+    user: Option<UserLease>,
+    // Held for the length of a cell so cells of one session run in turn.
+    kernel: tokio::sync::Mutex<Option<Kernel>>,
+    last_used: Mutex<Instant>,
+}
+
+impl Session {
+    fn open(
+        toolchain: Toolchain,
+        ctx: ExecContext,
+        user: Option<UserLease>,
+    ) -> Result<Self, InfraError> {
+        let workspace = TempDir::new_in(session_dir())?;
+        let ctx = ctx.with_workspace(workspace.path().to_path_buf());
+        Ok(Session {
+            toolchain,
+            workspace,
+            ctx,
+            user,
+            kernel: tokio::sync::Mutex::new(None),
+            last_used: Mutex::new(Instant::now()),
+        })
+    }
+
+    pub fn toolchain(&self) -> Toolchain {
+        self.toolchain
+    }
+
+    pub fn workspace(&self) -> &Path {
+        self.workspace.path()
+    }
+
+    fn idle_for(&self) -> Duration {
+        self.last_used.lock().unwrap().elapsed()
+    }
+
+    pub async fn run(&self, code: &str, submitter: &Submitter) -> Result<CellOutput, InfraError> {
+        match &self.user {
+            Some(lease) => lease.scope(self.run_cell(code, submitter)).await,
+            None => self.run_cell(code, submitter).await,
+        }
+    }
+
+    async fn run_cell(&self, code: &str, submitter: &Submitter) -> Result<CellOutput, InfraError> {
+        let mut kernel = self.kernel.lock().await;
+        *self.last_used.lock().unwrap() = Instant::now();
+        if !matches!(self.toolchain, Toolchain::Builtin(Language::Python)) {
+            let id = Uuid::new_v4().to_string();
+            let lang = self.toolchain.as_str();
+            let run = compile_lang(lang, code, "", &self.ctx);
+            return match logged(&id, lang, code, submitter, run).await {
+                Ok(stdout) => Ok(CellOutput {
+                    stdout,
+                    stderr: String::new(),
+                    ok: true,
+                }),
+                Err(err @ (InfraError::CompilationError(_) | InfraError::CompileError(_))) => {
+                    Ok(CellOutput {
+                        stdout: String::new(),
+                        stderr: err.to_string(),
+                        ok: false,
+                    })
+                }
+                Err(err) => Err(err),
+            };
+        }
+
+        let ctx = confine(
+            self.ctx.clone(),
+            &self.toolchain,
+            config().await,
+            language_defaults().await,
+        );
+        if kernel.is_none() {
+            *kernel = Some(Kernel::start(&ctx)?);
+        }
+        let live = kernel.as_mut().unwrap();
+        let max_reply = ctx.max_output().unwrap_or(MAX_REPLY_BYTES);
+        let result = match ctx.timeout() {
+            Some(limit) => {
+                let limit = calibration().await.scale(limit);
+                tokio::time::timeout(limit, live.run(code, max_reply))
+                    .await
+                    .unwrap_or(Err(InfraError::timeout(limit)))
+            }
+            None => live.run(code, max_reply).await,
+        };
+        // A kernel that broke off mid-cell cannot be trusted with the next
+        // one; dropping it kills the interpreter and the state is lost.
+        if result.is_err() {
+            *kernel = None;
+        }
+        result
+    }
+}
+
+// Open sessions by id. A session nobody has sent a cell to for `ttl` is
+// closed, taking its interpreter and files with it.
+pub struct Sessions {
+    sessions: Mutex<HashMap<String, Arc<Session>>>,
+    ttl: Duration,
+    max: usize,
+}
+
+static SESSIONS: OnceCell<Sessions> = OnceCell::const_new();
+
+pub async fn sessions() -> &'static Sessions {
+    SESSIONS
+        .get_or_init(|| async {
+            let app_config = config().await;
+            Sessions::new(app_config.session_ttl(), app_config.session_max())
+        })
+        .await
+}
+
+impl Sessions {
+    pub fn new(ttl: Duration, max: usize) -> Self {
+        Sessions {
+            sessions: Mutex::new(HashMap::new()),
+            ttl,
+            max,
+        }
+    }
+
+    pub fn ttl(&self) -> Duration {
+        self.ttl
+    }
+
+    // Opens a session for `toolchain`, or returns None when `max` are open
+    // already or no sandbox user is free to hold it.
+    pub fn open(
+        &self,
+        toolchain: Toolchain,
+        ctx: ExecContext,
+    ) -> Result<Option<String>, InfraError> {
+        self.expire();
+        let mut sessions = self.sessions.lock().unwrap();
+        if sessions.len() >= self.max {
+            return Ok(None);
+        }
+        let Ok(user) = try_lease_user() else {
+            return Ok(None);
+        };
+        let id = Uuid::new_v4().simple().to_string();
+        sessions.insert(id.clone(), Arc::new(Session::open(toolchain, ctx, user)?));
+        Ok(Some(id))
+    }
+
+    pub fn get(&self, id: &str) -> Option<Arc<Session>> {
+        let sessions = self.sessions.lock().unwrap();
+        sessions
+            .get(id)
+            .filter(|session| session.idle_for() < self.ttl)
+            .cloned()
+    }
+
+    pub fn close(&self, id: &str) -> bool {
+        self.sessions.lock().unwrap().remove(id).is_some()
+    }
+
+    fn expire(&self) -> usize {
+        let mut sessions = self.sessions.lock().unwrap();
+        let before = sessions.len();
+        sessions.retain(|_, session| session.idle_for() < self.ttl);
+        before - sessions.len()
+    }
+}
+
+fn owner_key(id: &str) -> String {
+    format!("session:{}", id)
+}
+
+// Sessions live in the memory of the node that opened them. A node with a
+// `NODE_URL` records the ones it holds in the store, for `ttl` from their
+// last cell, so nodes sharing the store can pass requests on to it.
+pub async fn record_owner(id: &str, ttl: Duration) {
+    let Some(node_url) = config().await.node_url() else {
+        return;
+    };
+    if let Err(err) = store().await.put(&owner_key(id), &node_url, Some(ttl)) {
+        tracing::warn!("failed to record the owner of session {}: {}", id, err);
+    }
+}
+
+// The URL of the node holding session `id`, if one recorded it.
+pub async fn session_owner(id: &str) -> Option<String> {
+    store().await.get(&owner_key(id))
+}
+
+pub async fn forget_owner(id: &str) {
+    if let Err(err) = store().await.remove(&owner_key(id)) {
+        tracing::warn!("failed to forget the owner of session {}: {}", id, err);
+    }
+}
+
+pub async fn sweep_sessions(interval: Duration) {
+    let mut ticker = tokio::time::interval(interval);
+    loop {
+        ticker.tick().await;
+        let closed = sessions().await.expire();
+        if closed > 0 {
+            tracing::debug!("closed {} idle sessions", closed);
+        }
+    }
+}
+
+#[cfg(test)]
+mod session_tests {
+    use super::*;
+
+    fn open(sessions: &Sessions, lang: &str) -> Arc<Session> {
+        let toolchain = Toolchain::resolve(lang).unwrap();
+        let id = sessions
+            .open(toolchain, ExecContext::default())
+            .unwrap()
+            .unwrap();
+        sessions.get(&id).unwrap()
+    }
+
+    fn submitter() -> Submitter {
+        Submitter::new(None, "127.0.0.1")
+    }
+
+    #[tokio::test]
+    async fn test_python_cells_share_state() {
+        let sessions = Sessions::new(Duration::from_secs(60), 4);
+        let session = open(&sessions, "python");
+
+        let first = session
+            .run(
+                "import os\ndef square(x):\n    return x * x\nprint('defined')",
+                &submitter(),
+            )
+            .await
+            .unwrap();
+        assert!(first.ok, "{}", first.stderr);
+        assert_eq!(first.stdout, "defined\n");
+
+        let second = session
+            .run("os.system('echo child')\nsquare(7)", &submitter())
+            .await
+            .unwrap();
+        assert!(second.ok, "{}", second.stderr);
+        assert_eq!(second.stdout, "child\n49\n");
+
+        let third = session.run("square(3)", &submitter()).await.unwrap();
+        assert_eq!(third.stdout, "9\n");
+    }
+
+    #[tokio::test]
+    async fn test_python_errors_leave_the_session_usable() {
+        let sessions = Sessions::new(Duration::from_secs(60), 4);
+        let session = open(&sessions, "python");
+
+        session.run("total = 1", &submitter()).await.unwrap();
+        let failed = session
+            .run("print('before')\n1 / 0", &submitter())
+            .await
+            .unwrap();
+        assert!(!failed.ok);
+        assert_eq!(failed.stdout, "before\n");
+        assert!(failed.stderr.contains("ZeroDivisionError"));
+        assert!(!failed.stderr.contains("<string>"), "{}", failed.stderr);
+
+        let next = session.run("total + 1", &submitter()).await.unwrap();
+        assert_eq!(next.stdout, "2\n");
+    }
+
+    #[tokio::test]
+    async fn test_python_timeout_restarts_the_kernel() {
+        let sessions = Sessions::new(Duration::from_secs(60), 4);
+        let toolchain = Toolchain::resolve("python").unwrap();
+        let ctx = ExecContext::default().with_timeout(Duration::from_millis(500));
+        let id = sessions.open(toolchain, ctx).unwrap().unwrap();
+        let session = sessions.get(&id).unwrap();
+
+        session.run("x = 1", &submitter()).await.unwrap();
+        let err = session
+            .run("while True: pass", &submitter())
+            .await
+            .unwrap_err();
+        assert!(matches!(err, InfraError::Timeout(..)));
+
+        let after = session.run("'x' in globals()", &submitter()).await.unwrap();
+        assert_eq!(after.stdout, "False\n");
+    }
+
+    #[tokio::test]
+    async fn test_other_languages_share_the_workspace() {
+        let sessions = Sessions::new(Duration::from_secs(60), 4);
+        let session = open(&sessions, "perl");
+
+        session
+            .run(
+                "open my $f, '>', 'notes.txt' or die; print $f \"kept\\n\";",
+                &submitter(),
+            )
+            .await
+            .unwrap();
+        assert!(session.workspace().join("notes.txt").exists());
+        let read = session
+            .run(
+                "open my $f, '<', 'notes.txt' or die; print <$f>;",
+                &submitter(),
+            )
+            .await
+            .unwrap();
+        assert_eq!(read.stdout, "kept\n");
+
+        let failed = session.run("exit 3", &submitter()).await.unwrap();
+        assert!(!failed.ok);
+    }
+
+    #[test]
+    fn test_sessions_are_limited_closed_and_expired() {
+        let sessions = Sessions::new(Duration::from_millis(50), 1);
+        let toolchain = Toolchain::resolve("python").unwrap();
+        let id = sessions
+            .open(toolchain, ExecContext::default())
+            .unwrap()
+            .unwrap();
+        assert!(
+            sessions
+                .open(toolchain, ExecContext::default())
+                .unwrap()
+                .is_none()
+        );
+
+        assert!(sessions.close(&id));
+        assert!(sessions.get(&id).is_none());
+        assert!(!sessions.close(&id));
+
+        let id = sessions
+            .open(toolchain, ExecContext::default())
+            .unwrap()
+            .unwrap();
+        let workspace = sessions.get(&id).unwrap().workspace().to_path_buf();
+        std::thread::sleep(Duration::from_millis(80));
+        assert!(sessions.get(&id).is_none());
+        assert_eq!(sessions.expire(), 1);
+        assert!(!workspace.exists());
+    }
+}
@@ -0,0 +1,126 @@
+use std::{
+    fs,
+    path::{Path, PathBuf},
+    sync::Arc,
+};
+
+use tempfile::TempDir;
+use tokio::sync::Mutex;
+
+use super::{
+    build_cache::cached_build, disk::execution_zone, error::InfraError, runner::ExecContext,
+};
+
+// An executable built once and copied to every run of the same submission
+// that asks for it, so that runs against many inputs compile only once. A
+// build the compiler rejected is remembered too, and every run reports it
+// as a compile error.
+#[derive(Debug, Clone)]
+pub struct SharedBuild {
+    dir: Arc<TempDir>,
+    built: Arc<Mutex<Option<Result<PathBuf, String>>>>,
+}
+
+impl SharedBuild {
+    pub fn new() -> std::io::Result<Self> {
+        Ok(SharedBuild {
+            dir: Arc::new(TempDir::new_in(execution_zone())?),
+            built: Arc::new(Mutex::new(None)),
+        })
+    }
+
+    // Runs `build`, which leaves its executable at `executable`, unless an
+    // earlier caller already has; later callers wait for the first and get
+    // a copy of its executable instead.
+    async fn provide<F>(&self, executable: &Path, build: F) -> Result<(), InfraError>
+    where
+        F: Future<Output = Result<(), InfraError>>,
+    {
+        let mut built = self.built.lock().await;
+        match &*built {
+            Some(Ok(kept)) => {
+                fs::copy(kept, executable)?;
+                return Ok(());
+            }
+            Some(Err(message)) => return Err(InfraError::CompileError(message.clone())),
+            None => {}
+        }
+
+        let message = match build.await {
+            Ok(()) => {
+                let kept = self
+                    .dir
+                    .path()
+                    .join(executable.file_name().unwrap_or_default());
+                fs::copy(executable, &kept)?;
+                *built = Some(Ok(kept));
+                return Ok(());
+            }
+            Err(InfraError::CompilationError(err)) => err.to_string(),
+            Err(InfraError::CompileError(message)) => message,
+            // Anything else, such as the build timing out, is left for the
+            // next caller to try again.
+            Err(err) => return Err(err),
+        };
+        *built = Some(Err(message.clone()));
+        Err(InfraError::CompileError(message))
+    }
+}
+
+// Compiled runners build `source` through this, so a context carrying a
+// `SharedBuild` compiles once however many times it runs, and a build
+// another replica shared is reused rather than compiled again.
+pub async fn build_once<F>(
+    ctx: &ExecContext,
+    source: &Path,
+    executable: &Path,
+    build: F,
+) -> Result<(), InfraError>
+where
+    F: Future<Output = Result<(), InfraError>>,
+{
+    let build = cached_build(ctx, source, executable, build);
+    match ctx.shared_build() {
+        Some(shared) => shared.provide(executable, build).await,
+        None => build.await,
+    }
+}
+
+#[cfg(test)]
+mod shared_build_tests {
+    use super::*;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+
+    #[tokio::test]
+    async fn test_builds_once_and_copies_to_later_callers() {
+        let ctx = ExecContext::default().with_shared_build(SharedBuild::new().unwrap());
+        let builds = AtomicUsize::new(0);
+        for _ in 0..3 {
+            let dir = TempDir::new().unwrap();
+            let (source, executable) = (dir.path().join("main.c"), dir.path().join("main"));
+            build_once(&ctx, &source, &executable, async {
+                builds.fetch_add(1, Ordering::SeqCst);
+                fs::write(&executable, "binary")?;
+                Ok(())
+            })
+            .await
+            .unwrap();
+            assert_eq!(fs::read_to_string(&executable).unwrap(), "binary");
+        }
+        assert_eq!(builds.load(Ordering::SeqCst), 1);
+    }
+
+    #[tokio::test]
+    async fn test_remembers_a_failed_build() {
+        let ctx = ExecContext::default().with_shared_build(SharedBuild::new().unwrap());
+        let dir = TempDir::new().unwrap();
+        let (source, executable) = (dir.path().join("main.c"), dir.path().join("main"));
+        let failed = build_once(&ctx, &source, &executable, async {
+            Err(InfraError::CompileError(String::from("syntax error")))
+        })
+        .await;
+        assert!(matches!(failed, Err(InfraError::CompileError(m)) if m == "syntax error"));
+        let again = build_once(&ctx, &source, &executable, async { Ok(()) }).await;
+        assert!(matches!(again, Err(InfraError::CompileError(m)) if m == "syntax error"));
+    }
+}
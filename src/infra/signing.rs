@@ -0,0 +1,205 @@
+use std::{collections::HashMap, fmt, str::FromStr, time::Duration};
+
+use sha2::{Digest, Sha256};
+use thiserror::Error;
+
+const BLOCK_SIZE: usize = 64;
+
+#[derive(Debug, Error, PartialEq, Eq)]
+pub enum SignatureError {
+    #[error("missing {0} header")]
+    MissingHeader(&'static str),
+
+    #[error("unknown signing key {0}")]
+    UnknownKey(String),
+
+    #[error("timestamp is not a unix time in seconds")]
+    MalformedTimestamp,
+
+    #[error("timestamp is outside the accepted window")]
+    Expired,
+
+    #[error("signature does not match the request")]
+    Mismatch,
+
+    #[error("request was already submitted")]
+    Replayed,
+}
+
+// Shared secrets handed out to frontends, parsed from a comma-separated list
+// of `key_id:secret` pairs. Several keys can be live at once so they can be
+// rotated without downtime.
+#[derive(Clone, Default)]
+pub struct SigningKeys {
+    keys: HashMap<String, Vec<u8>>,
+}
+
+impl fmt::Debug for SigningKeys {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_set().entries(self.keys.keys()).finish()
+    }
+}
+
+impl FromStr for SigningKeys {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut keys = HashMap::new();
+        for entry in s.split(',').map(str::trim).filter(|entry| !entry.is_empty()) {
+            match entry.split_once(':') {
+                Some((id, secret)) if !id.is_empty() && !secret.is_empty() => {
+                    keys.insert(id.to_string(), secret.as_bytes().to_vec());
+                }
+                _ => return Err(String::from("signing keys must be key_id:secret pairs")),
+            }
+        }
+        Ok(SigningKeys { keys })
+    }
+}
+
+pub fn hmac_sha256(key: &[u8], message: &[u8]) -> [u8; 32] {
+    let mut block = [0u8; BLOCK_SIZE];
+    if key.len() > BLOCK_SIZE {
+        block[..32].copy_from_slice(&Sha256::digest(key));
+    } else {
+        block[..key.len()].copy_from_slice(key);
+    }
+
+    let mut inner = Sha256::new();
+    inner.update(block.map(|b| b ^ 0x36));
+    inner.update(message);
+    let mut outer = Sha256::new();
+    outer.update(block.map(|b| b ^ 0x5c));
+    outer.update(inner.finalize());
+    outer.finalize().into()
+}
+
+// The string a client signs: timestamp, method, path and a digest of the
+// body, one per line.
+pub fn signed_message(timestamp: &str, method: &str, path: &str, body: &[u8]) -> String {
+    format!(
+        "{}\n{}\n{}\n{:x}",
+        timestamp,
+        method,
+        path,
+        Sha256::digest(body)
+    )
+}
+
+pub fn to_hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+pub fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
+    a.len() == b.len() && a.iter().zip(b).fold(0, |diff, (x, y)| diff | (x ^ y)) == 0
+}
+
+pub struct SignedRequest<'a> {
+    pub key_id: &'a str,
+    pub timestamp: &'a str,
+    pub signature: &'a str,
+    pub method: &'a str,
+    pub path: &'a str,
+    pub body: &'a [u8],
+}
+
+impl SigningKeys {
+    pub fn is_empty(&self) -> bool {
+        self.keys.is_empty()
+    }
+
+    // Checks the signature and that the timestamp is within `window` of
+    // `now`, in either direction to tolerate clock skew. Replays inside the
+    // window are caught by the caller.
+    pub fn verify(
+        &self,
+        request: &SignedRequest,
+        window: Duration,
+        now: u64,
+    ) -> Result<(), SignatureError> {
+        let key = self
+            .keys
+            .get(request.key_id)
+            .ok_or_else(|| SignatureError::UnknownKey(request.key_id.to_string()))?;
+        let timestamp = request
+            .timestamp
+            .parse::<u64>()
+            .map_err(|_| SignatureError::MalformedTimestamp)?;
+        if timestamp.abs_diff(now) > window.as_secs() {
+            return Err(SignatureError::Expired);
+        }
+
+        let message = signed_message(request.timestamp, request.method, request.path, request.body);
+        let expected = to_hex(&hmac_sha256(key, message.as_bytes()));
+        if !constant_time_eq(expected.as_bytes(), request.signature.to_lowercase().as_bytes()) {
+            return Err(SignatureError::Mismatch);
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod signing_tests {
+    use super::*;
+
+    const WINDOW: Duration = Duration::from_secs(300);
+
+    fn sign(secret: &str, timestamp: &str, body: &[u8]) -> String {
+        let message = signed_message(timestamp, "POST", "/api/v1/compile", body);
+        to_hex(&hmac_sha256(secret.as_bytes(), message.as_bytes()))
+    }
+
+    fn request<'a>(timestamp: &'a str, signature: &'a str, body: &'a [u8]) -> SignedRequest<'a> {
+        SignedRequest {
+            key_id: "web",
+            timestamp,
+            signature,
+            method: "POST",
+            path: "/api/v1/compile",
+            body,
+        }
+    }
+
+    #[test]
+    fn test_hmac_matches_rfc_4231_vector() {
+        let mac = hmac_sha256(&[0x0b; 20], b"Hi There");
+        assert_eq!(
+            to_hex(&mac),
+            "b0344c61d8db38535ca8afceaf0bf12b881dc200c9833da726e9376c2e32cff7"
+        );
+    }
+
+    #[test]
+    fn test_verify_accepts_fresh_signature_and_rejects_tampering() {
+        let keys: SigningKeys = "web:s3cret".parse().unwrap();
+        let signature = sign("s3cret", "1000", b"{}");
+
+        assert_eq!(keys.verify(&request("1000", &signature, b"{}"), WINDOW, 1100), Ok(()));
+        assert_eq!(
+            keys.verify(&request("1000", &signature, b"{\"x\":1}"), WINDOW, 1100),
+            Err(SignatureError::Mismatch)
+        );
+        assert_eq!(
+            keys.verify(&request("1000", &signature, b"{}"), WINDOW, 2000),
+            Err(SignatureError::Expired)
+        );
+        assert_eq!(
+            keys.verify(&request("soon", &signature, b"{}"), WINDOW, 1000),
+            Err(SignatureError::MalformedTimestamp)
+        );
+
+        let mut unknown = request("1000", &signature, b"{}");
+        unknown.key_id = "cli";
+        assert!(matches!(
+            keys.verify(&unknown, WINDOW, 1000),
+            Err(SignatureError::UnknownKey(_))
+        ));
+    }
+
+    #[test]
+    fn test_keys_parse_pairs() {
+        assert!("".parse::<SigningKeys>().unwrap().is_empty());
+        assert!("web:a,cli:b".parse::<SigningKeys>().is_ok());
+        assert!("web".parse::<SigningKeys>().is_err());
+    }
+}
@@ -0,0 +1,114 @@
+use super::{
+    error::InfraError,
+    interpreter::{Interpreter, interpreter},
+    language::Language,
+    python, ruby,
+    runner::{ExecContext, run_program},
+    warm::warm_pool,
+};
+
+// A language whose interpreter reads the whole program from stdin before
+// running it, so a short program can be piped to it without writing a file
+// or a directory for it. Its result reads as it would from a file.
+#[derive(Debug, Clone, Copy)]
+pub enum Snippet {
+    Python,
+    Ruby,
+    Interpreter(&'static Interpreter),
+}
+
+// The interpreter to pipe `content` to, if it can be run that way: it has to
+// fit in `max_bytes` and need nothing but the interpreter, and since it takes
+// the place of stdin the program must have none to read. A warm interpreter
+// is quicker still, so languages the pool keeps are left to it.
+pub fn in_memory(
+    language: Language,
+    content: &str,
+    stdin: &str,
+    ctx: &ExecContext,
+    max_bytes: usize,
+) -> Option<Snippet> {
+    let plain = stdin.is_empty()
+        && !ctx.streams_stdin()
+        && ctx.interaction().is_none()
+        && ctx.dependencies().is_empty()
+        && ctx.setup().is_empty()
+        && ctx.coverage_dir().is_none()
+        && ctx.profile_dir().is_none()
+        && ctx.sanitizer_dir().is_none();
+    if content.len() > max_bytes || !plain {
+        return None;
+    }
+    if warm_pool().is_some_and(|pool| pool.keeps(language)) {
+        return None;
+    }
+    match language {
+        Language::Python => Some(Snippet::Python),
+        Language::RUBY => Some(Snippet::Ruby),
+        _ => interpreter(language)
+            .filter(|interpreter| interpreter.stdin_args.is_some())
+            .map(Snippet::Interpreter),
+    }
+}
+
+impl Snippet {
+    // The interpreter, and the arguments that have it read the program from
+    // stdin. The program's own arguments follow.
+    fn command(&self) -> (&'static str, &'static [&'static str]) {
+        match self {
+            Snippet::Python => ("python3", &["-"]),
+            Snippet::Ruby => ("ruby", &["-"]),
+            Snippet::Interpreter(interpreter) => (
+                interpreter.binary,
+                interpreter.stdin_args.unwrap_or_default(),
+            ),
+        }
+    }
+
+    pub async fn run(&self, content: &str, ctx: &ExecContext) -> Result<String, InfraError> {
+        let (binary, args) = self.command();
+        let mut cmd = ctx.command(binary)?;
+        cmd.args(args);
+        let output = run_program(&mut cmd, content, ctx).await?;
+        match self {
+            Snippet::Python => python::program_result(output),
+            Snippet::Ruby => ruby::program_result(output),
+            Snippet::Interpreter(interpreter) => interpreter.program_result(output),
+        }
+    }
+}
+
+#[cfg(test)]
+mod snippet_tests {
+    use super::*;
+
+    #[test]
+    fn test_only_small_programs_without_stdin_are_piped() {
+        let ctx = ExecContext::default();
+        assert!(in_memory(Language::Python, "print(1)", "", &ctx, 64).is_some());
+        assert!(in_memory(Language::Python, "print(1)", "", &ctx, 4).is_none());
+        assert!(in_memory(Language::Python, "print(input())", "1", &ctx, 64).is_none());
+        assert!(in_memory(Language::RUST, "fn main() {}", "", &ctx, 64).is_none());
+
+        let ctx = ExecContext::default().with_dependencies(vec!["requests".into()]);
+        assert!(in_memory(Language::Python, "import requests", "", &ctx, 64).is_none());
+    }
+
+    #[tokio::test]
+    async fn test_piped_program_gets_its_arguments() {
+        let ctx = ExecContext::default().with_args(vec!["a".into(), "b c".into()]);
+        let python = in_memory(Language::Python, "", "", &ctx, 64).unwrap();
+        let output = python
+            .run("import sys\nprint(sys.argv[1:])", &ctx)
+            .await
+            .unwrap();
+        assert_eq!(output.trim(), "['a', 'b c']");
+
+        let err = python.run("raise SystemExit(3)", &ctx).await.unwrap_err();
+        assert!(err.to_string().contains("status code: 3"));
+        let from_file = python::compile_python("raise SystemExit(3)", "", &ctx)
+            .await
+            .unwrap_err();
+        assert_eq!(err.to_string(), from_file.to_string());
+    }
+}
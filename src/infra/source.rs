@@ -0,0 +1,61 @@
+use std::{
+    fs, io,
+    path::{Path, PathBuf},
+};
+
+use tempfile::TempDir;
+
+use super::{disk::execution_zone, language::Language, sandbox::sandbox_user};
+
+// A submitted program written to its own directory in the execution zone
+// under the language's conventional file name. Build artefacts placed next to
+// it are removed together with the directory when this is dropped.
+pub struct SourceFile {
+    dir: TempDir,
+    path: PathBuf,
+}
+
+impl SourceFile {
+    pub fn create(language: Language, content: &str) -> io::Result<Self> {
+        SourceFile::named(language.source_file_name(), content)
+    }
+
+    pub fn named(file_name: &str, content: &str) -> io::Result<Self> {
+        let dir = TempDir::new_in(execution_zone())?;
+        let path = dir.path().join(file_name);
+        fs::write(&path, content)?;
+        if let Some(user) = sandbox_user()? {
+            user.grant(dir.path())?;
+            user.grant(&path)?;
+        }
+        Ok(SourceFile { dir, path })
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    pub fn dir(&self) -> &Path {
+        self.dir.path()
+    }
+}
+
+#[cfg(test)]
+mod source_tests {
+    use super::*;
+
+    #[test]
+    fn test_create_writes_conventional_file_name() {
+        let source = SourceFile::create(Language::TYPESCRIPT, "let x: number = 1;").unwrap();
+        assert_eq!(source.path().file_name().unwrap(), "main.ts");
+        assert_eq!(source.path().parent().unwrap(), source.dir());
+        assert_eq!(
+            fs::read_to_string(source.path()).unwrap(),
+            "let x: number = 1;"
+        );
+
+        let dir = source.dir().to_path_buf();
+        drop(source);
+        assert!(!dir.exists());
+    }
+}
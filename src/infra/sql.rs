@@ -0,0 +1,96 @@
+use super::{
+    error::InfraError,
+    runner::{ExecContext, run_program},
+};
+
+// Runs the program against a fresh in-memory database, printing each
+// query's rows as a table. Safe mode keeps sqlite3 away from the host: no
+// shell commands, no other database files and no extensions. Setup output
+// is switched off, and with -bail the first failing statement, in the setup
+// or the program, stops the run.
+pub async fn compile_sql(
+    content: &str,
+    _stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let mut cmd = ctx.command("sqlite3")?;
+    cmd.args(["-safe", "-bail", "-cmd", ".mode off"]);
+    if !ctx.setup().is_empty() {
+        cmd.arg("-cmd").arg(ctx.setup());
+    }
+    cmd.args(["-cmd", ".mode table"]);
+    // The program is sqlite3's stdin, so there is no room for any other.
+    let ctx = ctx.clone().without_streamed_stdin();
+    let output = run_program(&mut cmd, content, &ctx).await?;
+    match output.status.code() {
+        Some(0) => Ok(String::from_utf8(output.stdout)?),
+        Some(code) => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!(
+                    "SQL program execution failed with status code: {}\nError: {}",
+                    code, stderr
+                )
+                .into(),
+            ))
+        }
+        None => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!("SQL program terminated by signal\nError: {}", stderr).into(),
+            ))
+        }
+    }
+}
+
+#[cfg(test)]
+mod sql_tests {
+    use super::*;
+
+    const SETUP: &str = "CREATE TABLE users (id INTEGER, name TEXT);
+        INSERT INTO users VALUES (1, 'Ada'), (2, 'Grace');
+        SELECT 'setup output is not returned';";
+
+    #[tokio::test]
+    async fn test_queries_print_tables() {
+        let ctx = ExecContext::default().with_setup(SETUP.to_string());
+        let result = compile_sql("SELECT name FROM users ORDER BY id;", "", &ctx).await;
+        assert_eq!(
+            result.unwrap(),
+            "+-------+\n| name  |\n+-------+\n| Ada   |\n| Grace |\n+-------+\n"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_each_run_starts_with_an_empty_database() {
+        let ctx = ExecContext::default().with_setup(SETUP.to_string());
+        compile_sql("DELETE FROM users;", "", &ctx).await.unwrap();
+        let result = compile_sql("SELECT count(*) AS n FROM users;", "", &ctx).await;
+        assert!(result.unwrap().contains("| 2 |"));
+
+        let result = compile_sql("SELECT * FROM users;", "", &ExecContext::default()).await;
+        assert!(
+            result
+                .unwrap_err()
+                .to_string()
+                .contains("no such table: users")
+        );
+    }
+
+    #[tokio::test]
+    async fn test_failing_setup_stops_the_run() {
+        let ctx = ExecContext::default().with_setup(String::from("CREATE TABLE broken ("));
+        let result = compile_sql("SELECT 1;", "", &ctx).await;
+        assert!(result.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_safe_mode_blocks_shell_and_attach() {
+        let ctx = ExecContext::default();
+        let result = compile_sql(".shell echo escaped\n", "", &ctx).await;
+        assert!(result.unwrap_err().to_string().contains("safe mode"));
+
+        let result = compile_sql("ATTACH 'other.db' AS other;", "", &ctx).await;
+        assert!(result.unwrap_err().to_string().contains("safe mode"));
+    }
+}
@@ -0,0 +1,172 @@
+use std::process::Output;
+
+use super::{error::InfraError, runner::ExecContext, wasm::forward_output};
+
+// Runs the script in an interpreter embedded in the server, so nothing needs
+// to be installed. Starlark has no I/O, clock or randomness: a script can
+// only print, and prints the same thing every time. Stdin and the
+// command-line arguments are handed to it as the `stdin` string and the
+// `argv` list.
+pub async fn compile_starlark(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let output = execute(content, stdin_input, ctx).await?;
+    forward_output(&output, ctx);
+    let output = ctx.output_encoding().encode(output);
+    match output.status.code() {
+        Some(0) => Ok(String::from_utf8(output.stdout)?),
+        code => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!(
+                    "Starlark program execution failed with status code: {}\nError: {}",
+                    code.unwrap_or(1),
+                    stderr
+                )
+                .into(),
+            ))
+        }
+    }
+}
+
+// Starlark has no while loop and a bounded call stack, so every script
+// ends, but the interpreter cannot be stopped from outside: a script past
+// its timeout is answered as timed out and left to finish on its thread.
+#[cfg(feature = "starlark")]
+async fn execute(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<Output, InfraError> {
+    let (source, stdin) = (content.to_string(), stdin_input.to_string());
+    let args = ctx.args().to_vec();
+    let run = tokio::task::spawn_blocking(move || interpreter::run(&source, &stdin, args));
+    let finished = match ctx.timeout() {
+        Some(limit) => tokio::time::timeout(limit, run)
+            .await
+            .map_err(|_| InfraError::timeout(limit))?,
+        None => run.await,
+    };
+    finished.map_err(|err| InfraError::CompilationError(err.into()))
+}
+
+#[cfg(not(feature = "starlark"))]
+async fn execute(
+    _content: &str,
+    _stdin_input: &str,
+    _ctx: &ExecContext,
+) -> Result<Output, InfraError> {
+    Err(InfraError::UnsupportedLanguage(String::from(
+        "starlark requires building with the `starlark` feature",
+    )))
+}
+
+#[cfg(feature = "starlark")]
+mod interpreter {
+    use std::{
+        cell::RefCell,
+        os::unix::process::ExitStatusExt,
+        process::{ExitStatus, Output},
+    };
+
+    use starlark::{
+        PrintHandler,
+        environment::{Globals, LibraryExtension, Module},
+        eval::Evaluator,
+        syntax::{AstModule, Dialect},
+    };
+
+    // The builtins beyond the core language that reach nothing outside the
+    // script.
+    const EXTENSIONS: &[LibraryExtension] = &[
+        LibraryExtension::StructType,
+        LibraryExtension::Map,
+        LibraryExtension::Filter,
+        LibraryExtension::Partial,
+        LibraryExtension::Json,
+        LibraryExtension::Print,
+    ];
+
+    #[derive(Default)]
+    struct Stdout(RefCell<Vec<u8>>);
+
+    impl PrintHandler for Stdout {
+        fn println(&self, text: &str) -> starlark::Result<()> {
+            let mut out = self.0.borrow_mut();
+            out.extend_from_slice(text.as_bytes());
+            out.push(b'\n');
+            Ok(())
+        }
+    }
+
+    // Exits with 1 and the interpreter's message on stderr if the script
+    // does not parse or fails while running.
+    pub fn run(source: &str, stdin: &str, args: Vec<String>) -> Output {
+        let globals = Globals::extended_by(EXTENSIONS);
+        let module = Module::new();
+        let heap = module.heap();
+        module.set("stdin", heap.alloc(stdin));
+        module.set("argv", heap.alloc(args));
+
+        let stdout = Stdout::default();
+        let outcome = AstModule::parse("main.star", source.to_string(), &Dialect::Standard)
+            .and_then(|ast| {
+                let mut eval = Evaluator::new(&module);
+                eval.set_print_handler(&stdout);
+                eval.eval_module(ast, &globals).map(|_| ())
+            });
+        let (code, stderr) = match outcome {
+            Ok(()) => (0, Vec::new()),
+            Err(err) => (1, format!("{}\n", err).into_bytes()),
+        };
+        Output {
+            status: ExitStatus::from_raw(code << 8),
+            stdout: stdout.0.take(),
+            stderr,
+        }
+    }
+}
+
+#[cfg(test)]
+mod starlark_tests {
+    use crate::infra::runner::ExecContext;
+    use crate::infra::starlark::compile_starlark;
+
+    #[cfg(not(feature = "starlark"))]
+    #[tokio::test]
+    async fn test_starlark_needs_the_feature() {
+        let result = compile_starlark("print(1)", "", &ExecContext::default()).await;
+        assert!(result.is_err());
+    }
+
+    #[cfg(feature = "starlark")]
+    #[tokio::test]
+    async fn test_starlark_reads_stdin_and_argv() {
+        let script = r#"
+def shout(line):
+    return line.upper() + argv[0]
+
+for line in stdin.splitlines():
+    print(shout(line))
+"#;
+        let ctx = ExecContext::default().with_args(vec!["!".into()]);
+        let result = compile_starlark(script, "a\nb\n", &ctx).await.unwrap();
+        assert_eq!(result, "A!\nB!\n");
+    }
+
+    #[cfg(feature = "starlark")]
+    #[tokio::test]
+    async fn test_starlark_errors_name_the_failure() {
+        let err = compile_starlark("print(1 // 0)", "", &ExecContext::default())
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("status code: 1"), "{}", err);
+
+        let err = compile_starlark("while True:\n    pass\n", "", &ExecContext::default())
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("status code: 1"), "{}", err);
+    }
+}
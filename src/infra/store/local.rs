@@ -0,0 +1,285 @@
+use std::{
+    collections::HashMap,
+    fs::{self, File, OpenOptions},
+    io::{self, BufRead, BufReader, Write},
+    path::{Path, PathBuf},
+    sync::Mutex,
+};
+
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+
+use super::{Driver, now};
+
+#[derive(Debug, Serialize, Deserialize)]
+struct Record {
+    key: String,
+    value: Option<Value>,
+    expires_at: Option<u64>,
+}
+
+struct Entry {
+    value: Value,
+    expires_at: Option<u64>,
+}
+
+impl Entry {
+    fn is_live(&self, now: u64) -> bool {
+        self.expires_at.is_none_or(|at| at > now)
+    }
+}
+
+// The log is compacted on a sweep once it is past this size and twice the
+// size it had after the last compaction.
+const COMPACT_MIN_BYTES: u64 = 16 << 20;
+
+struct Log {
+    path: PathBuf,
+    file: File,
+    bytes: u64,
+    compacted_bytes: u64,
+    compact_min_bytes: u64,
+}
+
+// Keeps every entry in memory. When opened on a path, writes are also
+// appended to a JSON-lines log that is replayed and compacted on open, and
+// again by sweeps once it has grown. Appends are not synced one by one,
+// since cached results are written on the request path; a sweep syncs
+// them, so a crash of the machine, though not of the server, loses what
+// was written since.
+pub struct LocalDriver {
+    entries: Mutex<HashMap<String, Entry>>,
+    log: Option<Mutex<Log>>,
+}
+
+impl LocalDriver {
+    pub fn memory() -> Self {
+        LocalDriver {
+            entries: Mutex::new(HashMap::new()),
+            log: None,
+        }
+    }
+
+    pub fn open(path: &Path) -> io::Result<Self> {
+        let mut entries = HashMap::new();
+        if path.exists() {
+            for line in BufReader::new(File::open(path)?).lines() {
+                let Ok(record) = serde_json::from_str::<Record>(&line?) else {
+                    continue;
+                };
+                match record.value {
+                    Some(value) => {
+                        entries.insert(
+                            record.key,
+                            Entry {
+                                value,
+                                expires_at: record.expires_at,
+                            },
+                        );
+                    }
+                    None => {
+                        entries.remove(&record.key);
+                    }
+                }
+            }
+        }
+
+        let now = now();
+        entries.retain(|_, entry: &mut Entry| entry.is_live(now));
+        let bytes = compact(path, &entries)?;
+
+        let file = OpenOptions::new().append(true).create(true).open(path)?;
+        Ok(LocalDriver {
+            entries: Mutex::new(entries),
+            log: Some(Mutex::new(Log {
+                path: path.to_path_buf(),
+                file,
+                bytes,
+                compacted_bytes: bytes,
+                compact_min_bytes: COMPACT_MIN_BYTES,
+            })),
+        })
+    }
+
+    fn append(&self, key: &str, value: Option<&Value>, expires_at: Option<u64>) -> io::Result<()> {
+        let Some(log) = &self.log else {
+            return Ok(());
+        };
+        let record = Record {
+            key: key.to_string(),
+            value: value.cloned(),
+            expires_at,
+        };
+        let mut line = serde_json::to_vec(&record)?;
+        line.push(b'\n');
+        let mut log = log.lock().unwrap();
+        log.file.write_all(&line)?;
+        log.bytes += line.len() as u64;
+        Ok(())
+    }
+}
+
+impl Driver for LocalDriver {
+    fn get(&self, key: &str, now: u64) -> io::Result<Option<Value>> {
+        let entries = self.entries.lock().unwrap();
+        Ok(entries
+            .get(key)
+            .filter(|entry| entry.is_live(now))
+            .map(|entry| entry.value.clone()))
+    }
+
+    fn put(&self, key: &str, value: &Value, expires_at: Option<u64>) -> io::Result<()> {
+        let mut entries = self.entries.lock().unwrap();
+        self.append(key, Some(value), expires_at)?;
+        entries.insert(
+            key.to_string(),
+            Entry {
+                value: value.clone(),
+                expires_at,
+            },
+        );
+        Ok(())
+    }
+
+    fn put_if_absent(
+        &self,
+        key: &str,
+        value: &Value,
+        expires_at: Option<u64>,
+        now: u64,
+    ) -> io::Result<Option<Value>> {
+        let mut entries = self.entries.lock().unwrap();
+        if let Some(entry) = entries.get(key).filter(|entry| entry.is_live(now)) {
+            return Ok(Some(entry.value.clone()));
+        }
+        self.append(key, Some(value), expires_at)?;
+        entries.insert(
+            key.to_string(),
+            Entry {
+                value: value.clone(),
+                expires_at,
+            },
+        );
+        Ok(None)
+    }
+
+    fn remove(&self, key: &str) -> io::Result<()> {
+        let mut entries = self.entries.lock().unwrap();
+        if entries.remove(key).is_some() {
+            self.append(key, None, None)?;
+        }
+        Ok(())
+    }
+
+    fn keys(&self, prefix: &str, now: u64) -> io::Result<Vec<String>> {
+        let entries = self.entries.lock().unwrap();
+        Ok(entries
+            .iter()
+            .filter(|(key, entry)| key.starts_with(prefix) && entry.is_live(now))
+            .map(|(key, _)| key.clone())
+            .collect())
+    }
+
+    fn sweep(&self, now: u64) -> io::Result<()> {
+        let mut entries = self.entries.lock().unwrap();
+        entries.retain(|_, entry| entry.is_live(now));
+        let Some(log) = &self.log else {
+            return Ok(());
+        };
+        let mut log = log.lock().unwrap();
+        if log.bytes <= log.compact_min_bytes.max(2 * log.compacted_bytes) {
+            return log.file.sync_data();
+        }
+        let bytes = compact(&log.path, &entries)?;
+        log.file = OpenOptions::new().append(true).open(&log.path)?;
+        log.bytes = bytes;
+        log.compacted_bytes = bytes;
+        Ok(())
+    }
+}
+
+// Rewrites the log at `path` to hold just `entries`, returning its size.
+fn compact(path: &Path, entries: &HashMap<String, Entry>) -> io::Result<u64> {
+    let mut tmp = PathBuf::from(path);
+    tmp.set_extension("compact");
+    let mut file = File::create(&tmp)?;
+    for (key, entry) in entries {
+        let record = Record {
+            key: key.clone(),
+            value: Some(entry.value.clone()),
+            expires_at: entry.expires_at,
+        };
+        serde_json::to_writer(&mut file, &record)?;
+        file.write_all(b"\n")?;
+    }
+    file.sync_all()?;
+    let bytes = file.metadata()?.len();
+    fs::rename(tmp, path)?;
+    Ok(bytes)
+}
+
+#[cfg(test)]
+mod local_tests {
+    use std::time::Duration;
+
+    use super::*;
+    use crate::infra::store::Store;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_embedded_store_persists_across_reopen() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("comphub.db");
+
+        let store = Store::open(&path).unwrap();
+        store.put("kept", &"value", None).unwrap();
+        store.put("removed", &1, None).unwrap();
+        store.remove("removed").unwrap();
+        drop(store);
+
+        let store = Store::open(&path).unwrap();
+        assert_eq!(store.get::<String>("kept").as_deref(), Some("value"));
+        assert_eq!(store.get::<i32>("removed"), None);
+    }
+
+    #[test]
+    fn test_expired_entries_are_hidden_and_compacted() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("comphub.db");
+
+        let store = Store::open(&path).unwrap();
+        store.put("expired", &1, Some(Duration::ZERO)).unwrap();
+        assert_eq!(store.get::<i32>("expired"), None);
+        drop(store);
+
+        Store::open(&path).unwrap();
+        assert_eq!(fs::read_to_string(&path).unwrap(), "");
+    }
+
+    #[test]
+    fn test_sweep_evicts_expired_entries_and_compacts_a_grown_log() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("comphub.db");
+
+        let driver = LocalDriver::open(&path).unwrap();
+        let log = driver.log.as_ref().unwrap();
+        log.lock().unwrap().compact_min_bytes = 0;
+        let now = now();
+        driver.put("expired", &Value::from(1), Some(now)).unwrap();
+        for value in 0..10 {
+            driver.put("kept", &Value::from(value), None).unwrap();
+        }
+        driver.sweep(now).unwrap();
+
+        assert!(!driver.entries.lock().unwrap().contains_key("expired"));
+        assert_eq!(
+            fs::read_to_string(&path).unwrap(),
+            "{\"key\":\"kept\",\"value\":9,\"expires_at\":null}\n"
+        );
+        driver.put("after", &Value::from(2), None).unwrap();
+        drop(driver);
+        let store = Store::open(&path).unwrap();
+        assert_eq!(store.get::<i32>("kept"), Some(9));
+        assert_eq!(store.get::<i32>("after"), Some(2));
+    }
+}
@@ -0,0 +1,258 @@
+use std::{
+    io,
+    path::Path,
+    str::FromStr,
+    time::{Duration, SystemTime, UNIX_EPOCH},
+};
+
+use serde::{Serialize, de::DeserializeOwned};
+use serde_json::Value;
+use tokio::sync::OnceCell;
+
+use super::history::HistoryDriver;
+use crate::config::config;
+
+mod local;
+#[cfg(feature = "postgres")]
+mod postgres;
+#[cfg(feature = "sqlite")]
+mod sqlite;
+
+pub use local::LocalDriver;
+#[cfg(feature = "postgres")]
+pub use postgres::PostgresDriver;
+#[cfg(feature = "sqlite")]
+pub use sqlite::SqliteDriver;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum StoreBackend {
+    Memory,
+    Embedded,
+    #[cfg(feature = "sqlite")]
+    Sqlite,
+    #[cfg(feature = "postgres")]
+    Postgres,
+}
+
+impl FromStr for StoreBackend {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_lowercase().as_str() {
+            "memory" => Ok(StoreBackend::Memory),
+            "embedded" => Ok(StoreBackend::Embedded),
+            #[cfg(feature = "sqlite")]
+            "sqlite" => Ok(StoreBackend::Sqlite),
+            #[cfg(feature = "postgres")]
+            "postgres" => Ok(StoreBackend::Postgres),
+            other if ["sqlite", "postgres"].contains(&other) => Err(format!(
+                "store backend {} requires building with the `{}` feature",
+                other, other
+            )),
+            other => Err(format!("unknown store backend: {}", other)),
+        }
+    }
+}
+
+// Persistence for jobs, idempotency keys and cached results. Keys are
+// namespaced by their owner (`job:`, `unfinished:`, `idempotency:`, `replay:`,
+// `rerun:`, `result:`, `session:`, `group:`, `submission:`, plus the
+// `problem:` lists) and values are JSON documents.
+// Expiry times are unix seconds; drivers must treat an entry whose expiry is
+// at or before `now` as absent.
+pub trait Driver: Send + Sync {
+    fn get(&self, key: &str, now: u64) -> io::Result<Option<Value>>;
+
+    fn put(&self, key: &str, value: &Value, expires_at: Option<u64>) -> io::Result<()>;
+
+    // Stores `value` unless a live entry already exists, returning the
+    // existing value in that case.
+    fn put_if_absent(
+        &self,
+        key: &str,
+        value: &Value,
+        expires_at: Option<u64>,
+        now: u64,
+    ) -> io::Result<Option<Value>>;
+
+    fn remove(&self, key: &str) -> io::Result<()>;
+
+    // The live keys starting with `prefix`, in no particular order.
+    fn keys(&self, prefix: &str, now: u64) -> io::Result<Vec<String>>;
+
+    // Drops the entries expired by `now` and reclaims the space they took.
+    // Called periodically, so that keys nobody reads again do not pile up.
+    fn sweep(&self, now: u64) -> io::Result<()>;
+
+    // The run history kept alongside the store, for drivers backed by a
+    // database that can be queried.
+    fn history(&self) -> Option<&dyn HistoryDriver> {
+        None
+    }
+}
+
+pub struct Store {
+    driver: Box<dyn Driver>,
+}
+
+static STORE: OnceCell<Store> = OnceCell::const_new();
+
+async fn init_store() -> Store {
+    let app_config = config().await;
+    match app_config.store_backend() {
+        StoreBackend::Memory => Store::memory(),
+        StoreBackend::Embedded => {
+            let path = app_config.store_path();
+            tracing::info!("opening embedded store at {}", path.display());
+            Store::open(path).unwrap()
+        }
+        #[cfg(feature = "sqlite")]
+        StoreBackend::Sqlite => {
+            let path = app_config.store_path();
+            tracing::info!("opening sqlite store at {}", path.display());
+            Store::new(SqliteDriver::open(path).unwrap())
+        }
+        #[cfg(feature = "postgres")]
+        StoreBackend::Postgres => {
+            tracing::info!("connecting to postgres store");
+            Store::new(
+                PostgresDriver::connect(app_config.store_url())
+                    .await
+                    .unwrap(),
+            )
+        }
+    }
+}
+
+pub async fn store() -> &'static Store {
+    STORE.get_or_init(init_store).await
+}
+
+// Sweeps the store every `interval`.
+pub async fn sweep_store(interval: Duration) {
+    let store = store().await;
+    let mut ticker = tokio::time::interval(interval);
+    loop {
+        ticker.tick().await;
+        match tokio::task::spawn_blocking(move || store.sweep()).await {
+            Ok(Ok(())) => {}
+            Ok(Err(err)) => tracing::warn!("store sweep failed: {}", err),
+            Err(err) => tracing::warn!("store sweep task panicked: {}", err),
+        }
+    }
+}
+
+fn now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+fn expiry(ttl: Option<Duration>) -> Option<u64> {
+    ttl.map(|ttl| now() + ttl.as_secs())
+}
+
+impl Store {
+    pub fn new<D: Driver + 'static>(driver: D) -> Self {
+        Store {
+            driver: Box::new(driver),
+        }
+    }
+
+    pub fn memory() -> Self {
+        Store::new(LocalDriver::memory())
+    }
+
+    pub fn open(path: &Path) -> io::Result<Self> {
+        Ok(Store::new(LocalDriver::open(path)?))
+    }
+
+    pub fn get<T: DeserializeOwned>(&self, key: &str) -> Option<T> {
+        match self.driver.get(key, now()) {
+            Ok(value) => value.and_then(|value| serde_json::from_value(value).ok()),
+            Err(err) => {
+                tracing::warn!("failed to read {} from store: {}", key, err);
+                None
+            }
+        }
+    }
+
+    pub fn put<T: Serialize>(&self, key: &str, value: &T, ttl: Option<Duration>) -> io::Result<()> {
+        let value = serde_json::to_value(value)?;
+        self.driver.put(key, &value, expiry(ttl))
+    }
+
+    pub fn put_if_absent<T: Serialize + DeserializeOwned>(
+        &self,
+        key: &str,
+        value: &T,
+        ttl: Option<Duration>,
+    ) -> io::Result<Option<T>> {
+        let value = serde_json::to_value(value)?;
+        let existing = self.driver.put_if_absent(key, &value, expiry(ttl), now())?;
+        Ok(existing.and_then(|value| serde_json::from_value(value).ok()))
+    }
+
+    pub fn remove(&self, key: &str) -> io::Result<()> {
+        self.driver.remove(key)
+    }
+
+    pub fn sweep(&self) -> io::Result<()> {
+        self.driver.sweep(now())
+    }
+
+    pub fn keys(&self, prefix: &str) -> Vec<String> {
+        match self.driver.keys(prefix, now()) {
+            Ok(keys) => keys,
+            Err(err) => {
+                tracing::warn!("failed to list {}* in store: {}", prefix, err);
+                Vec::new()
+            }
+        }
+    }
+
+    pub fn history(&self) -> Option<&dyn HistoryDriver> {
+        self.driver.history()
+    }
+}
+
+#[cfg(test)]
+mod store_tests {
+    use super::*;
+
+    #[test]
+    fn test_put_if_absent_returns_existing_value() {
+        let store = Store::memory();
+        let first = String::from("first");
+        let second = String::from("second");
+        assert_eq!(store.put_if_absent("key", &first, None).unwrap(), None);
+        assert_eq!(
+            store.put_if_absent("key", &second, None).unwrap(),
+            Some(first)
+        );
+    }
+
+    #[test]
+    fn test_put_if_absent_replaces_expired_value() {
+        let store = Store::memory();
+        store.put("key", &1, Some(Duration::ZERO)).unwrap();
+        assert_eq!(store.put_if_absent("key", &2, None).unwrap(), None);
+        assert_eq!(store.get::<i32>("key"), Some(2));
+    }
+
+    #[test]
+    fn test_keys_lists_live_keys_under_a_prefix() {
+        let store = Store::memory();
+        store.put("job:1", &1, None).unwrap();
+        store.put("job:2", &2, Some(Duration::ZERO)).unwrap();
+        store.put("jobs", &3, None).unwrap();
+        assert_eq!(store.keys("job:"), vec![String::from("job:1")]);
+    }
+
+    #[test]
+    fn test_unknown_backend_is_rejected() {
+        assert_eq!("Memory".parse::<StoreBackend>(), Ok(StoreBackend::Memory));
+        assert!("mongodb".parse::<StoreBackend>().is_err());
+    }
+}
@@ -0,0 +1,193 @@
+use std::{future::Future, io};
+
+use serde_json::Value;
+use tokio::runtime::Handle;
+use tokio_postgres::{Client, NoTls};
+
+use super::{Driver, now};
+use crate::infra::history::{HistoryDriver, HistoryQuery, RunRecord};
+
+const SCHEMA: &str = "CREATE TABLE IF NOT EXISTS store (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL,
+    expires_at BIGINT
+);
+CREATE TABLE IF NOT EXISTS runs (
+    id TEXT NOT NULL,
+    lang TEXT NOT NULL,
+    status TEXT NOT NULL,
+    started_at BIGINT NOT NULL,
+    record TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS runs_started_at ON runs (started_at)";
+
+pub struct PostgresDriver {
+    client: Client,
+}
+
+fn sql_err(err: tokio_postgres::Error) -> io::Error {
+    io::Error::other(err)
+}
+
+// The store API is synchronous, so queries are driven to completion on the
+// calling worker thread. This requires the multi-threaded runtime.
+fn block_on<F: Future>(future: F) -> F::Output {
+    tokio::task::block_in_place(|| Handle::current().block_on(future))
+}
+
+impl PostgresDriver {
+    pub async fn connect(url: &str) -> io::Result<Self> {
+        let (client, connection) = tokio_postgres::connect(url, NoTls).await.map_err(sql_err)?;
+        tokio::spawn(async move {
+            if let Err(err) = connection.await {
+                tracing::error!("postgres store connection closed: {}", err);
+            }
+        });
+
+        client.batch_execute(SCHEMA).await.map_err(sql_err)?;
+        client
+            .execute(
+                "DELETE FROM store WHERE expires_at <= $1",
+                &[&(now() as i64)],
+            )
+            .await
+            .map_err(sql_err)?;
+        Ok(PostgresDriver { client })
+    }
+
+    async fn select(&self, key: &str, now: u64) -> io::Result<Option<Value>> {
+        let row = self
+            .client
+            .query_opt(
+                "SELECT value FROM store
+                 WHERE key = $1 AND (expires_at IS NULL OR expires_at > $2)",
+                &[&key, &(now as i64)],
+            )
+            .await
+            .map_err(sql_err)?;
+        row.map(|row| serde_json::from_str(row.get::<_, &str>(0)).map_err(io::Error::from))
+            .transpose()
+    }
+}
+
+impl Driver for PostgresDriver {
+    fn get(&self, key: &str, now: u64) -> io::Result<Option<Value>> {
+        block_on(self.select(key, now))
+    }
+
+    fn put(&self, key: &str, value: &Value, expires_at: Option<u64>) -> io::Result<()> {
+        block_on(self.client.execute(
+            "INSERT INTO store (key, value, expires_at) VALUES ($1, $2, $3)
+             ON CONFLICT (key) DO UPDATE
+             SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at",
+            &[&key, &value.to_string(), &expires_at.map(|at| at as i64)],
+        ))
+        .map_err(sql_err)?;
+        Ok(())
+    }
+
+    fn put_if_absent(
+        &self,
+        key: &str,
+        value: &Value,
+        expires_at: Option<u64>,
+        now: u64,
+    ) -> io::Result<Option<Value>> {
+        block_on(async {
+            let written = self
+                .client
+                .execute(
+                    "INSERT INTO store (key, value, expires_at) VALUES ($1, $2, $3)
+                     ON CONFLICT (key) DO UPDATE
+                     SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at
+                     WHERE store.expires_at IS NOT NULL AND store.expires_at <= $4",
+                    &[
+                        &key,
+                        &value.to_string(),
+                        &expires_at.map(|at| at as i64),
+                        &(now as i64),
+                    ],
+                )
+                .await
+                .map_err(sql_err)?;
+            if written > 0 {
+                return Ok(None);
+            }
+            self.select(key, now).await
+        })
+    }
+
+    fn remove(&self, key: &str) -> io::Result<()> {
+        block_on(
+            self.client
+                .execute("DELETE FROM store WHERE key = $1", &[&key]),
+        )
+        .map_err(sql_err)?;
+        Ok(())
+    }
+
+    fn keys(&self, prefix: &str, now: u64) -> io::Result<Vec<String>> {
+        let rows = block_on(self.client.query(
+            "SELECT key FROM store
+             WHERE starts_with(key, $1) AND (expires_at IS NULL OR expires_at > $2)",
+            &[&prefix, &(now as i64)],
+        ))
+        .map_err(sql_err)?;
+        Ok(rows.iter().map(|row| row.get::<_, String>(0)).collect())
+    }
+
+    fn sweep(&self, now: u64) -> io::Result<()> {
+        block_on(
+            self.client
+                .execute("DELETE FROM store WHERE expires_at <= $1", &[&(now as i64)]),
+        )
+        .map_err(sql_err)?;
+        Ok(())
+    }
+
+    fn history(&self) -> Option<&dyn HistoryDriver> {
+        Some(self)
+    }
+}
+
+impl HistoryDriver for PostgresDriver {
+    fn insert(&self, run: &RunRecord) -> io::Result<()> {
+        let record = serde_json::to_string(run)?;
+        block_on(self.client.execute(
+            "INSERT INTO runs (id, lang, status, started_at, record)
+             VALUES ($1, $2, $3, $4, $5)",
+            &[
+                &run.id,
+                &run.lang,
+                &run.status.as_str(),
+                &run.started_at.timestamp_millis(),
+                &record,
+            ],
+        ))
+        .map_err(sql_err)?;
+        Ok(())
+    }
+
+    fn search(&self, query: &HistoryQuery) -> io::Result<Vec<RunRecord>> {
+        let rows = block_on(self.client.query(
+            "SELECT record FROM runs
+             WHERE ($1::TEXT IS NULL OR lang = $1)
+               AND ($2::TEXT IS NULL OR status = $2)
+               AND ($3::BIGINT IS NULL OR started_at >= $3)
+               AND ($4::BIGINT IS NULL OR started_at < $4)
+             ORDER BY started_at DESC
+             LIMIT $5",
+            &[
+                &query.language(),
+                &query.status.map(|status| status.as_str()),
+                &query.since.map(|since| since.timestamp_millis()),
+                &query.until.map(|until| until.timestamp_millis()),
+                &(query.limit() as i64),
+            ],
+        ))
+        .map_err(sql_err)?;
+        rows.iter()
+            .map(|row| serde_json::from_str(row.get::<_, &str>(0)).map_err(io::Error::from))
+            .collect()
+    }
+}
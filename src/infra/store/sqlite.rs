@@ -0,0 +1,277 @@
+use std::{io, path::Path, sync::Mutex};
+
+use rusqlite::{Connection, OptionalExtension, params};
+use serde_json::Value;
+
+use super::{Driver, now};
+use crate::infra::history::{HistoryDriver, HistoryQuery, RunRecord};
+
+const SCHEMA: &str = "CREATE TABLE IF NOT EXISTS store (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL,
+    expires_at INTEGER
+);
+CREATE TABLE IF NOT EXISTS runs (
+    id TEXT NOT NULL,
+    lang TEXT NOT NULL,
+    status TEXT NOT NULL,
+    started_at INTEGER NOT NULL,
+    record TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS runs_started_at ON runs (started_at)";
+
+pub struct SqliteDriver {
+    conn: Mutex<Connection>,
+}
+
+fn sql_err(err: rusqlite::Error) -> io::Error {
+    io::Error::other(err)
+}
+
+fn decode(text: Option<String>) -> io::Result<Option<Value>> {
+    text.map(|text| serde_json::from_str(&text).map_err(io::Error::from))
+        .transpose()
+}
+
+impl SqliteDriver {
+    pub fn open(path: &Path) -> io::Result<Self> {
+        let conn = Connection::open(path).map_err(sql_err)?;
+        conn.execute_batch(SCHEMA).map_err(sql_err)?;
+        conn.execute(
+            "DELETE FROM store WHERE expires_at <= ?1",
+            params![now() as i64],
+        )
+        .map_err(sql_err)?;
+        Ok(SqliteDriver {
+            conn: Mutex::new(conn),
+        })
+    }
+
+    fn select(conn: &Connection, key: &str, now: u64) -> io::Result<Option<Value>> {
+        let text = conn
+            .query_row(
+                "SELECT value FROM store
+                 WHERE key = ?1 AND (expires_at IS NULL OR expires_at > ?2)",
+                params![key, now as i64],
+                |row| row.get::<_, String>(0),
+            )
+            .optional()
+            .map_err(sql_err)?;
+        decode(text)
+    }
+}
+
+impl Driver for SqliteDriver {
+    fn get(&self, key: &str, now: u64) -> io::Result<Option<Value>> {
+        SqliteDriver::select(&self.conn.lock().unwrap(), key, now)
+    }
+
+    fn put(&self, key: &str, value: &Value, expires_at: Option<u64>) -> io::Result<()> {
+        self.conn
+            .lock()
+            .unwrap()
+            .execute(
+                "INSERT INTO store (key, value, expires_at) VALUES (?1, ?2, ?3)
+                 ON CONFLICT (key) DO UPDATE
+                 SET value = excluded.value, expires_at = excluded.expires_at",
+                params![key, value.to_string(), expires_at.map(|at| at as i64)],
+            )
+            .map_err(sql_err)?;
+        Ok(())
+    }
+
+    fn put_if_absent(
+        &self,
+        key: &str,
+        value: &Value,
+        expires_at: Option<u64>,
+        now: u64,
+    ) -> io::Result<Option<Value>> {
+        let conn = self.conn.lock().unwrap();
+        let written = conn
+            .execute(
+                "INSERT INTO store (key, value, expires_at) VALUES (?1, ?2, ?3)
+                 ON CONFLICT (key) DO UPDATE
+                 SET value = excluded.value, expires_at = excluded.expires_at
+                 WHERE store.expires_at IS NOT NULL AND store.expires_at <= ?4",
+                params![
+                    key,
+                    value.to_string(),
+                    expires_at.map(|at| at as i64),
+                    now as i64
+                ],
+            )
+            .map_err(sql_err)?;
+        if written > 0 {
+            return Ok(None);
+        }
+        SqliteDriver::select(&conn, key, now)
+    }
+
+    fn remove(&self, key: &str) -> io::Result<()> {
+        self.conn
+            .lock()
+            .unwrap()
+            .execute("DELETE FROM store WHERE key = ?1", params![key])
+            .map_err(sql_err)?;
+        Ok(())
+    }
+
+    fn keys(&self, prefix: &str, now: u64) -> io::Result<Vec<String>> {
+        let conn = self.conn.lock().unwrap();
+        let mut statement = conn
+            .prepare(
+                "SELECT key FROM store
+                 WHERE substr(key, 1, length(?1)) = ?1
+                 AND (expires_at IS NULL OR expires_at > ?2)",
+            )
+            .map_err(sql_err)?;
+        let keys: Vec<String> = statement
+            .query_map(params![prefix, now as i64], |row| row.get::<_, String>(0))
+            .map_err(sql_err)?
+            .collect::<Result<_, _>>()
+            .map_err(sql_err)?;
+        Ok(keys)
+    }
+
+    fn sweep(&self, now: u64) -> io::Result<()> {
+        self.conn
+            .lock()
+            .unwrap()
+            .execute(
+                "DELETE FROM store WHERE expires_at <= ?1",
+                params![now as i64],
+            )
+            .map_err(sql_err)?;
+        Ok(())
+    }
+
+    fn history(&self) -> Option<&dyn HistoryDriver> {
+        Some(self)
+    }
+}
+
+impl HistoryDriver for SqliteDriver {
+    fn insert(&self, run: &RunRecord) -> io::Result<()> {
+        let record = serde_json::to_string(run)?;
+        self.conn
+            .lock()
+            .unwrap()
+            .execute(
+                "INSERT INTO runs (id, lang, status, started_at, record)
+                 VALUES (?1, ?2, ?3, ?4, ?5)",
+                params![
+                    run.id,
+                    run.lang,
+                    run.status.as_str(),
+                    run.started_at.timestamp_millis(),
+                    record
+                ],
+            )
+            .map_err(sql_err)?;
+        Ok(())
+    }
+
+    fn search(&self, query: &HistoryQuery) -> io::Result<Vec<RunRecord>> {
+        let conn = self.conn.lock().unwrap();
+        let mut statement = conn
+            .prepare(
+                "SELECT record FROM runs
+                 WHERE (?1 IS NULL OR lang = ?1)
+                   AND (?2 IS NULL OR status = ?2)
+                   AND (?3 IS NULL OR started_at >= ?3)
+                   AND (?4 IS NULL OR started_at < ?4)
+                 ORDER BY started_at DESC
+                 LIMIT ?5",
+            )
+            .map_err(sql_err)?;
+        let rows = statement
+            .query_map(
+                params![
+                    query.language(),
+                    query.status.map(|status| status.as_str()),
+                    query.since.map(|since| since.timestamp_millis()),
+                    query.until.map(|until| until.timestamp_millis()),
+                    query.limit() as i64
+                ],
+                |row| row.get::<_, String>(0),
+            )
+            .map_err(sql_err)?;
+        rows.map(|text| serde_json::from_str(&text.map_err(sql_err)?).map_err(io::Error::from))
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod sqlite_tests {
+    use std::time::Duration;
+
+    use super::*;
+    use crate::infra::{error::InfraError, logs::RunStatus, store::Store};
+    use chrono::Utc;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_sqlite_store_persists_across_reopen() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("comphub.sqlite");
+
+        let store = Store::new(SqliteDriver::open(&path).unwrap());
+        store.put("kept", &"value", None).unwrap();
+        store.put("expired", &1, Some(Duration::ZERO)).unwrap();
+        assert_eq!(store.get::<i32>("expired"), None);
+        drop(store);
+
+        let store = Store::new(SqliteDriver::open(&path).unwrap());
+        assert_eq!(store.get::<String>("kept").as_deref(), Some("value"));
+        assert_eq!(
+            store
+                .put_if_absent("kept", &String::from("other"), None)
+                .unwrap(),
+            Some(String::from("value"))
+        );
+        assert_eq!(store.put_if_absent("expired", &2, None).unwrap(), None);
+    }
+
+    #[test]
+    fn test_sqlite_history_filters_runs_newest_first() {
+        let dir = TempDir::new().unwrap();
+        let driver = SqliteDriver::open(&dir.path().join("comphub.sqlite")).unwrap();
+        let history = driver.history().unwrap();
+        let start = Utc::now();
+        for (i, (id, lang, succeeded)) in [
+            ("a", "python", true),
+            ("b", "python", false),
+            ("c", "rust", false),
+        ]
+        .into_iter()
+        .enumerate()
+        {
+            let result = match succeeded {
+                true => Ok(String::new()),
+                false => Err(InfraError::CompilationError("boom".into())),
+            };
+            let started_at = start + chrono::Duration::minutes(i as i64);
+            let run = RunRecord::new(id, lang, "", started_at, &result, 1024);
+            history.insert(&run).unwrap();
+        }
+
+        let ids = |query: HistoryQuery| -> Vec<String> {
+            let runs = history.search(&query).unwrap();
+            runs.into_iter().map(|run| run.id).collect()
+        };
+        assert_eq!(ids(HistoryQuery::default()), ["c", "b", "a"]);
+        let failed_python = HistoryQuery {
+            language: Some("Python".into()),
+            status: Some(RunStatus::Failed),
+            ..Default::default()
+        };
+        assert_eq!(ids(failed_python), ["b"]);
+        let recent = HistoryQuery {
+            since: Some(start + chrono::Duration::minutes(1)),
+            limit: Some(1),
+            ..Default::default()
+        };
+        assert_eq!(ids(recent), ["c"]);
+    }
+}
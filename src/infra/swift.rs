@@ -0,0 +1,154 @@
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+};
+use tokio::process::Command;
+
+pub async fn compile_swift(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::SWIFT, content)?;
+    let source_path = source.path().to_path_buf();
+    let executable_path = source.dir().join("main");
+
+    // swiftc caches compiled modules under the home directory by default,
+    // which the sandbox user may not be able to write to.
+    let compile_output = ctx
+        .command("swiftc")?
+        .arg("-module-cache-path")
+        .arg(source.dir().join("module-cache"))
+        .arg("-o")
+        .arg(&executable_path)
+        .arg(&source_path)
+        .args(ctx.compiler_flags())
+        .kill_on_drop(true)
+        .output()
+        .await?;
+
+    if !compile_output.status.success() {
+        let stderr = String::from_utf8_lossy(&compile_output.stderr);
+        return Err(InfraError::CompilationError(
+            format!("Swift compilation failed:\n{}", stderr).into(),
+        ));
+    }
+    ctx.record_warnings(&compile_output.stderr);
+
+    let mut cmd = Command::new(&executable_path);
+    let output = run_program(&mut cmd, stdin_input, ctx).await?;
+    match output.status.code() {
+        Some(0) => Ok(String::from_utf8(output.stdout)?),
+        Some(code) => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!(
+                    "Swift program execution failed with status code: {}\nError: {}",
+                    code, stderr
+                )
+                .into(),
+            ))
+        }
+        None => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!("Swift program terminated by signal\nError: {}", stderr).into(),
+            ))
+        }
+    }
+}
+
+#[cfg(test)]
+mod swift_tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_simple_hello_world() {
+        let swift_code = r#"
+print("Hello, World!")
+"#;
+
+        let result = compile_swift(swift_code, "", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "Hello, World!");
+    }
+
+    #[tokio::test]
+    async fn test_stdin_input() {
+        let swift_code = r#"
+let num = Int(readLine()!)!
+print("You entered: \(num)")
+"#;
+
+        let result = compile_swift(swift_code, "42\n", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "You entered: 42");
+    }
+
+    #[tokio::test]
+    async fn test_complex_stdin_processing() {
+        let swift_code = r#"
+let numbers = readLine()!.split(separator: " ").map { Int($0)! }
+print("Sum: \(numbers[0] + numbers[1])")
+print("Product: \(numbers[0] * numbers[1])")
+"#;
+
+        let result = compile_swift(swift_code, "7 3\n", &ExecContext::default()).await;
+        assert!(result.is_ok());
+        let output = result.unwrap();
+        assert!(output.contains("Sum: 10"));
+        assert!(output.contains("Product: 21"));
+    }
+
+    #[tokio::test]
+    async fn test_program_args() {
+        let swift_code = r#"
+print(CommandLine.arguments.dropFirst().joined(separator: ","))
+"#;
+
+        let ctx = ExecContext::default().with_args(vec![String::from("a"), String::from("b c")]);
+        let result = compile_swift(swift_code, "", &ctx).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "a,b c");
+    }
+
+    #[tokio::test]
+    async fn test_optimized_build() {
+        let swift_code = r#"
+print((1...10).reduce(0, +))
+"#;
+
+        let ctx = ExecContext::default().with_compiler_flags(vec![String::from("-O")]);
+        let result = compile_swift(swift_code, "", &ctx).await;
+        assert!(result.is_ok());
+        assert_eq!(result.unwrap().trim(), "55");
+    }
+
+    #[tokio::test]
+    async fn test_compilation_error() {
+        let swift_code = r#"
+let x: Int = "not a number"
+"#;
+
+        let err = compile_swift(swift_code, "", &ExecContext::default())
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("Swift compilation failed"));
+        assert!(err.to_string().contains("main.swift"));
+    }
+
+    #[tokio::test]
+    async fn test_runtime_error() {
+        let swift_code = r#"
+import Foundation
+exit(3)
+"#;
+
+        let err = compile_swift(swift_code, "", &ExecContext::default())
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("status code: 3"));
+    }
+}
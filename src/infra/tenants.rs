@@ -0,0 +1,356 @@
+use std::{
+    collections::BTreeMap,
+    fs::OpenOptions,
+    io::{self, Write},
+    path::{Path, PathBuf},
+    sync::Mutex,
+    time::Duration,
+};
+
+use chrono::{DateTime, Utc};
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+use utoipa::ToSchema;
+
+use super::{scheduler::ANONYMOUS_TENANT, tier::Tiers};
+
+// A tenant is everyone calling with the same API key, known by the key's
+// hash; callers without a key share the anonymous tenant. Each tenant has
+// its own run slots and usage counters, so one cannot use up another's.
+pub fn tenant_id(api_key: Option<&str>) -> String {
+    match api_key {
+        Some(key) => format!("{:x}", Sha256::digest(key.as_bytes())),
+        None => ANONYMOUS_TENANT.to_string(),
+    }
+}
+
+// Whose share of the job queue a submission counts against. Only keys the
+// tier policy knows get a share of their own; other callers are queued by
+// their address, so that sending made-up keys does not buy extra turns.
+pub fn queue_tenant(tiers: &Tiers, api_key: Option<&str>, client_ip: &str) -> String {
+    match api_key.filter(|key| tiers.knows(key)) {
+        Some(key) => tenant_id(Some(key)),
+        None => format!("{}@{}", ANONYMOUS_TENANT, client_ip),
+    }
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, ToSchema)]
+pub struct TenantUsage {
+    #[schema(example = "anonymous")]
+    pub tenant: String,
+    // Runs in progress right now.
+    #[schema(example = 1)]
+    pub running: usize,
+    // Requests made since the server started, including those refused.
+    #[schema(example = 57)]
+    pub requests: u64,
+    // Runs finished since the server started, and how long they took.
+    #[schema(example = 42)]
+    pub runs: u64,
+    #[schema(example = 3)]
+    pub failed_runs: u64,
+    #[schema(example = 12500)]
+    pub run_time_ms: u64,
+    // Resident memory of the programs run, integrated over their run time.
+    // Languages executed in-process add nothing.
+    #[schema(example = 310.5)]
+    pub memory_mib_seconds: f64,
+}
+
+impl TenantUsage {
+    fn new(tenant: &str) -> Self {
+        TenantUsage {
+            tenant: tenant.to_string(),
+            ..TenantUsage::default()
+        }
+    }
+
+    fn add_run(&mut self, took: Duration, memory_mib_seconds: f64, failed: bool) {
+        self.runs += 1;
+        self.failed_runs += u64::from(failed);
+        self.run_time_ms += took.as_millis() as u64;
+        self.memory_mib_seconds += memory_mib_seconds;
+    }
+}
+
+struct Ledger {
+    totals: BTreeMap<String, TenantUsage>,
+    // What each tenant used since usage was last exported.
+    unexported: BTreeMap<String, TenantUsage>,
+}
+
+pub struct Tenants {
+    usage: Mutex<Ledger>,
+}
+
+// One of a tenant's concurrent runs, given back when dropped.
+pub struct RunSlot<'a> {
+    tenants: &'a Tenants,
+    tenant: String,
+}
+
+impl Drop for RunSlot<'_> {
+    fn drop(&mut self) {
+        let mut usage = self.tenants.usage.lock().unwrap();
+        if let Some(usage) = usage.totals.get_mut(&self.tenant) {
+            usage.running = usage.running.saturating_sub(1);
+        }
+    }
+}
+
+fn entry<'a>(usage: &'a mut BTreeMap<String, TenantUsage>, tenant: &str) -> &'a mut TenantUsage {
+    usage
+        .entry(tenant.to_string())
+        .or_insert_with(|| TenantUsage::new(tenant))
+}
+
+static TENANTS: Tenants = Tenants::new();
+
+pub fn tenants() -> &'static Tenants {
+    &TENANTS
+}
+
+impl Tenants {
+    pub const fn new() -> Self {
+        Tenants {
+            usage: Mutex::new(Ledger {
+                totals: BTreeMap::new(),
+                unexported: BTreeMap::new(),
+            }),
+        }
+    }
+
+    // Takes a run slot for `tenant`, unless it already has `limit` runs in
+    // progress.
+    pub fn acquire(&self, tenant: &str, limit: Option<usize>) -> Option<RunSlot<'_>> {
+        let mut usage = self.usage.lock().unwrap();
+        let usage = entry(&mut usage.totals, tenant);
+        if limit.is_some_and(|limit| usage.running >= limit) {
+            return None;
+        }
+        usage.running += 1;
+        Some(RunSlot {
+            tenants: self,
+            tenant: tenant.to_string(),
+        })
+    }
+
+    pub fn count_request(&self, tenant: &str) {
+        let mut usage = self.usage.lock().unwrap();
+        entry(&mut usage.totals, tenant).requests += 1;
+        entry(&mut usage.unexported, tenant).requests += 1;
+    }
+
+    pub fn record(&self, tenant: &str, took: Duration, memory_mib_seconds: f64, failed: bool) {
+        let mut usage = self.usage.lock().unwrap();
+        entry(&mut usage.totals, tenant).add_run(took, memory_mib_seconds, failed);
+        entry(&mut usage.unexported, tenant).add_run(took, memory_mib_seconds, failed);
+    }
+
+    pub fn usage(&self, tenant: &str) -> TenantUsage {
+        self.usage
+            .lock()
+            .unwrap()
+            .totals
+            .get(tenant)
+            .cloned()
+            .unwrap_or_else(|| TenantUsage::new(tenant))
+    }
+
+    // Every tenant seen since the server started, ordered by id.
+    pub fn all(&self) -> Vec<TenantUsage> {
+        self.usage
+            .lock()
+            .unwrap()
+            .totals
+            .values()
+            .cloned()
+            .collect()
+    }
+
+    // What each tenant used since the last call, leaving nothing behind for
+    // the next.
+    fn take_unexported(&self) -> Vec<TenantUsage> {
+        let unexported = std::mem::take(&mut self.usage.lock().unwrap().unexported);
+        unexported.into_values().collect()
+    }
+}
+
+// One tenant's usage over one export period, as billing reads it.
+#[derive(Debug, Serialize)]
+struct UsageRecord<'a> {
+    period_start: DateTime<Utc>,
+    period_end: DateTime<Utc>,
+    tenant: &'a str,
+    requests: u64,
+    runs: u64,
+    failed_runs: u64,
+    run_time_ms: u64,
+    memory_mib_seconds: f64,
+}
+
+const CSV_HEADER: &str =
+    "period_start,period_end,tenant,requests,runs,failed_runs,run_time_ms,memory_mib_seconds";
+
+// Appends a record per tenant to `path`: CSV rows if it ends in .csv, one
+// JSON object per line otherwise. A new CSV file starts with its header.
+fn append_usage(
+    path: &Path,
+    period_start: DateTime<Utc>,
+    period_end: DateTime<Utc>,
+    usage: &[TenantUsage],
+) -> io::Result<()> {
+    let csv = path.extension().is_some_and(|ext| ext == "csv");
+    let mut file = OpenOptions::new().create(true).append(true).open(path)?;
+    let mut out = String::new();
+    if csv && file.metadata()?.len() == 0 {
+        out.push_str(CSV_HEADER);
+        out.push('\n');
+    }
+    for usage in usage {
+        let record = UsageRecord {
+            period_start,
+            period_end,
+            tenant: &usage.tenant,
+            requests: usage.requests,
+            runs: usage.runs,
+            failed_runs: usage.failed_runs,
+            run_time_ms: usage.run_time_ms,
+            memory_mib_seconds: usage.memory_mib_seconds,
+        };
+        if csv {
+            out.push_str(&format!(
+                "{},{},{},{},{},{},{},{:.3}\n",
+                record.period_start.to_rfc3339(),
+                record.period_end.to_rfc3339(),
+                record.tenant,
+                record.requests,
+                record.runs,
+                record.failed_runs,
+                record.run_time_ms,
+                record.memory_mib_seconds,
+            ));
+        } else {
+            out.push_str(&serde_json::to_string(&record)?);
+            out.push('\n');
+        }
+    }
+    file.write_all(out.as_bytes())
+}
+
+// Every `interval`, appends what each tenant used since the last export to
+// `path`, so operators can bill or check fair use without polling the admin
+// API. Tenants that used nothing in a period are left out of it.
+pub async fn export_usage(path: PathBuf, interval: Duration) {
+    let mut period_start = Utc::now();
+    let mut ticks = tokio::time::interval(interval);
+    ticks.tick().await;
+    loop {
+        ticks.tick().await;
+        let period_end = Utc::now();
+        let usage = tenants().take_unexported();
+        if let Err(err) = append_usage(&path, period_start, period_end, &usage) {
+            tracing::error!("could not export usage to {}: {}", path.display(), err);
+        }
+        period_start = period_end;
+    }
+}
+
+#[cfg(test)]
+mod tenants_tests {
+    use super::*;
+
+    #[test]
+    fn test_slots_are_capped_per_tenant() {
+        let tenants = Tenants::new();
+        let first = tenants.acquire("a", Some(2)).unwrap();
+        let _second = tenants.acquire("a", Some(2)).unwrap();
+        assert!(tenants.acquire("a", Some(2)).is_none());
+        let _other = tenants.acquire("b", Some(2)).unwrap();
+        assert_eq!(tenants.usage("a").running, 2);
+
+        drop(first);
+        assert_eq!(tenants.usage("a").running, 1);
+        assert!(tenants.acquire("a", Some(2)).is_some());
+        assert!(tenants.acquire("c", None).is_some());
+    }
+
+    #[test]
+    fn test_usage_is_accounted_per_tenant() {
+        let tenants = Tenants::new();
+        tenants.record("a", Duration::from_millis(300), 1.5, false);
+        tenants.record("a", Duration::from_millis(200), 0.5, true);
+        tenants.record("b", Duration::from_millis(50), 0.0, false);
+        tenants.count_request("a");
+
+        let a = tenants.usage("a");
+        assert_eq!((a.runs, a.failed_runs, a.run_time_ms), (2, 1, 500));
+        assert_eq!((a.requests, a.memory_mib_seconds), (1, 2.0));
+        assert_eq!(tenants.usage("unknown").runs, 0);
+        let ids: Vec<_> = tenants
+            .all()
+            .into_iter()
+            .map(|usage| usage.tenant)
+            .collect();
+        assert_eq!(ids, ["a", "b"]);
+        assert_ne!(tenant_id(Some("key")), tenant_id(Some("other")));
+        assert_eq!(tenant_id(None), ANONYMOUS_TENANT);
+    }
+
+    #[test]
+    fn test_queue_tenant_ignores_keys_the_policy_does_not_know() {
+        let tiers = Tiers::from_json(r#"{"keys": {"known": "free"}}"#).unwrap();
+        assert_eq!(
+            queue_tenant(&tiers, Some("known"), "10.0.0.1"),
+            tenant_id(Some("known"))
+        );
+        assert_eq!(
+            queue_tenant(&tiers, Some("made-up"), "10.0.0.1"),
+            queue_tenant(&tiers, None, "10.0.0.1")
+        );
+        assert_ne!(
+            queue_tenant(&tiers, None, "10.0.0.1"),
+            queue_tenant(&tiers, None, "10.0.0.2")
+        );
+    }
+
+    #[test]
+    fn test_exports_usage_since_the_last_export() {
+        let tenants = Tenants::new();
+        tenants.count_request("a");
+        tenants.record("a", Duration::from_millis(300), 1.25, false);
+        let first = tenants.take_unexported();
+        assert_eq!(first.len(), 1);
+        assert_eq!((first[0].requests, first[0].runs), (1, 1));
+
+        tenants.record("b", Duration::from_millis(50), 0.0, true);
+        let second = tenants.take_unexported();
+        assert_eq!(second.len(), 1);
+        assert_eq!((second[0].tenant.as_str(), second[0].failed_runs), ("b", 1));
+        assert!(tenants.take_unexported().is_empty());
+        assert_eq!(tenants.usage("a").runs, 1);
+
+        let dir = tempfile::tempdir().unwrap();
+        let start = DateTime::from_timestamp(1_700_000_000, 0).unwrap();
+        let end = DateTime::from_timestamp(1_700_003_600, 0).unwrap();
+        let csv = dir.path().join("usage.csv");
+        append_usage(&csv, start, end, &first).unwrap();
+        append_usage(&csv, start, end, &second).unwrap();
+        let csv = std::fs::read_to_string(csv).unwrap();
+        let lines: Vec<_> = csv.lines().collect();
+        assert_eq!(lines.len(), 3);
+        assert_eq!(lines[0], CSV_HEADER);
+        assert_eq!(
+            lines[1],
+            "2023-11-14T22:13:20+00:00,2023-11-14T23:13:20+00:00,a,1,1,0,300,1.250"
+        );
+
+        let json = dir.path().join("usage.jsonl");
+        append_usage(&json, start, end, &first).unwrap();
+        let json = std::fs::read_to_string(json).unwrap();
+        let record: serde_json::Value = serde_json::from_str(json.trim()).unwrap();
+        assert_eq!(record["tenant"], "a");
+        assert_eq!(record["memory_mib_seconds"], 1.25);
+        assert_eq!(record["period_end"], "2023-11-14T23:13:20Z");
+    }
+}
@@ -0,0 +1,132 @@
+use std::{
+    collections::{HashMap, VecDeque},
+    sync::Mutex,
+    time::{Duration, Instant},
+};
+
+use tokio::sync::OnceCell;
+
+use crate::config::config;
+
+const SWEEP_THRESHOLD: usize = 10_000;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Verdict {
+    Allow,
+    Delay(Duration),
+    Reject,
+}
+
+#[derive(Debug, Clone, Copy)]
+pub struct ThrottleLimits {
+    pub window: Duration,
+    pub slow_after: usize,
+    pub reject_after: usize,
+    pub delay: Duration,
+}
+
+pub struct Throttle {
+    limits: ThrottleLimits,
+    hits: Mutex<HashMap<String, VecDeque<Instant>>>,
+}
+
+static THROTTLE: OnceCell<Throttle> = OnceCell::const_new();
+
+async fn init_throttle() -> Throttle {
+    Throttle::new(config().await.throttle_limits())
+}
+
+pub async fn throttle() -> &'static Throttle {
+    THROTTLE.get_or_init(init_throttle).await
+}
+
+impl Throttle {
+    pub fn new(limits: ThrottleLimits) -> Self {
+        Throttle {
+            limits,
+            hits: Mutex::new(HashMap::new()),
+        }
+    }
+
+    // Records a submission for `key` and decides how to treat it based on how
+    // many identical submissions landed inside the rolling window.
+    pub fn check(&self, key: &str) -> Verdict {
+        let now = Instant::now();
+        let mut hits = self.hits.lock().unwrap();
+        if hits.len() > SWEEP_THRESHOLD {
+            hits.retain(|_, times| {
+                times
+                    .back()
+                    .is_some_and(|last| now.duration_since(*last) < self.limits.window)
+            });
+        }
+
+        let times = hits.entry(key.to_string()).or_default();
+        while times
+            .front()
+            .is_some_and(|first| now.duration_since(*first) >= self.limits.window)
+        {
+            times.pop_front();
+        }
+        times.push_back(now);
+
+        let count = times.len();
+        if self.limits.reject_after > 0 && count > self.limits.reject_after {
+            Verdict::Reject
+        } else if self.limits.slow_after > 0 && count > self.limits.slow_after {
+            Verdict::Delay(self.limits.delay)
+        } else {
+            Verdict::Allow
+        }
+    }
+}
+
+#[cfg(test)]
+mod throttle_tests {
+    use super::*;
+
+    fn limits() -> ThrottleLimits {
+        ThrottleLimits {
+            window: Duration::from_secs(60),
+            slow_after: 2,
+            reject_after: 3,
+            delay: Duration::from_millis(500),
+        }
+    }
+
+    #[test]
+    fn test_check_escalates_from_delay_to_reject() {
+        let throttle = Throttle::new(limits());
+        assert_eq!(throttle.check("ip:hash"), Verdict::Allow);
+        assert_eq!(throttle.check("ip:hash"), Verdict::Allow);
+        assert_eq!(
+            throttle.check("ip:hash"),
+            Verdict::Delay(Duration::from_millis(500))
+        );
+        assert_eq!(throttle.check("ip:hash"), Verdict::Reject);
+        assert_eq!(throttle.check("ip:other"), Verdict::Allow);
+    }
+
+    #[test]
+    fn test_check_forgets_hits_outside_window() {
+        let throttle = Throttle::new(ThrottleLimits {
+            window: Duration::ZERO,
+            ..limits()
+        });
+        for _ in 0..10 {
+            assert_eq!(throttle.check("ip:hash"), Verdict::Allow);
+        }
+    }
+
+    #[test]
+    fn test_zero_thresholds_disable_throttling() {
+        let throttle = Throttle::new(ThrottleLimits {
+            slow_after: 0,
+            reject_after: 0,
+            ..limits()
+        });
+        for _ in 0..10 {
+            assert_eq!(throttle.check("ip:hash"), Verdict::Allow);
+        }
+    }
+}
@@ -0,0 +1,374 @@
+use std::{
+    collections::{HashMap, HashSet},
+    fs,
+    time::Duration,
+};
+
+use serde::{Deserialize, Serialize};
+use tokio::sync::OnceCell;
+
+use crate::config::config;
+
+use super::{
+    runner::ExecContext,
+    scheduler::ANONYMOUS_TENANT,
+    tenants::tenant_id,
+    throttle::{Throttle, ThrottleLimits, Verdict},
+    toolchain::Toolchain,
+};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Feature {
+    Files,
+    Images,
+    Transcript,
+    Matrix,
+    Archive,
+    Jobs,
+    Builds,
+    Sessions,
+    Interactive,
+    Judge,
+    // Programs may reach the network, as far as their syscall profile
+    // allows. Without it they run under one that denies sockets.
+    Network,
+    // Requests may import the packages the instance provides.
+    Dependencies,
+}
+
+impl Feature {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Feature::Files => "files",
+            Feature::Images => "images",
+            Feature::Transcript => "transcript",
+            Feature::Matrix => "matrix",
+            Feature::Archive => "archive",
+            Feature::Jobs => "jobs",
+            Feature::Builds => "builds",
+            Feature::Sessions => "sessions",
+            Feature::Interactive => "interactive",
+            Feature::Judge => "judge",
+            Feature::Network => "network",
+            Feature::Dependencies => "dependencies",
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct RateLimit {
+    pub requests: usize,
+    pub window_secs: u64,
+}
+
+// Limits and features for the API keys assigned to a tier. Anything left
+// unset falls back to the server-wide setting, and a tier without a feature
+// list may use every feature.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Tier {
+    pub timeout_secs: Option<u64>,
+    pub max_code_bytes: Option<usize>,
+    pub max_stdin_bytes: Option<usize>,
+    pub disk_quota_bytes: Option<u64>,
+    pub features: Option<Vec<Feature>>,
+    pub rate_limit: Option<RateLimit>,
+    // Runs each API key may have in progress at once.
+    pub max_concurrent_runs: Option<usize>,
+    // Languages the tier may run, by name.
+    pub languages: Option<Vec<String>>,
+}
+
+impl Tier {
+    pub fn allows(&self, feature: Feature) -> bool {
+        self.features
+            .as_ref()
+            .is_none_or(|features| features.contains(&feature))
+    }
+
+    pub fn allows_language(&self, toolchain: Toolchain) -> bool {
+        self.languages.as_ref().is_none_or(|languages| {
+            languages.iter().any(|name| {
+                Toolchain::resolve(name).is_ok_and(|allowed| allowed.as_str() == toolchain.as_str())
+            })
+        })
+    }
+
+    pub fn apply(&self, mut ctx: ExecContext) -> ExecContext {
+        if let Some(secs) = self.timeout_secs {
+            ctx = ctx.with_timeout(Duration::from_secs(secs));
+        }
+        if let Some(bytes) = self.disk_quota_bytes {
+            ctx = ctx.with_disk_quota(bytes);
+        }
+        if !self.allows(Feature::Network) {
+            ctx = ctx.offline();
+        }
+        ctx
+    }
+}
+
+pub fn presets() -> HashMap<String, Tier> {
+    HashMap::from([
+        (
+            String::from("free"),
+            Tier {
+                timeout_secs: Some(5),
+                max_code_bytes: Some(65_536),
+                max_stdin_bytes: Some(65_536),
+                disk_quota_bytes: Some(16 << 20),
+                features: Some(Vec::new()),
+                rate_limit: Some(RateLimit {
+                    requests: 20,
+                    window_secs: 60,
+                }),
+                max_concurrent_runs: Some(2),
+                languages: None,
+            },
+        ),
+        (
+            String::from("classroom"),
+            Tier {
+                timeout_secs: Some(10),
+                max_code_bytes: Some(262_144),
+                max_stdin_bytes: Some(1 << 20),
+                disk_quota_bytes: Some(64 << 20),
+                features: Some(vec![
+                    Feature::Files,
+                    Feature::Images,
+                    Feature::Transcript,
+                    Feature::Jobs,
+                    Feature::Dependencies,
+                ]),
+                rate_limit: Some(RateLimit {
+                    requests: 120,
+                    window_secs: 60,
+                }),
+                max_concurrent_runs: Some(16),
+                languages: None,
+            },
+        ),
+        (String::from("trusted"), Tier::default()),
+    ])
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct TierFile {
+    #[serde(default)]
+    default: Option<String>,
+    #[serde(default)]
+    tiers: HashMap<String, Tier>,
+    #[serde(default)]
+    keys: HashMap<String, String>,
+}
+
+// The tier policy: the tiers themselves, which API key belongs to which,
+// and the tier for requests without a known key. Requests that resolve to
+// no tier get the server-wide settings.
+pub struct Tiers {
+    tiers: HashMap<String, Tier>,
+    keys: HashMap<String, String>,
+    // The tenant ids of `keys`.
+    tenants: HashSet<String>,
+    default: Option<String>,
+    rate_limits: HashMap<String, Throttle>,
+}
+
+impl Tiers {
+    // Tiers in the policy replace the presets of the same name.
+    pub fn from_json(text: &str) -> Result<Self, String> {
+        let file: TierFile =
+            serde_json::from_str(text).map_err(|err| format!("invalid tier policy: {}", err))?;
+        let mut tiers = presets();
+        tiers.extend(file.tiers);
+
+        let assigned = file.keys.values().chain(&file.default);
+        if let Some(unknown) = assigned.into_iter().find(|name| !tiers.contains_key(*name)) {
+            return Err(format!("tier policy refers to unknown tier {}", unknown));
+        }
+        for (name, tier) in &tiers {
+            let languages = tier.languages.iter().flatten();
+            if let Some(unknown) = languages
+                .into_iter()
+                .find(|lang| Toolchain::resolve(lang).is_err())
+            {
+                return Err(format!("tier {} allows unknown language {}", name, unknown));
+            }
+        }
+
+        let rate_limits = tiers
+            .iter()
+            .filter_map(|(name, tier)| {
+                let limit = tier.rate_limit?;
+                let throttle = Throttle::new(ThrottleLimits {
+                    window: Duration::from_secs(limit.window_secs),
+                    slow_after: 0,
+                    reject_after: limit.requests,
+                    delay: Duration::ZERO,
+                });
+                Some((name.clone(), throttle))
+            })
+            .collect();
+
+        let tenants = file.keys.keys().map(|key| tenant_id(Some(key))).collect();
+        Ok(Tiers {
+            tiers,
+            keys: file.keys,
+            tenants,
+            default: file.default,
+            rate_limits,
+        })
+    }
+
+    pub fn resolve(&self, api_key: Option<&str>) -> Option<(&str, &Tier)> {
+        let name = api_key
+            .and_then(|key| self.keys.get(key))
+            .or(self.default.as_ref())?;
+        self.tiers
+            .get_key_value(name)
+            .map(|(name, tier)| (name.as_str(), tier))
+    }
+
+    // Whether the policy assigns `api_key` a tier of its own.
+    pub fn knows(&self, api_key: &str) -> bool {
+        self.keys.contains_key(api_key)
+    }
+
+    // The tenant whose run slots and usage `tenant` counts against: itself
+    // when it is a key the policy knows, and the anonymous tenant otherwise,
+    // so that made-up keys neither escape the anonymous caps nor fill the
+    // usage ledger.
+    pub fn tenant<'a>(&self, tenant: &'a str) -> &'a str {
+        if self.tenants.contains(tenant) {
+            tenant
+        } else {
+            ANONYMOUS_TENANT
+        }
+    }
+
+    // Counts a request from `caller` against its tier's rate limit.
+    pub fn check_rate(&self, tier: &str, caller: &str) -> Verdict {
+        match self.rate_limits.get(tier) {
+            Some(throttle) => throttle.check(caller),
+            None => Verdict::Allow,
+        }
+    }
+}
+
+static TIERS: OnceCell<Tiers> = OnceCell::const_new();
+
+async fn init_tiers() -> Tiers {
+    let text = match config().await.tiers_file() {
+        Some(path) => fs::read_to_string(path).unwrap(),
+        None => String::from("{}"),
+    };
+    Tiers::from_json(&text).unwrap()
+}
+
+pub async fn tiers() -> &'static Tiers {
+    TIERS.get_or_init(init_tiers).await
+}
+
+#[cfg(test)]
+mod tier_tests {
+    use super::*;
+
+    const POLICY: &str = r#"{
+        "default": "free",
+        "tiers": {
+            "free": {"features": ["transcript"], "rate_limit": {"requests": 2, "window_secs": 60}},
+            "staff": {"timeout_secs": 30},
+            "intro": {"languages": ["python", "javascript"], "max_concurrent_runs": 4}
+        },
+        "keys": {"key-a": "classroom", "key-b": "staff"}
+    }"#;
+
+    #[test]
+    fn test_resolve_by_key_then_default() {
+        let tiers = Tiers::from_json(POLICY).unwrap();
+        assert_eq!(tiers.resolve(Some("key-a")).unwrap().0, "classroom");
+        assert_eq!(
+            tiers.resolve(Some("key-b")).unwrap().1.timeout_secs,
+            Some(30)
+        );
+        assert_eq!(tiers.resolve(Some("unknown")).unwrap().0, "free");
+        assert_eq!(tiers.resolve(None).unwrap().0, "free");
+        let known = tenant_id(Some("key-a"));
+        assert_eq!(tiers.tenant(&known), known);
+        assert_eq!(tiers.tenant(&tenant_id(Some("unknown"))), ANONYMOUS_TENANT);
+
+        let open = Tiers::from_json("{}").unwrap();
+        assert!(open.resolve(Some("key-a")).is_none());
+        assert_eq!(open.tenant(&tenant_id(Some("key-a"))), ANONYMOUS_TENANT);
+        assert_eq!(open.tiers["trusted"], Tier::default());
+    }
+
+    #[test]
+    fn test_policy_overrides_presets_and_rejects_unknown_tiers() {
+        let tiers = Tiers::from_json(POLICY).unwrap();
+        let (_, free) = tiers.resolve(None).unwrap();
+        assert!(free.allows(Feature::Transcript));
+        assert!(!free.allows(Feature::Files));
+        assert_eq!(free.timeout_secs, None);
+        assert!(
+            tiers
+                .resolve(Some("key-a"))
+                .unwrap()
+                .1
+                .allows(Feature::Jobs)
+        );
+        assert!(Tier::default().allows(Feature::Matrix));
+
+        assert!(Tiers::from_json(r#"{"keys": {"k": "gold"}}"#).is_err());
+        assert!(Tiers::from_json(r#"{"default": "gold"}"#).is_err());
+        assert!(Tiers::from_json(r#"{"tiers": {"x": {"timeout": 1}}}"#).is_err());
+        assert!(Tiers::from_json(r#"{"tiers": {"x": {"languages": ["cobol"]}}}"#).is_err());
+    }
+
+    #[test]
+    fn test_tiers_without_network_run_offline() {
+        let tiers = Tiers::from_json(POLICY).unwrap();
+        let classroom = &tiers.tiers["classroom"];
+        assert!(classroom.allows(Feature::Dependencies));
+        assert!(!classroom.allows(Feature::Network));
+        assert!(classroom.apply(ExecContext::default()).is_offline());
+        assert!(!tiers.tiers["free"].allows(Feature::Dependencies));
+        assert!(!Tier::default().apply(ExecContext::default()).is_offline());
+    }
+
+    #[test]
+    fn test_language_allow_list() {
+        let tiers = Tiers::from_json(POLICY).unwrap();
+        let intro = &tiers.tiers["intro"];
+        assert_eq!(intro.max_concurrent_runs, Some(4));
+        assert!(intro.allows_language(Toolchain::resolve("python").unwrap()));
+        assert!(!intro.allows_language(Toolchain::resolve("rust").unwrap()));
+        assert!(Tier::default().allows_language(Toolchain::resolve("rust").unwrap()));
+    }
+
+    #[test]
+    fn test_rate_limit_is_per_caller_within_tier() {
+        let tiers = Tiers::from_json(POLICY).unwrap();
+        assert_eq!(tiers.check_rate("free", "1.2.3.4"), Verdict::Allow);
+        assert_eq!(tiers.check_rate("free", "1.2.3.4"), Verdict::Allow);
+        assert_eq!(tiers.check_rate("free", "1.2.3.4"), Verdict::Reject);
+        assert_eq!(tiers.check_rate("free", "5.6.7.8"), Verdict::Allow);
+        for _ in 0..10 {
+            assert_eq!(tiers.check_rate("staff", "key-b"), Verdict::Allow);
+        }
+    }
+
+    #[test]
+    fn test_apply_overrides_timeout_and_disk_quota() {
+        let tier = Tier {
+            timeout_secs: Some(3),
+            ..Tier::default()
+        };
+        let ctx = tier.apply(ExecContext::default().with_timeout(Duration::from_secs(10)));
+        assert_eq!(ctx.timeout(), Some(Duration::from_secs(3)));
+        assert_eq!(ctx.disk_quota(), None);
+    }
+}
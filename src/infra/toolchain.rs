@@ -0,0 +1,73 @@
+use std::fmt;
+
+use super::{
+    error::InfraError,
+    language::Language,
+    plugin::{Plugin, plugins},
+};
+
+// A language comphub can run: either one of the built-in executors or a
+// plugin discovered at startup.
+#[derive(Debug, Clone, Copy)]
+pub enum Toolchain {
+    Builtin(Language),
+    Plugin(&'static Plugin),
+}
+
+impl Toolchain {
+    pub fn resolve(lang: &str) -> Result<Self, InfraError> {
+        if let Ok(language) = lang.parse::<Language>() {
+            return Ok(Toolchain::Builtin(language));
+        }
+        plugins().get(lang).map(Toolchain::Plugin).ok_or_else(|| {
+            InfraError::UnsupportedLanguage(format!("{} language is not supported", lang))
+        })
+    }
+
+    pub fn names() -> Vec<&'static str> {
+        Language::ALL
+            .iter()
+            .map(Language::as_str)
+            .chain(plugins().names())
+            .collect()
+    }
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Toolchain::Builtin(language) => language.as_str(),
+            Toolchain::Plugin(plugin) => plugin.name(),
+        }
+    }
+
+    pub fn is_compiled(&self) -> bool {
+        match self {
+            Toolchain::Builtin(language) => language.is_compiled(),
+            Toolchain::Plugin(plugin) => plugin.description().compiled,
+        }
+    }
+
+    pub fn allowed_compiler_flags(&self) -> Vec<&'static str> {
+        match self {
+            Toolchain::Builtin(language) => language.allowed_compiler_flags().to_vec(),
+            Toolchain::Plugin(plugin) => plugin
+                .description()
+                .compiler_flags
+                .iter()
+                .map(String::as_str)
+                .collect(),
+        }
+    }
+
+    pub fn module_path_env(&self) -> Option<&'static str> {
+        match self {
+            Toolchain::Builtin(language) => language.module_path_env(),
+            Toolchain::Plugin(_) => None,
+        }
+    }
+}
+
+impl fmt::Display for Toolchain {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
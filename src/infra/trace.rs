@@ -0,0 +1,73 @@
+use std::future::Future;
+
+pub const TRACEPARENT_HEADER: &str = "traceparent";
+
+tokio::task_local! {
+    static TRACEPARENT: Option<String>;
+}
+
+// W3C Trace Context: version, trace id, parent id and flags in lowercase
+// hex, joined by dashes. Version ff and all-zero ids are invalid; versions
+// after 00 may append fields, which are kept as they are.
+pub fn is_traceparent(value: &str) -> bool {
+    let mut fields = value.split('-');
+    let mut field = |len: usize| {
+        fields.next().filter(|field| {
+            field.len() == len
+                && field
+                    .bytes()
+                    .all(|byte| byte.is_ascii_digit() || (b'a'..=b'f').contains(&byte))
+        })
+    };
+    let (Some(version), Some(trace_id), Some(parent_id), Some(_flags)) =
+        (field(2), field(32), field(16), field(2))
+    else {
+        return false;
+    };
+    let zero = |id: &str| id.bytes().all(|byte| byte == b'0');
+    let rest = fields.next();
+    version != "ff"
+        && !zero(trace_id)
+        && !zero(parent_id)
+        && (rest.is_none() || version != "00")
+}
+
+// Runs `run` as part of the trace `traceparent` names, so the jobs it
+// submits and the webhooks and events it sends carry it on.
+pub async fn traced<F: Future>(traceparent: Option<String>, run: F) -> F::Output {
+    TRACEPARENT.scope(traceparent, run).await
+}
+
+// The trace the current request or job is part of, if its caller sent one.
+pub fn traceparent() -> Option<String> {
+    TRACEPARENT.try_with(Clone::clone).ok().flatten()
+}
+
+#[cfg(test)]
+mod trace_tests {
+    use super::*;
+
+    #[test]
+    fn test_is_traceparent_follows_the_w3c_format() {
+        let valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01";
+        assert!(is_traceparent(valid));
+        assert!(is_traceparent(
+            "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future"
+        ));
+        assert!(!is_traceparent(&format!("{}-extra", valid)));
+        assert!(!is_traceparent(&valid.to_uppercase()));
+        assert!(!is_traceparent(&valid.replacen("00", "ff", 1)));
+        assert!(!is_traceparent(
+            "00-00000000000000000000000000000000-00f067aa0ba902b7-01"
+        ));
+        assert!(!is_traceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-01"));
+    }
+
+    #[tokio::test]
+    async fn test_traceparent_is_scoped_to_the_run() {
+        assert_eq!(traceparent(), None);
+        let inner = traced(Some("trace".into()), async { traceparent() }).await;
+        assert_eq!(inner.as_deref(), Some("trace"));
+        assert_eq!(traceparent(), None);
+    }
+}
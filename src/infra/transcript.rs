@@ -0,0 +1,92 @@
+use std::time::Instant;
+
+use serde::{Deserialize, Serialize};
+use tokio::{
+    sync::mpsc::{self, UnboundedSender},
+    task::JoinHandle,
+};
+use utoipa::ToSchema;
+
+use super::runner::OutputChunk;
+
+// Interpreters buffer stdout when it is not a terminal, which would push all
+// of it after stderr. Set for runs that record a transcript.
+pub const UNBUFFERED_ENV: &[(&str, &str)] = &[("PYTHONUNBUFFERED", "1")];
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize, ToSchema)]
+pub struct TranscriptEntry {
+    // Position in the merged stream; breaks ties between chunks read in the
+    // same millisecond.
+    pub seq: u64,
+    // Time since the program started, in milliseconds.
+    pub offset_ms: u64,
+    #[serde(flatten)]
+    pub chunk: OutputChunk,
+}
+
+// Stamps output chunks as they arrive so stdout and stderr can be shown in
+// the order the program produced them.
+pub struct TranscriptRecorder {
+    handle: JoinHandle<Vec<TranscriptEntry>>,
+}
+
+impl TranscriptRecorder {
+    // Returns the sink to hand to the run via `ExecContext::with_output`.
+    pub fn start() -> (UnboundedSender<OutputChunk>, Self) {
+        let (tx, mut rx) = mpsc::unbounded_channel();
+        let started = Instant::now();
+        let handle = tokio::spawn(async move {
+            let mut entries = Vec::new();
+            while let Some(chunk) = rx.recv().await {
+                entries.push(TranscriptEntry {
+                    seq: entries.len() as u64,
+                    offset_ms: started.elapsed().as_millis() as u64,
+                    chunk,
+                });
+            }
+            entries
+        });
+        (tx, TranscriptRecorder { handle })
+    }
+
+    // Resolves once every sender, including the one held by the run's
+    // context, has been dropped.
+    pub async fn finish(self) -> Vec<TranscriptEntry> {
+        self.handle.await.unwrap_or_default()
+    }
+}
+
+#[cfg(test)]
+mod transcript_tests {
+    use super::*;
+    use crate::infra::runner::{ExecContext, run_program};
+    use tokio::process::Command;
+
+    #[tokio::test]
+    async fn test_transcript_keeps_stdout_and_stderr_in_order() {
+        let (tx, recorder) = TranscriptRecorder::start();
+        let ctx = ExecContext::default().with_output(tx);
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c")
+            .arg("echo one; sleep 0.1; echo two >&2; sleep 0.1; echo three");
+        run_program(&mut cmd, "", &ctx).await.unwrap();
+        drop(ctx);
+
+        let entries = recorder.finish().await;
+        let chunks: Vec<_> = entries.iter().map(|entry| entry.chunk.clone()).collect();
+        assert_eq!(
+            chunks,
+            [
+                OutputChunk::Stdout("one\n".into()),
+                OutputChunk::Stderr("two\n".into()),
+                OutputChunk::Stdout("three\n".into()),
+            ]
+        );
+        assert!(
+            entries
+                .windows(2)
+                .all(|pair| pair[0].offset_ms <= pair[1].offset_ms)
+        );
+        assert_eq!(entries[2].seq, 2);
+    }
+}
@@ -0,0 +1,326 @@
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use reqwest::{StatusCode, header::CONTENT_TYPE};
+use serde::Serialize;
+use tokio::sync::{OnceCell, mpsc};
+use uuid::Uuid;
+
+use super::{
+    events::Submitter,
+    interactive::Verdict,
+    judge::TestResult,
+    metrics,
+    signing::{hmac_sha256, to_hex},
+    trace::{TRACEPARENT_HEADER, traceparent},
+};
+use crate::config::config;
+
+const WEBHOOK_METRIC: &str = "comphub_verdict_webhooks_total";
+// Events waiting on a slow endpoint beyond this are dropped rather than
+// holding up judging.
+const VERDICT_BUFFER: usize = 1024;
+const WEBHOOK_TIMEOUT: Duration = Duration::from_secs(10);
+// The wait before the first retry, doubled after each one up to the most.
+const FIRST_RETRY: Duration = Duration::from_secs(1);
+const MAX_RETRY: Duration = Duration::from_secs(60);
+
+pub const TIMESTAMP_HEADER: &str = "x-comphub-timestamp";
+pub const SIGNATURE_HEADER: &str = "x-comphub-signature";
+
+// What the judge webhook is told about a judging, in the order it happens.
+#[derive(Debug, Clone, Serialize)]
+#[serde(tag = "event", rename_all = "snake_case")]
+pub enum VerdictEvent {
+    // One test was judged; sent as soon as it is, so tests that run at once
+    // arrive in the order they finish.
+    Test {
+        judging_id: String,
+        lang: String,
+        submitter: Submitter,
+        // The test's position in the request.
+        index: usize,
+        result: TestResult,
+    },
+    // Every test was judged, or judging failed before they all were.
+    Summary {
+        judging_id: String,
+        lang: String,
+        submitter: Submitter,
+        verdict: Verdict,
+        passed: usize,
+        tests: usize,
+        #[serde(skip_serializing_if = "Option::is_none")]
+        error: Option<String>,
+    },
+}
+
+// Posts events to the endpoint in JUDGE_WEBHOOK_URL, each signed with
+// JUDGE_WEBHOOK_SECRET: the signature header carries the hex HMAC-SHA256 of
+// the timestamp header, a newline and the body. Events of a judging whose
+// request sent a traceparent carry it on in the same header.
+pub struct VerdictWebhook {
+    http: reqwest::Client,
+    url: String,
+    secret: Vec<u8>,
+    attempts: usize,
+}
+
+pub fn sign(secret: &[u8], timestamp: &str, body: &[u8]) -> String {
+    let mut message = format!("{}\n", timestamp).into_bytes();
+    message.extend_from_slice(body);
+    to_hex(&hmac_sha256(secret, &message))
+}
+
+impl VerdictWebhook {
+    pub fn new(url: &str, secret: &str, attempts: usize) -> Self {
+        VerdictWebhook {
+            http: reqwest::Client::builder()
+                .timeout(WEBHOOK_TIMEOUT)
+                .build()
+                .unwrap_or_default(),
+            url: url.to_string(),
+            secret: secret.as_bytes().to_vec(),
+            attempts: attempts.max(1),
+        }
+    }
+
+    // Each attempt is signed afresh, so a retry is not mistaken for a
+    // replay of a stale request.
+    async fn send(&self, body: &[u8], traceparent: Option<&str>) -> reqwest::Result<()> {
+        let timestamp = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .unwrap_or_default()
+            .as_secs()
+            .to_string();
+        let mut request = self
+            .http
+            .post(&self.url)
+            .header(CONTENT_TYPE, "application/json")
+            .header(TIMESTAMP_HEADER, &timestamp)
+            .header(SIGNATURE_HEADER, sign(&self.secret, &timestamp, body));
+        if let Some(traceparent) = traceparent {
+            request = request.header(TRACEPARENT_HEADER, traceparent);
+        }
+        request
+            .body(body.to_vec())
+            .send()
+            .await?
+            .error_for_status()?;
+        Ok(())
+    }
+
+    // Sends `body`, retrying with backoff until it is accepted or the
+    // attempts run out. An endpoint that refuses the event outright, other
+    // than for its rate limit, is not asked again.
+    pub async fn deliver(&self, body: &[u8], traceparent: Option<&str>) -> bool {
+        let mut delay = FIRST_RETRY;
+        for attempt in 1..=self.attempts {
+            let err = match self.send(body, traceparent).await {
+                Ok(()) => return true,
+                Err(err) => err,
+            };
+            tracing::warn!(
+                "judge webhook attempt {} of {} failed: {}",
+                attempt,
+                self.attempts,
+                err
+            );
+            let refused = err.status().is_some_and(|status| {
+                status.is_client_error() && status != StatusCode::TOO_MANY_REQUESTS
+            });
+            if refused || attempt == self.attempts {
+                break;
+            }
+            tokio::time::sleep(delay).await;
+            delay = (delay * 2).min(MAX_RETRY);
+        }
+        false
+    }
+}
+
+// An encoded event and the trace it belongs to.
+type Delivery = (Vec<u8>, Option<String>);
+
+static WEBHOOK: OnceCell<Option<mpsc::Sender<Delivery>>> = OnceCell::const_new();
+
+async fn init_webhook() -> Option<mpsc::Sender<Delivery>> {
+    let app_config = config().await;
+    let (url, secret) = app_config.judge_webhook()?;
+    let webhook = VerdictWebhook::new(url, secret, app_config.judge_webhook_attempts());
+    let (tx, rx) = mpsc::channel(VERDICT_BUFFER);
+    tokio::spawn(deliver_all(rx, webhook));
+    Some(tx)
+}
+
+// One event at a time, so the endpoint sees a judging's events in order
+// even when an earlier one had to be retried.
+async fn deliver_all(mut events: mpsc::Receiver<Delivery>, webhook: VerdictWebhook) {
+    while let Some((payload, traceparent)) = events.recv().await {
+        let outcome = if webhook.deliver(&payload, traceparent.as_deref()).await {
+            "delivered"
+        } else {
+            "failed"
+        };
+        metrics::increment(WEBHOOK_METRIC, &[("outcome", outcome)]);
+    }
+}
+
+// Reports one judging's verdicts to the judge webhook as they come.
+pub struct VerdictReporter {
+    events: mpsc::Sender<Delivery>,
+    judging_id: String,
+    lang: String,
+    submitter: Submitter,
+    traceparent: Option<String>,
+}
+
+impl VerdictReporter {
+    // None unless JUDGE_WEBHOOK_URL is set.
+    pub async fn start(lang: &str, submitter: &Submitter) -> Option<Self> {
+        let events = WEBHOOK.get_or_init(init_webhook).await.clone()?;
+        Some(VerdictReporter {
+            events,
+            judging_id: Uuid::new_v4().to_string(),
+            lang: lang.to_string(),
+            submitter: submitter.clone(),
+            traceparent: traceparent(),
+        })
+    }
+
+    pub fn judging_id(&self) -> &str {
+        &self.judging_id
+    }
+
+    fn send(&self, event: &VerdictEvent) {
+        let payload = match serde_json::to_vec(event) {
+            Ok(payload) => payload,
+            Err(err) => {
+                tracing::warn!("failed to encode verdict of {}: {}", self.judging_id, err);
+                return;
+            }
+        };
+        if self
+            .events
+            .try_send((payload, self.traceparent.clone()))
+            .is_err()
+        {
+            metrics::increment(WEBHOOK_METRIC, &[("outcome", "dropped")]);
+            tracing::warn!(
+                "judge webhook is falling behind, dropped a verdict of {}",
+                self.judging_id
+            );
+        }
+    }
+
+    pub fn test(&self, index: usize, result: &TestResult) {
+        self.send(&VerdictEvent::Test {
+            judging_id: self.judging_id.clone(),
+            lang: self.lang.clone(),
+            submitter: self.submitter.clone(),
+            index,
+            result: result.clone(),
+        });
+    }
+
+    pub fn summary(&self, verdict: Verdict, passed: usize, tests: usize, error: Option<String>) {
+        self.send(&VerdictEvent::Summary {
+            judging_id: self.judging_id.clone(),
+            lang: self.lang.clone(),
+            submitter: self.submitter.clone(),
+            verdict,
+            passed,
+            tests,
+            error,
+        });
+    }
+}
+
+#[cfg(test)]
+mod verdicts_tests {
+    use tokio::{
+        io::{AsyncReadExt, AsyncWriteExt},
+        net::TcpListener,
+    };
+
+    use super::*;
+
+    // Answers the first `failures` requests with `status` and the rest with
+    // 200, returning each request as it arrived.
+    async fn endpoint(failures: usize, status: &str) -> (String, mpsc::UnboundedReceiver<String>) {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let url = format!("http://{}/scores", listener.local_addr().unwrap());
+        let (tx, rx) = mpsc::unbounded_channel();
+        let status = status.to_string();
+        tokio::spawn(async move {
+            for answered in 0.. {
+                let (mut stream, _) = listener.accept().await.unwrap();
+                let mut received = Vec::new();
+                while !received.ends_with(b"{}") {
+                    let mut buf = [0u8; 1024];
+                    let n = stream.read(&mut buf).await.unwrap();
+                    received.extend_from_slice(&buf[..n]);
+                }
+                let status = if answered < failures {
+                    &status
+                } else {
+                    "200 OK"
+                };
+                let answer = format!("HTTP/1.1 {}\r\ncontent-length: 0\r\n\r\n", status);
+                stream.write_all(answer.as_bytes()).await.unwrap();
+                tx.send(String::from_utf8(received).unwrap().to_lowercase())
+                    .unwrap();
+            }
+        });
+        (url, rx)
+    }
+
+    fn header<'a>(request: &'a str, name: &str) -> &'a str {
+        request
+            .lines()
+            .find_map(|line| line.strip_prefix(&format!("{}: ", name)))
+            .unwrap()
+            .trim()
+    }
+
+    #[tokio::test]
+    async fn test_delivery_is_signed_and_retried_until_accepted() {
+        let (url, mut requests) = endpoint(1, "503 Service Unavailable").await;
+        let webhook = VerdictWebhook::new(&url, "secret", 3);
+        let traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01";
+        assert!(webhook.deliver(b"{}", Some(traceparent)).await);
+        let first = requests.recv().await.unwrap();
+        let second = requests.recv().await.unwrap();
+        assert!(second.starts_with("post /scores http/1.1\r\n"));
+        for request in [first, second] {
+            let timestamp = header(&request, TIMESTAMP_HEADER);
+            assert_eq!(
+                header(&request, SIGNATURE_HEADER),
+                sign(b"secret", timestamp, b"{}")
+            );
+            assert_eq!(header(&request, TRACEPARENT_HEADER), traceparent);
+        }
+
+        let (url, mut requests) = endpoint(usize::MAX, "400 Bad Request").await;
+        let webhook = VerdictWebhook::new(&url, "secret", 3);
+        assert!(!webhook.deliver(b"{}", None).await);
+        requests.recv().await.unwrap();
+        assert!(requests.try_recv().is_err());
+    }
+
+    #[test]
+    fn test_events_are_tagged_by_kind() {
+        let event = VerdictEvent::Summary {
+            judging_id: String::from("j"),
+            lang: String::from("python"),
+            submitter: Submitter::default(),
+            verdict: Verdict::WrongAnswer,
+            passed: 2,
+            tests: 3,
+            error: None,
+        };
+        let json = serde_json::to_value(&event).unwrap();
+        assert_eq!(json["event"], "summary");
+        assert_eq!(json["verdict"], "wrong_answer");
+        assert!(json.get("error").is_none());
+    }
+}
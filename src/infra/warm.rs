@@ -0,0 +1,405 @@
+use std::{
+    collections::HashMap,
+    path::Path,
+    process::Output,
+    str::FromStr,
+    sync::{Mutex, OnceLock},
+};
+
+use serde_json::{Map, Value, json};
+use tokio::process::Child;
+
+use crate::config::config;
+
+use super::{
+    compile::confine,
+    error::InfraError,
+    language::Language,
+    limits::language_defaults,
+    runner::{ExecContext, prepare, spawn_piped, supervise},
+    sandbox::{UserLease, try_lease_user},
+    seccomp::SyscallProfile,
+    toolchain::Toolchain,
+};
+
+// A warm interpreter waits for a single line of JSON on stdin describing the
+// program to run, then runs it with the rest of stdin. The line is read a
+// byte at a time so nothing meant for the program is buffered away from it.
+const PYTHON_BOOTSTRAP: &str = r#"
+import json, os, runpy, sys
+header = b""
+while not header.endswith(b"\n"):
+    byte = os.read(0, 1)
+    if not byte:
+        sys.exit(0)
+    header += byte
+spec = json.loads(header)
+path = spec["path"]
+if spec["cwd"]:
+    os.chdir(spec["cwd"])
+os.environ.update(spec["env"])
+if os.environ.get("PYTHONUNBUFFERED"):
+    sys.stdout.reconfigure(write_through=True)
+    sys.stderr.reconfigure(write_through=True)
+sys.argv = [path, *spec["args"]]
+sys.path[0] = os.path.dirname(path)
+try:
+    runpy.run_path(path, run_name="__main__")
+except SystemExit:
+    raise
+except BaseException as error:
+    tb = error.__traceback__
+    while tb is not None and tb.tb_frame.f_code.co_filename != path:
+        tb = tb.tb_next
+    error = error.with_traceback(tb or error.__traceback__)
+    sys.excepthook(type(error), error, error.__traceback__)
+    sys.exit(1)
+"#;
+
+const RUBY_BOOTSTRAP: &str = r#"
+require "json"
+header = +""
+until header.end_with?("\n")
+  begin
+    header << STDIN.sysread(1)
+  rescue EOFError
+    exit 0
+  end
+end
+spec = JSON.parse(header)
+path = spec["path"]
+Dir.chdir(spec["cwd"]) if spec["cwd"]
+ENV.update(spec["env"])
+ARGV.replace(spec["args"])
+$0 = path
+begin
+  load path
+rescue Exception => error
+  raise if error.is_a?(SystemExit)
+  error.set_backtrace(error.backtrace.reject { |line| line.start_with?("-e:") })
+  raise
+end
+"#;
+
+fn bootstrap(language: Language) -> Option<(&'static str, [&'static str; 2])> {
+    match language {
+        Language::Python => Some(("python3", ["-c", PYTHON_BOOTSTRAP])),
+        Language::RUBY => Some(("ruby", ["-e", RUBY_BOOTSTRAP])),
+        _ => None,
+    }
+}
+
+// How many idle interpreters to keep per language, parsed from a
+// comma-separated list of `lang:count` entries.
+#[derive(Debug, Clone, Default)]
+pub struct WarmPoolSizes {
+    sizes: Vec<(Language, usize)>,
+}
+
+impl FromStr for WarmPoolSizes {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut sizes = Vec::new();
+        for entry in s
+            .split(',')
+            .map(str::trim)
+            .filter(|entry| !entry.is_empty())
+        {
+            let (lang, count) = entry.split_once(':').ok_or_else(|| {
+                format!("invalid warm pool size {:?}, expected lang:count", entry)
+            })?;
+            let language = lang
+                .trim()
+                .parse::<Language>()
+                .map_err(|err| err.to_string())?;
+            if bootstrap(language).is_none() {
+                return Err(format!("{} cannot be kept warm", language.as_str()));
+            }
+            let count = count
+                .trim()
+                .parse::<usize>()
+                .map_err(|_| format!("invalid warm pool size {:?}", entry))?;
+            sizes.retain(|(existing, _)| *existing != language);
+            sizes.push((language, count));
+        }
+        Ok(WarmPoolSizes { sizes })
+    }
+}
+
+// An interpreter that has already started up and is waiting for a program.
+// Each one runs a single program; it is never reused. It runs as a sandbox
+// user of its own from the start, so the program's files are handed over to
+// that user rather than the run's.
+pub struct WarmProcess {
+    child: Child,
+    profile: Option<SyscallProfile>,
+    user: Option<UserLease>,
+}
+
+impl WarmProcess {
+    pub async fn run(
+        self,
+        script: &Path,
+        stdin_input: &str,
+        ctx: &ExecContext,
+    ) -> Result<Output, InfraError> {
+        if let Some(lease) = &self.user {
+            let user = lease.user();
+            if let Some(dir) = script.parent() {
+                user.grant(dir)?;
+            }
+            user.grant(script)?;
+            if let Some(workspace) = ctx.workspace() {
+                user.grant(workspace)?;
+            }
+        }
+        let env: Map<String, Value> = ctx
+            .envs()
+            .iter()
+            .map(|(key, value)| (key.clone(), Value::from(value.as_str())))
+            .collect();
+        let spec = json!({
+            "path": script,
+            "cwd": ctx.workspace(),
+            "args": ctx.args(),
+            "env": env,
+        });
+        let input = format!("{}\n{}", spec, stdin_input);
+        // The lease outlives the run, so whatever it left behind is killed.
+        let _user = self.user;
+        supervise(self.child, &input, ctx, self.profile).await
+    }
+}
+
+// Interpreters started ahead of time so short programs do not pay for
+// interpreter startup. A checked out process is replaced in the background.
+pub struct WarmPool {
+    sizes: HashMap<Language, usize>,
+    templates: HashMap<Language, ExecContext>,
+    idle: Mutex<HashMap<Language, Vec<WarmProcess>>>,
+}
+
+static WARM_POOL: OnceLock<WarmPool> = OnceLock::new();
+
+pub fn warm_pool() -> Option<&'static WarmPool> {
+    WARM_POOL.get()
+}
+
+pub async fn start_warm_pool(sizes: &WarmPoolSizes) {
+    let app_config = config().await;
+    let defaults = language_defaults().await;
+    let pool = WarmPool {
+        sizes: sizes.sizes.iter().copied().collect(),
+        templates: sizes
+            .sizes
+            .iter()
+            .map(|(language, _)| {
+                let toolchain = Toolchain::Builtin(*language);
+                (
+                    *language,
+                    confine(ExecContext::default(), &toolchain, app_config, defaults),
+                )
+            })
+            .collect(),
+        idle: Mutex::new(HashMap::new()),
+    };
+    if WARM_POOL.set(pool).is_err() {
+        tracing::warn!("warm pool was already started");
+        return;
+    }
+    let pool = WARM_POOL.get().unwrap();
+    for (language, size) in &sizes.sizes {
+        tracing::info!("keeping {} warm {} processes", size, language.as_str());
+        pool.refill(*language);
+    }
+}
+
+impl WarmPool {
+    // Hands out an idle interpreter for `language` if one is ready and was
+    // started with the same sandboxing `ctx` asks for.
+    pub fn checkout(&'static self, language: Language, ctx: &ExecContext) -> Option<WarmProcess> {
+        let template = self.templates.get(&language)?;
+        // The bootstrap reads its header from stdin, which an interactor
+        // would be talking to instead. An interpreter already running has
+        // read its locale and timezone, and its threads run on any core,
+        // whatever cores the run was leased.
+        if !ctx.same_confinement(template)
+            || ctx.interaction().is_some()
+            || !ctx.locale_env().is_empty()
+            || !ctx.cpus().is_empty()
+        {
+            return None;
+        }
+        let process = {
+            let mut idle = self.idle.lock().unwrap();
+            let processes = idle.entry(language).or_default();
+            loop {
+                let Some(mut process) = processes.pop() else {
+                    break None;
+                };
+                if matches!(process.child.try_wait(), Ok(None)) {
+                    break Some(process);
+                }
+            }
+        };
+        tokio::spawn(async move { self.refill(language) });
+        process
+    }
+
+    pub fn keeps(&self, language: Language) -> bool {
+        self.sizes.get(&language).is_some_and(|size| *size > 0)
+    }
+
+    fn refill(&self, language: Language) {
+        let size = self.sizes.get(&language).copied().unwrap_or(0);
+        let missing = {
+            let idle = self.idle.lock().unwrap();
+            size.saturating_sub(idle.get(&language).map_or(0, Vec::len))
+        };
+        let mut started = Vec::new();
+        for _ in 0..missing {
+            match self.spawn(language) {
+                Ok(process) => started.push(process),
+                Err(err) => {
+                    tracing::warn!(
+                        "failed to start warm {} process: {}",
+                        language.as_str(),
+                        err
+                    );
+                    break;
+                }
+            }
+        }
+        let mut idle = self.idle.lock().unwrap();
+        let processes = idle.entry(language).or_default();
+        processes.extend(started);
+        processes.truncate(size);
+    }
+
+    fn spawn(&self, language: Language) -> Result<WarmProcess, InfraError> {
+        let (binary, args) = bootstrap(language)
+            .ok_or_else(|| InfraError::UnsupportedLanguage(language.as_str().to_string()))?;
+        let template = &self.templates[&language];
+        let user = try_lease_user()?;
+        let start = || -> Result<_, InfraError> {
+            let mut cmd = template.command(binary)?;
+            cmd.args(args);
+            let profile = prepare(&mut cmd, template)?;
+            Ok((spawn_piped(&mut cmd)?, profile))
+        };
+        let (child, profile) = match &user {
+            Some(lease) => lease.sync_scope(start)?,
+            None => start()?,
+        };
+        Ok(WarmProcess {
+            child,
+            profile,
+            user,
+        })
+    }
+
+    pub fn idle(&self, language: Language) -> usize {
+        self.idle.lock().unwrap().get(&language).map_or(0, Vec::len)
+    }
+}
+
+#[cfg(test)]
+mod warm_tests {
+    use super::*;
+    use crate::infra::source::SourceFile;
+    use std::time::Duration;
+
+    fn pool(language: Language, size: usize) -> &'static WarmPool {
+        Box::leak(Box::new(WarmPool {
+            sizes: HashMap::from([(language, size)]),
+            templates: HashMap::from([(language, ExecContext::default())]),
+            idle: Mutex::new(HashMap::new()),
+        }))
+    }
+
+    #[test]
+    fn test_parse_sizes_accepts_only_warmable_languages() {
+        let sizes: WarmPoolSizes = "python:4, ruby:1, Python:2".parse().unwrap();
+        assert_eq!(sizes.sizes, [(Language::RUBY, 1), (Language::Python, 2)]);
+        assert!("".parse::<WarmPoolSizes>().unwrap().sizes.is_empty());
+        assert!("rust:2".parse::<WarmPoolSizes>().is_err());
+        assert!("python".parse::<WarmPoolSizes>().is_err());
+        assert!("python:many".parse::<WarmPoolSizes>().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_warm_python_runs_program_with_args_env_and_stdin() {
+        let pool = pool(Language::Python, 1);
+        pool.refill(Language::Python);
+        assert_eq!(pool.idle(Language::Python), 1);
+
+        let source = SourceFile::create(
+            Language::Python,
+            "import os, sys\nprint(open(0).read().split(), sys.argv[1:], os.environ['GREETING'])",
+        )
+        .unwrap();
+        let ctx = ExecContext::default()
+            .with_args(vec!["a".into(), "b c".into()])
+            .with_env("GREETING", "hi");
+        let process = pool.checkout(Language::Python, &ctx).unwrap();
+        let output = process
+            .run(source.path(), "first\nrest\n", &ctx)
+            .await
+            .unwrap();
+        assert!(
+            output.status.success(),
+            "{}",
+            String::from_utf8_lossy(&output.stderr)
+        );
+        assert_eq!(
+            String::from_utf8(output.stdout).unwrap(),
+            "['first', 'rest'] ['a', 'b c'] hi\n"
+        );
+
+        tokio::time::sleep(Duration::from_millis(200)).await;
+        assert_eq!(pool.idle(Language::Python), 1);
+    }
+
+    #[tokio::test]
+    async fn test_warm_python_reports_errors_like_a_cold_run() {
+        let pool = pool(Language::Python, 1);
+        pool.refill(Language::Python);
+        let source = SourceFile::create(Language::Python, "raise ValueError('boom')").unwrap();
+        let ctx = ExecContext::default();
+        let process = pool.checkout(Language::Python, &ctx).unwrap();
+        let output = process.run(source.path(), "", &ctx).await.unwrap();
+
+        assert_eq!(output.status.code(), Some(1));
+        let stderr = String::from_utf8(output.stderr).unwrap();
+        assert!(stderr.starts_with("Traceback"), "{}", stderr);
+        assert!(!stderr.contains("runpy"), "{}", stderr);
+        assert!(stderr.ends_with("ValueError: boom\n"), "{}", stderr);
+    }
+
+    #[tokio::test]
+    async fn test_checkout_skips_mismatched_confinement() {
+        let pool = pool(Language::Python, 1);
+        pool.refill(Language::Python);
+        let limited = ExecContext::default().with_disk_quota(1024);
+        assert!(pool.checkout(Language::Python, &limited).is_none());
+        assert!(
+            pool.checkout(Language::RUBY, &ExecContext::default())
+                .is_none()
+        );
+        assert_eq!(pool.idle(Language::Python), 1);
+    }
+
+    #[tokio::test]
+    async fn test_checkout_skips_runs_pinned_to_cores() {
+        let pool = pool(Language::Python, 1);
+        pool.refill(Language::Python);
+        let pinned = ExecContext::default().with_cpus(vec![0]);
+        assert!(pool.checkout(Language::Python, &pinned).is_none());
+        assert_eq!(pool.idle(Language::Python), 1);
+        assert!(
+            pool.checkout(Language::Python, &ExecContext::default())
+                .is_some()
+        );
+    }
+}
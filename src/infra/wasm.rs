@@ -0,0 +1,331 @@
+use std::process::Output;
+
+use base64::{Engine as _, engine::general_purpose::STANDARD};
+use serde::{Deserialize, Serialize};
+use utoipa::ToSchema;
+
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, OutputChunk},
+};
+
+const WASM_MAGIC: &[u8] = b"\0asm";
+
+// Where a submission runs: as a native process, or compiled to WASI and run
+// inside the embedded WebAssembly runtime, where it has no system calls of
+// its own to make.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+#[serde(rename_all = "lowercase")]
+pub enum Backend {
+    #[default]
+    Native,
+    Wasm,
+}
+
+impl Backend {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Backend::Native => "native",
+            Backend::Wasm => "wasm",
+        }
+    }
+
+    // Modules submitted as `wasm` run in the runtime whichever backend is
+    // asked for.
+    pub fn supports(&self, language: Language) -> bool {
+        match self {
+            Backend::Native => true,
+            Backend::Wasm => matches!(language, Language::C | Language::RUST | Language::WASM),
+        }
+    }
+}
+
+// Submitted modules arrive as JSON strings, so binaries are base64-encoded;
+// anything starting with `(` is taken as the text format and left for the
+// runtime to assemble.
+pub fn module_bytes(content: &str) -> Result<Vec<u8>, InfraError> {
+    let content = content.trim();
+    if content.starts_with('(') {
+        return Ok(content.as_bytes().to_vec());
+    }
+    let bytes = STANDARD.decode(content).map_err(|err| {
+        InfraError::CompilationError(format!("module is not valid base64: {}", err).into())
+    })?;
+    if !bytes.starts_with(WASM_MAGIC) {
+        return Err(InfraError::CompilationError(
+            "module is neither WebAssembly text nor a binary module".into(),
+        ));
+    }
+    Ok(bytes)
+}
+
+// Hands buffered output to a context that streams it, once the module has
+// finished, since the runtime only gives it back at the end.
+pub fn forward_output(output: &Output, ctx: &ExecContext) {
+    let Some(sink) = ctx.output() else {
+        return;
+    };
+    let streams = [
+        (
+            &output.stdout,
+            OutputChunk::Stdout as fn(String) -> OutputChunk,
+        ),
+        (&output.stderr, OutputChunk::Stderr),
+    ];
+    for (bytes, chunk) in streams {
+        if !bytes.is_empty() {
+            let _ = sink.send(chunk(String::from_utf8_lossy(bytes).into_owned()));
+        }
+    }
+}
+
+pub async fn compile_wasm(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let module = module_bytes(content)?;
+    let output = run_module(module, stdin_input, ctx).await?;
+    match output.status.code() {
+        Some(0) => Ok(String::from_utf8(output.stdout)?),
+        code => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompilationError(
+                format!(
+                    "WebAssembly module exited with status code: {}\nError: {}",
+                    code.unwrap_or(1),
+                    stderr
+                )
+                .into(),
+            ))
+        }
+    }
+}
+
+pub async fn run_module(
+    module: Vec<u8>,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<Output, InfraError> {
+    let output = execute(module, stdin_input, ctx).await?;
+    forward_output(&output, ctx);
+    Ok(ctx.output_encoding().encode(output))
+}
+
+// The runtime blocks, and keeps running after a timed out request is dropped
+// until its own epoch deadline stops it.
+#[cfg(feature = "wasm")]
+async fn execute(
+    module: Vec<u8>,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<Output, InfraError> {
+    let stdin = stdin_input.as_bytes().to_vec();
+    let ctx = ctx.clone();
+    tokio::task::spawn_blocking(move || runtime::run(&module, stdin, &ctx))
+        .await
+        .map_err(|err| InfraError::CompilationError(err.into()))?
+}
+
+#[cfg(not(feature = "wasm"))]
+async fn execute(
+    _module: Vec<u8>,
+    _stdin_input: &str,
+    _ctx: &ExecContext,
+) -> Result<Output, InfraError> {
+    Err(InfraError::UnsupportedLanguage(String::from(
+        "the wasm backend requires building with the `wasm` feature",
+    )))
+}
+
+#[cfg(feature = "wasm")]
+mod runtime {
+    use std::{
+        os::unix::process::ExitStatusExt,
+        process::{ExitStatus, Output},
+        sync::OnceLock,
+        thread,
+        time::Duration,
+    };
+
+    use wasmtime::{Config, Engine, Linker, Module, Store, StoreLimits, StoreLimitsBuilder, Trap};
+    use wasmtime_wasi::{
+        DirPerms, FilePerms, I32Exit, WasiCtxBuilder,
+        pipe::{MemoryInputPipe, MemoryOutputPipe},
+        preview1::{self, WasiP1Ctx},
+    };
+
+    use super::{ExecContext, InfraError};
+
+    // Deadlines are counted in epochs, advanced by one background thread for
+    // every module the engine runs.
+    const EPOCH_TICK: Duration = Duration::from_millis(10);
+    const MAX_MEMORY_BYTES: usize = 256 << 20;
+    const MAX_OUTPUT_BYTES: usize = 16 << 20;
+
+    struct State {
+        wasi: WasiP1Ctx,
+        limits: StoreLimits,
+    }
+
+    static ENGINE: OnceLock<Engine> = OnceLock::new();
+
+    fn engine() -> &'static Engine {
+        ENGINE.get_or_init(|| {
+            let mut config = Config::new();
+            config.epoch_interruption(true);
+            let engine = Engine::new(&config).unwrap();
+            let ticker = engine.clone();
+            thread::spawn(move || {
+                loop {
+                    thread::sleep(EPOCH_TICK);
+                    ticker.increment_epoch();
+                }
+            });
+            engine
+        })
+    }
+
+    fn runtime_error(err: impl Into<Box<dyn std::error::Error + Send + Sync>>) -> InfraError {
+        InfraError::CompilationError(err.into())
+    }
+
+    pub fn run(module: &[u8], stdin: Vec<u8>, ctx: &ExecContext) -> Result<Output, InfraError> {
+        let engine = engine();
+        let module = Module::new(engine, module).map_err(runtime_error)?;
+
+        let stdout = MemoryOutputPipe::new(MAX_OUTPUT_BYTES);
+        let stderr = MemoryOutputPipe::new(MAX_OUTPUT_BYTES);
+        let mut wasi = WasiCtxBuilder::new();
+        wasi.stdin(MemoryInputPipe::new(stdin))
+            .stdout(stdout.clone())
+            .stderr(stderr.clone())
+            .arg("main.wasm");
+        for arg in ctx.args() {
+            wasi.arg(arg);
+        }
+        for (key, value) in ctx.envs() {
+            wasi.env(key, value);
+        }
+        for (key, value) in ctx.locale_env() {
+            wasi.env(key, value);
+        }
+        // The module sees no files at all unless the request brought a
+        // workspace, which is mounted as its working directory.
+        if let Some(workspace) = ctx.workspace() {
+            wasi.preopened_dir(workspace, ".", DirPerms::all(), FilePerms::all())
+                .map_err(runtime_error)?;
+        }
+        let state = State {
+            wasi: wasi.build_p1(),
+            limits: StoreLimitsBuilder::new()
+                .memory_size(MAX_MEMORY_BYTES)
+                .build(),
+        };
+
+        let mut store = Store::new(engine, state);
+        store.limiter(|state| &mut state.limits);
+        match ctx.timeout() {
+            Some(limit) => {
+                store.set_epoch_deadline((limit.as_millis() / EPOCH_TICK.as_millis()) as u64 + 1)
+            }
+            // Deadlines are relative to the current epoch; leave room for it.
+            None => store.set_epoch_deadline(u64::MAX / 2),
+        }
+
+        let mut linker: Linker<State> = Linker::new(engine);
+        preview1::add_to_linker_sync(&mut linker, |state| &mut state.wasi)
+            .map_err(runtime_error)?;
+        let instance = linker
+            .instantiate(&mut store, &module)
+            .map_err(runtime_error)?;
+        let start = instance
+            .get_typed_func::<(), ()>(&mut store, "_start")
+            .map_err(runtime_error)?;
+
+        let mut trap_message = None;
+        let code = match start.call(&mut store, ()) {
+            Ok(()) => 0,
+            Err(err) => {
+                if let Some(exit) = err.downcast_ref::<I32Exit>() {
+                    exit.0
+                } else if err.downcast_ref::<Trap>() == Some(&Trap::Interrupt) {
+                    return Err(InfraError::timeout(ctx.timeout().unwrap_or_default()));
+                } else {
+                    trap_message = Some(format!("wasm trap: {:?}\n", err));
+                    1
+                }
+            }
+        };
+        drop(store);
+
+        let mut stderr = stderr.contents().to_vec();
+        if let Some(message) = trap_message {
+            stderr.extend_from_slice(message.as_bytes());
+        }
+        Ok(Output {
+            status: ExitStatus::from_raw((code & 0xff) << 8),
+            stdout: stdout.contents().to_vec(),
+            stderr,
+        })
+    }
+}
+
+#[cfg(test)]
+mod wasm_tests {
+    use super::*;
+
+    #[test]
+    fn test_module_bytes_accepts_text_or_base64_binary() {
+        let text = "  (module (func (export \"_start\")))\n";
+        assert_eq!(module_bytes(text).unwrap(), text.trim().as_bytes());
+
+        let binary = STANDARD.encode(b"\0asm\x01\0\0\0");
+        assert_eq!(module_bytes(&binary).unwrap(), b"\0asm\x01\0\0\0");
+
+        assert!(module_bytes("not base64!").is_err());
+        assert!(module_bytes(&STANDARD.encode(b"ELF...")).is_err());
+    }
+
+    #[test]
+    fn test_backend_supports() {
+        assert!(Backend::Native.supports(Language::Python));
+        assert!(Backend::Native.supports(Language::WASM));
+        assert!(Backend::Wasm.supports(Language::RUST));
+        assert!(Backend::Wasm.supports(Language::WASM));
+        assert!(!Backend::Wasm.supports(Language::Python));
+    }
+
+    #[cfg(feature = "wasm")]
+    #[tokio::test]
+    async fn test_runs_wat_module_with_stdout_and_exit_code() {
+        let module = r#"(module
+            (import "wasi_snapshot_preview1" "fd_write"
+                (func $fd_write (param i32 i32 i32 i32) (result i32)))
+            (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+            (memory (export "memory") 1)
+            (data (i32.const 16) "hi\n")
+            (func (export "_start")
+                (i32.store (i32.const 0) (i32.const 16))
+                (i32.store (i32.const 4) (i32.const 3))
+                (drop (call $fd_write (i32.const 1) (i32.const 0) (i32.const 1) (i32.const 8)))
+                (call $exit (i32.const 3))))"#;
+        let output = run_module(module_bytes(module).unwrap(), "", &ExecContext::default())
+            .await
+            .unwrap();
+        assert_eq!(output.stdout, b"hi\n");
+        assert_eq!(output.status.code(), Some(3));
+    }
+
+    #[cfg(feature = "wasm")]
+    #[tokio::test]
+    async fn test_infinite_loop_is_interrupted() {
+        let module = r#"(module (func (export "_start") (loop (br 0))))"#;
+        let ctx = ExecContext::default().with_timeout(std::time::Duration::from_millis(100));
+        let err = run_module(module_bytes(module).unwrap(), "", &ctx)
+            .await
+            .unwrap_err();
+        assert!(matches!(err, InfraError::Timeout(..)));
+    }
+}
@@ -0,0 +1,151 @@
+use std::{
+    collections::BTreeMap,
+    fs::{self, File},
+    io,
+    path::{Path, PathBuf},
+};
+
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use utoipa::ToSchema;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+#[serde(rename_all = "lowercase")]
+pub enum FileChange {
+    Created,
+    Modified,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, ToSchema)]
+pub struct FileEntry {
+    #[schema(example = "results.csv")]
+    pub path: String,
+    pub size: u64,
+    #[schema(example = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")]
+    pub sha256: String,
+    pub change: FileChange,
+    // The file itself, base64-encoded, when `file_contents` is `inline`.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub data: Option<String>,
+    // Where to download the file, when `file_contents` is `link`.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    #[schema(example = "/api/v1/artifacts/9f1c2e7a4b3d4c5e8f6a7b8c9d0e1f2a")]
+    pub url: Option<String>,
+}
+
+#[derive(Debug, Default)]
+pub struct Snapshot {
+    files: BTreeMap<PathBuf, (u64, String)>,
+}
+
+impl Snapshot {
+    pub fn take(root: &Path) -> io::Result<Self> {
+        let mut files = BTreeMap::new();
+        walk(root, root, &mut files)?;
+        Ok(Snapshot { files })
+    }
+
+    pub fn changes_since(&self, before: &Snapshot) -> Vec<FileEntry> {
+        self.files
+            .iter()
+            .filter_map(|(path, (size, sha256))| {
+                let change = match before.files.get(path) {
+                    None => FileChange::Created,
+                    Some((_, previous)) if previous != sha256 => FileChange::Modified,
+                    Some(_) => return None,
+                };
+                Some(FileEntry {
+                    path: path.to_string_lossy().into_owned(),
+                    size: *size,
+                    sha256: sha256.clone(),
+                    change,
+                    data: None,
+                    url: None,
+                })
+            })
+            .collect()
+    }
+}
+
+// Total size of the regular files under `dir`.
+pub fn disk_usage(dir: &Path) -> io::Result<u64> {
+    let mut total = 0;
+    for entry in fs::read_dir(dir)? {
+        let entry = entry?;
+        let file_type = entry.file_type()?;
+        if file_type.is_dir() {
+            total += disk_usage(&entry.path())?;
+        } else if file_type.is_file() {
+            total += entry.metadata()?.len();
+        }
+    }
+    Ok(total)
+}
+
+fn walk(root: &Path, dir: &Path, files: &mut BTreeMap<PathBuf, (u64, String)>) -> io::Result<()> {
+    for entry in fs::read_dir(dir)? {
+        let entry = entry?;
+        let file_type = entry.file_type()?;
+        let path = entry.path();
+        if file_type.is_dir() {
+            walk(root, &path, files)?;
+        } else if file_type.is_file() {
+            let mut hasher = Sha256::new();
+            let size = io::copy(&mut File::open(&path)?, &mut hasher)?;
+            let relative = path.strip_prefix(root).unwrap_or(&path).to_path_buf();
+            files.insert(relative, (size, format!("{:x}", hasher.finalize())));
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod workspace_tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_changes_since_reports_created_and_modified_files() {
+        let dir = TempDir::new().unwrap();
+        fs::write(dir.path().join("input.txt"), "a").unwrap();
+        fs::write(dir.path().join("same.txt"), "b").unwrap();
+        let before = Snapshot::take(dir.path()).unwrap();
+
+        fs::write(dir.path().join("input.txt"), "changed").unwrap();
+        fs::create_dir(dir.path().join("out")).unwrap();
+        fs::write(dir.path().join("out/results.csv"), "").unwrap();
+        let changes = Snapshot::take(dir.path()).unwrap().changes_since(&before);
+
+        assert_eq!(
+            changes,
+            vec![
+                FileEntry {
+                    path: "input.txt".into(),
+                    size: 7,
+                    sha256: format!("{:x}", Sha256::digest(b"changed")),
+                    change: FileChange::Modified,
+                    data: None,
+                    url: None,
+                },
+                FileEntry {
+                    path: "out/results.csv".into(),
+                    size: 0,
+                    sha256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+                        .into(),
+                    change: FileChange::Created,
+                    data: None,
+                    url: None,
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn test_disk_usage_sums_nested_files() {
+        let dir = TempDir::new().unwrap();
+        fs::write(dir.path().join("a.txt"), "12345").unwrap();
+        fs::create_dir_all(dir.path().join("out/deeper")).unwrap();
+        fs::write(dir.path().join("out/deeper/b.bin"), [0u8; 100]).unwrap();
+        assert_eq!(disk_usage(dir.path()).unwrap(), 105);
+    }
+}
@@ -1,36 +1,35 @@
-use super::error::InfraError;
-use std::{io::Write, process::Stdio};
-use tempfile::NamedTempFile;
-use tokio::{io::AsyncWriteExt, process::Command};
-use which::which;
-
-pub async fn compile_zig(content: &str, stdin_input: &str) -> Result<String, InfraError> {
-    let mut temp_file = NamedTempFile::with_suffix(".zig")?;
-    temp_file.write_all(content.as_bytes())?;
-    temp_file.flush()?;
-    let source_path = temp_file.path().to_path_buf();
-
-    let executable_file = NamedTempFile::new()?;
-    drop(executable_file);
-
-    let mut cmd = Command::new(which("zig")?)
-        .arg("run")
-        .arg(&source_path)
-        .stdin(Stdio::piped())
-        .stdout(Stdio::piped())
-        .stderr(Stdio::piped())
-        .spawn()?;
-
-    if let Some(mut stdin) = cmd.stdin.take() {
-        stdin.write_all(stdin_input.as_bytes()).await?;
-        stdin.flush().await?;
-        drop(stdin);
-    }
+use std::path::Path;
+
+use super::{
+    error::InfraError,
+    language::Language,
+    runner::{ExecContext, run_program},
+    source::SourceFile,
+};
 
-    let output = cmd.wait_with_output().await?;
+pub async fn compile_zig(
+    content: &str,
+    stdin_input: &str,
+    ctx: &ExecContext,
+) -> Result<String, InfraError> {
+    let source = SourceFile::create(Language::ZIG, content)?;
+    let source_path = source.path().to_path_buf();
+
+    let mut cmd = ctx.command("zig")?;
+    cmd.arg("run")
+        .arg(&source_path)
+        .arg("--");
+    let output = run_program(&mut cmd, stdin_input, ctx).await?;
 
     match output.status.code() {
         Some(0) => Ok(String::from_utf8(output.stdout)?),
+        Some(_) if rejected_by_compiler(&output.stderr, &source_path) => {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            Err(InfraError::CompileError(format!(
+                "Zig compilation failed:\n{}",
+                stderr
+            )))
+        }
         Some(code) => {
             let stderr = String::from_utf8_lossy(&output.stderr);
             Err(InfraError::CompilationError(
@@ -50,6 +49,17 @@ pub async fn compile_zig(content: &str, stdin_input: &str) -> Result<String, Inf
     }
 }
 
+// `zig run` compiles and runs in one step. Compile errors are reported
+// against the source file as `main.zig:3:5: error: ...`; errors the
+// program returns from `main` are printed as a bare `error: Name`.
+fn rejected_by_compiler(stderr: &[u8], source_path: &Path) -> bool {
+    let source = source_path.to_string_lossy();
+    String::from_utf8_lossy(stderr).lines().any(|line| {
+        line.strip_prefix(source.as_ref())
+            .is_some_and(|rest| rest.contains(": error: "))
+    })
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -66,7 +76,7 @@ pub fn main() !void {
 }
 "#;
 
-        let result = compile_zig(zig_code, "").await;
+        let result = compile_zig(zig_code, "", &ExecContext::default()).await;
         println!("{:?}", result);
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Hello, World!");
@@ -88,7 +98,7 @@ pub fn main() !void {
 }
 "#;
 
-        let result = compile_zig(zig_code, "Hello Zig").await;
+        let result = compile_zig(zig_code, "Hello Zig", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "You entered: Hello Zig");
     }
@@ -110,7 +120,7 @@ pub fn main() !void {
 }
 "#;
 
-        let result = compile_zig(zig_code, "").await;
+        let result = compile_zig(zig_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         let output = result.unwrap();
         assert!(output.contains("Addition: 15"));
@@ -131,8 +141,18 @@ pub fn main() !void {
 }
 "#;
 
-        let result = compile_zig(invalid_zig_code, "").await;
-        assert!(result.is_err());
+        let result = compile_zig(invalid_zig_code, "", &ExecContext::default()).await;
+        assert!(matches!(result, Err(InfraError::CompileError(_))));
+    }
+
+    #[test]
+    fn test_rejected_by_compiler_ignores_errors_returned_by_main() {
+        let source = Path::new("/tmp/run/main.zig");
+        let compile_error = b"/tmp/run/main.zig:6:38: error: use of undeclared identifier 'x'\n";
+        assert!(rejected_by_compiler(compile_error, source));
+
+        let returned = b"error: FileNotFound\n/tmp/run/main.zig:4:5: 0x1034 in main (main)\n";
+        assert!(!rejected_by_compiler(returned, source));
     }
 
     #[tokio::test]
@@ -145,7 +165,7 @@ pub fn main() !void {
 }
 "#;
 
-        let result = compile_zig(zig_code, "").await;
+        let result = compile_zig(zig_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -169,7 +189,7 @@ pub fn main() !void {
 "#;
 
         let input = "First line\nSecond line\nThird line";
-        let result = compile_zig(zig_code, input).await;
+        let result = compile_zig(zig_code, input, &ExecContext::default()).await;
         assert!(result.is_ok());
 
         let output = result.unwrap();
@@ -186,7 +206,7 @@ pub fn main() !void {
 }
 "#;
 
-        let result = compile_zig(zig_code, "").await;
+        let result = compile_zig(zig_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "");
     }
@@ -213,7 +233,7 @@ pub fn main() !void {
 }
 "#;
 
-        let result = compile_zig(zig_code, "").await;
+        let result = compile_zig(zig_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
         assert_eq!(result.unwrap().trim(), "Name: Alice, Age: 30");
     }
@@ -230,7 +250,7 @@ pub fn main() !void {
 }
 "#;
 
-        let result = compile_zig(invalid_zig_code, "").await;
+        let result = compile_zig(invalid_zig_code, "", &ExecContext::default()).await;
         assert!(result.is_err());
     }
 
@@ -249,7 +269,7 @@ pub fn main() !void {
 }
 "#;
 
-        let result = compile_zig(zig_code, "").await;
+        let result = compile_zig(zig_code, "", &ExecContext::default()).await;
         assert!(result.is_ok());
 
         let output = result.unwrap();
@@ -0,0 +1,155 @@
+use std::{
+    fs, io,
+    path::{Path, PathBuf},
+    time::Duration,
+};
+
+use futures_util::future::join_all;
+
+use crate::{
+    config::config,
+    error::ServerError,
+    handlers::playground::playground_embedded,
+    infra::{compile::compile_lang, error::InfraError, language::Language, runner::ExecContext},
+};
+
+pub const DEFAULT_CONFIG: &str = include_str!("../assets/comphub.env");
+const CONFIG_FILE: &str = ".env";
+// Generous, since the first run of some compilers also warms their caches.
+const CHECK_TIMEOUT: Duration = Duration::from_secs(120);
+
+#[derive(Debug, PartialEq, Eq)]
+pub enum ToolchainStatus {
+    Ready,
+    Missing,
+    Broken(String),
+}
+
+// Writes the default config and the directories it refers to into `dir`,
+// leaving an existing config alone unless `force` is set. Returns what was
+// written.
+pub fn scaffold(dir: &Path, force: bool) -> io::Result<Vec<PathBuf>> {
+    let mut written = Vec::new();
+    let config_file = dir.join(CONFIG_FILE);
+    if force || !config_file.exists() {
+        fs::write(&config_file, DEFAULT_CONFIG)?;
+        written.push(config_file);
+    }
+    let plugins = dir.join("plugins");
+    if !plugins.is_dir() {
+        fs::create_dir_all(&plugins)?;
+        written.push(plugins);
+    }
+    Ok(written)
+}
+
+// Runs the language's template program, the way a request would.
+pub async fn check_toolchain(language: Language) -> ToolchainStatus {
+    let ctx = ExecContext::default().with_timeout(CHECK_TIMEOUT);
+    match compile_lang(language.as_str(), language.template(), "", &ctx).await {
+        Ok(_) => ToolchainStatus::Ready,
+        Err(InfraError::CompilerNotFound(_) | InfraError::UnsupportedLanguage(_)) => {
+            ToolchainStatus::Missing
+        }
+        Err(err) => ToolchainStatus::Broken(err.to_string()),
+    }
+}
+
+// `comphub init [--force]`: scaffolds a config in the working directory and
+// reports which languages this host can run.
+pub async fn run(args: &[String]) -> Result<(), ServerError> {
+    let force = args.iter().any(|arg| arg == "--force");
+    for path in scaffold(Path::new("."), force)? {
+        println!("wrote {}", path.display());
+    }
+    // Loads the config just written.
+    let app_config = config().await;
+    println!(
+        "playground: {}",
+        if playground_embedded() {
+            "embedded"
+        } else {
+            "built-in page only, build web/ before the server to embed the full one"
+        }
+    );
+
+    let statuses = join_all(Language::ALL.map(check_toolchain)).await;
+    let mut ready = 0;
+    for (language, status) in Language::ALL.iter().zip(&statuses) {
+        match status {
+            ToolchainStatus::Ready => {
+                ready += 1;
+                println!("  ok       {}", language);
+            }
+            ToolchainStatus::Missing => println!("  missing  {}", language),
+            ToolchainStatus::Broken(err) => {
+                let reason = err.lines().next().unwrap_or_default();
+                println!("  failed   {}: {}", language, reason);
+            }
+        }
+    }
+    println!(
+        "{} of {} languages ready; start the server with `comphub` on port {}",
+        ready,
+        Language::ALL.len(),
+        app_config.server_port()
+    );
+    Ok(())
+}
+
+#[cfg(test)]
+mod init_tests {
+    use super::*;
+
+    #[test]
+    fn test_scaffold_keeps_existing_config_unless_forced() {
+        let dir = tempfile::tempdir().unwrap();
+        let written = scaffold(dir.path(), false).unwrap();
+        assert_eq!(
+            written,
+            [dir.path().join(".env"), dir.path().join("plugins")]
+        );
+        assert_eq!(
+            fs::read_to_string(dir.path().join(".env")).unwrap(),
+            DEFAULT_CONFIG
+        );
+
+        fs::write(dir.path().join(".env"), "PORT=8080\n").unwrap();
+        assert!(scaffold(dir.path(), false).unwrap().is_empty());
+        assert_eq!(
+            fs::read_to_string(dir.path().join(".env")).unwrap(),
+            "PORT=8080\n"
+        );
+
+        assert_eq!(
+            scaffold(dir.path(), true).unwrap(),
+            [dir.path().join(".env")]
+        );
+        assert_eq!(
+            fs::read_to_string(dir.path().join(".env")).unwrap(),
+            DEFAULT_CONFIG
+        );
+    }
+
+    #[test]
+    fn test_default_config_sets_each_key_once() {
+        let mut keys: Vec<_> = DEFAULT_CONFIG
+            .lines()
+            .filter(|line| !line.starts_with('#'))
+            .filter_map(|line| line.split_once('=').map(|(key, _)| key))
+            .collect();
+        let total = keys.len();
+        keys.sort();
+        keys.dedup();
+        assert_eq!(keys.len(), total);
+        assert!(keys.contains(&"PORT"));
+    }
+
+    #[tokio::test]
+    async fn test_check_toolchain_runs_template() {
+        assert_eq!(
+            check_toolchain(Language::Python).await,
+            ToolchainStatus::Ready
+        );
+    }
+}
@@ -1,6 +1,13 @@
 pub mod config;
 pub mod error;
 pub mod routes;
+pub mod server;
 pub mod utils;
 pub mod handlers;
 pub mod infra;
+pub mod init;
+pub mod engine;
+#[cfg(feature = "grpc")]
+pub mod grpc;
+#[cfg(feature = "graphql")]
+pub mod graphql;
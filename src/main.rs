@@ -1,21 +1,100 @@
+use std::env;
 use std::net::SocketAddrV4;
 use comphub::config::config;
 use comphub::error::ServerError;
+use comphub::handlers::recover::log_panics;
+use comphub::infra::artifacts::sweep_artifacts;
+use comphub::infra::calibration::calibration;
+use comphub::infra::crash::init_backtraces;
+use comphub::infra::disk::{init_execution_zone, watch_execution_zone};
+use comphub::infra::fsview::init_filesystem_view;
+use comphub::infra::jobs::start_workers;
+use comphub::infra::load::watch_load;
+use comphub::infra::plugin::load_plugins;
+use comphub::infra::reload::reload_on_hangup;
+use comphub::infra::sandbox::init_sandbox;
+use comphub::infra::session::sweep_sessions;
+use comphub::infra::store::sweep_store;
+use comphub::infra::tenants::export_usage;
+use comphub::infra::tls::load_tls;
+use comphub::infra::warm::start_warm_pool;
+use comphub::init;
 use comphub::routes::app_router;
+use comphub::server::serve;
 use comphub::utils::init_tracing;
 
 #[tokio::main]
 async fn main() -> Result<(), ServerError> {
+    let args: Vec<String> = env::args().skip(1).collect();
+    if args.first().is_some_and(|arg| arg == "init") {
+        return init::run(&args[1..]).await;
+    }
+
     init_tracing();
+    log_panics();
     let app_config = config().await;
 
     let addr = format!("{}:{}", app_config.server_host(), app_config.server_port());
     let socket_addr: SocketAddrV4 = addr.parse()?;
 
-    let app = app_router();
+    init_execution_zone(
+        app_config.execution_zone_dir(),
+        app_config.execution_zone_tmpfs_bytes(),
+    )
+    .map_err(|err| ServerError::InternalServerError(err.into()))?;
+    tokio::spawn(watch_execution_zone(
+        app_config.disk_high_watermark(),
+        app_config.disk_gc_max_age(),
+        app_config.disk_check_interval(),
+    ));
+    if app_config.load_limits().is_enabled() {
+        tokio::spawn(watch_load(app_config.load_limits()));
+    }
+    if !app_config.artifact_ttl().is_zero() {
+        tokio::spawn(sweep_artifacts(
+            app_config.artifact_ttl(),
+            app_config.disk_check_interval(),
+        ));
+    }
+    if !app_config.session_ttl().is_zero() {
+        tokio::spawn(sweep_sessions(app_config.disk_check_interval()));
+    }
+    tokio::spawn(sweep_store(app_config.store_sweep_interval()));
+    if let Some(path) = app_config.usage_export_file() {
+        tokio::spawn(export_usage(
+            path.to_path_buf(),
+            app_config.usage_export_interval(),
+        ));
+    }
+
+    load_tls()
+        .await
+        .map_err(|err| ServerError::InternalServerError(err.into()))?;
+    init_sandbox(app_config.sandbox_users());
+    init_filesystem_view(app_config.filesystem_view().cloned());
+    init_backtraces(app_config.crash_backtraces());
+    load_plugins(app_config.plugins_dir()).await;
+    tokio::spawn(reload_on_hangup());
+    calibration().await;
+    start_warm_pool(app_config.warm_pool_sizes()).await;
+    start_workers().await;
+
+    #[cfg(feature = "grpc")]
+    {
+        let grpc_addr = format!("{}:{}", app_config.server_host(), app_config.grpc_port());
+        let grpc_socket_addr: SocketAddrV4 = grpc_addr.parse()?;
+        tokio::spawn(async move {
+            if let Err(err) = comphub::grpc::serve(grpc_socket_addr.into()).await {
+                tracing::error!("grpc server stopped: {}", err);
+            }
+        });
+    }
+
+    let app = app_router().await;
 
     let listener = tokio::net::TcpListener::bind(socket_addr).await?;
-    tracing::info!("server listening on: {}", socket_addr);
-    axum::serve(listener, app).await?;
+    let scheme = if app_config.tls_files().is_some() { "https" } else { "http" };
+    tracing::info!("server listening on: {}://{}", scheme, socket_addr);
+    serve(listener, app).await?;
     Ok(())
 }
@@ -1,29 +1,179 @@
 use axum::{
     Router,
-    http::{StatusCode, header},
-    response::IntoResponse,
-    routing::{get, post},
+    extract::DefaultBodyLimit,
+    middleware,
+    http::{HeaderName, StatusCode, Uri, header},
+    response::{IntoResponse, Response},
+    routing::{delete, get, post},
 };
 use reqwest::Method;
-use tower_http::cors::{Any, CorsLayer};
+use tower_http::{
+    compression::{
+        CompressionLayer,
+        predicate::{DefaultPredicate, NotForContentType, Predicate},
+    },
+    cors::{Any, CorsLayer},
+    timeout::TimeoutLayer,
+};
 
-use crate::handlers::{compile::compile, health::healthz};
+use crate::{
+    config::config,
+    handlers::{
+        admin::{
+            kill_execution, list_canary_runs, list_executions, list_policy_matches, list_tenants,
+            regrade_submissions, search_audit_log,
+        },
+        archive::compile_archive,
+        blobs::{get_blob, upload_blob},
+        build::{build, get_artifact},
+        calibration::get_calibration,
+        compare::compare,
+        compile::compile,
+        docs::{openapi_json, swagger_ui},
+        estimate::estimate,
+        extract::NDJSON,
+        groups::{get_job_group, submit_job_group},
+        health::healthz,
+        interactive::judge_interactive,
+        jobs::{get_job, job_history, job_logs, rerun_job, submit_job},
+        judge::judge,
+        languages::list_languages,
+        lint::lint,
+        logs::search_logs,
+        matrix::compile_matrix,
+        metrics::metrics,
+        playground::playground_asset,
+        recover::{REQUEST_ID_HEADER, recover_panics},
+        sessions::{close_session, open_session, route_to_owner, run_cell},
+        signature::{KEY_ID_HEADER, SIGNATURE_HEADER, TIMESTAMP_HEADER, require_signature},
+        snippets::{get_snippet, run_snippet, save_snippet},
+        trace::propagate_trace,
+        upload::compile_upload,
+        usage::get_usage,
+        workers::{claim_job, complete_job, register_worker, worker_heartbeat},
+    },
+    infra::{
+        scheduler::{IDEMPOTENCY_HEADER, TENANT_HEADER},
+        trace::TRACEPARENT_HEADER,
+    },
+};
+#[cfg(feature = "graphql")]
+use crate::graphql::{GRAPHQL_PATH, GRAPHQL_WS_PATH, graphiql, graphql, subscriptions};
 
-pub fn app_router() -> Router {
+pub async fn app_router() -> Router {
     let cors = CorsLayer::new()
         .allow_origin(Any)
-        .allow_methods([Method::GET, Method::POST])
-        .allow_headers([header::CONTENT_TYPE]);
+        .allow_methods([Method::GET, Method::POST, Method::DELETE])
+        .allow_headers([
+            header::CONTENT_TYPE,
+            HeaderName::from_static(TENANT_HEADER),
+            HeaderName::from_static(IDEMPOTENCY_HEADER),
+            HeaderName::from_static(REQUEST_ID_HEADER),
+            HeaderName::from_static(KEY_ID_HEADER),
+            HeaderName::from_static(TIMESTAMP_HEADER),
+            HeaderName::from_static(SIGNATURE_HEADER),
+            HeaderName::from_static(TRACEPARENT_HEADER),
+        ])
+        .expose_headers([HeaderName::from_static(REQUEST_ID_HEADER)]);
 
-    Router::new()
-        .route("/api/v1/healthz", get(healthz))
+    let submissions = Router::new()
         .route("/api/v1/compile", post(compile))
+        .route(
+            "/api/v1/compile/archive",
+            post(compile_archive).layer(DefaultBodyLimit::disable()),
+        )
+        .route(
+            "/api/v1/compile/upload",
+            post(compile_upload).layer(DefaultBodyLimit::disable()),
+        )
+        .route("/api/v1/build", post(build))
+        .route(
+            "/api/v1/blobs",
+            post(upload_blob).layer(DefaultBodyLimit::max(config().await.blob_max_file_bytes())),
+        )
+        .route("/api/v1/interactive", post(judge_interactive))
+        .route("/api/v1/matrix", post(compile_matrix))
+        .route("/api/v1/judge", post(judge))
+        .route("/api/v1/compare", post(compare))
+        .route("/api/v1/jobs", post(submit_job))
+        .route("/api/v1/jobs/{id}/rerun", post(rerun_job))
+        .route("/api/v1/job-groups", post(submit_job_group))
+        .route("/api/v1/lint", post(lint))
+        .route("/api/v1/snippets", post(save_snippet))
+        .route("/api/v1/snippets/{id}/run", get(run_snippet))
+        .route("/api/v1/sessions", post(open_session))
+        .route("/api/v1/sessions/{id}/cells", post(run_cell));
+    // Queries are signed along with the mutations that run programs, since
+    // both arrive at the same endpoint.
+    #[cfg(feature = "graphql")]
+    let submissions = submissions.route(GRAPHQL_PATH, post(graphql));
+    let submissions = submissions.route_layer(middleware::from_fn(require_signature));
+
+    let router = Router::new()
+        .route("/api/v1/healthz", get(healthz))
+        .route("/api/v1/calibration", get(get_calibration))
+        .route("/api/v1/languages", get(list_languages))
+        .route("/api/v1/usage", get(get_usage))
+        .route("/api/v1/estimate", post(estimate))
+        .route("/metrics", get(metrics))
+        .merge(submissions)
+        .route("/api/v1/jobs", get(job_history))
+        .route("/api/v1/jobs/{id}", get(get_job))
+        .route("/api/v1/jobs/{id}/logs", get(job_logs))
+        .route("/api/v1/job-groups/{id}", get(get_job_group))
+        .route("/api/v1/snippets/{id}", get(get_snippet))
+        .route("/api/v1/artifacts/{id}", get(get_artifact))
+        .route("/api/v1/blobs/{hash}", get(get_blob))
+        .route("/api/v1/sessions/{id}", delete(close_session))
+        .route("/api/v1/workers", post(register_worker))
+        .route("/api/v1/workers/{id}/heartbeat", post(worker_heartbeat))
+        .route("/api/v1/workers/{id}/claim", post(claim_job))
+        .route("/api/v1/workers/{id}/jobs/{job_id}", post(complete_job))
+        .route("/api/v1/logs", get(search_logs))
+        .route("/admin/executions", get(list_executions))
+        .route("/admin/executions/{id}", delete(kill_execution))
+        .route("/admin/tenants", get(list_tenants))
+        .route("/admin/policy/audit", get(list_policy_matches))
+        .route("/admin/canary", get(list_canary_runs))
+        .route("/admin/audit", get(search_audit_log))
+        .route("/admin/regrades", post(regrade_submissions))
+        .route("/api/v1/openapi.json", get(openapi_json))
+        .route("/api/v1/docs", get(swagger_ui));
+    #[cfg(feature = "graphql")]
+    let router = router
+        .route(GRAPHQL_PATH, get(graphiql))
+        .route_service(GRAPHQL_WS_PATH, subscriptions());
+
+    router
+        .layer(middleware::from_fn(route_to_owner))
+        .layer(DefaultBodyLimit::max(config().await.request_max_bytes()))
+        .layer(TimeoutLayer::new(config().await.http_write_timeout()))
+        .layer(middleware::from_fn(propagate_trace))
+        .layer(middleware::from_fn(recover_panics))
+        .layer(CompressionLayer::new().compress_when(compress_when()))
         .layer(cors)
-        .fallback(handler_404)
+        .fallback(fallback)
+}
+
+// Streamed output has to reach the client as it is written, which a
+// compressor holding it back until its buffer fills would defeat.
+fn compress_when() -> impl Predicate {
+    DefaultPredicate::new().and(NotForContentType::const_new(NDJSON))
+}
+
+pub async fn test_router() -> Router {
+    app_router().await
 }
 
-pub fn test_router() -> Router {
-    app_router()
+// Anything the API does not route may still be a file of the embedded
+// playground.
+async fn fallback(method: Method, uri: Uri) -> Response {
+    if method == Method::GET {
+        if let Some(asset) = playground_asset(uri.path()) {
+            return asset;
+        }
+    }
+    handler_404().await.into_response()
 }
 
 async fn handler_404() -> impl IntoResponse {
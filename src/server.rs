@@ -0,0 +1,215 @@
+// Serves the HTTP API over plain TCP or TLS, speaking HTTP/1.1 and HTTP/2
+// on the same port. axum's own `serve` has no TLS and no connection
+// timeouts, so connections are driven by hyper directly.
+use std::{
+    io,
+    net::SocketAddr,
+    sync::{Arc, Mutex},
+    time::Duration,
+};
+
+use axum::{Router, extract::ConnectInfo};
+use hyper::{Request, body::Incoming, service::service_fn};
+use hyper_util::{
+    rt::{TokioExecutor, TokioIo, TokioTimer},
+    server::conn::auto,
+};
+use tokio::{
+    io::{AsyncRead, AsyncWrite},
+    net::TcpListener,
+    time::{Instant, sleep, sleep_until, timeout},
+};
+use tower::Service;
+
+use crate::{config::config, infra::tls::tls_acceptor};
+
+// How long to back off when accepting fails, usually because the process is
+// out of file descriptors.
+const ACCEPT_BACKOFF: Duration = Duration::from_secs(1);
+
+// Requests in progress on one connection and when the last one ended, to
+// tell an idle keep-alive connection from one waiting on a slow handler.
+struct Activity {
+    state: Mutex<(usize, Instant)>,
+}
+
+impl Activity {
+    fn new() -> Self {
+        Activity {
+            state: Mutex::new((0, Instant::now())),
+        }
+    }
+
+    fn begin(self: &Arc<Self>) -> ActiveRequest {
+        self.state.lock().unwrap().0 += 1;
+        ActiveRequest(self.clone())
+    }
+
+    // Resolves once no request has been in progress for `idle`.
+    async fn idle_for(&self, idle: Duration) {
+        loop {
+            let (in_flight, last) = *self.state.lock().unwrap();
+            if in_flight == 0 && last.elapsed() >= idle {
+                return;
+            }
+            if in_flight == 0 {
+                sleep_until(last + idle).await;
+            } else {
+                sleep(idle).await;
+            }
+        }
+    }
+}
+
+struct ActiveRequest(Arc<Activity>);
+
+impl Drop for ActiveRequest {
+    fn drop(&mut self) {
+        let mut state = self.0.state.lock().unwrap();
+        state.0 -= 1;
+        state.1 = Instant::now();
+    }
+}
+
+pub async fn serve(listener: TcpListener, app: Router) -> io::Result<()> {
+    let app_config = config().await;
+    let read_timeout = app_config.http_read_timeout();
+    let idle_timeout = app_config.http_idle_timeout();
+
+    let mut builder = auto::Builder::new(TokioExecutor::new());
+    builder
+        .http1()
+        .timer(TokioTimer::new())
+        .header_read_timeout(read_timeout);
+    builder.http2().timer(TokioTimer::new());
+    let builder = Arc::new(builder);
+
+    loop {
+        let (stream, remote_addr) = match listener.accept().await {
+            Ok(accepted) => accepted,
+            Err(err) => {
+                tracing::error!("failed to accept a connection: {}", err);
+                sleep(ACCEPT_BACKOFF).await;
+                continue;
+            }
+        };
+        let builder = builder.clone();
+        let app = app.clone();
+        tokio::spawn(async move {
+            let Some(acceptor) = tls_acceptor() else {
+                return serve_connection(&builder, stream, app, remote_addr, idle_timeout).await;
+            };
+            match timeout(read_timeout, acceptor.accept(stream)).await {
+                Ok(Ok(stream)) => {
+                    serve_connection(&builder, stream, app, remote_addr, idle_timeout).await
+                }
+                Ok(Err(err)) => {
+                    tracing::debug!("TLS handshake with {} failed: {}", remote_addr, err)
+                }
+                Err(_) => tracing::debug!("TLS handshake with {} timed out", remote_addr),
+            }
+        });
+    }
+}
+
+async fn serve_connection<S>(
+    builder: &auto::Builder<TokioExecutor>,
+    stream: S,
+    app: Router,
+    remote_addr: SocketAddr,
+    idle_timeout: Duration,
+) where
+    S: AsyncRead + AsyncWrite + Unpin + Send + 'static,
+{
+    let activity = Arc::new(Activity::new());
+    let tracked = activity.clone();
+    let service = service_fn(move |mut request: Request<Incoming>| {
+        request.extensions_mut().insert(ConnectInfo(remote_addr));
+        let active = tracked.begin();
+        let response = app.clone().call(request);
+        async move {
+            let response = response.await;
+            drop(active);
+            response
+        }
+    });
+
+    let connection = builder.serve_connection(TokioIo::new(stream), service);
+    tokio::pin!(connection);
+    let mut closing = false;
+    loop {
+        tokio::select! {
+            result = connection.as_mut() => {
+                if let Err(err) = result {
+                    tracing::debug!("connection from {} ended: {}", remote_addr, err);
+                }
+                return;
+            }
+            _ = activity.idle_for(idle_timeout), if !closing => {
+                connection.as_mut().graceful_shutdown();
+                closing = true;
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod server_tests {
+    use super::*;
+    use axum::routing::get;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio_rustls::{
+        TlsConnector,
+        rustls::{
+            ClientConfig, RootCertStore,
+            crypto::ring,
+            pki_types::{CertificateDer, ServerName, pem::PemObject},
+        },
+    };
+
+    use crate::infra::tls::tls_tests::{CERT, use_test_certificate};
+
+    fn connector(alpn: &[&[u8]]) -> TlsConnector {
+        let mut roots = RootCertStore::empty();
+        roots
+            .add(CertificateDer::from_pem_slice(CERT.as_bytes()).unwrap())
+            .unwrap();
+        let mut client = ClientConfig::builder_with_provider(Arc::new(ring::default_provider()))
+            .with_safe_default_protocol_versions()
+            .unwrap()
+            .with_root_certificates(roots)
+            .with_no_client_auth();
+        client.alpn_protocols = alpn.iter().map(|protocol| protocol.to_vec()).collect();
+        TlsConnector::from(Arc::new(client))
+    }
+
+    #[tokio::test]
+    async fn test_serves_http1_and_negotiates_http2_over_tls() {
+        use_test_certificate();
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        let app = Router::new().route("/", get(|| async { "ok" }));
+        tokio::spawn(serve(listener, app));
+        let name = ServerName::try_from("localhost").unwrap();
+
+        let stream = tokio::net::TcpStream::connect(addr).await.unwrap();
+        let h2 = connector(&[b"h2", b"http/1.1"])
+            .connect(name.clone(), stream)
+            .await
+            .unwrap();
+        assert_eq!(h2.get_ref().1.alpn_protocol(), Some(&b"h2"[..]));
+
+        let stream = tokio::net::TcpStream::connect(addr).await.unwrap();
+        let mut http1 = connector(&[b"http/1.1"])
+            .connect(name, stream)
+            .await
+            .unwrap();
+        http1
+            .write_all(b"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+            .await
+            .unwrap();
+        let mut response = String::new();
+        http1.read_to_string(&mut response).await.unwrap();
+        assert!(response.starts_with("HTTP/1.1 200"), "{}", response);
+    }
+}
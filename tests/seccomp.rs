@@ -0,0 +1,64 @@
+#[cfg(test)]
+mod seccomp_test {
+    use std::path::PathBuf;
+
+    use comphub::infra::{
+        error::InfraError,
+        runner::{ExecContext, run_program},
+        seccomp::SyscallProfile,
+    };
+    use tokio::process::Command;
+
+    fn confined(profile: SyscallProfile) -> ExecContext {
+        ExecContext::default().with_syscall_profile(
+            PathBuf::from(env!("CARGO_BIN_EXE_comphub-launcher")),
+            profile,
+        )
+    }
+
+    // The interpreter itself rather than whatever wrapper is first on PATH,
+    // since a wrapper script would need to exec.
+    fn python(script: &str) -> Command {
+        let executable = std::process::Command::new("python3")
+            .arg("-c")
+            .arg("import sys; print(sys.executable)")
+            .output()
+            .unwrap()
+            .stdout;
+        let mut cmd = Command::new(String::from_utf8(executable).unwrap().trim());
+        cmd.arg("-c").arg(script);
+        cmd
+    }
+
+    #[tokio::test]
+    async fn test_strict_profile_runs_self_contained_programs() {
+        let ctx = confined(SyscallProfile::Strict).with_args(vec!["arg".into()]);
+        let mut cmd = python("import sys; print(input(), sys.argv[1])");
+        let output = run_program(&mut cmd, "hello\n", &ctx).await.unwrap();
+        assert!(output.status.success());
+        assert_eq!(output.stdout, b"hello arg\n");
+    }
+
+    #[tokio::test]
+    async fn test_strict_profile_blocks_sockets_and_exec() {
+        let ctx = confined(SyscallProfile::Strict);
+
+        let mut cmd = python("import socket; socket.socket()");
+        let err = run_program(&mut cmd, "", &ctx).await.unwrap_err();
+        assert!(matches!(err, InfraError::BlockedSyscall(_)), "{}", err);
+
+        let mut cmd = python("import os; os.execv('/bin/true', ['true'])");
+        let err = run_program(&mut cmd, "", &ctx).await.unwrap_err();
+        assert!(matches!(err, InfraError::BlockedSyscall(_)), "{}", err);
+    }
+
+    #[tokio::test]
+    async fn test_default_profile_allows_starting_programs() {
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c").arg("echo $(echo nested)");
+        let output = run_program(&mut cmd, "", &confined(SyscallProfile::Default))
+            .await
+            .unwrap();
+        assert_eq!(output.stdout, b"nested\n");
+    }
+}
@@ -7,7 +7,7 @@ static TEST_SERVICE: OnceCell<IntoMakeService<Router>> = OnceCell::const_new();
 
 async fn get_test_service() -> &'static IntoMakeService<Router> {
     TEST_SERVICE
-        .get_or_init(|| async { app_router().into_make_service() })
+        .get_or_init(|| async { app_router().await.into_make_service() })
         .await
 }
 
@@ -1,8 +1,14 @@
 import { useEffect, useRef, useState } from 'react';
 import { Editor } from './components/Editor';
+import { Images, type ImageAttachment } from './components/Images';
 import { type Extension } from '@codemirror/state';
 import { loadLanguage } from '@uiw/codemirror-extensions-langs';
 import axios from "axios";
+import { signRequest } from './signing';
+
+// Builds embedded in the server set this to "" so the playground talks to
+// the instance that serves it.
+const API_BASE = import.meta.env.VITE_API_BASE ?? "https://run.quantinium.dev";
 
 type state = {
     value: string
@@ -12,6 +18,18 @@ type state = {
 }
 
 const States: state[] = [
+    {
+        value: 'assembly',
+        language: 'assembly',
+        content: 'section .data\n    msg db "Hello, World!", 10\n    len equ $ - msg\n\nsection .text\n    global _start\n\n_start:\n    mov rax, 1\n    mov rdi, 1\n    mov rsi, msg\n    mov rdx, len\n    syscall\n\n    mov rax, 60\n    xor rdi, rdi\n    syscall',
+        extension: [loadLanguage('gas')!]
+    },
+    {
+        value: 'bash',
+        language: 'shell',
+        content: 'echo "Hello, World!"',
+        extension: [loadLanguage('shell')!]
+    },
     {
         value: 'brainfuck',
         language: 'brainfuck',
@@ -48,6 +66,18 @@ const States: state[] = [
         content: "void main() {\n  print('Hello, World!');\n}",
         extension: [loadLanguage('dart')!]
     },
+    {
+        value: 'elixir',
+        language: 'elixir',
+        content: 'IO.puts("Hello, World!")',
+        extension: [loadLanguage('ruby')!]
+    },
+    {
+        value: 'fortran',
+        language: 'fortran',
+        content: 'program main\n    print *, "Hello, World!"\nend program main',
+        extension: [loadLanguage('fortran')!]
+    },
     {
         value: 'go',
         language: 'go',
@@ -90,12 +120,24 @@ const States: state[] = [
         content: '"hello world"',
         extension: [loadLanguage('nix')!]
     },
+    {
+        value: 'ocaml',
+        language: 'ocaml',
+        content: 'let () = print_endline "Hello, World!"',
+        extension: [loadLanguage('oCaml')!]
+    },
     {
         value: 'perl',
         language: 'perl',
         content: 'print "Hello, World!\\n";',
         extension: [loadLanguage('perl')!]
     },
+    {
+        value: 'php',
+        language: 'php',
+        content: '<?php\necho "Hello, World!\\n";',
+        extension: [loadLanguage('php')!]
+    },
     {
         value: 'python',
         language: 'python',
@@ -120,6 +162,24 @@ const States: state[] = [
         content: 'object Main {\n  def main(args: Array[String]): Unit = {\n    println("Hello, World!")\n  }\n}',
         extension: [loadLanguage('scala')!]
     },
+    {
+        value: 'sql',
+        language: 'sql',
+        content: "SELECT 'Hello, World!' AS greeting;",
+        extension: [loadLanguage('sql')!]
+    },
+    {
+        value: 'starlark',
+        language: 'python',
+        content: 'print("Hello, World!")',
+        extension: [loadLanguage('python')!]
+    },
+    {
+        value: 'swift',
+        language: 'swift',
+        content: 'print("Hello, World!")',
+        extension: [loadLanguage('swift')!]
+    },
     {
         value: 'typescript',
         language: 'typescript',
@@ -142,6 +202,7 @@ function App() {
         extension: [loadLanguage("brainfuck")!],
     })
     const [result, setResult] = useState("");
+    const [images, setImages] = useState<ImageAttachment[]>([]);
     const [stdin, setStdin] = useState("");
 
     const [leftWidth, setLeftWidth] = useState(50);
@@ -187,18 +248,24 @@ function App() {
         }
     }
 
-    const compileCode = () => {
-        axios.post("https://run.quantinium.dev/api/v1/compile", {
+    const compileCode = async () => {
+        const url = `${API_BASE}/api/v1/compile`;
+        const body = JSON.stringify({
             lang: editorState.language,
             content: editorState.content,
-            stdin: stdin
-        }).then((res) => {
+            stdin: stdin,
+            collect_images: true
+        });
+        const headers = await signRequest("POST", url, body);
+        axios.post(url, body, { headers }).then((res) => {
             setResult(res.data.result);
+            setImages(res.data.images ?? []);
             if (isMobile) {
                 setShowEditor(false);
             }
         }).catch((err) => {
             setResult("Error: " + err.message);
+            setImages([]);
             if (isMobile) {
                 setShowEditor(false);
             }
@@ -349,6 +416,7 @@ function App() {
                                         extension={[loadLanguage('shell')!]}
                                     />
                                 </div>
+                                <Images images={images} />
                             </div>
                         </div>
                     </>
@@ -437,6 +505,7 @@ function App() {
                                             extension={[loadLanguage('shell')!]}
                                         />
                                     </div>
+                                    <Images images={images} />
                                 </div>
                             </div>
                         )}
@@ -0,0 +1,25 @@
+export type ImageAttachment = {
+    path: string;
+    media_type: string;
+    size: number;
+    data: string;
+}
+
+export const Images = ({ images }: { images: ImageAttachment[] }) => {
+    if (images.length === 0) {
+        return null;
+    }
+    return (
+        <div className="flex gap-2 overflow-x-auto bg-zinc-900 p-2 border-t border-gray-700 flex-shrink-0">
+            {images.map((image) => (
+                <img
+                    key={image.path}
+                    src={`data:${image.media_type};base64,${image.data}`}
+                    alt={image.path}
+                    title={image.path}
+                    className="max-h-64 bg-white rounded"
+                />
+            ))}
+        </div>
+    );
+};